@@ -31,12 +31,12 @@
 package main
 
 import (
-	"bufio"
-	"database/sql"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
@@ -45,12 +45,11 @@ import (
 	"time"
 
 	"github.com/fizban-of-ragnarok/go-gma-server/mapservice"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 func eventMonitor(sig_chan chan os.Signal, stop_chan chan int,
 	ms *mapservice.MapService, saveInterval int) {
+	defer ms.ReportCrash()
 
 	report_interval := 1
 	var save_signal *time.Ticker
@@ -63,8 +62,9 @@ func eventMonitor(sig_chan chan os.Signal, stop_chan chan int,
 		save_signal = time.NewTicker(time.Duration(saveInterval) * time.Minute)
 	}
 	ping_signal := time.NewTicker(1 * time.Minute)
+	metrics_signal := time.NewTicker(mapservice.MetricsInterval)
 
-	if ms.Database == nil {
+	if ms.Storage == nil {
 		log.Printf("No database open; periodic saves DISABLED")
 		save_signal.Stop()
 	}
@@ -91,7 +91,7 @@ func eventMonitor(sig_chan chan os.Signal, stop_chan chan int,
 				// by terminating all client connections immediately.
 				log.Printf("EMERGENCY SHUTDOWN INITIATED")
 				ms.AcceptIncoming = false
-				for i, client := range ms.Clients {
+				for i, client := range ms.Clients.All() {
 					log.Printf("Terminating client %v from %s", i, client.ClientAddr)
 					client.Connection.Close()
 				}
@@ -101,14 +101,18 @@ func eventMonitor(sig_chan chan os.Signal, stop_chan chan int,
 		case t := <-save_signal.C:
 			// suppress messages and unnecessary saves
 			// if we're idling
-			if ms.SaveNeeded || report_interval <= 1 {
+			if ms.State.NeedsSave() || report_interval <= 1 {
 				log.Printf("***SAVE*** due to timer %v", t)
 				if err := ms.SaveState(); err != nil {
 					log.Printf("Error saving game state: %v", err)
 				}
 			}
 
+		case t := <-metrics_signal.C:
+			ms.SampleMetrics(t)
+
 		case <-ping_signal.C:
+			ms.AuditGoroutines()
 			any_connections := ms.PingAll()
 			if any_connections {
 				if report_interval > 1 {
@@ -139,13 +143,74 @@ func main() {
 	GMAVersionNumber = "4.2.2" // @@##@@
 	GMAMapperProtocol = "332"  // @@##@@
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check-config":
+			os.Exit(checkConfig(os.Args[2:]))
+		case "dice-selftest":
+			os.Exit(diceSelfTest(os.Args[2:]))
+		case "import":
+			os.Exit(importMap(os.Args[2:]))
+		}
+	}
+
 	passfile := flag.String("password-file", "", "get passwords from the designated file")
 	port := flag.Int("port", 2323, "TCP port of map service")
 	logfile := flag.String("log-file", "", "log connections and other info to this file")
+	logBufferLines := flag.Int("log-buffer", mapservice.DefaultLogBufferLines, "keep this many recent log lines for the HTTP API (0 to not keep them)")
+	debugTopics := flag.String("debug", "", "comma-separated list of debugging topics to log, each as topic[=log|buffer|file]")
 	initfile := flag.String("init-file", "", "initial commands to send all clients upon connection")
+	noAnnounce := flag.Bool("no-announce", false, "don't advertise the server on the local network by multicast DNS")
+	joinHost := flag.String("join-host", "", "host[:port] to give players in join links (default: this machine's LAN address)")
+	httpPort := flag.Int("http-port", 0, "TCP port for the HTTP API (0 to not offer it)")
+	corsOrigins := flag.String("cors-origins", "", "comma-separated list of web sites (scheme://host[:port], or * for any) whose pages may use the HTTP API")
+	campaign := flag.String("campaign", "", "name of the campaign (substituted for {{.Campaign}} in the init file)")
+	nextSession := flag.String("next-session", "", "when the next game session is, for the status page")
+	slowHandler := flag.Duration("slow-handler", mapservice.DefaultSlowHandlerThreshold, "log a warning whenever handling a client's message takes this long (<0 to never warn)")
+	persistMetrics := flag.Bool("persist-metrics", false, "keep the server metrics history in the database across restarts")
+	notifyWebhooks := flag.Bool("notify-webhooks", false, "let players be notified through webhooks when messaged while offline")
+	notifyAllow := flag.String("notify-allow", "", "comma-separated list of private networks (CIDR) players' webhooks may send to")
+	mqttBroker := flag.String("mqtt", "", "publish game events to this MQTT broker (mqtt://[user[:password]@]host[:port][/prefix])")
+	mqttEvents := flag.String("mqtt-events", strings.Join(mapservice.PublishableEvents, ","), "comma-separated list of game events to publish to the MQTT broker")
+	bandwidthWarning := flag.Uint64("bandwidth-warning", 0, "warn users whose network traffic passes each multiple of this many bytes (0 to not warn)")
 	saveint := flag.Int("save-interval", 10, "frequency at which to save game state")
 	sqlitedb := flag.String("sqlite", "", "use the named sqlite3 database for persistent storage")
 	mysqldb := flag.String("mysql", "", "use the named mysql database for persistent storage")
+	maxMessage := flag.Int("max-message-size", mapservice.DefaultMaxMessageSize, "longest message (in bytes) accepted from a client")
+	maxUpload := flag.Int("max-upload-size", mapservice.DefaultMaxFrameSize, "largest binary image upload (in bytes) accepted from a client")
+	dedupWindow := flag.Duration("dedup-window", mapservice.DefaultDedupWindow, "drop relayed messages a client repeats within this long (<0 to relay them all)")
+	maxClientMemory := flag.Int64("max-client-memory", mapservice.DefaultClientMemoryLimit, "most data (in bytes) held on behalf of any one client (<0 for no limit)")
+	replayBuffer := flag.Int("replay-buffer", mapservice.DefaultReplayBuffer, "most numbered lines kept to resend to each client which asks (<0 to keep none)")
+	maxPermutations := flag.Int("max-roll-permutations", mapservice.DefaultMaxPermutations, "most permutations a die-roll spec may expand to")
+	maxRolls := flag.Int("max-rolls", mapservice.DefaultMaxRolls, "most dice rolls a single die-roll spec may make")
+	rollsPerMinute := flag.Int("rolls-per-minute", 0, "most die rolls each user may make per minute (0 for no limit)")
+	auditFile := flag.String("audit-log", "", "append a record of privileged GM actions to this file")
+	journalFile := flag.String("journal", "", "record each change to the game state in this file, to recover them after a crash")
+	journalLimit := flag.Int64("journal-limit", mapservice.DefaultJournalLimit, "save the game state whenever the journal grows past this many bytes (0 for no limit)")
+	standbyOf := flag.String("standby-of", "", "run as a standby, mirroring the game state of the server whose HTTP API is at this URL")
+	standbyTokenFile := flag.String("standby-token-file", "", "read the API token for mirroring the primary server from this file")
+	failoverAfter := flag.Duration("failover-after", 0, "as a standby, take over when the primary has been unreachable this long (0 to wait to be promoted)")
+	enforceTurns := flag.String("enforce-turns", "off", "in combat, hold or reject players' moves and rolls made out of turn (off, hold, or reject)")
+	gmConflictWindow := flag.Duration("gm-conflict-window", mapservice.DefaultGMConflictWindow, "warn GMs who change the same thing within this long of each other (0 to never)")
+	gmLayers := flag.String("gm-layers", strings.Join(mapservice.DefaultGMLayers, ","), "comma-separated list of map layers only the GM may see or change")
+	wallLayers := flag.String("wall-layers", strings.Join(mapservice.DefaultWallLayers, ","), "comma-separated list of map layers whose elements block line of sight")
+	maxDrawn := flag.Int("max-drawn-elements", mapservice.DefaultMaxDrawnElements, "most map elements each player may draw (-1 for no limit)")
+	maxDrawnPoints := flag.Int("max-drawn-points", mapservice.DefaultMaxDrawnPoints, "most points in all of each player's map elements (-1 for no limit)")
+	maxElementPoints := flag.Int("max-element-points", mapservice.DefaultMaxElementPoints, "most points in any one map element drawn by a player (-1 for no limit)")
+	mapExportDir := flag.String("map-export-dir", "", "let the GM save the map as .map files in this directory")
+	markRetention := flag.Duration("mark-retention", 0, "keep map markers this long for clients which connect late, then expire them (0 to not keep them)")
+	diceSeed := flag.Int64("dice-seed", 0, "demo mode: seed each client's dice with this value so rolls are repeatable")
+	crashFile := flag.String("crash-file", "", "write a report to this file if the server crashes (default is a new file in the temp directory)")
+	crashWebhook := flag.String("crash-webhook", "", "POST a report to this URL if the server crashes")
+	alertWebhook := flag.String("alert-webhook", "", "POST an alert to this URL when security events such as failed logins pile up")
+	afkAfter := flag.Duration("afk-after", mapservice.DefaultAFKAfter, "take users to be away from the keyboard after this long doing nothing (0 to never)")
+	alertThreshold := flag.Int("alert-threshold", mapservice.DefaultSecurityAlertThreshold, "raise the alarm after this many security events of one kind within the alert window")
+	alertWindow := flag.Duration("alert-window", mapservice.DefaultSecurityAlertWindow, "span of time over which security events are counted for alerts")
+	reportSharedLogins := flag.Bool("report-shared-logins", false, "tell the GM when a user logs in while already connected elsewhere")
+	playerPolls := flag.Bool("player-polls", false, "let players open polls, not just the GM")
+	readTimeout := flag.Duration("read-timeout", mapservice.DefaultReadTimeout, "drop clients which send nothing for this long (0 for no limit)")
+	transferTimeout := flag.Duration("transfer-timeout", mapservice.DefaultTransferTimeout, "abandon multi-part messages from clients which stall for this long (<0 for no limit)")
+	writeTimeout := flag.Duration("write-timeout", mapservice.DefaultWriteTimeout, "drop clients which don't accept data for this long (0 for no limit)")
 	flag.Parse()
 
 	if *logfile != "" {
@@ -157,6 +222,21 @@ func main() {
 		log.SetOutput(lf)
 		defer lf.Close()
 	}
+	var logBuffer *mapservice.LogBuffer
+	if *logBufferLines > 0 {
+		logBuffer = mapservice.NewLogBuffer(*logBufferLines)
+		log.SetOutput(io.MultiWriter(log.Writer(), logBuffer))
+	}
+	if *debugTopics != "" {
+		debugFiles, err := mapservice.SetDebugSinks(*debugTopics)
+		if err != nil {
+			log.Fatalf("Invalid --debug value: %v", err)
+			os.Exit(1)
+		}
+		for _, f := range debugFiles {
+			defer f.Close()
+		}
+	}
 
 	if GMAMapperProtocol != mapservice.PROTOCOL_VERSION {
 		log.Printf("WARNING! This server implements service protocol version %s but %s is the current protocol for the GMA tool suite!\n",
@@ -178,85 +258,105 @@ func main() {
 	log.Printf("GMA Map Service (golang), version %s\n", GMAVersionNumber)
 
 	// open database
-	var sqldb *sql.DB
+	var storage mapservice.StorageBackend
 	if *sqlitedb != "" {
 		if *mysqldb != "" {
 			log.Fatalf("You can't specify --sqlite and --mysql at the same time.")
 			os.Exit(1)
 		}
-		if _, err = os.Stat(*sqlitedb); os.IsNotExist(err) {
-			// database doesn't exist yet; create a new one
-
-			sqldb, err = sql.Open("sqlite3", "file:"+*sqlitedb)
-			log.Printf("No existing sqlite3 database \"%s\" found--creating a new one.", *sqlitedb)
-			if err != nil {
-				log.Fatalf("Unable to create sqlite3 database %s: %v", *sqlitedb, err)
-				os.Exit(2)
-			}
-			_, err = sqldb.Exec(`
-				create table users (
-					userid integer primary key,
-					username text not null
-				);
-				create table dicepresets (
-					presetid    integer primary key,
-					userid      integer not null,
-					name        text    not null,
-					description text    not null,
-					rollspec    text    not null,
-						foreign key (userid)
-							references users (userid) 
-							on delete cascade
-				);
-				create table events (
-					eventid integer primary key,
-					rawdata  text    not null,
-					sequence integer not null,
-					key      text    not null,
-					class    text    not null,
-					objid    text    not null
-				);
-				create table extradata (
-					extraid integer primary key,
-					eventid integer not null,
-					datarow text    not null,
-						foreign key (eventid)
-							references events (eventid)
-							on delete cascade
-				);
-				create table chats (
-					rawdata text    not null,
-					msgid   text    not null
-				);
-				create table images (
-					name    text    not null,
-					zoom    text    not null,
-					location text   not null
-				);
-				create table idbyname (
-					name    text    not null,
-					objid	text    not null
-				);
-				create table classbyid (
-					objid   text    not null,
-					class   text    not null
-				);`)
-			if err != nil {
-				log.Printf("Unable to create sqlite3 database %s contents: %v", *sqlitedb, err)
-				log.Fatalf("WARNING! %s may be in a corrupt state--fix or delete before running the server!", *sqlitedb)
-				os.Exit(2)
-			}
-		} else {
-			sqldb, err = sql.Open("sqlite3", "file:"+*sqlitedb)
+		storage, err = mapservice.OpenStorageBackend("sqlite", *sqlitedb)
+		if err != nil {
+			log.Fatalf("Unable to open sqlite3 database: %v", err)
+			os.Exit(2)
 		}
-		defer sqldb.Close()
+		defer storage.Close()
 	} else if *mysqldb != "" {
 		log.Fatalf("--mysql not yet implemented.")
 		os.Exit(1)
 	} else {
 		log.Printf("WARNING: No database back-end specified. No persistent data storage will be used!")
 		log.Printf("(Avoid this by specifying the --sqlite=<filename> option)")
-		sqldb = nil
+	}
+
+	turnEnforcement, err := mapservice.CheckTurnEnforcement(*enforceTurns)
+	if err != nil {
+		log.Fatalf("Invalid --enforce-turns value: %v", err)
+		os.Exit(1)
+	}
+	if *alertWebhook != "" {
+		if err = mapservice.CheckNotifyURL(*alertWebhook); err != nil {
+			log.Fatalf("Invalid --alert-webhook value: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *crashWebhook != "" {
+		if err = mapservice.CheckNotifyURL(*crashWebhook); err != nil {
+			log.Fatalf("Invalid --crash-webhook value: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	var notifyAllowed []*net.IPNet
+	if *notifyAllow != "" {
+		if notifyAllowed, err = mapservice.ParseNetworks(*notifyAllow); err != nil {
+			log.Fatalf("Invalid --notify-allow value: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	var allowedOrigins []string
+	if *corsOrigins != "" {
+		allowedOrigins = strings.Split(*corsOrigins, ",")
+	}
+
+	var eventBus *mapservice.MQTTPublisher
+	if *mqttBroker != "" {
+		var events []string
+		if *mqttEvents != "" {
+			events = strings.Split(*mqttEvents, ",")
+		}
+		eventBus, err = mapservice.NewMQTTPublisher(*mqttBroker, events)
+		if err != nil {
+			log.Fatalf("Invalid --mqtt settings: %v", err)
+			os.Exit(1)
+		}
+		eventBus.Start()
+		defer eventBus.Close()
+	}
+
+	gmOnlyLayers := []string{}
+	if *gmLayers != "" {
+		gmOnlyLayers = strings.Split(*gmLayers, ",")
+	}
+	wallOnlyLayers := []string{}
+	if *wallLayers != "" {
+		wallOnlyLayers = strings.Split(*wallLayers, ",")
+	}
+
+	// open audit log
+	var auditLog *mapservice.AuditLog
+	if *auditFile != "" {
+		auditLog, err = mapservice.OpenAuditLog(*auditFile)
+		if err != nil {
+			log.Fatalf("Unable to open audit log \"%s\": %v", *auditFile, err)
+			os.Exit(2)
+		}
+		defer auditLog.Close()
+	}
+
+	// open the journal
+	var journal *mapservice.Journal
+	if *journalFile != "" {
+		if storage == nil {
+			log.Fatalf("The --journal option needs a database to save the game state in.")
+			os.Exit(1)
+		}
+		journal, err = mapservice.OpenJournal(*journalFile)
+		if err != nil {
+			log.Fatalf("Unable to open journal \"%s\": %v", *journalFile, err)
+			os.Exit(2)
+		}
+		defer journal.Close()
 	}
 
 	// set up authentication
@@ -266,44 +366,50 @@ func main() {
 
 	if *passfile != "" {
 		// The password file contains the group password
-		// and (optionally) gm password. Other personal
-		// ones are stored in the database (if they are used)
-		fp, err := os.Open(*passfile)
+		// and (optionally) gm password, followed by any
+		// personal passwords for individual players.
+		passwords, err := mapservice.ReadPasswordFile(*passfile)
 		if err != nil {
-			log.Fatalf("Unable to open password file \"%s\": %v", *passfile, err)
+			log.Fatalf("Unable to read password file \"%s\": %v", *passfile, err)
 			os.Exit(2)
 		}
-		scanner := bufio.NewScanner(fp)
-		if scanner.Scan() {
-			groupPassword = []byte(scanner.Text())
-			if scanner.Scan() {
-				gmPassword = []byte(scanner.Text())
-				//
-				// continue reading personal passwords if any
-				//
-				line := 3
-				for scanner.Scan() {
-					personal_password := strings.SplitN(scanner.Text(), ":", 2)
-					if len(personal_password) != 2 {
-						log.Printf("Warning: Rejecting personal password setting on line %d (missing ':' delimiter)", line)
-					} else {
-						log.Printf("Set personal password for %s", personal_password[0])
-						personalPasswords[personal_password[0]] = []byte(personal_password[1])
-					}
-				}
-			}
+		for _, problem := range passwords.Problems {
+			log.Printf("Warning: %s", problem)
+		}
+		groupPassword = passwords.GroupPassword
+		gmPassword = passwords.GmPassword
+		for user, password := range passwords.PersonalPasswords {
+			log.Printf("Set personal password for %s", user)
+			personalPasswords[user] = password
 		}
-		fp.Close()
 	}
 
-	// start listening to incoming port
-	incoming, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
-	if err != nil {
-		log.Fatalf("Unable to open incoming TCP port %d: %v", *port, err)
-		os.Exit(2)
+	// a standby needs to be able to reach the primary
+	var standbyToken string
+	if *standbyOf != "" {
+		if *standbyTokenFile == "" {
+			log.Fatalf("The --standby-of option needs an API token from the primary server (see --standby-token-file).")
+			os.Exit(1)
+		}
+		token, err := os.ReadFile(*standbyTokenFile)
+		if err != nil {
+			log.Fatalf("Unable to read standby token file \"%s\": %v", *standbyTokenFile, err)
+			os.Exit(2)
+		}
+		standbyToken = strings.TrimSpace(string(token))
+	}
+
+	// start listening to incoming port (a standby waits until it takes over)
+	var incoming net.Listener
+	if *standbyOf == "" {
+		incoming, err = net.Listen("tcp", fmt.Sprintf(":%d", *port))
+		if err != nil {
+			log.Fatalf("Unable to open incoming TCP port %d: %v", *port, err)
+			os.Exit(2)
+		}
+		log.Printf("Listening on port %d", *port)
+		defer incoming.Close()
 	}
-	log.Printf("Listening on port %d", *port)
-	defer incoming.Close()
 
 	// signal handler
 	sig_channel := make(chan os.Signal, 1)
@@ -312,17 +418,111 @@ func main() {
 
 	ms := mapservice.MapService{
 		IncomingListener:  incoming,
-		Database:          sqldb,
+		MaxMessageSize:    *maxMessage,
+		MaxFrameSize:      *maxUpload,
+		ClientMemoryLimit: *maxClientMemory,
+		ReplayBuffer:      *replayBuffer,
+		DiceLimits:        mapservice.DiceLimits{
+			MaxPermutations: *maxPermutations,
+			MaxRolls:        *maxRolls,
+		},
+		MaxRollsPerMinute: *rollsPerMinute,
+		DiceSeed:          *diceSeed,
+		AuditLog:          auditLog,
+		TurnEnforcement:   turnEnforcement,
+		GMLayers:          gmOnlyLayers,
+		WallLayers:        wallOnlyLayers,
+		DrawingQuota:      mapservice.DrawingQuota{
+			MaxElements:      *maxDrawn,
+			MaxPoints:        *maxDrawnPoints,
+			MaxElementPoints: *maxElementPoints,
+		},
+		MarkRetention:     *markRetention,
+		MapExportDir:      *mapExportDir,
+		PlayerPolls:       *playerPolls,
+		AFKAfter:          *afkAfter,
+		GMConflictWindow:  *gmConflictWindow,
+		JoinHost:          *joinHost,
+		HTTPPort:          *httpPort,
+		AllowedOrigins:    allowedOrigins,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		TransferTimeout:   *transferTimeout,
+		DedupWindow:       *dedupWindow,
+		Storage:           storage,
 		PlayerGroupPass:   groupPassword,
 		GmPass:            gmPassword,
 		PersonalPasswords: personalPasswords,
-		Clients:           make(map[string]*mapservice.MapClient),
+		ReportSharedLogins: *reportSharedLogins,
+		AlertWebhook:      *alertWebhook,
+		AlertThreshold:    *alertThreshold,
+		AlertWindow:       *alertWindow,
 		InitFile:          *initfile,
-		EventHistory:      make(map[string]*mapservice.MapEvent),
-		ImageList:         make(map[string]string),
+		Campaign:          *campaign,
+		NextSession:       *nextSession,
+		PersistMetrics:    *persistMetrics,
+		SlowHandler:       *slowHandler,
+		LogBuffer:         logBuffer,
+		CrashFile:         *crashFile,
+		CrashWebhook:      *crashWebhook,
+		NotifyWebhooks:    *notifyWebhooks,
+		NotifyAllowed:     notifyAllowed,
+		EventBus:          eventBus,
+		BandwidthWarning:  *bandwidthWarning,
+		ServerVersion:     GMAVersionNumber,
+		Started:           time.Now(),
+		State:             mapservice.NewGameState(),
+		Journal:           journal,
+		JournalLimit:      *journalLimit,
+		StandbyOf:         *standbyOf,
+		StandbyToken:      standbyToken,
+		FailoverAfter:     *failoverAfter,
 		StopChannel:       stop_channel,
 	}
-	go ms.Run()
+	announce := func() {
+		if *noAnnounce {
+			return
+		}
+		announcer, err := mapservice.NewAnnouncer(*port, *campaign, GMAVersionNumber)
+		if err == nil {
+			err = announcer.Start()
+		}
+		if err != nil {
+			log.Printf("Not announcing the server on the local network: %v", err)
+			return
+		}
+		ms.Announce(announcer)
+	}
+	if *standbyOf != "" {
+		go func() {
+			defer ms.ReportCrash()
+			ms.RunStandby()
+			listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+			if err != nil {
+				log.Printf("Unable to open incoming TCP port %d to take over: %v", *port, err)
+				ms.EmergencyStop()
+				return
+			}
+			log.Printf("Listening on port %d", *port)
+			ms.IncomingListener = listener
+			announce()
+			ms.Run()
+		}()
+	} else {
+		announce()
+		go ms.Run()
+	}
+	if *httpPort != 0 {
+		if _, ok := storage.(mapservice.TokenStorage); !ok {
+			log.Printf("WARNING: the HTTP API needs a database for its API tokens, so every request will be refused.")
+		}
+		go func() {
+			log.Printf("HTTP API listening on port %d", *httpPort)
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", *httpPort), ms.HTTPHandler()); err != nil {
+				log.Printf("HTTP API stopped: %v", err)
+			}
+		}()
+	}
 	go eventMonitor(sig_channel, stop_channel, &ms, *saveint)
 	<-stop_channel
 	log.Printf("Received STOP signal; shutting down")
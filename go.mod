@@ -5,5 +5,4 @@ go 1.16
 require (
 	github.com/google/go-cmp v0.5.5
 	github.com/mattn/go-sqlite3 v1.14.6
-	github.com/schwarmco/go-cartesian-product v0.0.0-20180515110546-d5ee747a6dc9
 )
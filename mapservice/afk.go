@@ -0,0 +1,167 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                               Away From the Keyboard                               //
+//                                                                                    //
+// A user whose client has sent nothing but answers to our pings for a while is taken //
+// to be away from the keyboard (AFK). The peer list shows who is, and the GM is      //
+// warned when the turn comes round to a creature whose player is away. Anything      //
+// the user does brings them back.                                                    //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+//
+// DefaultAFKAfter is how long a user may do nothing before they're
+// taken to be away from the keyboard, unless the server is told
+// otherwise.
+//
+const DefaultAFKAfter = 10 * time.Minute
+
+//
+// Note that the user did something, returning how long they had been
+// idle before that.
+//
+func (c *MapClient) noteActivity(now time.Time) time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	idle := now.Sub(c.lastInput)
+	c.lastInput = now
+	return idle
+}
+
+//
+// How long has it been since the user did anything?
+//
+func (c *MapClient) idleFor(now time.Time) time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return now.Sub(c.lastInput)
+}
+
+//
+// Is the client's user away from the keyboard?
+//
+func (ms *MapService) isAFK(c *MapClient, now time.Time) bool {
+	return ms.AFKAfter > 0 && c.idleFor(now) >= ms.AFKAfter
+}
+
+//
+// Called for each message a client sends us. Anything but an answer
+// to our ping means the user is there.
+//
+func (ms *MapService) noticeActivity(event *MapEvent, thisClient *MapClient) {
+	if event.EventType() == "POLO" {
+		return
+	}
+	idle := thisClient.noteActivity(time.Now())
+	if ms.AFKAfter > 0 && idle >= ms.AFKAfter {
+		log.Printf("[client %s] %s is back at the keyboard after %v", thisClient.logTag(), thisClient.Username(), idle.Truncate(time.Second))
+	}
+}
+
+//
+// It's the creature's turn in combat. If it belongs to a player who is
+// connected but away from the keyboard (on every client they have),
+// warn the GM.
+//
+func (ms *MapService) warnAFKTurn(creature string) {
+	if ms.AFKAfter <= 0 {
+		return
+	}
+	var name string
+	var players []*MapClient
+	ms.State.lock.RLock()
+	if obj := ms.State.creature(creature); obj != nil && obj.Class == "P" {
+		name = obj.Attrs["NAME"]
+		for _, peer := range ms.AllClients() {
+			if peer.Authenticated && !peer.IsGM() && obj.playedBy(peer.Username()) {
+				players = append(players, peer)
+			}
+		}
+	}
+	ms.State.lock.RUnlock()
+	if len(players) == 0 {
+		return
+	}
+
+	now := time.Now()
+	idle := time.Duration(-1)
+	for _, peer := range players {
+		if !ms.isAFK(peer, now) {
+			return
+		}
+		if i := peer.idleFor(now); idle < 0 || i < idle {
+			idle = i
+		}
+	}
+	user := players[0].Username()
+	log.Printf("It's %s's turn, but %s is away from the keyboard", name, user)
+	for _, gm := range ms.AllClients() {
+		if gm.IsGM() && !gm.WriteOnly {
+			gm.Send("TO", gm.Username(), gm.Username(),
+				fmt.Sprintf("NOTICE: it's %s's turn, but %s has been away from the keyboard for %v.",
+					name, user, idle.Truncate(time.Minute)),
+				NextMessageID())
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
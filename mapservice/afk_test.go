@@ -0,0 +1,117 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for away-from-keyboard tracking
+//
+
+package mapservice
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAFK(t *testing.T) {
+	ms := newTestService()
+	ms.AFKAfter = time.Minute
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	for _, raw := range []string{"PS 1 red Grax 1 M monster 3 4 0", "PS 2 blue Alice 1 M player 5 6 0", "CO 1"} {
+		ms.ExecuteAction(testEvent(t, raw), gm)
+	}
+
+	now := time.Now()
+	if ms.isAFK(alice, now) {
+		t.Errorf("alice is AFK as soon as she connects")
+	}
+	alice.lastInput = now.Add(-2 * time.Minute)
+	ms.ExecuteAction(testEvent(t, "POLO"), alice)
+	if !ms.isAFK(alice, now) {
+		t.Errorf("answering a ping brought alice back")
+	}
+	sentIgnoringTime(gm)
+	sentIgnoringTime(alice)
+
+	ms.ExecuteAction(testEvent(t, "/CONN"), gm)
+	if sent := sentIgnoringTime(gm); len(sent) != 4 || !strings.HasSuffix(sent[1], " 0") || !strings.HasSuffix(sent[2], " 1") {
+		t.Errorf("GM was sent %q for the peer list", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "I {1 0 0} 1"), gm)
+	if sent := sentIgnoringTime(gm); len(sent) != 0 {
+		t.Errorf("GM was sent %q on a monster's turn", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "I {1 1 0} 2"), gm)
+	if sent := sentIgnoringTime(gm); len(sent) != 1 || !strings.Contains(sent[0], "NOTICE: it's Alice's turn, but alice has been away") {
+		t.Errorf("GM was sent %q on an AFK player's turn", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "/CONN"), alice)
+	if ms.isAFK(alice, time.Now()) {
+		t.Errorf("alice is still AFK after doing something")
+	}
+	sentIgnoringTime(alice)
+	ms.ExecuteAction(testEvent(t, "I {1 2 0} 2"), gm)
+	if sent := sentIgnoringTime(gm); len(sent) != 0 {
+		t.Errorf("GM was sent %q on a present player's turn", sent)
+	}
+
+	ms.AFKAfter = 0
+	alice.lastInput = now.Add(-time.Hour)
+	if ms.isAFK(alice, now) {
+		t.Errorf("alice is AFK when AFK tracking is off")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,426 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                             Local Network Announcement                             //
+//                                                                                    //
+// Advertising the server by multicast DNS (DNS-SD) so clients at an in-person table  //
+// can find it on the local network without anyone typing in an IP address.           //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// MDNSServiceType is the DNS-SD service type under which the server
+// announces itself.
+//
+const MDNSServiceType = "_gma._tcp.local."
+
+//
+// MDNSTTL is how long (in seconds) clients may remember our
+// announcement.
+//
+const MDNSTTL = 120
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+//
+// DNS record types and classes we deal in.
+//
+const (
+	dnsTypeA      = 1
+	dnsTypePTR    = 12
+	dnsTypeTXT    = 16
+	dnsTypeSRV    = 33
+	dnsTypeANY    = 255
+	dnsClassIN    = 1
+	dnsCacheFlush = 0x8000
+)
+
+//
+// Announcer answers multicast DNS queries for the map service on the
+// local network, so clients may browse for it.
+//
+type Announcer struct {
+	Instance string            // name to show people browsing (a single DNS label)
+	Host     string            // our host name, ending in ".local."
+	Port     int               // TCP port of the map service
+	Addrs    []net.IP          // IPv4 addresses we may be reached at
+	Text     map[string]string // extra details for the TXT record
+
+	lock   sync.Mutex
+	conn   *net.UDPConn
+	done   chan struct{}
+	closed bool
+}
+
+//
+// NewAnnouncer sets up an announcement of the map service on the given
+// port, as run for the named campaign (if any), at whatever IPv4
+// addresses this machine has.
+//
+func NewAnnouncer(port int, campaign, version string) (*Announcer, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find our host name: %v", err)
+	}
+	hostname = strings.SplitN(hostname, ".", 2)[0]
+
+	addrs, err := localIPv4Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	instance := "GMA on " + hostname
+	if campaign != "" {
+		instance = campaign
+	}
+	if len(instance) > 63 {
+		instance = instance[:63]
+	}
+	text := map[string]string{"version": version}
+	if campaign != "" {
+		text["campaign"] = campaign
+	}
+	return &Announcer{
+		Instance: instance,
+		Host:     hostname + ".local.",
+		Port:     port,
+		Addrs:    addrs,
+		Text:     text,
+	}, nil
+}
+
+//
+// The IPv4 addresses this machine may be reached at from the local
+// network.
+//
+func localIPv4Addrs() ([]net.IP, error) {
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find our network addresses: %v", err)
+	}
+	var addrs []net.IP
+	for _, a := range ifaddrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			addrs = append(addrs, ipnet.IP.To4())
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no network addresses found")
+	}
+	return addrs, nil
+}
+
+//
+// Start listening for queries and announce ourselves to anyone already
+// browsing.
+//
+func (a *Announcer) Start() error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("Unable to join the mDNS group: %v", err)
+	}
+	a.lock.Lock()
+	a.conn = conn
+	a.done = make(chan struct{})
+	a.lock.Unlock()
+
+	go a.run()
+	go func() {
+		// RFC 6762 8.3: announce at least twice, a second apart
+		for i := 0; i < 2; i++ {
+			a.send(a.response(MDNSTTL))
+			select {
+				case <-a.done:
+					return
+				case <-time.After(time.Second):
+			}
+		}
+	}()
+	log.Printf("Announcing \"%s\" on the local network as %s", a.Instance, MDNSServiceType)
+	return nil
+}
+
+//
+// Close withdraws our announcement and stops answering queries.
+//
+func (a *Announcer) Close() {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	if a.conn == nil || a.closed {
+		a.lock.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.done)
+	a.lock.Unlock()
+
+	a.send(a.response(0)) // goodbye
+	a.conn.Close()
+}
+
+//
+// Announce the service on the local network with the given announcer
+// (which should already be started) until it shuts down.
+//
+func (ms *MapService) Announce(a *Announcer) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.announcer = a
+}
+
+func (a *Announcer) send(packet []byte) {
+	if _, err := a.conn.WriteToUDP(packet, mdnsGroup); err != nil {
+		log.Printf("Unable to send mDNS announcement: %v", err)
+	}
+}
+
+func (a *Announcer) run() {
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+				case <-a.done:
+				default:
+					log.Printf("mDNS listener stopped: %v", err)
+			}
+			return
+		}
+		if a.wanted(buf[:n]) {
+			a.send(a.response(MDNSTTL))
+		}
+	}
+}
+
+func (a *Announcer) instanceName() string {
+	return strings.ReplaceAll(a.Instance, ".", "\\.") + "." + MDNSServiceType
+}
+
+//
+// Is the packet a query asking about us?
+//
+func (a *Announcer) wanted(packet []byte) bool {
+	if len(packet) < 12 || packet[2]&0x80 != 0 {
+		return false // too short, or not a query
+	}
+	questions := int(binary.BigEndian.Uint16(packet[4:6]))
+	offset := 12
+	for i := 0; i < questions; i++ {
+		name, next, err := readDNSName(packet, offset)
+		if err != nil || next+4 > len(packet) {
+			return false
+		}
+		qtype := binary.BigEndian.Uint16(packet[next : next+2])
+		offset = next + 4
+		switch {
+			case strings.EqualFold(name, MDNSServiceType):
+				if qtype == dnsTypePTR || qtype == dnsTypeANY {
+					return true
+				}
+			case strings.EqualFold(name, a.instanceName()):
+				if qtype == dnsTypeSRV || qtype == dnsTypeTXT || qtype == dnsTypeANY {
+					return true
+				}
+			case strings.EqualFold(name, a.Host):
+				if qtype == dnsTypeA || qtype == dnsTypeANY {
+					return true
+				}
+		}
+	}
+	return false
+}
+
+//
+// Our full set of records (PTR, SRV, TXT, and A) as an mDNS response,
+// to be remembered for ttl seconds (0 to withdraw them).
+//
+func (a *Announcer) response(ttl uint32) []byte {
+	packet := []byte{0, 0, 0x84, 0, 0, 0, 0, 0, 0, 0, 0, 0} // response, authoritative
+	records := 0
+	add := func(name string, rtype, class uint16, data []byte) {
+		packet = append(packet, dnsName(name)...)
+		var fixed [10]byte
+		binary.BigEndian.PutUint16(fixed[0:2], rtype)
+		binary.BigEndian.PutUint16(fixed[2:4], class)
+		binary.BigEndian.PutUint32(fixed[4:8], ttl)
+		binary.BigEndian.PutUint16(fixed[8:10], uint16(len(data)))
+		packet = append(append(packet, fixed[:]...), data...)
+		records++
+	}
+
+	instance := a.instanceName()
+	add(MDNSServiceType, dnsTypePTR, dnsClassIN, dnsName(instance))
+
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:6], uint16(a.Port))
+	add(instance, dnsTypeSRV, dnsClassIN|dnsCacheFlush, append(srv, dnsName(a.Host)...))
+
+	keys := make([]string, 0, len(a.Text))
+	for key := range a.Text {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var txt []byte
+	for _, key := range keys {
+		entry := key + "=" + a.Text[key]
+		if len(entry) > 255 {
+			entry = entry[:255]
+		}
+		txt = append(append(txt, byte(len(entry))), entry...)
+	}
+	if txt == nil {
+		txt = []byte{0}
+	}
+	add(instance, dnsTypeTXT, dnsClassIN|dnsCacheFlush, txt)
+
+	for _, ip := range a.Addrs {
+		add(a.Host, dnsTypeA, dnsClassIN|dnsCacheFlush, ip.To4())
+	}
+	binary.BigEndian.PutUint16(packet[6:8], uint16(records))
+	return packet
+}
+
+//
+// Encode a domain name (with "\." standing for a dot within a label)
+// in DNS wire format.
+//
+func dnsName(name string) []byte {
+	var encoded []byte
+	var label []byte
+	escaped := false
+	flush := func() {
+		if len(label) > 0 {
+			encoded = append(append(encoded, byte(len(label))), label...)
+			label = nil
+		}
+	}
+	for i := 0; i < len(name); i++ {
+		switch {
+			case escaped:
+				label = append(label, name[i])
+				escaped = false
+			case name[i] == '\\':
+				escaped = true
+			case name[i] == '.':
+				flush()
+			default:
+				label = append(label, name[i])
+		}
+	}
+	flush()
+	return append(encoded, 0)
+}
+
+//
+// Read the domain name at offset in the packet, following any
+// compression pointers. Returns the name (ending in "." with dots in
+// labels escaped as "\.") and the offset just past it.
+//
+func readDNSName(packet []byte, offset int) (string, int, error) {
+	var name strings.Builder
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(packet) {
+			return "", 0, fmt.Errorf("name runs off the end of the packet")
+		}
+		length := int(packet[offset])
+		switch {
+			case length == 0:
+				if next < 0 {
+					next = offset + 1
+				}
+				if name.Len() == 0 {
+					name.WriteByte('.')
+				}
+				return name.String(), next, nil
+
+			case length&0xc0 == 0xc0:
+				if offset+1 >= len(packet) {
+					return "", 0, fmt.Errorf("truncated name pointer")
+				}
+				if jumps++; jumps > 16 {
+					return "", 0, fmt.Errorf("name pointers loop")
+				}
+				if next < 0 {
+					next = offset + 2
+				}
+				offset = int(binary.BigEndian.Uint16(packet[offset:offset+2]) & 0x3fff)
+
+			default:
+				if offset+1+length > len(packet) {
+					return "", 0, fmt.Errorf("label runs off the end of the packet")
+				}
+				name.WriteString(strings.ReplaceAll(string(packet[offset+1:offset+1+length]), ".", "\\."))
+				name.WriteByte('.')
+				offset += 1 + length
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
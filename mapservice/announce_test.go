@@ -0,0 +1,187 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for local network announcement
+//
+
+package mapservice
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func testAnnouncer() *Announcer {
+	return &Announcer{
+		Instance: "Ravenloft v2.0",
+		Host:     "tabletop.local.",
+		Port:     2323,
+		Addrs:    []net.IP{net.IPv4(192, 168, 1, 20)},
+		Text:     map[string]string{"version": "4.2.2", "campaign": "Ravenloft v2.0"},
+	}
+}
+
+func testDNSQuery(name string, qtype uint16) []byte {
+	packet := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	packet = append(packet, dnsName(name)...)
+	return append(packet, byte(qtype>>8), byte(qtype), 0, 1)
+}
+
+func TestDNSNames(t *testing.T) {
+	encoded := dnsName("Ravenloft v2\\.0._gma._tcp.local.")
+	if string(encoded) != "\x0eRavenloft v2.0\x04_gma\x04_tcp\x05local\x00" {
+		t.Errorf("name encoded as %q", encoded)
+	}
+	name, next, err := readDNSName(encoded, 0)
+	if err != nil || name != "Ravenloft v2\\.0._gma._tcp.local." || next != len(encoded) {
+		t.Errorf("name read back as %q, %d, %v", name, next, err)
+	}
+
+	// "tabletop" then a pointer back to "local."
+	packet := append(dnsName("local."), 8)
+	packet = append(append(packet, "tabletop"...), 0xc0, 0)
+	if name, next, err = readDNSName(packet, 7); err != nil || name != "tabletop.local." || next != len(packet) {
+		t.Errorf("compressed name read as %q, %d, %v", name, next, err)
+	}
+	if _, _, err = readDNSName([]byte{0xc0, 0}, 0); err == nil {
+		t.Errorf("looping name pointer accepted")
+	}
+	if _, _, err = readDNSName([]byte{5, 'a'}, 0); err == nil {
+		t.Errorf("truncated label accepted")
+	}
+}
+
+func TestAnnouncerQueries(t *testing.T) {
+	a := testAnnouncer()
+	for _, q := range []struct {
+		name   string
+		qtype  uint16
+		wanted bool
+	}{
+		{"_gma._tcp.local.", dnsTypePTR, true},
+		{"_GMA._tcp.local.", dnsTypeANY, true},
+		{"_http._tcp.local.", dnsTypePTR, false},
+		{"Ravenloft v2\\.0._gma._tcp.local.", dnsTypeSRV, true},
+		{"tabletop.local.", dnsTypeA, true},
+		{"tabletop.local.", dnsTypeTXT, false},
+	} {
+		if wanted := a.wanted(testDNSQuery(q.name, q.qtype)); wanted != q.wanted {
+			t.Errorf("query for %s type %d wanted=%v", q.name, q.qtype, wanted)
+		}
+	}
+	response := a.response(MDNSTTL)
+	if a.wanted(response) {
+		t.Errorf("answered a response")
+	}
+	if a.wanted(response[:5]) {
+		t.Errorf("answered a runt packet")
+	}
+}
+
+func TestAnnouncerResponse(t *testing.T) {
+	a := testAnnouncer()
+	packet := a.response(MDNSTTL)
+	if packet[2] != 0x84 || binary.BigEndian.Uint16(packet[6:8]) != 4 {
+		t.Fatalf("response header % x", packet[:12])
+	}
+	var records []string
+	offset := 12
+	for i := 0; i < 4; i++ {
+		name, next, err := readDNSName(packet, offset)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		rtype := binary.BigEndian.Uint16(packet[next:])
+		ttl := binary.BigEndian.Uint32(packet[next+4:])
+		length := int(binary.BigEndian.Uint16(packet[next+8:]))
+		data := packet[next+10 : next+10+length]
+		if ttl != MDNSTTL {
+			t.Errorf("record %d TTL %d", i, ttl)
+		}
+		switch rtype {
+			case dnsTypePTR, dnsTypeSRV:
+				if rtype == dnsTypeSRV {
+					if port := binary.BigEndian.Uint16(data[4:6]); port != 2323 {
+						t.Errorf("SRV port %d", port)
+					}
+					data = data[6:]
+				}
+				target, _, err := readDNSName(data, 0)
+				if err != nil {
+					t.Errorf("record %d target: %v", i, err)
+				}
+				records = append(records, name+" -> "+target)
+			case dnsTypeTXT:
+				records = append(records, name+" TXT "+string(data))
+			case dnsTypeA:
+				records = append(records, name+" A "+net.IP(data).String())
+		}
+		offset = next + 10 + length
+	}
+	expected := "_gma._tcp.local. -> Ravenloft v2\\.0._gma._tcp.local.\n" +
+		"Ravenloft v2\\.0._gma._tcp.local. -> tabletop.local.\n" +
+		"Ravenloft v2\\.0._gma._tcp.local. TXT \x17campaign=Ravenloft v2.0\x0dversion=4.2.2\n" +
+		"tabletop.local. A 192.168.1.20"
+	if actual := strings.Join(records, "\n"); actual != expected {
+		t.Errorf("response records were\n%s\nnot\n%s", actual, expected)
+	}
+
+	goodbye := a.response(0)
+	if ttl := binary.BigEndian.Uint32(goodbye[12+len(dnsName(MDNSServiceType))+4:]); ttl != 0 {
+		t.Errorf("goodbye TTL %d", ttl)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,310 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     API Tokens                                     //
+//                                                                                    //
+// Long-lived credentials for programs which use the server's HTTP API, each limited  //
+// to what it needs to do.                                                            //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+//
+// The scopes an API token may have. A read-only token may only look at
+// things, a chat-only token may only post chat messages, and an admin
+// token may do anything (including manage the other tokens).
+//
+const (
+	ScopeReadOnly = "read"
+	ScopeChat     = "chat"
+	ScopeAdmin    = "admin"
+)
+
+//
+// CheckTokenScope makes sure a scope name is one we know.
+//
+func CheckTokenScope(scope string) error {
+	switch scope {
+		case ScopeReadOnly, ScopeChat, ScopeAdmin:
+			return nil
+	}
+	return fmt.Errorf("Token scope \"%s\" not understood; must be %s, %s, or %s", scope, ScopeReadOnly, ScopeChat, ScopeAdmin)
+}
+
+//
+// An APIToken is a long-lived credential which lets a program outside
+// the game use the server's HTTP API. We only keep a hash of the token
+// itself, so it is only ever seen once, when it is created.
+//
+type APIToken struct {
+	ID        string    // public identifier of the token
+	Name      string    // who or what the token was issued to
+	Scope     string    // what the token may be used for (Scope* constants)
+	RateLimit int       // most requests per minute (0 for no limit)
+	Created   time.Time // when the token was issued
+	LastUsed  time.Time // when it was last used (zero if never)
+	Revoked   bool      // has the token been revoked?
+}
+
+//
+// Allows returns true if the token may be used for something which
+// needs the given scope.
+//
+func (t APIToken) Allows(scope string) bool {
+	return !t.Revoked && (t.Scope == ScopeAdmin || t.Scope == scope)
+}
+
+//
+// NewAPIToken creates a new token, returning its description and the
+// token string to give to the program which will use it.
+//
+func NewAPIToken(name, scope string, rateLimit int, now time.Time) (APIToken, string, error) {
+	if err := CheckTokenScope(scope); err != nil {
+		return APIToken{}, "", err
+	}
+	if name == "" {
+		return APIToken{}, "", fmt.Errorf("API tokens must have a name")
+	}
+	if rateLimit < 0 {
+		return APIToken{}, "", fmt.Errorf("API token rate limit may not be negative")
+	}
+	id := make([]byte, 4)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return APIToken{}, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return APIToken{}, "", err
+	}
+	t := APIToken{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Scope:     scope,
+		RateLimit: rateLimit,
+		Created:   now,
+	}
+	return t, "gma_" + t.ID + "_" + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+//
+// HashAPIToken returns the hash we store in place of a token string.
+//
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//
+// Fields returns the token's description as message fields:
+// <id> <name> <scope> <rate-limit> <created> <last-used> <revoked>
+// with times in seconds since the epoch (0 if never).
+//
+func (t APIToken) Fields() []string {
+	lastUsed := "0"
+	if !t.LastUsed.IsZero() {
+		lastUsed = strconv.FormatInt(t.LastUsed.Unix(), 10)
+	}
+	revoked := "0"
+	if t.Revoked {
+		revoked = "1"
+	}
+	return []string{t.ID, t.Name, t.Scope, strconv.Itoa(t.RateLimit), strconv.FormatInt(t.Created.Unix(), 10), lastUsed, revoked}
+}
+
+//
+// TokenStorage is implemented by storage backends which can keep
+// API tokens.
+//
+type TokenStorage interface {
+	SaveAPIToken(t APIToken, hash string) error
+	ListAPITokens() ([]APIToken, error)
+	LookupAPIToken(hash string) (APIToken, bool, error)
+	RevokeAPIToken(id string) (bool, error)
+	TouchAPIToken(id string, when time.Time) error
+}
+
+//
+// Database Schema
+//  _______________
+// | apitokens     |
+// |---------------|
+// | id         Ps |
+// | hash       Us |
+// | name        s |
+// | scope       s |
+// | ratelimit   i |
+// | created     i |
+// | lastused    i |
+// | revoked     i |
+// |_______________|
+//
+// P=primary key
+// U=unique
+// i=integer
+// s=string
+//
+// Times are stored as seconds since the epoch (lastused is 0 if the
+// token was never used). This table was added after the others, so it
+// is created whenever we open a database which doesn't have it yet.
+//
+func createAPITokenTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists apitokens (
+			id        text    primary key,
+			hash      text    not null unique,
+			name      text    not null,
+			scope     text    not null,
+			ratelimit integer not null,
+			created   integer not null,
+			lastused  integer not null,
+			revoked   integer not null
+		);`)
+	return err
+}
+
+//
+// SaveAPIToken stores a new API token under the hash of its token string.
+//
+func SaveAPIToken(db *sql.DB, t APIToken, hash string) error {
+	if _, err := db.Exec(`insert into apitokens (id, hash, name, scope, ratelimit, created, lastused, revoked) values (?, ?, ?, ?, ?, ?, 0, 0)`,
+		t.ID, hash, t.Name, t.Scope, t.RateLimit, t.Created.Unix()); err != nil {
+		return fmt.Errorf("Unable to save API token %s: %v", t.ID, err)
+	}
+	return nil
+}
+
+func scanAPIToken(row interface{ Scan(...interface{}) error }) (APIToken, error) {
+	var t APIToken
+	var created, lastUsed int64
+	if err := row.Scan(&t.ID, &t.Name, &t.Scope, &t.RateLimit, &created, &lastUsed, &t.Revoked); err != nil {
+		return APIToken{}, err
+	}
+	t.Created = time.Unix(created, 0)
+	if lastUsed != 0 {
+		t.LastUsed = time.Unix(lastUsed, 0)
+	}
+	return t, nil
+}
+
+//
+// ListAPITokens reads all the API tokens (including revoked ones)
+// in the order they were created.
+//
+func ListAPITokens(db *sql.DB) ([]APIToken, error) {
+	rows, err := db.Query(`select id, name, scope, ratelimit, created, lastused, revoked from apitokens order by created, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read API tokens: %v", err)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+//
+// LookupAPIToken finds the token with the given hash. It returns false
+// if there is no such token.
+//
+func LookupAPIToken(db *sql.DB, hash string) (APIToken, bool, error) {
+	t, err := scanAPIToken(db.QueryRow(`select id, name, scope, ratelimit, created, lastused, revoked from apitokens where hash = ?`, hash))
+	if err == sql.ErrNoRows {
+		return APIToken{}, false, nil
+	}
+	if err != nil {
+		return APIToken{}, false, fmt.Errorf("Unable to look up API token: %v", err)
+	}
+	return t, true, nil
+}
+
+//
+// RevokeAPIToken marks a token as no longer usable. It returns false
+// if there was no such token.
+//
+func RevokeAPIToken(db *sql.DB, id string) (bool, error) {
+	result, err := db.Exec(`update apitokens set revoked = 1 where id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+//
+// TouchAPIToken records when a token was last used.
+//
+func TouchAPIToken(db *sql.DB, id string, when time.Time) error {
+	_, err := db.Exec(`update apitokens set lastused = ? where id = ?`, when.Unix(), id)
+	return err
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
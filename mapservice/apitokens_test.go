@@ -0,0 +1,148 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for API tokens
+//
+
+package mapservice
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewAPIToken(t *testing.T) {
+	tk, token, err := NewAPIToken("bot", ScopeChat, 10, time.Now())
+	if err != nil {
+		t.Fatalf("unable to create token: %v", err)
+	}
+	if !strings.HasPrefix(token, "gma_"+tk.ID+"_") || len(tk.ID) != 8 {
+		t.Errorf("token %s has ID %s", token, tk.ID)
+	}
+	if _, other, _ := NewAPIToken("bot", ScopeChat, 10, time.Now()); other == token {
+		t.Errorf("two tokens were both %s", token)
+	}
+	for _, bad := range []struct{ name, scope string; limit int }{
+		{"bot", "root", 0},
+		{"", ScopeChat, 0},
+		{"bot", ScopeChat, -1},
+	} {
+		if _, _, err := NewAPIToken(bad.name, bad.scope, bad.limit, time.Now()); err == nil {
+			t.Errorf("created token %v", bad)
+		}
+	}
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	for _, test := range []struct {
+		scope, need string
+		revoked     bool
+		allowed     bool
+	}{
+		{ScopeReadOnly, ScopeReadOnly, false, true},
+		{ScopeReadOnly, ScopeChat, false, false},
+		{ScopeChat, ScopeChat, false, true},
+		{ScopeChat, ScopeReadOnly, false, false},
+		{ScopeAdmin, ScopeChat, false, true},
+		{ScopeAdmin, ScopeAdmin, false, true},
+		{ScopeAdmin, ScopeAdmin, true, false},
+	} {
+		if allowed := (APIToken{Scope: test.scope, Revoked: test.revoked}).Allows(test.need); allowed != test.allowed {
+			t.Errorf("%s token (revoked %v) allows %s: %v", test.scope, test.revoked, test.need, allowed)
+		}
+	}
+}
+
+func TestAPITokenStorage(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", filepath.Join(t.TempDir(), "tokens.db"))
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ts, ok := storage.(TokenStorage)
+	if !ok {
+		t.Fatalf("sqlite storage doesn't store API tokens")
+	}
+
+	tk, token, err := NewAPIToken("bot", ScopeReadOnly, 5, time.Unix(1600000000, 0))
+	if err != nil {
+		t.Fatalf("unable to create token: %v", err)
+	}
+	if err = ts.SaveAPIToken(tk, HashAPIToken(token)); err != nil {
+		t.Fatalf("unable to save token: %v", err)
+	}
+	found, ok, err := ts.LookupAPIToken(HashAPIToken(token))
+	if !ok || err != nil || found.ID != tk.ID || found.Name != "bot" || found.RateLimit != 5 || !found.LastUsed.IsZero() {
+		t.Errorf("looked up %+v, %v, %v", found, ok, err)
+	}
+	if _, ok, err := ts.LookupAPIToken(HashAPIToken(token + "x")); ok || err != nil {
+		t.Errorf("found a token which doesn't exist: %v", err)
+	}
+	if err = ts.TouchAPIToken(tk.ID, time.Unix(1600000100, 0)); err != nil {
+		t.Errorf("unable to touch token: %v", err)
+	}
+	if ok, err := ts.RevokeAPIToken(tk.ID); !ok || err != nil {
+		t.Errorf("unable to revoke token: %v, %v", ok, err)
+	}
+	if ok, err := ts.RevokeAPIToken("nothing"); ok || err != nil {
+		t.Errorf("revoked a token which doesn't exist: %v", err)
+	}
+	tokens, err := ts.ListAPITokens()
+	if err != nil || len(tokens) != 1 || !tokens[0].Revoked || tokens[0].LastUsed.Unix() != 1600000100 {
+		t.Errorf("listed %+v, %v", tokens, err)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,176 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     Audit Log                                      //
+//                                                                                    //
+// Record of privileged actions taken by the GM (or anyone else) which may need to be //
+// reviewed later, such as deciding the outcome of die rolls in advance.              //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// AuditRecord describes one privileged action taken on the server,
+// such as the GM deciding the outcome of a die roll in advance.
+//
+type AuditRecord struct {
+	Time    time.Time         `json:"time"`
+	User    string            `json:"user"`
+	GM      string            `json:"gm,omitempty"` // which GM, if the user is one who gave their name
+	Client  string            `json:"client,omitempty"`
+	Action  string            `json:"action"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+//
+// AuditLog is an append-only record of privileged actions, written
+// as one JSON object per line so it may be reviewed (or argued over)
+// after the game.
+//
+type AuditLog struct {
+	lock sync.Mutex
+	out  io.Writer
+	file *os.File
+}
+
+//
+// NewAuditLog creates an audit log which writes its records to w.
+//
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{out: w}
+}
+
+//
+// OpenAuditLog opens (or creates) the named file and appends
+// audit records to it.
+//
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{out: f, file: f}, nil
+}
+
+//
+// Close the audit log's file, if it opened one.
+//
+func (a *AuditLog) Close() error {
+	if a == nil || a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+//
+// Record writes a single record to the audit log.
+//
+func (a *AuditLog) Record(rec AuditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, err = a.out.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("Unable to write audit record: %v", err)
+	}
+	return nil
+}
+
+//
+// Note a privileged action taken by a client. It always goes to the
+// server log, and to the audit log too if one is configured.
+//
+func (ms *MapService) audit(thisClient *MapClient, action string, details map[string]string) {
+	ms.recordAudit(AuditRecord{
+		Time:    time.Now(),
+		User:    thisClient.Username(),
+		GM:      thisClient.GMName(),
+		Client:  thisClient.ClientAddr,
+		Action:  action,
+		Details: details,
+	})
+}
+
+//
+// Note an action described by an audit record, whoever (or whatever)
+// it came from.
+//
+func (ms *MapService) recordAudit(rec AuditRecord) {
+	user := rec.User
+	if rec.GM != "" {
+		user = fmt.Sprintf("%s (%s)", rec.User, rec.GM)
+	}
+	log.Printf("[client %s] AUDIT %s by %s: %v", rec.Client, rec.Action, user, rec.Details)
+	if ms.AuditLog == nil {
+		return
+	}
+	if err := ms.AuditLog.Record(rec); err != nil {
+		log.Printf("[client %s] %v", rec.Client, err)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -36,6 +36,7 @@ package mapservice
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
@@ -72,16 +73,12 @@ func (a *Authenticator) SetSecret(secret []byte) {
 }
 
 //
-// Compare two byte arrays for equality.
+// Compare two byte arrays for equality. This takes the same
+// time no matter where they differ, so it doesn't give away
+// how close a guess was to the expected value.
 //
 func bytesEqual(a, b []byte) bool {
-	if len(a) != len(b) { return false }
-	for i, v := range a {
-		if v != b[i] {
-			return false
-		}
-	}
-	return true
+	return subtle.ConstantTimeCompare(a, b) == 1
 }
 
 //
@@ -184,10 +181,14 @@ func (a *Authenticator) calcResponse(secret []byte) ([]byte, error) {
 // again against the GM's secret to see if the user is logging in as the GM
 // role.
 //
+// The challenge is used up by this call, so a second response to it is
+// never accepted; call GenerateChallenge() again for another attempt.
+//
 func (a *Authenticator) ValidateResponse(response string) (bool, error) {
 	if len(a.Secret) == 0 {
 		return false, fmt.Errorf("No password configured")
 	}
+	defer func() { a.Challenge = []byte{} }()
 	binary_response, err := base64.StdEncoding.DecodeString(response)
 	if err != nil {
 		return false, fmt.Errorf("Error decoding client response: %v", err)
@@ -0,0 +1,186 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                         Authentication challenge tracking                          //
+//                                                                                    //
+// Keeping track of the login challenges we have sent out, so that each one expires   //
+// and may be answered only once, and a captured AUTH exchange can't be replayed      //
+// against us later.                                                                  //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//
+// How long a client has to answer the challenge we send it
+// when it connects, unless the server's ChallengeLifetime says
+// otherwise.
+//
+const DefaultChallengeLifetime = 2 * time.Minute
+
+//
+// challengeRegistry remembers the authentication challenges we
+// have sent out which haven't been answered yet, and the responses
+// we've already accepted, so that each challenge may be answered
+// only once and only while it is fresh. Without this, someone who
+// captured a client's AUTH exchange could play it back to us.
+//
+type challengeRegistry struct {
+	lock   sync.Mutex
+	issued map[string]time.Time   // outstanding challenges -> when they expire
+	spent  map[[32]byte]time.Time // hashes of responses we've seen -> when we may forget them
+}
+
+//
+// Remember that we just sent out a challenge which must be
+// answered by the expiry time.
+//
+func (r *challengeRegistry) issue(challenge string, expires time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.issued == nil {
+		r.issued = make(map[string]time.Time)
+	}
+	r.issued[challenge] = expires
+}
+
+//
+// Use up a challenge by checking that it is one we sent out,
+// which hasn't expired or already been answered, and that the
+// response given to it isn't one we've seen before. Either way,
+// the challenge can't be used again afterward.
+//
+func (r *challengeRegistry) redeem(challenge, response string, now time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.prune(now)
+	expires, ok := r.issued[challenge]
+	if !ok {
+		return fmt.Errorf("Challenge was not issued by this server or was already answered")
+	}
+	delete(r.issued, challenge)
+	if !now.Before(expires) {
+		return fmt.Errorf("Challenge expired before it was answered")
+	}
+
+	// A response can only be valid for the challenge it was computed
+	// from, but we remember it until then anyway so that a reused one
+	// is refused no matter how it is presented to us.
+	sum := sha256.Sum256([]byte(response))
+	if _, seen := r.spent[sum]; seen {
+		return fmt.Errorf("Response was already used")
+	}
+	if r.spent == nil {
+		r.spent = make(map[[32]byte]time.Time)
+	}
+	r.spent[sum] = expires
+	return nil
+}
+
+//
+// Withdraw a challenge which won't be answered (e.g., because
+// the client went away).
+//
+func (r *challengeRegistry) withdraw(challenge string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.issued, challenge)
+}
+
+//
+// Forget the challenges and responses which have expired.
+// The caller must hold the lock.
+//
+func (r *challengeRegistry) prune(now time.Time) {
+	for challenge, expires := range r.issued {
+		if !now.Before(expires) {
+			delete(r.issued, challenge)
+		}
+	}
+	for sum, expires := range r.spent {
+		if !now.Before(expires) {
+			delete(r.spent, sum)
+		}
+	}
+}
+
+//
+// Report how many challenges are waiting to be answered.
+//
+func (r *challengeRegistry) outstanding() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.issued)
+}
+
+//
+// The length of time clients have to answer their challenges.
+//
+func (ms *MapService) challengeLifetime() time.Duration {
+	if ms.ChallengeLifetime > 0 {
+		return ms.ChallengeLifetime
+	}
+	return DefaultChallengeLifetime
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
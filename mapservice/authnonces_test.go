@@ -0,0 +1,194 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for authentication challenge tracking
+//
+
+package mapservice
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChallengeRegistry(t *testing.T) {
+	var r challengeRegistry
+	now := time.Date(2020, 5, 1, 19, 0, 0, 0, time.UTC)
+
+	r.issue("c1", now.Add(time.Minute))
+	r.issue("c2", now.Add(time.Minute))
+	r.issue("c3", now.Add(time.Minute))
+	if err := r.redeem("c1", "r1", now); err != nil {
+		t.Errorf("fresh challenge refused: %v", err)
+	}
+	if err := r.redeem("c1", "r1", now); err == nil {
+		t.Errorf("challenge answered twice")
+	}
+	if err := r.redeem("c2", "r1", now); err == nil {
+		t.Errorf("response used twice")
+	}
+	if err := r.redeem("c2", "r2", now); err == nil {
+		t.Errorf("challenge answered again after a refused response")
+	}
+	if err := r.redeem("nope", "r3", now); err == nil {
+		t.Errorf("challenge we never issued was accepted")
+	}
+	if err := r.redeem("c3", "r3", now.Add(time.Minute)); err == nil {
+		t.Errorf("expired challenge was accepted")
+	}
+
+	r.issue("c4", now.Add(time.Minute))
+	r.withdraw("c4")
+	r.issue("c5", now.Add(time.Minute))
+	r.prune(now.Add(2 * time.Minute))
+	if n := r.outstanding(); n != 0 {
+		t.Errorf("%d challenges still outstanding", n)
+	}
+	if len(r.spent) != 0 {
+		t.Errorf("%d spent responses still remembered", len(r.spent))
+	}
+}
+
+//
+// Run a client through AuthenticateUser, answering whatever challenge
+// it is sent with answer(challenge). Returns what the client was
+// sent at the end and the error from AuthenticateUser.
+//
+func authenticateTestClient(t *testing.T, ms *MapService, answer func(challenge string) string) (*MapClient, string, error) {
+	in, out := io.Pipe()
+	defer out.Close()
+	c := &MapClient{
+		ClientAddr:  "pipe",
+		Service:     ms,
+		Reader:      bufio.NewReader(in),
+		CommChannel: make(chan string, CommChannelBufferSize),
+		Auth:        &Authenticator{Secret: ms.PlayerGroupPass, GmSecret: ms.GmPass},
+	}
+	result := make(chan error, 1)
+	go func() { result <- c.AuthenticateUser() }()
+
+	greeting := strings.Fields(<-c.CommChannel)
+	if len(greeting) != 3 || greeting[0] != "OK" {
+		t.Fatalf("greeting was %v", greeting)
+	}
+	io.WriteString(out, "AUTH "+answer(greeting[2])+" alice test\n")
+	err := <-result
+	return c, strings.TrimSpace(<-c.CommChannel), err
+}
+
+func testAuthResponse(t *testing.T, challenge string, secret []byte) string {
+	nonce, err := base64.StdEncoding.DecodeString(challenge)
+	if err != nil {
+		t.Fatalf("challenge %q: %v", challenge, err)
+	}
+	a := Authenticator{Challenge: nonce}
+	response, err := a.calcResponse(secret)
+	if err != nil {
+		t.Fatalf("response to %q: %v", challenge, err)
+	}
+	return base64.StdEncoding.EncodeToString(response)
+}
+
+func TestAuthenticateReplay(t *testing.T) {
+	ms := newTestService()
+	ms.PlayerGroupPass = []byte("swordfish")
+	ms.GmPass = []byte("dungeon")
+
+	var captured string
+	c, reply, err := authenticateTestClient(t, ms, func(challenge string) string {
+		captured = testAuthResponse(t, challenge, ms.PlayerGroupPass)
+		return captured
+	})
+	if err != nil || !c.Authenticated || reply != "GRANTED alice" {
+		t.Fatalf("login failed: %v, %q", err, reply)
+	}
+
+	// Playing back the same exchange must not work.
+	c, reply, err = authenticateTestClient(t, ms, func(string) string { return captured })
+	if err == nil || c.Authenticated || !strings.HasPrefix(reply, "DENIED") {
+		t.Errorf("replayed response accepted: %v, %q", err, reply)
+	}
+
+	c, reply, err = authenticateTestClient(t, ms, func(challenge string) string {
+		return testAuthResponse(t, challenge, ms.GmPass)
+	})
+	if err != nil || !c.Authenticated || !c.Auth.GmMode || reply != "GRANTED GM" {
+		t.Errorf("GM login failed: %v, %q", err, reply)
+	}
+	if c.Username() != "GM" || c.GMName() != "alice" {
+		t.Errorf("GM logged in as %q (%q)", c.Username(), c.GMName())
+	}
+	if n := ms.challenges.outstanding(); n != 0 {
+		t.Errorf("%d challenges left outstanding", n)
+	}
+}
+
+func TestAuthenticateExpiredChallenge(t *testing.T) {
+	ms := newTestService()
+	ms.PlayerGroupPass = []byte("swordfish")
+	ms.ChallengeLifetime = 10 * time.Millisecond
+
+	c, reply, err := authenticateTestClient(t, ms, func(challenge string) string {
+		time.Sleep(20 * time.Millisecond)
+		return testAuthResponse(t, challenge, ms.PlayerGroupPass)
+	})
+	if err == nil || c.Authenticated || !strings.HasPrefix(reply, "DENIED") {
+		t.Errorf("late response accepted: %v, %q", err, reply)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
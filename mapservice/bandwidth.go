@@ -0,0 +1,342 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                Bandwidth Accounting                                //
+//                                                                                    //
+// Counting the network traffic each user causes across all their connections, with   //
+// an optional soft cap for GMs hosting over metered links.                           //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// BandwidthUsage is how much network traffic a user's clients have
+// caused (over all their connections) since the counters were last
+// reset.
+//
+type BandwidthUsage struct {
+	User     string    `json:"user"`
+	BytesIn  uint64    `json:"bytes_in"`  // received from the user's clients
+	BytesOut uint64    `json:"bytes_out"` // sent to them
+	Since    time.Time `json:"since"`     // when counting started
+}
+
+//
+// Total is the traffic in both directions.
+//
+func (u BandwidthUsage) Total() uint64 {
+	return u.BytesIn + u.BytesOut
+}
+
+//
+// bandwidthLedger keeps the running totals for each user, and how many
+// times over the soft cap each has been warned about.
+//
+type bandwidthLedger struct {
+	lock    sync.Mutex
+	usage   map[string]*BandwidthUsage
+	warned  map[string]uint64
+	changed bool
+}
+
+//
+// Add traffic to a user's totals. If the soft cap is nonzero and this
+// takes them past another multiple of it, the new total is returned
+// with true so they may be warned.
+//
+func (l *bandwidthLedger) add(user string, in, out int, softCap uint64, now time.Time) (uint64, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.usage == nil {
+		l.usage = make(map[string]*BandwidthUsage)
+		l.warned = make(map[string]uint64)
+	}
+	u, ok := l.usage[user]
+	if !ok {
+		u = &BandwidthUsage{User: user, Since: now}
+		l.usage[user] = u
+	}
+	u.BytesIn += uint64(in)
+	u.BytesOut += uint64(out)
+	l.changed = true
+	if softCap == 0 {
+		return u.Total(), false
+	}
+	times := u.Total() / softCap
+	if times > l.warned[user] {
+		l.warned[user] = times
+		return u.Total(), true
+	}
+	return u.Total(), false
+}
+
+func (l *bandwidthLedger) all() []BandwidthUsage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	usage := []BandwidthUsage{}
+	for _, u := range l.usage {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].User < usage[j].User })
+	return usage
+}
+
+func (l *bandwidthLedger) load(usage []BandwidthUsage, softCap uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.usage = make(map[string]*BandwidthUsage)
+	l.warned = make(map[string]uint64)
+	for i := range usage {
+		l.usage[usage[i].User] = &usage[i]
+		if softCap > 0 {
+			l.warned[usage[i].User] = usage[i].Total() / softCap
+		}
+	}
+}
+
+//
+// Take the changed flag, so we only save the totals when there's
+// something new in them.
+//
+func (l *bandwidthLedger) takeChanged() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	changed := l.changed
+	l.changed = false
+	return changed
+}
+
+//
+// Count traffic to or from a client against its user. If that takes
+// them past the soft cap (see BandwidthWarning), they and the GM are
+// warned. Traffic before the client logs in isn't counted, since we
+// don't yet know whose it is.
+//
+func (c *MapClient) countBandwidth(in, out int) {
+	if c.Service == nil || c.Auth == nil || !c.Authenticated {
+		return
+	}
+	ms := c.Service
+	user := c.Username()
+	total, warn := ms.bandwidth.add(user, in, out, ms.BandwidthWarning, time.Now())
+	if warn {
+		// we may be in the middle of writing to this very client
+		go ms.warnBandwidth(user, total)
+	}
+}
+
+func (ms *MapService) warnBandwidth(user string, total uint64) {
+	defer ms.ReportCrash()
+	message := fmt.Sprintf("WARNING: %s has used %s of network traffic (the soft cap is %s)",
+		user, formatBytes(total), formatBytes(ms.BandwidthWarning))
+	log.Print(message)
+	recipients := ms.Clients.ByUser("GM")
+	if user != "GM" {
+		recipients = append(recipients, ms.Clients.ByUser(user)...)
+	}
+	for _, peer := range recipients {
+		peer.Send("TO", peer.Username(), peer.Username(), message, NextMessageID())
+	}
+}
+
+func formatBytes(n uint64) string {
+	switch {
+		case n >= 1<<30:
+			return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+		case n >= 1<<20:
+			return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+		case n >= 1<<10:
+			return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+//
+// BandwidthUsage returns the traffic totals for each user, sorted by
+// name.
+//
+func (ms *MapService) BandwidthUsage() []BandwidthUsage {
+	return ms.bandwidth.all()
+}
+
+//
+// ResetBandwidth starts counting everyone's traffic again from zero
+// (say, at the start of a new billing period).
+//
+func (ms *MapService) ResetBandwidth() error {
+	ms.bandwidth.load(nil, ms.BandwidthWarning)
+	if storage, ok := ms.Storage.(BandwidthStorage); ok {
+		return storage.SaveBandwidthUsage(nil)
+	}
+	return nil
+}
+
+//
+// Save the traffic totals, if they've changed, so they last across
+// restarts of the server.
+//
+func (ms *MapService) saveBandwidth() error {
+	storage, ok := ms.Storage.(BandwidthStorage)
+	if !ok || !ms.bandwidth.takeChanged() {
+		return nil
+	}
+	return storage.SaveBandwidthUsage(ms.bandwidth.all())
+}
+
+//
+// Pick up the traffic totals saved before the server was last restarted.
+//
+func (ms *MapService) loadBandwidth() error {
+	storage, ok := ms.Storage.(BandwidthStorage)
+	if !ok {
+		return nil
+	}
+	usage, err := storage.LoadBandwidthUsage()
+	if err != nil {
+		return err
+	}
+	ms.bandwidth.load(usage, ms.BandwidthWarning)
+	return nil
+}
+
+//
+// BandwidthStorage is implemented by storage backends which can keep
+// the traffic totals across restarts of the server.
+//
+type BandwidthStorage interface {
+	SaveBandwidthUsage(usage []BandwidthUsage) error
+	LoadBandwidthUsage() ([]BandwidthUsage, error)
+}
+
+//
+// Database Schema
+//  ________________
+// | bandwidth      |
+// |----------------|
+// | user       P s |
+// | bytesin      i |
+// | bytesout     i |
+// | since        i |
+// |________________|
+//
+// P=primary key
+// i=integer
+// s=string
+//
+// The since time is stored as seconds since the epoch.
+//
+func createBandwidthTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists bandwidth (
+			user     text    primary key,
+			bytesin  integer not null,
+			bytesout integer not null,
+			since    integer not null
+		);`)
+	return err
+}
+
+//
+// SaveBandwidthUsage replaces the saved traffic totals with the ones
+// given.
+//
+func SaveBandwidthUsage(db *sql.DB, usage []BandwidthUsage) error {
+	return withTransaction(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`delete from bandwidth`); err != nil {
+			return fmt.Errorf("Unable to clear bandwidth totals: %w", err)
+		}
+		for _, u := range usage {
+			if _, err := tx.Exec(`insert into bandwidth (user, bytesin, bytesout, since) values (?, ?, ?, ?)`,
+				u.User, int64(u.BytesIn), int64(u.BytesOut), u.Since.Unix()); err != nil {
+				return fmt.Errorf("Unable to save bandwidth totals for %s: %w", u.User, err)
+			}
+		}
+		return nil
+	})
+}
+
+//
+// LoadBandwidthUsage reads the saved traffic totals.
+//
+func LoadBandwidthUsage(db *sql.DB) ([]BandwidthUsage, error) {
+	rows, err := db.Query(`select user, bytesin, bytesout, since from bandwidth order by user`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []BandwidthUsage
+	for rows.Next() {
+		var u BandwidthUsage
+		var in, out, since int64
+		if err = rows.Scan(&u.User, &in, &out, &since); err != nil {
+			return nil, fmt.Errorf("unable to read bandwidth totals: %v", err)
+		}
+		u.BytesIn, u.BytesOut, u.Since = uint64(in), uint64(out), time.Unix(since, 0)
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,176 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for per-user bandwidth accounting
+//
+
+package mapservice
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthCounting(t *testing.T) {
+	ms := newTestService()
+	ms.BandwidthWarning = 100
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	alice.Reader = bufio.NewReader(strings.NewReader("POLO\r\nAI 3\nabc\n"))
+
+	if line, err := alice.readLine(); err != nil || line != "POLO" {
+		t.Fatalf("read %q (%v)", line, err)
+	}
+	if line, err := alice.readLine(); err != nil || line != "AI 3" {
+		t.Fatalf("read %q (%v)", line, err)
+	}
+	if frame, err := alice.readFrame(3); err != nil || string(frame) != "abc" {
+		t.Fatalf("read frame %q (%v)", frame, err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	alice.Connection = server
+	go io.Copy(io.Discard, client)
+	if err := alice.writeMessage("OK 332"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	usage := ms.BandwidthUsage()
+	if len(usage) != 1 || usage[0].User != "alice" || usage[0].BytesIn != 15 || usage[0].BytesOut != 7 {
+		t.Errorf("usage was %v", usage)
+	}
+
+	// someone who hasn't logged in yet isn't counted
+	stranger := &MapClient{Service: ms, Reader: bufio.NewReader(strings.NewReader("AUTH x\n"))}
+	stranger.readLine()
+	if len(ms.BandwidthUsage()) != 1 {
+		t.Errorf("unauthenticated traffic was counted: %v", ms.BandwidthUsage())
+	}
+
+	// passing the soft cap warns alice and the GM, but only once per multiple of it
+	alice.countBandwidth(70, 0)
+	alice.countBandwidth(10, 0)
+	time.Sleep(50 * time.Millisecond)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.Contains(sent[0], "alice has used 102 bytes") {
+		t.Errorf("alice was sent %v", sent)
+	}
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.HasPrefix(sent[0], "TO GM GM {WARNING: alice") {
+		t.Errorf("GM was sent %v", sent)
+	}
+	alice.countBandwidth(0, 10)
+	alice.countBandwidth(0, 90)
+	time.Sleep(50 * time.Millisecond)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.Contains(sent[0], "202 bytes") {
+		t.Errorf("alice was sent %v", sent)
+	}
+}
+
+func TestBandwidthStorage(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/bandwidth.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	ms.BandwidthWarning = 1000
+	alice := newTestClient(ms, "alice", "alice", false)
+	bob := newTestClient(ms, "bob", "bob", false)
+	alice.countBandwidth(1500, 20)
+	bob.countBandwidth(5, 2000000)
+	time.Sleep(50 * time.Millisecond)
+	if err = ms.SaveState(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	restarted := newTestService()
+	restarted.Storage = storage
+	restarted.BandwidthWarning = 1000
+	if err = restarted.loadBandwidth(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	usage := restarted.BandwidthUsage()
+	if len(usage) != 2 || usage[0].User != "alice" || usage[0].Total() != 1520 || usage[1].BytesOut != 2000000 || usage[1].Since.IsZero() {
+		t.Errorf("usage after restart was %v", usage)
+	}
+	// alice was already warned about passing 1000 bytes
+	carol := newTestClient(restarted, "alice", "alice", false)
+	carol.countBandwidth(10, 0)
+	time.Sleep(50 * time.Millisecond)
+	if sent := sentToTestClient(carol); len(sent) != 0 {
+		t.Errorf("alice was warned again: %v", sent)
+	}
+
+	_, admin, _ := restarted.issueAPIToken("gm", ScopeAdmin, 0)
+	_, reader, _ := restarted.issueAPIToken("overlay", ScopeReadOnly, 0)
+	if status, reply := apiTestRequest(t, restarted, "GET", "/api/v1/bandwidth", reader, ""); status != 403 {
+		t.Errorf("read-only token got %d %v", status, reply)
+	}
+	status, reply := apiTestRequest(t, restarted, "GET", "/api/v1/bandwidth", admin, "")
+	if list, ok := reply["usage"].([]interface{}); status != 200 || !ok || len(list) != 2 || reply["warning"] != 1000.0 {
+		t.Errorf("bandwidth got %d %v", status, reply)
+	}
+	status, reply = apiTestRequest(t, restarted, "DELETE", "/api/v1/bandwidth", admin, "")
+	if list, ok := reply["usage"].([]interface{}); status != 200 || !ok || len(list) != 0 {
+		t.Errorf("reset got %d %v", status, reply)
+	}
+	if saved, err := LoadBandwidthUsage(storage.(*SQLiteStorage).DB); err != nil || len(saved) != 0 {
+		t.Errorf("saved totals after reset were %v (%v)", saved, err)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
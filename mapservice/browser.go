@@ -0,0 +1,201 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Browser Support                                   //
+//                                                                                    //
+// What a web page needs to use the HTTP API directly from a browser: cross-origin    //
+// (CORS) headers for the sites we trust, and a session cookie so the page needn't    //
+// keep its API token where scripts can see it.                                       //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//
+// APISessionCookie is the cookie in which a browser keeps its API
+// token once it has logged in with POST /api/v1/session.
+//
+const APISessionCookie = "gma_api_token"
+
+//
+// OriginAllowed returns true if a web page from the given origin
+// (scheme://host[:port]) may use the HTTP API from a browser. Requests
+// without an Origin aren't from another site's page, so are always
+// allowed.
+//
+func (ms *MapService) OriginAllowed(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range ms.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Wrap the API so browsers on the allowed origins may use it (sending
+// the CORS headers they need, and answering their preflight requests).
+//
+func (ms *MapService) withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Add("Vary", "Origin")
+			if !ms.OriginAllowed(origin) {
+				if r.Method == http.MethodOptions {
+					apiError(w, http.StatusForbidden, "origin %s may not use this API", origin)
+					return
+				}
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+				if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+					w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+					w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+					w.Header().Set("Access-Control-Max-Age", "600")
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//
+// Get the API token a request was made with, from its Authorization
+// header or (for browsers) its session cookie. Since browsers send the
+// cookie whatever page made the request, it's only accepted from the
+// allowed origins. The event feed may also be given its token in the
+// URL (see FeedPath).
+//
+func (ms *MapService) requestToken(r *http.Request) (string, bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[7:]), true
+	}
+	if token := r.URL.Query().Get("token"); token != "" && r.URL.Path == FeedPath {
+		return token, true
+	}
+	if cookie, err := r.Cookie(APISessionCookie); err == nil && cookie.Value != "" && ms.OriginAllowed(r.Header.Get("Origin")) {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+//
+// POST /api/v1/session
+//   {"token": <token>}
+// Log a browser in by giving it a session cookie holding the token.
+// replies with
+//   {"id": <id>, "scope": <scope>}
+// DELETE /api/v1/session
+// Log the browser out by removing the cookie.
+//
+func (ms *MapService) apiSession(w http.ResponseWriter, r *http.Request, t APIToken) {
+	cookie := &http.Cookie{
+		Name:     APISessionCookie,
+		Path:     "/api/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if r.Method == http.MethodDelete {
+		cookie.Expires = time.Unix(0, 0)
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+		writeJSON(w, http.StatusOK, map[string]string{})
+		return
+	}
+
+	if !ms.OriginAllowed(r.Header.Get("Origin")) {
+		apiError(w, http.StatusForbidden, "origin %s may not use this API", r.Header.Get("Origin"))
+		return
+	}
+	var request struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		apiError(w, http.StatusBadRequest, "request not understood: %v", err)
+		return
+	}
+	storage, ok := ms.Storage.(TokenStorage)
+	if !ok {
+		apiError(w, http.StatusServiceUnavailable, "API tokens can't be used without a database")
+		return
+	}
+	found, ok, err := storage.LookupAPIToken(HashAPIToken(request.Token))
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "unable to check API token")
+		return
+	}
+	if !ok || found.Revoked {
+		apiError(w, http.StatusUnauthorized, "invalid API token")
+		return
+	}
+	cookie.Value = request.Token
+	http.SetCookie(w, cookie)
+	writeJSON(w, http.StatusOK, map[string]string{"id": found.ID, "scope": found.Scope})
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
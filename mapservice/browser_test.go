@@ -0,0 +1,177 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for browser support of the HTTP API
+//
+
+package mapservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	ms := newTestService()
+	ms.AllowedOrigins = []string{"https://maps.example.com"}
+	for _, tc := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://maps.example.com", true},
+		{"HTTPS://Maps.Example.com", true},
+		{"http://maps.example.com", false},
+		{"https://evil.example.com", false},
+	} {
+		if ms.OriginAllowed(tc.origin) != tc.allowed {
+			t.Errorf("origin %q allowed should be %v", tc.origin, tc.allowed)
+		}
+	}
+	ms.AllowedOrigins = []string{"*"}
+	if !ms.OriginAllowed("https://evil.example.com") {
+		t.Errorf("* should allow any origin")
+	}
+}
+
+func TestBrowserCORS(t *testing.T) {
+	ms := newTestService()
+	ms.AllowedOrigins = []string{"https://maps.example.com"}
+
+	for _, tc := range []struct {
+		origin string
+		status int
+		allow  string
+	}{
+		{"https://maps.example.com", http.StatusNoContent, "https://maps.example.com"},
+		{"https://evil.example.com", http.StatusForbidden, ""},
+	} {
+		r := httptest.NewRequest("OPTIONS", "/api/v1/chat", nil)
+		r.Header.Set("Origin", tc.origin)
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		w := httptest.NewRecorder()
+		ms.HTTPHandler().ServeHTTP(w, r)
+		if w.Code != tc.status || w.Header().Get("Access-Control-Allow-Origin") != tc.allow {
+			t.Errorf("preflight from %s got %d %v", tc.origin, w.Code, w.Header())
+		}
+		if tc.allow != "" && (w.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+			!strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), "Authorization") ||
+			!strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), "PUT")) {
+			t.Errorf("preflight from %s got headers %v", tc.origin, w.Header())
+		}
+	}
+}
+
+func TestBrowserSession(t *testing.T) {
+	ms := newTestService()
+	ms.AllowedOrigins = []string{"https://maps.example.com"}
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/api.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+	_, token, _ := ms.issueAPIToken("viewer", ScopeReadOnly, 0)
+
+	request := func(method, path, origin, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		ms.HTTPHandler().ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request("POST", "/api/v1/session", "https://maps.example.com", `{"token": "gma_x_bogus"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("login with bad token got %d %s", w.Code, w.Body.String())
+	}
+	if w := request("POST", "/api/v1/session", "https://evil.example.com", `{"token": "`+token+`"}`, nil); w.Code != http.StatusForbidden {
+		t.Errorf("login from wrong origin got %d %s", w.Code, w.Body.String())
+	}
+
+	w := request("POST", "/api/v1/session", "https://maps.example.com", `{"token": "`+token+`"}`, nil)
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cookies) != 1 {
+		t.Fatalf("login got %d %s %v", w.Code, w.Body.String(), cookies)
+	}
+	cookie := cookies[0]
+	if cookie.Name != APISessionCookie || cookie.Value != token || !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("session cookie was %+v", cookie)
+	}
+
+	if w := request("GET", "/api/v1/clients", "https://maps.example.com", "", cookie); w.Code != http.StatusOK {
+		t.Errorf("request with session cookie got %d %s", w.Code, w.Body.String())
+	}
+	if w := request("GET", "/api/v1/clients", "", "", cookie); w.Code != http.StatusOK {
+		t.Errorf("same-origin request with session cookie got %d %s", w.Code, w.Body.String())
+	}
+	if w := request("GET", "/api/v1/clients", "https://evil.example.com", "", cookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("request with session cookie from wrong origin got %d %s", w.Code, w.Body.String())
+	}
+	if w := request("POST", "/api/v1/chat", "https://maps.example.com", `{"to": ["*"], "text": "hi"}`, cookie); w.Code != http.StatusForbidden {
+		t.Errorf("session cookie should keep its token's scope, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = request("DELETE", "/api/v1/session", "https://maps.example.com", "", cookie)
+	if cookies := w.Result().Cookies(); w.Code != http.StatusOK || len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("logout got %d %v", w.Code, cookies)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
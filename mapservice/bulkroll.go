@@ -0,0 +1,123 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Bulk die rolls                                   //
+//                                                                                    //
+// Rolling a list of die-roll specifications in a single request, for tools which     //
+// need to roll many things at once, such as a full stat block or initiative for an   //
+// entire encounter.                                                                  //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+)
+
+//
+// The most die-roll specifications we'll roll in a single bulk request.
+//
+const MaxBulkRolls = 100
+
+//
+// BulkRollResult is the outcome of one of the die-roll specifications
+// given in a bulk roll request. If the spec couldn't be rolled, Error
+// says why and the other fields other than Spec are empty.
+//
+type BulkRollResult struct {
+	Spec    string             // the die-roll spec as requested
+	Title   string             // title from the spec, if any
+	Results []StructuredResult // one for each roll (more than one for repeated rolls)
+	Error   error              // why the spec couldn't be rolled, or nil
+}
+
+//
+// DoRolls rolls a list of die-roll specifications, returning a result
+// for each. Unlike DoRoll, an empty spec is an error rather than
+// a request to roll the previous spec again.
+//
+func (d *DieRoller) DoRolls(specs []string) ([]BulkRollResult, error) {
+	if len(specs) > MaxBulkRolls {
+		return nil, fmt.Errorf("Too many die-roll specs (%d) in one request; the limit is %d", len(specs), MaxBulkRolls)
+	}
+	results := make([]BulkRollResult, len(specs))
+	for i, spec := range specs {
+		results[i].Spec = spec
+		if spec == "" {
+			results[i].Error = fmt.Errorf("Empty die-roll spec")
+			continue
+		}
+		results[i].Title, results[i].Results, results[i].Error = d.DoRoll(spec)
+	}
+	return results, nil
+}
+
+//
+// Format the details of a die-roll result as a Tcl list of
+// {type value} pairs, as sent in ROLL messages.
+//
+func formatRollDetails(result StructuredResult) (string, error) {
+	var details []string
+	for _, detail := range result.Details {
+		formatted_detail, err := ToTclString([]string{detail.Type, detail.Value})
+		if err != nil {
+			return "", err
+		}
+		details = append(details, formatted_detail)
+	}
+	return ToTclString(details)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,179 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                Server Capabilities                                 //
+//                                                                                    //
+// Telling each client which of the server's optional features are turned on, and     //
+// where to find its HTTP endpoints, so it needn't find out by trial and error.       //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+//
+// A Capability is one of the optional features a server may offer, and
+// how it's set up.
+//
+type Capability struct {
+	Name  string
+	Value string
+}
+
+//
+// Capabilities lists the optional features of the server, sorted by
+// name:
+//
+//   afk              seconds idle before a user is away from the keyboard (0 for never)
+//   api              base URL of the HTTP API ("" if there isn't one)
+//   feed             URL of the public event feed ("" if there isn't one)
+//   http             base URL of the HTTP server ("" if there isn't one)
+//   image-upload     largest image (in bytes) a client may upload with AIB
+//   initiative       whether players are held to their turns in combat (off, hold, or reject)
+//   join             URL under which join-link QR codes are served ("" if they aren't)
+//   map-export       1 if the GM may save the map on the server, else 0
+//   player-polls     1 if players may open polls, 0 if only the GM may
+//   replay-buffer    most lines resent on NAK SEQ (0 if none are kept)
+//   rolls-per-minute most die rolls each user may make per minute (0 for no limit)
+//   schema           URL of the protocol schema ("" if there isn't one; see Schema)
+//   storage          1 if the game is kept in a database, else 0
+//   version          the server's version
+//
+func (ms *MapService) Capabilities() []Capability {
+	flag := func(on bool) string {
+		if on {
+			return "1"
+		}
+		return "0"
+	}
+	initiative := ms.TurnEnforcement
+	if initiative == TurnsFree {
+		initiative = "off"
+	}
+	frameSize := ms.MaxFrameSize
+	if frameSize <= 0 {
+		frameSize = DefaultMaxFrameSize
+	}
+	replay := ms.ReplayBuffer
+	if replay == 0 {
+		replay = DefaultReplayBuffer
+	} else if replay < 0 {
+		replay = 0
+	}
+	base, api, feed, join, schema := ms.httpBaseURL(), "", "", "", ""
+	if base != "" {
+		api, feed, join, schema = base+"/api/v1", base+FeedPath, base+JoinPath, base+SchemaPath
+	}
+
+	capabilities := []Capability{
+		{"afk", strconv.Itoa(int(ms.AFKAfter.Seconds()))},
+		{"api", api},
+		{"feed", feed},
+		{"http", base},
+		{"image-upload", strconv.Itoa(frameSize)},
+		{"initiative", initiative},
+		{"join", join},
+		{"map-export", flag(ms.MapExportDir != "")},
+		{"player-polls", flag(ms.PlayerPolls)},
+		{"replay-buffer", strconv.Itoa(replay)},
+		{"rolls-per-minute", strconv.Itoa(ms.MaxRollsPerMinute)},
+		{"schema", schema},
+		{"storage", flag(ms.Storage != nil || ms.Database != nil)},
+		{"version", ms.ServerVersion},
+	}
+	sort.Slice(capabilities, func(i, j int) bool { return capabilities[i].Name < capabilities[j].Name })
+	return capabilities
+}
+
+//
+// The base URL (without a trailing slash) of our HTTP server, as the
+// clients can reach it, or "" if we don't have one.
+//
+func (ms *MapService) httpBaseURL() string {
+	if ms.HTTPPort == 0 {
+		return ""
+	}
+	host, err := ms.joinHost()
+	if err != nil {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return (&url.URL{Scheme: "http", Host: net.JoinHostPort(host, strconv.Itoa(ms.HTTPPort))}).String()
+}
+
+//
+// Tell a client what the server can do:
+//   CAPS
+//   CAPS: <i> <name> <value>
+//   ...
+//   CAPS. <count> <checksum>
+// This is sent as soon as the client logs in, and again if it asks
+// with NAK CAPS 0.
+//
+func (ms *MapService) sendCapabilities(thisClient *MapClient) {
+	transfer := thisClient.startTransfer("CAPS", "CAPS")
+	for i, capability := range ms.Capabilities() {
+		transfer.Send(strconv.Itoa(i), capability.Name, capability.Value)
+	}
+	transfer.Finish()
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,163 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for advertising the server.s capabilities
+//
+
+package mapservice
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Separate the CAPS messages sent to a client from the rest.
+//
+func withoutCapabilities(sent []string) (others, caps []string) {
+	for _, message := range sent {
+		if message == "CAPS" || strings.HasPrefix(message, "CAPS: ") || strings.HasPrefix(message, "CAPS. ") {
+			caps = append(caps, message)
+		} else {
+			others = append(others, message)
+		}
+	}
+	return others, caps
+}
+
+func TestCapabilities(t *testing.T) {
+	ms := newTestService()
+	ms.AFKAfter = 5 * time.Minute
+	ms.TurnEnforcement = TurnsHold
+	ms.MaxFrameSize = 1024
+	ms.ReplayBuffer = -1
+	ms.PlayerPolls = true
+	ms.ServerVersion = "1.2.3"
+
+	expected := map[string]string{
+		"afk":              "300",
+		"api":              "",
+		"feed":             "",
+		"http":             "",
+		"image-upload":     "1024",
+		"initiative":       "hold",
+		"join":             "",
+		"map-export":       "0",
+		"player-polls":     "1",
+		"replay-buffer":    "0",
+		"rolls-per-minute": "0",
+		"schema":           "",
+		"storage":          "0",
+		"version":          "1.2.3",
+	}
+	capabilities := ms.Capabilities()
+	if len(capabilities) != len(expected) {
+		t.Errorf("capabilities are %v", capabilities)
+	}
+	for i, capability := range capabilities {
+		if value, ok := expected[capability.Name]; !ok || value != capability.Value {
+			t.Errorf("capability %s is %q, expected %q", capability.Name, capability.Value, value)
+		}
+		if i > 0 && capabilities[i-1].Name >= capability.Name {
+			t.Errorf("capabilities not sorted: %s before %s", capabilities[i-1].Name, capability.Name)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer listener.Close()
+	ms.IncomingListener = listener
+	ms.JoinHost = "gma.example.com"
+	ms.HTTPPort = 8080
+	for _, capability := range ms.Capabilities() {
+		switch capability.Name {
+			case "http":
+				if capability.Value != "http://gma.example.com:8080" {
+					t.Errorf("HTTP server is at %q", capability.Value)
+				}
+			case "api":
+				if capability.Value != "http://gma.example.com:8080/api/v1" {
+					t.Errorf("HTTP API is at %q", capability.Value)
+				}
+			case "schema":
+				if capability.Value != "http://gma.example.com:8080"+SchemaPath {
+					t.Errorf("protocol schema is at %q", capability.Value)
+				}
+			case "join":
+				if capability.Value != "http://gma.example.com:8080"+JoinPath {
+					t.Errorf("join links are at %q", capability.Value)
+				}
+		}
+	}
+}
+
+func TestCapabilitiesMessage(t *testing.T) {
+	ms := newTestService()
+	ms.ServerVersion = "1.2.3"
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "NAK CAPS 0"), alice)
+	sent := sentToTestClient(alice)
+	if len(sent) != len(ms.Capabilities())+2 || sent[0] != "CAPS" || !strings.HasPrefix(sent[len(sent)-1], "CAPS. 14 ") {
+		t.Fatalf("capabilities were sent as %q", sent)
+	}
+	if sent[len(sent)-2] != "CAPS: 13 version 1.2.3" {
+		t.Errorf("last capability sent was %q", sent[len(sent)-2])
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
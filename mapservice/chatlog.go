@@ -0,0 +1,262 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Chat Log Export                                   //
+//                                                                                    //
+// Exporting the chat and die-roll history for other programs, including as a Foundry //
+// VTT chat log, so groups playing in both can keep one record of their games.        //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+//
+// A ChatLogEntry is one chat message or die roll from the chat history,
+// in a form other programs can read.
+//
+type ChatLogEntry struct {
+	ID      int              `json:"id"`
+	Type    string           `json:"type"`              // "chat" or "roll"
+	From    string           `json:"from"`
+	To      []string         `json:"to"`                // "*" for everyone, "%" for the GM alone
+	Text    string           `json:"text,omitempty"`
+	Title   string           `json:"title,omitempty"`
+	Result  string           `json:"result,omitempty"`
+	Details []ChatRollDetail `json:"details,omitempty"`
+	Time    *time.Time       `json:"time,omitempty"`    // when the server got it, if known
+}
+
+//
+// A ChatRollDetail is one part of how a die roll's result was obtained.
+//
+type ChatRollDetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+//
+// ChatLog converts TO and ROLL events from the chat history into
+// ChatLogEntries, skipping anything else found there.
+//
+func ChatLog(events []*MapEvent) ([]ChatLogEntry, error) {
+	entries := []ChatLogEntry{}
+	for _, event := range events {
+		var entry ChatLogEntry
+		var err error
+		switch event.EventType() {
+			case "TO":
+				if len(event.Fields) < 5 {
+					continue
+				}
+				entry = ChatLogEntry{Type: "chat", From: event.Fields[1], Text: event.Fields[3]}
+			case "ROLL":
+				if len(event.Fields) < 7 {
+					continue
+				}
+				entry = ChatLogEntry{Type: "roll", From: event.Fields[1], Title: event.Fields[3], Result: event.Fields[4]}
+				if entry.Details, err = chatRollDetails(event.Fields[5]); err != nil {
+					return nil, fmt.Errorf("Unable to read die roll %v: %v", event.Fields, err)
+				}
+			default:
+				continue
+		}
+		if entry.ID, err = event.MessageID(); err != nil {
+			return nil, fmt.Errorf("Chat message %v has no message ID: %v", event.Fields, err)
+		}
+		if entry.To, err = ParseTclList(event.Fields[2]); err != nil {
+			return nil, fmt.Errorf("Unable to read recipients of %v: %v", event.Fields, err)
+		}
+		if when, ok := event.ServerTime(); ok {
+			entry.Time = &when
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func chatRollDetails(list string) ([]ChatRollDetail, error) {
+	items, err := ParseTclList(list)
+	if err != nil {
+		return nil, err
+	}
+	var details []ChatRollDetail
+	for _, item := range items {
+		pair, err := ParseTclList(item)
+		if err != nil {
+			return nil, err
+		}
+		if len(pair) == 2 {
+			details = append(details, ChatRollDetail{Type: pair[0], Value: pair[1]})
+		}
+	}
+	return details, nil
+}
+
+//
+// Foundry VTT chat message types.
+//
+const (
+	FoundryChatOOC     = 1
+	FoundryChatWhisper = 4
+)
+
+//
+// A FoundryChatMessage is a chat message in the form Foundry VTT
+// stores them in its world database.
+//
+type FoundryChatMessage struct {
+	ID        string         `json:"_id"`
+	Type      int            `json:"type"`
+	User      string         `json:"user"`
+	Timestamp int64          `json:"timestamp"`
+	Flavor    string         `json:"flavor,omitempty"`
+	Content   string         `json:"content"`
+	Speaker   FoundrySpeaker `json:"speaker"`
+	Whisper   []string       `json:"whisper"`
+	Blind     bool           `json:"blind"`
+}
+
+type FoundrySpeaker struct {
+	Alias string `json:"alias"`
+}
+
+//
+// FoundryChatLog converts chat log entries into Foundry VTT chat
+// messages. Users are identified by name (Foundry uses its own IDs,
+// which we can't know). We don't record when messages were sent, so
+// they are given timestamps a millisecond apart ending at the export
+// time, to keep them in order.
+//
+func FoundryChatLog(entries []ChatLogEntry, now time.Time) []FoundryChatMessage {
+	messages := []FoundryChatMessage{}
+	start := now.UnixNano()/int64(time.Millisecond) - int64(len(entries))
+	for i, entry := range entries {
+		message := FoundryChatMessage{
+			ID:        fmt.Sprintf("gma%013d", entry.ID),
+			Type:      FoundryChatOOC,
+			User:      entry.From,
+			Timestamp: start + int64(i) + 1,
+			Speaker:   FoundrySpeaker{Alias: entry.From},
+			Whisper:   []string{},
+		}
+		to_all := false
+		var whisper []string
+		for _, recipient := range entry.To {
+			switch recipient {
+				case "*":
+					to_all = true
+				case "%":
+					whisper = append(whisper, "GM")
+					message.Blind = true
+				default:
+					whisper = append(whisper, recipient)
+			}
+		}
+		if to_all || len(whisper) == 0 {
+			message.Blind = false
+		} else {
+			message.Type = FoundryChatWhisper
+			message.Whisper = whisper
+		}
+		if entry.Type == "roll" {
+			message.Flavor = html.EscapeString(entry.Title)
+			var details []string
+			for _, detail := range entry.Details {
+				details = append(details, detail.Value)
+			}
+			message.Content = fmt.Sprintf("<strong>%s</strong> <span class=\"gma-roll-details\">%s</span>",
+				html.EscapeString(entry.Result), html.EscapeString(strings.Join(details, "")))
+		} else {
+			message.Content = html.EscapeString(entry.Text)
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+//
+// ChatLogFormats are the formats the chat history may be exported in.
+//
+var ChatLogFormats = []string{"gma", "foundry"}
+
+//
+// Export the chat history in the given format ("gma" for ChatLogEntries
+// or "foundry" for FoundryChatMessages).
+//
+func (ms *MapService) exportChatLog(format string, now time.Time) (interface{}, error) {
+	history, err := ms.State.ChatMessages("")
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ChatLog(history)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(format) {
+		case "", "gma":
+			return entries, nil
+		case "foundry":
+			return FoundryChatLog(entries, now), nil
+	}
+	return nil, fmt.Errorf("Chat log format %s not supported (use %s)", format, strings.Join(ChatLogFormats, " or "))
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
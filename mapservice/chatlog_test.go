@@ -0,0 +1,155 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for exporting the chat history
+//
+
+package mapservice
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func chatLogTestService(t *testing.T) *MapService {
+	ms := newTestService()
+	for _, raw := range []string{
+		"TO alice * {hello <everyone>} {}",
+		"TO GM {alice bob} {psst} {}",
+		"ROLL alice % {stealth} 17 {{result 17} {separator =} {diespec 1d20} {bonus +3}} {}",
+		"POLO",
+	} {
+		event, err := NewMapEvent(raw, "", "")
+		if err != nil {
+			t.Fatalf("unable to create event: %v", err)
+		}
+		ms.State.AddChatMessage(event)
+	}
+	return ms
+}
+
+func TestChatLog(t *testing.T) {
+	ms := chatLogTestService(t)
+	history, err := ms.exportChatLog("gma", time.Now())
+	if err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	entries := history.([]ChatLogEntry)
+	if len(entries) != 3 {
+		t.Fatalf("exported %v", entries)
+	}
+	if e := entries[0]; e.Type != "chat" || e.From != "alice" || len(e.To) != 1 || e.To[0] != "*" || e.Text != "hello <everyone>" || e.ID == 0 {
+		t.Errorf("chat message exported as %v", e)
+	}
+	if e := entries[2]; e.Type != "roll" || e.Title != "stealth" || e.Result != "17" || len(e.Details) != 4 || e.Details[2] != (ChatRollDetail{"diespec", "1d20"}) {
+		t.Errorf("die roll exported as %v", e)
+	}
+	if entries[1].ID <= entries[0].ID || entries[2].ID <= entries[1].ID {
+		t.Errorf("message IDs were %d, %d, %d", entries[0].ID, entries[1].ID, entries[2].ID)
+	}
+
+	now := time.Unix(1600000000, 0)
+	history, _ = ms.exportChatLog("Foundry", now)
+	messages := history.([]FoundryChatMessage)
+	if len(messages) != 3 {
+		t.Fatalf("exported %v", messages)
+	}
+	if m := messages[0]; m.Type != FoundryChatOOC || len(m.Whisper) != 0 || m.Content != "hello &lt;everyone&gt;" || m.Speaker.Alias != "alice" || len(m.ID) != 16 {
+		t.Errorf("chat message exported as %v", m)
+	}
+	if m := messages[1]; m.Type != FoundryChatWhisper || strings.Join(m.Whisper, ",") != "alice,bob" || m.Blind {
+		t.Errorf("whisper exported as %v", m)
+	}
+	if m := messages[2]; m.Type != FoundryChatWhisper || strings.Join(m.Whisper, ",") != "GM" || !m.Blind || m.Flavor != "stealth" || m.Content != `<strong>17</strong> <span class="gma-roll-details">17=1d20+3</span>` {
+		t.Errorf("die roll exported as %v", m)
+	}
+	if messages[2].Timestamp != 1600000000000 || messages[0].Timestamp != 1599999999998 {
+		t.Errorf("timestamps were %d..%d", messages[0].Timestamp, messages[2].Timestamp)
+	}
+
+	if _, err := ms.exportChatLog("roll20", now); err == nil {
+		t.Errorf("unknown format was accepted")
+	}
+}
+
+func TestChatLogAPI(t *testing.T) {
+	ms := chatLogTestService(t)
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/api.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+	_, admin, _ := ms.issueAPIToken("archivist", ScopeAdmin, 0)
+	_, reader, _ := ms.issueAPIToken("viewer", ScopeReadOnly, 0)
+
+	if status, reply := apiTestRequest(t, ms, "GET", "/api/v1/chatlog", reader, ""); status != 403 {
+		t.Errorf("GET with read token got %d %v", status, reply)
+	}
+	if status, reply := apiTestRequest(t, ms, "GET", "/api/v1/chatlog?format=roll20", admin, ""); status != 400 {
+		t.Errorf("GET in unknown format got %d %v", status, reply)
+	}
+	r := httptest.NewRequest("GET", "/api/v1/chatlog?format=foundry", nil)
+	r.Header.Set("Authorization", "Bearer "+admin)
+	w := httptest.NewRecorder()
+	ms.HTTPHandler().ServeHTTP(w, r)
+	var messages []FoundryChatMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &messages); err != nil || w.Code != 200 || len(messages) != 3 || messages[1].Whisper[1] != "bob" {
+		t.Errorf("GET got %d %s (%v)", w.Code, w.Body.String(), err)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,292 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                Chat History Replay                                 //
+//                                                                                    //
+// Answering SYNC CHAT from the database in batches on a goroutine of its own, so one //
+// client asking for the whole chat history doesn't hold up everyone else.            //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+//
+// ChatSyncBatchSize is how many chat messages we read from the database
+// at a time when replaying the chat history for SYNC CHAT.
+//
+const ChatSyncBatchSize = 100
+
+//
+// ChatStorage is implemented by storage backends which record each chat
+// message as it's sent (rather than only when the game state is saved),
+// so SYNC CHAT can be answered from the database instead of holding up
+// the game state while the whole history is sent.
+//
+type ChatStorage interface {
+	AddChatMessage(event *MapEvent) error
+	ClearChatMessages(target string) error
+	ChatMessagesAfter(after, limit int) ([]*MapEvent, error)
+	RecentChatMessageID(n int) (int, bool, error)
+}
+
+//
+// The chats table (see SQLiteStorage.SaveState) stores message IDs as
+// text, so we index them as numbers to find our place in the history.
+//
+func createChatIndex(db *sql.DB) error {
+	_, err := db.Exec(`create index if not exists chats_msgid on chats (cast(msgid as integer));`)
+	return err
+}
+
+//
+// AddChatMessage records a chat message in the database, unless it's
+// already there (if the game state was saved just as it was sent).
+//
+func AddChatMessage(db *sql.DB, event *MapEvent) error {
+	msgid, err := event.MessageID()
+	if err != nil {
+		return err
+	}
+	rawdata, err := event.RawEventText()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`insert into chats (rawdata, msgid)
+		select ?, ? where not exists (select 1 from chats where cast(msgid as integer) = ?)`,
+		rawdata, msgid, msgid)
+	return err
+}
+
+//
+// ClearChatMessages removes messages from the chat history in the
+// database the same way GameState.ClearChat does in memory.
+//
+func ClearChatMessages(db *sql.DB, target string) error {
+	if target == "" {
+		_, err := db.Exec(`delete from chats`)
+		return err
+	}
+	n, err := strconv.Atoi(target)
+	if err != nil {
+		return fmt.Errorf("invalid target: %v", err)
+	}
+	if n < 0 {
+		_, err = db.Exec(`delete from chats where rowid not in
+			(select rowid from chats order by cast(msgid as integer) desc limit ?)`, -n)
+	} else {
+		_, err = db.Exec(`delete from chats where cast(msgid as integer) < ?`, n)
+	}
+	return err
+}
+
+//
+// ChatMessagesAfter reads up to limit chat messages with IDs greater
+// than after, in order.
+//
+func ChatMessagesAfter(db *sql.DB, after, limit int) ([]*MapEvent, error) {
+	rows, err := db.Query(`select rawdata from chats where cast(msgid as integer) > ?
+		order by cast(msgid as integer) limit ?`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*MapEvent
+	for rows.Next() {
+		var rawdata string
+		if err = rows.Scan(&rawdata); err != nil {
+			return nil, err
+		}
+		event, err := NewMapEvent(rawdata, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("stored chat message %s not understood: %v", rawdata, err)
+		}
+		messages = append(messages, event)
+	}
+	return messages, rows.Err()
+}
+
+//
+// RecentChatMessageID finds the ID of the nth most recent chat message,
+// if there are that many.
+//
+func RecentChatMessageID(db *sql.DB, n int) (int, bool, error) {
+	var msgid int
+	err := db.QueryRow(`select cast(msgid as integer) from chats
+		order by cast(msgid as integer) desc limit 1 offset ?`, n-1).Scan(&msgid)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return msgid, err == nil, err
+}
+
+//
+// Add a chat message to the game state (which assigns its message ID)
+// and, if we can, to the database right away (or once it comes back,
+// if it's unavailable).
+//
+func (ms *MapService) addChatMessage(event *MapEvent) {
+	ms.State.AddChatMessage(event)
+	if storage, ok := ms.Storage.(ChatStorage); ok {
+		ms.persist("", "a chat message", func() error {
+			return storage.AddChatMessage(event)
+		})
+	}
+}
+
+//
+// Clear the chat history as described for the CC command, in the game
+// state and the database.
+//
+func (ms *MapService) clearChat(target string) error {
+	if err := ms.State.ClearChat(target); err != nil {
+		return err
+	}
+	if storage, ok := ms.Storage.(ChatStorage); ok {
+		ms.persist("", "clearing the chat history", func() error {
+			return storage.ClearChatMessages(target)
+		})
+	}
+	return nil
+}
+
+//
+// Replay the chat history to a client for SYNC CHAT (see handleSync).
+// If the database keeps the chat messages, they're read from there in
+// batches of ChatSyncBatchSize on a goroutine of their own, so neither
+// the game state nor the client's other requests wait for it. Messages
+// sent in the meantime may reach the client before the older ones do;
+// each carries its message ID so the client can put them in order.
+//
+// While the database is unavailable, the history is sent from the game
+// state instead, which has the messages still waiting to be saved.
+//
+func (ms *MapService) syncChat(thisClient *MapClient, target string) error {
+	storage, ok := ms.Storage.(ChatStorage)
+	if !ok || ms.PersistenceStatus().Degraded {
+		messages, err := ms.State.ChatMessages(target)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			if message.CanSendTo(thisClient.Username()) {
+				thisClient.Send(message.Fields...)
+			}
+		}
+		return nil
+	}
+
+	after := 0
+	if target != "" {
+		n, err := strconv.Atoi(target)
+		if err != nil {
+			return err
+		}
+		after = n
+		if n < 0 {
+			id, found, err := storage.RecentChatMessageID(-n)
+			if err != nil {
+				return err
+			}
+			after = 0
+			if found {
+				after = id - 1
+			}
+		}
+	}
+	go func() {
+		defer ms.ReportCrash()
+		defer ms.goroutines.track(thisClient.ClientAddr, "chat-sync")()
+		if err := ms.streamChat(storage, thisClient, after); err != nil {
+			log.Printf("[client %s] SYNC CHAT stopped: %v", thisClient.logTag(), err)
+		}
+	}()
+	return nil
+}
+
+//
+// Send the client the chat messages after the given message ID, reading
+// them from the database a batch at a time.
+//
+func (ms *MapService) streamChat(storage ChatStorage, thisClient *MapClient, after int) error {
+	thisClient.beginBulk()
+	defer thisClient.endBulk()
+	for !thisClient.ReachedEOF {
+		messages, err := storage.ChatMessagesAfter(after, ChatSyncBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			if after, err = message.MessageID(); err != nil {
+				return err
+			}
+			if message.CanSendTo(thisClient.Username()) {
+				thisClient.Send(message.Fields...)
+			}
+		}
+		if len(messages) < ChatSyncBatchSize {
+			break
+		}
+	}
+	return nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,175 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for replaying the chat history
+//
+
+package mapservice
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Collect what a client is sent until it has n messages or we give up
+// waiting for the chat sync goroutine. Since there's no sender for the
+// test client, we feed its backlog into its channel as one would (and
+// leave out the MARCOs it adds to measure how the client is keeping up).
+//
+func waitForTestMessages(c *MapClient, n int) []string {
+	var sent []string
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, message := range sentToTestClient(c) {
+			if message != "MARCO" {
+				sent = append(sent, message)
+			}
+		}
+		if len(sent) >= n || time.Now().After(deadline) {
+			return sent
+		}
+		c.refillFromBacklog(true)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSyncChatFromDatabase(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/chat.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	db := storage.(*SQLiteStorage).DB
+	ms := newTestService()
+	ms.Storage = storage
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	var ids []int
+	for i := 0; i < 2*ChatSyncBatchSize+10; i++ {
+		to := "*"
+		if i%10 == 9 {
+			to = "bob"
+		}
+		event := testEvent(t, fmt.Sprintf("TO GM %s {message %d} 0", to, i))
+		ms.addChatMessage(event)
+		id, _ := event.MessageID()
+		ids = append(ids, id)
+	}
+	// saving the game state rewrites the chats table without duplicating
+	// anything, as does recording a message which is already there
+	if err = ms.Storage.SaveState(ms.State); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if err = AddChatMessage(db, ms.State.ChatHistory[0]); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	var count int
+	if err = db.QueryRow(`select count(*) from chats`).Scan(&count); err != nil || count != len(ids) {
+		t.Errorf("database holds %d messages (%v)", count, err)
+	}
+
+	handleSync(ms, testEvent(t, "SYNC CHAT"), alice)
+	sent := waitForTestMessages(alice, 189)
+	if len(sent) != 189 || !strings.Contains(sent[0], "{message 0}") || !strings.Contains(sent[188], "{message 208}") {
+		t.Errorf("SYNC CHAT sent %d messages", len(sent))
+	}
+	for _, message := range sent {
+		if strings.Contains(message, " bob ") {
+			t.Errorf("alice was sent %s", message)
+		}
+	}
+
+	handleSync(ms, testEvent(t, "SYNC CHAT -3"), alice)
+	if sent = waitForTestMessages(alice, 2); len(sent) != 2 || !strings.Contains(sent[0], "{message 207}") {
+		t.Errorf("SYNC CHAT -3 sent %v", sent)
+	}
+	handleSync(ms, testEvent(t, fmt.Sprintf("SYNC CHAT %d", ids[204])), alice)
+	if sent = waitForTestMessages(alice, 4); len(sent) != 4 || !strings.Contains(sent[0], "{message 205}") {
+		t.Errorf("SYNC CHAT <id> sent %v", sent)
+	}
+	if handleSync(ms, testEvent(t, "SYNC CHAT x"), alice); len(sentToTestClient(alice)) != 0 {
+		t.Errorf("SYNC CHAT with bad target sent something")
+	}
+
+	// clearing the chat clears the database too
+	gm := newTestClient(ms, "gm", "GM", true)
+	handleClearChat(ms, testEvent(t, "CC GM -5"), gm)
+	sentToTestClient(alice)
+	if err = db.QueryRow(`select count(*) from chats`).Scan(&count); err != nil || count != 6 {
+		t.Errorf("database holds %d messages after CC (%v)", count, err)
+	}
+	if m, _ := ms.State.ChatMessages(""); len(m) != 6 {
+		t.Errorf("game state holds %d messages after CC", len(m))
+	}
+	handleSync(ms, testEvent(t, "SYNC CHAT"), alice)
+	if sent = waitForTestMessages(alice, 5); len(sent) != 5 || !strings.HasPrefix(sent[4], "CC GM") {
+		t.Errorf("SYNC CHAT after CC sent %v", sent)
+	}
+}
+
+func TestSyncChatWithoutDatabase(t *testing.T) {
+	ms := newTestService()
+	alice := newTestClient(ms, "alice", "alice", false)
+	for i := 0; i < 3; i++ {
+		ms.addChatMessage(testEvent(t, fmt.Sprintf("TO GM * {message %d} 0", i)))
+	}
+	handleSync(ms, testEvent(t, "SYNC CHAT -2"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 2 || !strings.Contains(sent[0], "{message 1}") {
+		t.Errorf("SYNC CHAT -2 sent %v", sent)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
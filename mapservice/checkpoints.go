@@ -0,0 +1,239 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                    Checkpoints                                     //
+//                                                                                    //
+// The GM may mark the game state at some point in the session with a label (such as  //
+// "before the dragon fight"), and later roll the map back to it if a scene needs to  //
+// be retconned. Everyone is then sent the restored game state.                       //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// MaxCheckpoints is how many checkpoints the server keeps. Making
+// another forgets the oldest.
+//
+const MaxCheckpoints = 20
+
+//
+// A Checkpoint is the game state as it was when the GM marked it, so
+// it can be restored later. Chat messages aren't part of it.
+//
+type Checkpoint struct {
+	Label   string
+	Made    time.Time
+	By      string         // who made it
+	Mark    int64          // the journal position it was made at
+	Objects int            // how many objects were on the map
+	entries []JournalEntry // the game state (as journal entries)
+}
+
+//
+// checkpointList holds the checkpoints the GM has made, oldest first.
+//
+type checkpointList struct {
+	lock sync.Mutex
+	list []Checkpoint
+}
+
+//
+// Add a checkpoint, replacing any with the same label.
+//
+func (l *checkpointList) add(cp Checkpoint) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.removeLocked(cp.Label)
+	l.list = append(l.list, cp)
+	if len(l.list) > MaxCheckpoints {
+		l.list = append([]Checkpoint(nil), l.list[len(l.list)-MaxCheckpoints:]...)
+	}
+}
+
+func (l *checkpointList) find(label string) (Checkpoint, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, cp := range l.list {
+		if cp.Label == label {
+			return cp, true
+		}
+	}
+	return Checkpoint{}, false
+}
+
+func (l *checkpointList) remove(label string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.removeLocked(label)
+}
+
+func (l *checkpointList) removeLocked(label string) bool {
+	for i, cp := range l.list {
+		if cp.Label == label {
+			l.list = append(l.list[:i:i], l.list[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (l *checkpointList) all() []Checkpoint {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]Checkpoint(nil), l.list...)
+}
+
+//
+// The game state as journal entries which will restore it (see
+// restoreCheckpoint), along with the journal position it is at and
+// how many objects there are.
+//
+func (gs *GameState) checkpoint() ([]JournalEntry, int64, int) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	events := gs.allEvents()
+	sort.Sort(events)
+	var entries []JournalEntry
+	for _, event := range events {
+		entry, err := eventJournalEntry(event, event.ID, event.Class)
+		if err != nil {
+			log.Printf("Unable to include %v in checkpoint: %v", event.Fields, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, gs.journalMark(), len(gs.Objects)
+}
+
+//
+// Replace the map with the one saved in a checkpoint. The restored
+// events are new changes, made by the given user, so they are stamped
+// and journaled as such.
+//
+func (gs *GameState) restoreCheckpoint(entries []JournalEntry, user string) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+
+	gs.clearObjects("*")
+	for _, entry := range entries {
+		event, err := NewMapEvent(entry.Event, entry.ID, entry.Class)
+		if err == nil {
+			event.MultiRawData = entry.Extra
+			event.User = user
+			err = gs.record(event)
+		}
+		if err != nil {
+			log.Printf("Unable to restore %s from checkpoint: %v", entry.Event, err)
+		}
+	}
+}
+
+//
+// MakeCheckpoint saves the game state as it is now under the given
+// label, replacing any checkpoint already made with it.
+//
+func (ms *MapService) MakeCheckpoint(label, user string) Checkpoint {
+	entries, mark, objects := ms.State.checkpoint()
+	cp := Checkpoint{Label: label, Made: time.Now(), By: user, Mark: mark, Objects: objects, entries: entries}
+	ms.checkpoints.add(cp)
+	log.Printf("Checkpoint %s made by %s (%d objects, journal at %d)", label, user, objects, mark)
+	return cp
+}
+
+//
+// Checkpoints returns the checkpoints which may be rolled back to,
+// oldest first.
+//
+func (ms *MapService) Checkpoints() []Checkpoint {
+	return ms.checkpoints.all()
+}
+
+//
+// DeleteCheckpoint forgets a checkpoint, returning false if there
+// was none with that label.
+//
+func (ms *MapService) DeleteCheckpoint(label string) bool {
+	return ms.checkpoints.remove(label)
+}
+
+//
+// Rollback restores the game state saved in a checkpoint, and sends
+// it to everyone connected in place of what they had. The checkpoint
+// is kept, so the scene may be rolled back to it again.
+//
+func (ms *MapService) Rollback(label, user string) error {
+	cp, ok := ms.checkpoints.find(label)
+	if !ok {
+		return fmt.Errorf("there is no checkpoint called %s", label)
+	}
+	ms.State.restoreCheckpoint(cp.entries, user)
+	for _, peer := range ms.AllClients() {
+		if peer.Authenticated {
+			ms.Sync(peer)
+		}
+	}
+	return nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,179 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for checkpoints
+//
+
+package mapservice
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestCheckpointRollback(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "PS abc red Grax 1 M monster 3 4 0"), gm)
+	ms.ExecuteAction(testEvent(t, "OA abc {HEALTH {10 0 0 12 0 0 0 {}}}"), gm)
+	ms.ExecuteAction(testEvent(t, "CS 100 0"), gm)
+	sentToTestClient(gm)
+	sentToTestClient(alice)
+
+	// only the GM may make checkpoints
+	ms.ExecuteAction(testEvent(t, "CK {before the dragon}"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV") {
+		t.Errorf("player making a checkpoint was sent %v", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "CK {before the dragon}"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || sent[0] != "// {Checkpoint before the dragon made (1 objects on the map).}" {
+		t.Errorf("GM was sent %v", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "OA abc {HEALTH {10 8 0 12 0 0 0 {}} GX 9}"), alice)
+	ms.ExecuteAction(testEvent(t, "PS dragon red Smaug 1 H monster 5 5 0"), gm)
+	ms.ExecuteAction(testEvent(t, "CS 160 0"), gm)
+	sentToTestClient(gm)
+	sentToTestClient(alice)
+
+	ms.ExecuteAction(testEvent(t, "RB {before the dragon}"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV") {
+		t.Errorf("player rolling back was sent %v", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "RB {before the dragon}"), gm)
+	if _, ok := ms.State.Object("dragon"); ok {
+		t.Errorf("object made after the checkpoint is still there")
+	}
+	if obj, ok := ms.State.Object("abc"); !ok || obj.Attrs["HEALTH"] != "10 0 0 12 0 0 0 {}" || obj.Attrs["GX"] != "3" {
+		t.Errorf("object restored as %v", obj)
+	}
+	if fields, ok := ms.State.RecordedEvent("CS"); !ok || fields[1] != "100" {
+		t.Errorf("clock restored as %v", fields)
+	}
+
+	// everyone is sent the restored map
+	for _, c := range []*MapClient{gm, alice} {
+		sent := strings.Join(sentToTestClient(c), "\n")
+		if !strings.Contains(sent, "// {DUMP OF CURRENT GAME STATE FOLLOWS}\nCLR *") || !strings.Contains(sent, "GX:abc 3") || strings.Contains(sent, "Smaug") {
+			t.Errorf("%s was sent %q", c.Username(), sent)
+		}
+	}
+
+	// the checkpoint is kept, and may be listed and deleted
+	ms.ExecuteAction(testEvent(t, "CK?"), gm)
+	sent := sentToTestClient(gm)
+	if len(sent) != 3 || sent[0] != "CK=" || !strings.HasPrefix(sent[1], "CK: {before the dragon} ") || !strings.HasSuffix(sent[1], " GM 1") {
+		t.Errorf("CK? was answered with %v", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "CK- {before the dragon}"), gm)
+	ms.ExecuteAction(testEvent(t, "CK- {before the dragon}"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 2 || sent[0] != "// {Checkpoint before the dragon deleted.}" || sent[1] != "// {There is no checkpoint called before the dragon.}" {
+		t.Errorf("CK- was answered with %v", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "RB {before the dragon}"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "there is no checkpoint called before the dragon") {
+		t.Errorf("RB of deleted checkpoint was answered with %v", sent)
+	}
+}
+
+func TestCheckpointLimit(t *testing.T) {
+	ms := newTestService()
+	for i := 0; i <= MaxCheckpoints; i++ {
+		ms.MakeCheckpoint(fmt.Sprintf("cp%d", i), "GM")
+	}
+	ms.MakeCheckpoint("cp5", "GM")
+	checkpoints := ms.Checkpoints()
+	if len(checkpoints) != MaxCheckpoints || checkpoints[0].Label != "cp1" || checkpoints[len(checkpoints)-1].Label != "cp5" {
+		t.Errorf("checkpoints kept were %v", checkpoints)
+	}
+}
+
+func TestCheckpointJournaled(t *testing.T) {
+	dir := t.TempDir()
+	ms, journal := journalTestService(t, dir)
+	ms.UpdateState(testEvent(t, "PS abc red Grax 1 M monster 3 4 0"))
+	ms.MakeCheckpoint("start", "GM")
+	if err := ms.SaveState(); err != nil {
+		t.Fatalf("unable to save state: %v", err)
+	}
+	ms.UpdateState(testEvent(t, "OA abc {GX 10}"))
+	ms.UpdateState(testEvent(t, "PS def red Fred 1 M monster 5 4 0"))
+	if err := ms.Rollback("start", "GM"); err != nil {
+		t.Fatalf("unable to roll back: %v", err)
+	}
+	if timeline := ms.ObjectTimeline("abc", "GX"); len(timeline) != 3 || timeline[2].User != "GM" || timeline[2].Value != "3" {
+		t.Errorf("timeline was %v", timeline)
+	}
+
+	// the rollback is recovered after a crash
+	journal.Close()
+	ms.Storage.Close()
+	recovered, journal := journalTestService(t, dir)
+	defer recovered.Storage.Close()
+	defer journal.Close()
+	opts := []cmp.Option{cmpopts.IgnoreUnexported(GameState{}), cmpopts.IgnoreFields(GameState{}, "SaveNeeded")}
+	if !cmp.Equal(ms.State, recovered.State, opts...) {
+		t.Errorf("recovered state differs: %s", cmp.Diff(ms.State, recovered.State, opts...))
+	}
+	if _, ok := recovered.State.Object("def"); ok {
+		t.Errorf("object made after the checkpoint was recovered")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,250 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Client Registry                                   //
+//                                                                                    //
+// The set of clients connected to the service, with indexes for finding the clients  //
+// belonging to a user or interested in a given type of message.                      //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+//
+// ClientRegistry tracks the connected clients. Readers get an immutable
+// snapshot of the client list and its indexes without taking any lock;
+// the (much rarer) changes to the set of clients build a new snapshot
+// and swap it in. Besides the list of all clients, the snapshot is
+// indexed by client address, by username (for authenticated clients),
+// and by the message types clients have subscribed to with ACCEPT.
+//
+// The zero value is an empty registry ready for use.
+//
+type ClientRegistry struct {
+	lock     sync.Mutex   // serializes changes to the registry
+	snapshot atomic.Value // current *clientSnapshot
+}
+
+type clientSnapshot struct {
+	all         []*MapClient
+	byAddr      map[string]*MapClient
+	byUser      map[string][]*MapClient
+	acceptAll   []*MapClient            // clients with no ACCEPT restrictions
+	bySubscribe map[string][]*MapClient // other clients, by message type accepted
+}
+
+var emptyClientSnapshot = &clientSnapshot{}
+
+func (r *ClientRegistry) current() *clientSnapshot {
+	if s, ok := r.snapshot.Load().(*clientSnapshot); ok {
+		return s
+	}
+	return emptyClientSnapshot
+}
+
+//
+// Build a new snapshot from a list of clients. The caller must hold r.lock.
+//
+func (r *ClientRegistry) rebuild(clients []*MapClient) {
+	s := &clientSnapshot{
+		all:         clients,
+		byAddr:      make(map[string]*MapClient, len(clients)),
+		byUser:      make(map[string][]*MapClient),
+		bySubscribe: make(map[string][]*MapClient),
+	}
+	for _, c := range clients {
+		s.byAddr[c.ClientAddr] = c
+		if c.Authenticated {
+			s.byUser[c.Username()] = append(s.byUser[c.Username()], c)
+		}
+		if c.AcceptedList == nil {
+			s.acceptAll = append(s.acceptAll, c)
+		} else {
+			for _, t := range c.AcceptedList {
+				s.bySubscribe[t] = append(s.bySubscribe[t], c)
+			}
+		}
+	}
+	r.snapshot.Store(s)
+}
+
+//
+// Add a new client to the registry.
+//
+func (r *ClientRegistry) Add(c *MapClient) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	old := r.current()
+	if _, exists := old.byAddr[c.ClientAddr]; exists {
+		return fmt.Errorf("Already tracking a connection for client %v; unable to add another", c.ClientAddr)
+	}
+	clients := make([]*MapClient, len(old.all), len(old.all)+1)
+	copy(clients, old.all)
+	r.rebuild(append(clients, c))
+	return nil
+}
+
+//
+// Remove the client with the given address from the registry,
+// returning it (if it was there).
+//
+func (r *ClientRegistry) Remove(addr string) (*MapClient, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	old := r.current()
+	c, ok := old.byAddr[addr]
+	if !ok {
+		return nil, false
+	}
+	clients := make([]*MapClient, 0, len(old.all))
+	for _, other := range old.all {
+		if other != c {
+			clients = append(clients, other)
+		}
+	}
+	r.rebuild(clients)
+	return c, true
+}
+
+//
+// Reindex must be called after a client's username, authentication
+// status, or ACCEPT list changes.
+//
+func (r *ClientRegistry) Reindex() {
+	r.lock.Lock()
+	r.rebuild(r.current().all)
+	r.lock.Unlock()
+}
+
+//
+// All returns every registered client. The returned slice must not
+// be modified.
+//
+func (r *ClientRegistry) All() []*MapClient {
+	return r.current().all
+}
+
+//
+// Len returns the number of registered clients.
+//
+func (r *ClientRegistry) Len() int {
+	return len(r.current().all)
+}
+
+//
+// Get returns the client with the given address.
+//
+func (r *ClientRegistry) Get(addr string) (*MapClient, bool) {
+	c, ok := r.current().byAddr[addr]
+	return c, ok
+}
+
+//
+// ByUser returns the authenticated clients logged in as the given user.
+// The returned slice must not be modified.
+//
+func (r *ClientRegistry) ByUser(username string) []*MapClient {
+	return r.current().byUser[username]
+}
+
+//
+// ByUsers returns the authenticated clients logged in as any of the
+// given users, each client appearing only once.
+//
+func (r *ClientRegistry) ByUsers(usernames []string) []*MapClient {
+	s := r.current()
+	seen := make(map[string]bool)
+	var clients []*MapClient
+	for _, u := range usernames {
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		clients = append(clients, s.byUser[u]...)
+	}
+	return clients
+}
+
+//
+// Subscribers returns the clients which will accept messages of the
+// given type.
+//
+func (r *ClientRegistry) Subscribers(msgType string) []*MapClient {
+	s := r.current()
+	subscribed := s.bySubscribe[msgType]
+	if len(subscribed) == 0 {
+		return s.acceptAll
+	}
+	return append(append(make([]*MapClient, 0, len(s.acceptAll)+len(subscribed)), s.acceptAll...), subscribed...)
+}
+
+//
+// Subscribed returns only those clients which explicitly listed the
+// given message type in their ACCEPT list. This is how clients tell
+// us they understand newer message types such as AIB.
+// The returned slice must not be modified.
+//
+func (r *ClientRegistry) Subscribed(msgType string) []*MapClient {
+	return r.current().bySubscribe[msgType]
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
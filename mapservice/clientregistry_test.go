@@ -0,0 +1,128 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the client registry
+//
+
+package mapservice
+
+import (
+	"testing"
+)
+
+func clientAddrs(clients []*MapClient) map[string]bool {
+	addrs := make(map[string]bool)
+	for _, c := range clients {
+		addrs[c.ClientAddr] = true
+	}
+	return addrs
+}
+
+func TestClientRegistry(t *testing.T) {
+	var r ClientRegistry
+
+	if r.Len() != 0 || len(r.All()) != 0 {
+		t.Fatalf("new registry is not empty")
+	}
+	a1 := &MapClient{ClientAddr: "a1", Authenticated: true, Auth: &Authenticator{Username: "alice"}}
+	a2 := &MapClient{ClientAddr: "a2", Authenticated: true, Auth: &Authenticator{Username: "alice"}, AcceptedList: []string{"TO"}}
+	gm := &MapClient{ClientAddr: "gm", Authenticated: true, Auth: &Authenticator{Username: "GM"}}
+	anon := &MapClient{ClientAddr: "anon"}
+	for _, c := range []*MapClient{a1, a2, gm, anon} {
+		if err := r.Add(c); err != nil {
+			t.Fatalf("unable to add %s: %v", c.ClientAddr, err)
+		}
+	}
+	if err := r.Add(a1); err == nil {
+		t.Errorf("added the same client twice")
+	}
+
+	snapshot := r.All()
+	if len(snapshot) != 4 {
+		t.Errorf("registry has %d clients", len(snapshot))
+	}
+	if got := clientAddrs(r.ByUser("alice")); len(got) != 2 || !got["a1"] || !got["a2"] {
+		t.Errorf("ByUser(alice) = %v", got)
+	}
+	if got := clientAddrs(r.ByUsers([]string{"GM", "alice", "GM", "nobody"})); len(got) != 3 {
+		t.Errorf("ByUsers = %v", got)
+	}
+	if got := clientAddrs(r.Subscribers("TO")); len(got) != 4 {
+		t.Errorf("Subscribers(TO) = %v", got)
+	}
+	if got := clientAddrs(r.Subscribers("AV")); len(got) != 3 || got["a2"] {
+		t.Errorf("Subscribers(AV) = %v", got)
+	}
+
+	anon.Authenticated = true
+	anon.Auth = &Authenticator{Username: "bob"}
+	r.Reindex()
+	if got := r.ByUser("bob"); len(got) != 1 || got[0] != anon {
+		t.Errorf("ByUser(bob) after reindex = %v", got)
+	}
+
+	if c, ok := r.Remove("a1"); !ok || c != a1 {
+		t.Errorf("Remove(a1) returned %v %v", c, ok)
+	}
+	if _, ok := r.Remove("a1"); ok {
+		t.Errorf("removed a1 twice")
+	}
+	if _, ok := r.Get("a1"); ok || len(r.ByUser("alice")) != 1 {
+		t.Errorf("a1 still indexed after removal")
+	}
+	if len(snapshot) != 4 {
+		t.Errorf("earlier snapshot changed when client was removed")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
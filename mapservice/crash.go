@@ -0,0 +1,195 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Crash reports                                    //
+//                                                                                    //
+// When the server crashes, saving what we know about why (the panic, the stacks of   //
+// all the goroutines, the last few log lines, and how big the game state was) to a   //
+// file and optionally sending it to a webhook, so crashes out in the field can be    //
+// diagnosed afterward.                                                               //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+//
+// How many of the most recent log lines go into a crash report.
+//
+const CrashReportLogLines = 200
+
+//
+// A CrashReport is what we send to the CrashWebhook when the server
+// crashes.
+//
+type CrashReport struct {
+	Server string    `json:"server"` // the campaign name, if any
+	Time   time.Time `json:"time"`
+	Panic  string    `json:"panic"`  // what the panic was about
+	File   string    `json:"file"`   // where the full report was saved ("" if it couldn't be)
+	Report string    `json:"report"` // the full report
+}
+
+var crashOnce sync.Once
+
+//
+// ReportCrash must be deferred at the top of each of the server's
+// goroutines. If the goroutine panics, it writes a crash report (what
+// the panic was, the sizes of the game state, the last few lines
+// logged, and the stack of every goroutine) to the CrashFile, sends
+// it to the CrashWebhook if there is one, and then lets the panic
+// carry on and end the program as it would have anyway.
+//
+// If several goroutines panic at once, only the first is reported.
+//
+func (ms *MapService) ReportCrash() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if ms != nil {
+		crashOnce.Do(func() { ms.reportCrash(r) })
+	}
+	panic(r)
+}
+
+func (ms *MapService) reportCrash(r interface{}) {
+	now := time.Now()
+	report := ms.crashReport(r, now)
+	path := ms.CrashFile
+	if path == "" {
+		path = filepath.Join(os.TempDir(), "go-gma-server-crash-"+now.Format("20060102-150405")+".txt")
+	}
+	if err := os.WriteFile(path, report, 0600); err != nil {
+		log.Printf("CRASH: unable to write crash report to %s: %v", path, err)
+		path = ""
+	} else {
+		log.Printf("CRASH: %v (report written to %s)", r, path)
+	}
+	if ms.CrashWebhook != "" {
+		if err := postWebhook(ms.CrashWebhook, CrashReport{
+			Server: ms.Campaign,
+			Time:   now,
+			Panic:  fmt.Sprint(r),
+			File:   path,
+			Report: string(report),
+		}); err != nil {
+			log.Printf("CRASH: unable to send crash report: %v", err)
+		}
+	}
+}
+
+//
+// Put together the text of a crash report. The game state's locks may
+// be held by whatever panicked, so we don't take them; the sizes of
+// things are only a rough guide anyway.
+//
+func (ms *MapService) crashReport(r interface{}, now time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "go-gma-server crash report\n")
+	fmt.Fprintf(&b, "Time:      %s\n", now.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Version:   %s\n", ms.ServerVersion)
+	if !ms.Started.IsZero() {
+		fmt.Fprintf(&b, "Started:   %s (up %v)\n", ms.Started.Format(time.RFC3339), now.Sub(ms.Started).Round(time.Second))
+	}
+	if ms.Campaign != "" {
+		fmt.Fprintf(&b, "Campaign:  %s\n", ms.Campaign)
+	}
+	fmt.Fprintf(&b, "Panic:     %v\n", r)
+
+	fmt.Fprintf(&b, "\nClients:   %d connected, %s goroutines\n", ms.Clients.Len(), clientGoroutineCount.String())
+	if gs := ms.State; gs != nil {
+		fmt.Fprintf(&b, "State:     %d objects, %d events, %d chat messages, %d images, %d names\n",
+			len(gs.Objects), len(gs.EventHistory), len(gs.ChatHistory), len(gs.Images), len(gs.IdByName))
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(&b, "Memory:    %d bytes in use, %d goroutines\n", mem.HeapAlloc, runtime.NumGoroutine())
+
+	if ms.LogBuffer != nil {
+		fmt.Fprintf(&b, "\nRecent log:\n")
+		for _, line := range ms.LogBuffer.Lines(CrashReportLogLines, "") {
+			fmt.Fprintf(&b, "%s\n", line)
+		}
+	}
+
+	fmt.Fprintf(&b, "\nGoroutines:\n%s", allStacks())
+	return b.Bytes()
+}
+
+//
+// The stack traces of all goroutines.
+//
+func allStacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,227 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                 Creature Templates                                 //
+//                                                                                    //
+// A library of reusable creature templates kept in the database, so the GM can put   //
+// tokens on the map with consistent sizes, images, and attributes.                   //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+//
+// A CreatureTemplate describes a kind of creature the GM uses often,
+// so tokens for it can be put on the map with consistent attributes
+// without typing them all in every time.
+//
+type CreatureTemplate struct {
+	Name  string // unique template name (also the default creature name)
+	Image string // image the mapper shows for the token ("" to use the name)
+	Size  string // creature size
+	Color string // token color
+	Area  string // area of threat
+	Reach string // reach
+	Type  string // "monster" or "player"
+	Attrs string // other attributes as a key/value list
+}
+
+//
+// CreatureTemplateStorage is implemented by storage backends which can
+// keep a library of creature templates.
+//
+type CreatureTemplateStorage interface {
+	ListCreatureTemplates() ([]CreatureTemplate, error)
+	LoadCreatureTemplate(name string) (CreatureTemplate, bool, error)
+	SaveCreatureTemplate(tmpl CreatureTemplate) error
+	DeleteCreatureTemplate(name string) (bool, error)
+}
+
+//
+// Database Schema
+//  ___________________
+// | creaturetemplates |
+// |-------------------|
+// | name           Ps |
+// | image           s |
+// | size            s |
+// | color           s |
+// | area            s |
+// | reach           s |
+// | type            s |
+// | attrs           s |
+// |___________________|
+//
+// P=primary key
+// s=string
+//
+// This table was added after the others, so it is created whenever we
+// open a database which doesn't have it yet.
+//
+func createCreatureTemplateTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists creaturetemplates (
+			name  text primary key,
+			image text not null,
+			size  text not null,
+			color text not null,
+			area  text not null,
+			reach text not null,
+			type  text not null,
+			attrs text not null
+		);`)
+	return err
+}
+
+//
+// LoadCreatureTemplates reads all of the creature templates in the
+// database (or just the one with the given name, if name isn't
+// empty), sorted by name.
+//
+func LoadCreatureTemplates(db *sql.DB, name string) ([]CreatureTemplate, error) {
+	query := `select name, image, size, color, area, reach, type, attrs from creaturetemplates`
+	var args []interface{}
+	if name != "" {
+		query += ` where name = ?`
+		args = append(args, name)
+	}
+	rows, err := db.Query(query+` order by name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var templates []CreatureTemplate
+	for rows.Next() {
+		var t CreatureTemplate
+		if err = rows.Scan(&t.Name, &t.Image, &t.Size, &t.Color, &t.Area, &t.Reach, &t.Type, &t.Attrs); err != nil {
+			return nil, fmt.Errorf("unable to read creature templates: %v", err)
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+//
+// SaveCreatureTemplate stores a creature template, replacing any
+// existing one with the same name.
+//
+func SaveCreatureTemplate(db *sql.DB, t CreatureTemplate) error {
+	if _, err := db.Exec(`
+		insert or replace into creaturetemplates (name, image, size, color, area, reach, type, attrs)
+			values (?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.Name, t.Image, t.Size, t.Color, t.Area, t.Reach, t.Type, t.Attrs); err != nil {
+		return fmt.Errorf("Unable to save creature template %s: %v", t.Name, err)
+	}
+	return nil
+}
+
+//
+// DeleteCreatureTemplate removes a creature template. It returns
+// false if there was no such template.
+//
+func DeleteCreatureTemplate(db *sql.DB, name string) (bool, error) {
+	result, err := db.Exec(`delete from creaturetemplates where name = ?`, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+//
+// Make sure a creature template makes sense before we store it.
+//
+func (t CreatureTemplate) check() error {
+	if t.Name == "" {
+		return fmt.Errorf("Creature templates must have a name")
+	}
+	if t.Type != "monster" && t.Type != "player" {
+		return fmt.Errorf("Creature type \"%s\" must be monster or player", t.Type)
+	}
+	if attrs, err := ParseTclList(t.Attrs); err != nil || len(attrs)%2 != 0 {
+		return fmt.Errorf("Creature template attributes must be a list of names and values")
+	}
+	return nil
+}
+
+//
+// PlaceFromTemplate puts a new creature token on the map at grid location
+// (x, y), with the size, image, and attributes from the template. If name
+// is empty, the template's name is used (numbered if there are already
+// creatures by that name). If id is empty, a new one is made up.
+// It returns the events which create the creature, which have already
+// been applied to the game state.
+//
+func (gs *GameState) PlaceFromTemplate(t CreatureTemplate, name, id string, x, y int) ([]*MapEvent, error) {
+	var err error
+	if id == "" {
+		if id, err = newObjectID(); err != nil {
+			return nil, err
+		}
+	}
+	if name == "" {
+		name = gs.unusedCreatureName(t.Name, false)
+	}
+	if t.Image != "" {
+		name = t.Image + "=" + name
+	}
+	return gs.placeCreature(id, t.Color, name, t.Area, t.Size, t.Type, x, y, t.Reach, t.Attrs)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
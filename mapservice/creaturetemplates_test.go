@@ -0,0 +1,129 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for creature templates
+//
+
+package mapservice
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCreatureTemplates(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", filepath.Join(t.TempDir(), "templates.db"))
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ts, ok := storage.(CreatureTemplateStorage)
+	if !ok {
+		t.Fatalf("sqlite storage doesn't store creature templates")
+	}
+
+	orc := CreatureTemplate{Name: "orc", Image: "orc_warrior", Size: "M", Color: "red", Area: "1", Reach: "0", Type: "monster", Attrs: "INIT_mod 1"}
+	wolf := CreatureTemplate{Name: "wolf", Size: "M", Color: "grey", Area: "1", Reach: "0", Type: "monster"}
+	for _, tmpl := range []CreatureTemplate{wolf, orc, wolf} {
+		if err = tmpl.check(); err != nil {
+			t.Errorf("template %s not valid: %v", tmpl.Name, err)
+		}
+		if err = ts.SaveCreatureTemplate(tmpl); err != nil {
+			t.Fatalf("unable to save template %s: %v", tmpl.Name, err)
+		}
+	}
+	if all, err := ts.ListCreatureTemplates(); err != nil || !cmp.Equal(all, []CreatureTemplate{orc, wolf}) {
+		t.Errorf("template list was %v, %v", all, err)
+	}
+	if tmpl, ok, err := ts.LoadCreatureTemplate("orc"); !ok || err != nil || tmpl != orc {
+		t.Errorf("loaded template %v, %v, %v", tmpl, ok, err)
+	}
+	if found, err := ts.DeleteCreatureTemplate("wolf"); !found || err != nil {
+		t.Errorf("deleting wolf gave %v, %v", found, err)
+	}
+	if _, ok, err := ts.LoadCreatureTemplate("wolf"); ok || err != nil {
+		t.Errorf("deleted template still loads: %v, %v", ok, err)
+	}
+
+	for _, bad := range []CreatureTemplate{{Type: "monster"}, {Name: "x", Type: "npc"}, {Name: "x", Type: "player", Attrs: "HP"}} {
+		if bad.check() == nil {
+			t.Errorf("template %v accepted", bad)
+		}
+	}
+
+	gs := NewGameState()
+	for _, name := range []string{"", "", "Grukk"} {
+		if _, err := gs.PlaceFromTemplate(orc, name, "", 1, 2); err != nil {
+			t.Fatalf("unable to place orc: %v", err)
+		}
+	}
+	events, err := gs.PlaceFromTemplate(wolf, "", "w1", 3, 4)
+	if err != nil || len(events) != 1 || events[0].Fields[1] != "w1" {
+		t.Errorf("placing wolf gave %v, %v", events, err)
+	}
+	for _, name := range []string{"orc", "orc#1", "Grukk"} {
+		id, _, known := gs.ResolveObject("@" + name)
+		if !known {
+			t.Errorf("%s not placed", name)
+			continue
+		}
+		obj, _ := gs.Object(id)
+		if obj.Attrs["NAME"] != "orc_warrior="+name || obj.Attrs["INIT_mod"] != "1" || obj.Attrs["COLOR"] != "red" {
+			t.Errorf("%s placed as %v", name, obj.Attrs)
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,232 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                    Dead Letters                                    //
+//                                                                                    //
+// Private chat messages sent to players who weren't connected, held in the database  //
+// until they next log in.                                                            //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+//
+// A DeadLetter is a private chat message sent to a player who wasn't
+// connected at the time, held until they next log in.
+//
+type DeadLetter struct {
+	Time   time.Time // when it was sent
+	Fields []string  // the TO message as it was sent
+}
+
+//
+// DeadLetterStorage is implemented by storage backends which can hold
+// private messages for players who aren't connected.
+//
+type DeadLetterStorage interface {
+	SaveDeadLetter(recipients []string, letter DeadLetter) error
+	TakeDeadLetters(user string) ([]DeadLetter, error)
+}
+
+//
+// Database Schema
+//  ________________
+// | deadletters    |
+// |----------------|
+// | letterid   PAi |
+// | recipient    s |
+// | time         i |
+// | message      s |
+// |________________|
+//
+// P=primary key
+// A=auto-increment
+// i=integer
+// s=string
+//
+// The time is stored as seconds since the epoch, and the message as
+// a Tcl list of the TO message's fields.
+//
+func createDeadLetterTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists deadletters (
+			letterid  integer primary key,
+			recipient text    not null,
+			time      integer not null,
+			message   text    not null
+		);
+		create index if not exists deadletter_recipient on deadletters (recipient);`)
+	return err
+}
+
+//
+// SaveDeadLetter holds a message for each of the recipients.
+//
+func SaveDeadLetter(db *sql.DB, recipients []string, letter DeadLetter) error {
+	message, err := ToTclString(letter.Fields)
+	if err != nil {
+		return err
+	}
+	return withTransaction(db, func(tx *sql.Tx) error {
+		for _, recipient := range recipients {
+			if _, err := tx.Exec(`insert into deadletters (recipient, time, message) values (?, ?, ?)`,
+				recipient, letter.Time.Unix(), message); err != nil {
+				return fmt.Errorf("Unable to hold message for %s: %w", recipient, err)
+			}
+		}
+		return nil
+	})
+}
+
+//
+// TakeDeadLetters removes the messages held for a user and returns
+// them in the order they were sent.
+//
+func TakeDeadLetters(db *sql.DB, user string) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := withTransaction(db, func(tx *sql.Tx) error {
+		letters = nil
+		rows, err := tx.Query(`select time, message from deadletters where recipient = ? order by letterid`, user)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var when int64
+			var message string
+			if err = rows.Scan(&when, &message); err != nil {
+				return fmt.Errorf("unable to read dead letters: %w", err)
+			}
+			fields, err := ParseTclList(message)
+			if err != nil {
+				return fmt.Errorf("unable to understand dead letter %q: %v", message, err)
+			}
+			letters = append(letters, DeadLetter{Time: time.Unix(when, 0), Fields: fields})
+		}
+		rows.Close()
+		if _, err = tx.Exec(`delete from deadletters where recipient = ?`, user); err != nil {
+			return fmt.Errorf("Unable to remove delivered dead letters: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
+
+//
+// Hold a private chat message for any of its recipients who aren't
+// connected, returning their names. Messages to everyone aren't held,
+// nor (if we have no database to keep them in) are any others.
+//
+func (ms *MapService) holdForOfflineRecipients(event *MapEvent, to_list []string) []string {
+	storage, ok := ms.Storage.(DeadLetterStorage)
+	if !ok {
+		return nil
+	}
+	var offline []string
+	seen := make(map[string]bool)
+	for _, recipient := range to_list {
+		if recipient == "*" {
+			return nil
+		}
+		if recipient == "" || seen[recipient] || recipient == event.Fields[1] {
+			continue
+		}
+		seen[recipient] = true
+		if len(ms.Clients.ByUser(recipient)) == 0 {
+			offline = append(offline, recipient)
+		}
+	}
+	if offline == nil {
+		return nil
+	}
+	if err := storage.SaveDeadLetter(offline, DeadLetter{Time: time.Now(), Fields: event.Fields}); err != nil {
+		log.Printf("Unable to hold message from %s for %s: %v", event.Fields[1], strings.Join(offline, ", "), err)
+		return nil
+	}
+	return offline
+}
+
+//
+// Deliver any private messages held for a player while they were away.
+//
+func (ms *MapService) deliverDeadLetters(thisClient *MapClient) {
+	storage, ok := ms.Storage.(DeadLetterStorage)
+	if !ok || !thisClient.Authenticated || thisClient.Auth == nil {
+		return
+	}
+	letters, err := storage.TakeDeadLetters(thisClient.Username())
+	if err != nil {
+		log.Printf("[client %s] Unable to retrieve messages held for %s: %v", thisClient.logTag(), thisClient.Username(), err)
+		return
+	}
+	if len(letters) > 0 {
+		log.Printf("[client %s] delivering %d message%s held for %s", thisClient.logTag(), len(letters), plural(len(letters)), thisClient.Username())
+	}
+	for _, letter := range letters {
+		thisClient.Send(letter.Fields...)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,189 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                Debugging log topics                                //
+//                                                                                    //
+// Optional debugging messages, grouped by topic, each topic sent to a destination of //
+// its own (the server's log, a file, or an in-memory buffer) so that tracing every   //
+// line sent to every client doesn't drown out the rest of the log.                   //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+//
+// A DebugTopic names one kind of debugging message the server can log.
+// None of them are logged unless turned on with SetDebugSinks.
+//
+type DebugTopic string
+
+const (
+	DebugConnections DebugTopic = "connections" // each client's sender starting and stopping
+	DebugExtensions  DebugTopic = "extensions"  // messages claimed by an extension's interceptor
+	DebugIO          DebugTopic = "io"          // each line queued for, sent to, or withheld from a client
+)
+
+//
+// DebugTopics lists all the debugging topics there are.
+//
+var DebugTopics = []DebugTopic{DebugConnections, DebugExtensions, DebugIO}
+
+//
+// Where each debugging topic's messages go. A topic with no logger
+// isn't being logged at all; one being kept in memory has a buffer too.
+//
+var debugSinks struct {
+	lock    sync.RWMutex
+	loggers map[DebugTopic]*log.Logger
+	buffers map[DebugTopic]*LogBuffer
+}
+
+//
+// The logger for a debugging topic, or nil if no one is listening to
+// it, so callers needn't go to the trouble of logging anything:
+//   if d := debugLog(DebugIO); d != nil {
+//       d.Printf(...)
+//   }
+//
+func debugLog(topic DebugTopic) *log.Logger {
+	debugSinks.lock.RLock()
+	defer debugSinks.lock.RUnlock()
+	return debugSinks.loggers[topic]
+}
+
+//
+// The buffer holding a debugging topic's recent messages, or nil if
+// it isn't being kept in one.
+//
+func debugBuffer(topic DebugTopic) *LogBuffer {
+	debugSinks.lock.RLock()
+	defer debugSinks.lock.RUnlock()
+	return debugSinks.buffers[topic]
+}
+
+//
+// SetDebugSinks turns on the debugging topics given in spec, a
+// comma-separated list of topic[=destination], and turns all the
+// others off. The destination may be "log" (the default) for the
+// server's own log, "buffer" to keep the topic's last
+// DefaultLogBufferLines lines in memory for the HTTP API, or the name
+// of a file to append them to. Returns the files it opened, for the
+// caller to close when the server exits.
+//
+func SetDebugSinks(spec string) ([]*os.File, error) {
+	loggers := make(map[DebugTopic]*log.Logger)
+	buffers := make(map[DebugTopic]*LogBuffer)
+	files := make(map[string]*os.File)
+	var opened []*os.File
+	fail := func(err error) ([]*os.File, error) {
+		for _, f := range opened {
+			f.Close()
+		}
+		return nil, err
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		topic, destination := DebugTopic(item), "log"
+		if eq := strings.IndexByte(item, '='); eq >= 0 {
+			topic, destination = DebugTopic(item[:eq]), item[eq+1:]
+		}
+		known := false
+		for _, t := range DebugTopics {
+			known = known || t == topic
+		}
+		if !known {
+			return fail(fmt.Errorf("there is no debugging topic \"%s\"", topic))
+		}
+
+		prefix := fmt.Sprintf("[debug %s] ", topic)
+		switch destination {
+			case "", "log":
+				loggers[topic] = log.New(log.Writer(), prefix, log.LstdFlags|log.Lmsgprefix)
+
+			case "buffer":
+				buffers[topic] = NewLogBuffer(DefaultLogBufferLines)
+				loggers[topic] = log.New(buffers[topic], prefix, log.LstdFlags|log.Lmsgprefix)
+
+			default:
+				f, ok := files[destination]
+				if !ok {
+					var err error
+					if f, err = os.OpenFile(destination, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+						return fail(fmt.Errorf("unable to open debugging log for %s: %v", topic, err))
+					}
+					files[destination] = f
+					opened = append(opened, f)
+				}
+				loggers[topic] = log.New(f, prefix, log.LstdFlags|log.Lmsgprefix)
+		}
+	}
+
+	debugSinks.lock.Lock()
+	debugSinks.loggers = loggers
+	debugSinks.buffers = buffers
+	debugSinks.lock.Unlock()
+	return opened, nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,111 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for debugging log topics
+//
+
+package mapservice
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDebugSinks(t *testing.T) {
+	defer SetDebugSinks("")
+	if _, err := SetDebugSinks("io,bogus=log"); err == nil {
+		t.Errorf("unknown topic was accepted")
+	}
+	path := filepath.Join(t.TempDir(), "debug.log")
+	files, err := SetDebugSinks("io=buffer, connections=" + path)
+	if err != nil {
+		t.Fatalf("unable to set debug sinks: %v", err)
+	}
+	defer files[0].Close()
+	if debugLog(DebugExtensions) != nil {
+		t.Errorf("extensions topic is being logged")
+	}
+
+	ms := newTestService()
+	alice := newTestClient(ms, "alice", "alice", false)
+	alice.Send("TO", "GM", "alice", "hello", "1")
+	lines := debugBuffer(DebugIO).Lines(0, "")
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], "[debug io] [client alice] chan<-TO GM alice hello 1") {
+		t.Errorf("io buffer has %q", lines)
+	}
+	debugLog(DebugConnections).Printf("[client alice] launched backgroundSender")
+	if data, err := os.ReadFile(path); err != nil || !strings.Contains(string(data), "[debug connections] [client alice] launched") {
+		t.Errorf("connections log has %q (%v)", data, err)
+	}
+
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/log.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+	_, admin, _ := ms.issueAPIToken("admin", ScopeAdmin, 0)
+	status, reply := apiTestRequest(t, ms, "GET", "/api/v1/log?topic=io", admin, "")
+	if got, _ := reply["lines"].([]interface{}); status != http.StatusOK || len(got) != 1 {
+		t.Errorf("io topic gave %d %v", status, reply)
+	}
+	if status, _ = apiTestRequest(t, ms, "GET", "/api/v1/log?topic=connections", admin, ""); status != http.StatusNotFound {
+		t.Errorf("unbuffered topic gave %d", status)
+	}
+}
+
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,194 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                            Duplicate relay suppression                             //
+//                                                                                    //
+// Dropping exact repeats of relayed messages from a client, so a client bug which    //
+// retransmits the same event over and over doesn't multiply into that much more      //
+// traffic for every other client.                                                    //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"crypto/sha256"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Unless configured otherwise, a relayed message which repeats exactly
+// what the same client said about the same thing within this long is
+// dropped as a duplicate.
+//
+const DefaultDedupWindow = 2 * time.Second
+
+//
+// relayHistory remembers, for each thing a client has sent relayed
+// messages about (each event key, or each message type for messages
+// which have none), a hash of the last such message and when it
+// arrived.
+//
+// We only ever compare a message with the last one about the same
+// thing, so a client which sets an attribute, changes it, then sets
+// it back again right away still has all three relayed. Only a straight
+// repetition (as from a client bug retransmitting an event) is dropped.
+//
+type relayHistory struct {
+	lock  sync.Mutex
+	epoch uint32 // the MapService's relayEpoch when this history was started
+	last  map[string]relayedMessage
+}
+
+type relayedMessage struct {
+	hash [32]byte
+	when time.Time
+}
+
+//
+// Note that a message is being relayed at time now, returning true
+// if it is the same as the last one about the same thing, received
+// within window of it. If epoch has moved on since the history was
+// started, it is forgotten first.
+//
+func (h *relayHistory) repeated(slot string, hash [32]byte, now time.Time, window time.Duration, epoch uint32) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.last == nil || h.epoch != epoch {
+		h.last = make(map[string]relayedMessage)
+		h.epoch = epoch
+	}
+	prev, ok := h.last[slot]
+	if ok && prev.hash == hash && now.Sub(prev.when) < window {
+		return true
+	}
+	// Don't let the history grow without bound as the client sends
+	// messages about more and more things.
+	if !ok {
+		for k, v := range h.last {
+			if now.Sub(v.when) >= window {
+				delete(h.last, k)
+			}
+		}
+	}
+	h.last[slot] = relayedMessage{hash: hash, when: now}
+	return false
+}
+
+func relayedMessageHash(event *MapEvent) [32]byte {
+	d := sha256.New()
+	for _, f := range event.Fields {
+		d.Write([]byte(f))
+		d.Write([]byte{0})
+	}
+	d.Write([]byte{1})
+	for _, r := range event.MultiRawData {
+		d.Write([]byte(r))
+		d.Write([]byte{0})
+	}
+	var hash [32]byte
+	copy(hash[:], d.Sum(nil))
+	return hash
+}
+
+//
+// How long a repeated relayed message is considered a duplicate.
+// Zero or less means we don't look for duplicates at all.
+//
+func (ms *MapService) dedupWindow() time.Duration {
+	if ms.DedupWindow == 0 {
+		return DefaultDedupWindow
+	}
+	return ms.DedupWindow
+}
+
+//
+// Check a message from a client before it is relayed to the others.
+// If it is an exact repeat of what the client just told us, we log
+// and count it, and return true so the caller drops it rather than
+// passing the same thing along to every other client again.
+//
+// Any change to the game state by a message which isn't marked for
+// deduplication (such as a CLR, which may remove the things earlier
+// messages created) makes us forget every client's history, so what
+// comes after it is always relayed.
+//
+func (ms *MapService) duplicateRelay(event *MapEvent, handler MessageHandler, thisClient *MapClient) bool {
+	window := ms.dedupWindow()
+	if window <= 0 {
+		return false
+	}
+	if !handler.Deduplicate {
+		if handler.RecordsEvent {
+			atomic.AddUint32(&ms.relayEpoch, 1)
+		}
+		return false
+	}
+	slot := event.Key
+	if slot == "" {
+		slot = event.EventType()
+	}
+	if !thisClient.recent.repeated(slot, relayedMessageHash(event), time.Now(), window, atomic.LoadUint32(&ms.relayEpoch)) {
+		return false
+	}
+	log.Printf("[client %s] Dropped duplicate %s event", thisClient.logTag(), event.EventType())
+	ms.metrics.countDuplicate()
+	return true
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
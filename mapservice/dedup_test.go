@@ -0,0 +1,127 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for duplicate relay suppression
+//
+
+package mapservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedup_Relay(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	bob := newTestClient(ms, "bob", "bob", false)
+
+	for i := 0; i < 10; i++ {
+		ms.ExecuteAction(testEvent(t, "OA abc {GX 10}"), alice)
+	}
+	if sent := sentToTestClient(gm); len(sent) != 1 {
+		t.Errorf("repeated OA was relayed as %q", sent)
+	}
+	if n := ms.DuplicatesDropped(); n != 9 {
+		t.Errorf("counted %d duplicates dropped, expected 9", n)
+	}
+
+	// the same thing from someone else is not a duplicate
+	ms.ExecuteAction(testEvent(t, "OA abc {GX 10}"), bob)
+	if sent := sentToTestClient(gm); len(sent) != 1 {
+		t.Errorf("bob's OA was relayed as %q", sent)
+	}
+
+	// nor is changing something and then changing it back
+	for _, raw := range []string{"OA abc {GX 11}", "OA abc {GX 10}", "OA abc {GY 3}", "OA abc {GX 10}"} {
+		ms.ExecuteAction(testEvent(t, raw), alice)
+	}
+	if sent := sentToTestClient(gm); len(sent) != 3 {
+		t.Errorf("alternating OAs were relayed as %q", sent)
+	}
+
+	// anything which may undo what went before starts over
+	ms.ExecuteAction(testEvent(t, "// hello"), alice)
+	ms.ExecuteAction(testEvent(t, "CLR abc"), gm)
+	ms.ExecuteAction(testEvent(t, "// hello"), alice)
+	ms.ExecuteAction(testEvent(t, "CLR abc"), alice)
+	ms.ExecuteAction(testEvent(t, "// hello"), alice)
+	if sent := sentToTestClient(bob); len(sent) != 9 {
+		t.Errorf("bob was sent %q", sent)
+	}
+}
+
+func TestDedup_Window(t *testing.T) {
+	ms := newTestService()
+	ms.DedupWindow = 50 * time.Millisecond
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "// hello"), alice)
+	ms.ExecuteAction(testEvent(t, "// hello"), alice)
+	time.Sleep(60 * time.Millisecond)
+	ms.ExecuteAction(testEvent(t, "// hello"), alice)
+	if sent := sentToTestClient(gm); len(sent) != 2 {
+		t.Errorf("gm was sent %q", sent)
+	}
+
+	ms.DedupWindow = -1
+	ms.ExecuteAction(testEvent(t, "// hello"), alice)
+	ms.ExecuteAction(testEvent(t, "// hello"), alice)
+	if sent := sentToTestClient(gm); len(sent) != 2 {
+		t.Errorf("with no window, gm was sent %q", sent)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -34,16 +34,12 @@ import (
 	"regexp"
 	"strings"
 	"strconv"
-	"github.com/schwarmco/go-cartesian-product"
 )
 
 //
 // Seed the random number generator with a very random seed.
-// TODO: For now, this is sufficient to support the die-rolling
-//       needs of the server. However, if we implement more of the
-//       core GMA to Go, this needs to change so that each Dice object
-//       can have its own random number generator which can be seeded
-//       independently.
+// This is used by any Dice object which wasn't given its own
+// RandomSource.
 //
 func init() {
 	s, err := cryptorand.Int(cryptorand.Reader, big.NewInt(0xffffffff))
@@ -54,6 +50,26 @@ func init() {
 	rand.Seed(s.Int64())
 }
 
+//
+// RandomSource is where dice get their random numbers. It is satisfied
+// by *rand.Rand, so a seeded generator may be used to get the same
+// rolls every time (e.g., for testing).
+//
+type RandomSource interface {
+	Int31n(n int32) int32
+}
+
+//
+// Get a random number in [0,n) from r, or from the package-wide
+// generator if r is nil.
+//
+func randomInt31n(r RandomSource, n int32) int32 {
+	if r == nil {
+		return rand.Int31n(n)
+	}
+	return r.Int31n(n)
+}
+
 //////////////////////////////////////////////////////////////////////////////////
 //  ____  _          
 // |  _ \(_) ___ ___ 
@@ -76,6 +92,7 @@ type Dice struct {
 	_onlydie	*DieSpec		// for single-die rolls, this is the lone die
 	Rolled      bool			// have we rolled the dice yet?
 	LastValue	int				// --result of last roll
+	Random		RandomSource	// source of random numbers (nil for the default)
 }
 
 
@@ -129,6 +146,7 @@ type DieComponent interface {
 	ApplyOp(x, y int)			(int, error)
 	Evaluate(x int)				(int, error)
 	MaxValue(x int)				(int, error)
+	Range()						(int, int)
 	LastValue()					int
 	Description()				string
 	StructuredDescribeRoll()	[]StructuredDescription
@@ -159,6 +177,10 @@ func (d *DieConstant) MaxValue(x int) (int, error) {
 	return _apply_op(d.Operator, x, d.Value)
 }
 
+func (d *DieConstant) Range() (int, int) {
+	return d.Value, d.Value
+}
+
 func (d *DieConstant) LastValue() int {
 	return d.Value
 }
@@ -216,6 +238,7 @@ type DieSpec struct {
 	History			[][]int
 	WasMaximized	bool
 	_natural        int
+	random			RandomSource
 }
 
 func (d *DieSpec) GetOperator() string { return d.Operator }
@@ -279,7 +302,7 @@ func (d *DieSpec) Evaluate(x int) (int, error) {
 			if d.InitialMax && j == 0 {
 				v = d.Sides + d.DieBonus
 			} else {
-				v = int(rand.Int31n(int32(d.Sides))) + 1 + d.DieBonus
+				v = int(randomInt31n(d.random, int32(d.Sides))) + 1 + d.DieBonus
 			}
 			if d.Denominator > 0 {
 				v /= d.Denominator
@@ -337,6 +360,29 @@ func (d *DieSpec) MaxValue(x int) (int, error) {
 	return _apply_op(d.Operator, x, d.Value)
 }
 
+//
+// The lowest and highest values this die spec could produce,
+// without actually rolling anything.
+//
+func (d *DieSpec) Range() (int, int) {
+	one_die := func(v int) int {
+		v += d.DieBonus
+		if d.Denominator > 0 {
+			v /= d.Denominator
+			if v < 1 {
+				v = 1
+			}
+		}
+		return v
+	}
+	low := d.Numerator * one_die(1)
+	high := d.Numerator * one_die(d.Sides)
+	if d.InitialMax && d.Numerator > 0 {
+		low += one_die(d.Sides) - one_die(1)
+	}
+	return low, high
+}
+
 func (d *DieSpec) LastValue() int {
 	return d.Value
 }
@@ -677,6 +723,53 @@ func NewDiceByParameters(qty, sides, bonus, diebonus, div, factor int) (*Dice, e
 	return d,nil
 }
 
+//
+// Range figures out the lowest and highest possible results of
+// rolling these dice, without rolling them.
+//
+func (d *Dice) Range() (int, int, error) {
+	low, high := 0, 0
+	for _, die := range d.MultiDice {
+		die_low, die_high := die.Range()
+		op := die.GetOperator()
+		if (op == "//" || op == "÷") && die_low <= 0 && die_high >= 0 {
+			return 0, 0, fmt.Errorf("Die roll could divide by zero")
+		}
+		//
+		// All of our operators are monotonic in each operand (as long
+		// as we don't divide by zero), so the extremes of the result
+		// will be found at the extremes of the operands.
+		//
+		first := true
+		var new_low, new_high int
+		for _, x := range []int{low, high} {
+			for _, y := range []int{die_low, die_high} {
+				v, err := _apply_op(op, x, y)
+				if err != nil {
+					return 0, 0, err
+				}
+				if first || v < new_low {
+					new_low = v
+				}
+				if first || v > new_high {
+					new_high = v
+				}
+				first = false
+			}
+		}
+		low, high = new_low, new_high
+	}
+	if d.MaxValue > 0 {
+		if low > d.MaxValue { low = d.MaxValue }
+		if high > d.MaxValue { high = d.MaxValue }
+	}
+	if d.MinValue > 0 {
+		if low < d.MinValue { low = d.MinValue }
+		if high < d.MinValue { high = d.MinValue }
+	}
+	return low, high, nil
+}
+
 func (d *Dice) Roll() (int, error) {
 	return d.RollToConfirm(false, 0, 0)
 }
@@ -748,6 +841,9 @@ func (d *Dice) RollToConfirm(confirm bool, threat int, bonus int) (int, error) {
 	var err error
 
 	for _, die := range d.MultiDice {
+		if spec, ok := die.(*DieSpec); ok {
+			spec.random = d.Random
+		}
 		roll_sum, err = die.Evaluate(roll_sum)
 		if err != nil {
 			return 0, err
@@ -859,7 +955,38 @@ func (d *Dice) StructuredDescribeRoll(sfOpt, successMessage, failureMessage stri
 // a die roll.
 //////////////////////////////////////////////////////////////////////////////
 
+//
+// DiceLimits keeps a die-roll spec from making us do an unreasonable
+// amount of work.
+//
+type DiceLimits struct {
+	MaxPermutations	int		// most permutations a spec may expand to (0 for default)
+	MaxRolls		int		// most rolls a single spec may make (0 for default)
+}
+
+const (
+	DefaultMaxPermutations = 100
+	DefaultMaxRolls        = 100
+)
+
+func (l DiceLimits) maxPermutations() int {
+	if l.MaxPermutations > 0 {
+		return l.MaxPermutations
+	}
+	return DefaultMaxPermutations
+}
+
+func (l DiceLimits) maxRolls() int {
+	if l.MaxRolls > 0 {
+		return l.MaxRolls
+	}
+	return DefaultMaxRolls
+}
+
 type DieRoller struct {
+	DiceLimits				// how much work we're willing to do for a roll
+	Random		RandomSource // source of random numbers (nil for the default)
+	Attributes	AttributeSource // where @creature.attr references are looked up
 	d			*Dice		// underlying Dice object
 	LabelText	string		// user-defined label
 	Confirm		bool		// are we supposed to confirm potential critical rolls?
@@ -874,8 +1001,28 @@ type DieRoller struct {
 	RepeatFor	int			// 0 or number of times to repeat rolls
 	DoMax		bool		// true if we should maximize all die rolls
 	DC			int			// 0 or target DC for successful roll
+	Degrees		bool		// report degrees of success for DC rolls?
+	CritFailBy	int			// --fail DC by this much for a critical failure
+	CritSuccessBy int		// --beat DC by this much for a critical success
 	PctChance	int			// -1 or percentile chance target
 	PctLabel	string		// --label for percentile roll
+	Fields		[]RollField	// named parts of a multi-part roll, or nil
+	permutationCount int	// how many permutations Template expands to
+}
+
+//
+// A multi-part die roll (such as an attack card with attack,
+// damage, and critical damage rolls) is a list of named fields,
+// each with its own die-roll spec:
+//   [<label>=] <name>: <spec>; <name>: <spec>; ...
+// A field's spec may refer to the result of any field before it
+// as $<name>, such as
+//   Longsword= attack: d20+7|c; damage: 1d8+4; crit: $damage*2
+// The fields' specs may not have their own labels.
+//
+type RollField struct {
+	Name	string		// name of the field
+	Spec	string		// die-roll spec for this field
 }
 
 func NewDieRoller() (*DieRoller, error) {
@@ -889,6 +1036,21 @@ func NewDieRoller() (*DieRoller, error) {
 	return dr, nil
 }
 
+//
+// NewDieRollerWithSeed creates a DieRoller with its own random number
+// generator, seeded with the given value. Two such DieRollers with the
+// same seed will produce the same results for the same sequence of
+// die-roll requests.
+//
+func NewDieRollerWithSeed(seed int64) (*DieRoller, error) {
+	dr, err := NewDieRoller()
+	if err != nil {
+		return nil, err
+	}
+	dr.Random = rand.New(rand.NewSource(seed))
+	return dr, nil
+}
+
 //
 // Roll dice as described by the specification string. If this string is empty,
 // re-roll the previously-used specification. Initially, "1d20" is assumed.
@@ -913,8 +1075,13 @@ func (d *DieRoller) setNewSpecification(spec string) error {
 	d.RepeatFor = 1
 	d.DoMax = false
 	d.DC = 0
+	d.Degrees = false
+	d.CritFailBy = 0
+	d.CritSuccessBy = 0
 	d.PctChance = -1
 	d.PctLabel = ""
+	d.Fields = nil
+	d.permutationCount = 1
 
 	re_label := regexp.MustCompile(`^\s*(.*?)\s*=\s*(.*?)\s*$`)
 	re_mod_minmax := regexp.MustCompile(`^\s*(min|max)\s*[+-]?\d+`)
@@ -922,7 +1089,7 @@ func (d *DieRoller) setNewSpecification(spec string) error {
 	re_mod_until := regexp.MustCompile(`^\s*until\s*(-?\d+)\s*$`)
 	re_mod_repeat := regexp.MustCompile(`^\s*repeat\s*(\d+)\s*$`)
 	re_mod_maximized := regexp.MustCompile(`^\s*(!|maximized)\s*$`)
-	re_mod_dc := regexp.MustCompile(`^\s*[Dd][Cc]\s*(-?\d+)\s*$`)
+	re_mod_dc := regexp.MustCompile(`^\s*[Dd][Cc]\s*(-?\d+)(\s+degrees(?:\s+(\d+)(?:\s*/\s*(\d+))?)?)?\s*$`)
 	re_mod_sf := regexp.MustCompile(`^\s*sf(?:\s+(\S.*?)(?:/(\S.*?))?)?\s*$`)
 	re_permutations := regexp.MustCompile(`\{(.*?)\}`)
 	re_pct_roll := regexp.MustCompile(`^\s*(\d+)%(.*)$`)
@@ -936,6 +1103,33 @@ func (d *DieRoller) setNewSpecification(spec string) error {
 		d.LabelText = fields[1]
 	}
 
+	//
+	// A multi-part roll is set up here and each part is
+	// fully parsed each time it's rolled.
+	//
+	if strings.Contains(spec, ";") {
+		re_field := regexp.MustCompile(`^\s*(\w+)\s*:\s*(\S.*?)\s*$`)
+		seen := make(map[string]bool)
+		for _, part := range strings.Split(spec, ";") {
+			if strings.TrimSpace(part) == "" {
+				continue
+			}
+			fields := re_field.FindStringSubmatch(part)
+			if fields == nil {
+				return fmt.Errorf("Multi-part die roll field \"%s\" should be <name>: <spec>", strings.TrimSpace(part))
+			}
+			if seen[fields[1]] {
+				return fmt.Errorf("Multi-part die roll field name \"%s\" used more than once", fields[1])
+			}
+			seen[fields[1]] = true
+			d.Fields = append(d.Fields, RollField{Name: fields[1], Spec: fields[2]})
+		}
+		if d.Fields == nil {
+			return fmt.Errorf("Empty dice description")
+		}
+		return nil
+	}
+
 	//
 	// The remainder of the spec is a die-roll string followed by a number
 	// of global modifiers, separated by vertical bars.
@@ -1011,13 +1205,36 @@ func (d *DieRoller) setNewSpecification(spec string) error {
 				} else if fields := re_mod_dc.FindStringSubmatch(major_pieces[i]); fields != nil {
 					//
 					// MODIFIER
-					//  | DC <n>
-					// Seek a value at least <n>
+					//  | DC <n> [degrees [<fail>[/<success>]]]
+					// Seek a value at least <n>. With "degrees", also report
+					// the degree of success: missing the DC by <fail> or more
+					// is a critical failure, and beating it by <success> or
+					// more is a critical success (both default to 10, and
+					// <success> defaults to <fail> if only one is given).
+					// A natural 20 or 1 on a d20 improves or worsens the
+					// degree by one step.
 					//
 					d.DC, err = strconv.Atoi(fields[1])
 					if err != nil {
 						return fmt.Errorf("Value error in die roll DC clause: %v", err)
 					}
+					if fields[2] != "" {
+						d.Degrees = true
+						d.CritFailBy, d.CritSuccessBy = 10, 10
+						if fields[3] != "" {
+							d.CritFailBy, err = strconv.Atoi(fields[3])
+							if err != nil {
+								return fmt.Errorf("Value error in die roll DC clause: %v", err)
+							}
+							d.CritSuccessBy = d.CritFailBy
+						}
+						if fields[4] != "" {
+							d.CritSuccessBy, err = strconv.Atoi(fields[4])
+							if err != nil {
+								return fmt.Errorf("Value error in die roll DC clause: %v", err)
+							}
+						}
+					}
 				} else if fields := re_mod_sf.FindStringSubmatch(major_pieces[i]); fields != nil {
 					//
 					// MODIFIER
@@ -1084,6 +1301,10 @@ func (d *DieRoller) setNewSpecification(spec string) error {
 				plist[i] = p
 			}
 			d.Permutations = append(d.Permutations, plist)
+			d.permutationCount *= len(plist)
+			if d.permutationCount > d.maxPermutations() {
+				return fmt.Errorf("Die roll \"%s\" has too many permutations; the limit is %d.", spec, d.maxPermutations())
+			}
 		}
 		//
 		// replace the {...} strings with placeholder tokens {0}, {1}, ... {n}
@@ -1097,6 +1318,10 @@ func (d *DieRoller) setNewSpecification(spec string) error {
 		})
 	}
 
+	if d.permutationCount * d.RepeatFor > d.maxRolls() {
+		return fmt.Errorf("Die roll would need %d rolls; the limit is %d.", d.permutationCount * d.RepeatFor, d.maxRolls())
+	}
+
 	if fields := re_pct_roll.FindStringSubmatch(spec); fields != nil {
 		//
 		// Special case: <n>% rolls percentile dice and
@@ -1140,12 +1365,23 @@ func (d *DieRoller) DoRoll(spec string) (string, []StructuredResult, error) {
 	//
 
 	if spec != "" {
+		if spec, err = ResolveAttributeReferences(spec, d.Attributes); err != nil {
+			return "", nil, err
+		}
 		err = d.setNewSpecification(spec)
 		if err != nil {
 			return "", nil, err
 		}
 	}
 
+	if d.Fields != nil {
+		results, err := d.rollFields()
+		if err != nil {
+			return "", nil, err
+		}
+		return d.LabelText, results, nil
+	}
+
 	var overall_results []StructuredResult
 	var results []StructuredResult
 	var result int
@@ -1157,8 +1393,7 @@ func (d *DieRoller) DoRoll(spec string) (string, []StructuredResult, error) {
 			// If we're working with a set of permutations, expand them now
 			// into their Cartesian product so we can then substitute each set
 			// of those values into the template for each roll of the dice.
-			iterlist := cartesian.Iter(d.Permutations...)
-			for iteration := range iterlist {
+			for _, iteration := range permutationValues(d.Permutations) {
 				d.d, err = NewDice(substituteTemplateValues(d.Template, iteration))
 				if err != nil {
 					return "", nil, err
@@ -1182,7 +1417,7 @@ func (d *DieRoller) DoRoll(spec string) (string, []StructuredResult, error) {
 			repeat_iter++
 		}
 		repeat_count++
-		if repeat_count >= 100 {
+		if repeat_count * d.permutationCount >= d.maxRolls() {
 			break
 		}
 	}
@@ -1193,6 +1428,133 @@ func (d *DieRoller) DoRoll(spec string) (string, []StructuredResult, error) {
 	return d.LabelText, overall_results, nil
 }
 
+//
+// Roll each field of a multi-part die roll. Each result's details
+// begin with a "field" description naming the field it belongs to.
+// If a field has more than one result (e.g., it repeats or confirms
+// a critical roll), the first is its value for $<name> references.
+//
+func (d *DieRoller) rollFields() ([]StructuredResult, error) {
+	var overall_results []StructuredResult
+	values := make(map[string]int)
+	re_ref := regexp.MustCompile(`([-+]?)\s*\$(\w+)`)
+
+	for _, field := range d.Fields {
+		if strings.Contains(field.Spec, "=") {
+			return nil, fmt.Errorf("Multi-part die roll field %s may not have its own label", field.Name)
+		}
+		var spec strings.Builder
+		last := 0
+		for _, ref := range re_ref.FindAllStringSubmatchIndex(field.Spec, -1) {
+			name := field.Spec[ref[4]:ref[5]]
+			value, ok := values[name]
+			if !ok {
+				return nil, fmt.Errorf("Multi-part die roll field %s refers to $%s before it was rolled", field.Name, name)
+			}
+			spec.WriteString(field.Spec[last:ref[0]])
+			spec.WriteString(substituteFieldValue(field.Spec[ref[2]:ref[3]], value, strings.TrimSpace(field.Spec[:ref[0]]) == ""))
+			last = ref[1]
+		}
+		spec.WriteString(field.Spec[last:])
+
+		sub, err := NewDieRoller()
+		if err != nil {
+			return nil, err
+		}
+		sub.DiceLimits = d.DiceLimits
+		sub.Random = d.Random
+		_, results, err := sub.DoRoll(spec.String())
+		if err != nil {
+			return nil, fmt.Errorf("In multi-part die roll field %s: %v", field.Name, err)
+		}
+		for _, result := range results {
+			result.Details = append([]StructuredDescription{{Type: "field", Value: field.Name}}, result.Details...)
+			overall_results = append(overall_results, result)
+		}
+		if len(results) > 0 {
+			values[field.Name] = results[0].Result
+		}
+	}
+	return overall_results, nil
+}
+
+//
+// Since die-roll specs are evaluated left to right and don't allow
+// a leading minus sign, we need to be careful how we put a negative
+// field value into another field's spec. If there's a + or - operator
+// in front of it, we just flip that operator as needed. At the start
+// of the spec, we subtract from 0.
+//
+func substituteFieldValue(op string, value int, at_start bool) string {
+	if value >= 0 {
+		return op + strconv.Itoa(value)
+	}
+	switch op {
+		case "+":
+			return "-" + strconv.Itoa(-value)
+		case "-":
+			return "+" + strconv.Itoa(-value)
+	}
+	if at_start {
+		return "0-" + strconv.Itoa(-value)
+	}
+	// leave it to the parser to complain about this
+	return op + strconv.Itoa(value)
+}
+
+//
+// The degrees of success for a DC roll, from worst to best.
+//
+var degreesOfSuccess = []string{"critical failure", "failure", "success", "critical success"}
+
+//
+// Figure out the degree of success for a roll against our DC.
+//
+func (d *DieRoller) degreeOfSuccess(result int) string {
+	var degree int
+	switch {
+		case result >= d.DC + d.CritSuccessBy:
+			degree = 3
+		case result >= d.DC:
+			degree = 2
+		case result <= d.DC - d.CritFailBy:
+			degree = 0
+		default:
+			degree = 1
+	}
+	if d.d != nil && d.d._defthreat == 20 {
+		if d.d._natural == 20 && degree < 3 {
+			degree++
+		} else if d.d._natural == 1 && degree > 0 {
+			degree--
+		}
+	}
+	return degreesOfSuccess[degree]
+}
+
+//
+// utility function to expand the lists of permutation values into their
+// Cartesian product: every combination of one value from each list, with
+// the last list's values changing fastest. These come out in the same
+// order every time, so a DieRoller with a fixed seed rolls each
+// combination with the same random numbers every time.
+//
+func permutationValues(lists [][]interface{}) [][]interface{} {
+	combinations := [][]interface{}{{}}
+	for _, list := range lists {
+		var expanded [][]interface{}
+		for _, combination := range combinations {
+			for _, value := range list {
+				next := make([]interface{}, len(combination), len(combination)+1)
+				copy(next, combination)
+				expanded = append(expanded, append(next, value))
+			}
+		}
+		combinations = expanded
+	}
+	return combinations
+}
+
 //
 // utility function to replace placeholders {0}, {1}, {2}, ... in an input string
 // with corresponding values taken from a list of substitution values, returning
@@ -1273,6 +1635,10 @@ func (d *DieRoller) rollDice(repeat_iter, repeat_count int) (int, []StructuredRe
 				StructuredDescription{Type: "dc", Value: strconv.Itoa(d.DC)},
 				describe_dc_roll(d.DC, result),
 			)
+			if d.Degrees {
+				this_result = append(this_result,
+					StructuredDescription{Type: "degree", Value: d.degreeOfSuccess(result)})
+			}
 		}
 		if d.sfOpt != "" {
 			this_result = append(this_result,
@@ -1346,6 +1712,7 @@ func (d *DieRoller) rollDice(repeat_iter, repeat_count int) (int, []StructuredRe
 	if d.d == nil {
 		return 0, nil, fmt.Errorf("No defined Dice object to consume")
 	}
+	d.d.Random = d.Random
 
 	// MAXIMIZED DIE ROLLS_____________________________________________________
 	//
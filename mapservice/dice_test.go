@@ -24,6 +24,7 @@ package mapservice
 import (
 	"math/rand"
 	"log"
+	"reflect"
 	"strings"
 	"sort"
 	"testing"
@@ -1626,6 +1627,213 @@ func TestDiceStructured(t *testing.T) {
 		}
 	}
 }
+
+func TestDiceMultiPart(t *testing.T) {
+	d, err := NewDieRoller()
+	if err != nil {
+		t.Fatalf("Error creating new DieRoller: %v", err)
+	}
+
+	label, results, err := d.DoRoll("Longsword= attack: d20+7|!; damage: 1d8+4|!; crit: $damage*2; penalty: 3-$crit; net: $penalty+10")
+	if err != nil {
+		t.Fatalf("multi-part roll error %v", err)
+	}
+	if label != "Longsword" {
+		t.Errorf("label was %q, expected Longsword", label)
+	}
+	expected := []struct {
+		field  string
+		result int
+	}{
+		{"attack", 27},
+		{"damage", 12},
+		{"crit", 24},
+		{"penalty", -21},
+		{"net", -11},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("got %d results, expected %d: %v", len(results), len(expected), results)
+	}
+	for i, e := range expected {
+		if results[i].Result != e.result || len(results[i].Details) == 0 || results[i].Details[0] != (StructuredDescription{Type: "field", Value: e.field}) {
+			t.Errorf("result %d was %v; expected field %s = %d", i, results[i], e.field, e.result)
+		}
+	}
+
+	// re-roll the same spec
+	if _, again, err := d.DoRoll(""); err != nil || len(again) != len(expected) {
+		t.Errorf("re-roll gave %v, %v", again, err)
+	}
+
+	for _, bad := range []string{
+		"attack: d20; damage: $crit",
+		"attack: d20; attack: d20",
+		"attack: d20; oops",
+		"x= attack: a=d20; damage: d6",
+	} {
+		if _, _, err := d.DoRoll(bad); err == nil {
+			t.Errorf("multi-part roll %q should have failed", bad)
+		}
+	}
+}
+
+func degreeDetail(result StructuredResult) string {
+	for _, detail := range result.Details {
+		if detail.Type == "degree" {
+			return detail.Value
+		}
+	}
+	return ""
+}
+
+func TestDiceDegreesOfSuccess(t *testing.T) {
+	d, err := NewDieRoller()
+	if err != nil {
+		t.Fatalf("Error creating new DieRoller: %v", err)
+	}
+
+	for i, test := range []struct {
+		Roll   string
+		Degree string
+	}{
+		{"d20+5|!|dc 15 degrees", "critical success"},
+		{"d20+5|!|dc 16 degrees", "success"},
+		{"d20|!|dc 25 degrees", "failure"},
+		{"d20|!|dc 30 degrees", "critical failure"},
+		{"d20|!|dc 24 degrees 5/10", "failure"},
+		{"d20|!|dc 25 degrees 5/10", "critical failure"},
+		{"d20+10|!|dc 25 degrees 5/10", "success"},
+		{"d20+10|!|dc 20 degrees 5/10", "critical success"},
+		{"d20|!|dc 19 degrees 2", "success"},
+		{"d20|!|dc 18 degrees 2", "critical success"},
+	} {
+		_, results, err := d.DoRoll(test.Roll)
+		if err != nil {
+			t.Fatalf("test #%d error %v", i, err)
+		}
+		if degree := degreeDetail(results[0]); degree != test.Degree {
+			t.Errorf("test #%d (%s) gave %v; expected degree %s", i, test.Roll, results[0].Details, test.Degree)
+		}
+	}
+
+	if _, results, err := d.DoRoll("d20|!|dc 15"); err != nil {
+		t.Errorf("plain DC roll error %v", err)
+	} else if degree := degreeDetail(results[0]); degree != "" {
+		t.Errorf("plain DC roll reported degree of success: %v", results[0].Details)
+	}
+
+	// natural 20s and 1s on a d20 shift the result by a degree
+	if err = d.setNewSpecification("d20+5|dc 15 degrees"); err != nil {
+		t.Fatalf("error setting spec: %v", err)
+	}
+	d.d._defthreat = 20
+	for i, test := range []struct {
+		Natural int
+		Result  int
+		Degree  string
+	}{
+		{20, 25, "critical success"},
+		{20, 15, "critical success"},
+		{20, 10, "success"},
+		{1, 6, "critical failure"},
+		{1, 25, "success"},
+		{10, 15, "success"},
+	} {
+		d.d._natural = test.Natural
+		if degree := d.degreeOfSuccess(test.Result); degree != test.Degree {
+			t.Errorf("natural test #%d gave %s; expected %s", i, degree, test.Degree)
+		}
+	}
+}
+
+func TestDiceLimits(t *testing.T) {
+	d, err := NewDieRoller()
+	if err != nil {
+		t.Fatalf("Error creating new DieRoller: %v", err)
+	}
+	d.DiceLimits = DiceLimits{MaxPermutations: 6, MaxRolls: 12}
+
+	for i, test := range []struct {
+		Roll  string
+		Error string
+	}{
+		{"d20+{1/2/3}+{4/5}", ""},
+		{"d20+{1/2/3}+{4/5/6}", "too many permutations"},
+		{"d20+{1/2/3}+{4/5}|repeat 2", ""},
+		{"d20+{1/2/3}+{4/5}|repeat 3", "would need 18 rolls"},
+		{"d20|repeat 13", "would need 13 rolls"},
+	} {
+		_, _, err := d.DoRoll(test.Roll)
+		if test.Error == "" && err != nil {
+			t.Errorf("test #%d (%s) error %v", i, test.Roll, err)
+		} else if test.Error != "" && (err == nil || !strings.Contains(err.Error(), test.Error)) {
+			t.Errorf("test #%d (%s) gave error %v; expected %q", i, test.Roll, err, test.Error)
+		}
+	}
+
+	_, results, err := d.DoRoll("d6|until 100")
+	if err != nil || len(results) != 12 {
+		t.Errorf("until roll gave %d results, %v; expected 12", len(results), err)
+	}
+}
+
+//
+// A RandomSource which always gives the same number.
+//
+type fixedRandomSource int32
+
+func (f fixedRandomSource) Int31n(n int32) int32 {
+	return int32(f) % n
+}
+
+func TestDiceRandomSource(t *testing.T) {
+	a, err := NewDieRollerWithSeed(42)
+	if err != nil {
+		t.Fatalf("Error creating new DieRoller: %v", err)
+	}
+	b, err := NewDieRollerWithSeed(42)
+	if err != nil {
+		t.Fatalf("Error creating new DieRoller: %v", err)
+	}
+	for i, spec := range []string{"d20+5", "3d6|repeat 4", "d20+{1/2/3}", "a: d20; b: 2d8+$a", "d20|c"} {
+		_, a_results, err := a.DoRoll(spec)
+		if err != nil {
+			t.Fatalf("test #%d error %v", i, err)
+		}
+		_, b_results, err := b.DoRoll(spec)
+		if err != nil {
+			t.Fatalf("test #%d error %v", i, err)
+		}
+		if !compareResults(a_results, b_results) {
+			t.Errorf("test #%d: same seed gave %v and %v", i, a_results, b_results)
+		}
+	}
+
+	d, err := NewDieRoller()
+	if err != nil {
+		t.Fatalf("Error creating new DieRoller: %v", err)
+	}
+	d.Random = fixedRandomSource(6)
+	_, results, err := d.DoRoll("3d10+1")
+	if err != nil {
+		t.Fatalf("fixed roll error %v", err)
+	}
+	if len(results) != 1 || results[0].Result != 22 {
+		t.Errorf("fixed roll gave %v; expected 22", results)
+	}
+}
+
+func TestPermutationValues(t *testing.T) {
+	got := permutationValues([][]interface{}{{"+15", "+10"}, {"2", "3", "4"}})
+	want := [][]interface{}{
+		{"+15", "2"}, {"+15", "3"}, {"+15", "4"},
+		{"+10", "2"}, {"+10", "3"}, {"+10", "4"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("permutations were %v, expected %v", got, want)
+	}
+}
+
 // @[00]@| GMA 4.2.2
 // @[01]@|
 // @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
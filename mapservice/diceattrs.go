@@ -0,0 +1,120 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                          Creature Attributes in Die Rolls                          //
+//                                                                                    //
+// Die-roll specs may refer to stored creature attributes as @<creature>.<attr>.      //
+// These are looked up when the roll is made, so changing a creature's modifier in    //
+// one place updates every preset that uses it.                                       //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//
+// AttributeSource is where die rolls look up the stored attributes of
+// creatures, so a spec such as "d20+@Fighter.STR_mod" always uses the
+// fighter's current strength modifier.
+//
+type AttributeSource interface {
+	CreatureAttribute(creature, attr string) (string, bool)
+}
+
+var attributeReference = regexp.MustCompile(`([-+*/]?)\s*@([\w#]+)\.(\w+)`)
+
+//
+// ResolveAttributeReferences replaces each @<creature>.<attr> in a die-roll
+// spec with the value of that attribute, which must be an integer.
+// If attrs is nil, specs with such references are refused.
+//
+func ResolveAttributeReferences(spec string, attrs AttributeSource) (string, error) {
+	refs := attributeReference.FindAllStringSubmatchIndex(spec, -1)
+	if refs == nil {
+		return spec, nil
+	}
+	if attrs == nil {
+		return "", fmt.Errorf("Creature attributes can't be used in this die roll")
+	}
+
+	var resolved strings.Builder
+	last := 0
+	for _, ref := range refs {
+		creature := spec[ref[4]:ref[5]]
+		attr := spec[ref[6]:ref[7]]
+		value, ok := attrs.CreatureAttribute(creature, attr)
+		if !ok {
+			return "", fmt.Errorf("Creature %s has no %s attribute", creature, attr)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return "", fmt.Errorf("Attribute %s of creature %s is \"%s\", which is not an integer", attr, creature, value)
+		}
+		before := strings.TrimSpace(spec[:ref[0]])
+		at_start := before == "" || strings.ContainsAny(before[len(before)-1:], "=:;")
+		resolved.WriteString(spec[last:ref[0]])
+		resolved.WriteString(substituteFieldValue(spec[ref[2]:ref[3]], n, at_start))
+		last = ref[1]
+	}
+	resolved.WriteString(spec[last:])
+	return resolved.String(), nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,112 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for creature attributes in die rolls
+//
+
+package mapservice
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveAttributeReferences(t *testing.T) {
+	gs := NewGameState()
+	recordTestEvents(t, gs,
+		"PS 1234 red Grax 1 M monster 3 4 0",
+		"OA 1234 {STR_mod -1 BAB 5}",
+	)
+
+	for i, tc := range []struct {
+		spec, resolved, err string
+	}{
+		{"d20+@Grax.STR_mod", "d20-1", ""},
+		{"d20 + @Grax.BAB", "d20 +5", ""},
+		{"hit=@Grax.STR_mod+d20", "hit=0-1+d20", ""},
+		{"atk: d20+@Grax.BAB; dmg: d8-@Grax.STR_mod", "atk: d20+5; dmg: d8+1", ""},
+		{"d20+@goblin#2.BAB", "", "Creature goblin#2 has no BAB"},
+		{"d20+@Grax.DEX_mod", "", "Creature Grax has no DEX_mod"},
+		{"d20+@Grax.NAME", "", "not an integer"},
+		{"d20+2", "d20+2", ""},
+	} {
+		resolved, err := ResolveAttributeReferences(tc.spec, gs)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("case %d: expected error \"%s\", got %q, %v", i, tc.err, resolved, err)
+			}
+		} else if err != nil || resolved != tc.resolved {
+			t.Errorf("case %d: expected %q, got %q, %v", i, tc.resolved, resolved, err)
+		}
+	}
+
+	if _, err := ResolveAttributeReferences("d20+@Grax.BAB", nil); err == nil {
+		t.Errorf("attribute reference resolved without a source")
+	}
+
+	d, err := NewDieRoller()
+	if err != nil {
+		t.Fatalf("unable to create die roller: %v", err)
+	}
+	d.Random = fixedRandomSource(9)
+	d.Attributes = gs
+	if _, results, err := d.DoRoll("d20+@Grax.STR_mod"); err != nil || len(results) != 1 || results[0].Result != 9 {
+		t.Errorf("roll with attribute gave %v, %v", results, err)
+	}
+	recordTestEvents(t, gs, "OA 1234 {STR_mod 3}")
+	if _, results, err := d.DoRoll("d20+@Grax.STR_mod"); err != nil || len(results) != 1 || results[0].Result != 13 {
+		t.Errorf("roll after changing attribute gave %v, %v", results, err)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
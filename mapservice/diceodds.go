@@ -0,0 +1,317 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Die-roll odds                                    //
+//                                                                                    //
+// Figuring the chance that a die roll meets or beats a DC, so GMs can see how hard   //
+// they are making things. Simple rolls are worked out exactly; for anything too      //
+// complicated for that, we roll the dice many times and count.                       //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+//
+// The most work (counted in pairs of values combined) we will do to
+// work out the odds of a roll exactly before estimating them instead.
+//
+const MaxExactOddsWork = 1000000
+
+//
+// How many times we roll the dice to estimate the odds of a roll we
+// can't work out exactly.
+//
+const OddsSamples = 20000
+
+//
+// RollOdds is the chance that a die roll meets or beats a DC.
+//
+type RollOdds struct {
+	DC      int     // the DC the roll needs to meet or beat
+	Chance  float64 // chance (from 0 to 1) that it does
+	Exact   bool    // worked out exactly rather than estimated
+	Samples int     // how many rolls it was estimated from (if not exact)
+}
+
+//
+// FigureOdds works out the chance that a single roll of the given
+// die-roll spec meets or beats the DC. If the DC is 0, the one given
+// in the spec (with |dc) is used. For percentile rolls (|pct) the chance
+// is the one given in the spec. Other modifiers which repeat the roll
+// or confirm criticals make no difference to the odds of each roll,
+// so they are ignored. Multi-part rolls and permutations have more
+// than one roll, so we can't give the odds of "the" roll for them.
+//
+func FigureOdds(spec string, dc int, limits DiceLimits) (RollOdds, error) {
+	if spec == "" {
+		return RollOdds{}, fmt.Errorf("Empty die-roll spec")
+	}
+	d, err := NewDieRoller()
+	if err != nil {
+		return RollOdds{}, err
+	}
+	d.DiceLimits = limits
+	if err = d.setNewSpecification(spec); err != nil {
+		return RollOdds{}, err
+	}
+	if d.Fields != nil {
+		return RollOdds{}, fmt.Errorf("Odds can't be figured for a multi-part die roll")
+	}
+	if d.Template != "" {
+		return RollOdds{}, fmt.Errorf("Odds can't be figured for a die roll with permutations")
+	}
+
+	odds := RollOdds{DC: dc, Exact: true}
+	if d.PctChance >= 0 {
+		odds.DC = 0
+		odds.Chance = float64(d.PctChance) / 100
+		if odds.Chance > 1 {
+			odds.Chance = 1
+		}
+		return odds, nil
+	}
+	if odds.DC == 0 {
+		odds.DC = d.DC
+	}
+	if odds.DC == 0 {
+		return RollOdds{}, fmt.Errorf("No DC given to figure the odds against")
+	}
+
+	// this also makes sure we can't divide by zero
+	low, high, err := d.d.Range()
+	if err != nil {
+		return RollOdds{}, err
+	}
+	if d.DoMax {
+		low = high
+	}
+	if low >= odds.DC || high < odds.DC {
+		if low >= odds.DC {
+			odds.Chance = 1
+		}
+		return odds, nil
+	}
+
+	if results, ok := diceDistribution(d.d, MaxExactOddsWork); ok {
+		for result, chance := range results {
+			if result >= odds.DC {
+				odds.Chance += chance
+			}
+		}
+		return odds, nil
+	}
+
+	odds.Exact = false
+	odds.Samples = OddsSamples
+	hits := 0
+	for i := 0; i < OddsSamples; i++ {
+		result, err := d.d.Roll()
+		if err != nil {
+			return RollOdds{}, err
+		}
+		if result >= odds.DC {
+			hits++
+		}
+	}
+	odds.Chance = float64(hits) / OddsSamples
+	return odds, nil
+}
+
+//
+// A distribution maps each possible result to the chance of getting it.
+//
+type distribution map[int]float64
+
+//
+// Combine two distributions, with op giving the result of each pair of
+// values from them. The work done is added to *work; if that goes past
+// the limit, we give up and return nil.
+//
+func combineDistributions(a, b distribution, op func(x, y int) (int, error), work *int, limit int) (distribution, error) {
+	*work += len(a) * len(b)
+	if *work > limit {
+		return nil, nil
+	}
+	combined := make(distribution)
+	for x, px := range a {
+		for y, py := range b {
+			v, err := op(x, y)
+			if err != nil {
+				return nil, err
+			}
+			combined[v] += px * py
+		}
+	}
+	return combined, nil
+}
+
+func addValues(x, y int) (int, error) {
+	return x + y, nil
+}
+
+//
+// Work out the chance of each possible result of rolling the dice,
+// unless that would take more than limit work, in which case we
+// return false.
+//
+func diceDistribution(d *Dice, limit int) (distribution, bool) {
+	work := 0
+	total := distribution{0: 1}
+	for _, die := range d.MultiDice {
+		var values distribution
+		switch component := die.(type) {
+			case *DieConstant:
+				values = distribution{component.Value: 1}
+			case *DieSpec:
+				values = dieSpecDistribution(component, &work, limit)
+			default:
+				return nil, false
+		}
+		if values == nil {
+			return nil, false
+		}
+		var err error
+		total, err = combineDistributions(total, values, die.ApplyOp, &work, limit)
+		if err != nil || total == nil {
+			return nil, false
+		}
+	}
+
+	clamped := make(distribution)
+	for v, p := range total {
+		if d.MaxValue > 0 && v > d.MaxValue {
+			v = d.MaxValue
+		}
+		if d.MinValue > 0 && v < d.MinValue {
+			v = d.MinValue
+		}
+		clamped[v] += p
+	}
+	return clamped, true
+}
+
+//
+// The chance of each possible value of a single component of a die
+// roll (like 3d6 or "best of 2 d20"), or nil if it would take too much
+// work to figure out.
+//
+func dieSpecDistribution(d *DieSpec, work *int, limit int) distribution {
+	if d.Sides < 1 {
+		return nil
+	}
+	one_die := func(v int) int {
+		v += d.DieBonus
+		if d.Denominator > 0 {
+			v /= d.Denominator
+			if v < 1 {
+				v = 1
+			}
+		}
+		return v
+	}
+	faces := make(distribution)
+	for face := 1; face <= d.Sides; face++ {
+		faces[one_die(face)] += 1 / float64(d.Sides)
+	}
+
+	set := distribution{0: 1}
+	for j := 0; j < d.Numerator; j++ {
+		die := faces
+		if d.InitialMax && j == 0 {
+			die = distribution{one_die(d.Sides): 1}
+		}
+		var err error
+		if set, err = combineDistributions(set, die, addValues, work, limit); err != nil || set == nil {
+			return nil
+		}
+	}
+	if d.Rerolls == 0 {
+		return set
+	}
+
+	//
+	// The best of n sets is no more than x when all of them are, and
+	// the worst of them is at least x when all of them are.
+	//
+	sets := d.Rerolls + 1
+	*work += len(set) * sets
+	if *work > limit {
+		return nil
+	}
+	values := make([]int, 0, len(set))
+	for v := range set {
+		values = append(values, v)
+	}
+	sort.Ints(values)
+	chosen := make(distribution)
+	below := 0.0
+	for _, v := range values {
+		at_most := below + set[v]
+		if d.BestReroll {
+			chosen[v] = math.Pow(at_most, float64(sets)) - math.Pow(below, float64(sets))
+		} else {
+			chosen[v] = math.Pow(1-below, float64(sets)) - math.Pow(1-at_most, float64(sets))
+		}
+		below = at_most
+	}
+	return chosen
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,186 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+// Unit tests for figuring die-roll odds
+//
+
+package mapservice
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFigureOdds(t *testing.T) {
+	for _, test := range []struct {
+		spec string
+		dc   int
+		odds RollOdds
+	}{
+		{"d20+5", 15, RollOdds{DC: 15, Chance: 11.0 / 20, Exact: true}},
+		{"2d6", 7, RollOdds{DC: 7, Chance: 21.0 / 36, Exact: true}},
+		{"d20|dc 15", 0, RollOdds{DC: 15, Chance: 6.0 / 20, Exact: true}},
+		{"d20|dc 15", 20, RollOdds{DC: 20, Chance: 1.0 / 20, Exact: true}},
+		{"d20 best of 2", 11, RollOdds{DC: 11, Chance: 0.75, Exact: true}},
+		{"d20 worst of 2", 11, RollOdds{DC: 11, Chance: 0.25, Exact: true}},
+		{">3d6", 12, RollOdds{DC: 12, Chance: 26.0 / 36, Exact: true}},
+		{"d6*2+1", 10, RollOdds{DC: 10, Chance: 2.0 / 6, Exact: true}},
+		{"d20÷2", 6, RollOdds{DC: 6, Chance: 9.0 / 20, Exact: true}},
+		{"d20|max 10", 10, RollOdds{DC: 10, Chance: 11.0 / 20, Exact: true}},
+		{"d20|min 10", 10, RollOdds{DC: 10, Chance: 1, Exact: true}},
+		{"d20+5", 26, RollOdds{DC: 26, Chance: 0, Exact: true}},
+		{"d20|!", 20, RollOdds{DC: 20, Chance: 1, Exact: true}},
+		{"d20|!", 21, RollOdds{DC: 21, Chance: 0, Exact: true}},
+		{"40%", 0, RollOdds{Chance: 0.4, Exact: true}},
+		{"hit=d20+5|c|repeat 3", 15, RollOdds{DC: 15, Chance: 11.0 / 20, Exact: true}},
+	} {
+		odds, err := FigureOdds(test.spec, test.dc, DiceLimits{})
+		if err != nil {
+			t.Errorf("odds of %s against %d: %v", test.spec, test.dc, err)
+			continue
+		}
+		if odds.DC != test.odds.DC || odds.Exact != test.odds.Exact || odds.Samples != 0 || math.Abs(odds.Chance-test.odds.Chance) > 1e-9 {
+			t.Errorf("odds of %s against %d were %+v; expected %+v", test.spec, test.dc, odds, test.odds)
+		}
+	}
+}
+
+//
+// The odds we work out should match what actually happens when the
+// dice are rolled.
+//
+func TestFigureOddsMatchesRolls(t *testing.T) {
+	for _, test := range []struct {
+		spec string
+		dc   int
+	}{
+		{"3d6+2", 13},
+		{"2/3d8 best of 3", 8},
+		{"d10*3-d4", 15},
+		{"4d6 worst of 2|min 8", 12},
+	} {
+		odds, err := FigureOdds(test.spec, test.dc, DiceLimits{})
+		if err != nil || !odds.Exact {
+			t.Errorf("odds of %s against %d: %+v %v", test.spec, test.dc, odds, err)
+			continue
+		}
+		d, err := NewDieRollerWithSeed(42)
+		if err != nil {
+			t.Fatalf("unable to create die roller: %v", err)
+		}
+		if err = d.setNewSpecification(test.spec); err != nil {
+			t.Fatalf("unable to parse %s: %v", test.spec, err)
+		}
+		d.d.Random = d.Random
+		hits := 0
+		for i := 0; i < OddsSamples; i++ {
+			result, err := d.d.Roll()
+			if err != nil {
+				t.Fatalf("unable to roll %s: %v", test.spec, err)
+			}
+			if result >= test.dc {
+				hits++
+			}
+		}
+		if rolled := float64(hits) / OddsSamples; math.Abs(rolled-odds.Chance) > 0.02 {
+			t.Errorf("odds of %s against %d were %.4f, but %.4f of rolls made it", test.spec, test.dc, odds.Chance, rolled)
+		}
+	}
+}
+
+func TestFigureOddsEstimated(t *testing.T) {
+	odds, err := FigureOdds("100d100", 5050, DiceLimits{})
+	if err != nil {
+		t.Fatalf("odds of 100d100: %v", err)
+	}
+	if odds.Exact || odds.Samples != OddsSamples || math.Abs(odds.Chance-0.5) > 0.03 {
+		t.Errorf("odds of 100d100 against 5050 were %+v", odds)
+	}
+}
+
+func TestFigureOddsErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"d20+",
+		"d20",
+		"attack: d20+5; damage: d8+3",
+		"d20+{1/2/3}",
+	} {
+		if odds, err := FigureOdds(spec, 0, DiceLimits{}); err == nil {
+			t.Errorf("odds of %q were %+v", spec, odds)
+		}
+	}
+}
+
+func TestHandlers_RollOdds(t *testing.T) {
+	ms := newTestService()
+	c := newTestClient(ms, "client", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "DO? 1 d20+5 15"), c)
+	if sent := sentToTestClient(c); len(sent) != 1 || sent[0] != "DO= 1 15 0.5500 0" {
+		t.Errorf("DO? response was %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "DO? 2 {d20|dc 11}"), c)
+	if sent := sentToTestClient(c); len(sent) != 1 || sent[0] != "DO= 2 11 0.5000 0" {
+		t.Errorf("DO? response with spec's DC was %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "DO? 3 d20 hard"), c)
+	if sent := sentToTestClient(c); len(sent) != 1 || sent[0] != "DO! 3 {DC \"hard\" is not a number}" {
+		t.Errorf("DO? response for bad DC was %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "DO? 4 d20"), c)
+	if sent := sentToTestClient(c); len(sent) != 1 || sent[0] != "DO! 4 {No DC given to figure the odds against}" {
+		t.Errorf("DO? response without a DC was %q", sent)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -26,6 +26,9 @@ package mapservice
 import (
 	"database/sql"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 ////////////////////////////////////////////////////////////////////////////////// 
@@ -39,9 +42,11 @@ import (
 // A DicePreset represents a single die-roll that is saved for future
 // use.
 type DicePreset struct {
-	Name	    string	// unique name; everything up to '|' does not display to the user but may be used for sorting list on the client.
+	Name	    string	// unique name.
 	Description string  // user-defined description of what this die roll is for.
 	RollSpec    string  // die-roll specification (see GMA documentation for syntax details).
+	Folder      string  // folder the client files it under ("" for none).
+	SortOrder   int     // where the client lists it within its folder.
 }
 
 //
@@ -66,6 +71,8 @@ func NewDicePreset(name, desc, roll string) *DicePreset {
 // | password     s |     | name         s |
 // |________________|     | description  s |
 //                        | rollspec     s |
+//                        | folder       s |
+//                        | sortorder    i |
 //                        |________________|
 // 
 // P=primary key
@@ -84,7 +91,7 @@ func LoadDicePresets(db *sql.DB) (map[string][]DicePreset, error) {
 	all_presets := make(map[string][]DicePreset)
 
 	preset, err := db.Query(`
-		select username, name, description, rollspec 
+		select username, name, description, rollspec, folder, sortorder
 			from users, dicepresets 
 			where users.userid=dicepresets.userid`)
 	if err != nil {
@@ -93,19 +100,21 @@ func LoadDicePresets(db *sql.DB) (map[string][]DicePreset, error) {
 	defer preset.Close()
 	for preset.Next() {
 		var (
-			user string
-			name string
-			desc string
-			spec string
+			user   string
+			name   string
+			desc   string
+			spec   string
+			folder string
+			order  int
 		)
-		if err = preset.Scan(&user, &name, &desc, &spec); err != nil {
+		if err = preset.Scan(&user, &name, &desc, &spec, &folder, &order); err != nil {
 			return nil, fmt.Errorf("unable to read die presets: %v", err)
 		}
 		plist, existing := all_presets[user]
 		if !existing {
 			plist = make([]DicePreset,0)
 		}
-		plist = append(plist, DicePreset{Name: name, Description: desc, RollSpec: spec})
+		plist = append(plist, DicePreset{Name: name, Description: desc, RollSpec: spec, Folder: folder, SortOrder: order})
 		all_presets[user] = plist
 	}
 
@@ -117,50 +126,21 @@ func LoadDicePresets(db *sql.DB) (map[string][]DicePreset, error) {
 // by LoadDicePresets to a persistent storage area.
 //
 func SaveDicePresets(db *sql.DB, collection map[string][]DicePreset) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("Unable to initiate dice preset save: %v", err)
-	}
-
-	_, err = tx.Exec(`delete from dicepresets;`)
-	if err != nil { goto bail_out }
-
-	for user, presets := range collection {
-		var user_id int64
-
-		result, err := tx.Query(`select userid from users where username = ?`, user)
-		if err != nil { goto bail_out }
-		if !result.Next() {
-			// the user doesn't exist yet
-			iresult, err := tx.Exec(`insert into users (username) values (?)`, user)
-			if err != nil { goto bail_out }
-			user_id, err = iresult.LastInsertId()
-			if err != nil {goto bail_out}
-		} else {
-			// existing user, get their id
-			if err = result.Scan(&user_id); err != nil { goto bail_out }
+	err := withTransaction(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`delete from dicepresets;`); err != nil {
+			return err
 		}
-		result.Close()
-
-		for _, preset := range presets {
-			if _, err = tx.Exec(`
-				insert into dicepresets
-					(userid, name, description, rollspec)
-				values
-					(?, ?, ?, ?)
-			`, user_id, preset.Name, preset.Description, preset.RollSpec); err != nil { goto bail_out }
+		for user, presets := range collection {
+			if err := insertDicePresets(tx, user, presets); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing to dice preset database (%v)", err)
 	}
-
-	if err = tx.Commit(); err != nil { goto bail_out }
-
 	return nil
-
-bail_out:
-	if rberr := tx.Rollback(); rberr != nil {
-		return fmt.Errorf("Error writing to dice preset database (%v); further, I failed to rollback that operation (%v)!", err, rberr)
-	}
-	return fmt.Errorf("Error writing to dice preset database (%v)", err)
 }
 
 //
@@ -169,46 +149,49 @@ bail_out:
 // saving the entire collection.
 //
 func UpdateDicePresets(db *sql.DB, user string, presets []DicePreset) error {
-	var user_id int64
-
-	tx, err := db.Begin()
+	err := withTransaction(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`delete from dicepresets where userid in (select userid from users where username = ?)`, user); err != nil {
+			return err
+		}
+		return insertDicePresets(tx, user, presets)
+	})
 	if err != nil {
-		return fmt.Errorf("Unable to initiate dice preset update: %v", err)
+		return fmt.Errorf("Error writing to dice preset database (%v) for user %s", err, user)
 	}
+	return nil
+}
 
-	result, err := tx.Query(`select userid from users where username = ?`, user)
-	if err != nil { goto bail_out }
-	if !result.Next() {
-		iresult, err := tx.Exec(`insert into users (username) values (?)`, user)
-		if err != nil { goto bail_out }
-		user_id, err = iresult.LastInsertId()
-		if err != nil { goto bail_out }
-	} else {
-		if err = result.Scan(&user_id); err != nil { goto bail_out }
-	}
-	result.Close()
+//
+// Add a user's presets to the database, adding the user too if
+// they aren't there yet.
+//
+func insertDicePresets(tx *sql.Tx, user string, presets []DicePreset) error {
+	var user_id int64
 
-	_, err = tx.Exec(`delete from dicepresets where userid = ?`, user_id)
-	if err != nil { goto bail_out }
+	err := tx.QueryRow(`select userid from users where username = ?`, user).Scan(&user_id)
+	if err == sql.ErrNoRows {
+		// the user doesn't exist yet
+		var result sql.Result
+		if result, err = tx.Exec(`insert into users (username) values (?)`, user); err != nil {
+			return err
+		}
+		user_id, err = result.LastInsertId()
+	}
+	if err != nil {
+		return err
+	}
 
 	for _, preset := range presets {
 		if _, err = tx.Exec(`
 			insert into dicepresets
-				(userid, name, description, rollspec)
+				(userid, name, description, rollspec, folder, sortorder)
 			values
-				(?, ?, ?, ?)
-		`, user_id, preset.Name, preset.Description, preset.RollSpec); err != nil { goto bail_out }
+				(?, ?, ?, ?, ?, ?)
+		`, user_id, preset.Name, preset.Description, preset.RollSpec, preset.Folder, preset.SortOrder); err != nil {
+			return err
+		}
 	}
-
-	if err = tx.Commit(); err != nil { goto bail_out }
-
 	return nil
-
-bail_out:
-	if rberr := tx.Rollback(); rberr != nil {
-		return fmt.Errorf("Error writing to dice preset database (%v) for user %s; further, I failed to rollback that operation (%v)!", err, user, rberr)
-	}
-	return fmt.Errorf("Error writing to dice preset database (%v) for user %s", err, user)
 }
 
 func NewDicePresetListFromString(srep string) ([]DicePreset, error) {
@@ -225,17 +208,28 @@ func NewDicePresetListFromString(srep string) ([]DicePreset, error) {
 	return plist, nil
 }
 
+//
+// A preset is given as a list of
+//   <name> <description> <dice-spec> [<folder> <sort-order>]
+//
 func NewDicePresetFromString(srep string) (DicePreset, error) {
 	flist, err := ParseTclList(srep)
-	if err != nil { return DicePreset{"","",""}, err }
-	if len(flist) != 3 {
-		return DicePreset{"","",""}, fmt.Errorf("Wrong number of values in die roll preset \"%s\"", srep)
+	if err != nil { return DicePreset{}, err }
+	if len(flist) != 3 && len(flist) != 5 {
+		return DicePreset{}, fmt.Errorf("Wrong number of values in die roll preset \"%s\"", srep)
 	}
-	return DicePreset{
+	preset := DicePreset{
 		Name: flist[0],
 		Description: flist[1],
 		RollSpec: flist[2],
-	}, nil
+	}
+	if len(flist) == 5 {
+		preset.Folder = flist[3]
+		if preset.SortOrder, err = strconv.Atoi(flist[4]); err != nil {
+			return DicePreset{}, fmt.Errorf("Sort order \"%s\" in die roll preset \"%s\" is not a number", flist[4], flist[0])
+		}
+	}
+	return preset, nil
 }
 
 func DicePresetListToString(presets []DicePreset) (string, error) {
@@ -248,8 +242,81 @@ func DicePresetListToString(presets []DicePreset) (string, error) {
 	return ToTclString(plist)
 }
 
+//
+// The folder and sort order are only included if the preset has them,
+// so clients which don't know about them see the same lists as before.
+//
 func DicePresetToString(preset DicePreset) (string, error) {
-	return ToTclString([]string{preset.Name, preset.Description, preset.RollSpec})
+	if preset.Folder == "" && preset.SortOrder == 0 {
+		return ToTclString([]string{preset.Name, preset.Description, preset.RollSpec})
+	}
+	return ToTclString([]string{preset.Name, preset.Description, preset.RollSpec, preset.Folder, strconv.Itoa(preset.SortOrder)})
+}
+
+//
+// Before presets had folders and sort orders, clients sorted them by
+// name, and people put a sort key before a '|' in the name to arrange
+// them. When we add the new columns to an older database, we number
+// each user's presets in the order they sorted in by their old names,
+// and take the sort keys off the names (unless that would give two of
+// them the same name).
+//
+func addDicePresetFolderColumns(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow(`select count(*) from pragma_table_info('dicepresets') where name = 'folder'`).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+	return withTransaction(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			alter table dicepresets add column folder    text    not null default '';
+			alter table dicepresets add column sortorder integer not null default 0;
+		`); err != nil {
+			return err
+		}
+
+		type oldPreset struct {
+			id   int64
+			name string
+		}
+		byUser := make(map[int64][]oldPreset)
+		rows, err := tx.Query(`select presetid, userid, name from dicepresets`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var p oldPreset
+			var user int64
+			if err = rows.Scan(&p.id, &user, &p.name); err != nil {
+				return fmt.Errorf("unable to read die presets: %w", err)
+			}
+			byUser[user] = append(byUser[user], p)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		for _, presets := range byUser {
+			sort.SliceStable(presets, func(i, j int) bool { return presets[i].name < presets[j].name })
+			taken := make(map[string]bool)
+			for _, p := range presets {
+				taken[p.name] = true
+			}
+			for i, p := range presets {
+				name := p.name
+				if bar := strings.IndexRune(name, '|'); bar >= 0 && !taken[name[bar+1:]] {
+					delete(taken, name)
+					name = name[bar+1:]
+					taken[name] = true
+				}
+				if _, err = tx.Exec(`update dicepresets set name = ?, sortorder = ? where presetid = ?`, name, i+1, p.id); err != nil {
+					return fmt.Errorf("unable to update die preset %s: %w", p.name, err)
+				}
+			}
+		}
+		return nil
+	})
 }
 // @[00]@| GMA 4.2.2
 // @[01]@|
@@ -45,6 +45,8 @@ func TestLoadDicePresets(t *testing.T) {
 		name text not null,
 		description text not null,
 		rollspec text not null,
+		folder text not null default '',
+		sortorder integer not null default 0,
 		foreign key (userid) references users (userid) on delete cascade);`)
 	if err != nil  { t.Fatalf("error initializing database: %v", err) }
 
@@ -133,6 +135,8 @@ func TestSaveDicePresets(t *testing.T) {
 		name text not null,
 		description text not null,
 		rollspec text not null,
+		folder text not null default '',
+		sortorder integer not null default 0,
 		foreign key (userid) references users (userid) on delete cascade);`)
 	if err != nil  { t.Fatalf("error initializing database: %v", err) }
 
@@ -204,6 +208,8 @@ func TestUpdateDicePresets(t *testing.T) {
 		name text not null,
 		description text not null,
 		rollspec text not null,
+		folder text not null default '',
+		sortorder integer not null default 0,
 		foreign key (userid) references users (userid) on delete cascade);`)
 	if err != nil  { t.Fatalf("error initializing database: %v", err) }
 
@@ -273,6 +279,85 @@ func TestDicePresetsToString(t *testing.T) {
 		t.Errorf("string form was \"%s\"", s)
 	}
 }
+func TestDicePresetsFromStringWithFolder(t *testing.T) {
+	pl, err := NewDicePresetListFromString("{aa bb cc {weapons} 3} {x {} d6}")
+	if err != nil { t.Fatalf("error %v", err) }
+	expected := []DicePreset{
+		{Name: "aa", Description: "bb", RollSpec: "cc", Folder: "weapons", SortOrder: 3},
+		{Name: "x", RollSpec: "d6"},
+	}
+	if !cmp.Equal(pl, expected) {
+		t.Errorf("parsed presets differ: %s", cmp.Diff(expected, pl))
+	}
+	s, err := DicePresetListToString(pl)
+	if err != nil { t.Fatalf("error %v", err) }
+	if s != "{aa bb cc weapons 3} {x {} d6}" {
+		t.Errorf("string form was \"%s\"", s)
+	}
+	if _, err = NewDicePresetListFromString("{aa bb cc weapons} {x {} d6 {} first}"); err == nil {
+		t.Errorf("bad presets were accepted")
+	}
+}
+
+func TestDicePresetFolderMigration(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:"+t.TempDir()+"/old.db")
+	if err != nil { t.Fatalf("error opening database: %v", err) }
+	defer db.Close()
+
+	_, err = db.Exec(`
+	create table users (
+		userid integer primary key,
+		username text not null
+	);
+	create table dicepresets (
+		presetid integer primary key,
+		userid integer not null,
+		name text not null,
+		description text not null,
+		rollspec text not null,
+		foreign key (userid) references users (userid) on delete cascade);
+	insert into users (username) values ("steve"), ("jon");
+	insert into dicepresets (userid, name, description, rollspec)
+		values
+			((select userid from users where username="steve"), "zz", "", "d20"),
+			((select userid from users where username="steve"), "002|b", "", "d6"),
+			((select userid from users where username="steve"), "001|a", "", "d4"),
+			((select userid from users where username="steve"), "003|zz", "", "d8"),
+			((select userid from users where username="jon"), "1|a", "", "d10");`)
+	if err != nil { t.Fatalf("error initializing database: %v", err) }
+
+	if err = addDicePresetFolderColumns(db); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	p, err := LoadDicePresets(db)
+	if err != nil { t.Fatalf("error querying migrated db: %v", err) }
+	expected := map[string][]DicePreset{
+		"steve": []DicePreset{
+			{Name: "zz",     RollSpec: "d20", SortOrder: 4},
+			{Name: "b",      RollSpec: "d6",  SortOrder: 2},
+			{Name: "a",      RollSpec: "d4",  SortOrder: 1},
+			{Name: "003|zz", RollSpec: "d8",  SortOrder: 3},
+		},
+		"jon": []DicePreset{
+			{Name: "a", RollSpec: "d10", SortOrder: 1},
+		},
+	}
+	if !cmp.Equal(p, expected) {
+		t.Errorf("migrated db returned different data than expected: %s", cmp.Diff(expected, p))
+	}
+
+	// the second time, there's nothing to do
+	if _, err = db.Exec(`update dicepresets set name = "004|c" where name = "zz"`); err != nil {
+		t.Fatalf("error changing database: %v", err)
+	}
+	if err = addDicePresetFolderColumns(db); err != nil {
+		t.Fatalf("repeated migration failed: %v", err)
+	}
+	if p, err = LoadDicePresets(db); err != nil || p["steve"][0].Name != "004|c" {
+		t.Errorf("repeated migration changed presets to %v (%v)", p, err)
+	}
+}
+
 // @[00]@| GMA 4.2.2
 // @[01]@|
 // @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
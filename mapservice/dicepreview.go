@@ -0,0 +1,191 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                 Die-roll previews                                  //
+//                                                                                    //
+// Checking a die-roll spec and describing what it would roll, and the range of       //
+// possible results, without actually rolling anything. Clients use this to validate  //
+// presets as they are edited.                                                        //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//
+// RollPreview describes what a die-roll spec would do, without
+// rolling it.
+//
+type RollPreview struct {
+	Name        string                  // field name for multi-part rolls, or ""
+	Description string                  // normalized description of the dice
+	Min         int                     // lowest possible result
+	Max         int                     // highest possible result
+	Computed    bool                    // depends on other fields, so Min and Max aren't known
+	Modifiers   []StructuredDescription // global modifiers in effect
+}
+
+//
+// PreviewRoll parses a die-roll spec and reports what it would roll,
+// along with the possible range of results. It returns the label
+// of the spec and one preview for each set of dice which would be
+// rolled (more than one for permutations and multi-part rolls).
+// The spec is checked against the given limits as if we were going
+// to roll it.
+//
+func PreviewRoll(spec string, limits DiceLimits) (string, []RollPreview, error) {
+	if spec == "" {
+		return "", nil, fmt.Errorf("Empty die-roll spec")
+	}
+	d, err := NewDieRoller()
+	if err != nil {
+		return "", nil, err
+	}
+	d.DiceLimits = limits
+	if err = d.setNewSpecification(spec); err != nil {
+		return "", nil, err
+	}
+
+	if d.Fields != nil {
+		var previews []RollPreview
+		for _, field := range d.Fields {
+			if strings.Contains(field.Spec, "$") {
+				previews = append(previews, RollPreview{Name: field.Name, Description: field.Spec, Computed: true})
+				continue
+			}
+			_, field_previews, err := PreviewRoll(field.Spec, limits)
+			if err != nil {
+				return "", nil, fmt.Errorf("In multi-part die roll field %s: %v", field.Name, err)
+			}
+			for _, p := range field_previews {
+				p.Name = field.Name
+				previews = append(previews, p)
+			}
+		}
+		return d.LabelText, previews, nil
+	}
+
+	var dice []*Dice
+	if d.Template != "" {
+		for _, iteration := range permutationValues(d.Permutations) {
+			permuted, err := NewDice(substituteTemplateValues(d.Template, iteration))
+			if err != nil {
+				return "", nil, err
+			}
+			dice = append(dice, permuted)
+		}
+	} else {
+		dice = append(dice, d.d)
+	}
+
+	modifiers := d.modifierDescriptions()
+	var previews []RollPreview
+	for _, these_dice := range dice {
+		p := RollPreview{Modifiers: modifiers}
+		if d.PctChance >= 0 {
+			p.Description = fmt.Sprintf("%d%%", d.PctChance)
+			p.Min, p.Max = 0, 1
+		} else {
+			p.Description = these_dice.Description()
+			if p.Min, p.Max, err = these_dice.Range(); err != nil {
+				return "", nil, err
+			}
+			if d.DoMax {
+				p.Min = p.Max
+			}
+		}
+		previews = append(previews, p)
+	}
+	return d.LabelText, previews, nil
+}
+
+//
+// Describe the global modifiers set for this DieRoller, in the same
+// terms as they're reported in a roll's results.
+//
+func (d *DieRoller) modifierDescriptions() []StructuredDescription {
+	var mods []StructuredDescription
+	if d.Confirm {
+		c := "c"
+		if d.critThreat != 0 { c += strconv.Itoa(d.critThreat) }
+		if d.critBonus != 0 { c += fmt.Sprintf("%+d", d.critBonus) }
+		mods = append(mods, StructuredDescription{Type: "critspec", Value: c})
+	}
+	if d.RepeatFor > 1 {
+		mods = append(mods, StructuredDescription{Type: "repeat", Value: strconv.Itoa(d.RepeatFor)})
+	}
+	if d.RepeatUntil != 0 {
+		mods = append(mods, StructuredDescription{Type: "until", Value: strconv.Itoa(d.RepeatUntil)})
+	}
+	if d.DC != 0 {
+		mods = append(mods, StructuredDescription{Type: "dc", Value: strconv.Itoa(d.DC)})
+		if d.Degrees {
+			mods = append(mods, StructuredDescription{Type: "degrees", Value: fmt.Sprintf("%d/%d", d.CritFailBy, d.CritSuccessBy)})
+		}
+	}
+	if d.sfOpt != "" {
+		mods = append(mods, StructuredDescription{Type: "sf", Value: d.sfOpt})
+	}
+	if d.DoMax {
+		mods = append(mods, StructuredDescription{Type: "fullmax", Value: "maximized"})
+	}
+	return mods
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,108 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for die-roll previews
+//
+
+package mapservice
+
+import (
+	"testing"
+)
+
+func TestPreviewRoll(t *testing.T) {
+	type expected struct {
+		name, desc string
+		min, max   int
+		computed   bool
+		mods       int
+	}
+	for i, test := range []struct {
+		spec     string
+		label    string
+		previews []expected
+	}{
+		{"d20+5", "", []expected{{"", "1d20+5", 6, 25, false, 0}}},
+		{"hit=d20+5|c|dc 15", "hit", []expected{{"", "1d20+5", 6, 25, false, 2}}},
+		{"10-2d6", "", []expected{{"", "10-2d6", -2, 8, false, 0}}},
+		{"3d6 best of 2 * 2|max 30", "", []expected{{"", "3d6 best of 2*2 max 30", 6, 30, false, 0}}},
+		{"d20+{1/2}", "", []expected{{"", "1d20+1", 2, 21, false, 0}, {"", "1d20+2", 3, 22, false, 0}}},
+		{"2d6|!", "", []expected{{"", "2d6", 12, 12, false, 1}}},
+		{"40%", "", []expected{{"", "40%", 0, 1, false, 0}}},
+		{"a: d20; b: $a+2", "", []expected{{"a", "1d20", 1, 20, false, 0}, {"b", "$a+2", 0, 0, true, 0}}},
+	} {
+		label, previews, err := PreviewRoll(test.spec, DiceLimits{})
+		if err != nil {
+			t.Errorf("test #%d (%s) error %v", i, test.spec, err)
+			continue
+		}
+		if label != test.label || len(previews) != len(test.previews) {
+			t.Errorf("test #%d (%s) gave %q, %v", i, test.spec, label, previews)
+			continue
+		}
+		for j, p := range previews {
+			e := test.previews[j]
+			if p.Name != e.name || p.Description != e.desc || p.Min != e.min || p.Max != e.max || p.Computed != e.computed || len(p.Modifiers) != e.mods {
+				t.Errorf("test #%d (%s) preview %d was %v, expected %v", i, test.spec, j, p, e)
+			}
+		}
+	}
+
+	for _, bad := range []string{"", "d20+", "bogus", "d20|repeat", "10//(d6-d6)", "d6//0"} {
+		if _, _, err := PreviewRoll(bad, DiceLimits{}); err == nil {
+			t.Errorf("preview of %q should have failed", bad)
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
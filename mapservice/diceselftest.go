@@ -0,0 +1,152 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Dice self-test                                   //
+//                                                                                    //
+// Statistical checks that the dice are fair, so server operators can show their      //
+// players that the server is not cheating.                                           //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"math"
+)
+
+//
+// The die sizes checked by DiceSelfTest unless others are requested.
+//
+var DefaultSelfTestSides = []int{2, 3, 4, 6, 8, 10, 12, 20, 100}
+
+//
+// DiceSelfTestResult reports how uniformly a die of a given size
+// rolled over a large sample.
+//
+type DiceSelfTestResult struct {
+	Sides            int     // size of the die
+	Samples          int     // number of times it was rolled
+	Counts           []int   // how many times each face came up (Counts[0] is for 1)
+	ChiSquare        float64 // Pearson's chi-square statistic
+	DegreesOfFreedom int
+	PValue           float64 // probability of a chi-square this large from fair dice
+}
+
+//
+// DiceSelfTest rolls a die of each of the given sizes the given number
+// of times, and checks the results against a uniform distribution
+// with Pearson's chi-square test. A very small PValue means the die
+// is unlikely to be fair. If r is nil, the same random number generator
+// used for actual game play is tested.
+//
+func DiceSelfTest(sides []int, samples int, r RandomSource) ([]DiceSelfTestResult, error) {
+	var results []DiceSelfTestResult
+
+	for _, s := range sides {
+		if s < 2 {
+			return nil, fmt.Errorf("Can't test a die with %d side%s", s, plural(s))
+		}
+		if samples < 5*s {
+			return nil, fmt.Errorf("%d samples are too few to test a d%d (need at least %d)", samples, s, 5*s)
+		}
+		d, err := NewDiceBasic(1, s, 0)
+		if err != nil {
+			return nil, err
+		}
+		d.Random = r
+		result := DiceSelfTestResult{
+			Sides:            s,
+			Samples:          samples,
+			Counts:           make([]int, s),
+			DegreesOfFreedom: s - 1,
+		}
+		for i := 0; i < samples; i++ {
+			v, err := d.Roll()
+			if err != nil {
+				return nil, err
+			}
+			if v < 1 || v > s {
+				return nil, fmt.Errorf("d%d rolled %d", s, v)
+			}
+			result.Counts[v-1]++
+		}
+
+		expected := float64(samples) / float64(s)
+		for _, count := range result.Counts {
+			diff := float64(count) - expected
+			result.ChiSquare += diff * diff / expected
+		}
+		result.PValue = chiSquarePValue(result.ChiSquare, result.DegreesOfFreedom)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+//
+// Approximate probability that a chi-square distributed value with k
+// degrees of freedom is at least x, using the Wilson-Hilferty
+// transformation to a normal distribution. This is plenty accurate
+// for the purpose of spotting a broken random number generator.
+//
+func chiSquarePValue(x float64, k int) float64 {
+	if x <= 0 {
+		return 1
+	}
+	kf := float64(k)
+	z := (math.Cbrt(x/kf) - (1 - 2/(9*kf))) / math.Sqrt(2/(9*kf))
+	return 0.5 * math.Erfc(z/math.Sqrt2)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,123 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the dice self-test
+//
+
+package mapservice
+
+import (
+	"math/rand"
+	"testing"
+)
+
+//
+// A RandomSource which just counts upward, so every face comes
+// up exactly as often as every other.
+//
+type cyclingRandomSource struct {
+	next int32
+}
+
+func (c *cyclingRandomSource) Int31n(n int32) int32 {
+	c.next++
+	return c.next % n
+}
+
+func TestDiceSelfTest(t *testing.T) {
+	results, err := DiceSelfTest([]int{6, 20}, 6000, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("self-test error %v", err)
+	}
+	if len(results) != 2 || results[0].Sides != 6 || results[1].DegreesOfFreedom != 19 {
+		t.Fatalf("self-test results %v", results)
+	}
+	for _, result := range results {
+		if result.PValue < 0.001 {
+			t.Errorf("d%d looks unfair: chi-square %f, p %f", result.Sides, result.ChiSquare, result.PValue)
+		}
+	}
+
+	results, err = DiceSelfTest([]int{6}, 6000, &cyclingRandomSource{})
+	if err != nil || results[0].ChiSquare != 0 || results[0].PValue != 1 {
+		t.Errorf("perfectly even dice gave %v, %v", results, err)
+	}
+	results, err = DiceSelfTest([]int{6}, 6000, fixedRandomSource(3))
+	if err != nil || results[0].PValue > 0.000001 {
+		t.Errorf("loaded dice gave %v, %v", results, err)
+	}
+
+	if _, err = DiceSelfTest([]int{1}, 6000, nil); err == nil {
+		t.Errorf("self-test of a d1 was accepted")
+	}
+	if _, err = DiceSelfTest([]int{100}, 100, nil); err == nil {
+		t.Errorf("self-test with too few samples was accepted")
+	}
+
+	// spot-check the p-value approximation against known critical values
+	for _, check := range []struct {
+		x float64
+		k int
+		p float64
+	}{
+		{11.07, 5, 0.05},
+		{30.14, 19, 0.05},
+		{36.19, 19, 0.01},
+	} {
+		if p := chiSquarePValue(check.x, check.k); p < check.p*0.9 || p > check.p*1.1 {
+			t.Errorf("p-value for chi-square %f with %d degrees of freedom was %f; expected about %f", check.x, check.k, p, check.p)
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,386 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Drawing Quotas                                   //
+//                                                                                    //
+// Each player may only draw so much on the map: so many map elements, with so many   //
+// points in all, and none of them too complex. The GM may change these limits while  //
+// the game is running, see how much each player has drawn, and clean up after anyone //
+// who has drawn too much.                                                            //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//
+// DrawingQuota limits how much each player may draw on the map, so that
+// nobody floods it (by accident or otherwise) with thousands of map
+// elements. The GM is never held to these limits.
+//
+type DrawingQuota struct {
+	MaxElements      int // most map elements a player may have drawn (0 for default, <0 for no limit)
+	MaxPoints        int // most points in all of a player's map elements together (ditto)
+	MaxElementPoints int // most points in any one map element (ditto)
+}
+
+const (
+	DefaultMaxDrawnElements = 500
+	DefaultMaxDrawnPoints   = 20000
+	DefaultMaxElementPoints = 1000
+)
+
+func quotaLimit(limit, defaultLimit int) int {
+	if limit == 0 {
+		return defaultLimit
+	}
+	return limit
+}
+
+func (q DrawingQuota) maxElements() int {
+	return quotaLimit(q.MaxElements, DefaultMaxDrawnElements)
+}
+
+func (q DrawingQuota) maxPoints() int {
+	return quotaLimit(q.MaxPoints, DefaultMaxDrawnPoints)
+}
+
+func (q DrawingQuota) maxElementPoints() int {
+	return quotaLimit(q.MaxElementPoints, DefaultMaxElementPoints)
+}
+
+func describeLimit(limit int) string {
+	if limit < 0 {
+		return "no limit"
+	}
+	return fmt.Sprintf("%d", limit)
+}
+
+//
+// String describes the quota for the GM.
+//
+func (q DrawingQuota) String() string {
+	return fmt.Sprintf("%s element%s, %s point%s in all, %s point%s per element",
+		describeLimit(q.maxElements()), plural(q.maxElements()),
+		describeLimit(q.maxPoints()), plural(q.maxPoints()),
+		describeLimit(q.maxElementPoints()), plural(q.maxElementPoints()))
+}
+
+//
+// Count the points in a map element: its X, Y location and any more
+// in its POINTS list.
+//
+func elementPoints(points string) (int, error) {
+	coords, err := ParseTclList(points)
+	if err != nil {
+		return 0, err
+	}
+	return 1 + len(coords)/2, nil
+}
+
+//
+// Count the points in a map element from its LS definition lines.
+//
+func definitionPoints(definition []string) int {
+	for _, item_text := range definition {
+		item, err := ParseTclList(item_text)
+		if err != nil || len(item) < 2 || !strings.HasPrefix(item[0], "POINTS:") {
+			continue
+		}
+		if n, err := elementPoints(item[1]); err == nil {
+			return n
+		}
+	}
+	return 1
+}
+
+//
+// A map element drawn by a player.
+//
+type drawnElement struct {
+	owner    string
+	points   int
+	sequence int
+}
+
+//
+// drawingLedger keeps track of who drew which map elements, and how
+// big they are, so we can hold each player to the drawing quota. We
+// learn about an element being removed (by CLR or otherwise) by noticing
+// that it's no longer in the game state.
+//
+type drawingLedger struct {
+	lock         sync.Mutex
+	elements     map[string]drawnElement
+	nextSequence int
+	quota        *DrawingQuota
+}
+
+//
+// Get the quota currently in force: whatever the GM last set, or else
+// the server's configured quota.
+//
+func (l *drawingLedger) currentQuota(configured DrawingQuota) DrawingQuota {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.quota != nil {
+		return *l.quota
+	}
+	return configured
+}
+
+func (l *drawingLedger) setQuota(q DrawingQuota) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.quota = &q
+}
+
+//
+// Forget about elements which no longer exist. The caller must hold
+// the lock.
+//
+func (l *drawingLedger) prune(exists func(string) bool) {
+	for id := range l.elements {
+		if !exists(id) {
+			delete(l.elements, id)
+		}
+	}
+}
+
+//
+// Record that a user drew (or redrew) the given elements (mapping ID
+// to number of points), if they may do so under quota q. If not,
+// nothing is recorded and an error explains why. Elements already drawn
+// by someone else stay theirs, but still can't be made too complex.
+//
+func (l *drawingLedger) claim(user string, drawn map[string]int, q DrawingQuota, exists func(string) bool) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.elements == nil {
+		l.elements = make(map[string]drawnElement)
+	}
+	l.prune(exists)
+
+	count, points := 0, 0
+	for _, e := range l.elements {
+		if e.owner == user {
+			count++
+			points += e.points
+		}
+	}
+	var ids []string
+	for id, n := range drawn {
+		if limit := q.maxElementPoints(); limit >= 0 && n > limit {
+			return fmt.Errorf("That map element has %d points, but no element may have more than %d", n, limit)
+		}
+		if e, ok := l.elements[id]; ok {
+			if e.owner != user {
+				continue
+			}
+			count--
+			points -= e.points
+		}
+		count++
+		points += n
+		ids = append(ids, id)
+	}
+	if limit := q.maxElements(); limit >= 0 && count > limit {
+		return fmt.Errorf("That would give you %d map elements, but you may only have %d; please remove some first", count, limit)
+	}
+	if limit := q.maxPoints(); limit >= 0 && points > limit {
+		return fmt.Errorf("That would give your map elements %d points in all, but you may only have %d; please remove or simplify some first", points, limit)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		seq := l.nextSequence
+		if e, ok := l.elements[id]; ok {
+			seq = e.sequence
+		} else {
+			l.nextSequence++
+		}
+		l.elements[id] = drawnElement{owner: user, points: drawn[id], sequence: seq}
+	}
+	return nil
+}
+
+//
+// DrawingUsage is how much a user has drawn on the map.
+//
+type DrawingUsage struct {
+	User     string
+	Elements int
+	Points   int
+}
+
+//
+// Report how much each user has drawn, sorted by username.
+//
+func (l *drawingLedger) usage(exists func(string) bool) []DrawingUsage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(exists)
+
+	byUser := make(map[string]*DrawingUsage)
+	for _, e := range l.elements {
+		u, ok := byUser[e.owner]
+		if !ok {
+			u = &DrawingUsage{User: e.owner}
+			byUser[e.owner] = u
+		}
+		u.Elements++
+		u.Points += e.points
+	}
+	var usage []DrawingUsage
+	for _, u := range byUser {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].User < usage[j].User })
+	return usage
+}
+
+//
+// Return the IDs of the elements drawn by a user, most recent first.
+// If n > 0, only the n most recent are returned.
+//
+func (l *drawingLedger) drawnBy(user string, n int, exists func(string) bool) []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(exists)
+
+	var ids []string
+	for id, e := range l.elements {
+		if e.owner == user {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return l.elements[ids[i]].sequence > l.elements[ids[j]].sequence })
+	if n > 0 && len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+func (ms *MapService) objectExists(id string) bool {
+	_, ok := ms.State.Object(id)
+	return ok
+}
+
+//
+// Check that a player may draw the given map elements (mapping ID to
+// number of points) and if so, note that they did. If not, they're
+// told why and we return false. The GM may draw anything.
+//
+func (ms *MapService) claimDrawing(thisClient *MapClient, drawn map[string]int) bool {
+	if thisClient.IsGM() || len(drawn) == 0 {
+		return true
+	}
+	q := ms.drawings.currentQuota(ms.DrawingQuota)
+	if err := ms.drawings.claim(thisClient.Username(), drawn, q, ms.objectExists); err != nil {
+		log.Printf("[client %s] DENIED drawing by %s over quota: %v", thisClient.logTag(), thisClient.Username(), err)
+		thisClient.sendError("map element not accepted: %v", err)
+		return false
+	}
+	return true
+}
+
+//
+// Check that a player isn't reshaping a map element beyond the drawing
+// quota. If they are, they're told no and we return false.
+//
+func (ms *MapService) checkDrawingQuota(event *MapEvent, thisClient *MapClient) bool {
+	if thisClient.IsGM() || event.EventType() != "OA" {
+		return true
+	}
+	kvlist, err := ParseTclList(event.Fields[2])
+	if err != nil {
+		return true
+	}
+	for i := 0; i+1 < len(kvlist); i += 2 {
+		if kvlist[i] != "POINTS" {
+			continue
+		}
+		id, class, _ := ms.State.ResolveObject(event.Fields[1])
+		if id == "" || (class != "E" && class != "") {
+			return true
+		}
+		n, err := elementPoints(kvlist[i+1])
+		if err != nil {
+			return true
+		}
+		return ms.claimDrawing(thisClient, map[string]int{id: n})
+	}
+	return true
+}
+
+//
+// Remove map elements drawn by a user (all of them, or the n most
+// recent), telling everyone to clear them. Returns how many there were.
+//
+func (ms *MapService) removeDrawings(user string, n int) int {
+	ids := ms.drawings.drawnBy(user, n, ms.objectExists)
+	for _, id := range ids {
+		ms.clearObject(id)
+	}
+	return len(ids)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
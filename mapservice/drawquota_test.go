@@ -0,0 +1,132 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for drawing quotas
+//
+
+package mapservice
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDefinitionPoints(t *testing.T) {
+	for i, test := range []struct {
+		definition []string
+		points     int
+	}{
+		{[]string{"X:e1 1", "Y:e1 2"}, 1},
+		{[]string{"X:e1 1", "POINTS:e1 {3 4 5 6}", "Y:e1 2"}, 3},
+		{[]string{"POINTS:e1 {}"}, 1},
+	} {
+		if n := definitionPoints(test.definition); n != test.points {
+			t.Errorf("test %d: %d points, expected %d", i, n, test.points)
+		}
+	}
+}
+
+func TestDrawingLedger(t *testing.T) {
+	var l drawingLedger
+	q := DrawingQuota{MaxElements: 3, MaxPoints: 10, MaxElementPoints: 5}
+	existing := make(map[string]bool)
+	exists := func(id string) bool { return existing[id] }
+	draw := func(user string, drawn map[string]int) error {
+		err := l.claim(user, drawn, q, exists)
+		if err == nil {
+			for id := range drawn {
+				existing[id] = true
+			}
+		}
+		return err
+	}
+
+	if err := draw("alice", map[string]int{"a1": 2, "a2": 3}); err != nil {
+		t.Errorf("first drawing refused: %v", err)
+	}
+	if err := draw("alice", map[string]int{"a3": 6}); err == nil || !strings.Contains(err.Error(), "no element may have more than 5") {
+		t.Errorf("complex element gave %v", err)
+	}
+	if err := draw("alice", map[string]int{"a3": 1, "a4": 1}); err == nil || !strings.Contains(err.Error(), "you may only have 3") {
+		t.Errorf("too many elements gave %v", err)
+	}
+	if err := draw("alice", map[string]int{"a3": 5, "a2": 4}); err == nil || !strings.Contains(err.Error(), "11 points") {
+		t.Errorf("too many points gave %v", err)
+	}
+	if err := draw("bob", map[string]int{"a1": 5, "b1": 5}); err != nil {
+		t.Errorf("bob's drawing refused: %v", err)
+	}
+	if err := draw("alice", map[string]int{"a2": 1, "a3": 5}); err != nil {
+		t.Errorf("redrawn element refused: %v", err)
+	}
+	if d := cmp.Diff([]DrawingUsage{{"alice", 3, 8}, {"bob", 1, 5}}, l.usage(exists)); d != "" {
+		t.Errorf("usage differs: %s", d)
+	}
+	if d := cmp.Diff([]string{"a3", "a2"}, l.drawnBy("alice", 2, exists)); d != "" {
+		t.Errorf("alice's recent drawings differ: %s", d)
+	}
+
+	delete(existing, "a3")
+	if d := cmp.Diff([]string{"a2", "a1"}, l.drawnBy("alice", 0, exists)); d != "" {
+		t.Errorf("alice's drawings after one was cleared differ: %s", d)
+	}
+
+	q = DrawingQuota{MaxElements: -1, MaxPoints: -1, MaxElementPoints: -1}
+	if err := draw("alice", map[string]int{"a5": 100, "a6": 100}); err != nil {
+		t.Errorf("unlimited drawing refused: %v", err)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,316 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Ambient Effects                                   //
+//                                                                                    //
+// The weather and light over the whole map: how hard it is raining, how thick the    //
+// fog is, and how dark it is. The GM sets them, and the server keeps them (in the    //
+// database, and with each scene the GM exports) and tells every client, so that all  //
+// the clients and overlays show the same conditions.                                 //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//
+// EffectsFileSuffix is added to a .map file's name (in place of ".map")
+// for the file beside it holding the ambient effects of that scene.
+//
+const EffectsFileSuffix = ".effects"
+
+//
+// MaxEffectLevel is the most any ambient effect may be (0 being none
+// at all).
+//
+const MaxEffectLevel = 100
+
+//
+// AmbientEffects describe the conditions over the whole map, each from
+// 0 (none) to MaxEffectLevel.
+//
+type AmbientEffects struct {
+	Rain     int `json:"rain"`
+	Fog      int `json:"fog"`
+	Darkness int `json:"darkness"`
+}
+
+//
+// ParseAmbientEffects makes sense of the fields of an FX message
+// (<rain> <fog> <darkness>).
+//
+func ParseAmbientEffects(fields []string) (AmbientEffects, error) {
+	if len(fields) != 3 {
+		return AmbientEffects{}, fmt.Errorf("Ambient effects need rain, fog, and darkness levels")
+	}
+	var e AmbientEffects
+	for i, level := range []*int{&e.Rain, &e.Fog, &e.Darkness} {
+		var err error
+		if *level, err = strconv.Atoi(fields[i]); err != nil || *level < 0 || *level > MaxEffectLevel {
+			return AmbientEffects{}, fmt.Errorf("%s level %s must be an integer from 0 to %d", []string{"Rain", "Fog", "Darkness"}[i], fields[i], MaxEffectLevel)
+		}
+	}
+	return e, nil
+}
+
+//
+// Message returns the FX message which tells a client about the effects.
+//
+func (e AmbientEffects) Message() []string {
+	return []string{"FX", strconv.Itoa(e.Rain), strconv.Itoa(e.Fog), strconv.Itoa(e.Darkness)}
+}
+
+//
+// EffectsStorage is implemented by storage backends which can keep the
+// ambient effects.
+//
+type EffectsStorage interface {
+	LoadAmbientEffects() (AmbientEffects, error)
+	SaveAmbientEffects(e AmbientEffects) error
+}
+
+//
+// Database Schema
+//  _______________
+// | effects       |
+// |---------------|
+// | id         Pi |
+// | rain        i |
+// | fog         i |
+// | darkness    i |
+// |_______________|
+//
+// P=primary key
+// i=integer
+//
+// There is only ever one row (with id 1). This table was added after
+// the others, so it is created whenever we open a database which doesn't
+// have it yet.
+//
+func createEffectsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists effects (
+			id       integer primary key check (id = 1),
+			rain     integer not null,
+			fog      integer not null,
+			darkness integer not null
+		);`)
+	return err
+}
+
+//
+// LoadAmbientEffects reads the ambient effects from the database. If
+// none have been saved, there aren't any.
+//
+func LoadAmbientEffects(db *sql.DB) (AmbientEffects, error) {
+	var e AmbientEffects
+	err := db.QueryRow(`select rain, fog, darkness from effects where id = 1`).Scan(&e.Rain, &e.Fog, &e.Darkness)
+	if err == sql.ErrNoRows {
+		return AmbientEffects{}, nil
+	}
+	if err != nil {
+		return AmbientEffects{}, fmt.Errorf("Unable to read ambient effects: %v", err)
+	}
+	return e, nil
+}
+
+//
+// SaveAmbientEffects stores the ambient effects, replacing the old ones.
+//
+func SaveAmbientEffects(db *sql.DB, e AmbientEffects) error {
+	if _, err := db.Exec(`insert or replace into effects (id, rain, fog, darkness) values (1, ?, ?, ?)`,
+		e.Rain, e.Fog, e.Darkness); err != nil {
+		return fmt.Errorf("Unable to save ambient effects: %v", err)
+	}
+	return nil
+}
+
+//
+// ambientEffects holds the current effects for the server.
+//
+type ambientEffects struct {
+	lock    sync.Mutex
+	effects AmbientEffects
+}
+
+func (a *ambientEffects) get() AmbientEffects {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.effects
+}
+
+func (a *ambientEffects) set(e AmbientEffects) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.effects = e
+}
+
+//
+// Load the saved ambient effects, if the storage backend keeps them.
+//
+func (ms *MapService) loadAmbientEffects() error {
+	storage, ok := ms.Storage.(EffectsStorage)
+	if !ok {
+		return nil
+	}
+	e, err := storage.LoadAmbientEffects()
+	if err != nil {
+		return err
+	}
+	ms.effects.set(e)
+	return nil
+}
+
+//
+// AmbientEffects returns the conditions over the map now.
+//
+func (ms *MapService) AmbientEffects() AmbientEffects {
+	return ms.effects.get()
+}
+
+//
+// Tell a client what the conditions are.
+//
+func (ms *MapService) sendAmbientEffects(thisClient *MapClient) {
+	thisClient.Send(ms.effects.get().Message()...)
+}
+
+//
+// Change the ambient effects, saving them if we can, and tell everyone
+// but the client who changed them (nil if the server did).
+//
+func (ms *MapService) changeAmbientEffects(thisClient *MapClient, e AmbientEffects) error {
+	if storage, ok := ms.Storage.(EffectsStorage); ok {
+		if err := storage.SaveAmbientEffects(e); err != nil {
+			return err
+		}
+	}
+	ms.effects.set(e)
+	for _, peer := range ms.Clients.Subscribers("FX") {
+		if peer != thisClient && peer.Authenticated {
+			peer.Send(e.Message()...)
+		}
+	}
+	return nil
+}
+
+//
+// The effects file which goes with a .map file.
+//
+func effectsFilePath(mapPath string) string {
+	return strings.TrimSuffix(mapPath, ".map") + EffectsFileSuffix
+}
+
+//
+// Save the ambient effects beside a .map file, so they go with it when
+// it is deployed as a scene. If there aren't any, there is no effects
+// file.
+//
+func (ms *MapService) saveEffectsFile(mapPath string) error {
+	e := ms.effects.get()
+	path := effectsFilePath(mapPath)
+	if e == (AmbientEffects{}) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+//
+// Change the ambient effects to those saved beside a .map file, or to
+// none if there aren't any saved there. Nobody is told if that doesn't
+// change them.
+//
+func (ms *MapService) deployEffectsFile(mapPath string) error {
+	var e AmbientEffects
+	data, err := os.ReadFile(effectsFilePath(mapPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &e); err != nil {
+			return fmt.Errorf("effects file for %s is unreadable: %v", mapPath, err)
+		}
+		// check them just as if the GM had sent them
+		if e, err = ParseAmbientEffects(e.Message()[1:]); err != nil {
+			return err
+		}
+	}
+	if e == ms.effects.get() {
+		return nil
+	}
+	if err = ms.changeAmbientEffects(nil, e); err != nil {
+		return err
+	}
+	log.Printf("Ambient effects for %s: rain %d, fog %d, darkness %d", filepath.Base(mapPath), e.Rain, e.Fog, e.Darkness)
+	return nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,164 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for ambient effects
+//
+
+package mapservice
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseAmbientEffects(t *testing.T) {
+	e, err := ParseAmbientEffects([]string{"40", "0", "100"})
+	if err != nil || e != (AmbientEffects{Rain: 40, Darkness: 100}) {
+		t.Errorf("effects were %v, %v", e, err)
+	}
+	for _, bad := range [][]string{{"1", "2"}, {"x", "0", "0"}, {"0", "-1", "0"}, {"0", "0", "101"}} {
+		if _, err := ParseAmbientEffects(bad); err == nil {
+			t.Errorf("effects %q accepted", bad)
+		}
+	}
+}
+
+func TestAmbientEffectCommands(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "FX 50 0 0"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV") {
+		t.Errorf("player changing the weather was sent %v", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "FX 50 20 10"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || sent[0] != "// {Ambient effects changed.}" {
+		t.Errorf("GM was sent %q", sent)
+	}
+	if sent := sentToTestClient(alice); strings.Join(sent, "\n") != "FX 50 20 10" {
+		t.Errorf("player was sent %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "FX?"), alice)
+	if sent := sentToTestClient(alice); strings.Join(sent, "\n") != "FX 50 20 10" {
+		t.Errorf("player's FX? was answered with %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "FX 50 20 200"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "from 0 to 100") {
+		t.Errorf("GM was sent %q for a bad level", sent)
+	}
+	if e := ms.AmbientEffects(); e != (AmbientEffects{Rain: 50, Fog: 20, Darkness: 10}) {
+		t.Errorf("effects are now %v", e)
+	}
+}
+
+func TestAmbientEffectsSaved(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", filepath.Join(t.TempDir(), "effects.db"))
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	gm := newTestClient(ms, "gm", "GM", true)
+	ms.ExecuteAction(testEvent(t, "FX 0 80 30"), gm)
+
+	restarted := newTestService()
+	restarted.Storage = storage
+	if err = restarted.loadAmbientEffects(); err != nil {
+		t.Fatalf("unable to load effects: %v", err)
+	}
+	if e := restarted.AmbientEffects(); e != (AmbientEffects{Fog: 80, Darkness: 30}) {
+		t.Errorf("effects loaded were %v", e)
+	}
+}
+
+func TestAmbientEffectsWithScene(t *testing.T) {
+	ms := newTestService()
+	ms.MapExportDir = t.TempDir()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	sendTestLS(t, ms, gm, "TEXT:t1 {welcome}", "X:t1 5")
+
+	ms.ExecuteAction(testEvent(t, "FX 70 10 0"), gm)
+	ms.ExecuteAction(testEvent(t, "EXPORT storm"), gm)
+	ms.ExecuteAction(testEvent(t, "FX 0 0 0"), gm)
+	ms.ExecuteAction(testEvent(t, "EXPORT calm"), gm)
+	if _, err := os.Stat(filepath.Join(ms.MapExportDir, "storm"+EffectsFileSuffix)); err != nil {
+		t.Errorf("effects not exported with storm: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(ms.MapExportDir, "calm"+EffectsFileSuffix)); !os.IsNotExist(err) {
+		t.Errorf("effects exported with calm: %v", err)
+	}
+	sentToTestClient(gm)
+	sentToTestClient(alice)
+
+	ms.ExecuteAction(testEvent(t, "SCENE storm"), gm)
+	if e := ms.AmbientEffects(); e != (AmbientEffects{Rain: 70, Fog: 10}) {
+		t.Errorf("effects after storm deployed were %v", e)
+	}
+	if sent := sentToTestClient(alice); len(sent) == 0 || sent[len(sent)-1] != "FX 70 10 0" {
+		t.Errorf("player was sent %q when storm deployed", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "SCENE calm"), gm)
+	if e := ms.AmbientEffects(); e != (AmbientEffects{}) {
+		t.Errorf("effects after calm deployed were %v", e)
+	}
+	if sent := sentToTestClient(gm); len(sent) < 2 || sent[len(sent)-2] != "FX 0 0 0" {
+		t.Errorf("GM was sent %q when calm deployed", sent)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,395 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     Encounters                                     //
+//                                                                                    //
+// Encounter definitions let the GM prepare fights ahead of time as lists of creature //
+// templates, which are kept in the database and may later be deployed onto the map   //
+// as new creature tokens.                                                            //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+//
+// An Encounter is a fight prepared ahead of time: a list of creatures
+// to put on the map together when the time comes.
+//
+type Encounter struct {
+	Name      string              // unique name of the encounter
+	CR        string              // challenge rating (as the GM likes to write it)
+	Notes     string              // anything else the GM wants to remember
+	Creatures []EncounterCreature // creatures in the encounter
+}
+
+//
+// An EncounterCreature is a template for one or more identical
+// creatures in an Encounter.
+//
+type EncounterCreature struct {
+	Name  string // creature name (numbered as goblin#1, goblin#2, ... if Count > 1)
+	Count int    // how many of them there are
+	Color string // token color
+	Area  string // area of threat
+	Size  string // creature size
+	Reach string // reach
+	Attrs string // other attributes (such as INIT_mod or HEALTH) as a key/value list
+}
+
+//
+// EncounterStorage is implemented by storage backends which can keep
+// encounter definitions.
+//
+type EncounterStorage interface {
+	ListEncounters() ([]Encounter, error)
+	LoadEncounter(name string) (Encounter, bool, error)
+	SaveEncounter(enc Encounter) error
+	DeleteEncounter(name string) (bool, error)
+}
+
+//
+// Database Schema
+//  ________________       ___________________
+// | encounters     |     | encountercreatures|
+// |----------------|     |-------------------|
+// | encounterid PAi|---->| encounterid     i |
+// | name         s |     | seq             i |
+// | cr           s |     | name            s |
+// | notes        s |     | count           i |
+// |________________|     | color           s |
+//                        | area            s |
+//                        | size            s |
+//                        | reach           s |
+//                        | attrs           s |
+//                        |___________________|
+//
+// P=primary key
+// A=auto-increment
+// i=integer
+// s=string
+//
+// These tables were added after the others, so they are created
+// whenever we open a database which doesn't have them yet.
+//
+func createEncounterTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists encounters (
+			encounterid integer primary key,
+			name        text    not null unique,
+			cr          text    not null,
+			notes       text    not null
+		);
+		create table if not exists encountercreatures (
+			encounterid integer not null,
+			seq         integer not null,
+			name        text    not null,
+			count       integer not null,
+			color       text    not null,
+			area        text    not null,
+			size        text    not null,
+			reach       text    not null,
+			attrs       text    not null,
+				foreign key (encounterid)
+					references encounters (encounterid)
+					on delete cascade
+		);`)
+	return err
+}
+
+//
+// LoadEncounters reads all of the encounters in the database (or just
+// the one with the given name, if name isn't empty), sorted by name.
+//
+func LoadEncounters(db *sql.DB, name string) ([]Encounter, error) {
+	query := `select encounterid, name, cr, notes from encounters`
+	var args []interface{}
+	if name != "" {
+		query += ` where name = ?`
+		args = append(args, name)
+	}
+	rows, err := db.Query(query+` order by name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	var encounters []Encounter
+	for rows.Next() {
+		var id int64
+		var enc Encounter
+		if err = rows.Scan(&id, &enc.Name, &enc.CR, &enc.Notes); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("unable to read encounters: %v", err)
+		}
+		ids = append(ids, id)
+		encounters = append(encounters, enc)
+	}
+	rows.Close()
+
+	for i, id := range ids {
+		rows, err := db.Query(`
+			select name, count, color, area, size, reach, attrs
+				from encountercreatures
+				where encounterid = ?
+				order by seq`, id)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var c EncounterCreature
+			if err = rows.Scan(&c.Name, &c.Count, &c.Color, &c.Area, &c.Size, &c.Reach, &c.Attrs); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("unable to read creatures for encounter %s: %v", encounters[i].Name, err)
+			}
+			encounters[i].Creatures = append(encounters[i].Creatures, c)
+		}
+		rows.Close()
+	}
+	return encounters, nil
+}
+
+//
+// SaveEncounter stores an encounter, replacing any existing one
+// with the same name.
+//
+func SaveEncounter(db *sql.DB, enc Encounter) error {
+	err := withTransaction(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`delete from encountercreatures where encounterid in (select encounterid from encounters where name = ?)`, enc.Name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`delete from encounters where name = ?`, enc.Name); err != nil {
+			return err
+		}
+		result, err := tx.Exec(`insert into encounters (name, cr, notes) values (?, ?, ?)`, enc.Name, enc.CR, enc.Notes)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for seq, c := range enc.Creatures {
+			if _, err = tx.Exec(`
+				insert into encountercreatures (encounterid, seq, name, count, color, area, size, reach, attrs)
+					values (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				id, seq, c.Name, c.Count, c.Color, c.Area, c.Size, c.Reach, c.Attrs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to save encounter %s: %v", enc.Name, err)
+	}
+	return nil
+}
+
+//
+// DeleteEncounter removes an encounter. It returns false if there
+// was no such encounter.
+//
+func DeleteEncounter(db *sql.DB, name string) (bool, error) {
+	if _, err := db.Exec(`delete from encountercreatures where encounterid in (select encounterid from encounters where name = ?)`, name); err != nil {
+		return false, err
+	}
+	result, err := db.Exec(`delete from encounters where name = ?`, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+//
+// ParseEncounterCreatures reads a creature list as sent in an EN message.
+// Each element is
+//   {<name> <count> <color> <area> <size> <reach> [<attrs>]}
+//
+func ParseEncounterCreatures(list string) ([]EncounterCreature, error) {
+	items, err := ParseTclList(list)
+	if err != nil {
+		return nil, err
+	}
+	var creatures []EncounterCreature
+	for _, item := range items {
+		f, err := ParseTclList(item)
+		if err != nil {
+			return nil, err
+		}
+		if len(f) < 6 || len(f) > 7 {
+			return nil, fmt.Errorf("Encounter creature \"%s\" should have 6 or 7 fields", item)
+		}
+		c := EncounterCreature{Name: f[0], Color: f[2], Area: f[3], Size: f[4], Reach: f[5]}
+		if c.Count, err = strconv.Atoi(f[1]); err != nil || c.Count < 1 {
+			return nil, fmt.Errorf("Encounter creature %s count \"%s\" must be a positive integer", f[0], f[1])
+		}
+		if len(f) > 6 {
+			if attrs, err := ParseTclList(f[6]); err != nil || len(attrs)%2 != 0 {
+				return nil, fmt.Errorf("Encounter creature %s attributes must be a list of names and values", f[0])
+			}
+			c.Attrs = f[6]
+		}
+		creatures = append(creatures, c)
+	}
+	return creatures, nil
+}
+
+//
+// Format the creature list as sent in EN messages.
+//
+func (enc Encounter) creatureList() (string, error) {
+	var items []string
+	for _, c := range enc.Creatures {
+		item, err := ToTclString([]string{c.Name, strconv.Itoa(c.Count), c.Color, c.Area, c.Size, c.Reach, c.Attrs})
+		if err != nil {
+			return "", err
+		}
+		items = append(items, item)
+	}
+	return ToTclString(items)
+}
+
+//
+// Make up a new object ID for a creature token.
+//
+func newObjectID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+//
+// Pick a name for a new creature which isn't already in use on the map.
+// If numbered is true, the name is always numbered (goblin#1, goblin#2, ...).
+//
+func (gs *GameState) unusedCreatureName(name string, numbered bool) string {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	if _, taken := gs.IdByName[name]; !taken && !numbered {
+		return name
+	}
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s#%d", name, n)
+		if _, taken := gs.IdByName[candidate]; !taken {
+			return candidate
+		}
+	}
+}
+
+//
+// DeployEncounter makes new creature tokens for everything in the
+// encounter, lined up in a row starting at the given grid location.
+// It returns the PS (and, where needed, OA) events which create them,
+// which have already been applied to the game state.
+//
+func (gs *GameState) DeployEncounter(enc Encounter, x, y int) ([]*MapEvent, error) {
+	var events []*MapEvent
+	for _, c := range enc.Creatures {
+		for i := 0; i < c.Count; i++ {
+			id, err := newObjectID()
+			if err != nil {
+				return events, err
+			}
+			name := gs.unusedCreatureName(c.Name, c.Count > 1)
+			placed, err := gs.placeCreature(id, c.Color, name, c.Area, c.Size, "monster", x, y, c.Reach, c.Attrs)
+			events = append(events, placed...)
+			if err != nil {
+				return events, err
+			}
+			x++
+		}
+	}
+	return events, nil
+}
+
+//
+// Put a new creature token on the map. Returns the PS event for it,
+// followed by an OA event to set its other attributes if attrs isn't
+// empty. These have already been applied to the game state.
+//
+func (gs *GameState) placeCreature(id, color, name, area, size, ctype string, x, y int, reach, attrs string) ([]*MapEvent, error) {
+	var events []*MapEvent
+	ps, err := NewMapEventFromList("", []string{"PS", id, color, name, area, size, ctype,
+		strconv.Itoa(x), strconv.Itoa(y), reach}, "", "")
+	if err != nil {
+		return nil, err
+	}
+	if err = gs.Record(ps); err != nil {
+		return nil, err
+	}
+	events = append(events, ps)
+	if attrs != "" {
+		oa, err := NewMapEventFromList("", []string{"OA", id, attrs}, "", "")
+		if err != nil {
+			return events, err
+		}
+		if err = gs.Record(oa); err != nil {
+			return events, err
+		}
+		events = append(events, oa)
+	}
+	return events, nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,136 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for encounters
+//
+
+package mapservice
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEncounters(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", filepath.Join(t.TempDir(), "encounters.db"))
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	es, ok := storage.(EncounterStorage)
+	if !ok {
+		t.Fatalf("sqlite storage doesn't store encounters")
+	}
+
+	creatures, err := ParseEncounterCreatures("{goblin 3 green 1 S 0 {INIT_mod 2}} {{ogre chief} 1 red 2 L 2}")
+	if err != nil {
+		t.Fatalf("unable to parse creatures: %v", err)
+	}
+	ambush := Encounter{Name: "ambush", CR: "3", Notes: "on the road", Creatures: creatures}
+	camp := Encounter{Name: "camp", CR: "1/2", Creatures: creatures[:1]}
+	for _, enc := range []Encounter{ambush, camp, camp} {
+		if err = es.SaveEncounter(enc); err != nil {
+			t.Fatalf("unable to save encounter %s: %v", enc.Name, err)
+		}
+	}
+	all, err := es.ListEncounters()
+	if err != nil || !cmp.Equal(all, []Encounter{ambush, camp}) {
+		t.Errorf("encounter list was %v, %v", all, err)
+	}
+	if enc, ok, err := es.LoadEncounter("ambush"); !ok || err != nil || !cmp.Equal(enc, ambush) {
+		t.Errorf("loaded encounter %v, %v, %v", enc, ok, err)
+	}
+	if list, err := ambush.creatureList(); err != nil || list != "{goblin 3 green 1 S 0 {INIT_mod 2}} {{ogre chief} 1 red 2 L 2 {}}" {
+		t.Errorf("creature list was %q, %v", list, err)
+	}
+	if found, err := es.DeleteEncounter("camp"); !found || err != nil {
+		t.Errorf("deleting camp gave %v, %v", found, err)
+	}
+	if found, err := es.DeleteEncounter("camp"); found || err != nil {
+		t.Errorf("deleting camp again gave %v, %v", found, err)
+	}
+	if _, ok, err := es.LoadEncounter("camp"); ok || err != nil {
+		t.Errorf("deleted encounter still loads: %v, %v", ok, err)
+	}
+
+	for _, bad := range []string{"{goblin 0 green 1 S 0}", "{goblin 1 green}", "{goblin 1 green 1 S 0 {INIT_mod}}"} {
+		if _, err := ParseEncounterCreatures(bad); err == nil {
+			t.Errorf("creature list %s accepted", bad)
+		}
+	}
+
+	gs := NewGameState()
+	recordTestEvents(t, gs, "PS 1 green goblin#1 1 S monster 0 0 0")
+	events, err := gs.DeployEncounter(ambush, 10, 5)
+	if err != nil || len(events) != 7 {
+		t.Fatalf("deploy gave %d events, %v", len(events), err)
+	}
+	for _, name := range []string{"goblin#2", "goblin#3", "goblin#4", "ogre chief"} {
+		id, _, known := gs.ResolveObject("@" + name)
+		if !known {
+			t.Errorf("%s not deployed", name)
+			continue
+		}
+		obj, _ := gs.Object(id)
+		if name != "ogre chief" && obj.Attrs["INIT_mod"] != "2" {
+			t.Errorf("%s attributes are %v", name, obj.Attrs)
+		}
+	}
+	if obj, _ := gs.Object(events[6].Fields[1]); obj.Attrs["GX"] != "13" || obj.Attrs["GY"] != "5" || obj.Class != "M" {
+		t.Errorf("ogre placed as %v", obj)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,286 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                    Event clocks                                    //
+//                                                                                    //
+// Each event in the game state is stamped with the writer which recorded it and its  //
+// place in that writer's sequence, so the state can be replayed in the same order,   //
+// and brought up to date with only what changed, however many writers feed it.       //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// DefaultWriter is the name a game state stamps on the events it
+// records unless told otherwise.
+//
+const DefaultWriter = "local"
+
+//
+// An EventStamp says which writer recorded an event and where it falls
+// in that writer's sequence.
+//
+type EventStamp struct {
+	Writer   string
+	Sequence int
+}
+
+//
+// An EventClock records, for each writer, how far through its sequence
+// we have seen: every event stamped with a sequence number lower than
+// the clock's entry for its writer is known.
+//
+// When more than one writer feeds the same game state, each numbers its
+// own events, but always starting past the highest sequence number it
+// has seen from anyone (so a writer's new event sorts after everything
+// it already knew about). Events are replayed in order of sequence
+// number, with ties between writers broken by writer name, which gives
+// every copy of the game state the same order no matter which order the
+// events reached it in.
+//
+type EventClock map[string]int
+
+//
+// Next returns the sequence number for a new event, past every event
+// the clock has seen.
+//
+func (c EventClock) Next() int {
+	next := 0
+	for _, n := range c {
+		if n > next {
+			next = n
+		}
+	}
+	return next
+}
+
+//
+// Observe advances the clock to include the given event.
+//
+func (c EventClock) Observe(s EventStamp) {
+	if s.Sequence >= c[s.Writer] {
+		c[s.Writer] = s.Sequence + 1
+	}
+}
+
+//
+// Has reports whether the clock includes the given event.
+//
+func (c EventClock) Has(s EventStamp) bool {
+	return s.Sequence < c[s.Writer]
+}
+
+//
+// Covers reports whether the clock includes everything the other
+// one does.
+//
+func (c EventClock) Covers(other EventClock) bool {
+	for writer, n := range other {
+		if c[writer] < n {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// Merge advances the clock to include everything the other one does.
+//
+func (c EventClock) Merge(other EventClock) {
+	for writer, n := range other {
+		if n > c[writer] {
+			c[writer] = n
+		}
+	}
+}
+
+//
+// Copy returns an independent copy of the clock.
+//
+func (c EventClock) Copy() EventClock {
+	copied := make(EventClock, len(c))
+	copied.Merge(c)
+	return copied
+}
+
+//
+// String renders the clock as space-separated <writer>=<n> pairs,
+// sorted by writer, as understood by ParseEventClock.
+//
+func (c EventClock) String() string {
+	var pairs []string
+	for writer, n := range c {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", writer, n))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+//
+// ParseEventClock reads a clock written by EventClock.String.
+//
+func ParseEventClock(s string) (EventClock, error) {
+	c := make(EventClock)
+	for _, pair := range strings.Fields(s) {
+		eq := strings.LastIndex(pair, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("Invalid event clock entry \"%s\"", pair)
+		}
+		n, err := strconv.Atoi(pair[eq+1:])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid event clock entry \"%s\"", pair)
+		}
+		c[pair[:eq]] = n
+	}
+	return c, nil
+}
+
+//
+// Stamp an event as it is applied to the game state. An event which
+// arrives without a writer is a new one of ours, so it gets the next
+// number in our sequence; one which already has a stamp (because it
+// came from storage or another writer) keeps it, and our clock moves
+// past it. Either way, the event's Changed stamp is set to the latest
+// change it carries, which is the one recorded against any object it
+// updates. Called with gs.lock held.
+//
+func (gs *GameState) stamp(event *MapEvent) {
+	if event.Writer == "" {
+		event.Writer, event.Sequence = gs.Writer, gs.clock.Next()
+		event.Changed = EventStamp{}
+	}
+	gs.clock.Observe(EventStamp{Writer: event.Writer, Sequence: event.Sequence})
+	if event.Changed.Writer == "" {
+		event.Changed = EventStamp{Writer: event.Writer, Sequence: event.Sequence}
+	}
+	gs.clock.Observe(event.Changed)
+}
+
+//
+// Note that something was removed from the game state, which a list of
+// changes can't express; anyone who hasn't seen the state since then
+// needs all of it again. Called with gs.lock held.
+//
+func (gs *GameState) noteRemoval(stamped bool) {
+	if !stamped {
+		gs.clock.Observe(EventStamp{Writer: gs.Writer, Sequence: gs.clock.Next()})
+	}
+	gs.removed = gs.clock.Copy()
+}
+
+//
+// Clock returns how far through each writer's events the game state
+// has seen.
+//
+func (gs *GameState) Clock() EventClock {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	return gs.clock.Copy()
+}
+
+//
+// EventsSince returns the events which bring someone who had the game
+// state as of the given clock up to date, in replay order: each object
+// and event which has changed since then. If something was removed in
+// the meantime, the list of changes isn't enough, so the whole state is
+// returned instead, and complete is true to say the recipient should
+// start over with it.
+//
+func (gs *GameState) EventsSince(since EventClock) (events MapEventList, complete bool) {
+	gs.lock.RLock()
+	all := gs.allEvents()
+	complete = !since.Covers(gs.removed)
+	gs.lock.RUnlock()
+
+	if complete {
+		events = all
+	} else {
+		for _, event := range all {
+			if !since.Has(event.Changed) {
+				events = append(events, event)
+			}
+		}
+	}
+	sort.Sort(events)
+	return events, complete
+}
+
+//
+// Older databases don't record who stamped each event or when it last
+// changed. Their events are loaded without a writer, and so are simply
+// numbered again in the order they were saved, as they always were.
+//
+func addEventClockColumns(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow(`select count(*) from pragma_table_info('events') where name = 'writer'`).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+	_, err := db.Exec(`
+		alter table events add column writer    text    not null default '';
+		alter table events add column changedby text    not null default '';
+		alter table events add column changed   integer not null default 0;
+	`)
+	return err
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
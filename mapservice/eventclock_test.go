@@ -0,0 +1,185 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for event clocks
+//
+
+package mapservice
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestEventClock(t *testing.T) {
+	c := make(EventClock)
+	if c.Next() != 0 || c.Has(EventStamp{"local", 0}) {
+		t.Errorf("empty clock has %v", c)
+	}
+	c.Observe(EventStamp{"local", 3})
+	c.Observe(EventStamp{"east", 7})
+	c.Observe(EventStamp{"local", 1})
+	if c.Next() != 8 || !c.Has(EventStamp{"local", 3}) || c.Has(EventStamp{"local", 4}) || !c.Has(EventStamp{"east", 0}) || c.Has(EventStamp{"west", 0}) {
+		t.Errorf("clock is %v", c)
+	}
+	if c.String() != "east=8 local=4" {
+		t.Errorf("clock printed as %q", c.String())
+	}
+	parsed, err := ParseEventClock(c.String())
+	if err != nil || !parsed.Covers(c) || !c.Covers(parsed) {
+		t.Errorf("clock parsed as %v (%v)", parsed, err)
+	}
+	older := c.Copy()
+	c.Observe(EventStamp{"west", 0})
+	if !c.Covers(older) || older.Covers(c) {
+		t.Errorf("%v vs %v", c, older)
+	}
+	older.Merge(c)
+	if !older.Covers(c) {
+		t.Errorf("merged clock is %v", older)
+	}
+	for _, bad := range []string{"local", "=3", "local=x", "local=-1"} {
+		if _, err := ParseEventClock(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestEventsSince(t *testing.T) {
+	gs := NewGameState()
+	gs.Record(testEvent(t, "PS abc red Grax 1 M monster 3 4 0"))
+	gs.Record(testEvent(t, "PS def red Fred 1 M monster 5 4 0"))
+	gs.Record(testEvent(t, "CS 12 0"))
+	since := gs.Clock()
+	if since.String() != "local=3" {
+		t.Errorf("clock is %v", since)
+	}
+
+	gs.Record(testEvent(t, "OA abc {GX 10}"))
+	gs.Record(testEvent(t, "CO 1"))
+	events, complete := gs.EventsSince(since)
+	if complete || len(events) != 2 || events[0].ID != "abc" || events[1].EventType() != "CO" {
+		t.Errorf("changes were %v (complete %v)", events, complete)
+	}
+
+	// another writer's event keeps its stamp, and ours come after it
+	remote := testEvent(t, "PS ghi red Ghi 1 M monster 1 1 0")
+	remote.Writer, remote.Sequence = "east", 40
+	gs.Record(remote)
+	gs.Record(testEvent(t, "PS jkl red Jkl 1 M monster 1 1 0"))
+	if obj, _ := gs.Object("jkl"); obj.Writer != "local" || obj.Sequence != 41 {
+		t.Errorf("new object stamped %s %d", obj.Writer, obj.Sequence)
+	}
+	tied := testEvent(t, "PS aaa red Aaa 1 M monster 1 1 0")
+	tied.Writer, tied.Sequence = "west", 41
+	gs.Record(tied)
+	events, _ = gs.EventsSince(since)
+	var order []string
+	for _, event := range events {
+		order = append(order, event.ID)
+	}
+	if len(order) != 5 || order[2] != "ghi" || order[3] != "jkl" || order[4] != "aaa" {
+		t.Errorf("changes in order %v", order)
+	}
+
+	// removals can't be sent as changes
+	gs.ClearObjects("def")
+	events, complete = gs.EventsSince(since)
+	if !complete || len(events) != 6 {
+		t.Errorf("after removal got %d events (complete %v)", len(events), complete)
+	}
+	if events, complete = gs.EventsSince(gs.Clock()); complete || len(events) != 0 {
+		t.Errorf("up to date clock got %v (complete %v)", events, complete)
+	}
+}
+
+func TestEventClockStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clock.db")
+	storage, err := OpenStorageBackend("sqlite", path)
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	ms := MapService{Storage: storage, State: NewGameState()}
+	ms.State.Record(testEvent(t, "PS abc red Grax 1 M monster 3 4 0"))
+	remote := testEvent(t, "CS 12 0")
+	remote.Writer, remote.Sequence = "east", 9
+	ms.State.Record(remote)
+	ms.State.Record(testEvent(t, "OA abc {GX 10}"))
+	if err = ms.SaveState(); err != nil {
+		t.Fatalf("unable to save state: %v", err)
+	}
+	storage.Close()
+
+	// opening it again mustn't try to add the columns twice
+	if storage, err = OpenStorageBackend("sqlite", path); err != nil {
+		t.Fatalf("unable to reopen database: %v", err)
+	}
+	defer storage.Close()
+	restored := MapService{Storage: storage}
+	if err = restored.LoadState(); err != nil {
+		t.Fatalf("unable to load state: %v", err)
+	}
+	if restored.State.Clock().String() != "east=10 local=11" {
+		t.Errorf("restored clock is %v", restored.State.Clock())
+	}
+	obj, _ := restored.State.Object("abc")
+	if obj.Sequence != 0 || obj.Changed != (EventStamp{"local", 10}) {
+		t.Errorf("restored object stamped %d %v", obj.Sequence, obj.Changed)
+	}
+	since, _ := ParseEventClock("east=10 local=10")
+	if events, complete := restored.State.EventsSince(since); complete || len(events) != 1 || events[0].ID != "abc" {
+		t.Errorf("changes after restore were %v (complete %v)", events, complete)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
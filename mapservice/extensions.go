@@ -0,0 +1,262 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     Extensions                                     //
+//                                                                                    //
+// Extension points which allow other packages to add behaviors to the map service    //
+// (message interceptors, storage backends, authentication sources, and chat filters) //
+// by implementing an interface and registering it, rather than patching the core     //
+// message handling code.                                                             //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// The following interfaces define the points at which outside code may
+// extend the behavior of the map service without modifying the core
+// message handling code. An implementation of any of these is made known
+// to the service by calling the corresponding Register... function, usually
+// from an init() function in the package which provides it (in the same
+// manner as database/sql drivers register themselves).
+//
+
+//
+// A MessageInterceptor is given a look at every event received from a
+// client before the service acts upon it. If InterceptMessage returns
+// false, the event is considered to have been fully handled (or rejected)
+// by the interceptor and the service will take no further action on it.
+// Interceptors are called in the order in which they were registered.
+//
+type MessageInterceptor interface {
+	InterceptMessage(ms *MapService, client *MapClient, event *MapEvent) bool
+}
+
+//
+// A StorageBackend provides persistent storage for the game state and
+// die-roll presets. Backends are registered by name along with a function
+// which opens a new instance given a backend-specific data source string
+// (e.g., a database filename). New backends should pass the conformance
+// tests in the storagetest package.
+//
+type StorageBackend interface {
+	LoadDicePresets() (map[string][]DicePreset, error)
+	UpdateDicePresets(user string, presets []DicePreset) error
+	LoadState(gs *GameState) error
+	SaveState(gs *GameState) error
+	Close() error
+}
+
+//
+// An AuthProvider supplies personal passwords for users beyond those
+// listed in the server's password file. LookupSecret returns the user's
+// secret and true, or false if the provider doesn't know about that user.
+//
+type AuthProvider interface {
+	LookupSecret(username string) ([]byte, bool)
+}
+
+//
+// A ChatFilter may inspect and rewrite chat messages (TO events) before
+// they are recorded and relayed to their recipients. It returns the
+// (possibly altered) message text, or an error if the message should be
+// rejected outright. The error text is reported back to the sender.
+//
+type ChatFilter interface {
+	FilterChat(sender string, recipients []string, message string) (string, error)
+}
+
+var extensionLock sync.RWMutex
+var messageInterceptors []MessageInterceptor
+var authProviders []AuthProvider
+var chatFilters []ChatFilter
+var storageBackends = make(map[string]func(string) (StorageBackend, error))
+
+//
+// RegisterMessageInterceptor adds an interceptor to the chain which
+// sees all incoming client events.
+//
+func RegisterMessageInterceptor(mi MessageInterceptor) {
+	extensionLock.Lock()
+	messageInterceptors = append(messageInterceptors, mi)
+	extensionLock.Unlock()
+}
+
+//
+// RegisterAuthProvider adds a source of personal passwords.
+//
+func RegisterAuthProvider(ap AuthProvider) {
+	extensionLock.Lock()
+	authProviders = append(authProviders, ap)
+	extensionLock.Unlock()
+}
+
+//
+// RegisterChatFilter adds a filter to the chain applied to chat messages.
+//
+func RegisterChatFilter(cf ChatFilter) {
+	extensionLock.Lock()
+	chatFilters = append(chatFilters, cf)
+	extensionLock.Unlock()
+}
+
+//
+// RegisterStorageBackend makes a storage backend available by name.
+// It panics if the same name is registered twice.
+//
+func RegisterStorageBackend(name string, opener func(string) (StorageBackend, error)) {
+	extensionLock.Lock()
+	defer extensionLock.Unlock()
+	if _, exists := storageBackends[name]; exists {
+		panic(fmt.Sprintf("storage backend %s registered twice", name))
+	}
+	storageBackends[name] = opener
+}
+
+//
+// OpenStorageBackend opens a new instance of the named storage backend.
+//
+func OpenStorageBackend(name, source string) (StorageBackend, error) {
+	extensionLock.RLock()
+	opener, ok := storageBackends[name]
+	extensionLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("No storage backend called \"%s\" is available", name)
+	}
+	return opener(source)
+}
+
+//
+// StorageBackends returns the sorted list of registered backend names.
+//
+func StorageBackends() []string {
+	extensionLock.RLock()
+	names := make([]string, 0, len(storageBackends))
+	for name := range storageBackends {
+		names = append(names, name)
+	}
+	extensionLock.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+//
+// Run an event past all registered interceptors. Returns false if
+// any of them claimed it.
+//
+func interceptMessage(ms *MapService, client *MapClient, event *MapEvent) bool {
+	extensionLock.RLock()
+	interceptors := messageInterceptors
+	extensionLock.RUnlock()
+
+	for _, mi := range interceptors {
+		if !mi.InterceptMessage(ms, client, event) {
+			if d := debugLog(DebugExtensions); d != nil {
+				d.Printf("[client %s] event %v claimed by interceptor %T", client.ClientAddr, event.Fields, mi)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+//
+// Look up a personal password for a user, first from the password file
+// and then from any registered AuthProviders.
+//
+func (ms *MapService) lookupPersonalSecret(username string) ([]byte, bool) {
+	if secret, ok := ms.PersonalPasswords[username]; ok {
+		return secret, true
+	}
+	if inv, ok := ms.invites.forUser(username, time.Now()); ok {
+		return []byte(inv.Password), true
+	}
+	extensionLock.RLock()
+	providers := authProviders
+	extensionLock.RUnlock()
+
+	for _, ap := range providers {
+		if secret, ok := ap.LookupSecret(username); ok {
+			return secret, true
+		}
+	}
+	return nil, false
+}
+
+//
+// Apply all registered chat filters to a message in turn.
+//
+func filterChat(sender string, recipients []string, message string) (string, error) {
+	var err error
+
+	extensionLock.RLock()
+	filters := chatFilters
+	extensionLock.RUnlock()
+
+	for _, cf := range filters {
+		if message, err = cf.FilterChat(sender, recipients, message); err != nil {
+			return "", err
+		}
+	}
+	return message, nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
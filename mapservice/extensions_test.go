@@ -0,0 +1,131 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the extension registry
+//
+
+package mapservice
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testChatFilter struct{}
+
+func (f testChatFilter) FilterChat(sender string, recipients []string, message string) (string, error) {
+	if strings.Contains(message, "!!reject!!") {
+		return "", fmt.Errorf("rejected by test filter")
+	}
+	return strings.Replace(message, "!!shout!!", "HEY", -1), nil
+}
+
+type testAuthProvider map[string][]byte
+
+func (p testAuthProvider) LookupSecret(username string) ([]byte, bool) {
+	secret, ok := p[username]
+	return secret, ok
+}
+
+func TestExtensions_ChatFilter(t *testing.T) {
+	RegisterChatFilter(testChatFilter{})
+
+	m, err := filterChat("alice", []string{"*"}, "hello !!shout!!")
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if m != "hello HEY" {
+		t.Errorf("filtered message was \"%s\"", m)
+	}
+	if _, err = filterChat("alice", []string{"*"}, "no !!reject!!"); err == nil {
+		t.Errorf("filter should have rejected message")
+	}
+}
+
+func TestExtensions_AuthProvider(t *testing.T) {
+	RegisterAuthProvider(testAuthProvider{"bob": []byte("bobsecret")})
+	ms := MapService{PersonalPasswords: map[string][]byte{"alice": []byte("alicesecret")}}
+
+	for _, c := range []struct {
+		user   string
+		secret string
+		ok     bool
+	}{
+		{"alice", "alicesecret", true},
+		{"bob", "bobsecret", true},
+		{"charlie", "", false},
+	} {
+		secret, ok := ms.lookupPersonalSecret(c.user)
+		if ok != c.ok || string(secret) != c.secret {
+			t.Errorf("lookup %s returned (%s, %v), expected (%s, %v)", c.user, secret, ok, c.secret, c.ok)
+		}
+	}
+}
+
+func TestExtensions_StorageBackends(t *testing.T) {
+	found := false
+	for _, name := range StorageBackends() {
+		if name == "sqlite" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("sqlite backend not registered (have %v)", StorageBackends())
+	}
+	if _, err := OpenStorageBackend("no-such-backend", ""); err == nil {
+		t.Errorf("opening nonexistent backend should have failed")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
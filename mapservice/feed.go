@@ -0,0 +1,260 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     Event Feed                                     //
+//                                                                                    //
+// A stream of server-sent events carrying the public side of the game (rolls made    //
+// for all to see, initiative, and the game clock) for stream overlays.               //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Kinds of events sent on the public event feed.
+//
+const (
+	FeedRoll       = "roll"       // a die roll made for everyone to see
+	FeedInitiative = "initiative" // the initiative order, whose turn it is, or combat mode changed (an APIInitiative)
+	FeedClock      = "clock"      // the game clock was set (an APIClock)
+)
+
+//
+// FeedEventTypes lists all the kinds of events sent on the feed.
+//
+var FeedEventTypes = []string{FeedRoll, FeedInitiative, FeedClock}
+
+//
+// FeedPath is where the event feed is served. Since browser sources
+// in streaming software can't add headers to their requests, the API
+// token may be given here as a "token" query parameter instead.
+//
+const FeedPath = "/api/v1/feed"
+
+//
+// FeedKeepAlive is how often we send a comment down an idle feed so
+// proxies don't give up on it.
+//
+const FeedKeepAlive = 30 * time.Second
+
+//
+// FeedBacklog is how many events may wait for a feed reader before
+// we start dropping them.
+//
+const FeedBacklog = 32
+
+//
+// A FeedDieRoll is a public die roll as sent on the event feed.
+//
+type FeedDieRoll struct {
+	From    string           `json:"from"`
+	Title   string           `json:"title,omitempty"`
+	Result  int              `json:"result"`
+	Details []ChatRollDetail `json:"details"`
+}
+
+type feedEvent struct {
+	eventType string
+	data      []byte
+}
+
+//
+// The readers of the event feed, and the kinds of events each wants.
+//
+type eventFeed struct {
+	lock    sync.Mutex
+	readers map[chan feedEvent]map[string]bool
+}
+
+func (f *eventFeed) subscribe(types map[string]bool) chan feedEvent {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.readers == nil {
+		f.readers = make(map[chan feedEvent]map[string]bool)
+	}
+	ch := make(chan feedEvent, FeedBacklog)
+	f.readers[ch] = types
+	return ch
+}
+
+func (f *eventFeed) unsubscribe(ch chan feedEvent) {
+	f.lock.Lock()
+	delete(f.readers, ch)
+	f.lock.Unlock()
+}
+
+func (f *eventFeed) readerCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.readers)
+}
+
+//
+// Send an event to every reader who wants it, dropping it for any
+// reader who has fallen too far behind.
+//
+func (f *eventFeed) publish(eventType string, payload interface{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.readers) == 0 {
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	for ch, types := range f.readers {
+		if types[eventType] {
+			select {
+				case ch <- feedEvent{eventType: eventType, data: data}:
+				default:
+			}
+		}
+	}
+}
+
+//
+// Put a public die roll on the feed.
+//
+func (ms *MapService) feedDieRoll(from, title string, result StructuredResult) {
+	roll := FeedDieRoll{From: from, Title: title, Result: result.Result, Details: []ChatRollDetail{}}
+	for _, detail := range result.Details {
+		roll.Details = append(roll.Details, ChatRollDetail{Type: detail.Type, Value: detail.Value})
+	}
+	ms.feed.publish(FeedRoll, roll)
+}
+
+//
+// Put a change to the initiative order or the game clock on the feed,
+// once it has been recorded in the game state.
+//
+func (ms *MapService) feedStateChange(event *MapEvent) {
+	switch event.EventType() {
+		case "CO", "I", "IL":
+			ms.feed.publish(FeedInitiative, ms.apiInitiative())
+		case "CS":
+			ms.feed.publish(FeedClock, ms.apiClock())
+	}
+}
+
+//
+// GET /api/v1/feed[?types=<type>,...]
+// A stream of server-sent events for stream overlays (such as browser
+// sources in OBS), each
+//   event: <type>
+//   data: <JSON>
+// for the public events of the given types (see FeedEventTypes; all of
+// them by default). Nothing private is sent: only rolls made for
+// everyone to see, and what all players already know about initiative
+// and the game clock.
+//
+func (ms *MapService) apiFeed(w http.ResponseWriter, r *http.Request, t APIToken) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apiError(w, http.StatusInternalServerError, "streaming is not supported here")
+		return
+	}
+	types := make(map[string]bool)
+	if list := r.URL.Query().Get("types"); list != "" {
+		for _, eventType := range strings.Split(list, ",") {
+			eventType = strings.TrimSpace(strings.ToLower(eventType))
+			known := false
+			for _, e := range FeedEventTypes {
+				known = known || e == eventType
+			}
+			if !known {
+				apiError(w, http.StatusBadRequest, "event type %s not understood (use %s)", eventType, strings.Join(FeedEventTypes, ", "))
+				return
+			}
+			types[eventType] = true
+		}
+	} else {
+		for _, eventType := range FeedEventTypes {
+			types[eventType] = true
+		}
+	}
+
+	events := ms.feed.subscribe(types)
+	defer ms.feed.unsubscribe(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, ": GMA event feed for %s\n\n", t.Name)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(FeedKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+			case event := <-events:
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.eventType, event.data)
+			case <-keepAlive.C:
+				fmt.Fprintf(w, ": keep-alive\n\n")
+			case <-r.Context().Done():
+				return
+		}
+		flusher.Flush()
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
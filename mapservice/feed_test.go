@@ -0,0 +1,178 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the public event feed
+//
+
+package mapservice
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Read the next event from a server-sent event stream, skipping
+// comments.
+//
+func nextFeedEvent(t *testing.T, lines chan string) (string, string) {
+	var eventType, data string
+	for {
+		select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatalf("feed closed")
+				}
+				switch {
+					case strings.HasPrefix(line, "event: "):
+						eventType = line[7:]
+					case strings.HasPrefix(line, "data: "):
+						data = line[6:]
+					case line == "" && eventType != "":
+						return eventType, data
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no event arrived")
+		}
+	}
+}
+
+func TestEventFeed(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/api.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	_, reader, _ := ms.issueAPIToken("overlay", ScopeReadOnly, 0)
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	if alice.dice, err = NewDieRoller(); err != nil {
+		t.Fatalf("unable to create die roller: %v", err)
+	}
+	server := httptest.NewServer(ms.HTTPHandler())
+	defer server.Close()
+
+	if status, reply := apiTestRequest(t, ms, "GET", FeedPath+"?types=roll,hp", reader, ""); status != 400 {
+		t.Errorf("feed with unknown type got %d %v", status, reply)
+	}
+	if status, reply := apiTestRequest(t, ms, "GET", "/api/v1/clients?token="+reader, "", ""); status != 401 {
+		t.Errorf("token in URL outside the feed got %d %v", status, reply)
+	}
+
+	resp, err := http.Get(server.URL + FeedPath + "?types=roll,clock&token=" + reader)
+	if err != nil {
+		t.Fatalf("unable to open feed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("feed got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	lines := make(chan string, 100)
+	go func() {
+		in := bufio.NewScanner(resp.Body)
+		for in.Scan() {
+			lines <- in.Text()
+		}
+		close(lines)
+	}()
+	for i := 0; i < 100 && ms.feed.readerCount() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ms.ExecuteAction(testEvent(t, "D % d20"), alice)
+	ms.ExecuteAction(testEvent(t, "IL {{0 Fizban 12 0 0}}"), gm)
+	ms.ExecuteAction(testEvent(t, "D * {Stealth=d20+3}"), alice)
+	eventType, data := nextFeedEvent(t, lines)
+	var roll FeedDieRoll
+	if err := json.Unmarshal([]byte(data), &roll); eventType != "roll" || err != nil || roll.From != "alice" || roll.Title != "Stealth" || roll.Result < 4 || len(roll.Details) == 0 {
+		t.Errorf("first event was %s %s (%v)", eventType, data, err)
+	}
+	ms.ExecuteAction(testEvent(t, "CS 1234 56"), gm)
+	if eventType, data = nextFeedEvent(t, lines); eventType != "clock" || data != `{"absolute":"1234","relative":"56"}` {
+		t.Errorf("second event was %s %s", eventType, data)
+	}
+}
+
+func TestEventFeedInitiative(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	events := ms.feed.subscribe(map[string]bool{FeedInitiative: true})
+	defer ms.feed.unsubscribe(events)
+
+	ms.ExecuteAction(testEvent(t, "IL {{0 Fizban 12 0 0}}"), gm)
+	ms.ExecuteAction(testEvent(t, "CS 1 2"), gm)
+	ms.ExecuteAction(testEvent(t, "CO 1"), gm)
+	var initiative APIInitiative
+	for i := 0; i < 2; i++ {
+		select {
+			case event := <-events:
+				if err := json.Unmarshal(event.data, &initiative); err != nil || event.eventType != FeedInitiative || len(initiative.Slots) != 1 || initiative.Combat != (i == 1) {
+					t.Errorf("event %d was %s %s (%v)", i, event.eventType, event.data, err)
+				}
+			default:
+				t.Fatalf("event %d wasn't sent", i)
+		}
+	}
+	if len(events) != 0 {
+		t.Errorf("%d more events were sent", len(events))
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
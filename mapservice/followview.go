@@ -0,0 +1,146 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Follow-Me View                                   //
+//                                                                                    //
+// The GM may have everyone's map view follow theirs (to show the party something,    //
+// say). While that is on, only the GM's view adjustments are passed along, and the   //
+// players' are dropped. Each client may opt out of following the GM, which the       //
+// server honors by not sending it the GM's view adjustments.                         //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"strings"
+	"sync"
+)
+
+//
+// followMode records whether the GM has told everyone's map view
+// to follow theirs.
+//
+type followMode struct {
+	lock sync.Mutex
+	on   bool
+}
+
+func (f *followMode) get() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.on
+}
+
+func (f *followMode) set(on bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.on = on
+}
+
+//
+// Make sense of an on/off flag in a message.
+//
+func parseOnOff(value string) bool {
+	switch strings.ToLower(value) {
+		case "1", "on", "true", "yes":
+			return true
+	}
+	return false
+}
+
+func onOff(on bool) string {
+	if on {
+		return "1"
+	}
+	return "0"
+}
+
+//
+// Does this client's view follow the GM's?
+//
+func (c *MapClient) followsGM() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return !c.followOptOut
+}
+
+func (c *MapClient) setFollowOptOut(optOut bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.followOptOut = optOut
+}
+
+//
+// Send a view adjustment from the GM to everyone else whose view
+// follows the GM's.
+//
+func (ms *MapService) sendViewToFollowers(thisClient *MapClient, values ...string) {
+	for _, peer := range ms.Clients.Subscribers(values[0]) {
+		if peer.ClientAddr != thisClient.ClientAddr && peer.followsGM() {
+			peer.Send(values...)
+		}
+	}
+}
+
+//
+// Tell a newly-connected client if the GM has follow-me mode on.
+//
+func (ms *MapService) sendFollowMode(thisClient *MapClient) {
+	if ms.following.get() {
+		thisClient.Send("FM", "1")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
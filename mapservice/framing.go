@@ -0,0 +1,222 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Input Framing                                    //
+//                                                                                    //
+// Reading messages from client connections, with limits on how large a message we    //
+// will accept.                                                                       //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+//
+// Unless configured otherwise, we won't accept any single message
+// from a client longer than this many bytes.
+//
+const DefaultMaxMessageSize = 1024 * 1024
+//
+// Size of the input buffer we read client data through. Lines longer
+// than this are still fine (up to the maximum message size); they just
+// take more than one read to collect.
+//
+const ReadBufferSize = 64 * 1024
+
+//
+// MessageTooLargeError is returned when a client sends us a message
+// longer than we're willing to accept. The offending message has been
+// read and discarded, so the input stream is still usable afterward.
+//
+type MessageTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message too large (%d bytes; limit is %d)", e.Size, e.Limit)
+}
+
+//
+// The maximum message size in effect for this client.
+//
+func (c *MapClient) maxMessageSize() int {
+	if c.Service != nil && c.Service.MaxMessageSize > 0 {
+		return c.Service.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+//
+// Read the next newline-terminated line of input from the client,
+// without the line terminator. If the line is longer than the maximum
+// message size, the whole line is consumed and discarded and a
+// *MessageTooLargeError is returned. A final line without a newline
+// before EOF is returned as a normal line; the next call reports io.EOF.
+// If reading is interrupted (e.g., by a timeout), what we had of the line
+// is kept, and the next call picks up where this one left off.
+//
+func (c *MapClient) readLine() (string, error) {
+	line, size := c.partialLine, c.partialSize
+	c.partialLine, c.partialSize = nil, 0
+	limit := c.maxMessageSize()
+
+	for {
+		chunk, err := c.Reader.ReadSlice('\n')
+		size += len(chunk)
+		if size <= limit + 2 {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && size > 0 {
+			break
+		}
+		if err != nil {
+			c.partialLine, c.partialSize = line, size
+			return "", err
+		}
+		break
+	}
+	c.countBandwidth(size, 0)
+
+	// don't count the line terminator against the limit
+	if size > 0 && size <= len(line) && line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+		size--
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+			size--
+		}
+	}
+	if size > limit {
+		return "", &MessageTooLargeError{Size: size, Limit: limit}
+	}
+	return string(line), nil
+}
+
+//
+// Unless configured otherwise, we won't accept a binary frame
+// (e.g., an uploaded image) larger than this many bytes.
+//
+const DefaultMaxFrameSize = 16 * 1024 * 1024
+
+//
+// The maximum binary frame size in effect for this client.
+//
+func (c *MapClient) maxFrameSize() int {
+	if c.Service != nil && c.Service.MaxFrameSize > 0 {
+		return c.Service.MaxFrameSize
+	}
+	return DefaultMaxFrameSize
+}
+
+//
+// Some messages (such as AIB) announce that a binary frame of a given
+// length follows them on the input stream. The frame is exactly that
+// many bytes of arbitrary data, followed by a newline.
+//
+// readFrame reads such a frame from the client. If the frame is larger
+// than we allow, it is read and discarded, and a *MessageTooLargeError
+// is returned.
+//
+func (c *MapClient) readFrame(length int) ([]byte, error) {
+	if length < 0 {
+		return nil, fmt.Errorf("invalid frame length %d", length)
+	}
+	if length > c.maxFrameSize() {
+		if _, err := io.CopyN(io.Discard, c.Reader, int64(length)); err != nil {
+			return nil, err
+		}
+		if _, err := c.readLine(); err != nil {
+			return nil, err
+		}
+		return nil, &MessageTooLargeError{Size: length, Limit: c.maxFrameSize()}
+	}
+
+	frame := make([]byte, length)
+	n, err := io.ReadFull(c.Reader, frame)
+	c.countBandwidth(n, 0)
+	if err != nil {
+		return nil, err
+	}
+	trailer, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if trailer != "" {
+		return nil, fmt.Errorf("binary frame of %d bytes was followed by unexpected data", length)
+	}
+	return frame, nil
+}
+
+//
+// Package a message followed by a binary frame into a single
+// string which may be sent to a client with SendRaw.
+//
+func packageFrame(frame []byte, values ...string) (string, error) {
+	header, err := PackageValues(values...)
+	if err != nil {
+		return "", err
+	}
+	return header + "\n" + string(frame), nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,123 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for client input framing
+//
+
+package mapservice
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFraming_ReadLine(t *testing.T) {
+	input := "short\r\n" + strings.Repeat("x", 100) + "\n" + strings.Repeat("y", 20) + "\nlast"
+	c := &MapClient{
+		Service: &MapService{MaxMessageSize: 20},
+		Reader:  bufio.NewReaderSize(strings.NewReader(input), 16),
+	}
+
+	type result struct {
+		line string
+		size int
+		err  error
+	}
+	for i, expected := range []result{
+		{line: "short"},
+		{size: 101},
+		{line: strings.Repeat("y", 20)},
+		{line: "last"},
+		{err: io.EOF},
+	} {
+		line, err := c.readLine()
+		if expected.size > 0 {
+			too_big, ok := err.(*MessageTooLargeError)
+			if !ok || too_big.Size != expected.size || too_big.Limit != 20 {
+				t.Errorf("line %d: expected too-large error, got %q, %v", i, line, err)
+			}
+			continue
+		}
+		if line != expected.line || err != expected.err {
+			t.Errorf("line %d: got %q, %v; expected %q, %v", i, line, err, expected.line, expected.err)
+		}
+	}
+}
+
+func TestFraming_ReadFrame(t *testing.T) {
+	input := "ab\ncd\n" + strings.Repeat("z", 50) + "\nnext\nxyzzy"
+	c := &MapClient{
+		Service: &MapService{MaxFrameSize: 10},
+		Reader:  bufio.NewReaderSize(strings.NewReader(input), 16),
+	}
+
+	frame, err := c.readFrame(5)
+	if err != nil || string(frame) != "ab\ncd" {
+		t.Errorf("got frame %q, %v; expected \"ab\\ncd\"", frame, err)
+	}
+	if _, err = c.readFrame(50); err == nil {
+		t.Errorf("oversized frame was accepted")
+	} else if too_big, ok := err.(*MessageTooLargeError); !ok || too_big.Size != 50 || too_big.Limit != 10 {
+		t.Errorf("expected too-large error, got %v", err)
+	}
+	if line, err := c.readLine(); line != "next" || err != nil {
+		t.Errorf("stream out of sync after oversized frame: got %q, %v", line, err)
+	}
+	if _, err = c.readFrame(3); err == nil {
+		t.Errorf("frame without trailing newline was accepted")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,180 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Die-Roll Fudging                                  //
+//                                                                                    //
+// Lets the GM decide in advance how the dice will come up for a particular player or //
+// die-roll spec, as a matter of table fiat. Every such decision is written to the    //
+// audit log and flagged to the GM when the roll is made.                             //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// DieRollFudge is the GM's decision, made ahead of time, about how
+// the dice will come up on someone's next roll. Rather than change
+// the total after the fact, we decide what the dice show, so the
+// result still adds up like any other roll.
+//
+type DieRollFudge struct {
+	User  string    // whose roll is affected ("*" for anyone)
+	Spec  string    // die-roll spec it applies to ("*" for any)
+	Faces []int     // what each die will show, in the order rolled
+	SetBy string    // who asked for this
+	Set   time.Time // when they asked for it
+}
+
+//
+// Does this fudge apply to a roll of spec by user?
+//
+func (f *DieRollFudge) matches(user, spec string) bool {
+	return (f.User == "*" || f.User == user) &&
+		(f.Spec == "*" || f.Spec == strings.TrimSpace(spec))
+}
+
+//
+// fudgeQueue holds the fudges waiting for their roll.
+//
+type fudgeQueue struct {
+	lock    sync.Mutex
+	pending []*DieRollFudge
+}
+
+//
+// Add a fudge, replacing any earlier one for the same user and spec.
+// A fudge with no faces just cancels the earlier one. Returns the
+// fudge it replaced, if any.
+//
+func (q *fudgeQueue) set(f *DieRollFudge) *DieRollFudge {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var old *DieRollFudge
+	for i, p := range q.pending {
+		if p.User == f.User && p.Spec == f.Spec {
+			old = p
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	if len(f.Faces) > 0 {
+		q.pending = append(q.pending, f)
+	}
+	return old
+}
+
+//
+// Remove and return the fudge for user's roll of spec, or nil if there
+// isn't one. A fudge naming the user and spec outranks one naming just
+// the user, which outranks one naming just the spec.
+//
+func (q *fudgeQueue) take(user, spec string) *DieRollFudge {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	best := -1
+	bestRank := 0
+	for i, p := range q.pending {
+		if !p.matches(user, spec) {
+			continue
+		}
+		rank := 1
+		if p.User != "*" {
+			rank += 2
+		}
+		if p.Spec != "*" {
+			rank++
+		}
+		if rank > bestRank {
+			best, bestRank = i, rank
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	f := q.pending[best]
+	q.pending = append(q.pending[:best], q.pending[best+1:]...)
+	return f
+}
+
+//
+// fudgedRandomSource makes the dice show the faces in a fudge, in
+// order. After they are used up (or if a face doesn't fit on the die
+// being rolled) it goes back to the real random numbers.
+//
+type fudgedRandomSource struct {
+	faces    []int
+	next     int
+	fallback RandomSource
+}
+
+func (f *fudgedRandomSource) Int31n(n int32) int32 {
+	if f.next < len(f.faces) {
+		face := f.faces[f.next]
+		f.next++
+		if face >= 1 && int32(face) <= n {
+			return int32(face) - 1
+		}
+	}
+	return randomInt31n(f.fallback, n)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,119 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for die-roll fudging
+//
+
+package mapservice
+
+import (
+	"testing"
+)
+
+func TestFudgeQueue(t *testing.T) {
+	var q fudgeQueue
+
+	q.set(&DieRollFudge{User: "*", Spec: "*", Faces: []int{1}})
+	q.set(&DieRollFudge{User: "alice", Spec: "*", Faces: []int{2}})
+	q.set(&DieRollFudge{User: "alice", Spec: "d20", Faces: []int{3}})
+	q.set(&DieRollFudge{User: "*", Spec: "d20", Faces: []int{4}})
+	if old := q.set(&DieRollFudge{User: "*", Spec: "d20", Faces: []int{5}}); old == nil || old.Faces[0] != 4 {
+		t.Errorf("replacing a fudge returned %v", old)
+	}
+
+	for i, c := range []struct {
+		user, spec string
+		face       int
+	}{
+		{"alice", " d20 ", 3},
+		{"alice", "d20", 2},
+		{"bob", "d20", 5},
+		{"bob", "d20", 1},
+		{"bob", "d20", 0},
+	} {
+		f := q.take(c.user, c.spec)
+		if c.face == 0 {
+			if f != nil {
+				t.Errorf("case %d: expected no fudge, got %v", i, f)
+			}
+		} else if f == nil || f.Faces[0] != c.face {
+			t.Errorf("case %d: expected fudge showing %d, got %v", i, c.face, f)
+		}
+	}
+
+	q.set(&DieRollFudge{User: "bob", Spec: "*", Faces: []int{6}})
+	if old := q.set(&DieRollFudge{User: "bob", Spec: "*"}); old == nil {
+		t.Errorf("cancelling a fudge didn't find it")
+	}
+	if f := q.take("bob", "d6"); f != nil {
+		t.Errorf("cancelled fudge was still used: %v", f)
+	}
+}
+
+func TestFudgeDice(t *testing.T) {
+	d, err := NewDieRoller()
+	if err != nil {
+		t.Fatalf("unable to create die roller: %v", err)
+	}
+	d.Random = &fudgedRandomSource{faces: []int{20, 7, 99}, fallback: fixedRandomSource(0)}
+	_, results, err := d.DoRoll("d20+2d8+d6")
+	if err != nil {
+		t.Fatalf("fudged roll failed: %v", err)
+	}
+	// 20 + 7 + (99 doesn't fit on a d8, so 1) + 1
+	if len(results) != 1 || results[0].Result != 29 {
+		t.Errorf("fudged roll gave %v", results)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
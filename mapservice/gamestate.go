@@ -0,0 +1,678 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     Game State                                     //
+//                                                                                    //
+// The GameState type tracks the state of the game in progress. It is the one place   //
+// where the server's notion of the map, chat history, and object indices is kept and //
+// updated; the message handlers and storage backends all go through it.              //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// GameState holds everything the server knows about the game in progress:
+// the set of events which make up the current map state, the chat history,
+// the locations of known images, and the indices we keep to resolve
+// creature names and object classes. All access goes through the methods
+// below so that every code path which changes the game state does so in
+// the same way.
+//
+// Creature tokens and map elements are kept in Objects, with the LS,
+// PS, and OA family of events applied to them as they arrive. Other
+// events are stored in EventHistory as a map of key->*MapEvent
+// (and ChatHistory for chat events as a linear slice of *MapEvent).
+// The ChatHistory list is stored in ascending message ID order so we
+// can simply re-transmit its events by finding our starting point
+// and going from there. However, the objects and EventHistory map
+// need to be sorted first. We store it by key to make updates more efficient
+// since the more expensive sorting operation only needs to be
+// performed on the relatively rare SYNC command.
+//
+type GameState struct {
+	lock         contendedLock             // controls concurrent access to Objects, EventHistory, and IdByName
+	chatLock     contendedLock             // controls concurrent access to ChatHistory
+	imageLock    contendedLock             // controls concurrent access to Images
+	saveLock     sync.Mutex                // controls concurrent access to SaveNeeded
+	Objects      map[string]*MapObject     // creature tokens and map elements by ID
+	EventHistory map[string]*MapEvent      // other game state as mapping of key to event
+	Images       map[string]ImageLocation  // known image locations by name and zoom
+	ChatHistory  []*MapEvent               // history of messages sent to chat channel
+	IdByName     map[string]string         // dictionary of object IDs by creature name
+	SaveNeeded   bool                      // have we made changes since the last save?
+	Writer       string                    // name stamped on the events we record (see EventClock)
+	clock        EventClock                // how far through each writer's events we have seen
+	removed      EventClock                // our clock when something was last removed
+	journal      *Journal                  // where we record changes as they are made, if anywhere
+	journaled    int64                     // last journal entry included in the state
+	snapshotMark int64                     // last journal entry included in the last save
+}
+
+//
+// An ImageLocation records where a client may find a given
+// image file at a given zoom level.
+//
+type ImageLocation struct {
+	Name     string
+	Zoom     string
+	Location string
+}
+
+//
+// NewGameState creates an empty game state.
+//
+func NewGameState() *GameState {
+	gs := &GameState{Writer: DefaultWriter}
+	gs.reset()
+	return gs
+}
+
+func (gs *GameState) reset() {
+	gs.Objects = make(map[string]*MapObject)
+	gs.EventHistory = make(map[string]*MapEvent)
+	gs.Images = make(map[string]ImageLocation)
+	gs.ChatHistory = nil
+	gs.IdByName = make(map[string]string)
+	gs.clock = make(EventClock)
+	gs.removed = make(EventClock)
+	gs.journaled = 0
+}
+
+//
+// Record an event in the game state. Events which describe objects
+// (LS, PS, OA, OA+, OA-) are applied to those objects. Any other
+// event is recorded as the most recent one with its key. Events with
+// a blank key are ones we aren't going to bother tracking here since
+// they don't really change the state of the game.
+//
+// We stamp each one with a sequence number (see EventClock) so they
+// can be played back in the correct order, but store by key since
+// most of the time that's what we're doing (so the more
+// expensive operation of sorting by sequence number only
+// happens occasionally).
+//
+func (gs *GameState) Record(event *MapEvent) error {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	return gs.record(event)
+}
+
+//
+// Record an event, with gs.lock held.
+//
+func (gs *GameState) record(event *MapEvent) error {
+	id, class := event.ID, event.Class
+	err := gs.apply(event)
+	gs.journalEvent(event, id, class)
+	return err
+}
+
+func (gs *GameState) apply(event *MapEvent) error {
+	if event.Key == "" {
+		return nil
+	}
+	gs.stamp(event)
+
+	switch event.EventType() {
+		case "LS":
+			objects, err := ObjectsFromLoadEvent(event)
+			if err != nil {
+				return err
+			}
+			for _, obj := range objects {
+				if err = gs.checkClass(obj.ID, obj.Class); err != nil {
+					return err
+				}
+			}
+			for _, obj := range objects {
+				if obj.Class == "" {
+					obj.Class = event.Class
+				}
+				gs.defineObject(obj, event)
+			}
+			gs.markChanged()
+			return nil
+
+		case "PS":
+			// PS <id> <color> <name> <area> <size> player|monster <x> <y> <reach>
+			if err := gs.checkClass(event.ID, event.Class); err != nil {
+				return err
+			}
+			obj, ok := gs.Objects[event.ID]
+			if !ok {
+				obj = NewMapObject(event.ID, event.Class)
+				obj.Writer, obj.Sequence = event.Writer, event.Sequence
+				gs.Objects[event.ID] = obj
+			}
+			obj.Changed = event.Changed
+			obj.Class = event.Class
+			gs.renameObject(obj, event.Fields[3])
+			obj.Attrs["COLOR"] = event.Fields[2]
+			obj.Attrs["AREA"] = event.Fields[4]
+			obj.Attrs["SIZE"] = event.Fields[5]
+			obj.Attrs["TYPE"] = event.Fields[6]
+			obj.Attrs["GX"] = event.Fields[7]
+			obj.Attrs["GY"] = event.Fields[8]
+			obj.Attrs["REACH"] = event.Fields[9]
+			gs.markChanged()
+			return nil
+
+		case "OA", "OA+", "OA-":
+			if strings.HasPrefix(event.ID, "@") {
+				if id, ok := gs.IdByName[strip_creature_base_name(event.ID[1:])]; ok {
+					event.ID = id
+				}
+			}
+			if event.ID == "" || strings.HasPrefix(event.ID, "@") {
+				// we couldn't figure out what object this refers to,
+				// so the best we can do is to remember the event itself.
+				gs.recordEvent(event)
+				return nil
+			}
+			obj, ok := gs.Objects[event.ID]
+			if !ok {
+				obj = NewMapObject(event.ID, event.Class)
+				obj.Writer, obj.Sequence = event.Writer, event.Sequence
+				gs.Objects[event.ID] = obj
+			}
+			obj.Changed = event.Changed
+			// An OA event's class is only a guess unless we already
+			// knew it, so it never changes the class of an object.
+			event.Class = obj.Class
+			gs.markChanged()
+
+			if event.EventType() == "OA" {
+				kvlist, err := ParseTclList(event.Fields[2])
+				if err != nil {
+					return err
+				}
+				for i := 0; i+1 < len(kvlist); i += 2 {
+					if kvlist[i] == "NAME" {
+						gs.renameObject(obj, kvlist[i+1])
+					} else {
+						obj.Attrs[kvlist[i]] = kvlist[i+1]
+					}
+				}
+				return nil
+			}
+			values, err := ParseTclList(event.Fields[3])
+			if err != nil {
+				return err
+			}
+			if event.EventType() == "OA+" {
+				return obj.AddToList(event.Fields[2], values)
+			}
+			return obj.RemoveFromList(event.Fields[2], values)
+
+		case "RA-":
+			delete(gs.EventHistory, event.Key)
+			gs.noteRemoval(true)
+			gs.markChanged()
+			return nil
+
+		case "GR":
+			if event.Fields[2] == "" {
+				delete(gs.EventHistory, event.Key)
+				gs.noteRemoval(true)
+				gs.markChanged()
+				return nil
+			}
+	}
+	gs.recordEvent(event)
+	return nil
+}
+
+func (gs *GameState) recordEvent(event *MapEvent) {
+	gs.EventHistory[event.Key] = event
+	gs.markChanged()
+}
+
+//
+// An object may change between player and monster, but a creature
+// can't turn into a map element or vice versa.
+//
+func (gs *GameState) checkClass(id, class string) error {
+	if obj, ok := gs.Objects[id]; ok && obj.Class != "" && class != "" {
+		if obj.IsCreature() != (class == "P" || class == "M") {
+			return fmt.Errorf("Object %s is already defined with class %s; can't change it to %s", id, obj.Class, class)
+		}
+	}
+	return nil
+}
+
+//
+// (Re-)define an object from a complete description in the given event.
+//
+func (gs *GameState) defineObject(obj *MapObject, event *MapEvent) {
+	name, has_name := obj.Attrs["NAME"]
+	delete(obj.Attrs, "NAME")
+	gs.deleteObject(obj.ID)
+	obj.Writer, obj.Sequence, obj.Changed = event.Writer, event.Sequence, event.Changed
+	gs.Objects[obj.ID] = obj
+	if has_name {
+		gs.renameObject(obj, name)
+	}
+}
+
+//
+// Change an object's NAME attribute, keeping the name index in step.
+//
+func (gs *GameState) renameObject(obj *MapObject, name string) {
+	if old, ok := obj.Attrs["NAME"]; ok && gs.IdByName[strip_creature_base_name(old)] == obj.ID {
+		delete(gs.IdByName, strip_creature_base_name(old))
+	}
+	obj.Attrs["NAME"] = name
+	gs.IdByName[strip_creature_base_name(name)] = obj.ID
+}
+
+//
+// Events returns the game state as a list of events in the order in
+// which they should be replayed to a client. Each object is sent as
+// a single LS event which defines it completely.
+//
+func (gs *GameState) Events() MapEventList {
+	gs.lock.RLock()
+	events := gs.allEvents()
+	gs.lock.RUnlock()
+	sort.Sort(events)
+	return events
+}
+
+func (gs *GameState) allEvents() MapEventList {
+	events := make(MapEventList, 0, len(gs.EventHistory) + len(gs.Objects))
+	for _, event := range gs.EventHistory {
+		events = append(events, event)
+	}
+	for _, obj := range gs.Objects {
+		event, err := obj.LoadEvent()
+		if err != nil {
+			log.Printf("Unable to package object %s for transmission: %v", obj.ID, err)
+			continue
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+//
+// ClearObjects removes objects from the game state as described for the
+// CLR command. <target> may be:
+//	*						all objects
+//  E*						all map elements
+//	M*						all monsters
+// 	P*						all players
+//  [<imagename>=]<name>	creature with the given <name>
+//  <id>					object with ID <id>
+//
+func (gs *GameState) ClearObjects(target string) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	gs.clearObjects(target)
+}
+
+//
+// Remove objects (see ClearObjects), with gs.lock held.
+//
+func (gs *GameState) clearObjects(target string) {
+	removed := ""
+	switch target {
+		case "*":
+			gs.Objects = make(map[string]*MapObject)
+			gs.EventHistory = make(map[string]*MapEvent)
+			gs.IdByName = make(map[string]string)
+
+		case "E*", "M*", "P*":
+			for id, obj := range gs.Objects {
+				if obj.Class == target[0:1] {
+					gs.deleteObject(id)
+				}
+			}
+			for key, ev := range gs.EventHistory {
+				if ev.EventClass() == target[0:1] {
+					delete(gs.EventHistory, key)
+				}
+			}
+
+		default:
+			id, ok := gs.IdByName[strip_creature_base_name(target)]
+			if !ok {
+				id = target
+			}
+			gs.deleteObject(id)
+			for key, ev := range gs.EventHistory {
+				if ev.ID == id {
+					delete(gs.EventHistory, key)
+				}
+			}
+			removed = id
+	}
+	gs.noteRemoval(false)
+	gs.markChanged()
+	if gs.journal != nil {
+		gs.journal.append(JournalEntry{Op: "clear", Target: target, Object: removed})
+	}
+}
+
+func (gs *GameState) deleteObject(id string) {
+	if obj, ok := gs.Objects[id]; ok {
+		if name, ok := obj.Attrs["NAME"]; ok && gs.IdByName[strip_creature_base_name(name)] == id {
+			delete(gs.IdByName, strip_creature_base_name(name))
+		}
+		delete(gs.Objects, id)
+	}
+}
+
+//
+// AddChatMessage assigns a new message ID to a chat event, stamps it
+// with the server's time, and appends it to the chat history.
+//
+func (gs *GameState) AddChatMessage(event *MapEvent) {
+	gs.chatLock.Lock()
+	event.AssignMessageID()
+	event.stampServerTime(time.Now())
+	gs.ChatHistory = append(gs.ChatHistory, event)
+	gs.markChanged()
+	gs.chatLock.Unlock()
+}
+
+//
+// ClearChat removes messages from the chat history as described for the
+// CC command. If <target> is empty, the entire history is deleted. If
+// negative, only the most recent -<target> messages are kept. Otherwise,
+// <target> is the lowest message ID to be kept.
+//
+func (gs *GameState) ClearChat(target string) error {
+	gs.chatLock.Lock()
+	defer gs.chatLock.Unlock()
+
+	if target == "" {
+		gs.ChatHistory = nil
+		gs.markChanged()
+		return nil
+	}
+
+	n, err := strconv.Atoi(target)
+	if err != nil {
+		return fmt.Errorf("invalid target: %v", err)
+	}
+	if n < 0 {
+		if len(gs.ChatHistory) > -n {
+			gs.ChatHistory = append([]*MapEvent(nil), gs.ChatHistory[len(gs.ChatHistory)+n:]...)
+			gs.markChanged()
+		}
+	} else if len(gs.ChatHistory) > 0 {
+		start := sort.Search(len(gs.ChatHistory), func(i int) bool {
+			mid, err := gs.ChatHistory[i].MessageID()
+			if err != nil {
+				log.Printf("CC: Error getting message ID from %v: %v", gs.ChatHistory[i], err)
+				return false
+			}
+			return mid >= n
+		})
+		gs.ChatHistory = append([]*MapEvent(nil), gs.ChatHistory[start:]...)
+		gs.markChanged()
+	}
+	return nil
+}
+
+//
+// ChatMessages returns the chat history to be replayed for SYNC CHAT.
+// If <target> is empty, all messages are returned. If negative, only the
+// most recent -<target> messages are returned. Otherwise, the messages
+// with IDs greater than <target> are returned.
+//
+func (gs *GameState) ChatMessages(target string) ([]*MapEvent, error) {
+	gs.chatLock.RLock()
+	defer gs.chatLock.RUnlock()
+
+	start := 0
+	if target != "" {
+		n, err := strconv.Atoi(target)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			start = len(gs.ChatHistory) + n
+			if start < 0 {
+				start = 0
+			}
+		} else {
+			start = sort.Search(len(gs.ChatHistory), func(i int) bool {
+				numeric_id, err := gs.ChatHistory[i].MessageID()
+				if err != nil {
+					return false
+				}
+				return numeric_id > n
+			})
+		}
+	}
+	return append([]*MapEvent(nil), gs.ChatHistory[start:]...), nil
+}
+
+//
+// ImageLocation returns the server location of the image with the
+// given name and zoom, if we know it.
+//
+func (gs *GameState) ImageLocation(name, zoom string) (string, bool) {
+	gs.imageLock.RLock()
+	image, ok := gs.Images[name + "‖" + zoom]
+	gs.imageLock.RUnlock()
+	return image.Location, ok
+}
+
+//
+// SetImageLocation remembers where the given image may be found.
+//
+func (gs *GameState) SetImageLocation(name, zoom, location string) {
+	gs.imageLock.Lock()
+	image := ImageLocation{Name: name, Zoom: zoom, Location: location}
+	gs.Images[name + "‖" + zoom] = image
+	gs.markChanged()
+	if gs.journal != nil {
+		gs.journal.append(JournalEntry{Op: "image", Image: &image})
+	}
+	gs.imageLock.Unlock()
+}
+
+//
+// Object returns a copy of the object with the given ID.
+//
+func (gs *GameState) Object(id string) (MapObject, bool) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	obj, ok := gs.Objects[id]
+	if !ok {
+		return MapObject{}, false
+	}
+	c := *obj
+	c.Attrs = make(map[string]string, len(obj.Attrs))
+	for k, v := range obj.Attrs {
+		c.Attrs[k] = v
+	}
+	c.Extra = append([]string(nil), obj.Extra...)
+	return c, true
+}
+
+//
+// ResolveObject takes an object reference as used in the OA family of
+// commands, which is either an object ID or "@<name>" for a named creature
+// token, and returns the object's ID (or "" if the name is not known)
+// and class. <known> is false if we have no record of the object.
+//
+func (gs *GameState) ResolveObject(ref string) (id, class string, known bool) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	if strings.HasPrefix(ref, "@") {
+		var ok bool
+		if id, ok = gs.IdByName[strip_creature_base_name(ref[1:])]; !ok {
+			return "", "", false
+		}
+	} else {
+		id = ref
+	}
+	if obj, ok := gs.Objects[id]; ok {
+		return id, obj.Class, true
+	}
+	return id, "", false
+}
+
+//
+// CreatureAttribute returns the value of an attribute of the creature
+// token with the given name, so die rolls can refer to it.
+//
+func (gs *GameState) CreatureAttribute(creature, attr string) (string, bool) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	id, ok := gs.IdByName[strip_creature_base_name(creature)]
+	if !ok {
+		return "", false
+	}
+	obj, ok := gs.Objects[id]
+	if !ok {
+		return "", false
+	}
+	value, ok := obj.Attrs[attr]
+	return value, ok
+}
+
+//
+// NeedsSave reports whether the state has changed since it was
+// last saved.
+//
+func (gs *GameState) NeedsSave() bool {
+	gs.saveLock.Lock()
+	defer gs.saveLock.Unlock()
+	return gs.SaveNeeded
+}
+
+//
+// MarkSaved notes that the state has been saved, so the journal no
+// longer needs the changes the save included.
+//
+func (gs *GameState) MarkSaved() {
+	gs.saveLock.Lock()
+	gs.SaveNeeded = false
+	journal, mark := gs.journal, gs.snapshotMark
+	gs.saveLock.Unlock()
+
+	if journal != nil {
+		if err := journal.Discard(mark); err != nil {
+			log.Printf("Unable to discard saved changes from the journal: %v", err)
+		}
+		// anything changed while we were saving still needs to be
+		if journal.Mark() > mark {
+			gs.markChanged()
+		}
+	}
+}
+
+//
+// Note which journal entries a save of the state included.
+//
+func (gs *GameState) noteSnapshot(mark int64) {
+	gs.saveLock.Lock()
+	gs.snapshotMark = mark
+	gs.saveLock.Unlock()
+}
+
+//
+// Dump the game state to the logfile
+//
+func (gs *GameState) Dump() {
+	gs.rlockAll()
+	defer gs.runlockAll()
+
+	log.Printf("SEQUENCE CLS ID------------------------------ NAME-----------------------------")
+	for _, obj := range gs.Objects {
+		log.Printf("%8d %3s %-32s %s", obj.Sequence, obj.Class, obj.ID, obj.Attrs["NAME"])
+	}
+	log.Printf("SEQUENCE CLS ID------------------------------ DATA-----------------------------")
+	for _, event := range gs.EventHistory {
+		rawdata, err := event.RawEventText()
+		if err != nil {
+			rawdata = fmt.Sprintf("**ERROR** %v", err)
+		}
+		log.Printf("%8d %3s %-32s %s", event.Sequence, event.Class, event.ID, rawdata)
+	}
+	log.Printf("IMAGE-ID------------ ZOOM FILE-------------------------------------------------")
+	for _, image := range gs.Images {
+		log.Printf("%20s %4s %s", image.Name, image.Zoom, image.Location)
+	}
+	log.Printf("NAME---------------------------- ID")
+	for name, id := range gs.IdByName {
+		log.Printf("%-32s %s", name, id)
+	}
+	log.Printf("Event clock:   %v", gs.clock)
+	log.Printf("Save needed?   %v", gs.NeedsSave())
+	log.Printf("LOCK---- ACQUIRED CONTENDED WAIT(s)- MAX(s)--")
+	for _, l := range gs.LockStats() {
+		log.Printf("%-8s %8d %9d %9.3f %8.3f", l.Name, l.Acquired, l.Contended, l.Wait, l.MaxWait)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
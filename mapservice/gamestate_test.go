@@ -0,0 +1,239 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the game state tracker
+//
+
+package mapservice
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func recordTestEvents(t *testing.T, gs *GameState, raw ...string) {
+	for _, r := range raw {
+		ev, err := NewMapEvent(r, "", "")
+		if err != nil {
+			t.Fatalf("unable to create event %s: %v", r, err)
+		}
+		if err = gs.Record(ev); err != nil {
+			t.Fatalf("unable to record event %s: %v", r, err)
+		}
+	}
+}
+
+func TestGameState_RecordAndClear(t *testing.T) {
+	gs := NewGameState()
+	recordTestEvents(t, gs,
+		"PS 1234 red Grax 1 M monster 3 4 0",
+		"PS 5678 blue Alice 1 M player 5 6 0",
+		"CO 1",
+	)
+
+	events := gs.Events()
+	if len(events) != 3 || events[0].Key != "LS:1234" || events[2].Fields[0] != "CO" {
+		t.Fatalf("events not returned in sequence: %v", events)
+	}
+
+	gs.ClearObjects("P*")
+	if len(gs.Objects) != 1 {
+		t.Errorf("CLR P* left %v", gs.Objects)
+	}
+	gs.ClearObjects("goblin=Grax")
+	if _, ok := gs.Objects["1234"]; ok {
+		t.Errorf("CLR by name didn't remove Grax: %v", gs.Objects)
+	}
+	if _, ok := gs.IdByName["Grax"]; ok {
+		t.Errorf("CLR by name didn't remove Grax from name index")
+	}
+	gs.ClearObjects("*")
+	if len(gs.EventHistory) != 0 || len(gs.IdByName) != 0 {
+		t.Errorf("CLR * left %v %v", gs.EventHistory, gs.IdByName)
+	}
+}
+
+func TestGameState_ObjectAttributes(t *testing.T) {
+	gs := NewGameState()
+	recordTestEvents(t, gs,
+		"PS 1234 red Grax 1 M monster 3 4 0",
+		"OA 1234 {HEALTH {10 0 0 12 0 0 0 {} 0} ELEV 5}",
+		"OA+ 1234 STATUSLIST {prone blinded}",
+		"OA+ 1234 STATUSLIST {prone stunned}",
+		"OA- 1234 STATUSLIST blinded",
+		"OA 1234 {NAME {Grax the Bold}}",
+		"OA @Nobody {ELEV 1}",
+	)
+
+	obj, ok := gs.Object("1234")
+	if !ok {
+		t.Fatalf("object not created")
+	}
+	expected := map[string]string{
+		"COLOR": "red", "NAME": "Grax the Bold", "AREA": "1", "SIZE": "M",
+		"TYPE": "monster", "GX": "3", "GY": "4", "REACH": "0", "ELEV": "5",
+		"HEALTH": "10 0 0 12 0 0 0 {} 0", "STATUSLIST": "prone stunned",
+	}
+	if !cmp.Equal(obj.Attrs, expected) || obj.Class != "M" {
+		t.Errorf("object is %s %s", obj.Class, cmp.Diff(expected, obj.Attrs))
+	}
+	if gs.IdByName["Grax the Bold"] != "1234" || gs.IdByName["Grax"] != "" {
+		t.Errorf("name index not updated: %v", gs.IdByName)
+	}
+	if len(gs.EventHistory) != 1 {
+		t.Errorf("unresolved OA not kept as a raw event: %v", gs.EventHistory)
+	}
+
+	ev, err := NewMapEvent("OA 1234 {X 12}", "", "E")
+	if err != nil {
+		t.Fatalf("unable to create event: %v", err)
+	}
+	gs.Record(ev)
+	if obj, _ = gs.Object("1234"); obj.Class != "M" {
+		t.Errorf("OA changed object class to %s", obj.Class)
+	}
+
+	ls, err := obj.LoadEvent()
+	if err != nil {
+		t.Fatalf("unable to package object: %v", err)
+	}
+	if ls.MultiRawData[0] != "LS: {M AREA:1234 1}" || len(ls.MultiRawData) != len(obj.Attrs)+1 {
+		t.Errorf("LS data is %v", ls.MultiRawData)
+	}
+	ls.Class = "E"
+	ls.MultiRawData = []string{"LS: {X:1234 12}", "LS. 1 x"}
+	if err = gs.Record(ls); err == nil {
+		t.Errorf("creature was redefined as a map element")
+	}
+}
+
+func TestGameState_Chat(t *testing.T) {
+	gs := NewGameState()
+	var ids []int
+	for i := 0; i < 5; i++ {
+		ev, err := NewMapEvent("TO alice * hello {}", "", "")
+		if err != nil {
+			t.Fatalf("unable to create event: %v", err)
+		}
+		gs.AddChatMessage(ev)
+		id, err := ev.MessageID()
+		if err != nil {
+			t.Fatalf("no message ID assigned: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if m, err := gs.ChatMessages("-2"); err != nil || len(m) != 2 {
+		t.Errorf("ChatMessages(-2) returned %d messages (%v)", len(m), err)
+	}
+	if m, _ := gs.ChatMessages(""); len(m) != 5 {
+		t.Errorf("ChatMessages() returned %d messages", len(m))
+	}
+	if _, err := gs.ChatMessages("x"); err == nil {
+		t.Errorf("ChatMessages(x) did not fail")
+	}
+
+	if err := gs.ClearChat(strconv.Itoa(ids[3])); err != nil {
+		t.Fatalf("ClearChat failed: %v", err)
+	}
+	if len(gs.ChatHistory) != 2 {
+		t.Errorf("ClearChat left %d messages", len(gs.ChatHistory))
+	}
+	if err := gs.ClearChat("-1"); err != nil || len(gs.ChatHistory) != 1 {
+		t.Errorf("ClearChat(-1) left %d messages (%v)", len(gs.ChatHistory), err)
+	}
+	if err := gs.ClearChat(""); err != nil || gs.ChatHistory != nil {
+		t.Errorf("ClearChat() left %d messages (%v)", len(gs.ChatHistory), err)
+	}
+}
+
+func TestGameState_ResolveObject(t *testing.T) {
+	gs := NewGameState()
+	recordTestEvents(t, gs, "PS 1234 red Grax 1 M monster 3 4 0")
+
+	type testcase struct {
+		ref, id, class string
+		known          bool
+	}
+	for i, tc := range []testcase{
+		{"@Grax", "1234", "M", true},
+		{"@goblin=Grax", "1234", "M", true},
+		{"1234", "1234", "M", true},
+		{"@Nobody", "", "", false},
+		{"9999", "9999", "", false},
+	} {
+		id, class, known := gs.ResolveObject(tc.ref)
+		if id != tc.id || class != tc.class || known != tc.known {
+			t.Errorf("case %d: %s resolved to (%s, %s, %v)", i, tc.ref, id, class, known)
+		}
+	}
+
+	recordTestEvents(t, gs, "OA @Grax {NAME {Grax the Bold}}")
+	if id, _, _ := gs.ResolveObject("@Grax"); id != "" {
+		t.Errorf("old name still resolves to %s", id)
+	}
+	if id, _, _ := gs.ResolveObject("@Grax the Bold"); id != "1234" {
+		t.Errorf("new name resolves to %s", id)
+	}
+	if !gs.NeedsSave() {
+		t.Errorf("changes not flagged for saving")
+	}
+	gs.MarkSaved()
+	if gs.NeedsSave() {
+		t.Errorf("still needs save after MarkSaved")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
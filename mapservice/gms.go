@@ -0,0 +1,350 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                               Sharing the GM's Chair                               //
+//                                                                                    //
+// Several people may be logged in with GM rights at once. They all answer to "GM" as //
+// far as the game is concerned, but each keeps the name they logged in with so the   //
+// logs and audit trail say which of them did what, and each is told when another     //
+// has just changed the same thing they did.                                          //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// DefaultGMConflictWindow is how soon after one GM changes something
+// another GM changing it too is taken to be a conflict, unless the
+// server is told otherwise.
+//
+const DefaultGMConflictWindow = 10 * time.Second
+
+//
+// GMName is the name a GM gave when logging in, if they gave one
+// (everyone with GM rights is "GM" to the game itself). It is empty
+// for players, and for a GM who didn't say who they were.
+//
+func (c *MapClient) GMName() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if !c.isGM() {
+		return ""
+	}
+	return c.gmName
+}
+
+//
+// Make the client a GM, going by the given name. (This and giveUpGM
+// are called from another GM's goroutine, so they change who the
+// client is under its lock.)
+//
+func (c *MapClient) takeOverGM(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gmName = name
+	c.Auth.Username = "GM"
+	c.Auth.GmMode = true
+}
+
+//
+// Make the client a player again, going by the name they gave when
+// they logged in. Returns false if they gave none, so have no one to
+// go back to being.
+//
+func (c *MapClient) giveUpGM() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Auth.GmMode = false
+	if c.gmName == "" {
+		return false
+	}
+	c.Auth.Username = c.gmName
+	c.gmName = ""
+	return true
+}
+
+//
+// Who the client is, for the logs: their username, plus which GM
+// they are if that's known.
+//
+func (c *MapClient) auditName() string {
+	if name := c.GMName(); name != "" {
+		return fmt.Sprintf("%s (%s)", c.Username(), name)
+	}
+	return c.Username()
+}
+
+//
+// The name a GM gave as their username when they logged in, if it's
+// worth keeping.
+//
+func gmLoginName(username string) string {
+	name := strings.ToLower(username)
+	if name == "gm" || name == "<unknown>" {
+		return ""
+	}
+	return name
+}
+
+//
+// Recipients of a chat message, as the users whose clients it goes to.
+// A message for "%" goes to the GM, which is every GM connection.
+//
+func chatRecipients(to_list []string) []string {
+	users := make([]string, 0, len(to_list))
+	for _, recipient := range to_list {
+		if recipient == "%" {
+			recipient = "GM"
+		}
+		users = append(users, recipient)
+	}
+	return users
+}
+
+//
+// Called when a GM has just logged in. Any other GMs already connected
+// (under another name) are told they have company.
+//
+func (ms *MapService) noticeCoGMs(thisClient *MapClient) {
+	if !thisClient.IsGM() {
+		return
+	}
+	var others []*MapClient
+	for _, peer := range ms.Clients.ByUser("GM") {
+		if peer != thisClient && peer.GMName() != thisClient.GMName() {
+			others = append(others, peer)
+		}
+	}
+	if len(others) == 0 {
+		return
+	}
+	log.Printf("[client %s] %s joined %d other GM connection%s", thisClient.logTag(), thisClient.auditName(), len(others), plural(len(others)))
+	for _, peer := range others {
+		peer.Send("TO", peer.Username(), peer.Username(),
+			fmt.Sprintf("NOTICE: %s has logged in from %s with GM rights too.",
+				thisClient.auditName(), thisClient.sessionDescription()),
+			NextMessageID())
+	}
+}
+
+//
+// A change some GM made to the game, remembered for a while to see if
+// another GM trips over it.
+//
+type gmEdit struct {
+	client *MapClient
+	when   time.Time
+}
+
+//
+// gmEditList remembers the recent changes made by GMs, by what they
+// changed.
+//
+type gmEditList struct {
+	lock  sync.Mutex
+	edits map[string]gmEdit
+}
+
+//
+// Note that the client changed the thing known by key. If a different
+// GM connection changed it within the window, return that edit.
+// Edits older than the window are forgotten as we go.
+//
+func (l *gmEditList) note(key string, c *MapClient, now time.Time, window time.Duration) (gmEdit, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.edits == nil {
+		l.edits = make(map[string]gmEdit)
+	}
+	for k, edit := range l.edits {
+		if now.Sub(edit.when) >= window {
+			delete(l.edits, k)
+		}
+	}
+	previous, found := l.edits[key]
+	l.edits[key] = gmEdit{client: c, when: now}
+	return previous, found && previous.client != c
+}
+
+//
+// What a GM's message changes, for spotting two GMs changing the same
+// thing, or "" if it changes nothing. Messages about a particular
+// object are keyed by that object; anything else by its type.
+//
+func gmEditKey(event *MapEvent, handler MessageHandler) (key, description string) {
+	if strings.HasSuffix(event.EventType(), "?") || (handler.Privilege != PrivGM && !handler.RecordsEvent) {
+		return "", ""
+	}
+	if event.ID != "" {
+		return "object " + event.ID, "object " + event.ID
+	}
+	return event.EventType(), "the game with " + event.EventType()
+}
+
+//
+// A GM is changing something. If another GM connection changed the
+// same thing only a moment ago, the later change stands (as it always
+// has), but both GMs are told, so they can sort out between them which
+// they meant.
+//
+func (ms *MapService) checkGMConflict(event *MapEvent, handler MessageHandler, thisClient *MapClient) {
+	if ms.GMConflictWindow <= 0 || !thisClient.IsGM() || len(ms.Clients.ByUser("GM")) < 2 {
+		return
+	}
+	key, what := gmEditKey(event, handler)
+	if key == "" {
+		return
+	}
+	now := time.Now()
+	previous, conflict := ms.gmEdits.note(key, thisClient, now, ms.GMConflictWindow)
+	if !conflict || !previous.client.IsGM() {
+		return
+	}
+	ago := now.Sub(previous.when).Truncate(time.Second)
+	log.Printf("[client %s] %s changed %s %v after %s did", thisClient.logTag(), thisClient.auditName(), what, ago, previous.client.auditName())
+	thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
+		fmt.Sprintf("NOTICE: %s changed %s %v ago; your change has replaced theirs.",
+			previous.client.auditName(), what, ago),
+		NextMessageID())
+	previous.client.Send("TO", previous.client.Username(), previous.client.Username(),
+		fmt.Sprintf("NOTICE: %s has just changed %s as well; their change has replaced yours.",
+			thisClient.auditName(), what),
+		NextMessageID())
+}
+
+//
+// Hand the GM's role over from thisClient to the named user, who must
+// be connected, as when the GM's computer has given up and someone
+// else is to run the rest of the game without being told the GM
+// password. Each of the user's connections becomes a GM for as long as
+// it lasts. The connections of the GM handing over (all those under
+// their GM name) give the role up: they carry on as the player they
+// named when they logged in, or are disconnected if they didn't name
+// one. Other GMs are left as they were. Returns the number of
+// connections which took over.
+//
+func (ms *MapService) handOffGM(thisClient *MapClient, user string) (int, error) {
+	if thisClient.Auth == nil {
+		return 0, fmt.Errorf("this server doesn't know who anyone is, so everyone is the GM already")
+	}
+	from := thisClient.auditName()
+	user = strings.ToLower(user)
+	if gmLoginName(user) == "" {
+		return 0, fmt.Errorf("the GM's role must be handed to someone by name")
+	}
+	if user == thisClient.GMName() {
+		return 0, fmt.Errorf("you are %s already", user)
+	}
+	takers := ms.Clients.ByUser(user)
+	if len(takers) == 0 {
+		return 0, fmt.Errorf("%s is not connected", user)
+	}
+	var givers []*MapClient
+	for _, peer := range ms.Clients.ByUser("GM") {
+		if peer.GMName() == thisClient.GMName() {
+			givers = append(givers, peer)
+		}
+	}
+
+	for _, peer := range takers {
+		peer.takeOverGM(user)
+	}
+	var dropped []*MapClient
+	for _, peer := range givers {
+		if !peer.giveUpGM() {
+			dropped = append(dropped, peer)
+		}
+	}
+	ms.Clients.Reindex()
+
+	log.Printf("[client %s] %s handed the GM's role to %s", thisClient.logTag(), from, user)
+	for _, peer := range takers {
+		peer.Send("GRANTED", "GM")
+		peer.Send("TO", "GM", "GM",
+			fmt.Sprintf("NOTICE: you are now the GM, handed over from %s.", thisClient.sessionDescription()),
+			NextMessageID())
+		ms.Sync(peer)
+	}
+	message := fmt.Sprintf("NOTICE: you have handed the GM's role to %s.", user)
+	for _, peer := range givers {
+		if peer.Username() == "GM" {
+			continue
+		}
+		peer.Send("GRANTED", peer.Username())
+		peer.Send("TO", peer.Username(), peer.Username(), message, NextMessageID())
+		ms.Sync(peer)
+	}
+	for _, peer := range dropped {
+		peer.Send("TO", "GM", "GM", message+" Since you didn't log in under a name of your own, this session is over.", NextMessageID())
+		peer.setDisconnectReason(DisconnectHandedOff)
+		peer.Close()
+	}
+	for _, peer := range ms.Clients.ByUser("GM") {
+		if peer.IsGM() && peer.GMName() != user {
+			peer.Send("TO", "GM", "GM",
+				fmt.Sprintf("NOTICE: %s has handed the GM's role to %s.", from, user),
+				NextMessageID())
+		}
+	}
+	return len(takers), nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
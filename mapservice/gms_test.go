@@ -0,0 +1,209 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for sharing the GM's role
+//
+
+package mapservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGMLoginName(t *testing.T) {
+	for name, expected := range map[string]string{"Alice": "alice", "GM": "", "gm": "", "<unknown>": ""} {
+		if actual := gmLoginName(name); actual != expected {
+			t.Errorf("GM logging in as %q is known as %q, not %q", name, actual, expected)
+		}
+	}
+}
+
+func TestSeveralGMs(t *testing.T) {
+	ms := newTestService()
+	alice := newTestClient(ms, "alice", "GM", true)
+	alice.gmName = "alice"
+	bob := newTestClient(ms, "bob", "GM", true)
+	bob.gmName = "bob"
+	player := newTestClient(ms, "player", "carol", false)
+	player.gmName = "carol"
+	if player.GMName() != "" || alice.auditName() != "GM (alice)" || player.auditName() != "carol" {
+		t.Errorf("names were %q, %q, %q", player.GMName(), alice.auditName(), player.auditName())
+	}
+
+	ms.noticeConcurrentSessions(bob)
+	ms.noticeCoGMs(bob)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.Contains(sent[0], "NOTICE: GM (bob) has logged in from bob") {
+		t.Errorf("alice was sent %q when bob logged in", sent)
+	}
+	if sent := sentToTestClient(bob); len(sent) != 0 {
+		t.Errorf("bob was sent %q when logging in", sent)
+	}
+
+	// the GM's messages go to every GM
+	ms.ExecuteAction(testEvent(t, "TO carol % {for the GM}"), player)
+	ms.ExecuteAction(testEvent(t, "TO carol GM {for the GMs}"), player)
+	for _, gm := range []*MapClient{alice, bob} {
+		if sent := sentToTestClient(gm); len(sent) != 2 || !strings.Contains(sent[0], "for the GM") || !strings.Contains(sent[1], "for the GMs") {
+			t.Errorf("%s was sent %q", gm.GMName(), sent)
+		}
+	}
+	sentToTestClient(player)
+}
+
+func TestGMConflicts(t *testing.T) {
+	ms := newTestService()
+	ms.GMConflictWindow = time.Minute
+	alice := newTestClient(ms, "alice", "GM", true)
+	alice.gmName = "alice"
+	bob := newTestClient(ms, "bob", "GM", true)
+	bob.gmName = "bob"
+	player := newTestClient(ms, "player", "carol", false)
+
+	ms.ExecuteAction(testEvent(t, "FX 10 0 0"), alice)
+	ms.ExecuteAction(testEvent(t, "FX 10 0 0"), alice)
+	if sent := sentToTestClient(alice); countNotices(sent, "NOTICE") != 0 {
+		t.Errorf("alice was warned about her own change: %q", sent)
+	}
+	sentToTestClient(bob)
+	ms.ExecuteAction(testEvent(t, "FX?"), bob)
+	if sent := sentToTestClient(bob); countNotices(sent, "NOTICE") != 0 {
+		t.Errorf("bob was warned about a query: %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "FX 0 50 0"), bob)
+	if n := countNotices(sentToTestClient(bob), "NOTICE: GM (alice) changed the game with FX 0s ago; your change has replaced theirs."); n != 1 {
+		t.Errorf("bob got %d warnings", n)
+	}
+	if n := countNotices(sentToTestClient(alice), "NOTICE: GM (bob) has just changed the game with FX as well"); n != 1 {
+		t.Errorf("alice got %d warnings", n)
+	}
+	if fx := ms.AmbientEffects(); fx.Fog != 50 {
+		t.Errorf("later change didn't stand: %v", fx)
+	}
+	if sent := sentToTestClient(player); countNotices(sent, "NOTICE") != 0 {
+		t.Errorf("player was sent %q", sent)
+	}
+
+	ms.gmEdits.edits["FX"] = gmEdit{client: bob, when: time.Now().Add(-2 * time.Minute)}
+	ms.ExecuteAction(testEvent(t, "FX 0 0 0"), alice)
+	if sent := sentToTestClient(alice); countNotices(sent, "NOTICE") != 0 {
+		t.Errorf("alice was warned about an old change: %q", sent)
+	}
+}
+
+func TestHandOffGM(t *testing.T) {
+	var buf bytes.Buffer
+	ms := newTestService()
+	ms.AuditLog = NewAuditLog(&buf)
+	alice := newTestClient(ms, "alice", "GM", true)
+	alice.gmName = "alice"
+	alice2 := newTestClient(ms, "alice2", "GM", true)
+	alice2.gmName = "alice"
+	bob := newTestClient(ms, "bob", "GM", true)
+	bob.gmName = "bob"
+	carol := newTestClient(ms, "carol", "carol", false)
+	dave := newTestClient(ms, "dave", "dave", false)
+
+	ms.ExecuteAction(testEvent(t, "HANDOFF carol"), dave)
+	if sent := sentToTestClient(dave); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV") {
+		t.Errorf("player handing off the GM's role was sent %q", sent)
+	}
+	for _, who := range []string{"erin", "GM", "alice"} {
+		ms.ExecuteAction(testEvent(t, "HANDOFF "+who), alice)
+		if sent := sentToTestClient(alice); len(sent) != 1 || !strings.Contains(sent[0], "not handed over") {
+			t.Errorf("handing off to %s gave %q", who, sent)
+		}
+	}
+
+	ms.ExecuteAction(testEvent(t, "HANDOFF Carol"), alice)
+	if !carol.IsGM() || carol.Username() != "GM" || carol.GMName() != "carol" {
+		t.Errorf("carol is %q (%q), GM %v", carol.Username(), carol.GMName(), carol.IsGM())
+	}
+	for _, c := range []*MapClient{alice, alice2} {
+		if c.IsGM() || c.Username() != "alice" || c.ReachedEOF {
+			t.Errorf("%s is %q, GM %v", c.ClientAddr, c.Username(), c.IsGM())
+		}
+		if sent := sentToTestClient(c); len(sent) < 2 || sent[0] != "GRANTED alice" || !strings.Contains(sent[1], "you have handed the GM's role to carol") {
+			t.Errorf("%s was sent %q", c.ClientAddr, sent)
+		}
+	}
+	if sent := sentToTestClient(carol); len(sent) < 2 || sent[0] != "GRANTED GM" || !strings.Contains(sent[1], "you are now the GM") {
+		t.Errorf("carol was sent %q", sent)
+	}
+	if !bob.IsGM() || countNotices(sentToTestClient(bob), "GM (alice) has handed the GM's role to carol") != 1 {
+		t.Errorf("bob wasn't told of the hand-off")
+	}
+	if len(ms.Clients.ByUser("GM")) != 2 || len(ms.Clients.ByUser("alice")) != 2 {
+		t.Errorf("clients not reindexed")
+	}
+	var rec AuditRecord
+	if err := json.NewDecoder(&buf).Decode(&rec); err != nil || rec.Action != "gm-handoff" || rec.GM != "alice" || rec.Details["to"] != "carol" || rec.Details["connections"] != "1" {
+		t.Errorf("audit record %+v (%v)", rec, err)
+	}
+
+	// a GM who never said who they were has nobody to go back to being
+	anon := newTestClient(ms, "anon", "GM", true)
+	ms.ExecuteAction(testEvent(t, "HANDOFF dave"), anon)
+	if anon.IsGM() || !anon.ReachedEOF || anon.DisconnectReason() != DisconnectHandedOff {
+		t.Errorf("anonymous GM not dropped (reason %q)", anon.DisconnectReason())
+	}
+	if !dave.IsGM() || !carol.IsGM() || !bob.IsGM() {
+		t.Errorf("GMs are wrong after second hand-off")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
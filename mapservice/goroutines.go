@@ -0,0 +1,179 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                            Client Goroutine Accounting                             //
+//                                                                                    //
+// Keeps track of the goroutines serving each client connection so that any which     //
+// fail to exit after their client is gone can be detected and reported.              //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"expvar"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// Each client connection is served by a pair of goroutines: the reader
+// (HandleClientConnection) and the backgroundSender which feeds its
+// socket. Each registers itself here while it runs, so we can tell if
+// any of them outlive the client they were working for.
+//
+
+//
+// Goroutines still running this long after their client was removed
+// are reported as orphaned.
+//
+const GoroutineAuditGrace = 1 * time.Minute
+
+var clientGoroutineCount = expvar.NewInt("client_goroutines")
+var orphanedGoroutineCount = expvar.NewInt("orphaned_client_goroutines")
+
+//
+// GoroutineInfo describes a goroutine running on behalf of a client.
+//
+type GoroutineInfo struct {
+	ClientAddr string
+	Role       string    // "reader" or "sender"
+	Started    time.Time
+	Removed    time.Time // when the client was removed (zero if still connected)
+}
+
+type goroutineRegistry struct {
+	lock    sync.Mutex
+	nextID  int
+	running map[int]*GoroutineInfo
+}
+
+//
+// Register a goroutine as running for the given client. The returned
+// function must be called when the goroutine exits.
+//
+func (r *goroutineRegistry) track(clientAddr, role string) func() {
+	r.lock.Lock()
+	if r.running == nil {
+		r.running = make(map[int]*GoroutineInfo)
+	}
+	id := r.nextID
+	r.nextID++
+	r.running[id] = &GoroutineInfo{ClientAddr: clientAddr, Role: role, Started: time.Now()}
+	r.lock.Unlock()
+	clientGoroutineCount.Add(1)
+
+	return func() {
+		r.lock.Lock()
+		delete(r.running, id)
+		r.lock.Unlock()
+		clientGoroutineCount.Add(-1)
+	}
+}
+
+//
+// Note that a client has been removed from the service. Any of its
+// goroutines should be finishing up now.
+//
+func (r *goroutineRegistry) clientRemoved(clientAddr string) {
+	now := time.Now()
+	r.lock.Lock()
+	for _, g := range r.running {
+		if g.ClientAddr == clientAddr && g.Removed.IsZero() {
+			g.Removed = now
+		}
+	}
+	r.lock.Unlock()
+}
+
+func (r *goroutineRegistry) list() []GoroutineInfo {
+	r.lock.Lock()
+	l := make([]GoroutineInfo, 0, len(r.running))
+	for _, g := range r.running {
+		l = append(l, *g)
+	}
+	r.lock.Unlock()
+	sort.Slice(l, func(i, j int) bool { return l[i].Started.Before(l[j].Started) })
+	return l
+}
+
+//
+// ClientGoroutines returns a list of the goroutines currently running
+// on behalf of clients, oldest first.
+//
+func (ms *MapService) ClientGoroutines() []GoroutineInfo {
+	return ms.goroutines.list()
+}
+
+//
+// AuditGoroutines looks for client goroutines which are still running
+// long after their client was removed, logs them, and returns how many
+// were found.
+//
+func (ms *MapService) AuditGoroutines() int {
+	orphans := 0
+	for _, g := range ms.goroutines.list() {
+		if !g.Removed.IsZero() && time.Since(g.Removed) > GoroutineAuditGrace {
+			log.Printf("[client %s] WARNING: %s goroutine still running %v after client was removed",
+				g.ClientAddr, g.Role, time.Since(g.Removed).Round(time.Second))
+			orphans++
+		}
+	}
+	orphanedGoroutineCount.Set(int64(orphans))
+	return orphans
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,262 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                      Map Grid                                      //
+//                                                                                    //
+// The GM decides what kind of grid is drawn over the map, how far across each space  //
+// is, and where the grid lines start. The server keeps these settings (in the        //
+// database, if it has one) and tells each client about them as it connects, and      //
+// again whenever they change, so everyone sees the same grid.                        //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+)
+
+//
+// The shapes a map grid may have.
+//
+const (
+	GridSquare = "square"
+	GridHex    = "hex"
+)
+
+//
+// GridSettings describe the grid drawn over the map, so that all the
+// clients draw the same one.
+//
+type GridSettings struct {
+	Shape   string // GridSquare or GridHex
+	Scale   string // distance across each grid space (e.g., "5ft")
+	OffsetX int    // map x coordinate of the first grid line
+	OffsetY int    // map y coordinate of the first grid line
+}
+
+//
+// DefaultGridSettings is the grid we use until the GM says otherwise.
+//
+var DefaultGridSettings = GridSettings{Shape: GridSquare, Scale: "5ft"}
+
+//
+// ParseGridSettings makes sense of the fields of a GRID message
+// (<shape> <scale> <x-offset> <y-offset>).
+//
+func ParseGridSettings(fields []string) (GridSettings, error) {
+	if len(fields) != 4 {
+		return GridSettings{}, fmt.Errorf("Grid settings need a shape, scale, and x and y offsets")
+	}
+	g := GridSettings{Shape: fields[0], Scale: fields[1]}
+	if g.Shape != GridSquare && g.Shape != GridHex {
+		return GridSettings{}, fmt.Errorf("Grid shape \"%s\" not understood; must be %s or %s", g.Shape, GridSquare, GridHex)
+	}
+	if g.Scale == "" {
+		return GridSettings{}, fmt.Errorf("Grid scale may not be empty")
+	}
+	var err error
+	if g.OffsetX, err = strconv.Atoi(fields[2]); err != nil {
+		return GridSettings{}, fmt.Errorf("Grid x offset %s must be an integer", fields[2])
+	}
+	if g.OffsetY, err = strconv.Atoi(fields[3]); err != nil {
+		return GridSettings{}, fmt.Errorf("Grid y offset %s must be an integer", fields[3])
+	}
+	return g, nil
+}
+
+//
+// Message returns the GRID message which tells a client about the grid.
+//
+func (g GridSettings) Message() []string {
+	return []string{"GRID", g.Shape, g.Scale, strconv.Itoa(g.OffsetX), strconv.Itoa(g.OffsetY)}
+}
+
+//
+// GridStorage is implemented by storage backends which can keep the
+// grid settings.
+//
+type GridStorage interface {
+	LoadGridSettings() (GridSettings, bool, error)
+	SaveGridSettings(g GridSettings) error
+}
+
+//
+// Database Schema
+//  _______________
+// | grid          |
+// |---------------|
+// | id         Pi |
+// | shape       s |
+// | scale       s |
+// | xoffset     i |
+// | yoffset     i |
+// |_______________|
+//
+// P=primary key
+// i=integer
+// s=string
+//
+// There is only ever one row (with id 1). This table was added after
+// the others, so it is created whenever we open a database which doesn't
+// have it yet.
+//
+func createGridTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists grid (
+			id      integer primary key check (id = 1),
+			shape   text    not null,
+			scale   text    not null,
+			xoffset integer not null,
+			yoffset integer not null
+		);`)
+	return err
+}
+
+//
+// LoadGridSettings reads the grid settings from the database. It
+// returns false if none have been saved.
+//
+func LoadGridSettings(db *sql.DB) (GridSettings, bool, error) {
+	var g GridSettings
+	err := db.QueryRow(`select shape, scale, xoffset, yoffset from grid where id = 1`).Scan(&g.Shape, &g.Scale, &g.OffsetX, &g.OffsetY)
+	if err == sql.ErrNoRows {
+		return GridSettings{}, false, nil
+	}
+	if err != nil {
+		return GridSettings{}, false, fmt.Errorf("Unable to read grid settings: %v", err)
+	}
+	return g, true, nil
+}
+
+//
+// SaveGridSettings stores the grid settings, replacing the old ones.
+//
+func SaveGridSettings(db *sql.DB, g GridSettings) error {
+	if _, err := db.Exec(`insert or replace into grid (id, shape, scale, xoffset, yoffset) values (1, ?, ?, ?, ?)`,
+		g.Shape, g.Scale, g.OffsetX, g.OffsetY); err != nil {
+		return fmt.Errorf("Unable to save grid settings: %v", err)
+	}
+	return nil
+}
+
+//
+// gridSettings holds the current grid for the server.
+//
+type gridSettings struct {
+	lock     sync.Mutex
+	settings *GridSettings
+}
+
+func (s *gridSettings) get() GridSettings {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.settings == nil {
+		return DefaultGridSettings
+	}
+	return *s.settings
+}
+
+func (s *gridSettings) set(g GridSettings) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.settings = &g
+}
+
+//
+// Load the saved grid settings, if the storage backend keeps them.
+//
+func (ms *MapService) loadGridSettings() error {
+	storage, ok := ms.Storage.(GridStorage)
+	if !ok {
+		return nil
+	}
+	g, found, err := storage.LoadGridSettings()
+	if err != nil {
+		return err
+	}
+	if found {
+		ms.grid.set(g)
+	}
+	return nil
+}
+
+//
+// Tell a client what the grid looks like.
+//
+func (ms *MapService) sendGridSettings(thisClient *MapClient) {
+	thisClient.Send(ms.grid.get().Message()...)
+}
+
+//
+// Change the grid, saving it if we can, and tell everyone but the
+// client who changed it.
+//
+func (ms *MapService) changeGridSettings(thisClient *MapClient, g GridSettings) error {
+	if storage, ok := ms.Storage.(GridStorage); ok {
+		if err := storage.SaveGridSettings(g); err != nil {
+			return err
+		}
+	}
+	ms.grid.set(g)
+	log.Printf("[client %s] grid changed to %s %s offset (%d, %d)", thisClient.logTag(), g.Shape, g.Scale, g.OffsetX, g.OffsetY)
+	thisClient.SendToOthers(g.Message()...)
+	return nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,108 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for map grid settings
+//
+
+package mapservice
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseGridSettings(t *testing.T) {
+	for i, test := range []struct {
+		fields []string
+		grid   GridSettings
+		ok     bool
+	}{
+		{[]string{"square", "5ft", "0", "0"}, GridSettings{GridSquare, "5ft", 0, 0}, true},
+		{[]string{"hex", "10m", "25", "-12"}, GridSettings{GridHex, "10m", 25, -12}, true},
+		{[]string{"triangle", "5ft", "0", "0"}, GridSettings{}, false},
+		{[]string{"hex", "", "0", "0"}, GridSettings{}, false},
+		{[]string{"hex", "5ft", "x", "0"}, GridSettings{}, false},
+		{[]string{"hex", "5ft", "0"}, GridSettings{}, false},
+	} {
+		g, err := ParseGridSettings(test.fields)
+		if (err == nil) != test.ok || g != test.grid {
+			t.Errorf("test %d: got %v, %v", i, g, err)
+		}
+	}
+}
+
+func TestGridStorage(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", filepath.Join(t.TempDir(), "grid.db"))
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	gs, ok := storage.(GridStorage)
+	if !ok {
+		t.Fatalf("sqlite storage doesn't store grid settings")
+	}
+	if g, found, err := gs.LoadGridSettings(); found || err != nil {
+		t.Errorf("new database had grid settings %v, %v", g, err)
+	}
+	hex := GridSettings{GridHex, "10ft", 5, 7}
+	for _, g := range []GridSettings{DefaultGridSettings, hex} {
+		if err = gs.SaveGridSettings(g); err != nil {
+			t.Fatalf("unable to save grid settings: %v", err)
+		}
+	}
+	if g, found, err := gs.LoadGridSettings(); !found || err != nil || g != hex {
+		t.Errorf("loaded grid settings %v, %v, %v", g, found, err)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,241 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Object Groups                                    //
+//                                                                                    //
+// The GM may tie map objects together into groups (say, a door and the marker for    //
+// the trap on it). Moving, hiding, or removing a group's leader does the same to the //
+// rest of the group. Groups are kept in the game state like any other event, so they //
+// are saved with the game and sent to clients when they sync.                        //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+//
+// Group returns the IDs of the members of the group led by the given
+// object, if it leads one.
+//
+func (gs *GameState) Group(leader string) ([]string, bool) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	ev, ok := gs.EventHistory["GR:"+leader]
+	if !ok || len(ev.Fields) < 3 {
+		return nil, false
+	}
+	members, err := ParseTclList(ev.Fields[2])
+	if err != nil || len(members) == 0 {
+		return nil, false
+	}
+	return members, true
+}
+
+//
+// The pairs of attributes which give an object's location: map
+// coordinates for map elements and grid coordinates for creatures.
+//
+var groupLocationAttrs = [][2]string{{"X", "Y"}, {"GX", "GY"}}
+
+//
+// Shift a POINTS list by (dx, dy).
+//
+func shiftPoints(points string, dx, dy float64) (string, error) {
+	coords, err := ParseTclList(points)
+	if err != nil {
+		return "", err
+	}
+	for i := range coords {
+		v, err := strconv.ParseFloat(coords[i], 64)
+		if err != nil {
+			return "", fmt.Errorf("Point coordinate %s is not a number", coords[i])
+		}
+		if i%2 == 0 {
+			v += dx
+		} else {
+			v += dy
+		}
+		coords[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ToTclString(coords)
+}
+
+//
+// How far does an attribute list move an object, given its current
+// attributes? Returns false if it doesn't change this location attribute.
+//
+func attributeShift(current map[string]string, changes map[string]string, attr string) (float64, bool) {
+	value, changed := changes[attr]
+	if !changed {
+		return 0, false
+	}
+	to, err1 := strconv.ParseFloat(value, 64)
+	from, err2 := strconv.ParseFloat(current[attr], 64)
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	return to - from, true
+}
+
+//
+// Work out what happens to a group member when its leader's attributes
+// change as given: it moves by the same amount as the leader (if they
+// measure their location the same way), and is hidden or revealed with
+// it. Returns the member's changed attributes as an OA kvlist.
+//
+func groupMemberChanges(leader, member MapObject, changes map[string]string) []string {
+	var kvlist []string
+	for _, attrs := range groupLocationAttrs {
+		dx, xMoved := attributeShift(leader.Attrs, changes, attrs[0])
+		dy, yMoved := attributeShift(leader.Attrs, changes, attrs[1])
+		if !xMoved && !yMoved {
+			continue
+		}
+		for i, d := range []float64{dx, dy} {
+			if v, err := strconv.ParseFloat(member.Attrs[attrs[i]], 64); err == nil && d != 0 {
+				kvlist = append(kvlist, attrs[i], strconv.FormatFloat(v+d, 'f', -1, 64))
+			}
+		}
+		if points, ok := member.Attrs["POINTS"]; ok && attrs[0] == "X" && (dx != 0 || dy != 0) {
+			if shifted, err := shiftPoints(points, dx, dy); err == nil {
+				kvlist = append(kvlist, "POINTS", shifted)
+			}
+		}
+	}
+	if hidden, ok := changes["HIDDEN"]; ok && member.Attrs["HIDDEN"] != hidden {
+		kvlist = append(kvlist, "HIDDEN", hidden)
+	}
+	return kvlist
+}
+
+//
+// The leader of a group was moved, hidden, or revealed by the given OA
+// attribute list, so do the same to the rest of the group and tell
+// everyone about it. This must be called before the leader's own change
+// is applied to the game state.
+//
+func (ms *MapService) groupFollowsLeader(thisClient *MapClient, leader string, kvlist []string) {
+	members, ok := ms.State.Group(leader)
+	if !ok {
+		return
+	}
+	leaderObj, ok := ms.State.Object(leader)
+	if !ok {
+		return
+	}
+	changes := make(map[string]string)
+	for i := 0; i+1 < len(kvlist); i += 2 {
+		changes[kvlist[i]] = kvlist[i+1]
+	}
+	for _, id := range members {
+		member, ok := ms.State.Object(id)
+		if !ok || id == leader {
+			continue
+		}
+		member_changes := groupMemberChanges(leaderObj, member, changes)
+		if len(member_changes) == 0 {
+			continue
+		}
+		attrs, err := ToTclString(member_changes)
+		if err != nil {
+			log.Printf("[client %s] unable to update group member %s: %v", thisClient.logTag(), id, err)
+			continue
+		}
+		raw, err := ToTclString([]string{"OA", id, attrs})
+		if err != nil {
+			log.Printf("[client %s] unable to update group member %s: %v", thisClient.logTag(), id, err)
+			continue
+		}
+		ev, err := NewMapEvent(raw, id, member.Class)
+		if err != nil {
+			log.Printf("[client %s] unable to update group member %s: %v", thisClient.logTag(), id, err)
+			continue
+		}
+		ev.User = thisClient.Username()
+		ms.sendObjectToAll(ms.isGMObject(id), ev.Fields...)
+		ms.UpdateState(ev)
+	}
+}
+
+//
+// The leader of a group is being removed from the map, so remove the
+// rest of the group with it. This must be called before the leader is
+// removed from the game state.
+//
+func (ms *MapService) clearGroup(thisClient *MapClient, leader string) {
+	members, ok := ms.State.Group(leader)
+	if !ok {
+		return
+	}
+	log.Printf("[client %s] removing group %s (%s)", thisClient.logTag(), leader, strings.Join(members, ", "))
+	for _, id := range members {
+		if _, ok := ms.State.Object(id); ok && id != leader {
+			ms.clearObject(id)
+		}
+	}
+	for _, peer := range ms.Clients.Subscribers("GR") {
+		if !peer.WriteOnly {
+			peer.Send("GR", leader, "")
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,95 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for object groups
+//
+
+package mapservice
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestShiftPoints(t *testing.T) {
+	shifted, err := shiftPoints("10 20 30.5 40", 5, -10)
+	if err != nil || shifted != "15 10 35.5 30" {
+		t.Errorf("shifted points %q, %v", shifted, err)
+	}
+	if _, err := shiftPoints("10 x", 1, 1); err == nil {
+		t.Errorf("non-numeric point accepted")
+	}
+}
+
+func TestGroupMemberChanges(t *testing.T) {
+	door := MapObject{ID: "door", Class: "E", Attrs: map[string]string{"X": "100", "Y": "200"}}
+	for i, test := range []struct {
+		member  MapObject
+		changes map[string]string
+		kvlist  []string
+	}{
+		{MapObject{Attrs: map[string]string{"X": "110", "Y": "210"}}, map[string]string{"X": "150", "Y": "200"}, []string{"X", "160"}},
+		{MapObject{Attrs: map[string]string{"X": "110", "Y": "210", "POINTS": "120 230"}}, map[string]string{"X": "150", "Y": "190"},
+			[]string{"X", "160", "Y", "200", "POINTS", "170 220"}},
+		{MapObject{Attrs: map[string]string{"GX": "1", "GY": "2"}}, map[string]string{"X": "150"}, nil},
+		{MapObject{Attrs: map[string]string{"X": "110", "Y": "210"}}, map[string]string{"HIDDEN": "1"}, []string{"HIDDEN", "1"}},
+		{MapObject{Attrs: map[string]string{"X": "110", "HIDDEN": "1"}}, map[string]string{"HIDDEN": "1", "FILL": "red"}, nil},
+	} {
+		if d := cmp.Diff(test.kvlist, groupMemberChanges(door, test.member, test.changes)); d != "" {
+			t.Errorf("test %d: changes differ: %s", i, d)
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,3408 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Message Handlers                                  //
+//                                                                                    //
+// The set of handlers which act on each type of message received from clients, along //
+// with the table which maps message types to those handlers and describes the        //
+// privilege each requires and whether they affect the game state.                    //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// HandlerPrivilege indicates what level of authority a client needs
+// to have before the server will act on a given message type.
+//
+type HandlerPrivilege int
+
+const (
+	PrivAnyone HandlerPrivilege = iota	// any connected client
+	PrivGM								// only the GM
+)
+
+//
+// A MessageHandler describes how the server responds to a single type
+// of incoming client message.
+//
+// The Handle function performs the actual work. It returns true if the
+// event was successfully acted upon; if it returns false, the event will
+// not be recorded in the game state even if RecordsEvent is set (this is
+// how handlers reject malformed requests or ones which are only partially
+// complete, such as the individual lines of an LS sequence).
+//
+type MessageHandler struct {
+	Privilege		HandlerPrivilege	// who may send this message
+	RecordsEvent	bool				// successful events are added to the game state
+	Deduplicate		bool				// drop exact repeats from the same client (see DedupWindow)
+	ServerOnly		bool				// only the server sends this message; clients may not
+	Handle			func(ms *MapService, event *MapEvent, thisClient *MapClient) bool
+}
+
+var handlerLock sync.RWMutex
+var messageHandlers map[string]MessageHandler
+
+func init() {
+	relay := MessageHandler{Handle: handleRelay, Deduplicate: true}
+	relayAndRecord := MessageHandler{Handle: handleRelay, RecordsEvent: true, Deduplicate: true}
+	gmRelayAndRecord := MessageHandler{Handle: handleRelay, RecordsEvent: true, Privilege: PrivGM, Deduplicate: true}
+	forbidden := MessageHandler{Handle: handleForbidden, ServerOnly: true}
+
+	messageHandlers = map[string]MessageHandler{
+		"//":     relay,
+		"/CONN":  {Handle: handleConnQuery},
+		"AC":     forbidden,
+		"ACCEPT": {Handle: handleAccept},
+		"AI":     {Handle: handleImageStart},
+		"AI:":    {Handle: handleImageData},
+		"AI.":    {Handle: handleImageEnd},
+		"AIB":    {Handle: handleBinaryImage},
+		"AI?":    {Handle: handleImageQuery},
+		"AI@":    {Handle: handleImageLocation},
+		"AUTH":   {Handle: handleLateAuth},
+		"AV":     {Handle: handleAdjustView, RecordsEvent: true},
+		"CAPS":   forbidden,
+		"CAPS:":  forbidden,
+		"CAPS.":  forbidden,
+		"CC":     {Handle: handleClearChat},
+		"CK":     {Handle: handleMakeCheckpoint, Privilege: PrivGM},
+		"CK=":    forbidden,
+		"CK:":    forbidden,
+		"CK.":    forbidden,
+		"CK?":    {Handle: handleListCheckpoints, Privilege: PrivGM},
+		"CK-":    {Handle: handleDeleteCheckpoint, Privilege: PrivGM},
+		"CLR":    {Handle: handleClear, RecordsEvent: true},
+		"CLR@":   relayAndRecord,
+		"CO":     {Handle: handleTurnChange, Privilege: PrivGM},
+		"CONN":   forbidden,
+		"CONN:":  forbidden,
+		"CONN.":  forbidden,
+		"CS":     {Handle: handleRelayToFeed, Privilege: PrivGM},
+		"CT":     {Handle: handleSaveCreatureTemplate, Privilege: PrivGM},
+		"CT=":    forbidden,
+		"CT:":    forbidden,
+		"CT.":    forbidden,
+		"CT?":    {Handle: handleListCreatureTemplates, Privilege: PrivGM},
+		"CT-":    {Handle: handleDeleteCreatureTemplate, Privilege: PrivGM},
+		"D":      {Handle: handleDieRoll},
+		"D?":     {Handle: handlePreviewDieRoll},
+		"DB":     {Handle: handleBulkDieRoll},
+		"DD":     {Handle: handleDefineDicePresets},
+		"DD+":    {Handle: handleAddDicePresets},
+		"DD/":    {Handle: handleFilterDicePresets},
+		"DENIED": forbidden,
+		"DF":     {Handle: handleFudgeDieRoll, Privilege: PrivGM},
+		"DI":     {Handle: handleImportStart},
+		"DI:":    {Handle: handleImportData},
+		"DI.":    {Handle: handleImportEnd},
+		"DI!":    forbidden,
+		"DO?":    {Handle: handleRollOdds},
+		"DO=":    forbidden,
+		"DO!":    forbidden,
+		"DQ":     {Handle: handleSetDrawingQuota, Privilege: PrivGM},
+		"DQ?":    {Handle: handleDrawingUsage, Privilege: PrivGM},
+		"DQ-":    {Handle: handleRemoveDrawings},
+		"DR":     {Handle: handleRequestDicePresets},
+		"DSM":    gmRelayAndRecord,
+		"DU?":    {Handle: handlePresetUsage},
+		"DU=":    forbidden,
+		"DU:":    forbidden,
+		"DU.":    forbidden,
+		"DX":     {Handle: handleExportDicePresets},
+		"DX=":    forbidden,
+		"DX:":    forbidden,
+		"DX.":    forbidden,
+		"ED":     {Handle: handleDeployEncounter, Privilege: PrivGM},
+		"EN":     {Handle: handleSaveEncounter, Privilege: PrivGM},
+		"EN=":    forbidden,
+		"EN:":    forbidden,
+		"EN.":    forbidden,
+		"EN?":    {Handle: handleListEncounters, Privilege: PrivGM},
+		"EN-":    {Handle: handleDeleteEncounter, Privilege: PrivGM},
+		"EXPORT": {Handle: handleExportMap, Privilege: PrivGM},
+		"FM":     {Handle: handleFollowMe, Privilege: PrivGM},
+		"FMO":    {Handle: handleFollowOptOut},
+		"GR":     {Handle: handleGroup, Privilege: PrivGM, RecordsEvent: true},
+		"GRANTED": forbidden,
+		"FX":     {Handle: handleAmbientEffects, Privilege: PrivGM},
+		"FX?":    {Handle: handleQueryAmbientEffects},
+		"GRID":   {Handle: handleGrid, Privilege: PrivGM},
+		"GRID?":  {Handle: handleQueryGrid},
+		"HANDOFF": {Handle: handleHandOffGM, Privilege: PrivGM},
+		"I":      {Handle: handleTurnChange, Privilege: PrivGM},
+		"IL":     {Handle: handleRelayToFeed, Privilege: PrivGM},
+		"INVITE": {Handle: handleInvite, Privilege: PrivGM},
+		"INVITE=": forbidden,
+		"IR":     {Handle: handleRollInitiative, Privilege: PrivGM},
+		"L":      relay,
+		"LOS?":   {Handle: handleLineOfSight},
+		"LOS=":   forbidden,
+		"LOS!":   forbidden,
+		"LT":     {Handle: handlePlaceLight, Privilege: PrivGM},
+		"LT-":    {Handle: handleRemoveLight, Privilege: PrivGM},
+		"LT?":    {Handle: handleListLights},
+		"LT=":    forbidden,
+		"LT:":    forbidden,
+		"LT.":    forbidden,
+		"LS":     {Handle: handleLoadStart},
+		"LS:":    {Handle: handleLoadData},
+		"LS.":    {Handle: handleLoadEnd},
+		"M":      relay,
+		"M?":     relayAndRecord,
+		"M@":     relayAndRecord,
+		"NAK":    {Handle: handleRetransmitRequest},
+		"MARCO":  {Handle: handleIgnored},
+		"MARK":   {Handle: handleMark},
+		"MARK-":  forbidden,
+		"MARK?":  {Handle: handleRecentMarks},
+		"MV":     {Handle: handleReserveMove},
+		"MV+":    forbidden,
+		"MV-":    forbidden,
+		"MV.":    {Handle: handleEndMovementRound, Privilege: PrivGM},
+		"NO":     {Handle: handleWriteOnly},
+		"NO+":    {Handle: handleWriteOnly},
+		"NOTIFY": {Handle: handleSetNotifyURL},
+		"NOTIFY?": {Handle: handleQueryNotifyURL},
+		"NOTIFY-": {Handle: handleSetNotifyURL},
+		"NT":     {Handle: handleSaveNote},
+		"NT=":    forbidden,
+		"NT:":    forbidden,
+		"NT.":    forbidden,
+		"NT?":    {Handle: handleListNotes},
+		"NT-":    {Handle: handleDeleteNote},
+		"OA":     {Handle: handleObjectAttributes, RecordsEvent: true, Deduplicate: true},
+		"OA+":    {Handle: handleObjectAttributeList, RecordsEvent: true},
+		"OA-":    {Handle: handleObjectAttributeList, RecordsEvent: true},
+		"OK":     forbidden,
+		"OR":     {Handle: handleOpposedRoll},
+		"OR?":    forbidden,
+		"ORR":    forbidden,
+		"POLL":   {Handle: handleOpenPoll},
+		"POLL+":  forbidden,
+		"POLL-":  {Handle: handleClosePoll},
+		"POLL.":  forbidden,
+		"POLO":   {Handle: handlePolo},
+		"PRIV":   forbidden,
+		"PS":     {Handle: handlePlaceSomeone, RecordsEvent: true},
+		"PST":    {Handle: handlePlaceFromTemplate, Privilege: PrivGM},
+		"RA":     {Handle: handleReadyAction, RecordsEvent: true},
+		"RA-":    {Handle: handleEndReadiedAction, RecordsEvent: true},
+		"RB":     {Handle: handleRollback, Privilege: PrivGM},
+		"RG":     {Handle: handleDefineRegion, Privilege: PrivGM},
+		"RG-":    {Handle: handleDeleteRegion, Privilege: PrivGM},
+		"RG=":    forbidden,
+		"RG:":    forbidden,
+		"RG.":    forbidden,
+		"RG?":    {Handle: handleListRegions},
+		"RGV":    {Handle: handleRevealRegion, Privilege: PrivGM},
+		"ROLL":   forbidden,
+		"SCENE":  {Handle: handleDeployScene, Privilege: PrivGM},
+		"SEQ":    {Handle: handleSequenceNumbers},
+		"SESS-":  {Handle: handleDropOtherSessions},
+		"SH":     {Handle: handleSaveCharacterSheet},
+		"SH!":    forbidden,
+		"SH=":    forbidden,
+		"SH:":    forbidden,
+		"SH.":    forbidden,
+		"SH?":    {Handle: handleListCharacterSheets},
+		"SH-":    {Handle: handleDeleteCharacterSheet},
+		"SYNC":   {Handle: handleSync},
+		"TB":     gmRelayAndRecord,
+		"TIME":   forbidden,
+		"TK":     {Handle: handleIssueAPIToken, Privilege: PrivGM},
+		"TK+":    forbidden,
+		"TK=":    forbidden,
+		"TK:":    forbidden,
+		"TK.":    forbidden,
+		"TK?":    {Handle: handleListAPITokens, Privilege: PrivGM},
+		"TK-":    {Handle: handleRevokeAPIToken, Privilege: PrivGM},
+		"TO":     {Handle: handleChatMessage},
+		"VOTE":   {Handle: handleVote},
+		"VOTE+":  forbidden,
+		"VOTE-":  forbidden,
+		"XP":     {Handle: handleAward, Privilege: PrivGM},
+		"XP=":    forbidden,
+		"XP:":    forbidden,
+		"XP.":    forbidden,
+		"XP?":    {Handle: handleQueryLedger},
+	}
+}
+
+//
+// RegisterMessageHandler installs a handler for a message type, replacing
+// any existing handler for that type. The minParams and maxParams values
+// give the number of parameters the message must have (maxParams < 0
+// allows any number). This should be called before the service starts
+// accepting client connections.
+//
+func RegisterMessageHandler(msgType string, minParams, maxParams int, h MessageHandler) {
+	registerEventType(msgType, minParams, maxParams)
+	handlerLock.Lock()
+	messageHandlers[msgType] = h
+	handlerLock.Unlock()
+}
+
+func lookupMessageHandler(msgType string) (MessageHandler, bool) {
+	handlerLock.RLock()
+	h, ok := messageHandlers[msgType]
+	handlerLock.RUnlock()
+	return h, ok
+}
+
+//
+// MARCO
+//
+// Effectively a no-op. Ignore completely.
+//
+func handleIgnored(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	return false
+}
+
+//
+// POLO
+//
+// Also a no-op, but we're interested in how long it's been since
+// we received an answer to our keep-alive pings, so we'll record
+// this (and how long it took, to pace what we send; see pacer).
+//
+func handlePolo(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.LastPolo = time.Now().Unix()
+	thisClient.pace.gotPolo(time.Now())
+	return false
+}
+
+//
+// Events not allowed to clients
+//
+func handleForbidden(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.Send("//", "Clients not allowed to send this command", event.EventType())
+	return false
+}
+
+//
+// Events simply relayed to all other clients (some of which
+// are restricted to the GM only; see the handler table)
+//
+func handleRelay(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.SendToOthers(event.Fields...)
+	return true
+}
+
+//
+// CS <absolute> <relative>
+// IL <slotlist>
+//
+// (GM only) Set the game clock or the initiative order. These are
+// relayed and recorded like other GM messages, and also put on the
+// public event feed for stream overlays.
+//
+func handleRelayToFeed(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.SendToOthers(event.Fields...)
+	ms.UpdateState(event)
+	ms.feedStateChange(event)
+	return false
+}
+
+//
+// AV <x> <y>
+//
+// Adjust the map view to show the given location. Normally this is just
+// relayed to the other clients, but while the GM has follow-me mode on
+// (see FM), only the GM's view adjustments are passed along (to those
+// who haven't opted out with FMO), and the players' are dropped.
+//
+func handleAdjustView(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if !ms.following.get() {
+		thisClient.SendToOthers(event.Fields...)
+		return true
+	}
+	if !thisClient.IsGM() {
+		log.Printf("[client %s] AV from %s dropped (follow-me mode is on)", thisClient.logTag(), thisClient.Username())
+		return false
+	}
+	ms.sendViewToFollowers(thisClient, event.Fields...)
+	return true
+}
+
+//
+// FM <state>
+//
+// (GM only) Turn follow-me mode on (1) or off (0). Everyone is sent the
+// FM message too, and clients which connect while it's on are sent FM 1.
+//
+func handleFollowMe(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	on := parseOnOff(event.Fields[1])
+	ms.following.set(on)
+	if on {
+		log.Printf("[client %s] follow-me mode on", thisClient.logTag())
+	} else {
+		log.Printf("[client %s] follow-me mode off", thisClient.logTag())
+	}
+	thisClient.SendToOthers("FM", onOff(on))
+	return false
+}
+
+//
+// FMO <state>
+//
+// This client does (1) or doesn't (0) want to opt out of having its
+// view follow the GM's.
+//
+func handleFollowOptOut(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.setFollowOptOut(parseOnOff(event.Fields[1]))
+	return false
+}
+
+//
+// GR <leader> <members>
+//
+// (GM only) Tie the objects whose IDs are listed in <members> to the
+// object <leader>, so that when the leader is moved, hidden, revealed,
+// or removed, the members are too. An empty <members> list breaks up
+// the group.
+//
+func handleGroup(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	members, err := ParseTclList(event.Fields[2])
+	if err != nil {
+		thisClient.sendError("group member list not understood: %v", err)
+		return false
+	}
+	for _, id := range members {
+		if id == event.Fields[1] {
+			thisClient.sendError("%s can't be a member of its own group", id)
+			return false
+		}
+	}
+	if len(members) == 0 {
+		log.Printf("[client %s] group %s broken up", thisClient.logTag(), event.Fields[1])
+	} else {
+		log.Printf("[client %s] group %s has members %s", thisClient.logTag(), event.Fields[1], strings.Join(members, ", "))
+	}
+	ms.sendObjectToOthers(thisClient, ms.isGMObject(event.Fields[1]), event.Fields...)
+	return true
+}
+
+//
+// GRID <shape> <scale> <x-offset> <y-offset>
+//
+// (GM only) Change the grid drawn over the map. <shape> is square or
+// hex, <scale> is the distance across each grid space (e.g., 5ft), and
+// the offsets give the map coordinates where the grid lines start. The
+// new settings are saved and sent to everyone.
+//
+func handleGrid(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	g, err := ParseGridSettings(event.Fields[1:])
+	if err == nil {
+		err = ms.changeGridSettings(thisClient, g)
+	}
+	if err != nil {
+		thisClient.sendError("grid not changed: %v", err)
+		return false
+	}
+	thisClient.Send("//", "Grid changed.")
+	return false
+}
+
+//
+// GRID?
+//
+// Ask what the grid looks like. We reply with a GRID message. (Each
+// client is sent one when it connects anyway.)
+//
+func handleQueryGrid(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	ms.sendGridSettings(thisClient)
+	return false
+}
+
+//
+// FX <rain> <fog> <darkness>
+//
+// (GM only) Change the weather and light over the whole map. Each is a
+// level from 0 (none) to MaxEffectLevel. The new effects are saved and
+// sent to everyone, and saved with the map when the GM exports it (see
+// EXPORT).
+//
+func handleAmbientEffects(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	e, err := ParseAmbientEffects(event.Fields[1:])
+	if err == nil {
+		err = ms.changeAmbientEffects(thisClient, e)
+	}
+	if err != nil {
+		thisClient.sendError("ambient effects not changed: %v", err)
+		return false
+	}
+	log.Printf("[client %s] ambient effects changed to rain %d, fog %d, darkness %d", thisClient.logTag(), e.Rain, e.Fog, e.Darkness)
+	thisClient.Send("//", "Ambient effects changed.")
+	return false
+}
+
+//
+// FX?
+//
+// Ask what the weather and light are. We reply with an FX message.
+// (Each client is sent one when it connects anyway.)
+//
+func handleQueryAmbientEffects(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	ms.sendAmbientEffects(thisClient)
+	return false
+}
+
+//
+// CO <state>
+// I <time> <id>
+//
+// (GM only) Combat mode is switched on or off, or it is someone else's
+// turn. We relay and record these as usual, then let anyone whose
+// messages were held for their turn go ahead. If the turn belongs to a
+// player who is away from the keyboard, the GM is warned.
+//
+func handleTurnChange(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if event.EventType() == "I" {
+		ms.broadcastServerTime()
+	}
+	thisClient.SendToOthers(event.Fields...)
+	ms.UpdateState(event)
+	ms.publishTurnChange(event)
+	ms.feedStateChange(event)
+	if event.EventType() == "I" {
+		ms.readiedActionsForTurn(event.Fields[2])
+		ms.warnAFKTurn(event.Fields[2])
+	} else if !ms.State.CombatActive() {
+		ms.expireReadiedActions()
+	}
+	ms.releaseHeldMessages()
+	return false
+}
+
+//
+// RA <id> <creature> delay|ready <trigger> [<description>]
+//
+// The creature is delaying its turn until after <trigger> has gone,
+// or has readied an action to take during <trigger>'s turn. Players may
+// only do this for their own creatures. We keep it until it is taken or
+// called off (see RA-), or the creature's next turn comes up.
+//
+func handleReadyAction(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if event.Fields[3] != ActionDelayed && event.Fields[3] != ActionReadied {
+		thisClient.sendError("action type \"%s\" not understood; must be %s or %s", event.Fields[3], ActionDelayed, ActionReadied)
+		return false
+	}
+	if !thisClient.IsGM() && !ms.State.mayActFor(thisClient.Username(), event.Fields[2]) {
+		thisClient.sendError("you can't hold an action for %s", event.Fields[2])
+		return false
+	}
+	log.Printf("[client %s] %s action %s for %s declared (trigger %s)", thisClient.logTag(), event.Fields[3], event.Fields[1], event.Fields[2], event.Fields[4])
+	thisClient.SendToOthers(event.Fields...)
+	return true
+}
+
+//
+// RA- <id> <reason>
+//
+// A delayed or readied action was taken (<reason> is usually "fired")
+// or called off ("cancelled").
+//
+func handleEndReadiedAction(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	for _, action := range ms.State.ReadiedActions() {
+		if action.ID != event.Fields[1] {
+			continue
+		}
+		if !thisClient.IsGM() && !ms.State.mayActFor(thisClient.Username(), action.Creature) {
+			thisClient.sendError("you can't end the held action for %s", action.Creature)
+			return false
+		}
+		log.Printf("[client %s] %s action %s for %s %s", thisClient.logTag(), action.Kind, action.ID, action.Creature, event.Fields[2])
+		thisClient.SendToOthers(event.Fields...)
+		return true
+	}
+	thisClient.sendError("there is no held action %s", event.Fields[1])
+	return false
+}
+
+//
+// ACCEPT <message set>
+//
+// Restrict messages to this client to include only those in the set,
+// unless <message set> is *, in which case accept all messages.
+//
+func handleAccept(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if event.Fields[1] == "*" {
+		thisClient.AcceptedList = nil
+	} else {
+		allowed, err := ParseTclList(event.Fields[1])
+		if err != nil {
+			log.Printf("[client %s] Error understanding ACCEPT command: %v", thisClient.logTag(), err)
+		} else {
+			thisClient.AcceptedList = allowed
+		}
+	}
+	ms.Clients.Reindex()
+	log.Printf("[client %s] accepting %v", thisClient.logTag(), thisClient.AcceptedList)
+	return true
+}
+
+//
+// AI? <name> <size>
+//
+// Client requests definition of the given image by name and size.
+// If we know, we'll send an AI@ event to answer the question directly.
+// Otherwise, we'll forward on the question to the other clients to answer.
+//
+func handleImageQuery(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	server_location, ok := ms.State.ImageLocation(event.Fields[1], event.Fields[2])
+	if ok {
+		thisClient.Send("AI@", event.Fields[1], event.Fields[2], server_location)
+	} else {
+		thisClient.SendToOthers(event.Fields...)
+	}
+	return true
+}
+
+//
+// AI@ <name> <size> <server_id>
+//
+// Declare that the image with the given <name> and <size>
+// may be found at the given <server_id>. If we receive this,
+// we remember that location so we can use it to answer subsequent
+// queries for that image.
+//
+func handleImageLocation(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	ms.State.SetImageLocation(event.Fields[1], event.Fields[2], event.Fields[3])
+	thisClient.SendToOthers(event.Fields...)
+	return true
+}
+
+//
+// AI <name> <zoom>
+// AI: <data> [<seq>]
+// AI. <count> <checksum>
+//
+// Upload an image as a series of base64-encoded lines. We collect
+// the whole set and validate it before passing it on to the other
+// clients.
+//
+func handleImageStart(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.beginTransfer(event)
+	return false
+}
+
+func handleImageData(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.transferChunk(event)
+	return false
+}
+
+func handleImageEnd(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	transfer := thisClient.finishTransfer(event)
+	if transfer == nil {
+		return false
+	}
+	name, zoom := transfer.Header.Fields[1], transfer.Header.Fields[2]
+	var binary_sent map[string]bool
+	if image, err := base64.StdEncoding.DecodeString(strings.Join(transfer.Chunks, "")); err == nil {
+		binary_sent = relayBinaryImage(ms, thisClient, name, zoom, image)
+	}
+	relayImageLines(ms, thisClient, name, zoom, transfer.Chunks, binary_sent)
+	return true
+}
+
+//
+// AIB <name> <zoom> <length> <checksum>
+// <binary frame of <length> bytes>
+//
+// Upload an image as a binary frame rather than as a series of
+// base64-encoded AI: lines. <checksum> is the base64-encoded SHA-256
+// digest of the image data. The frame is relayed as-is to clients
+// which have said they ACCEPT AIB; everyone else gets the traditional
+// AI/AI:/AI. sequence.
+//
+func handleBinaryImage(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	length, err := strconv.Atoi(event.Fields[3])
+	if err != nil {
+		// we have no way to find where the frame ends, so we can't go on
+		log.Printf("[client %s] AIB frame length not understood: %v; dropping connection", thisClient.logTag(), err)
+		thisClient.setDisconnectReason(DisconnectProtocol)
+		thisClient.Close()
+		return false
+	}
+	image, err := thisClient.readFrame(length)
+	if err != nil {
+		if too_big, ok := err.(*MessageTooLargeError); ok {
+			log.Printf("[client %s] Rejected AIB upload of %s: %v", thisClient.logTag(), event.Fields[1], too_big)
+			thisClient.sendError("image %s was not accepted: %v", event.Fields[1], too_big)
+			return false
+		}
+		log.Printf("[client %s] Error reading AIB frame: %v; dropping connection", thisClient.logTag(), err)
+		thisClient.setDisconnectReason(DisconnectProtocol)
+		thisClient.Close()
+		return false
+	}
+	cksum := sha256.Sum256(image)
+	if base64.StdEncoding.EncodeToString(cksum[:]) != event.Fields[4] {
+		log.Printf("[client %s] AIB checksum mismatch for %s (upload not accepted)", thisClient.logTag(), event.Fields[1])
+		thisClient.sendError("image %s was not accepted: checksum mismatch", event.Fields[1])
+		return false
+	}
+	relayImage(ms, thisClient, event.Fields[1], event.Fields[2], image)
+	return true
+}
+
+//
+// Number of base64 characters per AI: line when we have to send an
+// image to a client the old-fashioned way.
+//
+const legacyImageLineLength = 4096
+
+func relayImage(ms *MapService, thisClient *MapClient, name, zoom string, image []byte) {
+	var lines []string
+	encoded := base64.StdEncoding.EncodeToString(image)
+	for len(encoded) > 0 {
+		n := legacyImageLineLength
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		lines = append(lines, encoded[:n])
+		encoded = encoded[n:]
+	}
+	relayImageLines(ms, thisClient, name, zoom, lines, relayBinaryImage(ms, thisClient, name, zoom, image))
+}
+
+//
+// Send an image as an AIB frame to the clients who asked for them.
+// Returns the set of client addresses we sent it to.
+//
+func relayBinaryImage(ms *MapService, thisClient *MapClient, name, zoom string, image []byte) map[string]bool {
+	binary_sent := make(map[string]bool)
+	cksum := sha256.Sum256(image)
+	frame, err := packageFrame(image, "AIB", name, zoom, strconv.Itoa(len(image)),
+		base64.StdEncoding.EncodeToString(cksum[:]))
+	if err != nil {
+		log.Printf("[client %s] Internal error packaging AIB frame: %v", thisClient.logTag(), err)
+		return binary_sent
+	}
+	for _, peer := range ms.Clients.Subscribed("AIB") {
+		if peer.ClientAddr != thisClient.ClientAddr {
+			peer.SendRaw(frame)
+			binary_sent[peer.ClientAddr] = true
+		}
+	}
+	return binary_sent
+}
+
+//
+// Send an image as an AI/AI:/AI. sequence to everyone except the
+// sender and those in the skip set.
+//
+func relayImageLines(ms *MapService, thisClient *MapClient, name, zoom string, lines []string, skip map[string]bool) {
+	for _, peer := range ms.AllClients() {
+		if peer.ClientAddr == thisClient.ClientAddr || skip[peer.ClientAddr] {
+			continue
+		}
+		transfer := peer.startTransfer("AI", "AI", name, zoom)
+		for _, line := range lines {
+			transfer.Send(line)
+		}
+		transfer.Finish()
+	}
+}
+
+//
+// AUTH <response> [<user> [<client>]]
+// It's a bit late for this one to arrive now.
+//
+func handleLateAuth(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.Send("//", "AUTH command after authentication step ignored.")
+	return true
+}
+
+//
+// SESS-
+//
+// Disconnect the user's other sessions, as when they've been told
+// they're logged in from somewhere they aren't.
+//
+func handleDropOtherSessions(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if !thisClient.Authenticated || thisClient.Auth == nil {
+		thisClient.sendError("this server doesn't know who you are, so it can't tell which sessions are yours")
+		return false
+	}
+	n := ms.dropOtherSessions(thisClient)
+	thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
+		fmt.Sprintf("Disconnected %d other session%s.", n, plural(n)),
+		NextMessageID())
+	return false
+}
+
+//
+// HANDOFF <user>
+//
+// (GM only) Give the GM's role to <user>, who must be connected, for
+// the rest of their session. The sender (and their other connections
+// as the same GM) stop being the GM. Clients whose role changes are
+// sent GRANTED with their new username, followed by the game state
+// as they may now see it.
+//
+func handleHandOffGM(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	rec := AuditRecord{
+		User:   thisClient.Username(),
+		GM:     thisClient.GMName(),
+		Client: thisClient.ClientAddr,
+		Action: "gm-handoff",
+	}
+	n, err := ms.handOffGM(thisClient, event.Fields[1])
+	if err != nil {
+		thisClient.sendError("GM's role not handed over: %v", err)
+		return false
+	}
+	rec.Time = time.Now()
+	rec.Details = map[string]string{"to": strings.ToLower(event.Fields[1]), "connections": strconv.Itoa(n)}
+	ms.recordAudit(rec)
+	return false
+}
+
+//
+// INVITE <user> [<lifetime>]
+//
+// (GM only) Invite <user> to join the game, making up a password for
+// them which lasts for <lifetime> (a Go duration, 12h if not given).
+// We reply with
+//   INVITE= <user> <join-link> <qr-link> <expires>
+// where <join-link> is a gma: URL with everything their client needs
+// to log in, <qr-link> is where the HTTP API shows it as a QR code (or
+// empty if there's no HTTP API), and <expires> is when the invitation
+// runs out, in Unix time.
+//
+func handleInvite(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	lifetime := DefaultInviteLifetime
+	if len(event.Fields) > 2 {
+		var err error
+		if lifetime, err = time.ParseDuration(event.Fields[2]); err != nil {
+			thisClient.sendError("invitation lifetime \"%s\" not understood: %v", event.Fields[2], err)
+			return false
+		}
+	}
+	inv, err := ms.inviteUser(event.Fields[1], lifetime)
+	if err != nil {
+		thisClient.sendError("nobody invited: %v", err)
+		return false
+	}
+	link, err := ms.joinURL(inv)
+	if err != nil {
+		thisClient.sendError("unable to make a join link: %v", err)
+		return false
+	}
+	ms.audit(thisClient, "invite-issue", map[string]string{"user": inv.User, "expires": inv.Expires.Format(time.RFC3339)})
+	thisClient.Send("INVITE=", inv.User, link, ms.joinQRURL(inv), strconv.FormatInt(inv.Expires.Unix(), 10))
+	return false
+}
+
+//
+// CC [*|<user> [<target> [<messageID>]]]
+//
+// Clear the chat history
+//  <user> is the name of the user (if not "") who initiated this action
+//  <target> is "" or (if >=0) the minimum message ID to remain after the clear,
+//  or (if < 0) indicates that -<target> most recent messages should be kept.
+//  <messageID> will be reassigned by the server here.
+//
+func handleClearChat(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	// fill out missing fields with default values
+	if len(event.Fields) < 2 { event.Fields = append(event.Fields, "*") }
+	if len(event.Fields) < 3 { event.Fields = append(event.Fields, "")  }
+	if len(event.Fields) < 4 { event.Fields = append(event.Fields, "0") }
+
+	if err := ms.clearChat(event.Fields[2]); err != nil {
+		thisClient.Send("//", fmt.Sprintf("CC command rejected; %v", err))
+		return false
+	}
+	defer ms.order.hold(ChatStream)()
+	ms.addChatMessage(event)
+
+	// Now forward the CC command out to all our peers
+	thisClient.SendToOthers(event.Fields...)
+	return true
+}
+
+//
+// CLR <id>
+//
+// Delete all objects matching <id> from clients. <id> may be:
+//	*						all objects
+//  E*						all map elements
+//	M*						all monsters
+// 	P*						all players
+//  [<imagename>=]<name>	creature with the given <name>
+//  <id>					object with ID <id>
+//
+// If <id> leads a group, the rest of the group goes with it.
+//
+func handleClear(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if target, _, _ := ms.State.ResolveObject(event.Fields[1]); target != "" {
+		ms.clearGroup(thisClient, target)
+	}
+	ms.State.ClearObjects(event.Fields[1])
+
+	// Now forward the CLR command out to all our peers
+	thisClient.SendToOthers(event.Fields...)
+	return true
+}
+
+//
+// D <recipients> <die-expression> [<preset>]
+//
+// Roll the dice described by <die-expression> and then transmit the
+// result to the people in <recipients>. The latter may include
+// the following special recipients:
+//   @  send back to the client requesting this die-roll.
+//   *  send to all connected clients
+//   %  send privately to the GM, and ONLY the GM, regardless of any
+//      other values in <recipients>.
+// If the roll is one of the user's die-roll presets, the client may
+// give its name as <preset> so we can count it (see DU?).
+//
+func handleDieRoll(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if !ms.checkRollRate(thisClient, 1) {
+		return false
+	}
+	//
+	// If the GM has already decided how this roll comes out,
+	// the dice will show what the GM said they would.
+	//
+	fudge := ms.fudges.take(thisClient.Username(), event.Fields[2])
+	real_random := thisClient.dice.Random
+	if fudge != nil {
+		thisClient.dice.Random = &fudgedRandomSource{faces: fudge.Faces, fallback: real_random}
+	}
+	title, results, err := thisClient.dice.DoRoll(event.Fields[2])
+	thisClient.dice.Random = real_random
+	if err != nil {
+		if fudge != nil {
+			ms.fudges.set(fudge)
+		}
+		thisClient.sendError("die roll request not accepted: %v", err)
+		return false
+	}
+	if fudge != nil {
+		ms.audit(thisClient, "fudge-used", map[string]string{
+			"spec":    event.Fields[2],
+			"faces":   fudgeFaces(fudge.Faces),
+			"set_by":  fudge.SetBy,
+			"results": fudgeResults(results),
+		})
+	}
+	to_all := false
+	to_gm := false
+	to_list, err := ParseTclList(event.Fields[1])
+	if err != nil {
+		thisClient.sendError("die roll recipient list not understood: %v", err)
+		return false
+	}
+	for _, recipient := range to_list {
+		switch recipient {
+			case "*":
+				to_all = true
+			case "%":
+				to_gm = true
+		}
+	}
+	preset := ""
+	if len(event.Fields) > 3 {
+		preset = event.Fields[3]
+	}
+	ms.countPresetUse(thisClient.Username(), preset, event.Fields[2])
+
+	defer ms.order.hold(ChatStream)()
+	for _, result := range results {
+		formatted_detail_list, err := formatRollDetails(result)
+		if err != nil {
+			log.Printf("Internal error formatting ROLL response: %v", err)
+			return false
+		}
+		//
+		// Create a chat channel event containing the die roll result
+		//
+		response_event, err := NewMapEventFromList("", []string{"ROLL", thisClient.Username(),
+			event.Fields[1], title, strconv.Itoa(result.Result), formatted_detail_list,
+			""}, "", "")
+		if err != nil {
+			log.Printf("Internal error creating ROLL event: %v", err)
+			return false
+		}
+		//
+		// Add to the history of chat messages
+		//
+		ms.addChatMessage(response_event)
+		//
+		// A fudged roll looks like any other to the players, but
+		// the GM's copy says what was done.
+		//
+		gm_event := response_event
+		if fudge != nil {
+			flagged := result
+			flagged.Details = append(append([]StructuredDescription(nil), result.Details...),
+				StructuredDescription{Type: "fudged", Value: fudgeFaces(fudge.Faces)})
+			if formatted_detail_list, err = formatRollDetails(flagged); err != nil {
+				log.Printf("Internal error formatting ROLL response: %v", err)
+				return false
+			}
+			if gm_event, err = NewMapEventFromList("", []string{"ROLL", thisClient.Username(),
+				event.Fields[1], title, strconv.Itoa(result.Result), formatted_detail_list,
+				""}, "", ""); err != nil {
+				log.Printf("Internal error creating ROLL event: %v", err)
+				return false
+			}
+			gm_event.Fields = append(gm_event.Fields[:6], response_event.Fields[6:]...) // same ID and time
+		}
+		sendRoll := func(peer *MapClient) {
+			if peer.Username() == "GM" {
+				peer.Send(gm_event.Fields...)
+			} else {
+				peer.Send(response_event.Fields...)
+			}
+		}
+		//
+		// Send to recipients
+		//
+		if to_gm {
+			//
+			// ONLY to the GM's client(s)
+			//
+			for _, peer := range ms.Clients.ByUser("GM") {
+				if !peer.WriteOnly {
+					sendRoll(peer)
+				}
+			}
+			if thisClient.Username() != "GM" && !thisClient.WriteOnly {
+				ack_event, err := NewMapEventFromList("", []string{"ROLL",
+					thisClient.Username(), event.Fields[1], title, "*",
+					"{comment {Results sent to GM}}", ""}, "", "")
+				if err != nil {
+					log.Printf("Internal error creating ROLL ack event: %v", err)
+					return false
+				}
+				ack_event.AssignMessageID()
+				thisClient.Send(ack_event.Fields...)
+			}
+		} else {
+			//
+			// Send results openly to all (listed) peers 
+			//
+			var recipients []*MapClient
+			if to_all {
+				recipients = ms.Clients.All()
+			} else {
+				recipients = ms.Clients.ByUsers(to_list)
+			}
+			for _, peer := range recipients {
+				if !peer.WriteOnly && peer.Authenticated && peer.ClientAddr != thisClient.ClientAddr {
+					sendRoll(peer)
+				}
+			}
+			if !thisClient.WriteOnly {
+				sendRoll(thisClient)
+			}
+			if to_all {
+				ms.feedDieRoll(thisClient.Username(), title, result)
+				if naturalTwenty(result.Details) {
+					ms.EventBus.Publish(PublishCritical, map[string]string{"from": thisClient.Username(), "title": title, "result": strconv.Itoa(result.Result)})
+				}
+			}
+		}
+	}
+	return true
+}
+
+//
+// IR <names> [<tiebreak>]
+//
+// (GM only) Roll initiative for each of the named creatures, using their
+// stored initiative modifiers. The resulting initiative order is sent
+// to everyone as an IL message and recorded as the current one. The GM
+// is also told what everyone rolled. <tiebreak> may be modifier (the
+// default), reroll, or name.
+//
+func handleRollInitiative(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	names, err := ParseTclList(event.Fields[1])
+	if err != nil {
+		thisClient.sendError("creature list not understood: %v", err)
+		return false
+	}
+	tiebreak := ""
+	if len(event.Fields) > 2 {
+		tiebreak = event.Fields[2]
+	}
+	var random RandomSource
+	if thisClient.dice != nil {
+		random = thisClient.dice.Random
+	}
+	rolls, err := RollInitiative(ms.State, names, tiebreak, random)
+	if err != nil {
+		thisClient.sendError("initiative not rolled: %v", err)
+		return false
+	}
+	slots, err := InitiativeSlotList(rolls)
+	if err != nil {
+		log.Printf("Internal error creating IL slot list: %v", err)
+		return false
+	}
+	order, err := NewMapEventFromList("", []string{"IL", slots}, "", "")
+	if err != nil {
+		log.Printf("Internal error creating IL event: %v", err)
+		return false
+	}
+	ms.UpdateState(order)
+	ms.feedStateChange(order)
+	thisClient.SendToOthers(order.Fields...)
+	if !thisClient.WriteOnly {
+		thisClient.Send(order.Fields...)
+		for _, roll := range rolls {
+			thisClient.Send("//", fmt.Sprintf("Initiative for %s: %d (rolled %d%+d)", roll.Name, roll.Total, roll.Roll, roll.Modifier))
+		}
+	}
+	return false
+}
+
+//
+// Get the storage backend's encounter support, or tell the client
+// there isn't any.
+//
+func encounterStorage(ms *MapService, thisClient *MapClient) (EncounterStorage, bool) {
+	if storage, ok := ms.Storage.(EncounterStorage); ok {
+		return storage, true
+	}
+	thisClient.sendError("encounters can't be stored without a database")
+	return nil, false
+}
+
+//
+// EN <name> <cr> <notes> <creatures>
+//
+// (GM only) Store an encounter for later use, replacing any existing one
+// with the same name. <creatures> is a list of
+//   {<name> <count> <color> <area> <size> <reach> [<attrs>]}
+//
+func handleSaveEncounter(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := encounterStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	creatures, err := ParseEncounterCreatures(event.Fields[4])
+	if err == nil {
+		err = storage.SaveEncounter(Encounter{Name: event.Fields[1], CR: event.Fields[2], Notes: event.Fields[3], Creatures: creatures})
+	}
+	if err != nil {
+		thisClient.sendError("encounter %s not saved: %v", event.Fields[1], err)
+		return false
+	}
+	thisClient.Send("//", fmt.Sprintf("Encounter %s saved.", event.Fields[1]))
+	return false
+}
+
+//
+// EN? [<name>]
+//
+// (GM only) Ask for the stored encounters (or just the named one). We reply
+// with
+//   EN=
+//   EN: <name> <cr> <notes> <creatures>
+//   ...
+//   EN. <count> <checksum>
+//
+func handleListEncounters(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := encounterStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	var encounters []Encounter
+	var err error
+	if len(event.Fields) > 1 {
+		var enc Encounter
+		if enc, ok, err = storage.LoadEncounter(event.Fields[1]); ok {
+			encounters = append(encounters, enc)
+		}
+	} else {
+		encounters, err = storage.ListEncounters()
+	}
+	if err != nil {
+		thisClient.sendError("unable to read encounters: %v", err)
+		return false
+	}
+	transfer := thisClient.startTransfer("EN", "EN=")
+	for _, enc := range encounters {
+		creatures, err := enc.creatureList()
+		if err != nil {
+			log.Printf("Internal error formatting EN: response: %v", err)
+			return false
+		}
+		transfer.Send(enc.Name, enc.CR, enc.Notes, creatures)
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// EN- <name>
+//
+// (GM only) Delete a stored encounter.
+//
+func handleDeleteEncounter(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := encounterStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	found, err := storage.DeleteEncounter(event.Fields[1])
+	if err != nil {
+		thisClient.sendError("encounter %s not deleted: %v", event.Fields[1], err)
+	} else if !found {
+		thisClient.Send("//", fmt.Sprintf("There is no encounter called %s.", event.Fields[1]))
+	} else {
+		thisClient.Send("//", fmt.Sprintf("Encounter %s deleted.", event.Fields[1]))
+	}
+	return false
+}
+
+//
+// Get the storage backend's note support for an authenticated user,
+// or tell the client why they can't have it.
+//
+func noteStorage(ms *MapService, thisClient *MapClient) (NoteStorage, bool) {
+	if !thisClient.Authenticated || thisClient.Auth == nil {
+		log.Printf("[client %s] note request failed: no username authenticated for user", thisClient.logTag())
+		return nil, false
+	}
+	if storage, ok := ms.Storage.(NoteStorage); ok {
+		return storage, true
+	}
+	thisClient.sendError("notes can't be stored without a database")
+	return nil, false
+}
+
+//
+// NT <title> <text>
+//
+// Store a private note for the user, replacing any existing one of theirs
+// with the same title.
+//
+func handleSaveNote(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := noteStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	if event.Fields[1] == "" {
+		thisClient.sendError("notes must have a title")
+		return false
+	}
+	if err := storage.SaveNote(thisClient.Username(), Note{Title: event.Fields[1], Text: event.Fields[2], Modified: time.Now()}); err != nil {
+		thisClient.sendError("note %s not saved: %v", event.Fields[1], err)
+		return false
+	}
+	thisClient.Send("//", fmt.Sprintf("Note %s saved.", event.Fields[1]))
+	return false
+}
+
+//
+// NT? [<title>]
+//
+// Ask for the user's notes (or just the one with the given title). We
+// reply with
+//   NT=
+//   NT: <title> <modified> <text>
+//   ...
+//   NT. <count> <checksum>
+// where <modified> is the time the note was last saved, in seconds
+// since the epoch.
+//
+func handleListNotes(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := noteStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	var notes []Note
+	var err error
+	if len(event.Fields) > 1 {
+		var note Note
+		if note, ok, err = storage.LoadNote(thisClient.Username(), event.Fields[1]); ok {
+			notes = append(notes, note)
+		}
+	} else {
+		notes, err = storage.ListNotes(thisClient.Username())
+	}
+	if err != nil {
+		thisClient.sendError("unable to read notes: %v", err)
+		return false
+	}
+	transfer := thisClient.startTransfer("NT", "NT=")
+	for _, note := range notes {
+		transfer.Send(note.Title, strconv.FormatInt(note.Modified.Unix(), 10), note.Text)
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// NT- <title>
+//
+// Delete one of the user's notes.
+//
+func handleDeleteNote(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := noteStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	found, err := storage.DeleteNote(thisClient.Username(), event.Fields[1])
+	if err != nil {
+		thisClient.sendError("note %s not deleted: %v", event.Fields[1], err)
+	} else if !found {
+		thisClient.Send("//", fmt.Sprintf("There is no note called %s.", event.Fields[1]))
+	} else {
+		thisClient.Send("//", fmt.Sprintf("Note %s deleted.", event.Fields[1]))
+	}
+	return false
+}
+
+//
+// Get the storage backend's ledger support, or tell the client
+// there isn't any.
+//
+func ledgerStorage(ms *MapService, thisClient *MapClient) (LedgerStorage, bool) {
+	if storage, ok := ms.Storage.(LedgerStorage); ok {
+		return storage, true
+	}
+	thisClient.sendError("the XP and treasure ledger can't be kept without a database")
+	return nil, false
+}
+
+//
+// XP <users> <xp> <gp> <reason>
+//
+// (GM only) Award each of the players in the list <users> the given
+// experience points and treasure (valued in gold pieces). Either amount
+// may be 0, or negative to correct an earlier award. Each award is
+// recorded in the ledger and the players who are connected are told
+// about it.
+//
+func handleAward(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := ledgerStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	users, err := ParseTclList(event.Fields[1])
+	if err == nil && len(users) == 0 {
+		err = fmt.Errorf("no players named")
+	}
+	var xp, gp int
+	if err == nil {
+		if xp, err = strconv.Atoi(event.Fields[2]); err != nil {
+			err = fmt.Errorf("XP value %s must be an integer", event.Fields[2])
+		} else if gp, err = strconv.Atoi(event.Fields[3]); err != nil {
+			err = fmt.Errorf("treasure value %s must be an integer", event.Fields[3])
+		}
+	}
+	if err == nil {
+		var awards []Award
+		now := time.Now()
+		for _, user := range users {
+			awards = append(awards, Award{Time: now, User: user, AwardedBy: thisClient.Username(), XP: xp, GP: gp, Reason: event.Fields[4]})
+		}
+		err = storage.AddAwards(awards)
+	}
+	if err != nil {
+		thisClient.sendError("award not made: %v", err)
+		return false
+	}
+
+	ms.audit(thisClient, "award", map[string]string{
+		"users":  event.Fields[1],
+		"xp":     event.Fields[2],
+		"gp":     event.Fields[3],
+		"reason": event.Fields[4],
+	})
+	for _, peer := range ms.Clients.ByUsers(users) {
+		if !peer.WriteOnly && peer.ClientAddr != thisClient.ClientAddr {
+			peer.Send("TO", thisClient.Username(), peer.Username(),
+				fmt.Sprintf("You have been awarded %d XP and %d gp: %s", xp, gp, event.Fields[4]),
+				NextMessageID())
+		}
+	}
+	thisClient.Send("//", fmt.Sprintf("Awarded %d XP and %d gp to %d players.", xp, gp, len(users)))
+	return false
+}
+
+//
+// XP? [<user>]
+//
+// Ask for the awards in the ledger. Players only see their own; the GM
+// sees everyone's (or just those of the named user). We reply with
+//   XP=
+//   XP: <time> <user> <xp> <gp> <reason> <awarded-by> <total-xp> <total-gp>
+//   ...
+//   XP. <count> <checksum>
+// where <time> is in seconds since the epoch and the totals are the
+// player's running totals including that award.
+//
+func handleQueryLedger(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := ledgerStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	user := thisClient.Username()
+	if thisClient.IsGM() {
+		user = ""
+		if len(event.Fields) > 1 {
+			user = event.Fields[1]
+		}
+	}
+	awards, err := storage.LoadAwards(user)
+	if err != nil {
+		thisClient.sendError("unable to read the ledger: %v", err)
+		return false
+	}
+	transfer := thisClient.startTransfer("XP", "XP=")
+	for _, e := range RunningTotals(awards) {
+		transfer.Send(strconv.FormatInt(e.Time.Unix(), 10), e.User, strconv.Itoa(e.XP), strconv.Itoa(e.GP),
+			e.Reason, e.AwardedBy, strconv.Itoa(e.TotalXP), strconv.Itoa(e.TotalGP))
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// EXPORT <name> [<comment>]
+//
+// (GM only) Save everything on the map now as a .map file called
+// <name> (with ".map" added if it isn't there already) in the server's
+// map export directory, replacing any existing file of that name.
+// The regions of the map (see RG) are saved beside it, in a file with
+// RegionFileSuffix in place of ".map", as are the ambient effects (see
+// FX) with EffectsFileSuffix.
+//
+func handleExportMap(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	comment := "Exported from the game server"
+	if len(event.Fields) > 2 {
+		comment = event.Fields[2]
+	}
+	path, count, regions, err := ms.exportMap(event.Fields[1], comment)
+	if err != nil {
+		thisClient.sendError("map not exported: %v", err)
+		return false
+	}
+	ms.audit(thisClient, "map-export", map[string]string{
+		"file":    path,
+		"objects": strconv.Itoa(count),
+		"regions": strconv.Itoa(regions),
+	})
+	if regions > 0 {
+		thisClient.Send("//", fmt.Sprintf("Map exported to %s (%d objects, %d regions).", filepath.Base(path), count, regions))
+	} else {
+		thisClient.Send("//", fmt.Sprintf("Map exported to %s (%d objects).", filepath.Base(path), count))
+	}
+	return false
+}
+
+//
+// SCENE <name>
+//
+// (GM only) Put everything in the .map file <name> (with ".map" added
+// if it isn't there already) in the server's map export directory onto
+// everyone's map, sending them the images its tiles need first if
+// they're stored there too (as they are for maps imported from
+// Universal VTT files). Players aren't sent anything on the GM's own
+// layers. Any regions exported with the map (see RG) are defined
+// again, replacing those with the same IDs, and the ambient effects
+// (see FX) become those exported with it (or none if there weren't
+// any).
+//
+func handleDeployScene(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	objects, images, regions, err := ms.deployScene(event.Fields[1])
+	if err != nil {
+		thisClient.sendError("scene not deployed: %v", err)
+		return false
+	}
+	ms.audit(thisClient, "scene-deploy", map[string]string{
+		"scene":   event.Fields[1],
+		"objects": strconv.Itoa(objects),
+		"images":  strconv.Itoa(images),
+		"regions": strconv.Itoa(regions),
+	})
+	if regions > 0 {
+		thisClient.Send("//", fmt.Sprintf("Scene %s deployed (%d objects, %d images, %d regions).", event.Fields[1], objects, images, regions))
+	} else {
+		thisClient.Send("//", fmt.Sprintf("Scene %s deployed (%d objects, %d images).", event.Fields[1], objects, images))
+	}
+	return false
+}
+
+//
+// TK <name> <scope> [<rate-limit>]
+//
+// (GM only) Issue an API token to <name> for use with the HTTP API.
+// <scope> is read, chat, or admin, and <rate-limit> is the most requests
+// per minute it may make (default 0, for no limit). We reply with
+//   TK+ <id> <token>
+// This is the only time the token itself is ever shown.
+//
+func handleIssueAPIToken(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	rateLimit := 0
+	var err error
+	if len(event.Fields) > 3 {
+		if rateLimit, err = strconv.Atoi(event.Fields[3]); err != nil {
+			err = fmt.Errorf("rate limit %s must be an integer", event.Fields[3])
+		}
+	}
+	var t APIToken
+	var token string
+	if err == nil {
+		t, token, err = ms.issueAPIToken(event.Fields[1], event.Fields[2], rateLimit)
+	}
+	if err != nil {
+		thisClient.sendError("API token not issued: %v", err)
+		return false
+	}
+	ms.audit(thisClient, "api-token-issue", map[string]string{
+		"id":    t.ID,
+		"name":  t.Name,
+		"scope": t.Scope,
+	})
+	thisClient.Send("TK+", t.ID, token)
+	return false
+}
+
+//
+// TK?
+//
+// (GM only) Ask for the API tokens which have been issued. We reply with
+//   TK=
+//   TK: <id> <name> <scope> <rate-limit> <created> <last-used> <revoked>
+//   ...
+//   TK. <count> <checksum>
+// where the times are in seconds since the epoch (<last-used> is 0 if
+// the token was never used) and <revoked> is 1 if the token is revoked.
+//
+func handleListAPITokens(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := ms.Storage.(TokenStorage)
+	if !ok {
+		thisClient.sendError("API tokens can't be stored without a database")
+		return false
+	}
+	tokens, err := storage.ListAPITokens()
+	if err != nil {
+		thisClient.sendError("unable to read API tokens: %v", err)
+		return false
+	}
+	transfer := thisClient.startTransfer("TK", "TK=")
+	for _, t := range tokens {
+		transfer.Send(t.Fields()...)
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// TK- <id>
+//
+// (GM only) Revoke an API token so it can't be used any more.
+//
+func handleRevokeAPIToken(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := ms.Storage.(TokenStorage)
+	if !ok {
+		thisClient.sendError("API tokens can't be stored without a database")
+		return false
+	}
+	found, err := storage.RevokeAPIToken(event.Fields[1])
+	if err != nil {
+		thisClient.sendError("API token %s not revoked: %v", event.Fields[1], err)
+	} else if !found {
+		thisClient.Send("//", fmt.Sprintf("There is no API token %s.", event.Fields[1]))
+	} else {
+		ms.audit(thisClient, "api-token-revoke", map[string]string{"id": event.Fields[1]})
+		thisClient.Send("//", fmt.Sprintf("API token %s revoked.", event.Fields[1]))
+	}
+	return false
+}
+
+//
+// Get the storage backend's support for notification webhooks, or
+// tell the client why they can't have one.
+//
+func notifyStorage(ms *MapService, thisClient *MapClient) (NotifyStorage, bool) {
+	if !thisClient.Authenticated || thisClient.Auth == nil {
+		log.Printf("[client %s] notification request failed: no username authenticated for user", thisClient.logTag())
+		return nil, false
+	}
+	if !ms.NotifyWebhooks {
+		thisClient.sendError("this server doesn't send notifications")
+		return nil, false
+	}
+	if storage, ok := ms.Storage.(NotifyStorage); ok {
+		return storage, true
+	}
+	thisClient.sendError("notification webhooks can't be stored without a database")
+	return nil, false
+}
+
+//
+// NOTIFY <url>
+// NOTIFY-
+//
+// Have the server POST a notification to the given webhook whenever
+// someone sends the user a message (or mentions them as @<user> in a
+// message to everyone) while they aren't connected; or stop doing so.
+//
+func handleSetNotifyURL(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := notifyStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	webhook := ""
+	if event.EventType() == "NOTIFY" {
+		webhook = event.Fields[1]
+		if err := CheckNotifyURL(webhook); err != nil {
+			thisClient.sendError("webhook %s not accepted: %v", webhook, err)
+			return false
+		}
+	}
+	if err := storage.SetNotifyURL(thisClient.Username(), webhook); err != nil {
+		thisClient.sendError("%v", err)
+		return false
+	}
+	if webhook == "" {
+		thisClient.Send("//", "You will no longer be notified while offline.")
+	} else {
+		thisClient.Send("//", fmt.Sprintf("While offline, you will be notified through %s.", webhook))
+	}
+	return false
+}
+
+//
+// NOTIFY?
+//
+// Ask where the user's notifications are sent.
+//
+func handleQueryNotifyURL(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := notifyStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	webhook, found, err := storage.NotifyURL(thisClient.Username())
+	if err != nil {
+		thisClient.sendError("unable to look up your webhook: %v", err)
+	} else if !found {
+		thisClient.Send("//", "You are not notified while offline.")
+	} else {
+		thisClient.Send("//", fmt.Sprintf("While offline, you will be notified through %s.", webhook))
+	}
+	return false
+}
+
+//
+// Get the storage backend's character sheet support for an authenticated
+// user, or tell the client why they can't have it.
+//
+func characterSheetStorage(ms *MapService, thisClient *MapClient) (CharacterSheetStorage, bool) {
+	if !thisClient.Authenticated || thisClient.Auth == nil {
+		log.Printf("[client %s] character sheet request failed: no username authenticated for user", thisClient.logTag())
+		return nil, false
+	}
+	if storage, ok := ms.Storage.(CharacterSheetStorage); ok {
+		return storage, true
+	}
+	thisClient.sendError("character sheets can't be stored without a database")
+	return nil, false
+}
+
+//
+// SH <name> <base-version> <json>
+//
+// Save a character sheet. A new sheet (whose <base-version> must be 0)
+// belongs to the user; otherwise only its owner or the GM may change
+// it, and <base-version> must be the version they changed (so nobody
+// unknowingly overwrites someone else's change). The owner and GM
+// are told of the change by
+//   SH! <name> <version> <owner> <modified-by>
+//
+func handleSaveCharacterSheet(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := characterSheetStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	base, err := strconv.Atoi(event.Fields[2])
+	if err != nil || base < 0 {
+		thisClient.sendError("character sheet version %s is not valid", event.Fields[2])
+		return false
+	}
+	sheet, err := ms.saveCharacterSheet(storage, thisClient.Username(), thisClient.IsGM(), thisClient.Username(), event.Fields[1], base, []byte(event.Fields[3]))
+	if err != nil {
+		thisClient.sendError("%v", err)
+		return false
+	}
+	thisClient.Send("//", fmt.Sprintf("Character sheet %s saved as version %d.", sheet.Name, sheet.Version))
+	return false
+}
+
+//
+// SH? [<name>]
+//
+// Ask for the character sheets the user may see (their own, or all
+// of them for the GM), or just the named one with its document. We
+// reply with
+//   SH=
+//   SH: <name> <owner> <version> <modified> <modified-by> [<json>]
+//   ...
+//   SH. <count> <checksum>
+// where <modified> is the time the sheet was last saved, in seconds
+// since the epoch.
+//
+func handleListCharacterSheets(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := characterSheetStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	var sheets []CharacterSheet
+	var err error
+	if len(event.Fields) > 1 {
+		var sheet CharacterSheet
+		if sheet, ok, err = storage.LoadCharacterSheet(event.Fields[1]); ok {
+			sheets = append(sheets, sheet)
+		}
+	} else {
+		sheets, err = storage.ListCharacterSheets()
+	}
+	if err != nil {
+		thisClient.sendError("unable to read character sheets: %v", err)
+		return false
+	}
+	transfer := thisClient.startTransfer("SH", "SH=")
+	for _, sheet := range sheets {
+		if !sheet.Allows(thisClient.Username(), thisClient.IsGM()) {
+			continue
+		}
+		fields := []string{sheet.Name, sheet.Owner, strconv.Itoa(sheet.Version), strconv.FormatInt(sheet.Modified.Unix(), 10), sheet.ModifiedBy}
+		if sheet.Document != nil {
+			fields = append(fields, string(sheet.Document))
+		}
+		transfer.Send(fields...)
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// SH- <name>
+//
+// Delete a character sheet (which must be the user's own, unless they
+// are the GM). The owner and GM are told by
+//   SH! <name> - <owner> <deleted-by>
+//
+func handleDeleteCharacterSheet(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := characterSheetStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	found, err := ms.deleteCharacterSheet(storage, thisClient.Username(), thisClient.IsGM(), event.Fields[1])
+	if err != nil {
+		thisClient.sendError("character sheet %s not deleted: %v", event.Fields[1], err)
+	} else if !found {
+		thisClient.Send("//", fmt.Sprintf("There is no character sheet called %s.", event.Fields[1]))
+	} else {
+		thisClient.Send("//", fmt.Sprintf("Character sheet %s deleted.", event.Fields[1]))
+	}
+	return false
+}
+
+//
+// ED <name> <x> <y>
+//
+// (GM only) Put the creatures from a stored encounter onto the map as new
+// tokens, in a row starting at grid location (<x>, <y>). Everyone is
+// sent the PS and OA messages for the new creatures.
+//
+func handleDeployEncounter(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := encounterStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	x, err1 := strconv.Atoi(event.Fields[2])
+	y, err2 := strconv.Atoi(event.Fields[3])
+	if err1 != nil || err2 != nil {
+		thisClient.sendError("encounter location (%s, %s) must be integer grid coordinates", event.Fields[2], event.Fields[3])
+		return false
+	}
+	enc, found, err := storage.LoadEncounter(event.Fields[1])
+	if err == nil && !found {
+		err = fmt.Errorf("There is no encounter called %s", event.Fields[1])
+	}
+	if err != nil {
+		thisClient.sendError("encounter not deployed: %v", err)
+		return false
+	}
+	events, err := ms.State.DeployEncounter(enc, x, y)
+	deployed := 0
+	for _, ev := range events {
+		if ev.EventType() == "PS" {
+			deployed++
+		}
+		for _, peer := range ms.Clients.Subscribers(ev.EventType()) {
+			if !peer.WriteOnly {
+				peer.Send(ev.Fields...)
+			}
+		}
+	}
+	if err != nil {
+		thisClient.sendError("encounter %s only partly deployed: %v", enc.Name, err)
+		return false
+	}
+	log.Printf("[client %s] deployed encounter %s (%d creature%s)", thisClient.logTag(), enc.Name, deployed, plural(deployed))
+	return false
+}
+
+//
+// Get the storage backend's creature template support, or tell the
+// client there isn't any.
+//
+func creatureTemplateStorage(ms *MapService, thisClient *MapClient) (CreatureTemplateStorage, bool) {
+	if storage, ok := ms.Storage.(CreatureTemplateStorage); ok {
+		return storage, true
+	}
+	thisClient.sendError("creature templates can't be stored without a database")
+	return nil, false
+}
+
+//
+// CT <name> <image> <size> <color> <area> <reach> <type> <attrs>
+//
+// (GM only) Store a creature template, replacing any existing one with
+// the same name. <type> is monster or player; <attrs> is a list of other
+// attribute names and values to give each creature made from it.
+//
+func handleSaveCreatureTemplate(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := creatureTemplateStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	tmpl := CreatureTemplate{
+		Name:  event.Fields[1],
+		Image: event.Fields[2],
+		Size:  event.Fields[3],
+		Color: event.Fields[4],
+		Area:  event.Fields[5],
+		Reach: event.Fields[6],
+		Type:  event.Fields[7],
+		Attrs: event.Fields[8],
+	}
+	err := tmpl.check()
+	if err == nil {
+		err = storage.SaveCreatureTemplate(tmpl)
+	}
+	if err != nil {
+		thisClient.sendError("creature template %s not saved: %v", tmpl.Name, err)
+		return false
+	}
+	thisClient.Send("//", fmt.Sprintf("Creature template %s saved.", tmpl.Name))
+	return false
+}
+
+//
+// CT? [<name>]
+//
+// (GM only) Ask for the creature templates in the library (or just the
+// named one). We reply with
+//   CT=
+//   CT: <name> <image> <size> <color> <area> <reach> <type> <attrs>
+//   ...
+//   CT. <count> <checksum>
+//
+func handleListCreatureTemplates(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := creatureTemplateStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	var templates []CreatureTemplate
+	var err error
+	if len(event.Fields) > 1 {
+		var tmpl CreatureTemplate
+		if tmpl, ok, err = storage.LoadCreatureTemplate(event.Fields[1]); ok {
+			templates = append(templates, tmpl)
+		}
+	} else {
+		templates, err = storage.ListCreatureTemplates()
+	}
+	if err != nil {
+		thisClient.sendError("unable to read creature templates: %v", err)
+		return false
+	}
+	transfer := thisClient.startTransfer("CT", "CT=")
+	for _, t := range templates {
+		transfer.Send(t.Name, t.Image, t.Size, t.Color, t.Area, t.Reach, t.Type, t.Attrs)
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// CT- <name>
+//
+// (GM only) Delete a creature template from the library.
+//
+func handleDeleteCreatureTemplate(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := creatureTemplateStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	found, err := storage.DeleteCreatureTemplate(event.Fields[1])
+	if err != nil {
+		thisClient.sendError("creature template %s not deleted: %v", event.Fields[1], err)
+	} else if !found {
+		thisClient.Send("//", fmt.Sprintf("There is no creature template called %s.", event.Fields[1]))
+	} else {
+		thisClient.Send("//", fmt.Sprintf("Creature template %s deleted.", event.Fields[1]))
+	}
+	return false
+}
+
+//
+// PST <template> <x> <y> [<name> [<id>]]
+//
+// (GM only) Put a new creature on the map at grid location (<x>, <y>)
+// made from a creature template. If <name> is omitted or empty, the
+// template's name is used. If <id> is omitted or empty, a new one is
+// made up. Everyone is sent the PS (and OA) messages for it.
+//
+func handlePlaceFromTemplate(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	storage, ok := creatureTemplateStorage(ms, thisClient)
+	if !ok {
+		return false
+	}
+	x, err1 := strconv.Atoi(event.Fields[2])
+	y, err2 := strconv.Atoi(event.Fields[3])
+	if err1 != nil || err2 != nil {
+		thisClient.sendError("creature location (%s, %s) must be integer grid coordinates", event.Fields[2], event.Fields[3])
+		return false
+	}
+	var name, id string
+	if len(event.Fields) > 4 {
+		name = event.Fields[4]
+	}
+	if len(event.Fields) > 5 {
+		id = event.Fields[5]
+	}
+	tmpl, found, err := storage.LoadCreatureTemplate(event.Fields[1])
+	if err == nil && !found {
+		err = fmt.Errorf("There is no creature template called %s", event.Fields[1])
+	}
+	var events []*MapEvent
+	if err == nil {
+		events, err = ms.State.PlaceFromTemplate(tmpl, name, id, x, y)
+	}
+	for _, ev := range events {
+		for _, peer := range ms.Clients.Subscribers(ev.EventType()) {
+			if !peer.WriteOnly {
+				peer.Send(ev.Fields...)
+			}
+		}
+	}
+	if err != nil {
+		thisClient.sendError("creature not placed from template: %v", err)
+	}
+	return false
+}
+
+//
+// DF <user> <spec> <faces>
+//
+// (GM only) Decide how the dice will come up the next time <user>
+// rolls <spec>. Either may be "*" to mean anyone or any spec. <faces>
+// lists what each die will show, in the order they are rolled. An
+// empty list cancels an earlier DF for the same user and spec.
+// Every DF is written to the audit log.
+//
+func handleFudgeDieRoll(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	face_list, err := ParseTclList(event.Fields[3])
+	if err != nil {
+		thisClient.sendError("die roll faces not understood: %v", err)
+		return false
+	}
+	var faces []int
+	for _, f := range face_list {
+		face, err := strconv.Atoi(f)
+		if err != nil || face < 1 {
+			thisClient.sendError("die roll face \"%s\" must be a positive integer", f)
+			return false
+		}
+		faces = append(faces, face)
+	}
+
+	fudge := &DieRollFudge{
+		User:  event.Fields[1],
+		Spec:  strings.TrimSpace(event.Fields[2]),
+		Faces: faces,
+		SetBy: thisClient.Username(),
+		Set:   time.Now(),
+	}
+	if fudge.User == "" {
+		fudge.User = "*"
+	}
+	if fudge.Spec == "" {
+		fudge.Spec = "*"
+	}
+	old := ms.fudges.set(fudge)
+	details := map[string]string{
+		"player": fudge.User,
+		"spec":   fudge.Spec,
+		"faces":  fudgeFaces(faces),
+	}
+	if old != nil {
+		details["replaced"] = fudgeFaces(old.Faces)
+	}
+	if len(faces) == 0 {
+		ms.audit(thisClient, "fudge-cancel", details)
+		if old == nil {
+			thisClient.Send("//", fmt.Sprintf("No die roll for %s was waiting to be fudged.", fudge.User))
+		} else {
+			thisClient.Send("//", fmt.Sprintf("The next die roll for %s will be left to chance.", fudge.User))
+		}
+	} else {
+		ms.audit(thisClient, "fudge-set", details)
+		thisClient.Send("//", fmt.Sprintf("The next die roll for %s (%s) will show %s.", fudge.User, fudge.Spec, fudgeFaces(faces)))
+	}
+	return false
+}
+
+//
+// Describe fudged faces or die roll results for the GM and the audit log.
+//
+func fudgeFaces(faces []int) string {
+	var s []string
+	for _, f := range faces {
+		s = append(s, strconv.Itoa(f))
+	}
+	return strings.Join(s, " ")
+}
+
+func fudgeResults(results []StructuredResult) string {
+	var totals []int
+	for _, r := range results {
+		totals = append(totals, r.Result)
+	}
+	return fudgeFaces(totals)
+}
+
+//
+// OR <id> <opponent> <spec> [<opponent-spec> [<tiebreak>]]
+//
+// Start an opposed roll between this user and <opponent>. If the
+// opponent's spec is given (say, the GM is rolling for an NPC), we
+// roll both sides right away. Otherwise we send the opponent
+//   OR? <id> <challenger>
+// and wait for them to answer with
+//   OR <id> <challenger> <spec>
+// Either way, the outcome is sent to everyone as an ORR message.
+// <tiebreak> may be defender (the default), challenger, reroll, or none.
+//
+func handleOpposedRoll(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if !ms.checkRollRate(thisClient, 1) {
+		return false
+	}
+	if contest := ms.opposedRolls.take(event.Fields[2], thisClient.Username(), event.Fields[1]); contest != nil {
+		contest.OpponentSpec = event.Fields[3]
+		return resolveOpposedRoll(ms, contest, thisClient)
+	}
+
+	contest := &OpposedRoll{
+		ID:             event.Fields[1],
+		Challenger:     thisClient.Username(),
+		Opponent:       event.Fields[2],
+		ChallengerSpec: event.Fields[3],
+		Started:        time.Now(),
+		Limits:         ms.DiceLimits,
+		Attributes:     ms.State,
+	}
+	if len(event.Fields) > 4 {
+		contest.OpponentSpec = event.Fields[4]
+	}
+	var err error
+	if len(event.Fields) > 5 {
+		contest.TieBreak, err = checkTieBreak(event.Fields[5])
+	} else {
+		contest.TieBreak, err = checkTieBreak("")
+	}
+	if err != nil {
+		thisClient.sendError("opposed roll not accepted: %v", err)
+		return false
+	}
+	if contest.OpponentSpec != "" {
+		return resolveOpposedRoll(ms, contest, thisClient)
+	}
+
+	opponents := ms.Clients.ByUser(contest.Opponent)
+	if len(opponents) == 0 {
+		thisClient.sendError("opposed roll not accepted: %s is not connected", contest.Opponent)
+		return false
+	}
+	ms.opposedRolls.add(contest)
+	for _, peer := range opponents {
+		peer.Send("OR?", contest.ID, contest.Challenger)
+	}
+	return true
+}
+
+func resolveOpposedRoll(ms *MapService, contest *OpposedRoll, thisClient *MapClient) bool {
+	outcome, err := contest.Resolve()
+	if err != nil {
+		thisClient.sendError("opposed roll failed: %v", err)
+		return false
+	}
+	message, err := contest.OutcomeMessage(outcome)
+	if err != nil {
+		log.Printf("Internal error creating ORR message: %v", err)
+		return false
+	}
+	for _, peer := range ms.AllClients() {
+		if peer.Authenticated && !peer.WriteOnly {
+			peer.Send(message...)
+		}
+	}
+	return true
+}
+
+//
+// POLL <id> <question> <choices> [<timeout>]
+//
+// Put <question> to everyone, who may each vote for one of <choices>
+// (a list) with VOTE. The poll closes after <timeout> (a duration such
+// as 90s or 2m; DefaultPollTimeout if not given), or earlier with
+// POLL-. Only the GM may open polls unless the server lets players do
+// so too (PlayerPolls). Everyone (including the sender) is sent
+//   POLL+ <id> <question> <choices> <opened-by> <closes>
+// and, once it closes, the tallies (see Poll.ResultMessage)
+//   POLL. <id> <question> <tally> <voters>
+// which are also kept in the chat history as a message from whoever
+// opened the poll.
+//
+func handleOpenPoll(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if !thisClient.IsGM() && !ms.PlayerPolls {
+		thisClient.sendError("only the GM may open polls")
+		return false
+	}
+	options, err := ParseTclList(event.Fields[3])
+	if err != nil {
+		thisClient.sendError("poll choices not understood: %v", err)
+		return false
+	}
+	var timeout time.Duration
+	if len(event.Fields) > 4 && event.Fields[4] != "" {
+		if timeout, err = time.ParseDuration(event.Fields[4]); err != nil || timeout <= 0 {
+			thisClient.sendError("poll timeout \"%s\" is not a duration", event.Fields[4])
+			return false
+		}
+	}
+	p, err := ms.OpenPoll(event.Fields[1], event.Fields[2], options, timeout, thisClient.Username())
+	if err != nil {
+		thisClient.sendError("poll not opened: %v", err)
+		return false
+	}
+	log.Printf("[client %s] poll %s opened by %s until %s", thisClient.logTag(), p.ID, p.OpenedBy, p.Closes.Format(time.RFC3339))
+	return false
+}
+
+//
+// POLL- <id>
+//
+// Close a poll before its time is up. Only the GM or whoever opened it
+// may do so.
+//
+func handleClosePoll(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	p, ok := ms.polls.get(event.Fields[1])
+	if !ok {
+		thisClient.Send("//", fmt.Sprintf("There is no poll %s open.", event.Fields[1]))
+		return false
+	}
+	if !thisClient.IsGM() && !strings.EqualFold(p.OpenedBy, thisClient.Username()) {
+		thisClient.sendError("only the GM or %s may close poll %s", p.OpenedBy, p.ID)
+		return false
+	}
+	ms.ClosePoll(p.ID)
+	return false
+}
+
+//
+// VOTE <id> <choice>
+//
+// Vote in the poll <id> for <choice> (one of its choices, or its number
+// counting from 1), replacing any vote already made. Nobody else is
+// told. We reply with
+//   VOTE+ <id> <choice>
+// if the vote counts, or
+//   VOTE- <id> <reason>
+// if it doesn't.
+//
+func handleVote(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	choice, err := ms.polls.vote(event.Fields[1], thisClient.Username(), event.Fields[2])
+	if err != nil {
+		thisClient.Send("VOTE-", event.Fields[1], err.Error())
+		return false
+	}
+	thisClient.Send("VOTE+", event.Fields[1], choice)
+	return false
+}
+
+//
+// D? <id> <spec>
+//
+// Check a die-roll spec without rolling it. If the spec is valid,
+// we reply with
+//   D= <id> <label>
+//   D: <name> <description> <min> <max> <modifiers>
+//   ...
+//   D. <count> <checksum>
+// with a D: line for each set of dice the spec would roll (there
+// will be more than one for permutations and multi-part rolls).
+// <name> is the field name for multi-part rolls. <min> and <max> are
+// "*" for fields computed from other fields. <modifiers> is a list
+// of {type value} pairs as in ROLL results.
+//
+// If the spec is not valid, we reply with
+//   D! <id> <error>
+//
+func handlePreviewDieRoll(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	spec, err := ResolveAttributeReferences(event.Fields[2], ms.State)
+	if err != nil {
+		thisClient.Send("D!", event.Fields[1], err.Error())
+		return false
+	}
+	label, previews, err := PreviewRoll(spec, ms.DiceLimits)
+	if err != nil {
+		thisClient.Send("D!", event.Fields[1], err.Error())
+		return false
+	}
+	transfer := thisClient.startTransfer("D", "D=", event.Fields[1], label)
+	for _, preview := range previews {
+		modifiers, err := formatRollDetails(StructuredResult{Details: preview.Modifiers})
+		if err != nil {
+			log.Printf("Internal error formatting D: response: %v", err)
+			return false
+		}
+		low, high := "*", "*"
+		if !preview.Computed {
+			low, high = strconv.Itoa(preview.Min), strconv.Itoa(preview.Max)
+		}
+		transfer.Send(preview.Name, preview.Description, low, high, modifiers)
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// DO? <id> <spec> [<dc>]
+//
+// Figure the chance that a roll of <spec> meets or beats <dc> (or the
+// DC given in the spec with |dc), without rolling it (see FigureOdds).
+// We reply with
+//   DO= <id> <dc> <chance> <samples>
+// where <chance> is from 0 to 1, and <samples> is 0 if it was worked
+// out exactly, or the number of rolls it was estimated from if not.
+// If the odds can't be figured, we reply with
+//   DO! <id> <error>
+//
+func handleRollOdds(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	dc := 0
+	if len(event.Fields) > 3 && event.Fields[3] != "" {
+		var err error
+		if dc, err = strconv.Atoi(event.Fields[3]); err != nil {
+			thisClient.Send("DO!", event.Fields[1], fmt.Sprintf("DC \"%s\" is not a number", event.Fields[3]))
+			return false
+		}
+	}
+	spec, err := ResolveAttributeReferences(event.Fields[2], ms.State)
+	if err != nil {
+		thisClient.Send("DO!", event.Fields[1], err.Error())
+		return false
+	}
+	odds, err := FigureOdds(spec, dc, ms.DiceLimits)
+	if err != nil {
+		thisClient.Send("DO!", event.Fields[1], err.Error())
+		return false
+	}
+	thisClient.Send("DO=", event.Fields[1], strconv.Itoa(odds.DC), strconv.FormatFloat(odds.Chance, 'f', 4, 64), strconv.Itoa(odds.Samples))
+	return false
+}
+
+//
+// LOS? <id> <creature> [<range>]
+//
+// Work out what <creature> (ID or name) can see past the walls on the
+// map (see LineOfSight), optionally no farther than <range> grid
+// squares. We reply with
+//   LOS= <id> <polygon> <visible> <perceived>
+// where <polygon> is the outline of the visible part of the map as a
+// list of map coordinates x0 y0 x1 y1 ..., <visible> lists the IDs
+// of the other creatures in its line of sight, and <perceived> lists
+// those of them it can actually make out by the light on the map (see
+// LT). If it can't be worked out, we reply with
+//   LOS! <id> <error>
+//
+func handleLineOfSight(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	var reach float64
+	if len(event.Fields) > 3 && event.Fields[3] != "" {
+		var err error
+		if reach, err = strconv.ParseFloat(event.Fields[3], 64); err != nil || reach < 0 {
+			thisClient.Send("LOS!", event.Fields[1], fmt.Sprintf("Range \"%s\" is not a distance", event.Fields[3]))
+			return false
+		}
+	}
+	sight, err := ms.LineOfSight(event.Fields[2], reach, thisClient.IsGM())
+	if err != nil {
+		thisClient.Send("LOS!", event.Fields[1], err.Error())
+		return false
+	}
+	var polygon []string
+	for _, v := range sight.Polygon {
+		polygon = append(polygon, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	thisClient.Send("LOS=", event.Fields[1], strings.Join(polygon, " "), strings.Join(sight.Visible, " "), strings.Join(sight.Perceived, " "))
+	return false
+}
+
+//
+// DB <id> <speclist>
+//
+// Roll a list of die-roll specs at once. The results are sent back
+// only to the requesting client, as
+//   DB= <id>
+//   DB: <index> <title> <result> <details>
+//   ...
+//   DB. <count> <checksum>
+// with one DB: line per result (a spec which rolls repeatedly will have
+// several), where <index> is the position of the spec in <speclist>.
+// If a spec couldn't be rolled, its DB: line has a <result> of "*" and
+// an error detail explaining why.
+//
+func handleBulkDieRoll(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	specs, err := ParseTclList(event.Fields[2])
+	if err != nil {
+		thisClient.sendError("die roll list not understood: %v", err)
+		return false
+	}
+	if !ms.checkRollRate(thisClient, len(specs)) {
+		return false
+	}
+	rolls, err := thisClient.dice.DoRolls(specs)
+	if err != nil {
+		thisClient.sendError("die roll request not accepted: %v", err)
+		return false
+	}
+
+	transfer := thisClient.startTransfer("DB", "DB=", event.Fields[1])
+	for i, roll := range rolls {
+		if roll.Error != nil {
+			error_detail, err := formatRollDetails(StructuredResult{Details: []StructuredDescription{{Type: "error", Value: roll.Error.Error()}}})
+			if err != nil {
+				log.Printf("Internal error formatting DB response: %v", err)
+				return false
+			}
+			transfer.Send(strconv.Itoa(i), roll.Spec, "*", error_detail)
+			continue
+		}
+		for _, result := range roll.Results {
+			formatted_detail_list, err := formatRollDetails(result)
+			if err != nil {
+				log.Printf("Internal error formatting DB response: %v", err)
+				return false
+			}
+			transfer.Send(strconv.Itoa(i), roll.Title, strconv.Itoa(result.Result), formatted_detail_list)
+		}
+	}
+	transfer.Finish()
+	return true
+}
+
+//
+// DD <deflist>
+//
+// Define a personal set of die-roll presets. <deflist>
+// is a list of presets, each of which is a list of
+//   <name> <description> <dice-spec> [<folder> <sort-order>]
+//
+func handleDefineDicePresets(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if !thisClient.Authenticated || thisClient.Auth == nil {
+		log.Printf("[client %s] DD command failed: no username authenticated for user", thisClient.logTag())
+		return false
+	}
+	new_set, err := NewDicePresetListFromString(event.Fields[1])
+	if err != nil {
+		log.Printf("[client %s] DD command failed: %v; new set %s", thisClient.logTag(), err, event.Fields[1])
+		thisClient.sendError("die roll preset not understood: %v", err)
+		return false
+	}
+	if ms.Storage == nil {
+		log.Printf("[client %s] DD command failed (no open database)", thisClient.logTag())
+		thisClient.sendError("die roll preset could not be stored: the system administrator has not configured persistent storage.")
+		return false
+	}
+
+	ms.storeDicePresets(thisClient.Username(), new_set)
+	ms.SetDicePresets(thisClient.Username(), new_set)
+	ms.SendDicePresetsToOtherClients(thisClient, thisClient.Username())
+	return true
+}
+
+//
+// DD+ <deflist>
+//
+// Add a new set of die-roll presets to the existing
+// list for a user. 
+//
+func handleAddDicePresets(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if !thisClient.Authenticated || thisClient.Auth == nil {
+		log.Printf("[client %s] DD+ command failed: no username authenticated for user", thisClient.logTag())
+		return false
+	}
+	if ms.Storage == nil {
+		log.Printf("[client %s] DD+ command failed (no open database)", thisClient.logTag())
+		thisClient.sendError("die roll preset could not be stored: the system administrator has not configured persistent storage.")
+		return false
+	}
+	new_set, err := NewDicePresetListFromString(event.Fields[1])
+	if err != nil {
+		log.Printf("[client %s] DD+ command failed: %v; new set %s", thisClient.logTag(), err, event.Fields[1])
+		thisClient.sendError("die roll preset not understood: %v", err)
+		return false
+	}
+	old_set := ms.DicePresets(thisClient.Username())
+	new_set = append(append([]DicePreset(nil), old_set...), new_set...)
+	ms.storeDicePresets(thisClient.Username(), new_set)
+	ms.SetDicePresets(thisClient.Username(), new_set)
+	ms.SendDicePresetsToOtherClients(thisClient, thisClient.Username())
+	return true
+}
+
+//
+// DD/ <regex>
+//
+// Remove all die-roll presets for the requesting user which match
+// the given regular expression.
+//
+func handleFilterDicePresets(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if !thisClient.Authenticated || thisClient.Auth == nil {
+		log.Printf("[client %s] DD/ command failed: no username authenticated for user", thisClient.logTag())
+		return false
+	}
+	if ms.Storage == nil {
+		log.Printf("[client %s] DD/ command failed (no open database)", thisClient.logTag())
+		thisClient.sendError("die roll preset could not be stored: the system administrator has not configured persistent storage.")
+		return false
+	}
+	old_set := ms.DicePresets(thisClient.Username())
+	if len(old_set) == 0 {
+		return false // nothing to do in this case
+	}
+	pattern, err := regexp.Compile(event.Fields[1])
+	if err != nil {
+		log.Printf("[client %s] DD/ command failed on regex compilation: %v", thisClient.logTag(), err)
+		thisClient.sendError("die roll filter regex not understood: %v", err)
+		return false
+	}
+
+	var new_set []DicePreset
+	for _, preset := range old_set {
+		if !pattern.MatchString(preset.Name) {
+			new_set = append(new_set, preset)
+		}
+	}
+
+	ms.storeDicePresets(thisClient.Username(), new_set)
+	ms.SetDicePresets(thisClient.Username(), new_set)
+	ms.SendDicePresetsToOtherClients(thisClient, thisClient.Username())
+	return true
+}
+
+//
+// DR [<revision>]
+//
+// Request die-roll presets on file for this user. If the client
+// already has a set of presets, it may tell us which revision it
+// has (this is the checksum sent with the DD. message which ended
+// that set). If that's still current, we just reply with
+//   DD~ <revision>
+// instead of sending the whole list again.
+//
+func handleRequestDicePresets(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if !thisClient.Authenticated || thisClient.Auth == nil {
+		log.Printf("[client %s] DR command failed: no username authenticated for user", thisClient.logTag())
+		return false
+	}
+
+	if len(event.Fields) > 1 {
+		thisClient.swapPresetRevision(event.Fields[1])
+	}
+	ms.SendMyPresets(thisClient, thisClient.Username())
+	return true
+}
+
+//
+// DU? [<count>]
+//
+// Ask which of the user's die-roll presets they roll most often, and
+// which they rolled most recently (at most <count> of each, or 10 if
+// not given). We reply with
+//   DU=
+//   DU: top <name> <times-rolled> <last-rolled>
+//   ...
+//   DU: recent <name> <times-rolled> <last-rolled>
+//   ...
+//   DU. <count> <checksum>
+// where the top presets are listed most often rolled first, the
+// recent ones latest first, and <last-rolled> is in seconds since
+// the epoch.
+//
+func handlePresetUsage(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if !thisClient.Authenticated || thisClient.Auth == nil {
+		log.Printf("[client %s] DU? command failed: no username authenticated for user", thisClient.logTag())
+		return false
+	}
+	limit := DefaultPresetUsageLimit
+	if len(event.Fields) > 1 {
+		n, err := strconv.Atoi(event.Fields[1])
+		if err != nil || n < 1 {
+			thisClient.sendError("number of presets \"%s\" not understood", event.Fields[1])
+			return false
+		}
+		limit = n
+	}
+	top, recent := ms.PresetUsage(thisClient.Username(), limit)
+	transfer := thisClient.startTransfer("DU", "DU=")
+	for _, u := range top {
+		transfer.Send("top", u.Name, strconv.FormatUint(u.Count, 10), strconv.FormatInt(u.LastUsed.Unix(), 10))
+	}
+	for _, u := range recent {
+		transfer.Send("recent", u.Name, strconv.FormatUint(u.Count, 10), strconv.FormatInt(u.LastUsed.Unix(), 10))
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// DX <format>
+//
+// Export the user's die-roll presets as a file in the given format
+// (json or csv). We reply with the file, one line at a time:
+//   DX= <format>
+//   DX: <line>
+//   ...
+//   DX. <count> <checksum>
+//
+func handleExportDicePresets(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if !thisClient.Authenticated || thisClient.Auth == nil {
+		log.Printf("[client %s] DX command failed: no username authenticated for user", thisClient.logTag())
+		return false
+	}
+	var file strings.Builder
+	if err := ExportDicePresets(&file, event.Fields[1], ms.DicePresets(thisClient.Username())); err != nil {
+		thisClient.sendError("unable to export die-roll presets: %v", err)
+		return false
+	}
+	transfer := thisClient.startTransfer("DX", "DX=", event.Fields[1])
+	for _, line := range strings.Split(strings.TrimSuffix(file.String(), "\n"), "\n") {
+		transfer.Send(strings.TrimSuffix(line, "\r"))
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// DI <format> <mode>
+// DI: <line> [<seq>]
+// DI. <count> <checksum>
+//
+// Import die-roll presets from a file in the given format (json or
+// csv, as written by DX), sent one line at a time, either merging them
+// with the user's existing presets (replacing any with the same names)
+// or replacing them altogether, depending on <mode> (merge or replace).
+// If any row of the file is wrong, nothing is imported, and we tell
+// the client about each of them with
+//   DI! <row> <error>
+//
+func handleImportStart(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.beginTransfer(event)
+	return false
+}
+
+func handleImportData(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.transferChunk(event)
+	return false
+}
+
+func handleImportEnd(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	transfer := thisClient.finishTransfer(event)
+	if transfer == nil {
+		return false
+	}
+	if !thisClient.Authenticated || thisClient.Auth == nil {
+		log.Printf("[client %s] DI command failed: no username authenticated for user", thisClient.logTag())
+		return false
+	}
+	if ms.Storage == nil {
+		log.Printf("[client %s] DI command failed (no open database)", thisClient.logTag())
+		thisClient.sendError("die roll presets could not be stored: the system administrator has not configured persistent storage.")
+		return false
+	}
+	format, mode := transfer.Header.Fields[1], transfer.Header.Fields[2]
+	if mode != PresetImportMerge && mode != PresetImportReplace {
+		thisClient.sendError("unknown import mode \"%s\" (use %s or %s)", mode, PresetImportMerge, PresetImportReplace)
+		return false
+	}
+	file := strings.NewReader(strings.Join(transfer.Chunks, "\n"))
+	presets, problems, err := ImportDicePresets(file, format, ms.DiceLimits)
+	if err != nil {
+		thisClient.sendError("unable to import die-roll presets: %v", err)
+		return false
+	}
+	if problems != nil {
+		for _, problem := range problems {
+			thisClient.Send("DI!", strconv.Itoa(problem.Row), problem.Error)
+		}
+		thisClient.sendError("no die-roll presets were imported, since %d rows of the file had problems", len(problems))
+		return false
+	}
+	total, err := ms.importDicePresets(thisClient.Username(), mode, presets)
+	if err != nil {
+		thisClient.sendError("unable to import die-roll presets: %v", err)
+		return false
+	}
+	log.Printf("[client %s] imported %d die-roll presets (%s)", thisClient.logTag(), len(presets), mode)
+	thisClient.Send("//", fmt.Sprintf("Imported %d die-roll presets; you now have %d.", len(presets), total))
+	return false
+}
+
+//
+// LS
+// LS: <data> [<seq>]
+// LS. <count> <checksum>
+//
+// Load a data set (as if from a .map data file) describing all attributes
+// of a set of map elements and creature token.  Even though they are sent
+// as multiple commands over the client/server connections, we will store
+// them here as a single event with multiple lines in the raw portion and an
+// empty Fields list.
+//
+func handleLoadStart(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.beginTransfer(event)
+	return false // don't save this (incomplete) operation in the state history
+}
+
+
+func handleLoadData(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.transferChunk(event)
+	return false // don't save this (incomplete) operation in the state history
+}
+
+
+func handleLoadEnd(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	transfer := thisClient.finishTransfer(event)
+	if transfer == nil {
+		return false
+	}
+	data_by_id := make(map[string][]string)
+	class_by_id := make(map[string]string)
+	hidden_ids := make(map[string]bool)
+	drawn := make(map[string]int)
+	var relay_items, relay_ids []string
+
+	//
+	// run through the list of objects sent in the LS command,
+	// rearranging them from the random order they're allowed to arrive
+	// per the protocol spec into a new set of events that each describe
+	// a single object.
+	//
+
+	for _, item_text := range transfer.Chunks {
+		item, err := ParseTclList(item_text)
+		if err != nil {
+			log.Printf("[client %s] ERROR: LS object format error in %s: %v; sequence rejected", thisClient.logTag(), item_text, err)
+			goto reject_LS
+		}
+
+		if len(item) == 0 {
+			continue
+		}
+		if len(item) < 2 {
+			log.Printf("[client %s] ERROR: LS object format error in %s; sequence rejected", thisClient.logTag(), item_text)
+			goto reject_LS
+		}
+		relay_items = append(relay_items, item_text)
+		switch item[0] {
+			case "M", "P":
+				attrs := strings.SplitN(item[1], ":", 2)
+				if len(attrs) != 2 {
+					log.Printf("[client %s] ERROR: LS object format error in %s; sequence rejected", thisClient.logTag(), item[1])
+					goto reject_LS
+				}
+				relay_ids = append(relay_ids, attrs[1])
+				if attrs[0] == "LAYER" && len(item) > 2 && ms.isGMLayer(item[2]) {
+					hidden_ids[attrs[1]] = true
+				}
+				obj_list, ok := data_by_id[attrs[1]]
+				if !ok {
+					obj_list = []string{item_text}
+				} else {
+					obj_list = append(obj_list, item_text)
+				}
+				data_by_id[attrs[1]] = obj_list
+				class_by_id[attrs[1]] = item[0]
+				if attrs[0] == "NAME" && len(item) < 3 {
+					log.Printf("[client %s] ERROR: LS object format error in %s; sequence rejected", thisClient.logTag(), item_text)
+					goto reject_LS
+				}
+			case "F":
+				relay_ids = append(relay_ids, item[1])
+				data_by_id[item[1]] = []string{item_text}
+				class_by_id[item[1]] = ""
+
+			default:
+				attrs := strings.SplitN(item[0], ":", 2)
+				if len(attrs) != 2 {
+					log.Printf("[client %s] ERROR: LS object format error in %s; sequence rejected", thisClient.logTag(), item[0])
+					goto reject_LS
+				}
+				relay_ids = append(relay_ids, attrs[1])
+				if attrs[0] == "LAYER" && ms.isGMLayer(item[1]) {
+					hidden_ids[attrs[1]] = true
+				}
+				old_list, ok := data_by_id[attrs[1]]
+				if !ok {
+					old_list = []string{item_text}
+				} else {
+					old_list = append(old_list, item_text)
+				}
+				data_by_id[attrs[1]] = old_list
+				class_by_id[attrs[1]] = "E"
+		}
+	}
+	//
+	// Players may not put anything on (or change anything already on)
+	// the GM's own map layers, and won't be shown anything there.
+	//
+	for obj_id := range data_by_id {
+		if ms.isGMObject(obj_id) {
+			hidden_ids[obj_id] = true
+		}
+	}
+	if len(hidden_ids) > 0 && !thisClient.IsGM() {
+		log.Printf("[client %s] DENIED LS on GM-only map layer to %s", thisClient.logTag(), thisClient.Username())
+		thisClient.sendError("you may not change the GM's own map layers")
+		return false
+	}
+	for obj_id, definition := range data_by_id {
+		if class_by_id[obj_id] == "E" {
+			drawn[obj_id] = definitionPoints(definition)
+		}
+	}
+	if !ms.claimDrawing(thisClient, drawn) {
+		return false
+	}
+	for _, peer := range ms.Clients.Subscribers("LS") {
+		if peer.ClientAddr == thisClient.ClientAddr {
+			continue
+		}
+		peer.beginBulk()
+		if len(hidden_ids) == 0 || peer.IsGM() {
+			peer.Send("LS")
+			for _, item_text := range relay_items {
+				peer.Send("LS:", item_text)
+			}
+			peer.Send(event.Fields...)
+		} else {
+			players_transfer := peer.startTransfer("LS", "LS")
+			for i, item_text := range relay_items {
+				if !hidden_ids[relay_ids[i]] {
+					players_transfer.Send(item_text)
+				}
+			}
+			players_transfer.Finish()
+		}
+		peer.endBulk()
+	}
+	//
+	// repackage by object
+	//
+	for obj_id, definition := range data_by_id {
+		cksum := sha256.New()
+		var elements []string
+		for _, element := range definition {
+			cksum.Write([]byte(element))
+			elements = append(elements, "LS: {" + element + "}")
+		}
+		elements = append(elements, fmt.Sprintf("LS. %d %s",
+			len(elements), base64.StdEncoding.EncodeToString(cksum.Sum(nil))))
+		new_event, err := NewMapEvent("LS", obj_id, class_by_id[obj_id])
+		if err != nil {
+			log.Printf("[client %s] ERROR packaging LS data for object %s: %v",
+				thisClient.logTag(), obj_id, err)
+			return false
+		}
+		new_event.MultiRawData = elements
+		new_event.User = thisClient.Username()
+		ms.UpdateState(new_event)
+	}
+
+reject_LS:
+	return false // don't save the original event to our history (we already saved the repackaged ones)
+}
+
+//
+// DQ <elements> <points> <element-points>
+//
+// (GM only) Change how much each player may draw on the map: the most
+// map elements they may have, the most points in all of them together,
+// and the most points in any one element. A limit of 0 means the server's
+// default; a negative limit means there is no limit.
+//
+func handleSetDrawingQuota(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	var limits [3]int
+	for i := range limits {
+		var err error
+		if limits[i], err = strconv.Atoi(event.Fields[i+1]); err != nil {
+			thisClient.sendError("drawing quota %s must be an integer", event.Fields[i+1])
+			return false
+		}
+	}
+	q := DrawingQuota{MaxElements: limits[0], MaxPoints: limits[1], MaxElementPoints: limits[2]}
+	ms.drawings.setQuota(q)
+	log.Printf("[client %s] drawing quota set to %v", thisClient.logTag(), q)
+	ms.audit(thisClient, "drawing-quota", map[string]string{"quota": q.String()})
+	thisClient.Send("//", fmt.Sprintf("Each player may now draw %v.", q))
+	return false
+}
+
+//
+// DQ?
+//
+// (GM only) Ask how much each player has drawn on the map. We reply with
+// a comment giving the current quota, then
+//   DQ=
+//   DQ: <user> <elements> <points>
+//   ...
+//   DQ. <count> <checksum>
+//
+func handleDrawingUsage(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.Send("//", fmt.Sprintf("Each player may draw %v.", ms.drawings.currentQuota(ms.DrawingQuota)))
+	transfer := thisClient.startTransfer("DQ", "DQ=")
+	for _, u := range ms.drawings.usage(ms.objectExists) {
+		transfer.Send(u.User, strconv.Itoa(u.Elements), strconv.Itoa(u.Points))
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// DQ- <user> [<count>]
+//
+// Remove the map elements drawn by <user> (or just the <count> most
+// recent ones). Everyone is sent CLR messages for them. Players may only
+// clean up their own drawings; the GM may clean up anyone's.
+//
+func handleRemoveDrawings(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if !thisClient.IsGM() && event.Fields[1] != thisClient.Username() {
+		thisClient.sendError("you may only remove your own drawings")
+		return false
+	}
+	n := 0
+	if len(event.Fields) > 2 {
+		var err error
+		if n, err = strconv.Atoi(event.Fields[2]); err != nil || n < 1 {
+			thisClient.sendError("number of drawings to remove (%s) must be a positive integer", event.Fields[2])
+			return false
+		}
+	}
+	removed := ms.removeDrawings(event.Fields[1], n)
+	log.Printf("[client %s] removed %d map element%s drawn by %s", thisClient.logTag(), removed, plural(removed), event.Fields[1])
+	if thisClient.IsGM() {
+		ms.audit(thisClient, "drawings-removed", map[string]string{"user": event.Fields[1], "count": strconv.Itoa(removed)})
+	}
+	thisClient.Send("//", fmt.Sprintf("Removed %d map element%s drawn by %s.", removed, plural(removed), event.Fields[1]))
+	return false
+}
+
+//
+// MARK <x> <y>
+//
+// Flash a marker at map location (<x>, <y>) for everyone. If the
+// server keeps markers for a while, we remember it, and once it expires
+// we send everyone
+//   MARK- <x> <y>
+//
+func handleMark(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.SendToOthers(event.Fields...)
+	ms.rememberMark(event.Fields[1], event.Fields[2])
+	return false
+}
+
+//
+// MARK?
+//
+// Ask for the markers placed recently which haven't expired yet. Each
+// is sent back as a MARK message.
+//
+func handleRecentMarks(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	ms.sendRecentMarks(thisClient)
+	return false
+}
+
+//
+// RG <id> <title> <points> <note> [<revealed>]
+//
+// (GM only) Outline a region of the map (or change one) with the
+// given <id>. <points> lists the map coordinates of each corner of its
+// outline in turn (x0 y0 x1 y1 ...), and <note> is for the GM alone.
+// If <revealed> is 1, the players are shown the region (without its
+// note); if it isn't given, a region which was already revealed stays
+// that way. Other GM clients are sent the region as an RG message, as
+// are the players if they may see it (or RG- if they no longer may).
+// Regions are saved with the game, and with the map when the GM
+// exports it (see EXPORT).
+//
+func handleDefineRegion(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	var old *Region
+	if r, ok := ms.regions.get(event.Fields[1]); ok {
+		old = &r
+	}
+	r, err := ParseRegion(event.Fields[1:], old)
+	if err == nil {
+		err = ms.setRegion(thisClient, r)
+	}
+	if err != nil {
+		thisClient.sendError("region not defined: %v", err)
+	}
+	return false
+}
+
+//
+// RG- <id>
+//
+// (GM only) Remove a region. Everyone who could see it is sent the
+// same message.
+//
+func handleDeleteRegion(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	found, err := ms.deleteRegion(thisClient, event.Fields[1])
+	if err != nil {
+		thisClient.sendError("region %s not deleted: %v", event.Fields[1], err)
+	} else if !found {
+		thisClient.Send("//", fmt.Sprintf("There is no region %s.", event.Fields[1]))
+	}
+	return false
+}
+
+//
+// RGV <id> <revealed>
+//
+// (GM only) Reveal a region to the players (if <revealed> is 1) or
+// hide it from them again (if it is 0).
+//
+func handleRevealRegion(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	r, ok := ms.regions.get(event.Fields[1])
+	if !ok {
+		thisClient.sendError("there is no region %s", event.Fields[1])
+		return false
+	}
+	revealed, err := strconv.ParseBool(event.Fields[2])
+	if err != nil {
+		thisClient.sendError("region %s revealed flag must be 0 or 1", event.Fields[1])
+		return false
+	}
+	r.Revealed = revealed
+	if err = ms.setRegion(thisClient, r); err != nil {
+		thisClient.sendError("region %s not changed: %v", event.Fields[1], err)
+	}
+	return false
+}
+
+//
+// RG?
+//
+// Ask for the regions of the map. We reply with
+//   RG=
+//   RG: <id> <title> <points> <note> <revealed>
+//   ...
+//   RG. <count> <checksum>
+// sorted by ID. Players are only sent the regions revealed to them,
+// and never their notes.
+//
+func handleListRegions(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	gm := thisClient.IsGM()
+	transfer := thisClient.startTransfer("RG", "RG=")
+	for _, r := range ms.Regions(gm) {
+		transfer.Send(r.Message(gm)[1:]...)
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// LT <id> <x> <y> <radius> <color> [<token>]
+//
+// (GM only) Place a light source on the map (or change one) with the
+// given <id>, lighting <radius> grid squares around (<x>, <y>) in map
+// coordinates, or around the creature whose ID is <token> if it is
+// carried. Everyone else is sent the same message. Lights are saved
+// with the game, and decide what creatures can make out (see LOS?).
+//
+func handlePlaceLight(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	l, err := ParseLight(event.Fields[1:])
+	if err == nil {
+		err = ms.setLight(thisClient, l)
+	}
+	if err != nil {
+		thisClient.sendError("light not placed: %v", err)
+	}
+	return false
+}
+
+//
+// LT- <id>
+//
+// (GM only) Remove a light source. Everyone else is sent the same
+// message.
+//
+func handleRemoveLight(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	found, err := ms.deleteLight(thisClient, event.Fields[1])
+	if err != nil {
+		thisClient.sendError("light %s not removed: %v", event.Fields[1], err)
+	} else if !found {
+		thisClient.Send("//", fmt.Sprintf("There is no light %s.", event.Fields[1]))
+	}
+	return false
+}
+
+//
+// LT?
+//
+// Ask for the light sources on the map. We reply with
+//   LT=
+//   LT: <id> <x> <y> <radius> <color> <token>
+//   ...
+//   LT. <count> <checksum>
+// sorted by ID.
+//
+func handleListLights(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	transfer := thisClient.startTransfer("LT", "LT=")
+	for _, l := range ms.Lights() {
+		transfer.Send(l.Message()[1:]...)
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// CK <label>
+//
+// (GM only) Make a checkpoint of the game state as it is now, so the
+// map may be rolled back to it with RB. Any checkpoint already made
+// with the same label is replaced.
+//
+func handleMakeCheckpoint(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if event.Fields[1] == "" {
+		thisClient.sendError("checkpoints must have a label")
+		return false
+	}
+	cp := ms.MakeCheckpoint(event.Fields[1], thisClient.Username())
+	thisClient.Send("//", fmt.Sprintf("Checkpoint %s made (%d objects on the map).", cp.Label, cp.Objects))
+	return false
+}
+
+//
+// CK?
+//
+// (GM only) Ask for the checkpoints which may be rolled back to. We
+// reply with
+//   CK=
+//   CK: <label> <made> <user> <objects>
+//   ...
+//   CK. <count> <checksum>
+// oldest first, where <made> is when the checkpoint was made, in
+// seconds since the epoch.
+//
+func handleListCheckpoints(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	transfer := thisClient.startTransfer("CK", "CK=")
+	for _, cp := range ms.Checkpoints() {
+		transfer.Send(cp.Label, strconv.FormatInt(cp.Made.Unix(), 10), cp.By, strconv.Itoa(cp.Objects))
+	}
+	transfer.Finish()
+	return false
+}
+
+//
+// CK- <label>
+//
+// (GM only) Forget a checkpoint.
+//
+func handleDeleteCheckpoint(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if ms.DeleteCheckpoint(event.Fields[1]) {
+		thisClient.Send("//", fmt.Sprintf("Checkpoint %s deleted.", event.Fields[1]))
+	} else {
+		thisClient.Send("//", fmt.Sprintf("There is no checkpoint called %s.", event.Fields[1]))
+	}
+	return false
+}
+
+//
+// RB <label>
+//
+// (GM only) Roll the map back to the checkpoint made with CK under the
+// given label. Everything on the map (including the initiative order
+// and the game clock) is put back as it was then, and everyone is sent
+// the restored game state as they are when they first connect. The
+// chat history is left alone. Every rollback is written to the audit
+// log.
+//
+func handleRollback(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if err := ms.Rollback(event.Fields[1], thisClient.Username()); err != nil {
+		thisClient.sendError("unable to roll back: %v", err)
+		return false
+	}
+	ms.audit(thisClient, "rollback", map[string]string{"checkpoint": event.Fields[1]})
+	thisClient.Send("//", fmt.Sprintf("Rolled back to checkpoint %s.", event.Fields[1]))
+	return false
+}
+
+//
+// MV <id> <creature> <path>
+//
+// Reserve the path <creature> (ID or name) will take this round, for
+// games where everyone moves at once. <path> lists the grid coordinates
+// of each square it moves into in turn (x0 y0 x1 y1 ...). We reply
+//   MV+ <id>
+// if the path is clear, or
+//   MV- <id> <reason>
+// if it runs into another creature or another reserved path (or if
+// the reservation is otherwise not accepted). An empty <path> withdraws
+// the reservation <id>. Players may only move their own creatures.
+//
+func handleReserveMove(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	reject := func(format string, args ...interface{}) bool {
+		thisClient.Send("MV-", event.Fields[1], fmt.Sprintf(format, args...))
+		return false
+	}
+	creature, ok := ms.State.CreatureID(event.Fields[2])
+	if !ok {
+		return reject("There is no creature %s on the map", event.Fields[2])
+	}
+	if !thisClient.IsGM() && !ms.State.mayActFor(thisClient.Username(), creature) {
+		return reject("You can't move %s", event.Fields[2])
+	}
+	if event.Fields[3] == "" {
+		if !ms.moves.withdraw(event.Fields[1], creature) {
+			return reject("There is no reservation %s for %s", event.Fields[1], event.Fields[2])
+		}
+		log.Printf("[client %s] movement reservation %s for %s withdrawn", thisClient.logTag(), event.Fields[1], event.Fields[2])
+		return reject("Withdrawn")
+	}
+	path, err := ParsePath(event.Fields[3])
+	if err != nil {
+		return reject("%v", err)
+	}
+	positions, names := ms.State.CreaturePositions()
+	start, ok := positions[creature]
+	if !ok {
+		return reject("%s isn't on the grid", event.Fields[2])
+	}
+	r := MovementReservation{
+		ID:       event.Fields[1],
+		Creature: creature,
+		Name:     names[creature],
+		User:     thisClient.Username(),
+		Start:    start,
+		Path:     path,
+	}
+	if err = ms.moves.reserve(r, names, positions); err != nil {
+		log.Printf("[client %s] movement reservation %s for %s rejected: %v", thisClient.logTag(), r.ID, r.Name, err)
+		return reject("%v", err)
+	}
+	log.Printf("[client %s] movement reservation %s for %s confirmed (%d square%s)", thisClient.logTag(), r.ID, r.Name, len(path), plural(len(path)))
+	thisClient.Send("MV+", r.ID)
+	return false
+}
+
+//
+// MV.
+//
+// (GM only) The moves reserved this round have been made, so start
+// over with no reservations. Everyone is sent MV. too.
+//
+func handleEndMovementRound(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	reserved := ms.moves.clear()
+	log.Printf("[client %s] movement round ended (%d reservation%s)", thisClient.logTag(), len(reserved), plural(len(reserved)))
+	thisClient.SendToOthers("MV.")
+	thisClient.Send("//", fmt.Sprintf("New movement round started; %d path%s had been reserved.", len(reserved), plural(len(reserved))))
+	return false
+}
+
+//
+// NO
+// NO+
+// 
+// Set client to write-only mode. NO+ is an obsolete variation
+// of this command which we will now treat as a synonym for NO.
+//
+func handleWriteOnly(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.WriteOnly = true
+	return true
+}
+
+//
+// OA <id> <kvlist>
+//
+// Update a set of arbitrary attributes for the given object
+// by <id> (which may be the unique identifier for any object
+// (i.e., a UUID), or "@<name>" for a named creature token).
+//
+// <kvlist> is a list with an even number of elements, alternating
+// between the name of an object attribute and its new value.
+//
+func handleObjectAttributes(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if event.Fields[1] == "" || event.Fields[1] == "@" {
+		log.Printf("[client %s] OA command rejected (empty ID field)", thisClient.logTag())
+		return false
+	}
+	kvlist, err := ParseTclList(event.Fields[2])
+	if err != nil {
+		log.Printf("[client %s] OA command: cannot parse kvlist: %v",
+			thisClient.logTag(), err)
+		return false
+	}
+	if len(kvlist) % 2 != 0 {
+		log.Printf("[client %s] OA command: kvlist has non-even number of elements: %d",
+			thisClient.logTag(), len(kvlist))
+		return false
+	}
+
+	target, known_class, known := ms.State.ResolveObject(event.Fields[1])
+	if known {
+		event.Class = known_class
+	}
+	event.ID = target
+	if target == "" {
+		log.Printf("[client %s] OA command: setting attribute for %s: unknown object name (attempting best try)", thisClient.logTag(), event.Fields[1])
+	}
+
+	ms.sendObjectToOthers(thisClient, ms.isGMObject(target) || ms.setsGMLayer(event.Fields[2]), event.Fields...)
+	if target != "" {
+		ms.groupFollowsLeader(thisClient, target, kvlist)
+	}
+	return true
+}
+
+//
+// OA+ <id> <key> <valuelist>
+// OA- <id> <key> <valuelist>
+//
+// Assuming that the object with the given <id> has an attribute
+// <key> whose value is a list of values, add (OA+) or remove (OA-) the
+// list of values to/from that attribute.
+//
+func handleObjectAttributeList(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if event.Fields[1] == "" || event.Fields[1] == "@" {
+		log.Printf("[client %s] %s command rejected (empty ID field)",
+			thisClient.logTag(), event.EventType())
+		return false
+	}
+
+	target, known_class, known := ms.State.ResolveObject(event.Fields[1])
+	if known {
+		event.Class = known_class
+	}
+	event.ID = target
+	if target == "" {
+		log.Printf("[client %s] %s command: setting attribute for %s: unknown object name (attempting best try)",
+			thisClient.logTag(), event.EventType(), event.Fields[1])
+	}
+	ms.sendObjectToOthers(thisClient, ms.isGMObject(target), event.Fields...)
+	return true
+}
+
+//
+// PS <id> <color> <name> <area> <size> player|monster <x> <y> <reach>
+//
+// Place someone (a creature token) on the map.
+//
+func handlePlaceSomeone(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.SendToOthers(event.Fields...)
+	return true
+}
+
+//
+// SYNC [CHAT [<target>]]
+//
+// Synchronize the client with the current game state by replaying
+// all of the saved events we've been tracking.
+//
+// In the case of SYNC CHAT, rather than replaying the events, we replay
+// the saved chat messages. If <target> is supplied, only the messages
+// with IDs greater than <target> are sent. If <target> is negative, then
+// only the most recent |<target>| messages are sent. (These are sent
+// from the database when there is one; see syncChat.)
+//
+// See GameState for how these are stored.
+//
+func handleSync(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if len(event.Fields) == 1 {
+		// SYNC
+		// Send the stored events in our history
+		//
+		ms.Sync(thisClient)
+	} else {
+		if event.Fields[1] == "CHAT" {
+			// SYNC CHAT [target]
+			target := ""
+			if len(event.Fields) > 2 {
+				target = event.Fields[2]
+			}
+			if err := ms.syncChat(thisClient, target); err != nil {
+				log.Printf("[client %s] SYNC CHAT target value not understood: %v", thisClient.logTag(), err)
+				return false
+			}
+		} else {
+			log.Printf("[client %s] SYNC command not understood", thisClient.logTag())
+		}
+	}
+	return false // don't record the SYNC in the history
+}
+
+//
+// TO <sender> <recipientlist> <message> [<messageID> [<time>]]
+//
+// Send a chat message to the list of recipients (as with the D
+// command). The <messageID> and <time> are ignored when provided by
+// a client but are assigned by the server as it relays the message,
+// <time> being when the server got it (see TIME). We will also replace
+// the <sender> value with the actual sender's name.
+//
+func handleChatMessage(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	if len(event.Fields) == 4 {
+		event.Fields = append(event.Fields, "")
+	} else if len(event.Fields) == 6 {
+		event.Fields = event.Fields[:5] // we'll say when it was sent
+	} else if len(event.Fields) != 5 {
+		log.Printf("[client %s] Rejected malformed TO event %v", thisClient.logTag(), event.Fields)
+		return false
+	}
+	to_all := false
+	to_list, err := ParseTclList(event.Fields[2])
+	if err != nil {
+		thisClient.sendError("recipient list not understood: %v", err)
+		return false
+	}
+	for _, recipient := range to_list {
+		if recipient == "*" {
+			to_all = true
+		}
+	}
+	event.Fields[3], err = filterChat(thisClient.Username(), to_list, event.Fields[3])
+	if err != nil {
+		log.Printf("[client %s] TO message rejected by chat filter: %v", thisClient.logTag(), err)
+		thisClient.sendError("message not sent: %v", err)
+		return false
+	}
+	event.Fields[1] = thisClient.Username()
+	defer ms.order.hold(ChatStream)()
+	ms.addChatMessage(event)
+	var held []string
+	if to_all {
+		thisClient.SendToOthers(event.Fields...)
+	} else {
+		for _, peer := range ms.Clients.ByUsers(chatRecipients(to_list)) {
+			if peer.WriteOnly || peer.ClientAddr == thisClient.ClientAddr {
+				continue
+			}
+			peer.Send(event.Fields...)
+		}
+		if held = ms.holdForOfflineRecipients(event, chatRecipients(to_list)); held != nil {
+			thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
+				fmt.Sprintf("%s not connected; they will get your message when they next log in.", strings.Join(held, ", ")),
+				NextMessageID())
+		}
+	}
+	ms.notifyAddressed(event, to_list, held)
+	thisClient.Send(event.Fields...)
+	return true
+}
+
+//
+// /CONN
+//
+// Request a list of connected users. We reply with
+//   CONN
+//   CONN: <i> you|peer <addr> <user> <client> <auth> 0 <write-only> <polo-age> <afk>
+//   ...
+//   CONN. <count> <checksum>
+// where <polo-age> is how many seconds ago the client last answered
+// a ping, and <afk> is 1 if its user is away from the keyboard.
+//
+func handleConnQuery(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	thisClient.ConnResponse()
+	return true
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,1212 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the message handler table
+//
+
+package mapservice
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Set up a client connection for testing, which isn't connected
+// to any actual network socket. Anything sent to the client can be
+// retrieved by calling sentToTestClient.
+//
+func newTestClient(ms *MapService, addr, user string, gm bool) *MapClient {
+	c := &MapClient{
+		ClientAddr:    addr,
+		Service:       ms,
+		Authenticated: true,
+		Auth:          &Authenticator{Username: user, GmMode: gm},
+		LastPolo:      time.Now().Unix(),
+		lastInput:     time.Now(),
+		CommChannel:   make(chan string, CommChannelBufferSize),
+	}
+	ms.Clients.Add(c)
+	return c
+}
+
+func newTestService() *MapService {
+	return &MapService{
+		State: NewGameState(),
+	}
+}
+
+func sentToTestClient(c *MapClient) []string {
+	var sent []string
+	for {
+		select {
+		case m := <-c.CommChannel:
+			sent = append(sent, m)
+		default:
+			return sent
+		}
+	}
+}
+
+func testEvent(t *testing.T, raw string) *MapEvent {
+	ev, err := NewMapEvent(raw, "", "")
+	if err != nil {
+		t.Fatalf("unable to create test event %s: %v", raw, err)
+	}
+	return ev
+}
+
+func TestHandlers_Privilege(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	player := newTestClient(ms, "player", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "CO 1"), player)
+	if sent := sentToTestClient(player); len(sent) != 1 || sent[0] != "PRIV {You are not authorized to use the CO command}" {
+		t.Errorf("player CO response was %v", sent)
+	}
+	if sent := sentToTestClient(gm); len(sent) != 0 {
+		t.Errorf("player CO was relayed to GM: %v", sent)
+	}
+	if _, ok := ms.State.EventHistory["CO"]; ok {
+		t.Errorf("rejected CO event was recorded in game state")
+	}
+
+	ms.ExecuteAction(testEvent(t, "CO 1"), gm)
+	if sent := sentToTestClient(player); len(sent) != 1 || sent[0] != "CO 1" {
+		t.Errorf("GM CO relayed to player as %v", sent)
+	}
+	if _, ok := ms.State.EventHistory["CO"]; !ok {
+		t.Errorf("CO event was not recorded in game state")
+	}
+}
+
+func TestHandlers_Register(t *testing.T) {
+	ms := newTestService()
+	c := newTestClient(ms, "c", "alice", false)
+	called := false
+
+	RegisterMessageHandler("TEST-XYZZY", 1, 1, MessageHandler{
+		Handle: func(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+			called = event.Fields[1] == "plugh"
+			return true
+		},
+	})
+	if _, err := NewMapEvent("TEST-XYZZY a b", "", ""); err == nil {
+		t.Errorf("registered event type should have been limited to one parameter")
+	}
+	ms.ExecuteAction(testEvent(t, "TEST-XYZZY plugh"), c)
+	if !called {
+		t.Errorf("registered handler was not called")
+	}
+}
+
+func TestHandlers_BinaryImage(t *testing.T) {
+	ms := newTestService()
+	sender := newTestClient(ms, "sender", "alice", false)
+	binary := newTestClient(ms, "binary", "bob", false)
+	legacy := newTestClient(ms, "legacy", "carol", false)
+	binary.AcceptedList = []string{"AIB"}
+	ms.Clients.Reindex()
+
+	image := []byte("\x89PNG\r\n\x00binary\nstuff")
+	cksum := sha256.Sum256(image)
+	sender.Reader = bufio.NewReader(strings.NewReader(string(image) + "\n"))
+	ms.ExecuteAction(testEvent(t, fmt.Sprintf("AIB test 1 %d %s", len(image),
+		base64.StdEncoding.EncodeToString(cksum[:]))), sender)
+
+	if sent := sentToTestClient(sender); len(sent) != 0 {
+		t.Errorf("sender was sent %v", sent)
+	}
+	expected := fmt.Sprintf("AIB test 1 %d %s\n%s", len(image), base64.StdEncoding.EncodeToString(cksum[:]), image)
+	if sent := sentToTestClient(binary); len(sent) != 1 || sent[0] != expected {
+		t.Errorf("binary client was sent %q", sent)
+	}
+	encoded := base64.StdEncoding.EncodeToString(image)
+	line_cksum := sha256.Sum256([]byte(encoded))
+	if sent := sentToTestClient(legacy); len(sent) != 3 ||
+		sent[0] != "AI test 1" ||
+		sent[1] != "AI: "+encoded ||
+		sent[2] != "AI. 1 "+base64.StdEncoding.EncodeToString(line_cksum[:]) {
+		t.Errorf("legacy client was sent %q", sent)
+	}
+
+	sender.Reader = bufio.NewReader(strings.NewReader(string(image) + "\n"))
+	ms.ExecuteAction(testEvent(t, fmt.Sprintf("AIB test 1 %d bogus", len(image))), sender)
+	if sent := sentToTestClient(sender); len(sent) != 1 || !strings.Contains(sent[0], "checksum mismatch") {
+		t.Errorf("sender was sent %v after bad checksum", sent)
+	}
+	if sent := sentToTestClient(binary); len(sent) != 0 {
+		t.Errorf("bad upload was relayed as %q", sent)
+	}
+}
+
+func TestHandlers_DicePresetRevisions(t *testing.T) {
+	ms := newTestService()
+	first := newTestClient(ms, "first", "alice", false)
+	second := newTestClient(ms, "second", "alice", false)
+	ms.SetDicePresets("alice", []DicePreset{{Name: "hit", Description: "sword", RollSpec: "d20+3"}})
+
+	ms.ExecuteAction(testEvent(t, "DR"), first)
+	sent := sentToTestClient(first)
+	if len(sent) != 3 || sent[0] != "DD=" || sent[1] != "DD: 0 hit sword d20+3 {} 0" || !strings.HasPrefix(sent[2], "DD. 1 ") {
+		t.Fatalf("DR response was %v", sent)
+	}
+	revision := strings.TrimPrefix(sent[2], "DD. 1 ")
+	if revision != ms.DicePresetRevision("alice") {
+		t.Errorf("DD. checksum %s doesn't match revision %s", revision, ms.DicePresetRevision("alice"))
+	}
+
+	ms.ExecuteAction(testEvent(t, "DR"), first)
+	if sent := sentToTestClient(first); len(sent) != 1 || sent[0] != "DD~ "+revision {
+		t.Errorf("repeated DR response was %v", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "DR "+revision), second)
+	if sent := sentToTestClient(second); len(sent) != 1 || sent[0] != "DD~ "+revision {
+		t.Errorf("DR with current revision got %v", sent)
+	}
+
+	// an update that doesn't change anything keeps the revision
+	ms.SetDicePresets("alice", []DicePreset{{Name: "hit", Description: "sword", RollSpec: "d20+3"}})
+	ms.SendDicePresetsToOtherClients(first, "alice")
+	if sent := sentToTestClient(second); len(sent) != 1 || sent[0] != "DD~ "+revision {
+		t.Errorf("unchanged presets sent as %v", sent)
+	}
+	ms.SetDicePresets("alice", nil)
+	ms.SendDicePresetsToOtherClients(first, "alice")
+	if sent := sentToTestClient(second); len(sent) != 2 || sent[0] != "DD=" || !strings.HasPrefix(sent[1], "DD. 0 ") {
+		t.Errorf("changed presets sent as %v", sent)
+	}
+}
+
+func TestHandlers_BulkDieRoll(t *testing.T) {
+	var err error
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	other := newTestClient(ms, "other", "alice", false)
+	if gm.dice, err = NewDieRoller(); err != nil {
+		t.Fatalf("unable to create die roller: %v", err)
+	}
+
+	ms.ExecuteAction(testEvent(t, "DB 42 {{init=d20+2} {} {2d6|repeat 3} bogus}"), gm)
+	sent := sentToTestClient(gm)
+	if len(sent) != 8 || sent[0] != "DB= 42" || !strings.HasPrefix(sent[7], "DB. 6 ") {
+		t.Fatalf("DB response was %q", sent)
+	}
+	for i, prefix := range []string{"DB: 0 init ", "DB: 1 {} * {{error {Empty die-roll spec}}}", "DB: 2 {} ", "DB: 2 {} ", "DB: 2 {} ", "DB: 3 bogus * {{error "} {
+		if !strings.HasPrefix(sent[i+1], prefix) {
+			t.Errorf("DB result %d was %q; expected it to start with %q", i, sent[i+1], prefix)
+		}
+	}
+	if sent := sentToTestClient(other); len(sent) != 0 {
+		t.Errorf("bulk roll results were sent to another client: %v", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "DB 43 {"+strings.Repeat("d6 ", MaxBulkRolls+1)+"}"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "Too many") {
+		t.Errorf("oversized DB response was %q", sent)
+	}
+}
+
+func TestHandlers_OpposedRoll(t *testing.T) {
+	ms := newTestService()
+	alice := newTestClient(ms, "alice", "alice", false)
+	bob := newTestClient(ms, "bob", "bob", false)
+
+	ms.ExecuteAction(testEvent(t, "OR 7 bob grapple=d20+5|!"), alice)
+	if sent := sentToTestClient(bob); len(sent) != 1 || sent[0] != "OR? 7 alice" {
+		t.Fatalf("opponent was sent %v", sent)
+	}
+	if sent := sentToTestClient(alice); len(sent) != 0 {
+		t.Errorf("challenger was sent %v before the opponent answered", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "OR 7 alice escape=d20+8|!"), bob)
+	for _, c := range []*MapClient{alice, bob} {
+		sent := sentToTestClient(c)
+		if len(sent) != 1 || !strings.HasPrefix(sent[0], "ORR 7 alice bob bob 0 grapple 25 ") || !strings.Contains(sent[0], " escape 28 ") {
+			t.Errorf("%s was sent %v", c.ClientAddr, sent)
+		}
+	}
+
+	ms.ExecuteAction(testEvent(t, "OR 8 carol d20 d20 none"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "ORR 8 alice carol ") {
+		t.Errorf("immediate opposed roll sent %v", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "OR 9 carol d20"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.Contains(sent[0], "carol is not connected") {
+		t.Errorf("opposed roll against absent user sent %v", sent)
+	}
+}
+
+func TestHandlers_PreviewDieRoll(t *testing.T) {
+	ms := newTestService()
+	c := newTestClient(ms, "client", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "D? 3 {hit=d20+5|dc 15}"), c)
+	sent := sentToTestClient(c)
+	if len(sent) != 3 || sent[0] != "D= 3 hit" || sent[1] != "D: {} 1d20+5 6 25 {{dc 15}}" || !strings.HasPrefix(sent[2], "D. 1 ") {
+		t.Errorf("D? response was %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "D? 4 d20+"), c)
+	if sent := sentToTestClient(c); len(sent) != 1 || !strings.HasPrefix(sent[0], "D! 4 ") {
+		t.Errorf("D? response for bad spec was %q", sent)
+	}
+}
+
+func TestHandlers_RollInitiative(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	ms.ExecuteAction(testEvent(t, "PS 1 red Grax 1 M monster 3 4 0"), gm)
+	ms.ExecuteAction(testEvent(t, "OA 1 {INIT_mod 2}"), gm)
+	sentToTestClient(alice)
+
+	ms.ExecuteAction(testEvent(t, "IR Grax"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV ") {
+		t.Errorf("IR from a player gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "IR {Grax Nobody}"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "no creature named Nobody") {
+		t.Errorf("IR with unknown creature gave %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "IR Grax reroll"), gm)
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "IL {{0 Grax 0 0 1}}" {
+		t.Errorf("player was sent %q", sent)
+	}
+	if sent := sentToTestClient(gm); len(sent) != 2 || sent[0] != "IL {{0 Grax 0 0 1}}" || !strings.HasPrefix(sent[1], "// {Initiative for Grax: ") {
+		t.Errorf("GM was sent %q", sent)
+	}
+	if ev, ok := ms.State.EventHistory["IL"]; !ok || ev.Fields[1] != "{0 Grax 0 0 1}" {
+		t.Errorf("initiative order not recorded: %v", ev)
+	}
+}
+
+func TestHandlers_TurnEnforcement(t *testing.T) {
+	var err error
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	if alice.dice, err = NewDieRoller(); err != nil {
+		t.Fatalf("unable to create die roller: %v", err)
+	}
+	ms.TurnEnforcement = TurnsHold
+	for _, raw := range []string{"PS 1 red Grax 1 M monster 3 4 0", "PS 2 blue Alice 1 M player 5 6 0", "CO 1", "I {1 0 0} 1"} {
+		ms.ExecuteAction(testEvent(t, raw), gm)
+	}
+	sentIgnoringTime(alice)
+
+	ms.ExecuteAction(testEvent(t, "D * d20"), alice)
+	ms.ExecuteAction(testEvent(t, "TO alice GM hello"), alice)
+	sent := sentIgnoringTime(alice)
+	if len(sent) != 2 || !strings.Contains(sent[0], "isn't your turn") {
+		t.Errorf("out-of-turn roll gave %q", sent)
+	}
+	if sent = sentIgnoringTime(gm); len(sent) != 1 || !strings.HasPrefix(sent[0], "TO alice GM hello") {
+		t.Errorf("GM was sent %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "I {1 1 0} 2"), gm)
+	if sent = sentIgnoringTime(alice); len(sent) != 2 || !strings.HasPrefix(sent[0], "I ") || !strings.HasPrefix(sent[1], "ROLL alice ") {
+		t.Errorf("held roll not released on alice's turn: %q", sent)
+	}
+	sentIgnoringTime(gm)
+
+	ms.TurnEnforcement = TurnsReject
+	ms.ExecuteAction(testEvent(t, "I {1 2 0} 1"), gm)
+	sentIgnoringTime(alice)
+	ms.ExecuteAction(testEvent(t, "OA 2 {GX 7 GY 8}"), alice)
+	if sent = sentIgnoringTime(alice); len(sent) != 1 || !strings.Contains(sent[0], "Sorry") {
+		t.Errorf("out-of-turn move gave %q", sent)
+	}
+	if obj, _ := ms.State.Object("2"); obj.Attrs["GX"] != "5" {
+		t.Errorf("out-of-turn move was made")
+	}
+	ms.ExecuteAction(testEvent(t, "CO 0"), gm)
+	ms.ExecuteAction(testEvent(t, "OA 2 {GX 7 GY 8}"), alice)
+	if obj, _ := ms.State.Object("2"); obj.Attrs["GX"] != "7" {
+		t.Errorf("move after combat was not made")
+	}
+}
+
+func TestHandlers_ReadiedActions(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	for _, raw := range []string{"PS 1 red Grax 1 M monster 3 4 0", "PS 2 blue Alice 1 M player 5 6 0", "CO 1", "I {1 0 0} 2"} {
+		ms.ExecuteAction(testEvent(t, raw), gm)
+	}
+	sentIgnoringTime(alice)
+
+	ms.ExecuteAction(testEvent(t, "RA r1 Grax ready Alice"), alice)
+	ms.ExecuteAction(testEvent(t, "RA r1 Alice wait Grax"), alice)
+	if sent := sentIgnoringTime(alice); len(sent) != 2 || !strings.Contains(sent[0], "can't hold an action for Grax") || !strings.Contains(sent[1], "not understood") {
+		t.Errorf("bad RA requests gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "RA r1 Alice ready Grax {shoot it}"), alice)
+	ms.ExecuteAction(testEvent(t, "RA r2 Grax delay Alice"), gm)
+	if sent := sentIgnoringTime(gm); len(sent) != 1 || sent[0] != "RA r1 Alice ready Grax {shoot it}" {
+		t.Errorf("GM was sent %q", sent)
+	}
+	sentIgnoringTime(alice)
+
+	ms.ExecuteAction(testEvent(t, "I {1 1 0} 1"), gm)
+	if sent := sentIgnoringTime(gm); len(sent) != 2 || sent[1] != "RA- r2 expired" || !strings.Contains(sent[0], "Alice has an action readied for Grax's turn. (shoot it)") {
+		t.Errorf("on Grax's turn, GM was sent %q", sent)
+	}
+	if sent := sentIgnoringTime(alice); len(sent) != 2 || sent[1] != "RA- r2 expired" {
+		t.Errorf("on Grax's turn, alice was sent %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "RA- r1 fired"), alice)
+	ms.ExecuteAction(testEvent(t, "RA- r1 fired"), alice)
+	if sent := sentIgnoringTime(alice); len(sent) != 1 || !strings.Contains(sent[0], "no held action r1") {
+		t.Errorf("second RA- gave %q", sent)
+	}
+	if sent := sentIgnoringTime(gm); len(sent) != 1 || sent[0] != "RA- r1 fired" {
+		t.Errorf("GM was sent %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "RA r3 Grax delay Alice"), gm)
+	ms.ExecuteAction(testEvent(t, "CO 0"), gm)
+	if actions := ms.State.ReadiedActions(); len(actions) != 0 {
+		t.Errorf("actions still held after combat: %v", actions)
+	}
+}
+
+func TestHandlers_Encounters(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "EN? ambush"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "without a database") {
+		t.Errorf("EN? without storage gave %q", sent)
+	}
+
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/encounters.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+
+	ms.ExecuteAction(testEvent(t, "EN ambush 2 {} {{orc 2 red 1 M 0}}"), gm)
+	ms.ExecuteAction(testEvent(t, "EN? ambush"), gm)
+	sent := sentToTestClient(gm)
+	if len(sent) != 4 || sent[1] != "EN=" || sent[2] != "EN: ambush 2 {} {{orc 2 red 1 M 0 {}}}" || !strings.HasPrefix(sent[3], "EN. 1 ") {
+		t.Errorf("EN? response was %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "ED ambush 3 4"), gm)
+	if sent := sentToTestClient(alice); len(sent) != 2 || !strings.Contains(sent[0], " orc#1 ") || !strings.Contains(sent[1], " orc#2 ") {
+		t.Errorf("alice was sent %q", sent)
+	}
+	sentToTestClient(gm)
+	ms.ExecuteAction(testEvent(t, "ED nothing 3 4"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "no encounter called nothing") {
+		t.Errorf("ED of unknown encounter gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "EN- ambush"), alice)
+	ms.ExecuteAction(testEvent(t, "EN- ambush"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || sent[0] != "// {Encounter ambush deleted.}" {
+		t.Errorf("EN- gave %q", sent)
+	}
+}
+
+func TestHandlers_CreatureTemplates(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/templates.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+
+	ms.ExecuteAction(testEvent(t, "CT orc {} M red 1 0 npc {}"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "must be monster or player") {
+		t.Errorf("bad CT gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "CT orc {} M red 1 0 monster {INIT_mod 1}"), gm)
+	ms.ExecuteAction(testEvent(t, "CT?"), gm)
+	sent := sentToTestClient(gm)
+	if len(sent) != 4 || sent[1] != "CT=" || sent[2] != "CT: orc {} M red 1 0 monster {INIT_mod 1}" || !strings.HasPrefix(sent[3], "CT. 1 ") {
+		t.Errorf("CT? response was %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "PST orc 3 4 Grukk o1"), gm)
+	if sent := sentToTestClient(alice); len(sent) != 2 || sent[0] != "PS o1 red Grukk 1 M monster 3 4 0" || sent[1] != "OA o1 {INIT_mod 1}" {
+		t.Errorf("alice was sent %q", sent)
+	}
+	sentToTestClient(gm)
+	ms.ExecuteAction(testEvent(t, "CT- orc"), gm)
+	ms.ExecuteAction(testEvent(t, "PST orc 3 4"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 2 || !strings.Contains(sent[1], "no creature template called orc") {
+		t.Errorf("PST after CT- gave %q", sent)
+	}
+}
+
+//
+// Send an LS transfer of the given items from a client.
+//
+func sendTestLS(t *testing.T, ms *MapService, c *MapClient, items ...string) {
+	cksum := sha256.New()
+	ms.ExecuteAction(testEvent(t, "LS"), c)
+	for _, item := range items {
+		cksum.Write([]byte(item))
+		ms.ExecuteAction(testEvent(t, "LS: {"+item+"}"), c)
+	}
+	ms.ExecuteAction(testEvent(t, fmt.Sprintf("LS. %d %s", len(items), base64.StdEncoding.EncodeToString(cksum.Sum(nil)))), c)
+}
+
+func TestHandlers_MapLayers(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	sendTestLS(t, ms, gm, "TEXT:n1 {secret door}", "LAYER:n1 notes", "TEXT:t1 {welcome}", "LAYER:t1 players")
+	sent := sentToTestClient(alice)
+	if len(sent) != 4 || sent[0] != "LS" || sent[1] != "LS: {TEXT:t1 {welcome}}" || sent[2] != "LS: {LAYER:t1 players}" || !strings.HasPrefix(sent[3], "LS. 2 ") {
+		t.Errorf("alice was sent %q", sent)
+	}
+	if sent := sentToTestClient(gm); len(sent) != 0 {
+		t.Errorf("GM was sent %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "OA n1 {TEXT {open door}}"), alice)
+	ms.ExecuteAction(testEvent(t, "OA t1 {LAYER gm}"), alice)
+	ms.ExecuteAction(testEvent(t, "CLR n1"), alice)
+	ms.ExecuteAction(testEvent(t, "CLR *"), alice)
+	sendTestLS(t, ms, alice, "TEXT:n2 {mine}", "LAYER:n2 GM")
+	if sent := sentToTestClient(alice); len(sent) != 5 {
+		t.Errorf("alice's changes to GM layers gave %q", sent)
+	}
+	if sent := sentToTestClient(gm); len(sent) != 0 {
+		t.Errorf("GM was sent %q", sent)
+	}
+	if obj, ok := ms.State.Object("n1"); !ok || obj.Attrs["TEXT"] != "secret door" {
+		t.Errorf("GM's note was changed to %v", obj)
+	}
+
+	ms.ExecuteAction(testEvent(t, "OA n1 {TEXT {hidden door}}"), gm)
+	ms.ExecuteAction(testEvent(t, "OA t1 {TEXT hello}"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 0 {
+		t.Errorf("alice was sent %q", sent)
+	}
+	if sent := sentToTestClient(gm); len(sent) != 1 || sent[0] != "OA t1 {TEXT hello}" {
+		t.Errorf("GM was sent %q", sent)
+	}
+
+	ms.Sync(alice)
+	for _, m := range sentToTestClient(alice) {
+		if strings.Contains(m, "n1") {
+			t.Errorf("alice was sent %q in SYNC", m)
+		}
+	}
+	ms.Sync(gm)
+	found := false
+	for _, m := range sentToTestClient(gm) {
+		found = found || strings.Contains(m, "hidden door")
+	}
+	if !found {
+		t.Errorf("GM's note missing from SYNC")
+	}
+}
+
+func TestHandlers_DrawingQuota(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "DQ 2 0 3"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "2 elements, 20000 points in all, 3 points per element") {
+		t.Errorf("GM was sent %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "DQ 2 0 3"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV ") {
+		t.Errorf("alice's DQ gave %q", sent)
+	}
+
+	sendTestLS(t, ms, alice, "X:a1 1", "POINTS:a1 {1 2 3 4}", "X:a2 1")
+	sendTestLS(t, ms, alice, "X:a3 1", "POINTS:a3 {1 2 3 4 5 6}")
+	sendTestLS(t, ms, alice, "X:a4 1")
+	sendTestLS(t, ms, gm, "X:g1 1", "X:g2 1", "X:g3 1")
+	ms.ExecuteAction(testEvent(t, "OA a2 {POINTS {1 2 3 4 5 6 7 8}}"), alice)
+	var errors []string
+	for _, m := range sentToTestClient(alice) {
+		if strings.HasPrefix(m, "TO ") {
+			errors = append(errors, m)
+		}
+	}
+	if len(errors) != 3 {
+		t.Fatalf("alice was sent %q", errors)
+	}
+	for i, expected := range []string{"no element may have more than 3", "you may only have 2", "no element may have more than 3"} {
+		if !strings.Contains(errors[i], expected) {
+			t.Errorf("alice was sent %q, expected %q", errors[i], expected)
+		}
+	}
+	sentToTestClient(gm)
+
+	ms.ExecuteAction(testEvent(t, "DQ?"), gm)
+	sent := sentToTestClient(gm)
+	if len(sent) != 4 || sent[1] != "DQ=" || sent[2] != "DQ: alice 2 4" {
+		t.Errorf("DQ? gave %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "DQ- GM"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.Contains(sent[0], "only remove your own") {
+		t.Errorf("alice removing the GM's drawings gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "DQ- alice"), alice)
+	if sent := sentToTestClient(gm); len(sent) != 2 || sent[0] != "CLR a2" || sent[1] != "CLR a1" {
+		t.Errorf("GM was sent %q", sent)
+	}
+	if sent := sentToTestClient(alice); len(sent) != 3 || sent[2] != "// {Removed 2 map elements drawn by alice.}" {
+		t.Errorf("alice was sent %q", sent)
+	}
+	if _, ok := ms.State.Object("a1"); ok {
+		t.Errorf("a1 still on the map")
+	}
+	if _, ok := ms.State.Object("g1"); !ok {
+		t.Errorf("g1 removed from the map")
+	}
+	sendTestLS(t, ms, alice, "X:a5 1", "X:a6 1")
+	if sent := sentToTestClient(alice); len(sent) != 0 {
+		t.Errorf("alice was sent %q", sent)
+	}
+}
+
+func TestHandlers_Groups(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	sendTestLS(t, ms, gm, "X:door 100", "Y:door 200", "X:trap 110", "Y:trap 200", "LAYER:trap gm", "X:other 0", "Y:other 0")
+	ms.ExecuteAction(testEvent(t, "GR door {trap door}"), gm)
+	ms.ExecuteAction(testEvent(t, "GR door trap"), alice)
+	ms.ExecuteAction(testEvent(t, "GR door trap"), gm)
+	sentToTestClient(alice)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "can't be a member of its own group") {
+		t.Errorf("GM was sent %q", sent)
+	}
+	if members, ok := ms.State.Group("door"); !ok || len(members) != 1 || members[0] != "trap" {
+		t.Errorf("door's group is %v, %v", members, ok)
+	}
+
+	ms.ExecuteAction(testEvent(t, "OA door {X 150 Y 210}"), alice)
+	if sent := sentToTestClient(gm); len(sent) != 2 || sent[0] != "OA door {X 150 Y 210}" || sent[1] != "OA trap {X 160 Y 210}" {
+		t.Errorf("GM was sent %q", sent)
+	}
+	if sent := sentToTestClient(alice); len(sent) != 0 {
+		t.Errorf("alice was sent %q", sent)
+	}
+	if obj, _ := ms.State.Object("trap"); obj.Attrs["X"] != "160" || obj.Attrs["Y"] != "210" {
+		t.Errorf("trap was left at (%s, %s)", obj.Attrs["X"], obj.Attrs["Y"])
+	}
+
+	ms.Sync(alice)
+	found := false
+	for _, m := range sentToTestClient(alice) {
+		found = found || m == "GR door trap"
+	}
+	if !found {
+		t.Errorf("group missing from SYNC")
+	}
+
+	ms.ExecuteAction(testEvent(t, "CLR door"), gm)
+	if sent := sentToTestClient(alice); len(sent) != 2 || sent[0] != "GR door {}" || sent[1] != "CLR door" {
+		t.Errorf("alice was sent %q", sent)
+	}
+	for _, id := range []string{"door", "trap"} {
+		if _, ok := ms.State.Object(id); ok {
+			t.Errorf("%s is still on the map", id)
+		}
+	}
+	if _, ok := ms.State.Object("other"); !ok {
+		t.Errorf("other was removed from the map")
+	}
+	if _, ok := ms.State.Group("door"); ok {
+		t.Errorf("door's group is still defined")
+	}
+}
+
+func TestHandlers_Grid(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "GRID?"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "GRID square 5ft 0 0" {
+		t.Errorf("alice was sent %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "GRID hex 10ft 5 5"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV ") {
+		t.Errorf("alice's GRID gave %q", sent)
+	}
+
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/grid.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+
+	ms.ExecuteAction(testEvent(t, "GRID octagon 10ft 5 5"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "grid not changed") {
+		t.Errorf("GM was sent %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "GRID hex 10ft 5 -5"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || sent[0] != "// {Grid changed.}" {
+		t.Errorf("GM was sent %q", sent)
+	}
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "GRID hex 10ft 5 -5" {
+		t.Errorf("alice was sent %q", sent)
+	}
+
+	restarted := newTestService()
+	restarted.Storage = storage
+	if err := restarted.loadGridSettings(); err != nil {
+		t.Fatalf("unable to load grid settings: %v", err)
+	}
+	bob := newTestClient(restarted, "bob", "bob", false)
+	restarted.sendGridSettings(bob)
+	if sent := sentToTestClient(bob); len(sent) != 1 || sent[0] != "GRID hex 10ft 5 -5" {
+		t.Errorf("bob was sent %q after restart", sent)
+	}
+}
+
+func TestHandlers_MovementReservations(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	for _, raw := range []string{"PS 1 red Grax 1 M monster 3 4 0", "PS 2 blue Alice 1 M player 5 4 0", "PS 3 green Bush 1 M monster 5 6 0"} {
+		ms.ExecuteAction(testEvent(t, raw), gm)
+	}
+	sentToTestClient(alice)
+
+	ms.ExecuteAction(testEvent(t, "MV m1 Grax {4 4}"), alice)
+	ms.ExecuteAction(testEvent(t, "MV m1 Nobody {4 4}"), alice)
+	ms.ExecuteAction(testEvent(t, "MV m1 Alice {5 5 5 6}"), alice)
+	ms.ExecuteAction(testEvent(t, "MV m1 Alice {4 4}"), alice)
+	ms.ExecuteAction(testEvent(t, "MV m2 Grax {4 4}"), gm)
+	ms.ExecuteAction(testEvent(t, "MV m3 Grax {4 5}"), gm)
+	sent := append(sentToTestClient(alice), sentToTestClient(gm)...)
+	if len(sent) != 6 {
+		t.Fatalf("replies were %q", sent)
+	}
+	for i, expected := range []string{"MV- m1 {You can't move Grax}", "MV- m1 {There is no creature Nobody", "MV- m1 {The path runs into Bush at (5, 6)}", "MV+ m1", "MV- m2 {The path runs into Alice at (4, 4) on step 1}", "MV+ m3"} {
+		if !strings.HasPrefix(sent[i], expected) {
+			t.Errorf("reply %d was %q, expected %q", i, sent[i], expected)
+		}
+	}
+
+	ms.ExecuteAction(testEvent(t, "MV m1 Alice {}"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "MV- m1 Withdrawn" {
+		t.Errorf("withdrawal gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "MV m1 Alice {4 5}"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "MV- m1 {The path runs into Grax at (4, 5) on step 1}" {
+		t.Errorf("alice was sent %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "MV."), alice)
+	ms.ExecuteAction(testEvent(t, "MV."), gm)
+	if sent := sentToTestClient(alice); len(sent) != 2 || !strings.HasPrefix(sent[0], "PRIV ") || sent[1] != "MV." {
+		t.Errorf("alice was sent %q", sent)
+	}
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "1 path had been reserved") {
+		t.Errorf("GM was sent %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "MV m1 Alice {4 5}"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "MV+ m1" {
+		t.Errorf("alice was sent %q in the new round", sent)
+	}
+}
+
+func TestHandlers_FollowMe(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	bob := newTestClient(ms, "bob", "bob", false)
+
+	ms.ExecuteAction(testEvent(t, "AV 1 2"), alice)
+	if sent := sentToTestClient(bob); len(sent) != 1 || sent[0] != "AV 1 2" {
+		t.Errorf("bob was sent %q", sent)
+	}
+	sentToTestClient(gm)
+
+	ms.ExecuteAction(testEvent(t, "FM 1"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV ") {
+		t.Errorf("alice's FM gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "FM 1"), gm)
+	ms.ExecuteAction(testEvent(t, "FMO 1"), bob)
+	if sent := sentToTestClient(bob); len(sent) != 1 || sent[0] != "FM 1" {
+		t.Errorf("bob was sent %q", sent)
+	}
+	sentToTestClient(alice)
+
+	ms.ExecuteAction(testEvent(t, "AV 3 4"), alice)
+	if sent := append(sentToTestClient(bob), sentToTestClient(gm)...); len(sent) != 0 {
+		t.Errorf("alice's AV was sent as %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "AV 5 6"), gm)
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "AV 5 6" {
+		t.Errorf("alice was sent %q", sent)
+	}
+	if sent := sentToTestClient(bob); len(sent) != 0 {
+		t.Errorf("bob was sent %q after opting out", sent)
+	}
+	if ev, ok := ms.State.EventHistory["AV"]; !ok || ev.Fields[1] != "5" {
+		t.Errorf("GM's AV wasn't recorded")
+	}
+
+	carol := newTestClient(ms, "carol", "carol", false)
+	ms.sendFollowMode(carol)
+	if sent := sentToTestClient(carol); len(sent) != 1 || sent[0] != "FM 1" {
+		t.Errorf("carol was sent %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "FM 0"), gm)
+	ms.ExecuteAction(testEvent(t, "AV 7 8"), alice)
+	if sent := sentToTestClient(bob); len(sent) != 2 || sent[0] != "FM 0" || sent[1] != "AV 7 8" {
+		t.Errorf("bob was sent %q", sent)
+	}
+}
+
+func TestHandlers_Notes(t *testing.T) {
+	ms := newTestService()
+	alice := newTestClient(ms, "alice", "alice", false)
+	bob := newTestClient(ms, "bob", "bob", false)
+
+	ms.ExecuteAction(testEvent(t, "NT? loot"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.Contains(sent[0], "without a database") {
+		t.Errorf("NT? without storage gave %q", sent)
+	}
+
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/notes.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+
+	ms.ExecuteAction(testEvent(t, "NT loot {200gp and a wand}"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "// {Note loot saved.}" {
+		t.Errorf("NT gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "NT {} nothing"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.Contains(sent[0], "must have a title") {
+		t.Errorf("NT without title gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "NT?"), alice)
+	sent := sentToTestClient(alice)
+	if len(sent) != 3 || sent[0] != "NT=" || !strings.HasPrefix(sent[1], "NT: loot ") || !strings.HasSuffix(sent[1], " {200gp and a wand}") || !strings.HasPrefix(sent[2], "NT. 1 ") {
+		t.Errorf("NT? response was %q", sent)
+	}
+	if sent := sentToTestClient(bob); len(sent) != 0 {
+		t.Errorf("bob was sent %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "NT? loot"), bob)
+	if sent := sentToTestClient(bob); len(sent) != 2 || sent[0] != "NT=" || !strings.HasPrefix(sent[1], "NT. 0 ") {
+		t.Errorf("bob's NT? response was %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "NT- loot"), bob)
+	if sent := sentToTestClient(bob); len(sent) != 1 || sent[0] != "// {There is no note called loot.}" {
+		t.Errorf("bob's NT- gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "NT- loot"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "// {Note loot deleted.}" {
+		t.Errorf("NT- gave %q", sent)
+	}
+}
+
+func TestHandlers_Ledger(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	bob := newTestClient(ms, "bob", "bob", false)
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/ledger.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+
+	ms.ExecuteAction(testEvent(t, "XP {alice bob} 100 5 goblins"), alice)
+	sentToTestClient(alice)
+	ms.ExecuteAction(testEvent(t, "XP {alice bob} lots 5 goblins"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "must be an integer") {
+		t.Errorf("XP with bad value gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "XP {alice bob} 100 5 goblins"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || sent[0] != "// {Awarded 100 XP and 5 gp to 2 players.}" {
+		t.Errorf("XP gave %q", sent)
+	}
+	if sent := sentToTestClient(bob); len(sent) != 1 || !strings.Contains(sent[0], "awarded 100 XP and 5 gp: goblins") {
+		t.Errorf("bob was sent %q", sent)
+	}
+	sentToTestClient(alice)
+	ms.ExecuteAction(testEvent(t, "XP alice 50 0 {saved the mayor}"), gm)
+	sentToTestClient(gm)
+	sentToTestClient(alice)
+
+	ms.ExecuteAction(testEvent(t, "XP? bob"), alice)
+	sent := sentToTestClient(alice)
+	if len(sent) != 4 || sent[0] != "XP=" || !strings.HasSuffix(sent[2], " alice 50 0 {saved the mayor} GM 150 5") || !strings.HasPrefix(sent[3], "XP. 2 ") {
+		t.Errorf("alice's XP? response was %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "XP?"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 5 || !strings.HasPrefix(sent[4], "XP. 3 ") {
+		t.Errorf("GM's XP? response was %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "XP? bob"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 3 || !strings.HasSuffix(sent[1], " bob 100 5 goblins GM 100 5") {
+		t.Errorf("GM's XP? bob response was %q", sent)
+	}
+}
+
+func TestHandlers_ExportMap(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+
+	ms.ExecuteAction(testEvent(t, "EXPORT cave"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "not enabled") {
+		t.Errorf("EXPORT without a directory gave %q", sent)
+	}
+
+	ms.MapExportDir = t.TempDir()
+	sendTestLS(t, ms, gm, "TEXT:t1 {welcome}", "X:t1 5")
+	ms.ExecuteAction(testEvent(t, "EXPORT ../cave"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "may only contain") {
+		t.Errorf("EXPORT outside the directory gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "EXPORT cave {the goblin cave}"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || sent[0] != "// {Map exported to cave.map (1 objects).}" {
+		t.Errorf("EXPORT gave %q", sent)
+	}
+	data, err := os.ReadFile(filepath.Join(ms.MapExportDir, "cave.map"))
+	if err != nil {
+		t.Fatalf("unable to read exported map: %v", err)
+	}
+	if lines := strings.Split(string(data), "\n"); len(lines) != 4 || !strings.HasPrefix(lines[0], "__MAPPER__:17 {{the goblin cave} ") || lines[1] != "TEXT:t1 welcome" || lines[2] != "X:t1 5" {
+		t.Errorf("exported map was %q", lines)
+	}
+}
+
+func TestHandlers_DeployScene(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "SCENE crypt"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV ") {
+		t.Errorf("alice's SCENE gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "SCENE crypt"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "not enabled") {
+		t.Errorf("SCENE without a directory gave %q", sent)
+	}
+
+	ms.MapExportDir = t.TempDir()
+	scene := "__MAPPER__:17 {{Imported from uvtt: crypt} {0 {}}}\nIMAGE:t1 crypt\nTYPE:t1 tile\nX:t1 0\nLAYER:s1 gm\nTEXT:s1 {secret door}\n"
+	if err := os.WriteFile(filepath.Join(ms.MapExportDir, "crypt.map"), []byte(scene), 0644); err != nil {
+		t.Fatalf("unable to write scene: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(ms.MapExportDir, "crypt.png"), []byte("\x89PNG"), 0644); err != nil {
+		t.Fatalf("unable to write image: %v", err)
+	}
+	ms.ExecuteAction(testEvent(t, "SCENE ../crypt"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "may only contain") {
+		t.Errorf("SCENE outside the directory gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "SCENE crypt"), gm)
+	sent := sentToTestClient(gm)
+	if len(sent) != 11 || sent[0] != "AI crypt 1" || sent[1] != "AI: iVBORw==" || sent[3] != "LS" || sent[len(sent)-1] != "// {Scene crypt deployed (2 objects, 1 images).}" {
+		t.Errorf("GM was sent %q", sent)
+	}
+	if sent := sentToTestClient(alice); len(sent) != 8 || sent[3] != "LS" || strings.Contains(strings.Join(sent, "\n"), "secret") {
+		t.Errorf("alice was sent %q", sent)
+	}
+	if obj, ok := ms.State.Object("s1"); !ok || obj.Attrs["TEXT"] != "secret door" {
+		t.Errorf("scene object in game state was %v", obj)
+	}
+}
+
+func TestHandlers_APITokens(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/tokens.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+
+	ms.ExecuteAction(testEvent(t, "TK bot admin"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV ") {
+		t.Errorf("alice's TK gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "TK bot root"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "not understood") {
+		t.Errorf("TK with bad scope gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "TK bot chat 30"), gm)
+	sent := sentToTestClient(gm)
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "TK+ ") {
+		t.Fatalf("TK gave %q", sent)
+	}
+	fields := strings.Fields(sent[0])
+	if tk, ok, _ := storage.(TokenStorage).LookupAPIToken(HashAPIToken(fields[2])); !ok || tk.ID != fields[1] || tk.RateLimit != 30 {
+		t.Errorf("token %s stored as %+v", fields[2], tk)
+	}
+
+	ms.ExecuteAction(testEvent(t, "TK- "+fields[1]), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || sent[0] != "// {API token "+fields[1]+" revoked.}" {
+		t.Errorf("TK- gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "TK?"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 3 || !strings.HasPrefix(sent[1], "TK: "+fields[1]+" bot chat 30 ") || !strings.HasSuffix(sent[1], " 0 1") {
+		t.Errorf("TK? gave %q", sent)
+	}
+}
+
+func TestHandlers_DeadLetters(t *testing.T) {
+	ms := newTestService()
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/deadletters.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+	alice := newTestClient(ms, "alice", "alice", false)
+	bob := newTestClient(ms, "bob", "bob", false)
+
+	ms.ExecuteAction(testEvent(t, "TO alice {bob carol} {see you at the inn} 42"), alice)
+	sent := sentToTestClient(bob)
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "TO alice {bob carol} {see you at the inn} ") {
+		t.Errorf("bob was sent %q", sent)
+	}
+	if sent := sentToTestClient(alice); len(sent) != 2 || !strings.Contains(sent[0], "carol not connected") {
+		t.Errorf("alice was sent %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "TO alice * {hello all} 43"), alice)
+	sentToTestClient(alice)
+	sentToTestClient(bob)
+
+	carol := newTestClient(ms, "carol", "carol", false)
+	ms.sendPostAuthPreamble(carol, false)
+	var chat []string
+	for _, message := range sentToTestClient(carol) {
+		if strings.HasPrefix(message, "TO ") {
+			chat = append(chat, message)
+		}
+	}
+	if len(chat) != 1 || chat[0] != sent[0] {
+		t.Errorf("carol was sent %q", chat)
+	}
+	ms.sendPostAuthPreamble(carol, false)
+	for _, message := range sentToTestClient(carol) {
+		if strings.HasPrefix(message, "TO ") {
+			t.Errorf("carol was sent %q again", message)
+		}
+	}
+}
+
+func TestHandlers_NotifyWebhook(t *testing.T) {
+	ms := newTestService()
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/notify.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "NOTIFY https://hooks.example.com/alice"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.Contains(sent[0], "doesn't send notifications") {
+		t.Errorf("NOTIFY while disabled gave %q", sent)
+	}
+
+	ms.NotifyWebhooks = true
+	ms.ExecuteAction(testEvent(t, "NOTIFY ftp://hooks.example.com/alice"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.Contains(sent[0], "not accepted") {
+		t.Errorf("NOTIFY with bad URL gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "NOTIFY https://hooks.example.com/alice"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "// {While offline, you will be notified through https://hooks.example.com/alice.}" {
+		t.Errorf("NOTIFY gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "NOTIFY?"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "// {While offline, you will be notified through https://hooks.example.com/alice.}" {
+		t.Errorf("NOTIFY? gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "NOTIFY-"), alice)
+	sentToTestClient(alice)
+	ms.ExecuteAction(testEvent(t, "NOTIFY?"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "// {You are not notified while offline.}" {
+		t.Errorf("NOTIFY? after NOTIFY- gave %q", sent)
+	}
+}
+
+func TestHandlers_CharacterSheets(t *testing.T) {
+	ms := newTestService()
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/sheets.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+	alice := newTestClient(ms, "alice", "alice", false)
+	bob := newTestClient(ms, "bob", "bob", false)
+	gm := newTestClient(ms, "gm", "GM", true)
+
+	ms.ExecuteAction(testEvent(t, `SH Fizban 0 {{"str": 8}}`), alice)
+	if sent := sentToTestClient(alice); len(sent) != 2 || sent[0] != "SH! Fizban 1 alice alice" || sent[1] != "// {Character sheet Fizban saved as version 1.}" {
+		t.Errorf("SH gave %q", sent)
+	}
+	if sent := sentToTestClient(gm); len(sent) != 1 || sent[0] != "SH! Fizban 1 alice alice" {
+		t.Errorf("GM was sent %q", sent)
+	}
+	if sent := sentToTestClient(bob); len(sent) != 0 {
+		t.Errorf("bob was sent %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, `SH Fizban 1 {{"str": 18}}`), bob)
+	if sent := sentToTestClient(bob); len(sent) != 1 || !strings.Contains(sent[0], "belongs to alice") {
+		t.Errorf("bob's SH gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, `SH Fizban 0 {{"str": 9}}`), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "changed by someone else") {
+		t.Errorf("GM's SH of old version gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, `SH Fizban 1 {{"str": 9}}`), gm)
+	sentToTestClient(gm)
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "SH! Fizban 2 alice GM" {
+		t.Errorf("alice was sent %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, `SH Other 0 {not json}`), bob)
+	if sent := sentToTestClient(bob); len(sent) != 1 || !strings.Contains(sent[0], "not a valid JSON") {
+		t.Errorf("SH of bad JSON gave %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "SH?"), bob)
+	if sent := sentToTestClient(bob); len(sent) != 2 || sent[0] != "SH=" || !strings.HasPrefix(sent[1], "SH. 0 ") {
+		t.Errorf("bob's SH? gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "SH? Fizban"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 3 || !strings.HasPrefix(sent[1], "SH: Fizban alice 2 ") || !strings.HasSuffix(sent[1], ` GM {{"str": 9}}`) {
+		t.Errorf("alice's SH? gave %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "SH- Fizban"), bob)
+	if sent := sentToTestClient(bob); len(sent) != 1 || !strings.Contains(sent[0], "belongs to alice") {
+		t.Errorf("bob's SH- gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "SH- Fizban"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 2 || sent[0] != "SH! Fizban - alice alice" || sent[1] != "// {Character sheet Fizban deleted.}" {
+		t.Errorf("SH- gave %q", sent)
+	}
+}
+
+func TestHandlers_FudgeDieRoll(t *testing.T) {
+	var err error
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	if alice.dice, err = NewDieRoller(); err != nil {
+		t.Fatalf("unable to create die roller: %v", err)
+	}
+
+	ms.ExecuteAction(testEvent(t, "DF alice d20 {20 x}"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "positive integer") {
+		t.Errorf("DF with bad faces gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "DF alice d20 {20}"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV ") {
+		t.Errorf("DF from a player gave %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "DF alice d20 {20}"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.HasPrefix(sent[0], "// ") {
+		t.Errorf("DF response was %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "D * d20"), alice)
+	sent := sentToTestClient(alice)
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "ROLL alice * {} 20 ") || strings.Contains(sent[0], "fudged") {
+		t.Errorf("player's copy of fudged roll was %q", sent)
+	}
+	sent = sentToTestClient(gm)
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "ROLL alice * {} 20 ") || !strings.Contains(sent[0], "{fudged 20}") {
+		t.Errorf("GM's copy of fudged roll was %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "D * d20"), alice)
+	if sent := sentToTestClient(gm); len(sent) != 1 || strings.Contains(sent[0], "fudged") {
+		t.Errorf("fudge was used twice: %q", sent)
+	}
+	sentToTestClient(alice)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,199 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                               Message handler timing                               //
+//                                                                                    //
+// How long it takes us to handle each type of message clients send, so an operator   //
+// can see when (say) a slow database call has crept into the chat path, with a       //
+// warning in the log whenever a single message takes too long.                       //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Unless configured otherwise, we log a warning whenever handling a
+// single message from a client takes longer than this.
+//
+const DefaultSlowHandlerThreshold = 250 * time.Millisecond
+
+//
+// HandlerTimeBuckets are the upper bounds of the histogram buckets
+// we sort each message's handling time into. There is one more
+// bucket after these for anything slower.
+//
+var HandlerTimeBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	25 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	2500 * time.Millisecond,
+}
+
+//
+// How much of a slow message we show in the warning about it.
+//
+const maxSlowHandlerSummary = 100
+
+//
+// HandlerStats describes how long we have taken to handle one type of
+// message since the server started.
+//
+type HandlerStats struct {
+	Type    string  `json:"type"`
+	Count   int64   `json:"count"`   // messages handled
+	Total   float64 `json:"total"`   // total seconds spent handling them
+	Max     float64 `json:"max"`     // longest time in seconds
+	Slow    int64   `json:"slow"`    // times it took longer than the slow handler threshold
+	Buckets []int64 `json:"buckets"` // how many fell into each of HandlerTimeBuckets, then how many were slower still
+}
+
+func handlerBucketSeconds() []float64 {
+	bounds := make([]float64, len(HandlerTimeBuckets))
+	for i, b := range HandlerTimeBuckets {
+		bounds[i] = b.Seconds()
+	}
+	return bounds
+}
+
+//
+// handlerTimings keeps a HandlerStats for each message type.
+//
+type handlerTimings struct {
+	lock   sync.Mutex
+	byType map[string]*HandlerStats
+}
+
+func (h *handlerTimings) record(eventType string, elapsed time.Duration, slow bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.byType == nil {
+		h.byType = make(map[string]*HandlerStats)
+	}
+	s, ok := h.byType[eventType]
+	if !ok {
+		s = &HandlerStats{Type: eventType, Buckets: make([]int64, len(HandlerTimeBuckets)+1)}
+		h.byType[eventType] = s
+	}
+	s.Count++
+	s.Total += elapsed.Seconds()
+	if elapsed.Seconds() > s.Max {
+		s.Max = elapsed.Seconds()
+	}
+	if slow {
+		s.Slow++
+	}
+	b := sort.Search(len(HandlerTimeBuckets), func(i int) bool { return elapsed <= HandlerTimeBuckets[i] })
+	s.Buckets[b]++
+}
+
+//
+// HandlerStats reports how long we have taken to handle each type of
+// message clients have sent us, sorted by type.
+//
+func (ms *MapService) HandlerStats() []HandlerStats {
+	ms.handlerTimes.lock.Lock()
+	defer ms.handlerTimes.lock.Unlock()
+
+	stats := make([]HandlerStats, 0, len(ms.handlerTimes.byType))
+	for _, s := range ms.handlerTimes.byType {
+		c := *s
+		c.Buckets = append([]int64(nil), s.Buckets...)
+		stats = append(stats, c)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Type < stats[j].Type })
+	return stats
+}
+
+//
+// How long handling a message may take before we warn about it.
+// Zero or less means we never do.
+//
+func (ms *MapService) slowHandlerThreshold() time.Duration {
+	if ms.SlowHandler == 0 {
+		return DefaultSlowHandlerThreshold
+	}
+	return ms.SlowHandler
+}
+
+//
+// Note that we have finished handling an event from a client, having
+// started at the given time. If that took too long, we log a warning
+// with enough of the message to see what it was.
+//
+func (ms *MapService) timeHandler(event *MapEvent, thisClient *MapClient, start time.Time) {
+	elapsed := time.Since(start)
+	threshold := ms.slowHandlerThreshold()
+	slow := threshold > 0 && elapsed > threshold
+	ms.handlerTimes.record(event.EventType(), elapsed, slow)
+	if slow {
+		summary := strings.Join(event.Fields, " ")
+		if len(summary) > maxSlowHandlerSummary {
+			summary = summary[:maxSlowHandlerSummary] + "..."
+		}
+		log.Printf("[client %s] WARNING: %s event took %v to handle: %s", thisClient.logTag(), event.EventType(), elapsed, summary)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,102 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for message handler timing
+//
+
+package mapservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandlerTimings(t *testing.T) {
+	ms := &MapService{}
+	h := &ms.handlerTimes
+	h.record("M", 500*time.Microsecond, false)
+	h.record("M", 3*time.Millisecond, false)
+	h.record("M", 3*time.Second, true)
+	h.record("//", time.Millisecond, false)
+
+	stats := ms.HandlerStats()
+	if len(stats) != 2 || stats[0].Type != "//" || stats[1].Type != "M" {
+		t.Fatalf("stats are %v", stats)
+	}
+	m := stats[1]
+	if m.Count != 3 || m.Slow != 1 || m.Max != 3 || len(m.Buckets) != len(HandlerTimeBuckets)+1 {
+		t.Errorf("M stats are %v", m)
+	}
+	if m.Buckets[0] != 1 || m.Buckets[1] != 1 || m.Buckets[len(HandlerTimeBuckets)] != 1 {
+		t.Errorf("M buckets are %v", m.Buckets)
+	}
+	if stats[0].Buckets[0] != 1 {
+		t.Errorf("// buckets are %v", stats[0].Buckets)
+	}
+}
+
+func TestHandlerTimings_Execute(t *testing.T) {
+	ms := newTestService()
+	ms.SlowHandler = -1
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "// hello"), alice)
+	ms.ExecuteAction(testEvent(t, "// again"), alice)
+	ms.ExecuteAction(testEvent(t, "CO 1"), alice)
+	stats := ms.HandlerStats()
+	if len(stats) != 2 || stats[0].Type != "//" || stats[0].Count != 2 || stats[1].Type != "CO" || stats[1].Count != 1 || stats[0].Slow != 0 {
+		t.Errorf("stats are %v", stats)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,901 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                      HTTP API                                      //
+//                                                                                    //
+// A small HTTP interface so programs outside the game (bots, web pages, and the      //
+// like) can see what's going on and post to the chat, using API tokens issued by the //
+// GM.                                                                                //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// HTTPHandler returns the handler for the server's HTTP API. Every
+// request must carry an API token (see TK) as
+//   Authorization: Bearer <token>
+// whose scope allows what it is asking for. The API is:
+//   GET    /api/v1/clients       (read)  who is connected
+//   GET    /api/v1/state         (read)  the game state (see apiGameState)
+//   GET    /api/v1/state/<part>  (read)  part of the game state
+//   GET    /api/v1/feed          (read)  public game events for stream overlays
+//   GET    /api/v1/metrics       (read)  the server's recent metrics history
+//   GET    /api/v1/replica       (admin) the journal, for a standby server to mirror
+//   GET    /api/v1/standby       (read)  how this server is getting on as a standby
+//   POST   /api/v1/standby       (admin) promote this standby server to take over
+//   GET    /api/v1/bandwidth     (admin) network traffic caused by each user
+//   DELETE /api/v1/bandwidth     (admin) start counting traffic again
+//   GET    /api/v1/security      (admin) the security event log
+//   GET    /api/v1/log           (admin) the last lines written to the server's log
+//   POST   /api/v1/chat          (chat)  send a chat message
+//   GET    /api/v1/chatlog       (admin) export the chat history
+//   GET    /api/v1/tokens        (admin) list the API tokens
+//   POST   /api/v1/tokens        (admin) issue a new API token
+//   DELETE /api/v1/tokens/<id>   (admin) revoke an API token
+//   GET    /api/v1/sheets        (read)  list the character sheets
+//   GET    /api/v1/sheets/<name> (read)  get a character sheet
+//   PUT    /api/v1/sheets/<name> (admin) save a character sheet
+//   DELETE /api/v1/sheets/<name> (admin) delete a character sheet
+//   GET    /api/v1/presets/<user> (admin) export a user's die-roll presets
+//   POST   /api/v1/presets/<user> (admin) add to a user's die-roll presets
+//   PUT    /api/v1/presets/<user> (admin) replace a user's die-roll presets
+//   GET    /api/v1/history/<id>  (read)  the changes made to an object
+//   POST   /api/v1/maps/import   (admin) convert another tabletop's map
+//   POST   /api/v1/session       (none)  log a browser in
+//   DELETE /api/v1/session       (none)  log a browser out
+//   GET    /api/v1/schema        (none)  the protocol schema (see Schema)
+// The public status page (see serveStatusPage) is served at /.
+// Replies are JSON objects; errors are {"error": <message>}. Every
+// request is recorded in the audit log. A browser may present its token
+// in a session cookie instead (see apiSession), and pages from the
+// AllowedOrigins may make requests from other sites.
+//
+func (ms *MapService) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/clients", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeReadOnly}, ms.apiClients))
+	mux.HandleFunc("/api/v1/state", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeReadOnly}, ms.apiGameState))
+	mux.HandleFunc("/api/v1/state/", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeReadOnly}, ms.apiGameState))
+	mux.HandleFunc(FeedPath, ms.apiEndpoint(map[string]string{http.MethodGet: ScopeReadOnly}, ms.apiFeed))
+	mux.HandleFunc("/api/v1/metrics", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeReadOnly}, ms.apiMetrics))
+	mux.HandleFunc(ReplicaPath, ms.apiEndpoint(map[string]string{http.MethodGet: ScopeAdmin}, ms.apiReplica))
+	mux.HandleFunc("/api/v1/standby", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeReadOnly, http.MethodPost: ScopeAdmin}, ms.apiStandby))
+	mux.HandleFunc("/api/v1/bandwidth", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeAdmin, http.MethodDelete: ScopeAdmin}, ms.apiBandwidth))
+	mux.HandleFunc("/api/v1/security", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeAdmin}, ms.apiSecurityEvents))
+	mux.HandleFunc("/api/v1/log", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeAdmin}, ms.apiLog))
+	mux.HandleFunc("/api/v1/chat", ms.apiEndpoint(map[string]string{http.MethodPost: ScopeChat}, ms.apiChat))
+	mux.HandleFunc("/api/v1/chatlog", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeAdmin}, ms.apiChatLog))
+	mux.HandleFunc("/api/v1/tokens", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeAdmin, http.MethodPost: ScopeAdmin}, ms.apiTokens))
+	mux.HandleFunc("/api/v1/tokens/", ms.apiEndpoint(map[string]string{http.MethodDelete: ScopeAdmin}, ms.apiRevokeToken))
+	mux.HandleFunc("/api/v1/sheets", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeReadOnly}, ms.apiCharacterSheets))
+	mux.HandleFunc("/api/v1/sheets/", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeReadOnly, http.MethodPut: ScopeAdmin, http.MethodDelete: ScopeAdmin}, ms.apiCharacterSheet))
+	mux.HandleFunc("/api/v1/presets/", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeAdmin, http.MethodPost: ScopeAdmin, http.MethodPut: ScopeAdmin}, ms.apiDicePresets))
+	mux.HandleFunc("/api/v1/history/", ms.apiEndpoint(map[string]string{http.MethodGet: ScopeReadOnly}, ms.apiObjectHistory))
+	mux.HandleFunc("/api/v1/maps/import", ms.apiEndpointLimit(map[string]string{http.MethodPost: ScopeAdmin}, MaxMapImportSize, ms.apiImportMap))
+	mux.HandleFunc("/api/v1/session", ms.apiEndpoint(map[string]string{http.MethodPost: "", http.MethodDelete: ""}, ms.apiSession))
+	mux.HandleFunc(JoinPath, ms.apiEndpoint(map[string]string{http.MethodGet: ""}, ms.apiJoinQR))
+	mux.HandleFunc(SchemaPath, ms.apiEndpoint(map[string]string{http.MethodGet: ""}, ms.apiSchema))
+	mux.HandleFunc("/healthz", ms.serveHealth)
+	mux.HandleFunc("/", ms.serveStatusPage)
+	mux.Handle("/static/", staticFiles())
+	return ms.withCORS(mux)
+}
+
+//
+// An apiHandlerFunc handles an API request made with a token which
+// has already been checked.
+//
+type apiHandlerFunc func(w http.ResponseWriter, r *http.Request, t APIToken)
+
+//
+// statusRecorder remembers the status of the response to an API
+// request so it can be audited.
+//
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//
+// Wrap an API handler so that it only accepts the given methods, each
+// of which needs a token with the given scope (or none, if the scope
+// is ""), and every request made to it (whether it is allowed or not)
+// is recorded in the audit log. We don't look at the body of a request
+// until we know it is allowed, and then only up to MaxAPIBodySize bytes
+// of it.
+//
+func (ms *MapService) apiEndpoint(scopes map[string]string, handle apiHandlerFunc) http.HandlerFunc {
+	return ms.apiEndpointLimit(scopes, MaxAPIBodySize, handle)
+}
+
+//
+// Same, but accepting request bodies of up to limit bytes.
+//
+func (ms *MapService) apiEndpointLimit(scopes map[string]string, limit int64, handle apiHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var t APIToken
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		params, _ := apiParameters(r, false)
+		allowed := false
+
+		if scope, ok := scopes[r.Method]; !ok {
+			var methods []string
+			for method := range scopes {
+				methods = append(methods, method)
+			}
+			sort.Strings(methods)
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			apiError(rec, http.StatusMethodNotAllowed, "%s not allowed here", r.Method)
+		} else if scope == "" {
+			allowed = true
+		} else {
+			t, allowed = ms.apiToken(rec, r, scope)
+		}
+		if allowed {
+			r.Body = http.MaxBytesReader(rec, r.Body, limit)
+			var err error
+			if params, err = apiParameters(r, true); err != nil {
+				apiBodyError(rec, err)
+			} else {
+				handle(rec, r, t)
+			}
+		}
+		ms.auditAPIRequest(r, t, params, rec.status)
+	}
+}
+
+//
+// MaxAPIBodySize is the largest request body (in bytes) we accept
+// from an API client, except for maps to be imported, which may be
+// up to MaxMapImportSize.
+//
+const MaxAPIBodySize = 1024 * 1024
+const MaxMapImportSize = 16 * 1024 * 1024
+
+//
+// Reply to a request whose body we couldn't read, which is most likely
+// because it was larger than we allow.
+//
+func apiBodyError(w http.ResponseWriter, err error) {
+	if strings.Contains(err.Error(), "request body too large") {
+		apiError(w, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	apiError(w, http.StatusBadRequest, "unable to read request: %v", err)
+}
+
+//
+// Parameter names whose values never go in the audit log.
+//
+var redactedAPIParameters = []string{"token", "password", "secret"}
+
+//
+// Longest parameter value we put in the audit log.
+//
+const maxAuditedParameter = 100
+
+//
+// Collect the parameters of an API request (from the URL query and,
+// if withBody is set, for a JSON object body, its top-level fields) for
+// the audit log, with any secrets redacted and long values cut short.
+// The body is left for the handler to read. If it can't be read, we
+// return the error along with the parameters we could collect.
+//
+func apiParameters(r *http.Request, withBody bool) (map[string]string, error) {
+	var err error
+	params := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		params[name] = strings.Join(values, ",")
+	}
+	if withBody && r.Body != nil {
+		var body []byte
+		body, err = io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var fields map[string]json.RawMessage
+		if err == nil && json.Unmarshal(body, &fields) == nil {
+			for name, value := range fields {
+				var s string
+				if json.Unmarshal(value, &s) == nil {
+					params[name] = s
+				} else {
+					params[name] = string(value)
+				}
+			}
+		}
+	}
+	for name, value := range params {
+		for _, secret := range redactedAPIParameters {
+			if strings.Contains(strings.ToLower(name), secret) {
+				value = "[redacted]"
+			}
+		}
+		if len(value) > maxAuditedParameter {
+			value = value[:maxAuditedParameter] + "..."
+		}
+		params[name] = value
+	}
+	return params, err
+}
+
+//
+// Record an API request in the audit log, noting who made it (by token)
+// and how it turned out.
+//
+func (ms *MapService) auditAPIRequest(r *http.Request, t APIToken, params map[string]string, status int) {
+	details := map[string]string{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"status": strconv.Itoa(status),
+	}
+	for name, value := range params {
+		details["param."+name] = value
+	}
+	user := "unknown"
+	if t.ID != "" {
+		user = t.Name
+		details["token"] = t.ID
+	}
+	ms.recordAudit(AuditRecord{
+		Time:    time.Now(),
+		User:    user,
+		Client:  r.RemoteAddr,
+		Action:  "api-request",
+		Details: details,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("[api] unable to send response: %v", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, message string, args ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(message, args...)})
+}
+
+//
+// Check the API token presented with a request. It must exist, not
+// be revoked, allow the given scope, and be within its rate limit.
+// If all is well, we note that it was used and return it; otherwise
+// the caller is told why not and we return false.
+//
+func (ms *MapService) apiToken(w http.ResponseWriter, r *http.Request, scope string) (APIToken, bool) {
+	storage, ok := ms.Storage.(TokenStorage)
+	if !ok {
+		apiError(w, http.StatusServiceUnavailable, "API tokens can't be used without a database")
+		return APIToken{}, false
+	}
+	token, ok := ms.requestToken(r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, "an API token is required")
+		ms.securityEvent(SecurityAuthFailure, "", r.RemoteAddr, "no API token given for "+r.URL.Path)
+		return APIToken{}, false
+	}
+	t, found, err := storage.LookupAPIToken(HashAPIToken(token))
+	if err != nil {
+		log.Printf("[api %s] %v", r.RemoteAddr, err)
+		apiError(w, http.StatusInternalServerError, "unable to check API token")
+		return APIToken{}, false
+	}
+	if !found || t.Revoked {
+		log.Printf("[api %s] rejected unknown or revoked API token for %s", r.RemoteAddr, r.URL.Path)
+		apiError(w, http.StatusUnauthorized, "invalid API token")
+		ms.securityEvent(SecurityAuthFailure, "", r.RemoteAddr, "unknown or revoked API token given for "+r.URL.Path)
+		return APIToken{}, false
+	}
+	if !t.Allows(scope) {
+		log.Printf("[api %s] API token %s (%s) may not be used for %s", r.RemoteAddr, t.ID, t.Scope, r.URL.Path)
+		apiError(w, http.StatusForbidden, "this API token does not have %s scope", scope)
+		ms.securityEvent(SecurityPrivilege, t.ID, r.RemoteAddr, fmt.Sprintf("API token with %s scope used for %s", t.Scope, r.URL.Path))
+		return APIToken{}, false
+	}
+	now := time.Now()
+	if t.RateLimit > 0 {
+		if err := ms.apiRate.allow(t.ID, 1, t.RateLimit, now); err != nil {
+			apiError(w, http.StatusTooManyRequests, "this API token is limited to %d requests per minute", t.RateLimit)
+			ms.securityEvent(SecurityRateLimit, t.ID, r.RemoteAddr, err.Error())
+			return APIToken{}, false
+		}
+	}
+	if err := storage.TouchAPIToken(t.ID, now); err != nil {
+		log.Printf("[api %s] unable to record use of API token %s: %v", r.RemoteAddr, t.ID, err)
+	}
+	t.LastUsed = now
+	return t, true
+}
+
+//
+// GET /api/v1/clients
+//   {"clients": [{"user": <name>, "gm": <bool>}, ...]}
+//
+func (ms *MapService) apiClients(w http.ResponseWriter, r *http.Request, t APIToken) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clients": ms.apiConnectedClients()})
+}
+
+//
+// GET /api/v1/metrics[?since=<duration>]
+//   {"interval": <seconds>, "samples": [<MetricSample>, ...],
+//    "slow_clients": [<SlowClientReport>, ...], "locks": [<LockStats>, ...],
+//    "journal": <JournalStats>, "abandoned_transfers": <n>,
+//    "duplicates_dropped": <n>, "handlers": [<HandlerStats>, ...],
+//    "handler_buckets": [<seconds>, ...]}
+// The samples are from the last <duration> (e.g. "1h"), or all we
+// have (up to a day's worth) if that isn't given. The slow client
+// reports are the most recent ones, however old they are, and the lock
+// and journal figures, counts of stalled transfers abandoned and
+// duplicate messages dropped, and message handling times are since the
+// server started (the journal is null if there isn't one). The
+// handler_buckets are the upper bounds of the histogram buckets in
+// each HandlerStats, which has one more bucket for anything slower.
+//
+func (ms *MapService) apiMetrics(w http.ResponseWriter, r *http.Request, t APIToken) {
+	since := time.Time{}
+	if s := r.URL.Query().Get("since"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			apiError(w, http.StatusBadRequest, "since must be a duration such as 1h")
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+	var journal *JournalStats
+	if ms.Journal != nil {
+		stats := ms.Journal.Stats()
+		journal = &stats
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"interval":            MetricsInterval.Seconds(),
+		"samples":             ms.MetricsSince(since),
+		"slow_clients":        ms.SlowClientReports(),
+		"locks":               ms.State.LockStats(),
+		"journal":             journal,
+		"abandoned_transfers": ms.AbandonedTransfers(),
+		"duplicates_dropped":  ms.DuplicatesDropped(),
+		"handlers":            ms.HandlerStats(),
+		"handler_buckets":     handlerBucketSeconds(),
+	})
+}
+
+//
+// GET /api/v1/bandwidth
+//   {"usage": [{"user": ..., "bytes_in": ..., "bytes_out": ...,
+//               "since": ...}, ...], "warning": <soft cap>}
+// DELETE /api/v1/bandwidth
+//   resets everyone's totals to zero
+//
+func (ms *MapService) apiBandwidth(w http.ResponseWriter, r *http.Request, t APIToken) {
+	if r.Method == http.MethodDelete {
+		if err := ms.ResetBandwidth(); err != nil {
+			apiError(w, http.StatusInternalServerError, "unable to reset bandwidth totals: %v", err)
+			return
+		}
+		log.Printf("[api %s] bandwidth totals reset by %s", r.RemoteAddr, t.ID)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"usage":   ms.BandwidthUsage(),
+		"warning": ms.BandwidthWarning,
+	})
+}
+
+//
+// GET /api/v1/security[?since=<duration>][&limit=<n>]
+//   {"events": [<SecurityEvent>, ...]}
+// The events are from the last <duration> (e.g. "24h"), or as far back
+// as we have them if that isn't given, oldest first. With a limit, only
+// the most recent <n> are sent.
+//
+func (ms *MapService) apiSecurityEvents(w http.ResponseWriter, r *http.Request, t APIToken) {
+	since := time.Time{}
+	if s := r.URL.Query().Get("since"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			apiError(w, http.StatusBadRequest, "since must be a duration such as 24h")
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			apiError(w, http.StatusBadRequest, "limit must be a whole number")
+			return
+		}
+		limit = n
+	}
+	events, err := ms.SecurityEventsSince(since, limit)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "unable to read security events: %v", err)
+		return
+	}
+	if events == nil {
+		events = []SecurityEvent{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": events})
+}
+
+//
+// GET /api/v1/log[?limit=<n>][&match=<text>][&topic=<topic>]
+//   {"lines": [<line>, ...]}
+// The lines are the most recent ones the server has logged (only
+// those containing <text>, such as a trace ID, if that is given),
+// oldest first. With a limit, only the last <n> are sent. With a
+// topic, they're the debugging messages on that topic instead, if
+// those are being kept in a buffer (see SetDebugSinks).
+//
+func (ms *MapService) apiLog(w http.ResponseWriter, r *http.Request, t APIToken) {
+	buffer := ms.LogBuffer
+	if topic := r.URL.Query().Get("topic"); topic != "" {
+		if buffer = debugBuffer(DebugTopic(topic)); buffer == nil {
+			apiError(w, http.StatusNotFound, "debugging messages on %s aren't being kept", topic)
+			return
+		}
+	} else if buffer == nil {
+		apiError(w, http.StatusServiceUnavailable, "the server isn't keeping its recent log lines")
+		return
+	}
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			apiError(w, http.StatusBadRequest, "limit must be a whole number")
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"lines": buffer.Lines(limit, r.URL.Query().Get("match"))})
+}
+
+//
+// GET /api/v1/sheets
+//   {"sheets": [{"name": ..., "owner": ..., "version": ...,
+//                "modified": ..., "modified_by": ...}, ...]}
+// Only the sheets owned by the token's name are listed, unless it's an
+// admin token.
+//
+func (ms *MapService) apiCharacterSheets(w http.ResponseWriter, r *http.Request, t APIToken) {
+	storage, ok := ms.Storage.(CharacterSheetStorage)
+	if !ok {
+		apiError(w, http.StatusServiceUnavailable, "character sheets can't be stored without a database")
+		return
+	}
+	sheets, err := storage.ListCharacterSheets()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "unable to read character sheets: %v", err)
+		return
+	}
+	visible := []CharacterSheet{}
+	for _, sheet := range sheets {
+		if sheet.Allows(t.Name, t.Allows(ScopeAdmin)) {
+			visible = append(visible, sheet)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sheets": visible})
+}
+
+//
+// GET /api/v1/sheets/<name>
+//   {"name": ..., "owner": ..., "version": ..., "modified": ...,
+//    "modified_by": ..., "document": <sheet>}
+// (Another player's sheet is not found unless it's an admin token.)
+// PUT /api/v1/sheets/<name>
+//   {"version": <base-version>, "owner": <user>, "document": <sheet>}
+// The change must be based on the current version (0 for a new sheet,
+// which belongs to the given owner, or the token's name if none is
+// given). Replies with the sheet as saved (without its document), or
+// 409 if it was changed by someone else in the mean time.
+// DELETE /api/v1/sheets/<name>
+//   {"deleted": <name>}
+// Changes are made by the token's name, with the GM's authority.
+//
+func (ms *MapService) apiCharacterSheet(w http.ResponseWriter, r *http.Request, t APIToken) {
+	storage, ok := ms.Storage.(CharacterSheetStorage)
+	if !ok {
+		apiError(w, http.StatusServiceUnavailable, "character sheets can't be stored without a database")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/sheets/")
+	switch r.Method {
+		case http.MethodGet:
+			sheet, found, err := storage.LoadCharacterSheet(name)
+			if err != nil {
+				apiError(w, http.StatusInternalServerError, "unable to read character sheet: %v", err)
+			} else if !found || !sheet.Allows(t.Name, t.Allows(ScopeAdmin)) {
+				apiError(w, http.StatusNotFound, "there is no character sheet %s", name)
+			} else {
+				writeJSON(w, http.StatusOK, sheet)
+			}
+
+		case http.MethodPut:
+			var request struct {
+				Version  int             `json:"version"`
+				Owner    string          `json:"owner"`
+				Document json.RawMessage `json:"document"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				apiError(w, http.StatusBadRequest, "request not understood: %v", err)
+				return
+			}
+			if request.Owner == "" {
+				request.Owner = t.Name
+			}
+			sheet, err := ms.saveCharacterSheet(storage, t.Name, true, request.Owner, name, request.Version, request.Document)
+			if err == ErrSheetVersion {
+				apiError(w, http.StatusConflict, "%v", err)
+			} else if err != nil {
+				apiError(w, http.StatusBadRequest, "%v", err)
+			} else {
+				sheet.Document = nil
+				writeJSON(w, http.StatusOK, sheet)
+			}
+
+		case http.MethodDelete:
+			found, err := ms.deleteCharacterSheet(storage, t.Name, true, name)
+			if err != nil {
+				apiError(w, http.StatusInternalServerError, "unable to delete character sheet: %v", err)
+			} else if !found {
+				apiError(w, http.StatusNotFound, "there is no character sheet %s", name)
+			} else {
+				writeJSON(w, http.StatusOK, map[string]string{"deleted": name})
+			}
+	}
+}
+
+//
+// GET /api/v1/presets/<user>?format=<format>
+// The user's die-roll presets as a file in the given format (json, the
+// default, or csv).
+// POST /api/v1/presets/<user>?format=<format>
+// PUT /api/v1/presets/<user>?format=<format>
+//   <file contents>
+// Import die-roll presets for the user from a file in the given format,
+// merged with their existing presets (POST) or replacing them (PUT).
+// Replies with
+//   {"imported": <count>, "presets": <count they now have>}
+// or, if any rows of the file are wrong (in which case nothing is
+// imported), 400 with
+//   {"error": <message>, "rows": [{"row": <row>, "error": <message>}, ...]}
+//
+func (ms *MapService) apiDicePresets(w http.ResponseWriter, r *http.Request, t APIToken) {
+	user := strings.TrimPrefix(r.URL.Path, "/api/v1/presets/")
+	if user == "" {
+		apiError(w, http.StatusNotFound, "no user given")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = PresetFormatJSON
+	}
+
+	if r.Method == http.MethodGet {
+		var file bytes.Buffer
+		if err := ExportDicePresets(&file, format, ms.DicePresets(user)); err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if format == PresetFormatCSV {
+			w.Header().Set("Content-Type", "text/csv")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-presets.%s\"", user, format))
+		w.Write(file.Bytes())
+		return
+	}
+
+	if ms.Storage == nil {
+		apiError(w, http.StatusServiceUnavailable, "die-roll presets can't be stored without a database")
+		return
+	}
+	mode := PresetImportMerge
+	if r.Method == http.MethodPut {
+		mode = PresetImportReplace
+	}
+	presets, problems, err := ImportDicePresets(r.Body, format, ms.DiceLimits)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "presets not imported: %v", err)
+		return
+	}
+	if problems != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": fmt.Sprintf("presets not imported, since %d rows of the file had problems", len(problems)),
+			"rows":  problems,
+		})
+		return
+	}
+	total, err := ms.importDicePresets(user, mode, presets)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "presets not imported: %v", err)
+		return
+	}
+	log.Printf("[api %s] %s imported %d die-roll presets for %s (%s)", r.RemoteAddr, t.Name, len(presets), user, mode)
+	writeJSON(w, http.StatusOK, map[string]int{"imported": len(presets), "presets": total})
+}
+
+//
+// POST /api/v1/maps/import?format=<format>&name=<name>
+//   <map data>
+// Convert a map exported from another tabletop (see ImportMap) and
+// save it as <name>.map in the MapExportDir (if no name is given, the
+// name it had there is used). Replies with
+//   {"file": <file name>, "objects": <count>}
+// Maps larger than MaxMapImportSize are refused with status 413.
+//
+func (ms *MapService) apiImportMap(w http.ResponseWriter, r *http.Request, t APIToken) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxMapImportSize))
+	if err != nil {
+		apiBodyError(w, err)
+		return
+	}
+	path, count, err := ms.importMap(r.URL.Query().Get("format"), r.URL.Query().Get("name"), data)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "map not imported: %v", err)
+		return
+	}
+	log.Printf("[api %s] %s imported as %s (%d objects)", r.RemoteAddr, t.Name, path, count)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"file": filepath.Base(path), "objects": count})
+}
+
+//
+// GET /api/v1/chatlog?format=<format>
+// The whole chat history, including private messages and die rolls, as
+// a list of ChatLogEntries (format gma, the default) or as Foundry VTT
+// chat messages (format foundry). See exportChatLog.
+//
+func (ms *MapService) apiChatLog(w http.ResponseWriter, r *http.Request, t APIToken) {
+	history, err := ms.exportChatLog(r.URL.Query().Get("format"), time.Now())
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+//
+// POST /api/v1/chat
+//   {"to": [<user>, ...], "text": <message>}
+// The message comes from the token's name. Send it to "*" for everyone.
+//
+func (ms *MapService) apiChat(w http.ResponseWriter, r *http.Request, t APIToken) {
+	var request struct {
+		To   []string `json:"to"`
+		Text string   `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		apiError(w, http.StatusBadRequest, "request not understood: %v", err)
+		return
+	}
+	if len(request.To) == 0 || request.Text == "" {
+		apiError(w, http.StatusBadRequest, "chat messages need recipients and text")
+		return
+	}
+	id, err := ms.postChat(t.Name, request.To, request.Text)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "message not sent: %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"id": id})
+}
+
+//
+// Send a chat message which didn't come from any client, returning
+// its message ID.
+//
+func (ms *MapService) postChat(from string, to_list []string, text string) (string, error) {
+	text, err := filterChat(from, to_list, text)
+	if err != nil {
+		return "", err
+	}
+	recipients, err := ToTclString(to_list)
+	if err != nil {
+		return "", err
+	}
+	fields := []string{"TO", from, recipients, text, ""}
+	raw, err := ToTclString(fields)
+	if err != nil {
+		return "", err
+	}
+	event, err := NewMapEventFromList(raw, fields, "", "")
+	if err != nil {
+		return "", err
+	}
+	defer ms.order.hold(ChatStream)()
+	ms.addChatMessage(event)
+
+	to_all := false
+	for _, recipient := range to_list {
+		if recipient == "*" {
+			to_all = true
+		}
+	}
+	peers := ms.AllClients()
+	if !to_all {
+		peers = ms.Clients.ByUsers(chatRecipients(to_list))
+	}
+	for _, peer := range peers {
+		if !peer.WriteOnly {
+			peer.Send(event.Fields...)
+		}
+	}
+	var held []string
+	if !to_all {
+		held = ms.holdForOfflineRecipients(event, chatRecipients(to_list))
+	}
+	ms.notifyAddressed(event, to_list, held)
+	return event.Fields[4], nil
+}
+
+//
+// GET /api/v1/tokens
+//   {"tokens": [{"id": ..., "name": ..., "scope": ..., "rate_limit": ...,
+//                "created": ..., "last_used": ..., "revoked": ...}, ...]}
+// POST /api/v1/tokens
+//   {"name": <name>, "scope": <scope>, "rate_limit": <n>}
+// replies with
+//   {"id": <id>, "token": <token>}
+//
+func (ms *MapService) apiTokens(w http.ResponseWriter, r *http.Request, t APIToken) {
+	storage := ms.Storage.(TokenStorage)
+
+	if r.Method == http.MethodGet {
+		tokens, err := storage.ListAPITokens()
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, "unable to read API tokens: %v", err)
+			return
+		}
+		type token struct {
+			ID        string     `json:"id"`
+			Name      string     `json:"name"`
+			Scope     string     `json:"scope"`
+			RateLimit int        `json:"rate_limit"`
+			Created   time.Time  `json:"created"`
+			LastUsed  *time.Time `json:"last_used"`
+			Revoked   bool       `json:"revoked"`
+		}
+		list := []token{}
+		for _, tk := range tokens {
+			entry := token{ID: tk.ID, Name: tk.Name, Scope: tk.Scope, RateLimit: tk.RateLimit, Created: tk.Created, Revoked: tk.Revoked}
+			if !tk.LastUsed.IsZero() {
+				lastUsed := tk.LastUsed
+				entry.LastUsed = &lastUsed
+			}
+			list = append(list, entry)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"tokens": list})
+		return
+	}
+
+	var request struct {
+		Name      string `json:"name"`
+		Scope     string `json:"scope"`
+		RateLimit int    `json:"rate_limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		apiError(w, http.StatusBadRequest, "request not understood: %v", err)
+		return
+	}
+	issued, token, err := ms.issueAPIToken(request.Name, request.Scope, request.RateLimit)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "API token not issued: %v", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"id": issued.ID, "token": token})
+}
+
+//
+// DELETE /api/v1/tokens/<id>
+//
+func (ms *MapService) apiRevokeToken(w http.ResponseWriter, r *http.Request, t APIToken) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/")
+	found, err := ms.Storage.(TokenStorage).RevokeAPIToken(id)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "unable to revoke API token: %v", err)
+		return
+	}
+	if !found {
+		apiError(w, http.StatusNotFound, "there is no API token %s", id)
+		return
+	}
+	log.Printf("[api %s] API token %s revoked by %s", r.RemoteAddr, id, t.ID)
+	writeJSON(w, http.StatusOK, map[string]string{"revoked": id})
+}
+
+//
+// Issue a new API token and store it.
+//
+func (ms *MapService) issueAPIToken(name, scope string, rateLimit int) (APIToken, string, error) {
+	storage, ok := ms.Storage.(TokenStorage)
+	if !ok {
+		return APIToken{}, "", fmt.Errorf("API tokens can't be stored without a database")
+	}
+	t, token, err := NewAPIToken(name, scope, rateLimit, time.Now())
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	if err = storage.SaveAPIToken(t, HashAPIToken(token)); err != nil {
+		return APIToken{}, "", err
+	}
+	log.Printf("API token %s issued to %s with %s scope", t.ID, t.Name, t.Scope)
+	return t, token, nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,281 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the HTTP API
+//
+
+package mapservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func apiTestRequest(t *testing.T, ms *MapService, method, path, token, body string) (int, map[string]interface{}) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	ms.HTTPHandler().ServeHTTP(w, r)
+	var reply map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("%s %s reply %q not understood: %v", method, path, w.Body.String(), err)
+	}
+	return w.Code, reply
+}
+
+func TestAPIChatToGM(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/api.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	alice := newTestClient(ms, "alice", "alice", false)
+	_, bot, _ := ms.issueAPIToken("bot", ScopeChat, 0)
+
+	if status, reply := apiTestRequest(t, ms, "POST", "/api/v1/chat", bot, `{"to": ["%"], "text": "for the GM"}`); status != http.StatusOK {
+		t.Errorf("chat to the GM gave %d %v", status, reply)
+	}
+	s := storage.(DeadLetterStorage)
+	if letters, err := s.TakeDeadLetters("GM"); err != nil || len(letters) != 1 {
+		t.Errorf("held for the GM were %v (%v)", letters, err)
+	}
+	if letters, _ := s.TakeDeadLetters("%"); len(letters) != 0 {
+		t.Errorf("held for %% were %v", letters)
+	}
+
+	gm := newTestClient(ms, "gm", "GM", true)
+	if status, reply := apiTestRequest(t, ms, "POST", "/api/v1/chat", bot, `{"to": ["%"], "text": "for the GM"}`); status != http.StatusOK {
+		t.Errorf("chat to the GM gave %d %v", status, reply)
+	}
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.HasPrefix(sent[0], "TO bot % {for the GM} ") {
+		t.Errorf("GM was sent %q", sent)
+	}
+	if sent := sentToTestClient(alice); len(sent) != 0 {
+		t.Errorf("alice was sent %q", sent)
+	}
+}
+
+func TestHTTPAPI(t *testing.T) {
+	ms := newTestService()
+	alice := newTestClient(ms, "alice", "alice", false)
+	newTestClient(ms, "gm", "GM", true)
+
+	if status, _ := apiTestRequest(t, ms, "GET", "/api/v1/clients", "x", ""); status != http.StatusServiceUnavailable {
+		t.Errorf("request without a database gave status %d", status)
+	}
+
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/api.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+
+	_, reader, err := ms.issueAPIToken("status page", ScopeReadOnly, 2)
+	if err != nil {
+		t.Fatalf("unable to issue token: %v", err)
+	}
+	_, bot, _ := ms.issueAPIToken("bot", ScopeChat, 0)
+	_, admin, _ := ms.issueAPIToken("admin", ScopeAdmin, 0)
+
+	if status, _ := apiTestRequest(t, ms, "GET", "/api/v1/clients", "", ""); status != http.StatusUnauthorized {
+		t.Errorf("request without a token gave status %d", status)
+	}
+	if status, _ := apiTestRequest(t, ms, "GET", "/api/v1/clients", reader+"x", ""); status != http.StatusUnauthorized {
+		t.Errorf("request with a bad token gave status %d", status)
+	}
+	if status, _ := apiTestRequest(t, ms, "POST", "/api/v1/clients", reader, ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST to clients gave status %d", status)
+	}
+	status, reply := apiTestRequest(t, ms, "GET", "/api/v1/clients", reader, "")
+	if clients, ok := reply["clients"].([]interface{}); status != http.StatusOK || !ok || len(clients) != 2 {
+		t.Errorf("clients gave %d %v", status, reply)
+	}
+	if status, _ := apiTestRequest(t, ms, "GET", "/api/v1/clients", reader, ""); status != http.StatusOK {
+		t.Errorf("second request in a minute gave status %d", status)
+	}
+	if status, _ := apiTestRequest(t, ms, "GET", "/api/v1/clients", reader, ""); status != http.StatusTooManyRequests {
+		t.Errorf("third request in a minute gave status %d", status)
+	}
+
+	if status, _ := apiTestRequest(t, ms, "GET", "/api/v1/clients", bot, ""); status != http.StatusForbidden {
+		t.Errorf("chat token reading clients gave status %d", status)
+	}
+	status, reply = apiTestRequest(t, ms, "POST", "/api/v1/chat", bot, `{"to": ["alice"], "text": "hello"}`)
+	if status != http.StatusOK {
+		t.Errorf("chat gave %d %v", status, reply)
+	}
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "TO bot alice hello ") {
+		t.Errorf("alice was sent %q", sent)
+	}
+
+	status, reply = apiTestRequest(t, ms, "POST", "/api/v1/tokens", admin, `{"name": "logger", "scope": "read"}`)
+	if status != http.StatusCreated || !strings.HasPrefix(reply["token"].(string), "gma_") {
+		t.Errorf("issuing a token gave %d %v", status, reply)
+	}
+	status, reply = apiTestRequest(t, ms, "GET", "/api/v1/tokens", admin, "")
+	if tokens, ok := reply["tokens"].([]interface{}); status != http.StatusOK || !ok || len(tokens) != 4 {
+		t.Errorf("listing tokens gave %d %v", status, reply)
+	}
+	var id string
+	for _, token := range reply["tokens"].([]interface{}) {
+		if token.(map[string]interface{})["name"] == "bot" {
+			id = token.(map[string]interface{})["id"].(string)
+		}
+	}
+	if status, reply = apiTestRequest(t, ms, "DELETE", "/api/v1/tokens/"+id, admin, ""); status != http.StatusOK {
+		t.Errorf("revoking a token gave %d %v", status, reply)
+	}
+	if status, _ := apiTestRequest(t, ms, "POST", "/api/v1/chat", bot, `{"to": ["*"], "text": "hello"}`); status != http.StatusUnauthorized {
+		t.Errorf("revoked token gave status %d", status)
+	}
+	if status, _ := apiTestRequest(t, ms, "DELETE", "/api/v1/tokens/nothing", admin, ""); status != http.StatusNotFound {
+		t.Errorf("revoking unknown token gave status %d", status)
+	}
+}
+
+func TestAPIParameters(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/v1/x?since=10&user=a&user=b", strings.NewReader(
+		`{"name": "bot", "rate_limit": 5, "token": "gma_secret", "Password": "x", "text": "`+strings.Repeat("a", 150)+`"}`))
+	params, err := apiParameters(r, true)
+	if err != nil {
+		t.Fatalf("parameters not collected: %v", err)
+	}
+	expected := map[string]string{
+		"since":      "10",
+		"user":       "a,b",
+		"name":       "bot",
+		"rate_limit": "5",
+		"token":      "[redacted]",
+		"Password":   "[redacted]",
+		"text":       strings.Repeat("a", 100) + "...",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("parameters were %v, expected %v", params, expected)
+	}
+	if body, err := io.ReadAll(r.Body); err != nil || !strings.Contains(string(body), "gma_secret") {
+		t.Errorf("body left for the handler was %q, %v", body, err)
+	}
+}
+
+func TestHTTPAPIAudit(t *testing.T) {
+	var audit bytes.Buffer
+	ms := newTestService()
+	ms.AuditLog = NewAuditLog(&audit)
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/api.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+	admin, token, _ := ms.issueAPIToken("admin", ScopeAdmin, 0)
+
+	apiTestRequest(t, ms, "POST", "/api/v1/tokens", token, `{"name": "bot", "scope": "chat"}`)
+	apiTestRequest(t, ms, "PUT", "/api/v1/chat?why=test", "", `{"to": ["*"], "text": "hi"}`)
+
+	var records []AuditRecord
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var rec AuditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("audit record %q not understood: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 2 {
+		t.Fatalf("audit log was %q", audit.String())
+	}
+	if r := records[0]; r.User != "admin" || r.Action != "api-request" || r.Details["token"] != admin.ID || r.Details["status"] != "201" ||
+		r.Details["param.name"] != "bot" || r.Details["method"] != "POST" || r.Details["path"] != "/api/v1/tokens" {
+		t.Errorf("first audit record was %+v", r)
+	}
+	if r := records[1]; r.User != "unknown" || r.Details["status"] != "405" || r.Details["param.why"] != "test" || r.Details["param.text"] != "" {
+		t.Errorf("second audit record was %+v", r)
+	}
+	if strings.Contains(audit.String(), "gma_") {
+		t.Errorf("a token was written to the audit log: %s", audit.String())
+	}
+}
+
+func TestAPIBodyLimit(t *testing.T) {
+	ms := newTestService()
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/api.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+	_, token, _ := ms.issueAPIToken("admin", ScopeAdmin, 0)
+	huge := `{"name": "bot", "scope": "chat", "padding": "` + strings.Repeat("x", MaxAPIBodySize) + `"}`
+
+	if status, _ := apiTestRequest(t, ms, "POST", "/api/v1/tokens", "nonsense", huge); status != http.StatusUnauthorized {
+		t.Errorf("oversized request with a bad token gave status %d", status)
+	}
+	if status, _ := apiTestRequest(t, ms, "POST", "/api/v1/tokens", token, huge); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized request gave status %d", status)
+	}
+	if status, _ := apiTestRequest(t, ms, "POST", "/api/v1/tokens", token, `{"name": "bot", "scope": "chat"}`); status != http.StatusCreated {
+		t.Errorf("request within the limit gave status %d", status)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,197 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     Init Files                                     //
+//                                                                                    //
+// Reading the greeting sent to each client as it connects, with template variables   //
+// and included files so one init file can serve several campaigns.                   //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//
+// MaxInitFileDepth is how deeply INCLUDE directives may be nested in
+// an init file, so an include loop doesn't go on forever.
+//
+const MaxInitFileDepth = 10
+
+//
+// InitFileVars are the values which may be substituted into init
+// file lines as {{.Campaign}}, {{.Date}}, and {{.Time}}. Environment
+// variables may be substituted as {{env "NAME"}}.
+//
+type InitFileVars struct {
+	Campaign string // name of the campaign being run
+	Date     string // today's date (YYYY-MM-DD)
+	Time     string // the time now (HH:MM)
+}
+
+//
+// NewInitFileVars returns the variables for an init file read at
+// the given time.
+//
+func NewInitFileVars(campaign string, now time.Time) InitFileVars {
+	return InitFileVars{
+		Campaign: campaign,
+		Date:     now.Format("2006-01-02"),
+		Time:     now.Format("15:04"),
+	}
+}
+
+var initFileFuncs = template.FuncMap{
+	"env": os.Getenv,
+}
+
+//
+// An InitFile is the greeting we send each client as it connects,
+// as read from the server's init file. Lines after an AUTHENTICATED
+// directive are held back until the client has logged in.
+//
+type InitFile struct {
+	Lines    []string // lines to send to the client as soon as it connects
+	PostAuth []string // lines to send once it has authenticated
+	Sync     bool     // should the client be sent the game state too?
+
+	postAuth bool // are we reading the post-authentication lines?
+}
+
+//
+// ReadInitFile reads an init file, expanding any template variables
+// in each line and following INCLUDE directives (whose file names are
+// relative to the directory of the file including them).
+//
+func ReadInitFile(path string, vars InitFileVars) (InitFile, error) {
+	var f InitFile
+	err := f.read(path, vars, 0)
+	return f, err
+}
+
+func (f *InitFile) read(path string, vars InitFileVars, depth int) error {
+	if depth > MaxInitFileDepth {
+		return fmt.Errorf("%s: init files nested more than %d deep (is there an INCLUDE loop?)", path, MaxInitFileDepth)
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line, err := expandInitLine(scanner.Text(), vars)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		switch {
+			case line == "SYNC":
+				f.Sync = true
+
+			case line == "AUTHENTICATED":
+				f.postAuth = true
+
+			case strings.HasPrefix(line, "INCLUDE "):
+				included := strings.TrimSpace(line[8:])
+				if !filepath.IsAbs(included) {
+					included = filepath.Join(filepath.Dir(path), included)
+				}
+				if err = f.read(included, vars, depth+1); err != nil {
+					return fmt.Errorf("%s:%d: %v", path, lineno, err)
+				}
+
+			case len(line) >= 4 && line[0:4] == "LOAD":
+				log.Printf("Ignoring deprecated init-file directive: %s", line)
+
+			default:
+				if f.postAuth {
+					f.PostAuth = append(f.PostAuth, line)
+				} else {
+					f.Lines = append(f.Lines, line)
+				}
+		}
+	}
+	return scanner.Err()
+}
+
+//
+// Expand the template variables in an init file line. Lines without
+// any are left alone.
+//
+func expandInitLine(line string, vars InitFileVars) (string, error) {
+	if !strings.Contains(line, "{{") {
+		return line, nil
+	}
+	t, err := template.New("init").Funcs(initFileFuncs).Parse(line)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	if err = t.Execute(&out, vars); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
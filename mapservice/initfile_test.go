@@ -0,0 +1,127 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for reading init files
+//
+
+package mapservice
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, path string, lines ...string) {
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatalf("unable to write %s: %v", path, err)
+	}
+}
+
+func TestReadInitFile(t *testing.T) {
+	dir := t.TempDir()
+	os.Setenv("GMA_TEST_GREETING", "hello")
+	defer os.Unsetenv("GMA_TEST_GREETING")
+
+	writeTestFile(t, filepath.Join(dir, "main.init"),
+		"// {{.Campaign}} game on {{.Date}}",
+		"// {{env \"GMA_TEST_GREETING\"}}",
+		"INCLUDE {{.Campaign}}.init",
+		"LOAD old.map",
+		"SYNC")
+	writeTestFile(t, filepath.Join(dir, "wyrmhold.init"),
+		"// Welcome to {{.Campaign}}",
+		"AUTHENTICATED",
+		"AC Alice PC1 blue M M")
+
+	vars := NewInitFileVars("wyrmhold", time.Date(2020, 9, 13, 12, 26, 0, 0, time.UTC))
+	greeting, err := ReadInitFile(filepath.Join(dir, "main.init"), vars)
+	if err != nil {
+		t.Fatalf("unable to read init file: %v", err)
+	}
+	expected := []string{
+		"// wyrmhold game on 2020-09-13",
+		"// hello",
+		"// Welcome to wyrmhold",
+	}
+	if !reflect.DeepEqual(greeting.Lines, expected) || !greeting.Sync {
+		t.Errorf("read %q (sync %v), expected %q", greeting.Lines, greeting.Sync, expected)
+	}
+	if expected = []string{"AC Alice PC1 blue M M"}; !reflect.DeepEqual(greeting.PostAuth, expected) {
+		t.Errorf("read post-auth lines %q, expected %q", greeting.PostAuth, expected)
+	}
+}
+
+func TestReadInitFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "bad.init"),
+		"// fine",
+		"// {{.Weather}}")
+	writeTestFile(t, filepath.Join(dir, "loop.init"),
+		"INCLUDE loop.init")
+
+	for file, expected := range map[string]string{
+		"bad.init":     "bad.init:2: ",
+		"loop.init":    "nested more than",
+		"missing.init": "no such file",
+	} {
+		if _, err := ReadInitFile(filepath.Join(dir, file), InitFileVars{}); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("reading %s gave error %v, expected %q", file, err, expected)
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,192 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     Initiative                                     //
+//                                                                                    //
+// Rolls initiative for a set of creatures on the map, using each creature's stored   //
+// initiative modifier, and sorts them into initiative order.                         //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// InitiativeAttribute is the creature attribute holding its
+// initiative modifier. Creatures without one roll with no modifier.
+//
+const InitiativeAttribute = "INIT_mod"
+
+//
+// Ways to break ties in initiative order. By default, the creature
+// with the higher modifier goes first (rerolling if those are the same).
+//
+const (
+	InitTieModifier = "modifier"
+	InitTieReroll   = "reroll"
+	InitTieName     = "name"
+)
+
+//
+// InitiativeRoll is one creature's initiative roll.
+//
+type InitiativeRoll struct {
+	Name     string // creature name
+	Modifier int    // initiative modifier
+	Roll     int    // what the d20 showed
+	Total    int    // roll + modifier
+	HP       int    // current hit points, if known
+	NoHealth bool   // true if we don't know the creature's hit points
+	tiebreak int32  // stands in for rerolling any ties
+}
+
+//
+// Check a tie-break rule, filling in the default if it's empty.
+//
+func checkInitiativeTieBreak(rule string) (string, error) {
+	switch rule {
+		case "":
+			return InitTieModifier, nil
+		case InitTieModifier, InitTieReroll, InitTieName:
+			return rule, nil
+	}
+	return "", fmt.Errorf("Initiative tie-break rule \"%s\" not understood; must be %s, %s, or %s", rule, InitTieModifier, InitTieReroll, InitTieName)
+}
+
+//
+// RollInitiative rolls d20 plus each named creature's initiative
+// modifier, and returns them in initiative order.
+//
+func RollInitiative(gs *GameState, names []string, tiebreak string, r RandomSource) ([]InitiativeRoll, error) {
+	var err error
+	if tiebreak, err = checkInitiativeTieBreak(tiebreak); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No creatures given to roll initiative for")
+	}
+
+	var rolls []InitiativeRoll
+	for _, name := range names {
+		id, _, known := gs.ResolveObject("@" + name)
+		if !known || id == "" {
+			return nil, fmt.Errorf("There is no creature named %s on the map", name)
+		}
+		obj, _ := gs.Object(id)
+		roll := InitiativeRoll{Name: name, NoHealth: true}
+		if mod, ok := obj.Attrs[InitiativeAttribute]; ok {
+			if roll.Modifier, err = strconv.Atoi(strings.TrimSpace(mod)); err != nil {
+				return nil, fmt.Errorf("Initiative modifier for %s is \"%s\", which is not an integer", name, mod)
+			}
+		}
+		if health, err := ParseTclList(obj.Attrs["HEALTH"]); err == nil && len(health) >= 2 {
+			max_hp, err1 := strconv.Atoi(health[0])
+			lethal, err2 := strconv.Atoi(health[1])
+			if err1 == nil && err2 == nil {
+				roll.HP, roll.NoHealth = max_hp-lethal, false
+			}
+		}
+		roll.Roll = int(randomInt31n(r, 20)) + 1
+		roll.Total = roll.Roll + roll.Modifier
+		roll.tiebreak = randomInt31n(r, 1<<30)
+		rolls = append(rolls, roll)
+	}
+
+	sort.SliceStable(rolls, func(i, j int) bool {
+		a, b := rolls[i], rolls[j]
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		}
+		switch tiebreak {
+			case InitTieName:
+				return a.Name < b.Name
+			case InitTieModifier:
+				if a.Modifier != b.Modifier {
+					return a.Modifier > b.Modifier
+				}
+		}
+		return a.tiebreak > b.tiebreak
+	})
+	return rolls, nil
+}
+
+//
+// InitiativeSlotList formats the initiative order as the slot list of
+// an IL message. Each slot is
+//   {<slot> <name> <hp> <hold> <nohealth>}
+// with slots numbered from 0 in initiative order.
+//
+func InitiativeSlotList(rolls []InitiativeRoll) (string, error) {
+	var slots []string
+	for i, roll := range rolls {
+		nohealth := "0"
+		if roll.NoHealth {
+			nohealth = "1"
+		}
+		slot, err := ToTclString([]string{strconv.Itoa(i), roll.Name, strconv.Itoa(roll.HP), "0", nohealth})
+		if err != nil {
+			return "", err
+		}
+		slots = append(slots, slot)
+	}
+	return ToTclString(slots)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,136 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for initiative rolls
+//
+
+package mapservice
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+//
+// A RandomSource which gives a fixed sequence of numbers, then 0.
+//
+type sequenceRandomSource struct {
+	values []int32
+}
+
+func (s *sequenceRandomSource) Int31n(n int32) int32 {
+	if len(s.values) == 0 {
+		return 0
+	}
+	v := s.values[0]
+	s.values = s.values[1:]
+	return v % n
+}
+
+func TestRollInitiative(t *testing.T) {
+	gs := NewGameState()
+	recordTestEvents(t, gs,
+		"PS 1 red Grax 1 M monster 3 4 0",
+		"PS 2 blue Alice 1 M player 5 6 0",
+		"PS 3 green Bob 1 M player 7 8 0",
+		"OA 1 {INIT_mod 2 HEALTH {20 5 0 12 0 0 0 {} 0}}",
+		"OA 2 {INIT_mod 4}",
+		"OA 3 {INIT_mod -1}",
+	)
+
+	for i, tc := range []struct {
+		tiebreak string
+		random   []int32 // d20 roll (less 1) then tiebreak for Grax, Alice, Bob
+		order    string
+	}{
+		{"", []int32{9, 0, 7, 0, 14, 0}, "Bob=14 Alice=12 Grax=12"},
+		{"modifier", []int32{9, 0, 7, 0, 14, 0}, "Bob=14 Alice=12 Grax=12"},
+		{"name", []int32{9, 0, 7, 0, 14, 0}, "Bob=14 Alice=12 Grax=12"},
+		{"reroll", []int32{9, 5, 7, 2, 14, 0}, "Bob=14 Grax=12 Alice=12"},
+		{"reroll", []int32{9, 2, 7, 5, 14, 0}, "Bob=14 Alice=12 Grax=12"},
+		{"", []int32{19, 0, 0, 0, 9, 0}, "Grax=22 Bob=9 Alice=5"},
+	} {
+		rolls, err := RollInitiative(gs, []string{"Grax", "Alice", "Bob"}, tc.tiebreak, &sequenceRandomSource{values: tc.random})
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		var order []string
+		for _, r := range rolls {
+			order = append(order, fmt.Sprintf("%s=%d", r.Name, r.Total))
+		}
+		if strings.Join(order, " ") != tc.order {
+			t.Errorf("case %d: order was %v; expected %s", i, order, tc.order)
+		}
+	}
+
+	rolls, err := RollInitiative(gs, []string{"Grax", "Alice"}, "", fixedRandomSource(0))
+	if err != nil {
+		t.Fatalf("unable to roll initiative: %v", err)
+	}
+	slots, err := InitiativeSlotList(rolls)
+	if err != nil || slots != "{0 Alice 0 0 1} {1 Grax 15 0 0}" {
+		t.Errorf("slot list was %q, %v", slots, err)
+	}
+
+	for _, bad := range [][]string{nil, {"Nobody"}} {
+		if _, err := RollInitiative(gs, bad, "", nil); err == nil {
+			t.Errorf("initiative rolled for %v", bad)
+		}
+	}
+	if _, err := RollInitiative(gs, []string{"Grax"}, "dex", nil); err == nil {
+		t.Errorf("bad tie-break rule accepted")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,292 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     Join Links                                     //
+//                                                                                    //
+// Links (and QR codes for them) which tell a new player's client where the server    //
+// is and let them log in once with a password made up just for them, so the group    //
+// password needn't be read out across the table.                                     //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"image/png"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// DefaultInviteLifetime is how long an invitation lasts unless the GM
+// says otherwise.
+//
+const DefaultInviteLifetime = 12 * time.Hour
+
+//
+// JoinPath is where the HTTP API serves the QR code for each
+// invitation, as JoinPath<code>.png (or .txt for text).
+//
+const JoinPath = "/join/"
+
+//
+// Invite lets one user log in with a password made up for them, until
+// it expires. While it lasts, that is the only password they may log
+// in with.
+//
+type Invite struct {
+	Code     string    // identifies the invitation in its QR code link
+	User     string
+	Password string
+	Expires  time.Time
+}
+
+//
+// inviteList holds the invitations which haven't yet expired.
+//
+type inviteList struct {
+	lock   sync.Mutex
+	byUser map[string]*Invite
+}
+
+//
+// Invite the user, replacing any invitation they already had.
+//
+func (l *inviteList) issue(user string, lifetime time.Duration, now time.Time) (*Invite, error) {
+	code := make([]byte, 8)
+	password := make([]byte, 12)
+	if _, err := rand.Read(code); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(password); err != nil {
+		return nil, err
+	}
+	inv := &Invite{
+		Code:     hex.EncodeToString(code),
+		User:     user,
+		Password: base64.RawURLEncoding.EncodeToString(password),
+		Expires:  now.Add(lifetime),
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.byUser == nil {
+		l.byUser = make(map[string]*Invite)
+	}
+	l.byUser[user] = inv
+	return inv, nil
+}
+
+//
+// The invitation for the user, if they have one which hasn't expired.
+//
+func (l *inviteList) forUser(user string, now time.Time) (*Invite, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	inv, ok := l.byUser[user]
+	if ok && !now.Before(inv.Expires) {
+		delete(l.byUser, user)
+		return nil, false
+	}
+	return inv, ok
+}
+
+//
+// The invitation with the given code, if it hasn't expired.
+//
+func (l *inviteList) withCode(code string, now time.Time) (*Invite, bool) {
+	l.lock.Lock()
+	var user string
+	for u, inv := range l.byUser {
+		if inv.Code == code {
+			user = u
+		}
+	}
+	l.lock.Unlock()
+	if user == "" {
+		return nil, false
+	}
+	return l.forUser(user, now)
+}
+
+//
+// The host (and port) clients should connect to, as given in join
+// links: JoinHost if it was set (with the port we listen on added if
+// it doesn't name one), or else our first address on the local
+// network.
+//
+func (ms *MapService) joinHost() (string, error) {
+	host := ms.JoinHost
+	if host == "" {
+		addrs, err := localIPv4Addrs()
+		if err != nil {
+			return "", err
+		}
+		host = addrs[0].String()
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host, nil
+	}
+	if ms.IncomingListener == nil {
+		return "", fmt.Errorf("the server isn't listening for clients yet")
+	}
+	addr, ok := ms.IncomingListener.Addr().(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("unable to tell which port the server is listening on")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(addr.Port)), nil
+}
+
+//
+// The link a client follows to join the game with an invitation:
+//   gma://<host>:<port>/?user=<user>&password=<password>[&campaign=<name>]
+//
+func (ms *MapService) joinURL(inv *Invite) (string, error) {
+	host, err := ms.joinHost()
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{"user": {inv.User}, "password": {inv.Password}}
+	if ms.Campaign != "" {
+		query.Set("campaign", ms.Campaign)
+	}
+	return (&url.URL{Scheme: "gma", Host: host, Path: "/", RawQuery: query.Encode()}).String(), nil
+}
+
+//
+// Where the HTTP API serves the invitation's QR code, if we have an
+// HTTP API.
+//
+func (ms *MapService) joinQRURL(inv *Invite) string {
+	base := ms.httpBaseURL()
+	if base == "" {
+		return ""
+	}
+	return base + JoinPath + inv.Code + ".png"
+}
+
+//
+// Invite the named user to join the game for the given time. Users
+// who already have a password of their own (or the GM) can't be
+// invited, since their invitation password would lock them out of
+// their own.
+//
+func (ms *MapService) inviteUser(user string, lifetime time.Duration) (*Invite, error) {
+	user = strings.ToLower(user)
+	if gmLoginName(user) == "" {
+		return nil, fmt.Errorf("invitations must be for a named player")
+	}
+	if lifetime <= 0 {
+		return nil, fmt.Errorf("invitations must last some time")
+	}
+	if ms.PlayerGroupPass == nil && ms.GmPass == nil {
+		return nil, fmt.Errorf("this server doesn't ask for passwords, so nobody needs an invitation")
+	}
+	if _, invited := ms.invites.forUser(user, time.Now()); !invited {
+		if _, ok := ms.lookupPersonalSecret(user); ok {
+			return nil, fmt.Errorf("%s already has a password of their own", user)
+		}
+	}
+	return ms.invites.issue(user, lifetime, time.Now())
+}
+
+//
+// GET /join/<code>.png (or .txt)
+//
+// The QR code for an invitation's join link, as a PNG image or as text
+// to show in a terminal. The code in the path is all the authority
+// needed, so no token is asked for.
+//
+func (ms *MapService) apiJoinQR(w http.ResponseWriter, r *http.Request, _ APIToken) {
+	name := strings.TrimPrefix(r.URL.Path, JoinPath)
+	code, format := name, ""
+	if dot := strings.LastIndex(name, "."); dot >= 0 {
+		code, format = name[:dot], name[dot+1:]
+	}
+	inv, ok := ms.invites.withCode(code, time.Now())
+	if !ok {
+		apiError(w, http.StatusNotFound, "no such invitation (it may have expired)")
+		return
+	}
+	link, err := ms.joinURL(inv)
+	if err != nil {
+		apiError(w, http.StatusServiceUnavailable, "%v", err)
+		return
+	}
+	qr, err := EncodeQR([]byte(link))
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	switch format {
+		case "png":
+			w.Header().Set("Content-Type", "image/png")
+			png.Encode(w, qr.Image(8))
+		case "txt":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintf(w, "%s\n%s", link, qr.Text())
+		default:
+			apiError(w, http.StatusNotFound, "ask for %s%s.png or %s%s.txt", JoinPath, code, JoinPath, code)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
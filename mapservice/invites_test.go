@@ -0,0 +1,165 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for join links
+//
+
+package mapservice
+
+import (
+	"bytes"
+	"image/png"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvite(t *testing.T) {
+	ms := newTestService()
+	ms.PlayerGroupPass = []byte("swordfish")
+	ms.PersonalPasswords = map[string][]byte{"bob": []byte("bobpass")}
+	ms.JoinHost = "table.example:2323"
+	ms.HTTPPort = 8080
+	ms.Campaign = "Red Hand"
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "INVITE carol"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV") {
+		t.Errorf("player inviting someone was sent %q", sent)
+	}
+	for _, bad := range []string{"INVITE bob", "INVITE GM", "INVITE carol soon", "INVITE carol -1h"} {
+		ms.ExecuteAction(testEvent(t, bad), gm)
+		if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "ERROR") && !strings.Contains(sent[0], "not") {
+			t.Errorf("%s gave %q", bad, sent)
+		}
+	}
+
+	ms.ExecuteAction(testEvent(t, "INVITE Carol 1h"), gm)
+	sent := sentToTestClient(gm)
+	if len(sent) != 1 {
+		t.Fatalf("GM was sent %q", sent)
+	}
+	reply, err := ParseTclList(sent[0])
+	if err != nil || len(reply) != 5 || reply[0] != "INVITE=" || reply[1] != "carol" {
+		t.Fatalf("invitation reply %q", sent[0])
+	}
+	link, err := url.Parse(reply[2])
+	if err != nil || link.Scheme != "gma" || link.Host != "table.example:2323" || link.Query().Get("user") != "carol" || link.Query().Get("campaign") != "Red Hand" {
+		t.Errorf("join link %q (%v)", reply[2], err)
+	}
+	password := link.Query().Get("password")
+	if secret, ok := ms.lookupPersonalSecret("carol"); !ok || string(secret) != password || password == "" {
+		t.Errorf("carol's password is %q, %v (link gave %q)", secret, ok, password)
+	}
+	if !strings.HasPrefix(reply[3], "http://table.example:8080/join/") || !strings.HasSuffix(reply[3], ".png") {
+		t.Errorf("QR link %q", reply[3])
+	}
+
+	// inviting carol again replaces her invitation
+	ms.ExecuteAction(testEvent(t, "INVITE carol"), gm)
+	if again, _ := ParseTclList(sentToTestClient(gm)[0]); len(again) != 5 || again[2] == reply[2] {
+		t.Errorf("second invitation was the same as the first")
+	}
+	inv, ok := ms.invites.forUser("carol", time.Now())
+	if !ok || inv.Expires.Before(time.Now().Add(11*time.Hour)) {
+		t.Fatalf("carol's invitation is %+v", inv)
+	}
+	if _, ok := ms.invites.withCode(inv.Code, inv.Expires); ok {
+		t.Errorf("expired invitation still found")
+	}
+	if _, ok := ms.lookupPersonalSecret("carol"); ok {
+		t.Errorf("carol still has a password after her invitation expired")
+	}
+}
+
+func TestInviteQR(t *testing.T) {
+	ms := newTestService()
+	ms.PlayerGroupPass = []byte("swordfish")
+	ms.JoinHost = "table.example:2323"
+	inv, err := ms.inviteUser("dave", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, _ := ms.joinURL(inv)
+	if ms.joinQRURL(inv) != "" {
+		t.Errorf("QR link given without an HTTP API")
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ms.HTTPHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	w := get(JoinPath + inv.Code + ".png")
+	img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/png" || err != nil {
+		t.Errorf("PNG request gave %d %q (%v)", w.Code, w.Header().Get("Content-Type"), err)
+	}
+	qr, _ := EncodeQR([]byte(link))
+	if err == nil && img.Bounds().Dx() != (qr.Size+2*QRQuietZone)*8 {
+		t.Errorf("QR code image is %v", img.Bounds())
+	}
+	if w = get(JoinPath + inv.Code + ".txt"); w.Code != 200 || !strings.HasPrefix(w.Body.String(), link+"\n") {
+		t.Errorf("text request gave %d %q", w.Code, w.Body.String())
+	}
+	for _, path := range []string{JoinPath + inv.Code, JoinPath + "nope.png"} {
+		if w = get(path); w.Code != 404 {
+			t.Errorf("%s gave %d", path, w.Code)
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,645 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Event journal                                    //
+//                                                                                    //
+// Every change to the game state is written to a journal file as it happens, so that //
+// if the server crashes, the changes made since the last save can be recovered when  //
+// it starts again.                                                                   //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// JournalSyncInterval is how often the journal is flushed to disk,
+// and so about the most map changes a crash can lose.
+//
+const JournalSyncInterval = 5 * time.Millisecond
+
+//
+// DefaultJournalLimit is how large the journal may grow before the game
+// state is saved so it can be emptied.
+//
+const DefaultJournalLimit = 1 << 20
+
+//
+// ObjectHistoryLimit is how many of the latest changes to objects the
+// journal remembers (see ObjectHistory), even after a save has let it
+// discard them from the file.
+//
+const ObjectHistoryLimit = 10000
+
+//
+// A JournalEntry records one change made to the game state. Chat
+// messages aren't journaled, since they go into the database as soon
+// as they arrive (see addChatMessage).
+//
+type JournalEntry struct {
+	N        int64          `json:"n"`                // position in the journal
+	Op       string         `json:"op"`               // event, clear, or image
+	Event    string         `json:"event,omitempty"`  // the event recorded (for event)
+	Extra    []string       `json:"extra,omitempty"`  // its additional lines (for LS)
+	ID       string         `json:"id,omitempty"`     // the object it was for
+	Class    string         `json:"class,omitempty"`  // and that object's class
+	Object   string         `json:"object,omitempty"` // the object it changed, if not ID (or the one removed, for clear)
+	User     string         `json:"user,omitempty"`   // who made the change, if we know
+	Time     time.Time      `json:"time"`             // when it was made
+	Writer   string         `json:"writer,omitempty"` // how it was stamped (see EventClock)
+	Sequence int            `json:"seq,omitempty"`
+	Changed  *EventStamp    `json:"changed,omitempty"`
+	Target   string         `json:"target,omitempty"` // what was removed (for clear)
+	Image    *ImageLocation `json:"image,omitempty"`  // where an image is (for image)
+}
+
+//
+// A Journal is an append-only file recording each change made to the
+// game state as it happens, so the changes made since the last save can
+// be recovered if the server crashes. Entries are flushed to disk every
+// JournalSyncInterval, and discarded once a save includes them. If the
+// journal grows past its limit between saves, it asks for one (see
+// compactJournal), so that recovering it never takes too long.
+//
+type Journal struct {
+	lock      sync.Mutex
+	syncLock  sync.Mutex     // held while syncing or rewriting the file
+	path      string
+	file      *os.File
+	out       *bufio.Writer
+	last      int64          // N of the last entry written
+	size      int64          // bytes in the file (including any not yet flushed)
+	limit     int64          // size at which to ask for a save (0 for never)
+	full      chan bool      // where we ask for a save
+	asked     bool           // have we asked for one which hasn't happened yet?
+	stats     JournalStats
+	dirty     bool           // are there entries not yet flushed?
+	failed    error          // why the last write failed, if it did
+	closed    bool
+	followers map[chan JournalEntry]bool // standby servers mirroring the journal
+	recovered []JournalEntry // entries found in the file when it was opened
+	history   []JournalEntry // the latest changes to objects (see ObjectHistory)
+	stop      chan bool
+	done      chan bool
+}
+
+//
+// JournalStats describes the journal and how long it has taken to
+// compact it (by saving the game state) when it grew too large.
+//
+type JournalStats struct {
+	Bytes        int64   `json:"bytes"`         // size of the journal now
+	Limit        int64   `json:"limit"`         // size at which it is compacted (0 for never)
+	Compactions  int     `json:"compactions"`   // how many times it has been, since the server started
+	Failures     int     `json:"failures"`      // how many times the save failed
+	LastDuration float64 `json:"last_duration"` // seconds the last compaction took
+	MaxDuration  float64 `json:"max_duration"`  // seconds the longest compaction took
+}
+
+//
+// OpenJournal opens (or creates) the named journal file. Any entries
+// already in it are kept to be recovered (see RecoverFromJournal),
+// and new ones are appended to them.
+//
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Unable to read journal %s: %v", path, err)
+	}
+	// A crash may have left half an entry at the end.
+	if good := bytes.LastIndexByte(data, '\n') + 1; good < len(data) {
+		log.Printf("Journal %s: discarding %d bytes of incomplete entry at the end", path, len(data)-good)
+		if err = f.Truncate(int64(good)); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Unable to repair journal %s: %v", path, err)
+		}
+		data = data[:good]
+	}
+
+	j := &Journal{
+		path: path,
+		file: f,
+		out:  bufio.NewWriter(f),
+		size: int64(len(data)),
+		full: make(chan bool, 1),
+		stop: make(chan bool),
+		done: make(chan bool),
+	}
+	for i, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			log.Printf("Journal %s: skipping unreadable entry on line %d: %v", path, i+1, err)
+			continue
+		}
+		j.recovered = append(j.recovered, entry)
+		j.remember(entry)
+		if entry.N > j.last {
+			j.last = entry.N
+		}
+	}
+	go j.syncLoop()
+	return j, nil
+}
+
+//
+// Close the journal, after writing out anything still pending.
+//
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	if j.closed {
+		j.lock.Unlock()
+		return nil
+	}
+	j.closed = true
+	close(j.full)
+	for ch := range j.followers {
+		j.unfollowLocked(ch)
+	}
+	j.lock.Unlock()
+	close(j.stop)
+	<-j.done
+	err := j.sync()
+	if cerr := j.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//
+// Mark returns the position of the last entry written to the journal.
+//
+func (j *Journal) Mark() int64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.last
+}
+
+//
+// Add an entry to the journal. It's written out the next time the
+// journal is synced.
+//
+func (j *Journal) append(entry JournalEntry) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.closed {
+		j.fail(fmt.Errorf("the journal is closed"))
+		return
+	}
+	j.last++
+	entry.N = j.last
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		_, err = j.out.Write(append(data, '\n'))
+	}
+	if err != nil {
+		j.fail(err)
+		return
+	}
+	j.size += int64(len(data) + 1)
+	j.dirty = true
+	j.remember(entry)
+	j.publish(entry)
+	if j.limit > 0 && j.size >= j.limit && !j.asked {
+		j.asked = true
+		j.full <- true
+	}
+}
+
+//
+// The object a journal entry changed, if it changed one in particular.
+//
+func (entry JournalEntry) object() string {
+	switch entry.Op {
+		case "event":
+			if entry.Object != "" {
+				return entry.Object
+			}
+			return entry.ID
+
+		case "clear":
+			return entry.Object
+	}
+	return ""
+}
+
+//
+// Remember an entry which changed an object, forgetting the oldest
+// if there are too many. Called with j.lock held.
+//
+func (j *Journal) remember(entry JournalEntry) {
+	if entry.object() == "" {
+		return
+	}
+	j.history = append(j.history, entry)
+	if len(j.history) > ObjectHistoryLimit {
+		j.history = append([]JournalEntry(nil), j.history[len(j.history)-ObjectHistoryLimit:]...)
+	}
+}
+
+//
+// ObjectHistory returns the entries the journal remembers which changed
+// the given object, oldest first. They go back as far as the server was
+// started (or the journal holds, from before that), up to the last
+// ObjectHistoryLimit changes to any object.
+//
+func (j *Journal) ObjectHistory(id string) []JournalEntry {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	var entries []JournalEntry
+	for _, entry := range j.history {
+		if entry.object() == id {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+//
+// SetLimit sets the size the journal may grow to before it asks for
+// the game state to be saved (0 for it to wait for the usual saves).
+//
+func (j *Journal) SetLimit(limit int64) {
+	j.lock.Lock()
+	j.limit = limit
+	j.lock.Unlock()
+}
+
+//
+// Stats returns the journal's size and how its compactions have gone.
+//
+func (j *Journal) Stats() JournalStats {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	stats := j.stats
+	stats.Bytes, stats.Limit = j.size, j.limit
+	return stats
+}
+
+//
+// Note that a save asked for by the journal has been made, and how long
+// it took.
+//
+func (j *Journal) compacted(d time.Duration, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.asked = false
+	if err != nil {
+		j.stats.Failures++
+		return
+	}
+	j.stats.Compactions++
+	j.stats.LastDuration = d.Seconds()
+	if j.stats.LastDuration > j.stats.MaxDuration {
+		j.stats.MaxDuration = j.stats.LastDuration
+	}
+}
+
+//
+// Report a failure to write the journal, once, rather than for every
+// entry until it's fixed. Called with j.lock held.
+//
+func (j *Journal) fail(err error) {
+	if j.failed == nil {
+		log.Printf("Unable to write journal %s: %v; changes made now may be lost in a crash", j.path, err)
+	}
+	j.failed = err
+}
+
+func (j *Journal) syncLoop() {
+	ticker := time.NewTicker(JournalSyncInterval)
+	defer ticker.Stop()
+	defer close(j.done)
+	for {
+		select {
+			case <-ticker.C:
+				j.sync()
+			case <-j.stop:
+				return
+		}
+	}
+}
+
+//
+// Flush any new entries to disk. We don't hold j.lock while waiting
+// for the disk, since changes to the game state wait for that.
+//
+func (j *Journal) sync() error {
+	j.syncLock.Lock()
+	defer j.syncLock.Unlock()
+
+	j.lock.Lock()
+	if !j.dirty {
+		j.lock.Unlock()
+		return nil
+	}
+	j.dirty = false
+	err := j.out.Flush()
+	f := j.file
+	j.lock.Unlock()
+
+	if err == nil {
+		err = f.Sync()
+	}
+	j.lock.Lock()
+	if err != nil {
+		j.fail(err)
+	} else if j.failed != nil {
+		log.Printf("Journal %s is being written again", j.path)
+		j.failed = nil
+	}
+	j.lock.Unlock()
+	return err
+}
+
+//
+// Discard the entries up to and including the given position, which
+// a save of the game state has made unnecessary. The file is replaced
+// in one step, so a crash part way through leaves either the old
+// journal or the new one.
+//
+func (j *Journal) Discard(mark int64) error {
+	if err := j.sync(); err != nil {
+		return err
+	}
+	j.syncLock.Lock()
+	defer j.syncLock.Unlock()
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if err := j.out.Flush(); err != nil {
+		return err
+	}
+	if mark >= j.last {
+		if err := j.file.Truncate(0); err != nil {
+			return fmt.Errorf("Unable to truncate journal %s: %v", j.path, err)
+		}
+		j.size = 0
+		return nil
+	}
+
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		return fmt.Errorf("Unable to read journal %s: %v", j.path, err)
+	}
+	var kept []byte
+	for _, line := range bytes.SplitAfter(data, []byte{'\n'}) {
+		var entry struct{ N int64 `json:"n"` }
+		if json.Unmarshal(line, &entry) == nil && entry.N > mark {
+			kept = append(kept, line...)
+		}
+	}
+	tmp, err := os.OpenFile(j.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to rewrite journal %s: %v", j.path, err)
+	}
+	if _, err = tmp.Write(kept); err == nil {
+		if err = tmp.Sync(); err == nil {
+			err = os.Rename(j.path+".tmp", j.path)
+		}
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(j.path + ".tmp")
+		return fmt.Errorf("Unable to rewrite journal %s: %v", j.path, err)
+	}
+	j.file.Close()
+	j.file = tmp
+	j.out.Reset(tmp)
+	j.size = int64(len(kept))
+	return nil
+}
+
+//
+// Save the game state whenever the journal asks for it, until the
+// journal is closed.
+//
+func (ms *MapService) compactJournal(j *Journal) {
+	defer ms.ReportCrash()
+	for range j.full {
+		log.Printf("Journal has grown past %d bytes; saving the game state to compact it", j.Stats().Limit)
+		start := time.Now()
+		err := ms.SaveState()
+		if err != nil {
+			log.Printf("Unable to save the game state to compact the journal: %v", err)
+		}
+		j.compacted(time.Since(start), err)
+	}
+}
+
+//
+// SetJournal starts recording every change made to the game state in
+// the given journal (or stops, if it is nil).
+//
+func (gs *GameState) SetJournal(j *Journal) {
+	gs.lockAll()
+	gs.saveLock.Lock()
+	gs.journal = j
+	gs.saveLock.Unlock()
+	gs.unlockAll()
+}
+
+//
+// RecoverFromJournal applies the changes recorded in the journal since
+// the game state was last saved, returning how many there were. It is
+// called after loading the saved state and before the journal is used
+// (see SetJournal).
+//
+func (gs *GameState) RecoverFromJournal(j *Journal) int {
+	j.lock.Lock()
+	entries := j.recovered
+	j.recovered = nil
+	j.lock.Unlock()
+
+	recovered := 0
+	for _, entry := range entries {
+		if entry.N <= gs.journaled {
+			continue
+		}
+		if err := gs.replayJournal(entry); err != nil {
+			log.Printf("Journal %s: skipping entry %d: %v", j.path, entry.N, err)
+		}
+		gs.journaled = entry.N
+		recovered++
+	}
+
+	// carry on numbering past the save, even if the journal was lost
+	j.lock.Lock()
+	if j.last < gs.journaled {
+		j.last = gs.journaled
+	}
+	j.lock.Unlock()
+	return recovered
+}
+
+func (gs *GameState) replayJournal(entry JournalEntry) error {
+	switch entry.Op {
+		case "event":
+			event, err := NewMapEvent(entry.Event, entry.ID, entry.Class)
+			if err != nil {
+				return err
+			}
+			event.MultiRawData = entry.Extra
+			event.Writer, event.Sequence = entry.Writer, entry.Sequence
+			event.User = entry.User
+			if entry.Changed != nil {
+				event.Changed = *entry.Changed
+			}
+			return gs.Record(event)
+
+		case "clear":
+			gs.ClearObjects(entry.Target)
+			return nil
+
+		case "image":
+			if entry.Image == nil {
+				return fmt.Errorf("no image given")
+			}
+			gs.SetImageLocation(entry.Image.Name, entry.Image.Zoom, entry.Image.Location)
+			return nil
+	}
+	return fmt.Errorf("unknown journal operation %s", entry.Op)
+}
+
+//
+// Journal an event which has just been recorded, given the object ID
+// and class it arrived with (since recording it may change them).
+// Called with gs.lock held.
+//
+func (gs *GameState) journalEvent(event *MapEvent, id, class string) {
+	if gs.journal == nil || event.Writer == "" {
+		return
+	}
+	entry, err := eventJournalEntry(event, id, class)
+	if err != nil {
+		log.Printf("Unable to journal %v: %v", event.Fields, err)
+		return
+	}
+	gs.journal.append(entry)
+}
+
+func eventJournalEntry(event *MapEvent, id, class string) (JournalEntry, error) {
+	raw, err := event.RawEventText()
+	if err != nil {
+		return JournalEntry{}, err
+	}
+	changed := event.Changed
+	entry := JournalEntry{
+		Op:       "event",
+		Event:    raw,
+		Extra:    event.MultiRawData,
+		ID:       id,
+		Class:    class,
+		User:     event.User,
+		Writer:   event.Writer,
+		Sequence: event.Sequence,
+		Changed:  &changed,
+	}
+	if event.ID != id {
+		// an OA for @name, which was for this object
+		entry.Object = event.ID
+	}
+	return entry, nil
+}
+
+//
+// The journal position the game state is up to, which is saved with
+// it. Called with the game state locked.
+//
+func (gs *GameState) journalMark() int64 {
+	if gs.journal != nil {
+		return gs.journal.Mark()
+	}
+	return gs.journaled
+}
+
+//
+// The journal table holds the mark of the last journal entry included
+// in the saved game state (see SQLiteStorage.SaveState).
+//
+func createJournalTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists journal (
+			mark integer not null
+		);`)
+	return err
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,245 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the event journal
+//
+
+package mapservice
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func journalTestService(t *testing.T, dir string) (*MapService, *Journal) {
+	storage, err := OpenStorageBackend("sqlite", filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatalf("unable to open database: %v", err)
+	}
+	journal, err := OpenJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatalf("unable to open journal: %v", err)
+	}
+	ms := &MapService{Storage: storage, Journal: journal}
+	if err = ms.LoadState(); err != nil {
+		t.Fatalf("unable to load state: %v", err)
+	}
+	ms.State.RecoverFromJournal(journal)
+	ms.State.SetJournal(journal)
+	return ms, journal
+}
+
+func TestJournalRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ms, journal := journalTestService(t, dir)
+	ms.UpdateState(testEvent(t, "PS abc red Grax 1 M monster 3 4 0"))
+	if err := ms.SaveState(); err != nil {
+		t.Fatalf("unable to save state: %v", err)
+	}
+	ms.UpdateState(testEvent(t, "OA @Grax {GX 10}"))
+	ms.UpdateState(testEvent(t, "OA+ abc STATUSLIST {prone}"))
+	ms.UpdateState(testEvent(t, "PS def red Fred 1 M monster 5 4 0"))
+	ms.UpdateState(testEvent(t, "CS 12 0"))
+	ms.State.SetImageLocation("goblin", "1", "/images/goblin.png")
+	ms.State.ClearObjects("def")
+
+	// changes reach the disk without waiting for anything else to happen
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(filepath.Join(dir, "journal"))
+		if strings.Count(string(data), "\n") == 6 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("journal never written: %q", data)
+		}
+		time.Sleep(JournalSyncInterval)
+	}
+
+	// the server crashes here, and starts again
+	journal.Close()
+	ms.Storage.Close()
+	recovered, journal := journalTestService(t, dir)
+	defer recovered.Storage.Close()
+	defer journal.Close()
+	opts := []cmp.Option{cmpopts.IgnoreUnexported(GameState{}), cmpopts.IgnoreFields(GameState{}, "SaveNeeded")}
+	if !cmp.Equal(ms.State, recovered.State, opts...) {
+		t.Errorf("recovered state differs: %s", cmp.Diff(ms.State, recovered.State, opts...))
+	}
+	if ms.State.Clock().String() != recovered.State.Clock().String() {
+		t.Errorf("recovered clock %v, expected %v", recovered.State.Clock(), ms.State.Clock())
+	}
+	if !recovered.State.NeedsSave() {
+		t.Errorf("recovered changes aren't waiting to be saved")
+	}
+
+	// once they're saved, the journal is emptied, and carries on from there
+	if err := recovered.SaveState(); err != nil {
+		t.Fatalf("unable to save state: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "journal")); err != nil || info.Size() != 0 {
+		t.Errorf("journal not emptied (%v)", err)
+	}
+	recovered.UpdateState(testEvent(t, "CO 1"))
+	if journal.Mark() != 8 {
+		t.Errorf("journal mark is %d", journal.Mark())
+	}
+}
+
+func TestJournalSavedButNotDiscarded(t *testing.T) {
+	dir := t.TempDir()
+	ms, journal := journalTestService(t, dir)
+	ms.UpdateState(testEvent(t, "PS abc red Grax 1 M monster 3 4 0"))
+	ms.UpdateState(testEvent(t, "CS 12 0"))
+	// saved, but the server crashes before it can discard the journal
+	if err := ms.Storage.SaveState(ms.State); err != nil {
+		t.Fatalf("unable to save state: %v", err)
+	}
+	ms.UpdateState(testEvent(t, "CS 13 0"))
+	journal.Close()
+	ms.Storage.Close()
+
+	recovered, journal := journalTestService(t, dir)
+	defer recovered.Storage.Close()
+	defer journal.Close()
+	if fields, _ := recovered.State.RecordedEvent("CS"); len(fields) < 2 || fields[1] != "13" {
+		t.Errorf("clock is %v", fields)
+	}
+	if journal.Mark() != 3 {
+		t.Errorf("journal mark is %d", journal.Mark())
+	}
+}
+
+func TestJournalDamaged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal")
+	if err := os.WriteFile(path, []byte(`{"n":1,"op":"event","event":"CS 12 0"}
+not an entry
+{"n":2,"op":"image","image":{"Name":"orc","Zoom":"1","Location":"x"}}
+{"n":3,"op":"ev`), 0600); err != nil {
+		t.Fatalf("unable to write journal: %v", err)
+	}
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("unable to open journal: %v", err)
+	}
+	gs := NewGameState()
+	if n := gs.RecoverFromJournal(journal); n != 2 {
+		t.Errorf("recovered %d entries", n)
+	}
+	if _, ok := gs.ImageLocation("orc", "1"); !ok {
+		t.Errorf("image not recovered")
+	}
+	gs.SetJournal(journal)
+	gs.Record(testEvent(t, "CO 1"))
+	journal.Close()
+
+	data, _ := os.ReadFile(path)
+	if lines := strings.Split(string(data), "\n"); len(lines) != 5 || !strings.HasPrefix(lines[3], `{"n":3,"op":"event","event":"CO 1"`) {
+		t.Errorf("journal is now %q", data)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	dir := t.TempDir()
+	ms, journal := journalTestService(t, dir)
+	defer ms.Storage.Close()
+	journal.SetLimit(400)
+	go ms.compactJournal(journal)
+	defer journal.Close()
+
+	for i := 0; i < 10; i++ {
+		ms.UpdateState(testEvent(t, fmt.Sprintf("PS id%d red Orc%d 1 M monster %d 4 0", i, i, i)))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for journal.Stats().Compactions == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("journal never compacted: %+v", journal.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stats := journal.Stats()
+	if stats.Bytes >= 400 || stats.Limit != 400 || stats.Failures != 0 || stats.LastDuration <= 0 || stats.MaxDuration < stats.LastDuration {
+		t.Errorf("journal stats %+v", stats)
+	}
+
+	// whatever didn't make it into that save is still recovered
+	journal.SetLimit(0)
+	ms.UpdateState(testEvent(t, "CS 12 0"))
+	journal.Close()
+	restored, j := journalTestService(t, dir)
+	defer restored.Storage.Close()
+	defer j.Close()
+	if len(restored.State.MapObjects()) != 10 {
+		t.Errorf("restored %d objects", len(restored.State.MapObjects()))
+	}
+	if _, ok := restored.State.RecordedEvent("CS"); !ok {
+		t.Errorf("last change not recovered")
+	}
+
+	ms.Journal = j
+	_, token, _ := ms.issueAPIToken("grafana", ScopeReadOnly, 0)
+	status, reply := apiTestRequest(t, ms, "GET", "/api/v1/metrics", token, "")
+	if report, ok := reply["journal"].(map[string]interface{}); status != 200 || !ok || report["limit"] != 0.0 {
+		t.Errorf("metrics got %d %v", status, reply)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,229 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     Map Layers                                     //
+//                                                                                    //
+// Map elements may be placed on layers by giving them a LAYER attribute. Some layers //
+// (such as the GM's own annotations and notes) are only for the GM, so the server    //
+// won't show them to the players or let the players change them, whatever their      //
+// client may try.                                                                    //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"log"
+	"strings"
+)
+
+//
+// DefaultGMLayers are the map layers which only the GM may see or
+// change, unless the server is told otherwise. Everything else
+// (including the players' drawing layer) is open to everyone.
+//
+var DefaultGMLayers = []string{"gm", "notes"}
+
+//
+// Is this one of the GM-only map layers?
+//
+func (ms *MapService) isGMLayer(layer string) bool {
+	if layer == "" {
+		return false
+	}
+	layers := ms.GMLayers
+	if layers == nil {
+		layers = DefaultGMLayers
+	}
+	for _, l := range layers {
+		if strings.EqualFold(l, layer) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Is the object with the given ID on a GM-only layer?
+//
+func (ms *MapService) isGMObject(id string) bool {
+	if id == "" {
+		return false
+	}
+	obj, ok := ms.State.Object(id)
+	return ok && ms.isGMLayer(obj.Attrs["LAYER"])
+}
+
+//
+// Does an OA attribute list put the object on a GM-only layer?
+//
+func (ms *MapService) setsGMLayer(attrs string) bool {
+	kvlist, err := ParseTclList(attrs)
+	if err != nil {
+		return false
+	}
+	for i := 0; i+1 < len(kvlist); i += 2 {
+		if kvlist[i] == "LAYER" && ms.isGMLayer(kvlist[i+1]) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Are there any objects on GM-only layers?
+//
+func (ms *MapService) anyGMObjects() bool {
+	ms.State.lock.RLock()
+	defer ms.State.lock.RUnlock()
+	for _, obj := range ms.State.Objects {
+		if ms.isGMLayer(obj.Attrs["LAYER"]) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Check that a player isn't trying to change something on a GM-only
+// layer (or move something onto one). If they are, they're told no and
+// we return false. The GM may do anything.
+//
+func (ms *MapService) checkLayerAccess(event *MapEvent, thisClient *MapClient) bool {
+	if thisClient.IsGM() {
+		return true
+	}
+	var denied string
+	switch event.EventType() {
+		case "OA", "OA+", "OA-":
+			id, _, _ := ms.State.ResolveObject(event.Fields[1])
+			if ms.isGMObject(id) || (event.EventType() == "OA" && ms.setsGMLayer(event.Fields[2])) {
+				denied = event.Fields[1]
+			}
+		case "CLR":
+			switch event.Fields[1] {
+				case "*", "E*":
+					if ms.anyGMObjects() {
+						denied = "everything"
+					}
+				default:
+					id, _, _ := ms.State.ResolveObject(event.Fields[1])
+					if id == "" {
+						id = event.Fields[1]
+					}
+					if ms.isGMObject(id) {
+						denied = event.Fields[1]
+					}
+			}
+		default:
+			return true
+	}
+	if denied == "" {
+		return true
+	}
+	log.Printf("[client %s] DENIED %s on GM-only map layer to %s", thisClient.logTag(), event.EventType(), thisClient.Username())
+	thisClient.sendError("you may not change %s since that includes the GM's own map layers", denied)
+	return false
+}
+
+//
+// Send a message about an object to the other clients, but if it's
+// hidden (on a GM-only layer), only send it to the GM.
+//
+func (ms *MapService) sendObjectToOthers(thisClient *MapClient, hidden bool, values ...string) {
+	if !hidden {
+		thisClient.SendToOthers(values...)
+		return
+	}
+	for _, peer := range ms.Clients.Subscribers(values[0]) {
+		if peer.ClientAddr != thisClient.ClientAddr && peer.IsGM() {
+			peer.Send(values...)
+		}
+	}
+}
+
+//
+// Send a message the server made up about an object to all the clients,
+// but if it's hidden, only to the GM.
+//
+func (ms *MapService) sendObjectToAll(hidden bool, values ...string) {
+	for _, peer := range ms.Clients.Subscribers(values[0]) {
+		if !peer.WriteOnly && (!hidden || peer.IsGM()) {
+			peer.Send(values...)
+		}
+	}
+}
+
+//
+// Remove an object from the map on the server's own initiative,
+// telling everyone who could see it.
+//
+func (ms *MapService) clearObject(id string) {
+	raw, err := ToTclString([]string{"CLR", id})
+	if err != nil {
+		log.Printf("Unable to clear object %s: %v", id, err)
+		return
+	}
+	ev, err := NewMapEvent(raw, id, "")
+	if err != nil {
+		log.Printf("Unable to clear object %s: %v", id, err)
+		return
+	}
+	hidden := ms.isGMObject(id)
+	ms.State.ClearObjects(id)
+	ms.sendObjectToAll(hidden, ev.Fields...)
+	ms.UpdateState(ev)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
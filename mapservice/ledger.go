@@ -0,0 +1,204 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                           Experience and Treasure Ledger                           //
+//                                                                                    //
+// A record of the experience points and treasure the GM has awarded to each player,  //
+// with their running totals.                                                         //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+//
+// An Award is an amount of experience and/or treasure the GM gave
+// to a player.
+//
+type Award struct {
+	Time      time.Time // when it was awarded
+	User      string    // player who received it
+	AwardedBy string    // GM who awarded it
+	XP        int       // experience points (negative to take some back)
+	GP        int       // value of the treasure in gold pieces
+	Reason    string    // what it was for
+}
+
+//
+// A LedgerEntry is an award along with the player's running totals
+// including it.
+//
+type LedgerEntry struct {
+	Award
+	TotalXP int
+	TotalGP int
+}
+
+//
+// LedgerStorage is implemented by storage backends which can keep
+// a ledger of experience and treasure awards.
+//
+type LedgerStorage interface {
+	AddAwards(awards []Award) error
+	LoadAwards(user string) ([]Award, error)
+}
+
+//
+// Database Schema
+//  ________________
+// | awards         |
+// |----------------|
+// | awardid    PAi |
+// | time         i |
+// | user         s |
+// | awardedby    s |
+// | xp           i |
+// | gp           i |
+// | reason       s |
+// |________________|
+//
+// P=primary key
+// A=auto-increment
+// i=integer
+// s=string
+//
+// The time is stored as seconds since the epoch. This table was added
+// after the others, so it is created whenever we open a database which
+// doesn't have it yet.
+//
+func createAwardTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists awards (
+			awardid   integer primary key,
+			time      integer not null,
+			user      text    not null,
+			awardedby text    not null,
+			xp        integer not null,
+			gp        integer not null,
+			reason    text    not null
+		);`)
+	return err
+}
+
+//
+// AddAwards records a set of awards in the ledger. Either all of them
+// are recorded or none are.
+//
+func AddAwards(db *sql.DB, awards []Award) error {
+	return withTransaction(db, func(tx *sql.Tx) error {
+		for _, a := range awards {
+			if _, err := tx.Exec(`insert into awards (time, user, awardedby, xp, gp, reason) values (?, ?, ?, ?, ?, ?)`,
+				a.Time.Unix(), a.User, a.AwardedBy, a.XP, a.GP, a.Reason); err != nil {
+				return fmt.Errorf("Unable to save award to %s: %w", a.User, err)
+			}
+		}
+		return nil
+	})
+}
+
+//
+// LoadAwards reads the awards from the ledger in the order they were
+// made. If user is not empty, only that player's awards are read.
+//
+func LoadAwards(db *sql.DB, user string) ([]Award, error) {
+	var rows *sql.Rows
+	var err error
+
+	if user == "" {
+		rows, err = db.Query(`select time, user, awardedby, xp, gp, reason from awards order by awardid`)
+	} else {
+		rows, err = db.Query(`select time, user, awardedby, xp, gp, reason from awards where user = ? order by awardid`, user)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var awards []Award
+	for rows.Next() {
+		var a Award
+		var when int64
+		if err = rows.Scan(&when, &a.User, &a.AwardedBy, &a.XP, &a.GP, &a.Reason); err != nil {
+			return nil, fmt.Errorf("unable to read awards: %v", err)
+		}
+		a.Time = time.Unix(when, 0)
+		awards = append(awards, a)
+	}
+	return awards, rows.Err()
+}
+
+//
+// RunningTotals pairs each award with the totals its player had
+// received up to and including it.
+//
+func RunningTotals(awards []Award) []LedgerEntry {
+	type totals struct{ xp, gp int }
+	sums := make(map[string]totals)
+	var entries []LedgerEntry
+	for _, a := range awards {
+		t := sums[a.User]
+		t.xp += a.XP
+		t.gp += a.GP
+		sums[a.User] = t
+		entries = append(entries, LedgerEntry{Award: a, TotalXP: t.xp, TotalGP: t.gp})
+	}
+	return entries
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,405 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Light Sources                                    //
+//                                                                                    //
+// Lights the GM has placed on the map, each shining a given number of grid squares   //
+// from where it stands or from the creature carrying it. Together with the walls     //
+// which block line of sight, they decide which creatures another can actually make   //
+// out, given how well it sees in the dark (its VISION attribute).                    //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//
+// A Light is a light source on the map. If it is carried by a creature
+// (Token), it shines from wherever that creature is, and not at all
+// while the creature isn't on the map.
+//
+type Light struct {
+	ID     string  `json:"id"`
+	X      float64 `json:"x"`               // where it stands, in map coordinates
+	Y      float64 `json:"y"`
+	Radius float64 `json:"radius"`          // how many grid squares it lights
+	Color  string  `json:"color"`
+	Token  string  `json:"token,omitempty"` // ID of the creature carrying it
+}
+
+//
+// ParseLight makes sense of the fields of an LT message (<id> <x> <y>
+// <radius> <color> [<token>]).
+//
+func ParseLight(fields []string) (Light, error) {
+	if len(fields) < 5 || len(fields) > 6 {
+		return Light{}, fmt.Errorf("Lights need an ID, location, radius, and color")
+	}
+	l := Light{ID: fields[0], Color: fields[4]}
+	if l.ID == "" {
+		return Light{}, fmt.Errorf("Lights must have an ID")
+	}
+	for i, v := range []*float64{&l.X, &l.Y, &l.Radius} {
+		var err error
+		*v, err = strconv.ParseFloat(fields[i+1], 64)
+		if err != nil || math.IsNaN(*v) || math.IsInf(*v, 0) {
+			return Light{}, fmt.Errorf("Light %s %s \"%s\" is not a number", l.ID, []string{"x coordinate", "y coordinate", "radius"}[i], fields[i+1])
+		}
+	}
+	if l.Radius < 0 {
+		return Light{}, fmt.Errorf("Light %s radius may not be negative", l.ID)
+	}
+	if len(fields) > 5 {
+		l.Token = fields[5]
+	}
+	return l, nil
+}
+
+//
+// Message returns the LT message which shows the light to a client.
+//
+func (l Light) Message() []string {
+	return []string{"LT", l.ID,
+		strconv.FormatFloat(l.X, 'f', -1, 64),
+		strconv.FormatFloat(l.Y, 'f', -1, 64),
+		strconv.FormatFloat(l.Radius, 'f', -1, 64),
+		l.Color, l.Token}
+}
+
+//
+// ParseVision makes sense of a creature's VISION attribute, a list of
+// the ways it sees beyond the ordinary: "lowlight" (it sees twice as
+// far by any light) and "darkvision <squares>" (it sees that far with
+// no light at all). An empty list (or "normal") is ordinary vision.
+//
+func ParseVision(vision string) (lowLight bool, darkvision float64, err error) {
+	words, err := ParseTclList(vision)
+	if err != nil {
+		return false, 0, fmt.Errorf("Vision \"%s\" is malformed (%v)", vision, err)
+	}
+	for i := 0; i < len(words); i++ {
+		switch strings.ToLower(words[i]) {
+			case "normal":
+			case "lowlight", "low-light":
+				lowLight = true
+			case "darkvision":
+				if i+1 >= len(words) {
+					return false, 0, fmt.Errorf("Vision \"%s\" doesn't say how far darkvision reaches", vision)
+				}
+				i++
+				if darkvision, err = strconv.ParseFloat(words[i], 64); err != nil || darkvision < 0 {
+					return false, 0, fmt.Errorf("Darkvision range \"%s\" is not a distance", words[i])
+				}
+			default:
+				return false, 0, fmt.Errorf("Vision \"%s\" not understood", words[i])
+		}
+	}
+	return lowLight, darkvision, nil
+}
+
+//
+// lightList holds the light sources on the map, by ID.
+//
+type lightList struct {
+	lock   sync.Mutex
+	lights map[string]Light
+}
+
+func (l *lightList) set(light Light) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.lights == nil {
+		l.lights = make(map[string]Light)
+	}
+	l.lights[light.ID] = light
+}
+
+func (l *lightList) remove(id string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, ok := l.lights[id]
+	delete(l.lights, id)
+	return ok
+}
+
+//
+// The lights, sorted by ID.
+//
+func (l *lightList) all() []Light {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var lights []Light
+	for _, light := range l.lights {
+		lights = append(lights, light)
+	}
+	sort.Slice(lights, func(i, j int) bool { return lights[i].ID < lights[j].ID })
+	return lights
+}
+
+//
+// LightStorage is implemented by storage backends which can keep the
+// light sources on the map.
+//
+type LightStorage interface {
+	LoadLights() ([]Light, error)
+	SaveLight(l Light) error
+	DeleteLight(id string) error
+}
+
+//
+// Database Schema
+//  _______________
+// | lights        |
+// |---------------|
+// | id         Ps |
+// | x           r |
+// | y           r |
+// | radius      r |
+// | color       s |
+// | token       s |
+// |_______________|
+//
+// P=primary key
+// r=real
+// s=string
+//
+// This table was added after the others, so it is created whenever we
+// open a database which doesn't have it yet.
+//
+func createLightTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists lights (
+			id     text primary key,
+			x      real not null,
+			y      real not null,
+			radius real not null,
+			color  text not null,
+			token  text not null
+		);`)
+	return err
+}
+
+//
+// LoadLights reads the light sources from the database.
+//
+func LoadLights(db *sql.DB) ([]Light, error) {
+	rows, err := db.Query(`select id, x, y, radius, color, token from lights order by id`)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read lights: %v", err)
+	}
+	defer rows.Close()
+	var lights []Light
+	for rows.Next() {
+		var l Light
+		if err = rows.Scan(&l.ID, &l.X, &l.Y, &l.Radius, &l.Color, &l.Token); err != nil {
+			return nil, fmt.Errorf("Unable to read lights: %v", err)
+		}
+		lights = append(lights, l)
+	}
+	return lights, rows.Err()
+}
+
+//
+// SaveLight stores a light source, replacing any with the same ID.
+//
+func SaveLight(db *sql.DB, l Light) error {
+	if _, err := db.Exec(`insert or replace into lights (id, x, y, radius, color, token) values (?, ?, ?, ?, ?, ?)`,
+		l.ID, l.X, l.Y, l.Radius, l.Color, l.Token); err != nil {
+		return fmt.Errorf("Unable to save light %s: %v", l.ID, err)
+	}
+	return nil
+}
+
+//
+// DeleteLight removes a light source from the database.
+//
+func DeleteLight(db *sql.DB, id string) error {
+	if _, err := db.Exec(`delete from lights where id = ?`, id); err != nil {
+		return fmt.Errorf("Unable to delete light %s: %v", id, err)
+	}
+	return nil
+}
+
+//
+// Load the saved light sources, if the storage backend keeps them.
+//
+func (ms *MapService) loadLights() error {
+	storage, ok := ms.Storage.(LightStorage)
+	if !ok {
+		return nil
+	}
+	lights, err := storage.LoadLights()
+	if err != nil {
+		return err
+	}
+	for _, l := range lights {
+		ms.lights.set(l)
+	}
+	return nil
+}
+
+//
+// Lights returns the light sources on the map, sorted by ID.
+//
+func (ms *MapService) Lights() []Light {
+	return ms.lights.all()
+}
+
+//
+// Place a light (or change one), saving it if we can, and show it to
+// everyone but the client who did it.
+//
+func (ms *MapService) setLight(thisClient *MapClient, l Light) error {
+	if storage, ok := ms.Storage.(LightStorage); ok {
+		if err := storage.SaveLight(l); err != nil {
+			return err
+		}
+	}
+	ms.lights.set(l)
+	for _, peer := range ms.Clients.Subscribers("LT") {
+		if peer != thisClient && peer.Authenticated {
+			peer.Send(l.Message()...)
+		}
+	}
+	return nil
+}
+
+//
+// Remove a light, returning false if there wasn't one with that ID,
+// and tell everyone but the client who removed it.
+//
+func (ms *MapService) deleteLight(thisClient *MapClient, id string) (bool, error) {
+	if storage, ok := ms.Storage.(LightStorage); ok {
+		if err := storage.DeleteLight(id); err != nil {
+			return false, err
+		}
+	}
+	if !ms.lights.remove(id) {
+		return false, nil
+	}
+	for _, peer := range ms.Clients.Subscribers("LT-") {
+		if peer != thisClient && peer.Authenticated {
+			peer.Send("LT-", id)
+		}
+	}
+	return true, nil
+}
+
+//
+// Show a client the light sources on the map.
+//
+func (ms *MapService) sendLights(thisClient *MapClient) {
+	for _, l := range ms.lights.all() {
+		thisClient.Send(l.Message()...)
+	}
+}
+
+//
+// A light shining from (X, Y) as far as Reach map pixels.
+//
+type shiningLight struct {
+	X, Y, Reach float64
+}
+
+//
+// The lights shining on the map as seen by a creature with low-light
+// vision or not, and whether any were placed at all. The caller must
+// hold the game state lock.
+//
+func (ms *MapService) shiningLights(lowLight bool) ([]shiningLight, bool) {
+	placed := ms.lights.all()
+	var shining []shiningLight
+	for _, l := range placed {
+		s := shiningLight{X: l.X, Y: l.Y, Reach: l.Radius * GMAGridSize}
+		if lowLight {
+			s.Reach *= 2
+		}
+		if l.Token != "" {
+			obj, ok := ms.State.Objects[l.Token]
+			if !ok {
+				continue
+			}
+			x, y, width, ok := creatureArea(obj)
+			if !ok {
+				continue
+			}
+			s.X, s.Y = x+width/2, y+width/2
+		}
+		shining = append(shining, s)
+	}
+	return shining, len(placed) > 0
+}
+
+//
+// Is (x, y) lit by any of the lights, or are they all too far away or
+// behind walls?
+//
+func litPoint(x, y float64, lights []shiningLight, walls []wallSegment) bool {
+	for _, l := range lights {
+		if math.Hypot(x-l.X, y-l.Y) <= l.Reach && !sightBlocked(l.X, l.Y, x, y, walls) {
+			return true
+		}
+	}
+	return false
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,196 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for light sources
+//
+
+package mapservice
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseVision(t *testing.T) {
+	for i, test := range []struct {
+		vision     string
+		lowLight   bool
+		darkvision float64
+		err        string
+	}{
+		{"", false, 0, ""},
+		{"normal", false, 0, ""},
+		{"lowlight", true, 0, ""},
+		{"Low-Light darkvision 12", true, 12, ""},
+		{"darkvision", false, 0, "doesn't say how far"},
+		{"darkvision -1", false, 0, "not a distance"},
+		{"xray", false, 0, "not understood"},
+	} {
+		lowLight, darkvision, err := ParseVision(test.vision)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("test %d: error %v, expected %q", i, err, test.err)
+			}
+		} else if err != nil || lowLight != test.lowLight || darkvision != test.darkvision {
+			t.Errorf("test %d: got %v, %v, %v", i, lowLight, darkvision, err)
+		}
+	}
+}
+
+func TestLightCommands(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "LT l1 350 25 2 yellow"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV") {
+		t.Errorf("player placing a light was sent %v", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "LT l1 350 25 2 yellow"), gm)
+	ms.ExecuteAction(testEvent(t, "LT l2 0 0 0.5 orange m2"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 0 {
+		t.Errorf("GM was sent %v", sent)
+	}
+	if sent := sentToTestClient(alice); strings.Join(sent, "\n") != "LT l1 350 25 2 yellow {}\nLT l2 0 0 0.5 orange m2" {
+		t.Errorf("player was sent %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "LT?"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 4 || sent[0] != "LT=" || sent[2] != "LT: l2 0 0 0.5 orange m2" {
+		t.Errorf("player's LT? was answered with %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "LT- l2"), gm)
+	if sent := sentToTestClient(alice); strings.Join(sent, "\n") != "LT- l2" {
+		t.Errorf("player was sent %q when light removed", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "LT- l2"), gm)
+	ms.ExecuteAction(testEvent(t, "LT l3 x 0 1 red"), gm)
+	ms.ExecuteAction(testEvent(t, "LT l3 0 0 -1 red"), gm)
+	sent := sentToTestClient(gm)
+	if len(sent) != 3 || sent[0] != "// {There is no light l2.}" || !strings.Contains(sent[1], "x coordinate") || !strings.Contains(sent[2], "negative") {
+		t.Errorf("GM was sent %q for mistakes", sent)
+	}
+}
+
+func TestLightsSaved(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", filepath.Join(t.TempDir(), "lights.db"))
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	gm := newTestClient(ms, "gm", "GM", true)
+	ms.ExecuteAction(testEvent(t, "LT l1 350 25 2 yellow"), gm)
+	ms.ExecuteAction(testEvent(t, "LT l2 0 0 0.5 orange m2"), gm)
+	ms.ExecuteAction(testEvent(t, "LT- l1"), gm)
+
+	restarted := newTestService()
+	restarted.Storage = storage
+	if err = restarted.loadLights(); err != nil {
+		t.Fatalf("unable to load lights: %v", err)
+	}
+	lights := restarted.Lights()
+	if len(lights) != 1 || lights[0] != (Light{ID: "l2", Radius: 0.5, Color: "orange", Token: "m2"}) {
+		t.Errorf("lights loaded were %v", lights)
+	}
+
+	alice := newTestClient(restarted, "alice", "alice", false)
+	restarted.sendPostAuthPreamble(alice, true)
+	if sent := strings.Join(sentToTestClient(alice), "\n"); !strings.Contains(sent, "LT l2 0 0 0.5 orange m2") {
+		t.Errorf("player was greeted with %q", sent)
+	}
+}
+
+func TestLightsAndVision(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	ms.ExecuteAction(testEvent(t, "PS p1 blue Alice 1 M player 0 0 1"), gm)
+	ms.ExecuteAction(testEvent(t, "PS m2 red Goblin 1 M monster 4 0 1"), gm)
+
+	perceives := func(what, expected string) {
+		t.Helper()
+		sight, err := ms.LineOfSight("p1", 0, true)
+		if err != nil {
+			t.Fatalf("line of sight failed (%s): %v", what, err)
+		}
+		if strings.Join(sight.Visible, " ") != "m2" {
+			t.Errorf("%s: Alice can see %v", what, sight.Visible)
+		}
+		if strings.Join(sight.Perceived, " ") != expected {
+			t.Errorf("%s: Alice can make out %v", what, sight.Perceived)
+		}
+	}
+
+	perceives("no lights placed", "m2")
+	ms.ExecuteAction(testEvent(t, "LT l1 350 25 2 yellow"), gm)
+	perceives("light too far", "")
+	ms.ExecuteAction(testEvent(t, "OA p1 {VISION lowlight}"), gm)
+	perceives("low-light vision", "m2")
+	sendTestLS(t, ms, gm, "TYPE:w1 line", "X:w1 300", "Y:w1 -500", "POINTS:w1 {300 500}", "LAYER:w1 walls")
+	perceives("light behind a wall", "")
+	ms.ExecuteAction(testEvent(t, "OA p1 {VISION {darkvision 5}}"), gm)
+	perceives("darkvision", "m2")
+	ms.ExecuteAction(testEvent(t, "OA p1 {VISION normal}"), gm)
+	perceives("normal vision", "")
+	ms.ExecuteAction(testEvent(t, "LT l2 0 0 0.5 orange m2"), gm)
+	perceives("light carried", "m2")
+
+	ms.ExecuteAction(testEvent(t, "OA p1 {VISION {darkvision far}}"), gm)
+	if _, err := ms.LineOfSight("p1", 0, true); err == nil || !strings.Contains(err.Error(), "not a distance") {
+		t.Errorf("bad vision gave error %v", err)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,152 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                 Recent log history                                 //
+//                                                                                    //
+// Keeping the last lines written to the server's log in memory, so they can be       //
+// fetched through the HTTP API from a running server even if the log file has been   //
+// rotated away or was never configured.                                              //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"strings"
+	"sync"
+)
+
+//
+// Unless configured otherwise, we keep this many of the most recent
+// lines written to the log in memory.
+//
+const DefaultLogBufferLines = 1000
+
+//
+// A LogBuffer keeps the last few lines written to it, so that (by
+// adding it as another destination for the log) an operator can see
+// what the server has been saying lately through the HTTP API, even
+// if the log file has been rotated away or there isn't one.
+//
+type LogBuffer struct {
+	lock    sync.Mutex
+	lines   []string // ring of saved lines; the oldest is at next once it fills up
+	next    int      // where the next line goes
+	full    bool     // have we wrapped around yet?
+	partial string   // start of a line which hasn't been finished yet
+}
+
+//
+// NewLogBuffer makes a LogBuffer which holds up to n lines.
+//
+func NewLogBuffer(n int) *LogBuffer {
+	if n < 1 {
+		n = 1
+	}
+	return &LogBuffer{lines: make([]string, n)}
+}
+
+//
+// Write saves the lines in p (which need not be whole lines; the log
+// package always writes whole ones, but we don't count on it),
+// dropping the oldest ones to make room.
+//
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	text := b.partial + string(p)
+	for {
+		eol := strings.IndexByte(text, '\n')
+		if eol < 0 {
+			break
+		}
+		b.lines[b.next] = text[:eol]
+		b.next = (b.next + 1) % len(b.lines)
+		if b.next == 0 {
+			b.full = true
+		}
+		text = text[eol+1:]
+	}
+	b.partial = text
+	return len(p), nil
+}
+
+//
+// Lines returns the most recent n lines (or all of them if n is 0)
+// which contain match, oldest first.
+//
+func (b *LogBuffer) Lines(n int, match string) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var saved []string
+	if b.full {
+		saved = append(saved, b.lines[b.next:]...)
+	}
+	saved = append(saved, b.lines[:b.next]...)
+
+	lines := []string{}
+	for _, line := range saved {
+		if strings.Contains(line, match) {
+			lines = append(lines, line)
+		}
+	}
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,118 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the recent log history
+//
+
+package mapservice
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestLogBuffer(t *testing.T) {
+	b := NewLogBuffer(3)
+	if lines := b.Lines(0, ""); len(lines) != 0 {
+		t.Errorf("empty buffer has %q", lines)
+	}
+	fmt.Fprintf(b, "one\ntwo\nthr")
+	if lines := b.Lines(0, ""); !reflect.DeepEqual(lines, []string{"one", "two"}) {
+		t.Errorf("buffer has %q", lines)
+	}
+	fmt.Fprintf(b, "ee\nfour\nfive\n")
+	if lines := b.Lines(0, ""); !reflect.DeepEqual(lines, []string{"three", "four", "five"}) {
+		t.Errorf("wrapped buffer has %q", lines)
+	}
+	if lines := b.Lines(2, ""); !reflect.DeepEqual(lines, []string{"four", "five"}) {
+		t.Errorf("last 2 lines are %q", lines)
+	}
+	if lines := b.Lines(0, "f"); !reflect.DeepEqual(lines, []string{"four", "five"}) {
+		t.Errorf("matching lines are %q", lines)
+	}
+	if lines := b.Lines(1, "e"); !reflect.DeepEqual(lines, []string{"five"}) {
+		t.Errorf("last matching line is %q", lines)
+	}
+}
+
+func TestLogBufferAPI(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/log.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	_, reader, _ := ms.issueAPIToken("status page", ScopeReadOnly, 0)
+	_, admin, _ := ms.issueAPIToken("admin", ScopeAdmin, 0)
+
+	if status, _ := apiTestRequest(t, ms, "GET", "/api/v1/log", admin, ""); status != http.StatusServiceUnavailable {
+		t.Errorf("without a buffer, got status %d", status)
+	}
+	ms.LogBuffer = NewLogBuffer(10)
+	fmt.Fprintf(ms.LogBuffer, "[client a #1] hello\n[client b #2] hello\n[client a #1] goodbye\n")
+	if status, _ := apiTestRequest(t, ms, "GET", "/api/v1/log", reader, ""); status != http.StatusForbidden {
+		t.Errorf("read-only token gave status %d", status)
+	}
+	status, reply := apiTestRequest(t, ms, "GET", "/api/v1/log?match=%231%5D&limit=5", admin, "")
+	if lines, _ := reply["lines"].([]interface{}); status != http.StatusOK || len(lines) != 2 || lines[1] != "[client a #1] goodbye" {
+		t.Errorf("got status %d, %v", status, reply)
+	}
+	if status, _ := apiTestRequest(t, ms, "GET", "/api/v1/log?limit=all", admin, ""); status != http.StatusBadRequest {
+		t.Errorf("bad limit gave status %d", status)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
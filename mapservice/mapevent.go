@@ -60,6 +60,9 @@ const MESSAGE_ID_EPOCH = 1593130546
 type MapEvent struct {
 	MultiRawData []string
 	Sequence     int
+	Writer       string     // who stamped the Sequence (see EventClock)
+	Changed      EventStamp // the latest change this event carries
+	User         string     // who sent it, if a client did (for the journal)
 	Fields       []string
 	Key          string
 	Class        string
@@ -77,7 +80,13 @@ func (e MapEventList) Len() int {
 }
 
 func (e MapEventList) Less(i, j int) bool {
-	return e[i].Sequence < e[j].Sequence
+	if e[i].Sequence != e[j].Sequence {
+		return e[i].Sequence < e[j].Sequence
+	}
+	if e[i].Writer != e[j].Writer {
+		return e[i].Writer < e[j].Writer
+	}
+	return e[i].ID < e[j].ID
 }
 
 func (e MapEventList) Swap(i, j int) {
@@ -104,6 +113,7 @@ func even_elements(in []string) []string {
 type map_event_parameters struct {
 	MinParams	int
 	MaxParams	int
+	Syntax		string	// e.g. "TO from recip message [id [time]]" (see MessageSchema)
 }
 
 var map_event_checklist map[string]map_event_parameters
@@ -129,52 +139,131 @@ func init() {
 	next_message_id = int(time.Now().Unix() - MESSAGE_ID_EPOCH)
 
 	map_event_checklist = map[string]map_event_parameters{
-		"//":     {MinParams: 0, MaxParams: -1}, // //...
-		"ACCEPT": {MinParams: 1, MaxParams:  1}, // ACCEPT list
-		"AI":     {MinParams: 2, MaxParams:  2}, // AI name size
-		"AI:":    {MinParams: 1, MaxParams:  1}, // AI: data
-		"AI.":    {MinParams: 1, MaxParams:  2}, // AI. lines [cks]
-		"AI?":    {MinParams: 2, MaxParams:  2}, // AI? name size
-		"AI@":    {MinParams: 3, MaxParams:  3}, // AI@ name size id
-		"AUTH":   {MinParams: 1, MaxParams:  3}, // AUTH response [user [client]]
-		"AV":     {MinParams: 2, MaxParams:  2}, // AV x y
-		"CC":     {MinParams: 0, MaxParams:  3}, // CC [user [target [id]]]
-		"CLR":    {MinParams: 1, MaxParams:  1}, // CLR id
-		"CLR@":   {MinParams: 1, MaxParams:  1}, // CLR@ id
-		"CO":     {MinParams: 1, MaxParams:  1}, // CO state
-		"CS":     {MinParams: 2, MaxParams:  2}, // CS abs rel
-		"D":      {MinParams: 2, MaxParams:  2}, // D recipients dice
-		"DD":     {MinParams: 1, MaxParams:  1}, // DD list
-		"DD+":    {MinParams: 1, MaxParams:  1}, // DD+ list
-		"DD/":    {MinParams: 1, MaxParams:  1}, // DD/ regex
-		"DR":     {MinParams: 0, MaxParams:  0}, // DR
-		"DSM":    {MinParams: 3, MaxParams:  3}, // DSM cond shape color
-		"I":      {MinParams: 2, MaxParams:  2}, // I time id
-		"IL":     {MinParams: 1, MaxParams:  1}, // IL slotlist
-		"L":      {MinParams: 1, MaxParams:  1}, // L list
-		"LS":     {MinParams: 0, MaxParams:  0}, // LS
-		"LS:":    {MinParams: 0, MaxParams:  1}, // LS: [data]
-		"LS.":    {MinParams: 1, MaxParams:  2}, // LS. count [cks]
-		"M":      {MinParams: 1, MaxParams:  1}, // M list
-		"M?":     {MinParams: 1, MaxParams:  1}, // M? id
-		"M@":     {MinParams: 1, MaxParams:  1}, // M@ id
-		"MARK":   {MinParams: 2, MaxParams:  2}, // MARK x y
-		"MARCO":  {MinParams: 0, MaxParams:  0}, // MARCO
-		"NO":     {MinParams: 0, MaxParams:  0}, // NO
-		"NO+":    {MinParams: 0, MaxParams:  0}, // NO+
-		"OA":     {MinParams: 2, MaxParams:  2}, // OA id kvlist
-		"OA+":    {MinParams: 3, MaxParams:  3}, // OA+ id key vlist
-		"OA-":    {MinParams: 3, MaxParams:  3}, // OA- id key vlist
-		"POLO":   {MinParams: 0, MaxParams:  0}, // POLO
-		"PS":     {MinParams: 9, MaxParams:  9}, // PS id color name area size type x y reach
-		"ROLL":   {MinParams: 6, MaxParams:  6}, // ROLL from recip title result rlist id
-		"SYNC":   {MinParams: 0, MaxParams:  2}, // SYNC [CHAT [target]]
-		"TB":     {MinParams: 1, MaxParams:  1}, // TB state
-		"TO":     {MinParams: 3, MaxParams:  4}, // TO from recip message [id]
-		"/CONN":  {MinParams: 0, MaxParams:  0}, // /CONN
+		"//":     {MinParams: 0, MaxParams: -1, Syntax: "//..."},
+		"ACCEPT": {MinParams: 1, MaxParams:  1, Syntax: "ACCEPT list"},
+		"AI":     {MinParams: 2, MaxParams:  2, Syntax: "AI name size"},
+		"AI:":    {MinParams: 1, MaxParams:  2, Syntax: "AI: data [seq]"},
+		"AI.":    {MinParams: 1, MaxParams:  2, Syntax: "AI. lines [cks]"},
+		"AI?":    {MinParams: 2, MaxParams:  2, Syntax: "AI? name size"},
+		"AI@":    {MinParams: 3, MaxParams:  3, Syntax: "AI@ name size id"},
+		"AIB":    {MinParams: 4, MaxParams:  4, Syntax: "AIB name size length cks"},
+		"AUTH":   {MinParams: 1, MaxParams:  3, Syntax: "AUTH response [user [client]]"},
+		"AV":     {MinParams: 2, MaxParams:  2, Syntax: "AV x y"},
+		"CC":     {MinParams: 0, MaxParams:  3, Syntax: "CC [user [target [id]]]"},
+		"CK":     {MinParams: 1, MaxParams:  1, Syntax: "CK label"},
+		"CK?":    {MinParams: 0, MaxParams:  0, Syntax: "CK?"},
+		"CK-":    {MinParams: 1, MaxParams:  1, Syntax: "CK- label"},
+		"CLR":    {MinParams: 1, MaxParams:  1, Syntax: "CLR id"},
+		"CLR@":   {MinParams: 1, MaxParams:  1, Syntax: "CLR@ id"},
+		"CO":     {MinParams: 1, MaxParams:  1, Syntax: "CO state"},
+		"CS":     {MinParams: 2, MaxParams:  2, Syntax: "CS abs rel"},
+		"CT":     {MinParams: 8, MaxParams:  8, Syntax: "CT name image size color area reach type attrs"},
+		"CT?":    {MinParams: 0, MaxParams:  1, Syntax: "CT? [name]"},
+		"CT-":    {MinParams: 1, MaxParams:  1, Syntax: "CT- name"},
+		"D":      {MinParams: 2, MaxParams:  3, Syntax: "D recipients dice [preset]"},
+		"D?":     {MinParams: 2, MaxParams:  2, Syntax: "D? id dice"},
+		"DB":     {MinParams: 2, MaxParams:  2, Syntax: "DB id speclist"},
+		"DD":     {MinParams: 1, MaxParams:  1, Syntax: "DD list"},
+		"DD+":    {MinParams: 1, MaxParams:  1, Syntax: "DD+ list"},
+		"DD/":    {MinParams: 1, MaxParams:  1, Syntax: "DD/ regex"},
+		"DF":     {MinParams: 3, MaxParams:  3, Syntax: "DF user spec faces"},
+		"DI":     {MinParams: 2, MaxParams:  2, Syntax: "DI format mode"},
+		"DI:":    {MinParams: 0, MaxParams:  2, Syntax: "DI: [line [seq]]"},
+		"DI.":    {MinParams: 1, MaxParams:  2, Syntax: "DI. lines [cks]"},
+		"DO?":    {MinParams: 2, MaxParams:  3, Syntax: "DO? id dice [dc]"},
+		"DQ":     {MinParams: 3, MaxParams:  3, Syntax: "DQ elements points element-points"},
+		"DQ?":    {MinParams: 0, MaxParams:  0, Syntax: "DQ?"},
+		"DQ-":    {MinParams: 1, MaxParams:  2, Syntax: "DQ- user [count]"},
+		"DR":     {MinParams: 0, MaxParams:  1, Syntax: "DR [revision]"},
+		"DSM":    {MinParams: 3, MaxParams:  3, Syntax: "DSM cond shape color"},
+		"DU?":    {MinParams: 0, MaxParams:  1, Syntax: "DU? [count]"},
+		"DX":     {MinParams: 1, MaxParams:  1, Syntax: "DX format"},
+		"ED":     {MinParams: 3, MaxParams:  3, Syntax: "ED name x y"},
+		"EN":     {MinParams: 4, MaxParams:  4, Syntax: "EN name cr notes creatures"},
+		"EN?":    {MinParams: 0, MaxParams:  1, Syntax: "EN? [name]"},
+		"EN-":    {MinParams: 1, MaxParams:  1, Syntax: "EN- name"},
+		"EXPORT": {MinParams: 1, MaxParams:  2, Syntax: "EXPORT name [comment]"},
+		"FM":     {MinParams: 1, MaxParams:  1, Syntax: "FM state"},
+		"FMO":    {MinParams: 1, MaxParams:  1, Syntax: "FMO state"},
+		"GR":     {MinParams: 2, MaxParams:  2, Syntax: "GR leader members"},
+		"FX":     {MinParams: 3, MaxParams:  3, Syntax: "FX rain fog darkness"},
+		"FX?":    {MinParams: 0, MaxParams:  0, Syntax: "FX?"},
+		"GRID":   {MinParams: 4, MaxParams:  4, Syntax: "GRID shape scale xoffset yoffset"},
+		"GRID?":  {MinParams: 0, MaxParams:  0, Syntax: "GRID?"},
+		"HANDOFF": {MinParams: 1, MaxParams:  1, Syntax: "HANDOFF user"},
+		"I":      {MinParams: 2, MaxParams:  2, Syntax: "I time id"},
+		"IL":     {MinParams: 1, MaxParams:  1, Syntax: "IL slotlist"},
+		"INVITE": {MinParams: 1, MaxParams:  2, Syntax: "INVITE user [lifetime]"},
+		"IR":     {MinParams: 1, MaxParams:  2, Syntax: "IR names [tiebreak]"},
+		"L":      {MinParams: 1, MaxParams:  1, Syntax: "L list"},
+		"LOS?":   {MinParams: 2, MaxParams:  3, Syntax: "LOS? id creature [range]"},
+		"LT":     {MinParams: 5, MaxParams:  6, Syntax: "LT id x y radius color [token]"},
+		"LT-":    {MinParams: 1, MaxParams:  1, Syntax: "LT- id"},
+		"LT?":    {MinParams: 0, MaxParams:  0, Syntax: "LT?"},
+		"LS":     {MinParams: 0, MaxParams:  0, Syntax: "LS"},
+		"LS:":    {MinParams: 0, MaxParams:  2, Syntax: "LS: [data [seq]]"},
+		"LS.":    {MinParams: 1, MaxParams:  2, Syntax: "LS. count [cks]"},
+		"M":      {MinParams: 1, MaxParams:  1, Syntax: "M list"},
+		"M?":     {MinParams: 1, MaxParams:  1, Syntax: "M? id"},
+		"M@":     {MinParams: 1, MaxParams:  1, Syntax: "M@ id"},
+		"MARK":   {MinParams: 2, MaxParams:  2, Syntax: "MARK x y"},
+		"MARK?":  {MinParams: 0, MaxParams:  0, Syntax: "MARK?"},
+		"MARCO":  {MinParams: 0, MaxParams:  0, Syntax: "MARCO"},
+		"MV":     {MinParams: 3, MaxParams:  3, Syntax: "MV id creature path"},
+		"MV.":    {MinParams: 0, MaxParams:  0, Syntax: "MV."},
+		"NAK":    {MinParams: 2, MaxParams:  3, Syntax: "NAK type seq [to]"},
+		"NO":     {MinParams: 0, MaxParams:  0, Syntax: "NO"},
+		"NOTIFY": {MinParams: 1, MaxParams:  1, Syntax: "NOTIFY url"},
+		"NOTIFY?": {MinParams: 0, MaxParams:  0, Syntax: "NOTIFY?"},
+		"NOTIFY-": {MinParams: 0, MaxParams:  0, Syntax: "NOTIFY-"},
+		"NT":     {MinParams: 2, MaxParams:  2, Syntax: "NT title text"},
+		"NT?":    {MinParams: 0, MaxParams:  1, Syntax: "NT? [title]"},
+		"NT-":    {MinParams: 1, MaxParams:  1, Syntax: "NT- title"},
+		"NO+":    {MinParams: 0, MaxParams:  0, Syntax: "NO+"},
+		"OA":     {MinParams: 2, MaxParams:  2, Syntax: "OA id kvlist"},
+		"OA+":    {MinParams: 3, MaxParams:  3, Syntax: "OA+ id key vlist"},
+		"OA-":    {MinParams: 3, MaxParams:  3, Syntax: "OA- id key vlist"},
+		"OR":     {MinParams: 3, MaxParams:  5, Syntax: "OR id user spec [spec [tiebreak]]"},
+		"POLL":   {MinParams: 3, MaxParams:  4, Syntax: "POLL id question options [timeout]"},
+		"POLL-":  {MinParams: 1, MaxParams:  1, Syntax: "POLL- id"},
+		"POLO":   {MinParams: 0, MaxParams:  0, Syntax: "POLO"},
+		"PS":     {MinParams: 9, MaxParams:  9, Syntax: "PS id color name area size type x y reach"},
+		"PST":    {MinParams: 3, MaxParams:  5, Syntax: "PST template x y [name [id]]"},
+		"RA":     {MinParams: 4, MaxParams:  5, Syntax: "RA id creature kind trigger [description]"},
+		"RA-":    {MinParams: 2, MaxParams:  2, Syntax: "RA- id reason"},
+		"RB":     {MinParams: 1, MaxParams:  1, Syntax: "RB label"},
+		"RG":     {MinParams: 4, MaxParams:  5, Syntax: "RG id title points note [revealed]"},
+		"RG-":    {MinParams: 1, MaxParams:  1, Syntax: "RG- id"},
+		"RG?":    {MinParams: 0, MaxParams:  0, Syntax: "RG?"},
+		"RGV":    {MinParams: 2, MaxParams:  2, Syntax: "RGV id revealed"},
+		"ROLL":   {MinParams: 6, MaxParams:  7, Syntax: "ROLL from recip title result rlist id [time]"},
+		"SCENE":  {MinParams: 1, MaxParams:  1, Syntax: "SCENE name"},
+		"SEQ":    {MinParams: 1, MaxParams:  1, Syntax: "SEQ 0|1"},
+		"SESS-":  {MinParams: 0, MaxParams:  0, Syntax: "SESS-"},
+		"SH":     {MinParams: 3, MaxParams:  3, Syntax: "SH name base-version json"},
+		"SH?":    {MinParams: 0, MaxParams:  1, Syntax: "SH? [name]"},
+		"SH-":    {MinParams: 1, MaxParams:  1, Syntax: "SH- name"},
+		"SYNC":   {MinParams: 0, MaxParams:  2, Syntax: "SYNC [CHAT [target]]"},
+		"TB":     {MinParams: 1, MaxParams:  1, Syntax: "TB state"},
+		"TIME":   {MinParams: 1, MaxParams:  1, Syntax: "TIME milliseconds"},
+		"TK":     {MinParams: 2, MaxParams:  3, Syntax: "TK name scope [rate-limit]"},
+		"TK?":    {MinParams: 0, MaxParams:  0, Syntax: "TK?"},
+		"TK-":    {MinParams: 1, MaxParams:  1, Syntax: "TK- id"},
+		"TO":     {MinParams: 3, MaxParams:  5, Syntax: "TO from recip message [id [time]]"},
+		"VOTE":   {MinParams: 2, MaxParams:  2, Syntax: "VOTE id choice"},
+		"XP":     {MinParams: 4, MaxParams:  4, Syntax: "XP users xp gp reason"},
+		"XP?":    {MinParams: 0, MaxParams:  1, Syntax: "XP? [user]"},
+		"/CONN":  {MinParams: 0, MaxParams:  0, Syntax: "/CONN"},
 	}
 }
 
+//
+// Add a new event type to the list we know how to validate.
+//
+func registerEventType(name string, minParams, maxParams int) {
+	map_event_checklist[name] = map_event_parameters{MinParams: minParams, MaxParams: maxParams}
+}
+
 func (ev *MapEvent) ValidateMapEvent() error {
 	params, ok := map_event_checklist[ev.EventType()]
 	if !ok {
@@ -265,6 +354,21 @@ func NewMapEventFromList(raw string, fields []string, obj_id string, obj_class s
 		case "CLR", "CLR@", "M?", "M@":
 			ev.Key = ev.EventType() + ":" + ev.Fields[1]
 
+		case "RA", "RA-":
+			// RA- removes the RA with the same ID
+			ev.Key = "RA:" + ev.Fields[1]
+
+		case "DSM":
+			// DSM <condition> <shape> <color>
+			// only the latest definition of each condition's marker matters
+			ev.Key = "DSM:" + ev.Fields[1]
+
+		case "GR":
+			// GR <leader> <members>
+			// the group goes away along with its leader
+			ev.ID = ev.Fields[1]
+			ev.Key = "GR:" + ev.Fields[1]
+
 		case "PS":
 			// PS <id> <color> <name> <area> <size> player|monster <x> <y> <reach>
 			// set the event ID from the data received
@@ -61,7 +61,7 @@ func TestMapEvent(t *testing.T) {
 		{raw: "OK foo",etype: "OK", err: true},
 		{raw: "POLO",etype: "POLO"},
 		{raw: "SYNC foo",etype: "SYNC"},
-		{raw: "DSM foo x x",etype: "DSM"},
+		{raw: "DSM foo x x",etype: "DSM", key: "DSM:foo"},
 		{raw: "TO foo x x x",etype: "TO"},
 		{raw: "CLR x", etype: "CLR", key: "CLR:x"},
 		{raw: "CLR@ x", etype: "CLR@", key: "CLR@:x"},
@@ -0,0 +1,186 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     Map Export                                     //
+//                                                                                    //
+// Saving the map as it stands (including anything improvised during play) as a GMA   //
+// .map file which can be loaded again later.                                         //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// MapFileVersion is the version of the GMA .map file format we write.
+//
+const MapFileVersion = 17
+
+//
+// MapObjects returns copies of all the objects on the map, sorted
+// by ID.
+//
+func (gs *GameState) MapObjects() []MapObject {
+	gs.lock.RLock()
+	ids := make([]string, 0, len(gs.Objects))
+	for id := range gs.Objects {
+		ids = append(ids, id)
+	}
+	gs.lock.RUnlock()
+	sort.Strings(ids)
+
+	var objects []MapObject
+	for _, id := range ids {
+		if obj, ok := gs.Object(id); ok {
+			objects = append(objects, obj)
+		}
+	}
+	return objects
+}
+
+//
+// WriteMapFile writes the objects to w in the GMA .map file format:
+// a header line
+//   __MAPPER__:<version> {<comment> {<time> <date>}}
+// followed by each object's definition, one line per attribute
+// (just like the LS: lines which would load them onto a client).
+//
+func WriteMapFile(w io.Writer, objects []MapObject, comment string, now time.Time) error {
+	out := bufio.NewWriter(w)
+	timestamp, err := ToTclString([]string{strconv.FormatInt(now.Unix(), 10), now.Format(time.UnixDate)})
+	if err != nil {
+		return err
+	}
+	header, err := ToTclString([]string{comment, timestamp})
+	if err != nil {
+		return err
+	}
+	header, err = ToTclString([]string{header})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "__MAPPER__:%d %s\n", MapFileVersion, header)
+
+	for _, obj := range objects {
+		definition, err := obj.Definition()
+		if err != nil {
+			return fmt.Errorf("Unable to write object %s: %v", obj.ID, err)
+		}
+		for _, line := range definition {
+			fmt.Fprintln(out, line)
+		}
+	}
+	return out.Flush()
+}
+
+var mapFileName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+//
+// Save the current map as a .map file in the MapExportDir, with its
+// regions and ambient effects beside it (see saveRegionFile and
+// saveEffectsFile), returning its path and the number of objects and
+// regions written.
+//
+func (ms *MapService) exportMap(name, comment string) (string, int, int, error) {
+	objects := ms.State.MapObjects()
+	path, err := ms.saveMapFile(name, objects, comment)
+	if err != nil {
+		return path, 0, 0, err
+	}
+	regions, err := ms.saveRegionFile(path)
+	if err != nil {
+		return path, len(objects), 0, err
+	}
+	return path, len(objects), regions, ms.saveEffectsFile(path)
+}
+
+//
+// Save the objects as a .map file in the MapExportDir, returning its path.
+//
+func (ms *MapService) saveMapFile(name string, objects []MapObject, comment string) (string, error) {
+	if ms.MapExportDir == "" {
+		return "", fmt.Errorf("map export is not enabled on this server")
+	}
+	if !mapFileName.MatchString(name) {
+		return "", fmt.Errorf("map file name \"%s\" may only contain letters, digits, underscores, hyphens and dots", name)
+	}
+	if !strings.HasSuffix(name, ".map") {
+		name += ".map"
+	}
+	path := filepath.Join(ms.MapExportDir, name)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if err = WriteMapFile(f, objects, comment, time.Now()); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
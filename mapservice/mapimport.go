@@ -0,0 +1,617 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     Map Import                                     //
+//                                                                                    //
+// Converting maps from other virtual tabletops (Foundry VTT scenes, Roll20 pages,    //
+// and Universal VTT files such as Dungeondraft exports) into GMA map objects, so     //
+// groups moving to GMA can bring their maps with them.                               //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//
+// GMAGridSize is the size of a map grid square, in the pixels used
+// for map element coordinates.
+//
+const GMAGridSize = 50
+
+//
+// Roll20GridSize is the size of a Roll20 grid square, in pixels.
+//
+const Roll20GridSize = 70
+
+//
+// mapBuilder collects the objects for a map converted from another
+// tabletop's format, scaling its coordinates to match our grid.
+//
+type mapBuilder struct {
+	scale   float64 // our pixels per one of theirs
+	grid    float64 // their pixels per grid square
+	objects []MapObject
+	err     error
+}
+
+func newMapBuilder(grid float64) *mapBuilder {
+	if grid <= 0 {
+		grid = GMAGridSize
+	}
+	return &mapBuilder{scale: GMAGridSize / grid, grid: grid}
+}
+
+func (b *mapBuilder) coord(v float64) string {
+	return strconv.FormatFloat(math.Round(v*b.scale), 'f', -1, 64)
+}
+
+func (b *mapBuilder) add(class string, attrs map[string]string) {
+	if b.err != nil {
+		return
+	}
+	id, err := newObjectID()
+	if err != nil {
+		b.err = err
+		return
+	}
+	obj := NewMapObject(id, class)
+	obj.Attrs = attrs
+	b.objects = append(b.objects, *obj)
+}
+
+//
+// Add a line (or, with more points, a polyline) through the points
+// (x0, y0, x1, y1, ...).
+//
+func (b *mapBuilder) line(points []float64, color string, width int, layer string) {
+	if len(points) < 4 {
+		return
+	}
+	var rest []string
+	for _, p := range points[2:] {
+		rest = append(rest, b.coord(p))
+	}
+	attrs := map[string]string{
+		"TYPE":   "line",
+		"X":      b.coord(points[0]),
+		"Y":      b.coord(points[1]),
+		"Z":      "1",
+		"POINTS": strings.Join(rest, " "),
+		"LINE":   color,
+		"FILL":   "",
+		"WIDTH":  strconv.Itoa(width),
+	}
+	if layer != "" {
+		attrs["LAYER"] = layer
+	}
+	b.add("E", attrs)
+}
+
+//
+// Add an image tile with its top left corner at (x, y).
+//
+func (b *mapBuilder) tile(x, y float64, src string, z int, layer string) {
+	if src == "" {
+		return
+	}
+	attrs := map[string]string{
+		"TYPE":  "tile",
+		"X":     b.coord(x),
+		"Y":     b.coord(y),
+		"Z":     strconv.Itoa(z),
+		"IMAGE": ImportedImageName(src),
+	}
+	if layer != "" {
+		attrs["LAYER"] = layer
+	}
+	b.add("E", attrs)
+}
+
+//
+// Add a creature token with its top left corner at (x, y), width
+// grid squares wide.
+//
+func (b *mapBuilder) creature(name string, player bool, x, y, width float64) {
+	class, ctype, color := "M", "monster", "red"
+	if player {
+		class, ctype, color = "P", "player", "blue"
+	}
+	size := creatureSizeForWidth(width)
+	b.add(class, map[string]string{
+		"TYPE":  ctype,
+		"NAME":  name,
+		"COLOR": color,
+		"GX":    strconv.Itoa(int(math.Round(x / b.grid))),
+		"GY":    strconv.Itoa(int(math.Round(y / b.grid))),
+		"SIZE":  size,
+		"AREA":  size,
+		"REACH": "0",
+	})
+}
+
+func creatureSizeForWidth(width float64) string {
+	switch {
+		case width <= 0.25: return "T"
+		case width <= 0.5:  return "S"
+		case width <= 1:    return "M"
+		case width <= 2:    return "L"
+		case width <= 3:    return "H"
+		default:            return "G"
+	}
+}
+
+//
+// ImportedImageName is the name a tile uses for an image from another
+// tabletop: the base name of its file (which the GM will need to
+// upload to the mapper under that name).
+//
+func ImportedImageName(src string) string {
+	if i := strings.IndexAny(src, "?#"); i >= 0 {
+		src = src[:i]
+	}
+	name := path.Base(src)
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+//
+// Foundry VTT scenes give some values either as a plain value (older
+// versions) or inside an object (newer ones).
+//
+type foundryImage struct {
+	Img     string `json:"img"`
+	Texture struct {
+		Src string `json:"src"`
+	} `json:"texture"`
+}
+
+func (f foundryImage) src() string {
+	if f.Texture.Src != "" {
+		return f.Texture.Src
+	}
+	return f.Img
+}
+
+type foundryScene struct {
+	Name       string          `json:"name"`
+	Grid       json.RawMessage `json:"grid"`
+	Img        string          `json:"img"`
+	Background struct {
+		Src string `json:"src"`
+	} `json:"background"`
+	Walls []struct {
+		C    []float64 `json:"c"`
+		Door int       `json:"door"`
+	} `json:"walls"`
+	Tiles []struct {
+		foundryImage
+		X float64 `json:"x"`
+		Y float64 `json:"y"`
+	} `json:"tiles"`
+	Tokens []struct {
+		foundryImage
+		Name      string  `json:"name"`
+		X         float64 `json:"x"`
+		Y         float64 `json:"y"`
+		Width     float64 `json:"width"`
+		ActorLink bool    `json:"actorLink"`
+	} `json:"tokens"`
+}
+
+func (s foundryScene) gridSize() float64 {
+	var size float64
+	if json.Unmarshal(s.Grid, &size) == nil && size > 0 {
+		return size
+	}
+	var grid struct {
+		Size float64 `json:"size"`
+	}
+	if json.Unmarshal(s.Grid, &grid) == nil && grid.Size > 0 {
+		return grid.Size
+	}
+	return 100
+}
+
+//
+// ImportFoundryScene converts a Foundry VTT scene (as exported to JSON
+// from Foundry) into map objects: its background and tiles become
+// image tiles, its walls lines (doors in brown), and its tokens
+// creatures (those linked to actors are taken to be players).
+//
+func ImportFoundryScene(data []byte) (string, []MapObject, error) {
+	var scene foundryScene
+	if err := json.Unmarshal(data, &scene); err != nil {
+		return "", nil, fmt.Errorf("Foundry scene not understood: %v", err)
+	}
+	b := newMapBuilder(scene.gridSize())
+	background := scene.Background.Src
+	if background == "" {
+		background = scene.Img
+	}
+	b.tile(0, 0, background, 0, "")
+	for _, tile := range scene.Tiles {
+		b.tile(tile.X, tile.Y, tile.src(), 0, "")
+	}
+	for _, wall := range scene.Walls {
+		if len(wall.C) == 4 {
+			color := "black"
+			if wall.Door != 0 {
+				color = "#8b4513"
+			}
+			b.line(wall.C, color, 5, "")
+		}
+	}
+	for _, token := range scene.Tokens {
+		if token.Width == 0 {
+			token.Width = 1
+		}
+		b.creature(token.Name, token.ActorLink, token.X, token.Y, token.Width)
+	}
+	return scene.Name, b.objects, b.err
+}
+
+type roll20Page struct {
+	Name     string `json:"name"`
+	Graphics []struct {
+		Name       string  `json:"name"`
+		Left       float64 `json:"left"`
+		Top        float64 `json:"top"`
+		Width      float64 `json:"width"`
+		Height     float64 `json:"height"`
+		ImgSrc     string  `json:"imgsrc"`
+		Layer      string  `json:"layer"`
+		Represents string  `json:"represents"`
+	} `json:"graphics"`
+	Paths []struct {
+		Path        string  `json:"path"`
+		Left        float64 `json:"left"`
+		Top         float64 `json:"top"`
+		Width       float64 `json:"width"`
+		Height      float64 `json:"height"`
+		Stroke      string  `json:"stroke"`
+		StrokeWidth float64 `json:"stroke_width"`
+		Layer       string  `json:"layer"`
+	} `json:"paths"`
+}
+
+//
+// ImportRoll20Page converts a Roll20 page (as found in a campaign
+// export) into map objects: graphics on the map layer become image
+// tiles, graphics representing characters become creatures (and those
+// on the GM layer are put on our GM layer), and paths become lines.
+//
+func ImportRoll20Page(data []byte) (string, []MapObject, error) {
+	var page roll20Page
+	if err := json.Unmarshal(data, &page); err != nil {
+		return "", nil, fmt.Errorf("Roll20 page not understood: %v", err)
+	}
+	b := newMapBuilder(Roll20GridSize)
+	for _, g := range page.Graphics {
+		// Roll20 positions graphics by their centers
+		x, y := g.Left-g.Width/2, g.Top-g.Height/2
+		switch {
+			case g.Layer == "map":
+				b.tile(x, y, g.ImgSrc, 0, "")
+			case g.Represents != "":
+				b.creature(g.Name, g.Layer == "objects", x, y, g.Width/Roll20GridSize)
+			default:
+				layer := ""
+				if g.Layer == "gmlayer" {
+					layer = "gm"
+				}
+				b.tile(x, y, g.ImgSrc, 1, layer)
+		}
+	}
+	for _, p := range page.Paths {
+		var segments [][]interface{}
+		if err := json.Unmarshal([]byte(p.Path), &segments); err != nil {
+			return "", nil, fmt.Errorf("Roll20 path %q not understood: %v", p.Path, err)
+		}
+		// path coordinates are relative to the path's bounding box,
+		// which is positioned by its center
+		x0, y0 := p.Left-p.Width/2, p.Top-p.Height/2
+		var points []float64
+		for _, segment := range segments {
+			if len(segment) < 3 {
+				continue
+			}
+			px, okx := segment[len(segment)-2].(float64)
+			py, oky := segment[len(segment)-1].(float64)
+			if okx && oky {
+				points = append(points, x0+px, y0+py)
+			}
+		}
+		color, layer := p.Stroke, ""
+		if color == "" || color == "transparent" {
+			color = "black"
+		}
+		switch p.Layer {
+			case "walls":
+				color = "black"
+			case "gmlayer":
+				layer = "gm"
+		}
+		width := int(math.Round(p.StrokeWidth))
+		if width < 1 {
+			width = 1
+		}
+		b.line(points, color, width, layer)
+	}
+	return page.Name, b.objects, b.err
+}
+
+//
+// Universal VTT files (.dd2vtt from Dungeondraft, .uvtt and the like)
+// give positions in grid squares from the map's origin.
+//
+type uvttPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type uvttResolution struct {
+	MapOrigin     uvttPoint `json:"map_origin"`
+	MapSize       uvttPoint `json:"map_size"`
+	PixelsPerGrid float64   `json:"pixels_per_grid"`
+}
+
+type uvttPortal struct {
+	Bounds []uvttPoint `json:"bounds"`
+	Closed bool        `json:"closed"`
+}
+
+type uvttLight struct {
+	Position uvttPoint `json:"position"`
+	Range    float64   `json:"range"`
+	Color    string    `json:"color"`
+}
+
+type universalVTT struct {
+	Resolution         uvttResolution `json:"resolution"`
+	LineOfSight        [][]uvttPoint  `json:"line_of_sight"`
+	ObjectsLineOfSight [][]uvttPoint  `json:"objects_line_of_sight"`
+	Portals            []uvttPortal   `json:"portals"`
+	Lights             []uvttLight    `json:"lights"`
+	Image              string         `json:"image"`
+}
+
+//
+// Convert a Universal VTT color (AARRGGBB hex) to one of ours.
+//
+func uvttColor(color string) string {
+	if len(color) == 8 {
+		color = color[2:]
+	}
+	if _, err := strconv.ParseUint(color, 16, 32); err != nil || len(color) != 6 {
+		return "#ffffff"
+	}
+	return "#" + strings.ToLower(color)
+}
+
+//
+// ImportUniversalVTT converts a Universal VTT file (such as
+// Dungeondraft's .dd2vtt) into map objects: a tile showing the map's
+// image (named for the map, since these files don't name it), walls
+// drawn as black lines, doors and windows as brown ones, and each light
+// as a circle on the "lights" layer.
+//
+func ImportUniversalVTT(data []byte, name string) (ImportedMap, error) {
+	var u universalVTT
+	if err := json.Unmarshal(data, &u); err != nil {
+		return ImportedMap{}, fmt.Errorf("Unable to read Universal VTT file: %v", err)
+	}
+	if name == "" {
+		name = "imported"
+	}
+	imported := ImportedMap{Name: name}
+	var image []byte
+	if u.Image != "" {
+		var err error
+		if image, err = base64.StdEncoding.DecodeString(u.Image); err != nil {
+			return imported, fmt.Errorf("Unable to decode Universal VTT map image: %v", err)
+		}
+		imported.Images = map[string][]byte{ImportedImageName(name): image}
+	}
+
+	b := newMapBuilder(1)
+	origin := u.Resolution.MapOrigin
+	points := func(path []uvttPoint) []float64 {
+		var p []float64
+		for _, pt := range path {
+			p = append(p, pt.X-origin.X, pt.Y-origin.Y)
+		}
+		return p
+	}
+	if image != nil {
+		b.tile(0, 0, name, 0, "")
+	}
+	for _, wall := range u.LineOfSight {
+		b.line(points(wall), "black", 5, "walls")
+	}
+	for _, wall := range u.ObjectsLineOfSight {
+		b.line(points(wall), "black", 3, "walls")
+	}
+	for _, portal := range u.Portals {
+		b.line(points(portal.Bounds), "#8b4513", 5, "walls")
+	}
+	for _, light := range u.Lights {
+		if light.Range <= 0 {
+			continue
+		}
+		x, y := light.Position.X-origin.X, light.Position.Y-origin.Y
+		b.add("E", map[string]string{
+			"TYPE":   "circ",
+			"X":      b.coord(x - light.Range),
+			"Y":      b.coord(y - light.Range),
+			"Z":      "1",
+			"POINTS": b.coord(x+light.Range) + " " + b.coord(y+light.Range),
+			"LINE":   uvttColor(light.Color),
+			"FILL":   "",
+			"WIDTH":  "1",
+			"LAYER":  "lights",
+		})
+	}
+	imported.Objects = b.objects
+	return imported, b.err
+}
+
+//
+// An ImportedMap is a map converted from another tabletop.
+//
+type ImportedMap struct {
+	Name    string            // what it was called there
+	Objects []MapObject
+	Images  map[string][]byte // images it brought with it, by name
+}
+
+//
+// ImportMap converts a map from another tabletop's format ("foundry",
+// "roll20", or "uvtt" for Universal VTT files such as Dungeondraft's
+// .dd2vtt) into map objects. The name is used for the map (and its
+// image) if the format doesn't give it one.
+//
+func ImportMap(format string, data []byte, name string) (ImportedMap, error) {
+	var imported ImportedMap
+	var err error
+	switch strings.ToLower(format) {
+		case "foundry":
+			imported.Name, imported.Objects, err = ImportFoundryScene(data)
+		case "roll20":
+			imported.Name, imported.Objects, err = ImportRoll20Page(data)
+		case "uvtt", "dd2vtt":
+			imported, err = ImportUniversalVTT(data, name)
+		default:
+			return imported, fmt.Errorf("Map format %s not supported (use foundry, roll20, or uvtt)", format)
+	}
+	if imported.Name == "" {
+		imported.Name = name
+	}
+	return imported, err
+}
+
+//
+// Pick a file name for an image: its name with an extension to suit
+// its contents.
+//
+func imageFileName(name string, image []byte) string {
+	switch http.DetectContentType(image) {
+		case "image/png":
+			return name + ".png"
+		case "image/jpeg":
+			return name + ".jpg"
+		case "image/gif":
+			return name + ".gif"
+		case "image/webp":
+			return name + ".webp"
+	}
+	return name + ".img"
+}
+
+//
+// Write the images brought in with an imported map to files in dir.
+//
+func (m ImportedMap) SaveImages(dir string) ([]string, error) {
+	var paths []string
+	for name, image := range m.Images {
+		path := filepath.Join(dir, imageFileName(name, image))
+		if err := os.WriteFile(path, image, 0644); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+var unsafeMapFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+//
+// Convert a map from another tabletop and save it as a .map file in the
+// MapExportDir (along with any images it brought with it), named for
+// the name it had there if name is "". Returns its path and the number
+// of objects in it.
+//
+func (ms *MapService) importMap(format, name string, data []byte) (string, int, error) {
+	imported, err := ImportMap(format, data, strings.TrimSuffix(name, ".map"))
+	if err != nil {
+		return "", 0, err
+	}
+	if name == "" {
+		name = strings.Trim(unsafeMapFileChars.ReplaceAllString(imported.Name, "_"), "_.-")
+		if name == "" {
+			name = "imported"
+		}
+	}
+	path, err := ms.saveMapFile(name, imported.Objects, fmt.Sprintf("Imported from %s: %s", format, imported.Name))
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err = imported.SaveImages(ms.MapExportDir); err != nil {
+		return "", 0, err
+	}
+	return path, len(imported.Objects), nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,245 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for importing maps from other tabletops
+//
+
+package mapservice
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//
+// Find the imported objects of a given TYPE, as their attribute maps.
+//
+func importedOfType(objects []MapObject, objType string) []map[string]string {
+	var found []map[string]string
+	for _, obj := range objects {
+		if obj.Attrs["TYPE"] == objType {
+			found = append(found, obj.Attrs)
+		}
+	}
+	return found
+}
+
+func TestImportFoundryScene(t *testing.T) {
+	scene := `{
+		"name": "Goblin Cave",
+		"grid": {"size": 100},
+		"background": {"src": "worlds/test/maps/cave.webp"},
+		"walls": [{"c": [0, 0, 200, 0]}, {"c": [200, 0, 200, 300], "door": 1}],
+		"tiles": [{"x": 300, "y": 100, "texture": {"src": "tiles/chest.png?v=2"}}],
+		"tokens": [
+			{"name": "Fizban", "x": 100, "y": 200, "width": 1, "actorLink": true},
+			{"name": "Ogre", "x": 400, "y": 400, "width": 2}
+		]
+	}`
+	imported, err := ImportMap("foundry", []byte(scene), "")
+	name, objects := imported.Name, imported.Objects
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if name != "Goblin Cave" || len(objects) != 6 {
+		t.Errorf("imported %s as %d objects", name, len(objects))
+	}
+	tiles := importedOfType(objects, "tile")
+	if len(tiles) != 2 || tiles[0]["IMAGE"] != "cave" || tiles[1]["IMAGE"] != "chest" || tiles[1]["X"] != "150" || tiles[1]["Y"] != "50" {
+		t.Errorf("tiles were %v", tiles)
+	}
+	lines := importedOfType(objects, "line")
+	if len(lines) != 2 || lines[0]["X"] != "0" || lines[0]["POINTS"] != "100 0" || lines[1]["POINTS"] != "100 150" || lines[1]["LINE"] != "#8b4513" {
+		t.Errorf("walls were %v", lines)
+	}
+	pc := importedOfType(objects, "player")
+	if len(pc) != 1 || pc[0]["NAME"] != "Fizban" || pc[0]["GX"] != "1" || pc[0]["GY"] != "2" || pc[0]["SIZE"] != "M" {
+		t.Errorf("players were %v", pc)
+	}
+	monsters := importedOfType(objects, "monster")
+	if len(monsters) != 1 || monsters[0]["NAME"] != "Ogre" || monsters[0]["GX"] != "4" || monsters[0]["SIZE"] != "L" {
+		t.Errorf("monsters were %v", monsters)
+	}
+	for _, obj := range objects {
+		if (obj.Attrs["TYPE"] == "player") != (obj.Class == "P") {
+			t.Errorf("object %v has class %s", obj.Attrs, obj.Class)
+		}
+	}
+
+	// older Foundry versions give the grid size and images directly
+	_, objects, err = ImportFoundryScene([]byte(`{"grid": 50, "img": "old.jpg", "tokens": [{"name": "Rat", "x": 150, "y": 50}]}`))
+	if err != nil || len(objects) != 2 || importedOfType(objects, "tile")[0]["IMAGE"] != "old" || importedOfType(objects, "monster")[0]["GX"] != "3" {
+		t.Errorf("old scene imported as %v (%v)", objects, err)
+	}
+}
+
+func TestImportRoll20Page(t *testing.T) {
+	page := `{
+		"name": "Tavern",
+		"graphics": [
+			{"name": "floor", "left": 350, "top": 350, "width": 700, "height": 700, "imgsrc": "https://s3.example.com/floor.jpg", "layer": "map"},
+			{"name": "Barkeep", "left": 105, "top": 105, "width": 70, "height": 70, "layer": "objects", "represents": "-abc"},
+			{"name": "Assassin", "left": 175, "top": 105, "width": 70, "height": 70, "layer": "gmlayer", "represents": "-def"},
+			{"name": "secret note", "left": 35, "top": 35, "width": 70, "height": 70, "imgsrc": "note.png", "layer": "gmlayer"}
+		],
+		"paths": [
+			{"path": "[[\"M\",0,0],[\"L\",140,0]]", "left": 140, "top": 70, "width": 140, "height": 0, "stroke": "#ff0000", "stroke_width": 2, "layer": "walls"}
+		]
+	}`
+	imported, err := ImportMap("Roll20", []byte(page), "")
+	name, objects := imported.Name, imported.Objects
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if name != "Tavern" || len(objects) != 5 {
+		t.Errorf("imported %s as %d objects", name, len(objects))
+	}
+	tiles := importedOfType(objects, "tile")
+	if len(tiles) != 2 || tiles[0]["IMAGE"] != "floor" || tiles[0]["X"] != "0" || tiles[1]["LAYER"] != "gm" {
+		t.Errorf("tiles were %v", tiles)
+	}
+	if pc := importedOfType(objects, "player"); len(pc) != 1 || pc[0]["NAME"] != "Barkeep" || pc[0]["GX"] != "1" || pc[0]["GY"] != "1" {
+		t.Errorf("players were %v", pc)
+	}
+	if monsters := importedOfType(objects, "monster"); len(monsters) != 1 || monsters[0]["NAME"] != "Assassin" || monsters[0]["GX"] != "2" {
+		t.Errorf("monsters were %v", monsters)
+	}
+	lines := importedOfType(objects, "line")
+	if len(lines) != 1 || lines[0]["X"] != "50" || lines[0]["Y"] != "50" || lines[0]["POINTS"] != "150 50" || lines[0]["LINE"] != "black" || lines[0]["WIDTH"] != "2" {
+		t.Errorf("lines were %v", lines)
+	}
+}
+
+func TestImportUniversalVTT(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\nfake image data"
+	file := `{
+		"format": 0.3,
+		"resolution": {"map_origin": {"x": 1, "y": 0}, "map_size": {"x": 10, "y": 8}, "pixels_per_grid": 256},
+		"line_of_sight": [[{"x": 1, "y": 0}, {"x": 5, "y": 0}, {"x": 5, "y": 2.5}]],
+		"objects_line_of_sight": [],
+		"portals": [{"position": {"x": 3, "y": 4}, "bounds": [{"x": 3, "y": 4}, {"x": 4, "y": 4}], "closed": true}],
+		"lights": [{"position": {"x": 2, "y": 2}, "range": 1, "intensity": 1, "color": "ffeccd8b"}],
+		"image": "` + base64.StdEncoding.EncodeToString([]byte(png)) + `"
+	}`
+	imported, err := ImportMap("uvtt", []byte(file), "crypt.v2")
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if imported.Name != "crypt.v2" || len(imported.Objects) != 4 || len(imported.Images) != 1 || string(imported.Images["crypt"]) != png {
+		t.Errorf("imported %s as %d objects and images %v", imported.Name, len(imported.Objects), imported.Images)
+	}
+	if tiles := importedOfType(imported.Objects, "tile"); len(tiles) != 1 || tiles[0]["IMAGE"] != "crypt" || tiles[0]["X"] != "0" || tiles[0]["Z"] != "0" {
+		t.Errorf("tiles were %v", tiles)
+	}
+	lines := importedOfType(imported.Objects, "line")
+	if len(lines) != 2 || lines[0]["X"] != "0" || lines[0]["POINTS"] != "200 0 200 125" || lines[1]["X"] != "100" || lines[1]["POINTS"] != "150 200" || lines[1]["LINE"] != "#8b4513" {
+		t.Errorf("walls were %v", lines)
+	}
+	lights := importedOfType(imported.Objects, "circ")
+	if len(lights) != 1 || lights[0]["X"] != "0" || lights[0]["Y"] != "50" || lights[0]["POINTS"] != "100 150" || lights[0]["LINE"] != "#eccd8b" || lights[0]["LAYER"] != "lights" {
+		t.Errorf("lights were %v", lights)
+	}
+
+	dir := t.TempDir()
+	if paths, err := imported.SaveImages(dir); err != nil || len(paths) != 1 || paths[0] != filepath.Join(dir, "crypt.png") {
+		t.Errorf("images saved as %v (%v)", paths, err)
+	}
+	if _, err := ImportMap("dd2vtt", []byte(`{"image": "not base64!"}`), ""); err == nil {
+		t.Errorf("bad image was accepted")
+	}
+}
+
+func TestImportMapErrors(t *testing.T) {
+	if _, err := ImportMap("fantasygrounds", []byte(`{}`), ""); err == nil {
+		t.Errorf("unknown format was accepted")
+	}
+	if _, err := ImportMap("foundry", []byte(`not json`), ""); err == nil {
+		t.Errorf("bad JSON was accepted")
+	}
+	if _, err := ImportMap("roll20", []byte(`{"paths": [{"path": "nope"}]}`), ""); err == nil {
+		t.Errorf("bad path was accepted")
+	}
+}
+
+func TestImportMapAPI(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/api.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	ms.MapExportDir = t.TempDir()
+	_, admin, _ := ms.issueAPIToken("gm", ScopeAdmin, 0)
+
+	status, reply := apiTestRequest(t, ms, "POST", "/api/v1/maps/import?format=foundry", admin, `{"name": "Goblin Cave!", "walls": [{"c": [0, 0, 100, 0]}]}`)
+	if status != 201 || reply["file"] != "Goblin_Cave.map" || reply["objects"] != 1.0 {
+		t.Errorf("import got %d %v", status, reply)
+	}
+	data, err := os.ReadFile(filepath.Join(ms.MapExportDir, "Goblin_Cave.map"))
+	if err != nil || !strings.HasPrefix(string(data), "__MAPPER__:17 {{Imported from foundry: Goblin Cave!} ") || !strings.Contains(string(data), "TYPE:") {
+		t.Errorf("map file was %q (%v)", data, err)
+	}
+	if status, reply = apiTestRequest(t, ms, "POST", "/api/v1/maps/import?format=foundry&name=../evil", admin, `{}`); status != 400 {
+		t.Errorf("import with bad name got %d %v", status, reply)
+	}
+	if status, _ = apiTestRequest(t, ms, "POST", "/api/v1/maps/import?format=foundry", admin, `{"name": "`+strings.Repeat("x", MaxMapImportSize)+`"}`); status != 413 {
+		t.Errorf("oversized import got %d", status)
+	}
+}
+
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
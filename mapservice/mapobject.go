@@ -0,0 +1,293 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                    Map Objects                                     //
+//                                                                                    //
+// The MapObject type holds the current definition of a creature token or map         //
+// element, built up from the LS, PS, and OA family of events which describe it.      //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//
+// A MapObject is a creature token or map element as the server understands
+// it: the object's unique ID, its class ("P" for players, "M" for monsters,
+// "E" for map elements, or "" if we don't know), and the set of attributes
+// which describe it. Rather than keeping every LS, PS, and OA event which
+// ever touched an object, we apply them to the object as they arrive, so
+// that a client which asks for the game state receives a single definition
+// of each object.
+//
+type MapObject struct {
+	ID       string
+	Class    string
+	Attrs    map[string]string
+	Extra    []string          // definition lines we keep but don't interpret (e.g., F lines)
+	Sequence int               // when the object was (re-)defined, for ordering SYNC output
+	Writer   string            // who stamped the Sequence (see EventClock)
+	Changed  EventStamp        // when the object was last changed
+}
+
+//
+// NewMapObject creates an object with no attributes.
+//
+func NewMapObject(id, class string) *MapObject {
+	return &MapObject{
+		ID:    id,
+		Class: class,
+		Attrs: make(map[string]string),
+	}
+}
+
+//
+// IsCreature returns true if the object is a creature token.
+//
+func (o *MapObject) IsCreature() bool {
+	return o.Class == "P" || o.Class == "M"
+}
+
+//
+// AddToList treats the attribute <key> as a list and adds each of
+// <values> to it which aren't already present (as OA+ does).
+//
+func (o *MapObject) AddToList(key string, values []string) error {
+	current, err := ParseTclList(o.Attrs[key])
+	if err != nil {
+		return fmt.Errorf("Attribute %s of %s is not a list (%v)", key, o.ID, err)
+	}
+	for _, v := range values {
+		found := false
+		for _, c := range current {
+			if c == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			current = append(current, v)
+		}
+	}
+	o.Attrs[key], err = ToTclString(current)
+	return err
+}
+
+//
+// RemoveFromList treats the attribute <key> as a list and removes
+// all of <values> from it (as OA- does).
+//
+func (o *MapObject) RemoveFromList(key string, values []string) error {
+	current, err := ParseTclList(o.Attrs[key])
+	if err != nil {
+		return fmt.Errorf("Attribute %s of %s is not a list (%v)", key, o.ID, err)
+	}
+	var kept []string
+	for _, c := range current {
+		remove := false
+		for _, v := range values {
+			if c == v {
+				remove = true
+				break
+			}
+		}
+		if !remove {
+			kept = append(kept, c)
+		}
+	}
+	o.Attrs[key], err = ToTclString(kept)
+	return err
+}
+
+//
+// An object definition line (as sent in LS: commands) is one of
+//   P|M <attr>:<id> <value>      (creature attribute)
+//   F <id> ...                   (kept as-is)
+//   <attr>:<id> <value>          (map element attribute)
+// parseObjectItem picks one apart, returning the object ID, class,
+// attribute name and value. If <attr> is "", the line is not an
+// attribute setting and should be kept verbatim.
+//
+func parseObjectItem(item []string) (id, class, attr, value string, err error) {
+	if len(item) < 2 {
+		return "", "", "", "", fmt.Errorf("Object definition %v is too short", item)
+	}
+	switch item[0] {
+		case "M", "P":
+			parts := strings.SplitN(item[1], ":", 2)
+			if len(parts) != 2 {
+				return "", "", "", "", fmt.Errorf("Object attribute %s not understood", item[1])
+			}
+			if len(item) > 2 {
+				value = item[2]
+			}
+			return parts[1], item[0], parts[0], value, nil
+
+		case "F":
+			return item[1], "", "", "", nil
+
+		default:
+			parts := strings.SplitN(item[0], ":", 2)
+			if len(parts) != 2 {
+				return "", "", "", "", fmt.Errorf("Object attribute %s not understood", item[0])
+			}
+			return parts[1], "E", parts[0], item[1], nil
+	}
+}
+
+//
+// ObjectsFromLoadEvent reconstructs the objects described by the data
+// lines of an LS event (as repackaged by the LS handler).
+//
+func ObjectsFromLoadEvent(event *MapEvent) (map[string]*MapObject, error) {
+	objects := make(map[string]*MapObject)
+	for _, line := range event.MultiRawData {
+		fields, err := ParseTclList(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) != 2 || fields[0] != "LS:" {
+			continue
+		}
+		item, err := ParseTclList(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(item) == 0 {
+			continue
+		}
+		id, class, attr, value, err := parseObjectItem(item)
+		if err != nil {
+			return nil, err
+		}
+		obj, ok := objects[id]
+		if !ok {
+			obj = NewMapObject(id, class)
+			objects[id] = obj
+		}
+		if obj.Class == "" {
+			obj.Class = class
+		}
+		if attr == "" {
+			obj.Extra = append(obj.Extra, fields[1])
+		} else {
+			obj.Attrs[attr] = value
+		}
+	}
+	return objects, nil
+}
+
+//
+// Definition returns the object as a list of LS: data lines (without
+// the LS: prefix), in a consistent order.
+//
+func (o *MapObject) Definition() ([]string, error) {
+	var lines []string
+	keys := make([]string, 0, len(o.Attrs))
+	for k := range o.Attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var line string
+		var err error
+		if o.IsCreature() {
+			line, err = ToTclString([]string{o.Class, k + ":" + o.ID, o.Attrs[k]})
+		} else {
+			line, err = ToTclString([]string{k + ":" + o.ID, o.Attrs[k]})
+		}
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return append(lines, o.Extra...), nil
+}
+
+//
+// LoadEvent packages the object as an LS event which will recreate
+// it on a client.
+//
+func (o *MapObject) LoadEvent() (*MapEvent, error) {
+	definition, err := o.Definition()
+	if err != nil {
+		return nil, err
+	}
+	cksum := sha256.New()
+	var elements []string
+	for _, element := range definition {
+		cksum.Write([]byte(element))
+		elements = append(elements, "LS: {" + element + "}")
+	}
+	elements = append(elements, fmt.Sprintf("LS. %d %s",
+		len(elements), base64.StdEncoding.EncodeToString(cksum.Sum(nil))))
+
+	event, err := NewMapEvent("LS", o.ID, o.Class)
+	if err != nil {
+		return nil, err
+	}
+	event.MultiRawData = elements
+	event.Sequence, event.Writer, event.Changed = o.Sequence, o.Writer, o.Changed
+	return event, nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -37,13 +37,12 @@ import (
 	"database/sql"
 	"log"
 	"fmt"
+	"io"
 	"net"
-	"os"
-	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 //
@@ -56,10 +55,6 @@ import (
 //
 const PROTOCOL_VERSION = "332"
 
-//
-// Turn on DEBUGGING to get extra information logged during transactions with clients
-//
-const DEBUGGING = false
 //
 // We will terminate clients if they've been idle this many seconds and we have a full
 // channel of messages trying to send to them
@@ -70,6 +65,30 @@ const ClientIdleTimeout = 180
 // more expensive queuing
 //
 const CommChannelBufferSize = 256
+//
+// Default limits on how long we'll wait for a client to send us something
+// (we ping them every minute, so a healthy client is never silent for long)
+// and for a write to a client's socket to complete.
+//
+const DefaultReadTimeout = 3 * time.Minute
+const DefaultWriteTimeout = 15 * time.Second
+//
+// Reasons why a client connection was dropped, as reported in the log.
+//
+const (
+	DisconnectEOF          = "client closed connection"
+	DisconnectReadTimeout  = "read timeout"
+	DisconnectWriteTimeout = "write timeout"
+	DisconnectIOError      = "I/O error"
+	DisconnectTooSlow      = "client not keeping up"
+	DisconnectAuthTimeout  = "authentication timeout"
+	DisconnectAuthFailed   = "authentication failed"
+	DisconnectRefused      = "server not accepting connections"
+	DisconnectProtocol     = "protocol error"
+	DisconnectReplaced     = "disconnected by another session of the same user"
+	DisconnectHandedOff    = "handed the GM's role to someone else"
+	DisconnectMemory       = "client used too much memory"
+)
 
 /////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 //  __  __              ____ _ _            _   
@@ -83,7 +102,7 @@ const CommChannelBufferSize = 256
 //
 type MapClient struct {
     Connection          net.Conn        // this client's socket connection
-    Scanner            *bufio.Scanner   // scanner to collect input lines
+    Reader             *bufio.Reader    // buffered reader to collect input lines
     ClientAddr          string          // IP address of client
     Service            *MapService      // pointer to the overall map service
     Auth               *Authenticator   // pointer to the authentication object
@@ -92,17 +111,79 @@ type MapClient struct {
     AcceptedList        []string        // list of accepted messages for this client (nil to accept all)
     dice               *DieRoller       // random number generator ala rolling dice
     WriteOnly           bool            // is this client refusing to listen to incoming messages?
-    IncomingDataType    string          // what multi-command event are we processing? or ""
-    IncomingData        []string        // holding buffer for multi-command sequence of events
+    incoming           *incomingTransfer // multi-command sequence of events we're receiving, or nil
+    presetRevision      string          // revision of die-roll presets this client has
     LastPolo            int64           // last time we heard a POLO response
+    lastInput           time.Time       // last time we heard anything else (see noticeActivity)
+    gmName              string          // who this GM said they were when logging in (see GMName)
     UnauthenticatedPings int            // number of times we pinged this client withouth authentication
 	CommChannel			chan string		// buffered channel for data to be sent to the client
-	ReadyToClose        bool			// true if we're really finished with this connection now
+	stopSending         chan struct{}   // closed to tell backgroundSender to finish up
+	senderDone          chan struct{}   // closed when backgroundSender has exited
+	closeOnce           sync.Once       // makes sure we only signal stopSending once
 	messageBacklogQueue []string		// holding area for backlog of messages waiting to get into channel
+	disconnectReason    string          // why we dropped this connection
+	followOptOut        bool            // has this client opted out of following the GM's view?
+	slowReported        bool            // have we reported this client's current backlog as too large?
+	pace                pacer           // how fast this client is taking what we send it
+	memory              clientMemory    // how much data we're holding for this client
+	partialLine         []byte          // start of a line we were reading when a transfer timed out
+	partialSize         int             // length of that line so far (it may be too long to keep)
+	recent              relayHistory    // last relayed message about each thing, to spot duplicates
+	replay              replayBuffer    // lines we sent, if the client wants them numbered
+	trace               atomic.Value    // trace ID of the message being read or handled (see NewTraceID)
+	handling            sync.Mutex      // held while one of this client's messages is acted upon
     lock                sync.RWMutex    // controls concurrent access to this structure between goroutines
 }
 
+//
+// Does this client have GM privileges? If the server isn't doing
+// authentication at all, everyone does.
+//
+func (c *MapClient) IsGM() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.isGM()
+}
+
+//
+// Same, for when we already hold the client's lock.
+//
+func (c *MapClient) isGM() bool {
+	return c.Authenticated && (c.Auth == nil || c.Auth.GmMode)
+}
+
+//
+// Record why we're disconnecting from this client. Only the first
+// reason given is kept, since that's the one which started the teardown.
+//
+func (c *MapClient) setDisconnectReason(reason string) {
+	c.lock.Lock()
+	if c.disconnectReason == "" {
+		c.disconnectReason = reason
+	}
+	c.lock.Unlock()
+}
+
+func (c *MapClient) DisconnectReason() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.disconnectReason
+}
+
+//
+// Classify a network error as a timeout or other I/O failure.
+//
+func ioErrorReason(err error, timeout_reason string) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return timeout_reason
+	}
+	return DisconnectIOError
+}
+
 func (c *MapClient) Username() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	if c.Auth == nil || !c.Authenticated {
 		return "unknown"
 	}
@@ -127,6 +208,8 @@ func (c *MapClient) AuthenticateUser() error {
 	if err != nil {
 		return err
 	}
+	c.Service.challenges.issue(challenge, time.Now().Add(c.Service.challengeLifetime()))
+	defer c.Service.challenges.withdraw(challenge)
 	c.Send("OK", PROTOCOL_VERSION, challenge)
 	for {
 		event, err := c.NextEvent()
@@ -139,7 +222,7 @@ func (c *MapClient) AuthenticateUser() error {
 			case "AUTH":
 				if len(event.Fields) >= 3 {
 					c.Auth.Username = event.Fields[2]
-					user_password, ok := c.Service.PersonalPasswords[c.Auth.Username]
+					user_password, ok := c.Service.lookupPersonalSecret(c.Auth.Username)
 					if ok {
 						c.Auth.SetSecret(user_password)	 // use personal password if one defined for that user
 					}
@@ -152,39 +235,54 @@ func (c *MapClient) AuthenticateUser() error {
 					c.Auth.Client = "<unknown>"
 				}
 
+				if err := c.Service.challenges.redeem(challenge, event.Fields[1], time.Now()); err != nil {
+					log.Printf("[client %s] ERROR validating authentication response \"%s\": %v", c.logTag(), event.Fields[1], err)
+					c.Send("DENIED", "Login challenge expired or already used")
+					c.Service.securityEvent(SecurityAuthFailure, c.Auth.Username, c.ClientAddr, err.Error())
+					return err
+				}
 				successful, err := c.Auth.ValidateResponse(event.Fields[1])
 				if err != nil {
-					log.Printf("[client %s] ERROR validating authentication response \"%s\": %v", c.ClientAddr, event.Fields[1], err)
+					log.Printf("[client %s] ERROR validating authentication response \"%s\": %v", c.logTag(), event.Fields[1], err)
 					c.Send("DENIED", "Invalid AUTH command format")
+					c.Service.securityEvent(SecurityAuthFailure, c.Auth.Username, c.ClientAddr, err.Error())
 					return err
 				}
 				if !successful {
-					log.Printf("[client %s] ERROR validating authentication response \"%s\": login incorrect", c.ClientAddr, event.Fields[1])
+					log.Printf("[client %s] ERROR validating authentication response \"%s\": login incorrect", c.logTag(), event.Fields[1])
 					c.Send("DENIED", "Login incorrect")
+					c.Service.securityEvent(SecurityAuthFailure, c.Auth.Username, c.ClientAddr, "login incorrect")
 					return fmt.Errorf("Login incorrect")
 				}
 				if c.Auth.GmMode {
+					c.lock.Lock()
+					c.gmName = gmLoginName(c.Auth.Username)
 					c.Auth.Username = "GM"
-					c.Send("GRANTED", "GM")
 					c.Authenticated = true
-					log.Printf("[client %s] Access granted for GM", c.ClientAddr)
+					c.lock.Unlock()
+					c.Send("GRANTED", "GM")
+					log.Printf("[client %s] Access granted for %s", c.logTag(), c.auditName())
 					return nil
 				}
 
 				c.Auth.Username = strings.ToLower(c.Auth.Username)
 				if c.Auth.Username == "gm" {
-					log.Printf("[client %s] Access denied to GM impersonator!", c.ClientAddr)
+					log.Printf("[client %s] Access denied to GM impersonator!", c.logTag())
 					c.Send("DENIED", "You are not the GM.")
+					c.Service.securityEvent(SecurityAuthFailure, c.Auth.Username, c.ClientAddr, "tried to log in as GM with a player password")
 					return fmt.Errorf("Login incorrect")
 				}
 
-				log.Printf("[client %s] Access granted for %s", c.ClientAddr, c.Auth.Username)
+				log.Printf("[client %s] Access granted for %s", c.logTag(), c.Auth.Username)
 				c.Send("GRANTED", c.Auth.Username)
+				c.lock.Lock()
 				c.Authenticated = true
+				c.lock.Unlock()
 				return nil
 
 			default:
 				c.Send("PRIV", "Not authorized for that operation until authenticated.")
+				c.Service.securityEvent(SecurityPrivilege, "", c.ClientAddr, fmt.Sprintf("sent %s before logging in", event.EventType()))
 		}
 	}
 }
@@ -206,9 +304,10 @@ func (c *MapClient) AuthenticateUser() error {
 // all messages sent on the client's channel out to the network
 // socket connected to the client app. When the server is done
 // talking to a client, we don't shut down the socket right away,
-// but rather send a stop signal of "■■■" on the channel. When the
-// background feeder goroutine gets that signal, it closes the socket
-// and terminates its own operation.
+// but rather close the client's stopSending channel. When the
+// background feeder goroutine sees that, it sends out whatever is
+// left in its channel, closes the socket, and terminates its own
+// operation, closing senderDone on its way out.
 //
 
 //
@@ -235,28 +334,34 @@ func (c *MapClient) SendWithExtraData(ev *MapEvent) {
 	c._send_event(ev.MultiRawData, ev.Fields)
 }
 
-func (c *MapClient) _send_event(extra_data []string, values []string) {
-	if c.AcceptedList != nil {
-		ok_to_send := false
-		for _, allowed_type := range c.AcceptedList {
-			if values[0] == allowed_type {
-				ok_to_send = true
-				break
-			}
+//
+// Does this client want to be sent messages of this type?
+//
+func (c *MapClient) accepts(messageType string) bool {
+	if c.AcceptedList == nil {
+		return true
+	}
+	for _, allowed_type := range c.AcceptedList {
+		if messageType == allowed_type {
+			return true
 		}
-		if !ok_to_send {
-			if DEBUGGING {
-				log.Printf("[client %s] blocked sending %v", c.ClientAddr, values)
-			}
-			return
+	}
+	return false
+}
+
+func (c *MapClient) _send_event(extra_data []string, values []string) {
+	if !c.accepts(values[0]) {
+		if d := debugLog(DebugIO); d != nil {
+			d.Printf("[client %s] blocked sending %v", c.logTag(), values)
 		}
+		return
 	}
 	message, err := PackageValues(values...)
 	if err != nil {
-		log.Printf("[client %s] ERROR packaging data to be transmitted: %v (%v)", c.ClientAddr, err, values)
+		log.Printf("[client %s] ERROR packaging data to be transmitted: %v (%v)", c.logTag(), err, values)
 	} else {
 		if strings.ContainsAny(message, "\n\r") {
-			log.Printf("[client %s] ERROR packaging data to be transmitted: message would contain newlines (%v)", c.ClientAddr, values)
+			log.Printf("[client %s] ERROR packaging data to be transmitted: message would contain newlines (%v)", c.logTag(), values)
 		} else {
 			c.sendToClientChannel(message)
 		}
@@ -274,7 +379,10 @@ func (c *MapClient) _send_event(extra_data []string, values []string) {
 // Send to all other clients (other than myself)
 //
 func (c *MapClient) SendToOthers(values ...string) {
-	for _, aClient := range c.Service.AllClients() {
+	if len(values) == 0 {
+		return
+	}
+	for _, aClient := range c.Service.Clients.Subscribers(values[0]) {
 		if aClient.ClientAddr != c.ClientAddr {
 			aClient.Send(values...)
 		}
@@ -311,13 +419,19 @@ func (c *MapClient) SendRawToOthers(values string) {
 // so we will check to see if a client we're queuing up messages for
 // hasn't responded to our pings for a while, and will eventually give
 // up on it if it really does look like they're not able to keep up.
+// (A client which is still taking data from us, if slowly, isn't given
+// up on, though.)
+//
+// While a bulk transfer is being sent, messages also go into the backlog
+// once the channel holds as many as the client is currently taking at a
+// time (see pacer).
 //
 func (c *MapClient) sendToClientChannel(data string) {
 	c.lock.RLock()
 	queueing := c.messageBacklogQueue != nil
 	c.lock.RUnlock()
 
-	if queueing {
+	if queueing || c.pace.holding(len(c.CommChannel)) {
 		// If we're already queueing messages, just add to the backlog
 		c.queueMessage(data)
 		return
@@ -325,13 +439,15 @@ func (c *MapClient) sendToClientChannel(data string) {
 
 	select {
 		case c.CommChannel <- data:
-			if DEBUGGING {
-				log.Printf("[client %s] chan<-%s", c.ClientAddr, data)
+			if d := debugLog(DebugIO); d != nil {
+				d.Printf("[client %s] chan<-%s", c.logTag(), data)
 			}
 
 		default:
-			if time.Now().Unix() - c.LastPolo > ClientIdleTimeout {
-				log.Printf("[client %s] TERMINATING CONNECTION TO DEAD/PAINFULLY SLOW CLIENT", c.ClientAddr)
+			if time.Now().Unix() - c.LastPolo > ClientIdleTimeout && !c.pace.absorbing(time.Now(), ClientIdleTimeout*time.Second) {
+				c.reportSlowClient("dropped as too slow")
+				log.Printf("[client %s] TERMINATING CONNECTION TO DEAD/PAINFULLY SLOW CLIENT", c.logTag())
+				c.setDisconnectReason(DisconnectTooSlow)
 				c.Close()
 			} else {
 				// queue this message up 
@@ -341,12 +457,30 @@ func (c *MapClient) sendToClientChannel(data string) {
 }
 
 func (c *MapClient) queueMessage(data string) {
-	if DEBUGGING {
-		log.Printf("[client %s] queued %s", c.ClientAddr, data)
+	if d := debugLog(DebugIO); d != nil {
+		d.Printf("[client %s] queued %s", c.logTag(), data)
+	}
+	if !c.memory.reserve(int64(len(data)), 0, c.memoryLimit()) {
+		// Rather than let the backlog grow without end, or leave gaps
+		// in what the client sees, we give up on the client.
+		if c.memory.exceed() {
+			c.memoryExceeded(fmt.Sprintf("a backlog of more than %d bytes", c.memory.usage()-ReadBufferSize))
+			c.reportSlowClient("backlog too large to hold")
+			c.setDisconnectReason(DisconnectMemory)
+			c.Close()
+		}
+		return
 	}
 	c.lock.Lock()
 	c.messageBacklogQueue = append(c.messageBacklogQueue, data)
+	report := len(c.messageBacklogQueue) >= SlowClientThreshold && !c.slowReported
+	if report {
+		c.slowReported = true
+	}
 	c.lock.Unlock()
+	if report {
+		c.reportSlowClient(fmt.Sprintf("backlog reached %d messages", SlowClientThreshold))
+	}
 }
 
 //
@@ -357,23 +491,15 @@ func (c *MapClient) queueMessage(data string) {
 // about why we're terminating them)
 //
 func (c *MapClient) Close() {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("[client %s] recovered from MapClient Close error: %v", c.ClientAddr, r)
-		}
-	}()
-	c.ReachedEOF = true
-	// try to signal the background feeder that we're finished and it's
-	// safe to shut down the socket, if possible
-	select {
-		case c.CommChannel <- "■■■":
-			if DEBUGGING {
-				log.Printf("[client %s] Signaling client to stop", c.ClientAddr)
+	c.closeOnce.Do(func() {
+		c.ReachedEOF = true
+		if c.stopSending != nil {
+			if d := debugLog(DebugConnections); d != nil {
+				d.Printf("[client %s] Signaling client to stop", c.logTag())
 			}
-		default:
-			log.Printf("[client %s] Unable to send stop signal to client channel; shutting down socket as last resort.", c.ClientAddr)
-			c.Connection.Close()
-	}
+			close(c.stopSending)
+		}
+	})
 }
 
 //
@@ -381,33 +507,84 @@ func (c *MapClient) Close() {
 // Returns error if EOF or error is reached before the next non-null event
 //
 func (c *MapClient) NextEvent() (*MapEvent, error) {
-	for c.Scanner.Scan() {
-		t := strings.TrimSpace(c.Scanner.Text())
+	for {
+		// We stop waiting when the client has been silent too long, or
+		// when a transfer it's in the middle of has stalled, whichever
+		// comes first.
+		var deadline time.Time
+		if c.Service != nil && c.Service.ReadTimeout > 0 {
+			deadline = time.Now().Add(c.Service.ReadTimeout)
+		}
+		if transfer_deadline, ok := c.transferDeadline(); ok && (deadline.IsZero() || transfer_deadline.Before(deadline)) {
+			deadline = transfer_deadline
+		}
+		if c.Connection != nil {
+			c.Connection.SetReadDeadline(deadline)
+		}
+		line, err := c.readLine()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && c.abandonStalledTransfer(time.Now()) {
+				continue
+			}
+			if too_big, ok := err.(*MessageTooLargeError); ok {
+				log.Printf("[client %s] Rejected incoming message: %v", c.logTag(), too_big)
+				c.sendError("your last message was not accepted: %v", too_big)
+				continue
+			}
+			if err == io.EOF {
+				c.ReachedEOF = true
+				c.setDisconnectReason(DisconnectEOF)
+				return nil, fmt.Errorf("EOF while waiting for input from client")
+			}
+			c.setDisconnectReason(ioErrorReason(err, DisconnectReadTimeout))
+			return nil, err
+		}
+		t := strings.TrimSpace(line)
 		if t == "" {
 			continue	// ignore blank input lines
 		}
+		if c.Service != nil {
+			c.Service.metrics.countIn()
+		}
 		new_event, err := NewMapEvent(t, "", "")
 		if err != nil {
-			log.Printf("[client %s] Error in incoming event: %v", c.ClientAddr, err)
+			log.Printf("[client %s] Error in incoming event: %v", c.logTag(), err)
 			continue
 		}
 		return new_event, nil
 	}
-	err := c.Scanner.Err()
+}
+
+//
+// Write a line of data to the client's socket, giving up if it
+// doesn't go through in time.
+//
+func (c *MapClient) writeMessage(message string) error {
+	if c.Service != nil && c.Service.WriteTimeout > 0 {
+		c.Connection.SetWriteDeadline(time.Now().Add(c.Service.WriteTimeout))
+	}
+	c.pace.writing(message, time.Now())
+	n, err := c.Connection.Write([]byte(c.replay.number(message, c.replayLimit()) + "\n"))
+	c.countBandwidth(0, n)
 	if err == nil {
-		c.ReachedEOF = true
-		return nil, fmt.Errorf("EOF while waiting for input from client")
+		c.pace.wrote(time.Now())
 	}
-	return nil, err
+	if err == nil && c.Service != nil {
+		c.Service.metrics.countOut()
+	}
+	return err
 }
 
 //
 // Send the list of all connected clients to a client
 //
 func (c *MapClient) ConnResponse() {
-	c.Send("CONN")
-	cksum := sha256.New()
-	time_now := time.Now().Unix()
+	if notice := c.Service.persistenceNotice(); notice != "" {
+		c.Send("//", notice)
+	}
+	transfer := c.startTransfer("CONN", "CONN")
+	now := time.Now()
+	time_now := now.Unix()
 	count := 0
 
 	for _, peer := range c.Service.AllClients() {
@@ -428,17 +605,15 @@ func (c *MapClient) ConnResponse() {
 			wo = "1"
 		}
 		active_sec := fmt.Sprintf("%d", time_now - peer.LastPolo)
-
-		c.Send("CONN:", is, who, peer.ClientAddr, user, client, auth, "0", wo, active_sec)
-		ckval, err := PackageValues(is, who, peer.ClientAddr, user, client, auth, "0", wo, active_sec)
-		if err != nil {
-			log.Printf("[client %s] WARNING: Unable to calculate checksum for line %d of /CONN response: %v", c.ClientAddr, count, err)
-		} else {
-			cksum.Write([]byte(ckval))
+		afk := "0"
+		if c.Service.isAFK(peer, now) {
+			afk = "1"
 		}
+
+		transfer.Send(is, who, peer.ClientAddr, user, client, auth, "0", wo, active_sec, afk)
 		count++
 	}
-	c.Send("CONN.", strconv.Itoa(count), base64.StdEncoding.EncodeToString(cksum.Sum(nil)))
+	transfer.Finish()
 }
 
 //
@@ -446,30 +621,59 @@ func (c *MapClient) ConnResponse() {
 // from our channel.
 //
 func (c *MapClient) backgroundSender() {
+	defer c.Service.ReportCrash()
 	checkForBacklog := false
+	resumed := false
+	var resume <-chan time.Time
+	if c.Service != nil {
+		defer c.Service.goroutines.track(c.ClientAddr, "sender")()
+	}
 
-	if DEBUGGING {
-		log.Printf("[client %s] launched backgroundSender", c.ClientAddr)
+	if d := debugLog(DebugConnections); d != nil {
+		d.Printf("[client %s] launched backgroundSender", c.logTag())
 	}
 
 FeedClient:
 	for {
 		select {
-			case message, more := <-c.CommChannel:
-				if !more || message == "■■■" {
-					log.Printf("[client %s] Disconnecting", c.ClientAddr)
-					c.Connection.Close()
-					c.ReachedEOF = true
+			case message := <-c.CommChannel:
+				if d := debugLog(DebugIO); d != nil {
+					d.Printf("[client %s] tx: %s", c.logTag(), message)
+				}
+				if err := c.writeMessage(message); err != nil {
+					log.Printf("[client %s] Error writing to client: %v", c.logTag(), err)
+					c.setDisconnectReason(ioErrorReason(err, DisconnectWriteTimeout))
 					break FeedClient
-				} else {
-					if DEBUGGING {
-						log.Printf("[client %s] tx: %s", c.ClientAddr, message)
-					}
-					c.Connection.Write([]byte(message + "\n"))
 				}
-				if len(c.CommChannel) == 0 {
+				if len(c.CommChannel) == 0 && resume == nil {
 					checkForBacklog = true
 				}
+
+			case <-c.replay.wakeup():
+				// the client missed some lines and wants them again
+				if err := c.writeResends(); err != nil {
+					log.Printf("[client %s] Error writing to client: %v", c.logTag(), err)
+					c.setDisconnectReason(ioErrorReason(err, DisconnectWriteTimeout))
+					break FeedClient
+				}
+
+			case <-resume:
+				// the client has had time to catch up
+				resume = nil
+				checkForBacklog = true
+				resumed = true
+
+			case <-c.stopSending:
+				// Send out whatever is still waiting in the channel (such
+				// as the message telling the client why it's being dropped)
+				// before we hang up.
+				for len(c.CommChannel) > 0 {
+					if err := c.writeMessage(<-c.CommChannel); err != nil {
+						break
+					}
+				}
+				log.Printf("[client %s] Disconnecting", c.logTag())
+				break FeedClient
 		}
 
 		if checkForBacklog {
@@ -480,41 +684,25 @@ FeedClient:
 			// we should re-fill the channel from it. (Other concurrent routines
 			// won't be sending to the channel in the mean time if the queue
 			// of backlogged messages will not be empty.)
+			//
+			// The messages are let in a window at a time, paced to suit
+			// the client (see refillFromBacklog).
 			checkForBacklog = false
-			c.lock.Lock()
-			if c.messageBacklogQueue != nil {
-				if len(c.messageBacklogQueue) > 0 {
-drainBacklog:
-					for {
-						select {
-							case c.CommChannel <- c.messageBacklogQueue[0]:
-								if DEBUGGING {
-									log.Printf("[client %s] unqueue %s", c.ClientAddr, c.messageBacklogQueue[0])
-								}
-								if len(c.messageBacklogQueue) > 1 {
-									c.messageBacklogQueue = c.messageBacklogQueue[1:]
-								} else {
-									c.messageBacklogQueue = nil
-									break drainBacklog
-								}
-
-							default:
-								// no more will fit, stop here
-								break drainBacklog
-						}
-					}
-				} else {
-					c.messageBacklogQueue = nil
-				}
+			if delay := c.refillFromBacklog(resumed); delay > 0 {
+				resume = time.After(delay)
 			}
-			c.lock.Unlock()
+			resumed = false
 		}
 	}
 
-	if DEBUGGING {
-		log.Printf("[client %s] stopped backgroundSender", c.ClientAddr)
+	c.Connection.Close()
+	c.ReachedEOF = true
+	if d := debugLog(DebugConnections); d != nil {
+		d.Printf("[client %s] stopped backgroundSender", c.logTag())
+	}
+	if c.senderDone != nil {
+		close(c.senderDone)
 	}
-	c.ReadyToClose = true
 }
 
 /////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -534,38 +722,106 @@ type MapService struct {
     serverRunning       bool                    // if false, we're shutting down operations
     outstandingClients  sync.WaitGroup          // atomic semaphore counting connected clients
     IncomingListener    net.Listener            // incoming socket for new connections
-    Database            *sql.DB                 // database interface for persistent storage
+    announcer           *Announcer              // advertising us on the local network (see Announce)
+    MaxMessageSize      int                     // longest message we'll accept from a client (0 for default)
+    MaxFrameSize        int                     // largest binary frame we'll accept from a client (0 for default)
+    TransferTimeout     time.Duration           // abandon multi-part transfers from clients stalled this long (0 for default, <0 for no limit)
+    ClientMemoryLimit   int64                   // most data we'll hold for any one client (0 for default, <0 for no limit)
+    ReplayBuffer        int                     // most numbered lines kept to resend to each client (0 for default, <0 for none)
+    DedupWindow         time.Duration           // drop repeated relayed messages from a client within this long (0 for default, <0 to relay them all)
+    relayEpoch          uint32                  // counts changes which may undo what relayed messages did
+    ReadTimeout         time.Duration           // drop clients silent for this long (0 for no limit)
+    WriteTimeout        time.Duration           // drop clients whose writes block this long (0 for no limit)
+    Database            *sql.DB                 // database interface for persistent storage (if Storage not set)
+    Storage             StorageBackend          // persistent storage for game state and presets
+    persistence         persistenceState        // is the database working? (see persist)
     PlayerGroupPass     []byte                  // authentication password shared amongst players
     GmPass              []byte                  // authentication password for the GM
     PersonalPasswords   map[string][]byte       // set of passwords for individual players
-    Clients             map[string]*MapClient   // dictionary of connected clients by client address
+    ChallengeLifetime   time.Duration           // how long clients have to answer their login challenge (0 for default)
+    challenges          challengeRegistry       // login challenges sent out and responses accepted
+    ReportSharedLogins  bool                    // tell the GM when a user logs in while already connected elsewhere
+    AlertWebhook        string                  // where to POST alerts when security events pile up ("" for nowhere)
+    AlertThreshold      int                     // raise the alarm after this many security events of one kind... (0 for default)
+    AlertWindow         time.Duration           // ...within this long (0 for default)
+    security            securityMonitor         // recent security events
+    Clients             ClientRegistry          // connected clients
     InitFile            string                  // name of initial greeting file
-    EventHistory        map[string]*MapEvent    // game state as mapping of key to event
-    ImageList           map[string]string       // dictionary of server locations for known images
-    ChatHistory         []*MapEvent             // history of messages sent to chat channel
-    IdByName            map[string]string       // dictionary of object IDs by creature name
-    ClassById           map[string]string       // dictionary of object classes by ID
+    Campaign            string                  // name of the campaign (for init file templates)
+    State               *GameState              // current state of the game
+    Journal             *Journal                // record of changes to the state since the last save (nil for none)
+    JournalLimit        int64                   // save the state when the journal grows past this many bytes (0 for no limit)
+    StandbyOf           string                  // HTTP API of the primary server we mirror, if we are a standby (see RunStandby)
+    StandbyToken        string                  // API token for mirroring the primary
+    FailoverAfter       time.Duration           // take over when the primary has been unreachable this long (0 to wait to be promoted)
+    standby             standbyState            // how we are getting on as a standby
     PlayerDicePresets   map[string][]DicePreset // dictionary mapping username to personal die roll presets
-    SaveNeeded          bool                    // have we made changes to the game state since the last save?
+    presetRevisions     map[string]string       // current revision of each user's presets
+    presetLock          sync.Mutex              // controls access to PlayerDicePresets and presetRevisions
+    opposedRolls        opposedRollQueue        // opposed rolls waiting for the opponent
+    DiceLimits          DiceLimits              // limits on the work done for each die roll
+    DiceSeed            int64                   // if nonzero, seed each client's dice with this (demo mode)
+    MaxRollsPerMinute   int                     // most die rolls a user may make per minute (0 for no limit)
+    rollRate            rollRateLimiter         // recent die rolls by each user
+    fudges              fudgeQueue              // GM decisions about upcoming die rolls
+    AuditLog            *AuditLog               // record of privileged actions (nil to only log them)
+    TurnEnforcement     string                  // hold players to initiative order in combat (Turns* constants)
+    heldMessages        heldMessageQueue        // out-of-turn messages waiting for their sender's turn
+    GMLayers            []string                // map layers only the GM may see or change (nil for default)
+    WallLayers          []string                // map layers whose elements block line of sight (nil for default)
+    DrawingQuota        DrawingQuota            // how much each player may draw on the map
+    drawings            drawingLedger           // who drew which map elements
+    grid                gridSettings            // the grid drawn over the map
+    moves               movementReservations    // paths reserved for this round's simultaneous movement
+    MarkRetention       time.Duration           // how long to keep map markers for latecomers (0 to not keep them)
+    marks               markHistory             // map markers placed within MarkRetention
+    following           followMode              // does everyone's view follow the GM's?
+    MapExportDir        string                  // directory for map files saved by the GM ("" to not allow it)
+    apiRate             rollRateLimiter         // recent HTTP API requests by each API token
+    AllowedOrigins      []string                // web sites whose pages may use the HTTP API ("*" for any)
+    ServerVersion       string                  // version of this server, for the status page
+    Started             time.Time               // when the server started
+    NextSession         string                  // when the next game session is, for the status page
+    metrics             metricsHistory          // recent samples of how busy the server is
+    PersistMetrics      bool                    // keep the metrics history in the database across restarts
+    LogBuffer           *LogBuffer              // recent lines from the server's log, for the HTTP API (nil to not keep them)
+    CrashFile           string                  // where to write a report if the server crashes ("" for a new file in the temp directory)
+    CrashWebhook        string                  // where to POST crash reports ("" for nowhere)
+    SlowHandler         time.Duration           // warn about messages which take this long to handle (0 for default, <0 to never warn)
+    handlerTimes        handlerTimings          // how long we've taken to handle each type of message
+    NotifyWebhooks      bool                    // may players be notified through their webhooks while offline?
+    NotifyAllowed       []*net.IPNet            // private networks players' webhooks may nevertheless send to
+    notified            notifyThrottle          // when we last notified each player
+    EventBus            *MQTTPublisher          // where to publish game events for gadgets at the table (nil for nowhere)
+    feed                eventFeed               // readers of the public event feed for stream overlays
+    bandwidth           bandwidthLedger         // network traffic caused by each user
+    presetUsage         presetUsageLedger       // how often and when each user's die-roll presets were rolled
+    checkpoints         checkpointList          // game states the GM may roll back to
+    regions             regionList              // areas of the map the GM has annotated
+    lights              lightList               // light sources on the map
+    effects             ambientEffects          // weather and light over the whole map
+    PlayerPolls         bool                    // may players open polls, or only the GM?
+    AFKAfter            time.Duration           // take users to be away from the keyboard after this long idle (0 to never)
+    GMConflictWindow    time.Duration           // warn GMs who change the same thing this close together (0 to never)
+    polls               pollList                // questions put to everyone which are still open
+    gmEdits             gmEditList              // recent changes by each GM (see checkGMConflict)
+    order               streamOrder             // keeps each stream of messages in order (see streamOrder)
+    invites             inviteList              // invitations to join which haven't expired
+    JoinHost            string                  // host (and port) to give in join links (default: our LAN address)
+    HTTPPort            int                     // port the HTTP API is served on (0 if it isn't)
+    BandwidthWarning    uint64                  // warn users whose traffic passes each multiple of this many bytes (0 to not warn)
     StopChannel         chan int                // channel used to signal time for server to stop
+    goroutines          goroutineRegistry       // goroutines running on behalf of clients
 }
 
 //
 // Get a list of clients the server is tracking
 //
 func (ms *MapService) AllClients() []*MapClient {
-	// This allows us to lock the global client list for as
-	// little time as possible, so a routine can then go off
-	// and use the list independently. 
-	ms.lock.RLock()
-	clients := make([]*MapClient, len(ms.Clients))
-	i := 0
-	for _, aClient := range ms.Clients {
-		clients[i] = aClient
-		i++
-	}
-	ms.lock.RUnlock()
-	return clients
+	// The registry hands us a snapshot of the client list which
+	// won't change underneath us, so a routine can then go off
+	// and use the list independently.
+	return ms.Clients.All()
 }
 
 //
@@ -574,31 +830,83 @@ func (ms *MapService) AllClients() []*MapClient {
 // it from that point forward.
 //
 func (ms *MapService) Run() {
+	defer ms.ReportCrash()
 	var err error
+
+	if ms.State == nil {
+		ms.State = NewGameState()
+	}
 	//
 	// load all user presets into memory for quick recall later
 	//
-	if ms.Database != nil {
-		ms.PlayerDicePresets, err = LoadDicePresets(ms.Database)
+	if ms.Storage == nil && ms.Database != nil {
+		ms.Storage = &SQLiteStorage{DB: ms.Database}
+	}
+	if ms.Storage != nil {
+		ms.PlayerDicePresets, err = ms.Storage.LoadDicePresets()
 		if err != nil {
 			log.Printf("Unable to preload dice presets! (%v)", err)
 			ms.EmergencyStop()
 			return
 		}
-		err = ms.LoadState()
-		if err != nil {
+		promoted := ms.standby.wasPromoted()
+		if promoted {
+			log.Printf("Taking over the game state mirrored from %s", ms.StandbyOf)
+		} else if err = ms.LoadState(); err != nil {
 			log.Printf("Unable to preload game state! (%v)", err)
 			ms.EmergencyStop()
 			return
 		}
+		if ms.Journal != nil {
+			if promoted {
+				// anything in our journal is from before we were a standby
+				if err = ms.Journal.Discard(ms.Journal.Mark()); err != nil {
+					log.Printf("Unable to empty the journal: %v", err)
+				}
+			} else if n := ms.State.RecoverFromJournal(ms.Journal); n > 0 {
+				log.Printf("Recovered %d changes made since the last save from the journal", n)
+			}
+			ms.State.SetJournal(ms.Journal)
+			ms.Journal.SetLimit(ms.JournalLimit)
+			go ms.compactJournal(ms.Journal)
+		}
+		if promoted {
+			// the database has whatever we had before we were a standby
+			ms.State.markChanged()
+			if err = ms.SaveState(); err != nil {
+				log.Printf("Unable to save the game state we took over: %v", err)
+			}
+		}
+		err = ms.loadGridSettings()
+		if err != nil {
+			log.Printf("Unable to preload grid settings! (%v)", err)
+			ms.EmergencyStop()
+			return
+		}
+		if err = ms.loadMetricsHistory(); err != nil {
+			log.Printf("Unable to load server metrics history (%v); starting a new one", err)
+		}
+		if err = ms.loadBandwidth(); err != nil {
+			log.Printf("Unable to load bandwidth totals (%v); starting new ones", err)
+		}
+		if err = ms.loadPresetUsage(); err != nil {
+			log.Printf("Unable to load die-roll preset counters (%v); starting new ones", err)
+		}
+		if err = ms.loadRegions(); err != nil {
+			log.Printf("Unable to load map regions (%v); starting without them", err)
+		}
+		if err = ms.loadLights(); err != nil {
+			log.Printf("Unable to load light sources (%v); starting without them", err)
+		}
+		if err = ms.loadAmbientEffects(); err != nil {
+			log.Printf("Unable to load ambient effects (%v); starting without them", err)
+		}
 	}
 	//
 	// Initialize
 	//
 	ms.AcceptIncoming = true
 	ms.serverRunning = true
-	ms.IdByName = make(map[string]string)
-	ms.ClassById = make(map[string]string)
 
 	for ms.serverRunning {
 		client, err := ms.IncomingListener.Accept()
@@ -611,8 +919,9 @@ func (ms *MapService) Run() {
 			}
 			log.Printf("Error accepting incoming connection: %v", err)
 		} else {
+			ms.outstandingClients.Add(1)
 			go func () {
-				ms.outstandingClients.Add(1)
+				defer ms.ReportCrash()
 				defer ms.outstandingClients.Done()
 				ms.HandleClientConnection(client)
 			}()
@@ -625,23 +934,21 @@ func (ms *MapService) Run() {
 // returns true if there were any connected clients to send to.
 //
 func (ms *MapService) PingAll() bool {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("caught attempt to ping too late to client: %v", r)
-		}
-	}()
-
 	i := 0
 	for _, client := range ms.AllClients() {
 		if !client.Authenticated {
 			client.UnauthenticatedPings++
 			if client.UnauthenticatedPings > 2 {
 				log.Printf("[client %s] timeout waiting for successful authentication", client.ClientAddr)
+				client.setDisconnectReason(DisconnectAuthTimeout)
 				client.Send("DENIED", "No successful login made in time.")
 				client.Close()
 			}
 		}
 		client.Send("MARCO")
+		if client.Authenticated {
+			client.sendServerTime()
+		}
 		i++
 	}
 	if i > 0 {
@@ -662,7 +969,9 @@ func (ms *MapService) Shutdown() {
 	ms.lock.Lock()
 	ms.AcceptIncoming = false
 	ms.serverRunning = false
+	announcer := ms.announcer
 	ms.lock.Unlock()
+	announcer.Close()
 
 	log.Printf("MapService waiting for outstanding clients to exit...")
 	ms.outstandingClients.Wait()
@@ -689,44 +998,39 @@ func plural(n int) string {
 }
 
 func (ms *MapService) AddClient(newClient *MapClient) error {
-	ms.lock.Lock()
-	_, ok := ms.Clients[(*newClient).ClientAddr]
-	if ok {
-		ms.lock.Unlock()
-		return fmt.Errorf("Already tracking a connection for client %v; unable to add another", newClient.ClientAddr)
+	if err := ms.Clients.Add(newClient); err != nil {
+		return err
 	}
-	ms.Clients[(*newClient).ClientAddr] = newClient
-	log.Printf("Now %d connected client%s", len(ms.Clients), plural(len(ms.Clients)))
-	ms.lock.Unlock()
+	log.Printf("Now %d connected client%s", ms.Clients.Len(), plural(ms.Clients.Len()))
 
 	// notify everyone of the change
 	ms.NotifyPeerChange(newClient.Username(), "joined")
 	return nil
 }
 
+//
 // Wait for pending output to drain on the network socket before
 // fully closing it.
-
+//
 func (ms *MapService) WaitAndRemoveClient(oldClient *MapClient) {
-	log.Printf("[client %s] Waiting to close socket", (*oldClient).ClientAddr)
-	for !(*oldClient).ReadyToClose {
-		time.Sleep(10 * time.Millisecond)
+	log.Printf("[client %s] Waiting to close socket", oldClient.ClientAddr)
+	oldClient.Close()
+	if oldClient.senderDone != nil {
+		<-oldClient.senderDone
 	}
-	(*oldClient).Connection.Close()
-	log.Printf("[client %s] Closed socket", (*oldClient).ClientAddr)
+	oldClient.Connection.Close()
+	log.Printf("[client %s] Closed socket", oldClient.ClientAddr)
 }
 
 func (ms *MapService) RemoveClient(oldClient string) {
-	ms.lock.RLock()
-	oldClientObj, ok := ms.Clients[oldClient]
-	ms.lock.RUnlock()
-	if ok {
-		go ms.WaitAndRemoveClient(oldClientObj)
-		ms.lock.Lock()
-		delete(ms.Clients, oldClient)
-		ms.lock.Unlock()
-		log.Printf("Now %d connected client%s", len(ms.Clients), plural(len(ms.Clients)))
+	oldClientObj, ok := ms.Clients.Remove(oldClient)
+	if !ok {
+		return
 	}
+	remaining := ms.Clients.Len()
+
+	ms.goroutines.clientRemoved(oldClient)
+	log.Printf("Now %d connected client%s", remaining, plural(remaining))
 	// notify everyone of the change
 	ms.NotifyPeerChange(oldClientObj.Username(), "left")
 }
@@ -746,42 +1050,56 @@ func (ms *MapService) NotifyPeerChange(username, action string) {
 // the life of the connection.
 //
 func (ms *MapService) HandleClientConnection(clientConnection net.Conn) {
-	dieRoller, err := NewDieRoller()
+	var dieRoller *DieRoller
+	var err error
+	if ms.DiceSeed != 0 {
+		dieRoller, err = NewDieRollerWithSeed(ms.DiceSeed)
+	} else {
+		dieRoller, err = NewDieRoller()
+	}
 	if err != nil {
 		log.Printf("Internal error: Unable to create new die roller for client at %s: %v",
 			clientConnection.RemoteAddr().String(), err)
 		clientConnection.Close()
 		return
 	}
+	dieRoller.DiceLimits = ms.DiceLimits
+	dieRoller.Attributes = ms.State
 
 	thisClient := MapClient {
 		Connection:    clientConnection,
 		ClientAddr:    clientConnection.RemoteAddr().String(),
-		Scanner:       bufio.NewScanner(clientConnection),
+		Reader:        bufio.NewReaderSize(clientConnection, ReadBufferSize),
 		Service:       ms,
 		Authenticated: false,
 		dice:          dieRoller,
 		LastPolo:	   time.Now().Unix(),
+		lastInput:     time.Now(),
 		CommChannel:   make(chan string, CommChannelBufferSize),
+		stopSending:   make(chan struct{}),
+		senderDone:    make(chan struct{}),
 	}
 	log.Printf("Incoming connection from %s", thisClient.ClientAddr)
+	defer ms.goroutines.track(thisClient.ClientAddr, "reader")()
 	defer ms.WaitAndRemoveClient(&thisClient)
 	go thisClient.backgroundSender()
 	sync_client := false
+	var greeting InitFile
 
 	//
 	// Start by sending our greeting to the client
 	//
 	if !ms.AcceptIncoming {
-		log.Printf("[client %s] DENIED access (server not accepting new connections at this time).", thisClient.ClientAddr)
+		log.Printf("[client %s] DENIED access (server not accepting new connections at this time).", thisClient.logTag())
 		thisClient.Send("DENIED", "Server is not ready to accept connections. Try again later.")
+		thisClient.setDisconnectReason(DisconnectRefused)
 		goto end_connection
 	}
 
 	err = ms.AddClient(&thisClient)
 	if err != nil {
 		thisClient.Send("DENIED", "Internal error setting up connection.")
-		log.Printf("[client %s] ERROR adding client to list: %v", thisClient.ClientAddr, err)
+		log.Printf("[client %s] ERROR adding client to list: %v", thisClient.logTag(), err)
 		goto end_connection
 	}
 
@@ -789,23 +1107,14 @@ func (ms *MapService) HandleClientConnection(clientConnection net.Conn) {
 	// Initial server greeting from InitFile
 	//
 	if ms.InitFile != "" {
-		fp, err := os.Open(ms.InitFile)
+		greeting, err = ReadInitFile(ms.InitFile, NewInitFileVars(ms.Campaign, time.Now()))
 		if err != nil {
-			log.Printf("[client %s] ERROR opening %s: %v", thisClient.ClientAddr, ms.InitFile, err)
-		} else {
-			scanner := bufio.NewScanner(fp)
-			for scanner.Scan() {
-				init_text := scanner.Text()
-				if init_text == "SYNC" {
-					sync_client = true
-				} else if len(init_text) >= 4 && init_text[0:4] == "LOAD" {
-					log.Printf("Ignoring deprecated init-file directive: %s", init_text)
-				} else {
-					thisClient.SendRaw(scanner.Text())
-				}
-			}
-			fp.Close()
+			log.Printf("[client %s] ERROR reading %s: %v", thisClient.logTag(), ms.InitFile, err)
 		}
+		for _, init_text := range greeting.Lines {
+			thisClient.SendRaw(init_text)
+		}
+		sync_client = greeting.Sync
 	}
 
 	//
@@ -819,17 +1128,26 @@ func (ms *MapService) HandleClientConnection(clientConnection net.Conn) {
 		}
 		err := thisClient.AuthenticateUser()
 		if err != nil {
-			log.Printf("[client %s] Dropping connection due to authentication error: %v", thisClient.ClientAddr, err)
+			log.Printf("[client %s] Dropping connection due to authentication error: %v", thisClient.logTag(), err)
+			thisClient.setDisconnectReason(DisconnectAuthFailed)
 			goto end_connection
 		}
+		ms.Clients.Reindex()
 		ms.NotifyPeerChange(thisClient.Username(), "authenticated")
+		ms.noticeConcurrentSessions(&thisClient)
+		ms.noticeCoGMs(&thisClient)
 	} else {
 		// proceed without authentication (since this server is not configured
 		// to do authentication at all)
 		thisClient.Authenticated = true		// vacuously
+		ms.Clients.Reindex()
 		thisClient.Send("OK", PROTOCOL_VERSION)
 		ms.NotifyPeerChange(thisClient.Username(), "joined")
 	}
+	for _, init_text := range greeting.PostAuth {
+		thisClient.SendRaw(init_text)
+	}
+	ms.sendPostAuthPreamble(&thisClient, sync_client)
 
 	if sync_client {
 		ms.Sync(&thisClient)
@@ -839,33 +1157,39 @@ func (ms *MapService) HandleClientConnection(clientConnection net.Conn) {
 	// Read input events from the client and act upon them
 	//
 	for !thisClient.ReachedEOF {
+		thisClient.beginTrace()
 		event, err := thisClient.NextEvent()
 		if thisClient.ReachedEOF {
 			break
 		}
 		if err != nil {
-			log.Printf("[client %s] error reading input: %v", thisClient.ClientAddr, err)
+			log.Printf("[client %s] error reading input: %v", thisClient.logTag(), err)
 			goto end_connection
 		} else {
 			// interpret the event
-			log.Printf("[client %s] event %v; key %v", thisClient.ClientAddr, event.Fields, event.Key)
+			log.Printf("[client %s] event %v; key %v", thisClient.logTag(), event.Fields, event.Key)
+			thisClient.handling.Lock()
 			ms.ExecuteAction(event, &thisClient)
+			thisClient.handling.Unlock()
 		}
 	}
 
-	for thisClient.Scanner.Scan() {
-		event := thisClient.Scanner.Text()
-		log.Printf("[client %s] Received event [%s]", thisClient.ClientAddr, event)
+	for {
+		event, err := thisClient.readLine()
+		if err != nil {
+			break
+		}
+		log.Printf("[client %s] Received event [%s]", thisClient.logTag(), event)
 	}
 
 end_connection:
 	ms.RemoveClient(thisClient.ClientAddr)
 	thisClient.Close()
-	if commError := thisClient.Scanner.Err(); commError != nil {
-		log.Printf("[client %s] I/O Error on connection: %v", thisClient.ClientAddr, commError)
+	if reason := thisClient.DisconnectReason(); reason != "" {
+		log.Printf("[client %s] Disconnected (%s)", thisClient.logTag(), reason)
 	}
-	if DEBUGGING {
-		log.Printf("[client %s] Exiting client handler", thisClient.ClientAddr)
+	if d := debugLog(DebugConnections); d != nil {
+		d.Printf("[client %s] Exiting client handler", thisClient.logTag())
 	}
 }
 
@@ -880,990 +1204,69 @@ end_connection:
 // clients are, without needlessly acting on old state information which
 // was subsequently made obsolete.
 //
-var nextEventSequence int = 0
-
 func (ms *MapService) UpdateState(event *MapEvent) {
-	// Events with a blank key are ones we aren't going to bother
-	// tracking here since they don't really change the state of the
-	// game.
-	if event.Key != "" {
-		//
-		// store this as the most recent with the given key.
-		// we store the sequence number in each one so they can be
-		// played back in the correct order, but store by key since
-		// most of the time that's what we're doing (so the more
-		// expensive operation of sorting by sequence number only
-		// happens occasionally).
-		//
-		ms.lock.Lock()
-		event.Sequence = nextEventSequence
-		nextEventSequence++
-		ms.EventHistory[event.Key] = event
-		ms.SaveNeeded = true
-		ms.lock.Unlock()
+	if err := ms.State.Record(event); err != nil {
+		log.Printf("Unable to apply %v to game state: %v", event.Fields, err)
 	}
 }
 
 //
 // Act on the incoming event. Many will just be echoed to the other
-// clients, but a few require special processing, which we'll do here.
+// clients, but a few require special processing. The handler for each
+// message type is found in the messageHandlers table (see handlers.go).
 //
 func (ms *MapService) ExecuteAction(event *MapEvent, thisClient *MapClient) {
-	switch event.EventType() {
-		// Effectively a no-op. Ignore completely.
-		case "MARCO":
-			return
-
-		// Also a no-op, but we're interested in how long it's been since
-		// we received an answer to our keep-alive pings, so we'll record
-		// this.
-		case "POLO":
-			thisClient.LastPolo = time.Now().Unix()
-			return
-
-		// Events not allowed to clients
-		case "AC", "CONN", "CONN:", "CONN.", "DENIED", "GRANTED", "ROLL", "OK", "PRIV":
-			thisClient.Send("//", "Clients not allowed to send this command", event.EventType())
-
-		// Events simply relayed to all other clients
-		case "//", "AI", "AI:", "AI.", "AV", "CLR@", "L", "M", "M?", "M@", "MARK":
-			thisClient.SendToOthers(event.Fields...)
-
-		// Events simply relayed, but restricted to GM only
-		case "CO", "CS", "DSM", "I", "IL", "TB":
-			if !thisClient.Authenticated || (thisClient.Auth != nil && !thisClient.Auth.GmMode) {
-				log.Printf("[client %s] DENIED privileged command %v to non-GM user", thisClient.ClientAddr, event.Fields)
-				thisClient.Send("PRIV", "You are not authorized to use the %v command", event.EventType())
-				return
-			}
-			thisClient.SendToOthers(event.Fields...)
-
-		// ACCEPT <message set>
-		//
-		// Restrict messages to this client to include only those in the set,
-		// unless <message set> is *, in which case accept all messages.
-		case "ACCEPT":
-			if event.Fields[1] == "*" {
-				thisClient.AcceptedList = nil
-			} else {
-				allowed, err := ParseTclList(event.Fields[1])
-				if err != nil {
-					log.Printf("[client %s] Error understanding ACCEPT command: %v", thisClient.ClientAddr, err)
-				} else {
-					thisClient.AcceptedList = allowed
-				}
-			}
-			log.Printf("[client %s] accepting %v", thisClient.ClientAddr, thisClient.AcceptedList)
-
-		// AI? <name> <size>
-		//
-		// Client requests definition of the given image by name and size.
-		// If we know, we'll send an AI@ event to answer the question directly.
-		// Otherwise, we'll forward on the question to the other clients to answer.
-		case "AI?":
-			ms.lock.RLock()
-			server_location, ok := ms.ImageList[event.Fields[1] + "‖" + event.Fields[2]]
-			ms.lock.RUnlock()
-			if ok {
-				thisClient.Send("AI@", event.Fields[1], event.Fields[2], server_location)
-			} else {
-				thisClient.SendToOthers(event.Fields...)
-			}
-
-		// AI@ <name> <size> <server_id>
-		//
-		// Declare that the image with the given <name> and <size>
-		// may be found at the given <server_id>. If we receive this,
-		// we remember that location so we can use it to answer subsequent
-		// queries for that image.
-		case "AI@":
-			ms.lock.Lock()
-			ms.ImageList[event.Fields[1] + "‖" + event.Fields[2]] = event.Fields[3]
-			ms.SaveNeeded = true
-			ms.lock.Unlock()
-			thisClient.SendToOthers(event.Fields...)
-
-		// AUTH <response> [<user> [<client>]]
-		// It's a bit late for this one to arrive now.
-		case "AUTH":
-			thisClient.Send("//", "AUTH command after authentication step ignored.")
-
-		// CC [*|<user> [<target> [<messageID>]]]
-		//
-		// Clear the chat history
-		//  <user> is the name of the user (if not "") who initiated this action
-		//  <target> is "" or (if >=0) the minimum message ID to remain after the clear,
-		//  or (if < 0) indicates that -<target> most recent messages should be kept.
-		//  <messageID> will be reassigned by the server here.
-		case "CC":
-			// fill out missing fields with default values
-			if len(event.Fields) < 2 { event.Fields = append(event.Fields, "*") }
-			if len(event.Fields) < 3 { event.Fields = append(event.Fields, "")  }
-			if len(event.Fields) < 4 { event.Fields = append(event.Fields, "0") }
-
-			if event.Fields[2] == "" {
-				// delete entire history
-				ms.lock.Lock()
-				ms.ChatHistory = nil
-				ms.SaveNeeded = true
-				ms.lock.Unlock()
-			} else {
-				target, err := strconv.Atoi(event.Fields[2])
-				if err != nil {
-					thisClient.Send("//", fmt.Sprintf("CC command rejected; invalid target: %v", err))
-					return
-				}
-				if target < 0 {
-					// delete all but last -target elements
-					ms.lock.Lock()
-					if len(ms.ChatHistory) > -target {
-						ms.ChatHistory = append([]*MapEvent(nil), ms.ChatHistory[len(ms.ChatHistory)+target:]...)
-						ms.SaveNeeded = true
-					}
-					ms.lock.Unlock()
-				} else {
-					// delete all up to one with message ID target
-					ms.lock.Lock()
-					if len(ms.ChatHistory) > 0 {
-						n := sort.Search(len(ms.ChatHistory), func(i int) bool {
-							mid, err := ms.ChatHistory[i].MessageID()
-							if err != nil {
-								log.Printf("[client %s] CC: Error getting message ID from %v: %v", thisClient.ClientAddr, ms.ChatHistory[i], err)
-								return false
-							}
-							return mid >= target
-						})
-						ms.ChatHistory = append([]*MapEvent(nil), ms.ChatHistory[n:]...)
-						ms.SaveNeeded = true
-					}
-					ms.lock.Unlock()
-				}
-			}
-			ms.lock.Lock()
-			event.AssignMessageID()
-			ms.ChatHistory = append(ms.ChatHistory, event)
-			ms.SaveNeeded = true
-			ms.lock.Unlock()
-
-			// Now forward the CC command out to all our peers
-			thisClient.SendToOthers(event.Fields...)
-
-		// CLR <id>
-		//
-		// Delete all objects matching <id> from clients. <id> may be:
-		//	*						all objects
-		//  E*						all map elements
-		//	M*						all monsters
-		// 	P*						all players
-		//  [<imagename>=]<name>	creature with the given <name>
-		//  <id>					object with ID <id>
-		case "CLR":
-			switch event.Fields[1] {
-				case "*":	// delete all objects
-					ms.lock.Lock()
-					ms.EventHistory = make(map[string]*MapEvent)
-					nextEventSequence = 0
-					ms.IdByName = make(map[string]string)
-					ms.SaveNeeded = true
-					ms.lock.Unlock()
-
-				case "E*", "M*", "P*":	// delete tokens of the given type
-					ms.lock.Lock()
-					for key, ev := range ms.EventHistory {
-						if ev.EventClass() == event.Fields[1][0:1] {
-							delete(ms.EventHistory, key)
-						}
-					}
-					ms.lock.Unlock()
-
-				default: // delete creature token by name or any object by ID
-					creature_name := strip_creature_base_name(event.Fields[1])
-					ms.lock.RLock()
-					target, ok := ms.IdByName[creature_name]
-					ms.lock.RUnlock()
-					if !ok {
-						target = event.Fields[1]
-					}
-					ms.lock.Lock()
-					for key, ev := range ms.EventHistory {
-						if ev.ID == target {
-							delete(ms.EventHistory, key)
-						}
-					}
-					ms.lock.Unlock()
-			}
-
-			// Now forward the CLR command out to all our peers
-			thisClient.SendToOthers(event.Fields...)
-
-		// D <recipients> <die-expression>
-		//
-		// Roll the dice described by <die-expression> and then transmit the
-		// result to the people in <recipients>. The latter may include
-		// the following special recipients:
-		//   @  send back to the client requesting this die-roll.
-		//   *  send to all connected clients
-		//   %  send privately to the GM, and ONLY the GM, regardless of any
-		//      other values in <recipients>.
-		//
-		case "D":
-			title, results, err := thisClient.dice.DoRoll(event.Fields[2])
-			if err != nil {
-				thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
-				fmt.Sprintf("ERROR: die roll request not accepted: %v", err),
-				NextMessageID())
-				return
-			}
-			to_all := false
-			to_gm := false
-			to_list, err := ParseTclList(event.Fields[1])
-			if err != nil {
-				thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
-				fmt.Sprintf("ERROR: die roll recipient list not understood: %v", err),
-				NextMessageID())
-				return
-			}
-			for _, recipient := range to_list {
-				switch recipient {
-					case "*":
-						to_all = true
-					case "%":
-						to_gm = true
-				}
-			}
-
-
-			for _, result := range results {
-				var details []string
-				for _, detail := range result.Details {
-					formatted_detail, err := ToTclString([]string{detail.Type, detail.Value})
-					if err != nil {
-						log.Printf("Internal error formatting ROLL response: %v", err)
-						return
-					}
-					details = append(details, formatted_detail)
-				}
-				formatted_detail_list, err := ToTclString(details)
-				if err != nil {
-					log.Printf("Internal error formatting ROLL response: %v", err)
-					return
-				}
-				//
-				// Create a chat channel event containing the die roll result
-				//
-				response_event, err := NewMapEventFromList("", []string{"ROLL", thisClient.Username(),
-					event.Fields[1], title, strconv.Itoa(result.Result), formatted_detail_list,
-					""}, "", "")
-				if err != nil {
-					log.Printf("Internal error creating ROLL event: %v", err)
-					return
-				}
-				//
-				// Add to the history of chat messages
-				//
-				ms.lock.Lock()
-				response_event.AssignMessageID()
-				ms.ChatHistory = append(ms.ChatHistory, response_event)
-				ms.SaveNeeded = true
-				ms.lock.Unlock()
-				//
-				// Send to recipients
-				//
-				if to_gm {
-					//
-					// ONLY to the GM's client(s)
-					//
-					for peerAddr, peer := range ms.Clients {
-						if !peer.WriteOnly && peer.Authenticated {
-							if peer.Username() == "GM" {
-								peer.Send(response_event.Fields...)
-							} else if peerAddr == thisClient.ClientAddr {
-								ack_event, err := NewMapEventFromList("", []string{"ROLL",
-									thisClient.Username(), event.Fields[1], title, "*",
-									"{comment {Results sent to GM}}", ""}, "", "")
-								if err != nil {
-									log.Printf("Internal error creating ROLL ack event: %v", err)
-									return
-								}
-								ms.lock.Lock()
-								ack_event.AssignMessageID()
-								ms.lock.Unlock()
-								thisClient.Send(ack_event.Fields...)
-							}
-						}
-					}
-				} else {
-					//
-					// Send results openly to all (listed) peers 
-					//
-					for peerAddr, peer := range ms.Clients {
-						if !peer.WriteOnly && peer.Authenticated {
-							if !to_all && peerAddr != thisClient.ClientAddr {
-								ok_to_send := false
-								for _, recipient := range to_list {
-									if peer.Username() == recipient {
-										ok_to_send = true
-										break
-									}
-								}
-								if !ok_to_send {
-									continue
-								}
-							}
-							peer.Send(response_event.Fields...)
-						}
-					}
-				}
-			}
-
-		//
-		// DD <deflist>
-		//
-		// Define a personal set of die-roll presets. <deflist>
-		// is a list of presets, each of which is a 3-tuple:
-		//   <name> <description> <dice-spec>
-		//
-		case "DD":
-			if !thisClient.Authenticated || thisClient.Auth == nil {
-				log.Printf("[client %s] DD command failed: no username authenticated for user", thisClient.ClientAddr)
-				return
-			}
-			new_set, err := NewDicePresetListFromString(event.Fields[1])
-			if err != nil {
-				log.Printf("[client %s] DD command failed: %v; new set %s", thisClient.ClientAddr, err, event.Fields[1])
-				thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
-					fmt.Sprintf("ERROR: die roll preset not understood: %v", err),
-					NextMessageID())
-				return
-			}
-			if ms.Database == nil {
-				log.Printf("[client %s] DD command failed (no open database)", thisClient.ClientAddr)
-				thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
-					fmt.Sprintf("ERROR: die roll preset could not be stored: the system administrator has not configured persistent storage."),
-					NextMessageID())
-				return
-			}
-
-			err = UpdateDicePresets(ms.Database, thisClient.Username(), new_set)
-			if err != nil {
-				log.Printf("[client %s] DD command failed to store: %v", thisClient.ClientAddr, err)
-				thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
-					fmt.Sprintf("ERROR: die roll preset could not be stored: %v", err),
-					NextMessageID())
-				return
-			}
-			ms.PlayerDicePresets[thisClient.Username()] = new_set
-			ms.SaveNeeded = true
-			ms.SendDicePresetsToOtherClients(thisClient, thisClient.Username())
-
-		//
-		// DD+ <deflist>
-		//
-		// Add a new set of die-roll presets to the existing
-		// list for a user. 
-		//
-		case "DD+":
-			if !thisClient.Authenticated || thisClient.Auth == nil {
-				log.Printf("[client %s] DD+ command failed: no username authenticated for user", thisClient.ClientAddr)
-				return
-			}
-			if ms.Database == nil {
-				log.Printf("[client %s] DD+ command failed (no open database)", thisClient.ClientAddr)
-				thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
-					fmt.Sprintf("ERROR: die roll preset could not be stored: the system administrator has not configured persistent storage."),
-					NextMessageID())
-				return
-			}
-			new_set, err := NewDicePresetListFromString(event.Fields[1])
-			if err != nil {
-				log.Printf("[client %s] DD+ command failed: %v; new set %s", thisClient.ClientAddr, err, event.Fields[1])
-				thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
-					fmt.Sprintf("ERROR: die roll preset not understood: %v", err),
-					NextMessageID())
-				return
-			}
-			old_set, ok := ms.PlayerDicePresets[thisClient.Username()]
-			if ok {
-				new_set = append(old_set, new_set...)
-			}
-			err = UpdateDicePresets(ms.Database, thisClient.Username(), new_set)
-			if err != nil {
-				log.Printf("[client %s] DD+ command failed to store: %v", thisClient.ClientAddr, err)
-				thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
-					fmt.Sprintf("ERROR: die roll preset could not be stored: %v", err),
-					NextMessageID())
-				return
-			}
-			ms.PlayerDicePresets[thisClient.Username()] = new_set
-			ms.SaveNeeded = true
-			ms.SendDicePresetsToOtherClients(thisClient, thisClient.Username())
-
-		//
-		// DD/ <regex>
-		//
-		// Remove all die-roll presets for the requesting user which match
-		// the given regular expression.
-		//
-		case "DD/":
-			if !thisClient.Authenticated || thisClient.Auth == nil {
-				log.Printf("[client %s] DD/ command failed: no username authenticated for user", thisClient.ClientAddr)
-				return
-			}
-			if ms.Database == nil {
-				log.Printf("[client %s] DD/ command failed (no open database)", thisClient.ClientAddr)
-				thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
-					fmt.Sprintf("ERROR: die roll preset could not be stored: the system administrator has not configured persistent storage."),
-					NextMessageID())
-				return
-			}
-			old_set, ok := ms.PlayerDicePresets[thisClient.Username()]
-			if !ok || len(old_set) == 0 {
-				return // nothing to do in this case
-			}
-			pattern, err := regexp.Compile(event.Fields[1])
-			if err != nil {
-				log.Printf("[client %s] DD/ command failed on regex compilation: %v", thisClient.ClientAddr, err)
-				thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
-					fmt.Sprintf("ERROR: die roll filter regex not understood: %v", err),
-					NextMessageID())
-				return
-			}
-
-			var new_set []DicePreset
-			for _, preset := range old_set {
-				if !pattern.MatchString(preset.Name) {
-					new_set = append(new_set, preset)
-				}
-			}
-
-			err = UpdateDicePresets(ms.Database, thisClient.Username(), new_set)
-			if err != nil {
-				log.Printf("[client %s] DD/ command failed to store: %v", thisClient.ClientAddr, err)
-				thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
-					fmt.Sprintf("ERROR: die roll filter results could not be stored: %v", err),
-					NextMessageID())
-				return
-			}
-			ms.PlayerDicePresets[thisClient.Username()] = new_set
-			ms.SaveNeeded = true
-			ms.SendDicePresetsToOtherClients(thisClient, thisClient.Username())
-
-		//
-		// DR
-		//
-		// Request die-roll presets on file for this user.
-		//
-		case "DR":
-			if !thisClient.Authenticated || thisClient.Auth == nil {
-				log.Printf("[client %s] DR command failed: no username authenticated for user", thisClient.ClientAddr)
-				return
-			}
-
-			old_set, ok := ms.PlayerDicePresets[thisClient.Username()]
-			if !ok || len(old_set) == 0 {
-				thisClient.Send("DD=")
-				thisClient.Send("DD.", "0", "")
-				return
-			}
-
-			ms.SendMyPresets(thisClient, thisClient.Username())
-
-		//
-		// LS
-		// LS: <data>
-		// LS. <count> <checksum>
-		//
-		// Load a data set (as if from a .map data file) describing all attributes
-		// of a set of map elements and creature token.  Even though they are sent
-		// as multiple commands over the client/server connections, we will store
-		// them here as a single event with multiple lines in the raw portion and an
-		// empty Fields list.
-		//
-		case "LS":
-			if thisClient.IncomingData != nil {
-				log.Printf("[client %s] WARNING: LS command received before previous one completed!", thisClient.ClientAddr)
-				log.Printf("[client %s] WARNING: Abandoning %d element%s previously received!",
-					thisClient.ClientAddr, len(thisClient.IncomingData),
-					plural(len(thisClient.IncomingData)))
-				thisClient.IncomingData = nil
-			}
-			thisClient.IncomingDataType = "LS"
-			return // don't save this (incomplete) operation in the state history
-
-		case "LS:":
-			if thisClient.IncomingDataType == "" {
-				log.Printf("[client %s] WARNING: LS: command received before LS command (ignored)", thisClient.ClientAddr)
-				return
-			}
-			if thisClient.IncomingDataType != "LS" {
-				log.Printf("[client %s] WARNING: LS: command received during %s command set (ignored)", thisClient.ClientAddr, thisClient.IncomingDataType)
-				return
-			}
-			saved_data := event.Fields[1]
-			thisClient.IncomingData = append(thisClient.IncomingData, saved_data)
-			return // don't save this (incomplete) operation in the state history
-
-		case "LS.":
-			if thisClient.IncomingDataType == "" {
-				log.Printf("[client %s] WARNING: LS. command received before LS command (ignored)", thisClient.ClientAddr)
-				return
-			}
-			if thisClient.IncomingDataType != "LS" {
-				log.Printf("[client %s] WARNING: LS. command received during %s command sequence (ignored)", thisClient.ClientAddr, thisClient.IncomingDataType)
-				return
-			}
-			data_by_id := make(map[string][]string)
-			expected_count, err := strconv.Atoi(event.Fields[1])
-			if err != nil {
-				log.Printf("[client %s] ERROR: LS. command count value couldn't be parsed: %v (LS sequence not accepted)", thisClient.ClientAddr, err)
-				goto reject_LS
-			}
-			if len(thisClient.IncomingData) != expected_count {
-				log.Printf("[client %s] ERROR: LS. command count value %d doesn't match expected count %d (LS sequence not accepted)", thisClient.ClientAddr, len(thisClient.IncomingData), expected_count)
-				goto reject_LS
-			}
-
-
-			if len(event.Fields) < 3 || event.Fields[2] == "" {
-				log.Printf("[client %s] WARNING: LS. command without checksum (won't validate)", thisClient.ClientAddr)
-			} else {
-				expected_checksum, err := base64.StdEncoding.DecodeString(event.Fields[2])
-				if err != nil {
-					log.Printf("[client %s] WARNING: LS. command checksum value couldn't be parsed: %v (LS sequence not accepted)", thisClient.ClientAddr, err)
-					goto reject_LS
-				}
-				cksum := sha256.New()
-				for _, x := range thisClient.IncomingData {
-					log.Printf("[client %s] adding \"%s\" to checksum", thisClient.ClientAddr, x)
-					cksum.Write([]byte(x))
-				}
-				if !bytesEqual(expected_checksum, cksum.Sum(nil)) {
-					log.Printf("[client %s] ERROR: LS. command checksum mismatch (LS sequence not accepted)", thisClient.ClientAddr)
-					log.Printf("[client %s] calculated: %v", thisClient.ClientAddr, cksum.Sum(nil))
-					log.Printf("[client %s] expected:   %v", thisClient.ClientAddr, expected_checksum)
-					goto reject_LS
-				}
-			}
-			//
-			// run through the list of objects sent in the LS command,
-			// rearranging them from the random order they're allowed to arrive
-			// per the protocol spec into a new set of events that each describe
-			// a single object.
-			//
-
-			thisClient.SendToOthers("LS")
-			for _, item_text := range thisClient.IncomingData {
-				item, err := ParseTclList(item_text)
-				if err != nil {
-					log.Printf("[client %s] ERROR: LS object format error in %s: %v; sequence rejected", thisClient.ClientAddr, item_text, err)
-					goto reject_LS
-				}
-
-				if len(item) == 0 {
-					continue
-				}
-				if len(item) < 2 {
-					log.Printf("[client %s] ERROR: LS object format error in %s; sequence rejected", thisClient.ClientAddr, item_text)
-					goto reject_LS
-				}
-				thisClient.SendToOthers("LS:", item_text)
-				switch item[0] {
-					case "M", "P":
-						attrs := strings.SplitN(item[1], ":", 2)
-						if len(attrs) != 2 {
-							log.Printf("[client %s] ERROR: LS object format error in %s; sequence rejected", thisClient.ClientAddr, item[1])
-							goto reject_LS
-						}
-						obj_list, ok := data_by_id[attrs[1]]
-						if !ok {
-							obj_list = []string{item_text}
-						} else {
-							obj_list = append(obj_list, item_text)
-						}
-						data_by_id[attrs[1]] = obj_list
-						ms.lock.Lock()
-						ms.ClassById[attrs[1]] = item[0]
-						ms.SaveNeeded = true
-						ms.lock.Unlock()
-						if attrs[0] == "NAME" {
-							if len(item) < 3 {
-								log.Printf("[client %s] ERROR: LS object format error in %s; sequence rejected", thisClient.ClientAddr, item_text)
-								goto reject_LS
-							}
-							ms.lock.Lock()
-							ms.IdByName[strip_creature_base_name(item[2])] = attrs[1]
-							ms.SaveNeeded = true
-							ms.lock.Unlock()
-						}
-					case "F":
-						data_by_id[item[1]] = []string{item_text}
-						ms.lock.Lock()
-						ms.ClassById[item[1]] = ""
-						ms.SaveNeeded = true
-						ms.lock.Unlock()
-
-					default:
-						attrs := strings.SplitN(item[0], ":", 2)
-						if len(attrs) != 2 {
-							log.Printf("[client %s] ERROR: LS object format error in %s; sequence rejected", thisClient.ClientAddr, item[0])
-							goto reject_LS
-						}
-						old_list, ok := data_by_id[attrs[1]]
-						if !ok {
-							old_list = []string{item_text}
-						} else {
-							old_list = append(old_list, item_text)
-						}
-						data_by_id[attrs[1]] = old_list
-						ms.lock.Lock()
-						ms.ClassById[attrs[1]] = "E"
-						ms.SaveNeeded = true
-						ms.lock.Unlock()
-				}
-			}
-			thisClient.SendToOthers(event.Fields...)
-			//
-			// repackage by object
-			//
-			for obj_id, definition := range data_by_id {
-				cksum := sha256.New()
-				var elements []string
-				for _, element := range definition {
-					cksum.Write([]byte(element))
-					elements = append(elements, "LS: {" + element + "}")
-				}
-				elements = append(elements, fmt.Sprintf("LS. %d %s",
-					len(elements), base64.StdEncoding.EncodeToString(cksum.Sum(nil))))
-				ms.lock.RLock()
-				obj_class, ok := ms.ClassById[obj_id]
-				ms.lock.RUnlock()
-				if !ok {
-					obj_class = ""
-				}
-				new_event, err := NewMapEvent("LS", obj_id, obj_class)
-				if err != nil {
-					log.Printf("[client %s] ERROR packaging LS data for object %s: %v",
-						thisClient.ClientAddr, obj_id, err)
-					return
-				}
-				new_event.MultiRawData = elements
-				ms.UpdateState(new_event)
-			}
-
-reject_LS:
-			thisClient.IncomingDataType = ""
-			thisClient.IncomingData = nil
-			return // don't save the original event to our history (we already saved the repackaged ones)
-
-		//
-		// NO
-		// NO+
-		// 
-		// Set client to write-only mode. NO+ is an obsolete variation
-		// of this command which we will now treat as a synonym for NO.
-		//
-		case "NO", "NO+":
-			thisClient.WriteOnly = true
-
-		//
-		// OA <id> <kvlist>
-		//
-		// Update a set of arbitrary attributes for the given object
-		// by <id> (which may be the unique identifier for any object
-		// (i.e., a UUID), or "@<name>" for a named creature token).
-		//
-		// <kvlist> is a list with an even number of elements, alternating
-		// between the name of an object attribute and its new value.
-		//
-		case "OA":
-			target := ""
-			name := ""
-			if event.Fields[1] == "" || event.Fields[1] == "@" {
-				log.Printf("[client %s] OA command rejected (empty ID field)", thisClient.ClientAddr)
-				return
-			}
-			kvlist, err := ParseTclList(event.Fields[2])
-			if err != nil {
-				log.Printf("[client %s] OA command: cannot parse kvlist: %v",
-					thisClient.ClientAddr, err)
-				return
-			}
-			if len(kvlist) % 2 != 0 {
-				log.Printf("[client %s] OA command: kvlist has non-even number of elements: %d",
-					thisClient.ClientAddr, len(kvlist))
-				return
-			}
-
-			if event.Fields[1][0:1] == "@" {
-				var ok bool
-
-				name = strip_creature_base_name(event.Fields[1][1:])
-				ms.lock.RLock()
-				target, ok = ms.IdByName[name]
-				ms.lock.RUnlock()
-				if ok {
-					ms.lock.RLock()
-					known_class, ok := ms.ClassById[target]
-					ms.lock.RUnlock()
-					if ok {
-						event.Class = known_class
-					}
-					event.ID = target
-				} else {
-					target = ""
-					event.ID = ""
-					log.Printf("[client %s] OA command: setting attribute for %s: unknown object name (attempting best try)", thisClient.ClientAddr, event.Fields[1])
-				}
-			} else {
-				target = event.Fields[1]
-				ms.lock.RLock()
-				known_class, ok := ms.ClassById[target]
-				ms.lock.RUnlock()
-				if ok {
-					event.Class = known_class
-				}
-				event.ID = target
-			}
-
-			// if we're changing the object's NAME attribute, we'll have to
-			// change the mapping of name to ID now.
-			for i := 0; i < len(kvlist)-1; i+= 2 {
-				if kvlist[i] == "NAME" {
-					ms.lock.Lock()
-					if target != "" {
-						if name != "" {
-							_, ok := ms.IdByName[name]
-							if ok {
-								delete(ms.IdByName, name)
-							}
-						}
-						ms.IdByName[kvlist[i+1]] = target
-					}
-					ms.SaveNeeded = true
-					ms.lock.Unlock()
-					break
-				}
-			}
-			thisClient.SendToOthers(event.Fields...)
-
-		//
-		// OA+ <id> <key> <valuelist>
-		// OA- <id> <key> <valuelist>
-		//
-		// Assuming that the object with the given <id> has an attribute
-		// <key> whose value is a list of values, add (OA+) or remove (OA-) the
-		// list of values to/from that attribute.
-		//
-		case "OA+", "OA-":
-			target := ""
-			name := ""
-			if event.Fields[1] == "" || event.Fields[1] == "@" {
-				log.Printf("[client %s] %s command rejected (empty ID field)",
-					thisClient.ClientAddr, event.EventType())
-				return
-			}
-
-			if event.Fields[1][0:1] == "@" {
-				var ok bool
-				name = strip_creature_base_name(event.Fields[1][1:])
-				ms.lock.RLock()
-				target, ok = ms.IdByName[name]
-				ms.lock.RUnlock()
-				if ok {
-					ms.lock.RLock()
-					known_class, ok := ms.ClassById[target]
-					ms.lock.RUnlock()
-					if ok {
-						event.Class = known_class
-					}
-					event.ID = target
-				} else {
-					target = ""
-					event.ID = ""
-					log.Printf("[client %s] %s command: setting attribute for %s: unknown object name (attempting best try)",
-						thisClient.ClientAddr, event.EventType(), event.Fields[1])
-				}
-			} else {
-				target = event.Fields[1]
-				ms.lock.RLock()
-				known_class, ok := ms.ClassById[target]
-				ms.lock.RUnlock()
-				if ok {
-					event.Class = known_class
-				}
-				event.ID = target
-			}
-			log.Printf("%v", target)
-			thisClient.SendToOthers(event.Fields...)
-
-		//
-		// PS <id> <color> <name> <area> <size> player|monster <x> <y> <reach>
-		//
-		// Place someone (a creature token) on the map.
-		//
-		case "PS":
-			ms.lock.Lock()
-			ms.IdByName[event.Fields[3]] = event.Fields[1]
-			ms.SaveNeeded = true
-			ms.lock.Unlock()
-			thisClient.SendToOthers(event.Fields...)
-
-		//
-		// SYNC [CHAT [<target>]]
-		//
-		// Synchronize the client with the current game state by replaying
-		// all of the saved events we've been tracking.
-		//
-		// In the case of SYNC CHAT, rather than replaying the events, we replay
-		// the saved chat messages. If <target> is supplied, only the messages
-		// with IDs greater than <target> are sent. If <target> is negative, then
-		// only the most recent |<target>| messages are sent.
-		//
-		// The events are stored in EventHistory as a map of key->*MapEvent
-		// (and ChatHistory for chat events as a linear slice of *MapEvent)
-		// 
-		// The ChatHistory list is stored in ascending message ID order so we 
-		// can simply re-transmit its events by finding our starting point
-		// and going from there. However, the EventHistory map needs to be
-		// sorted first. We store it by key to make updates more efficient
-		// since the more expensive sorting operation only needs to be 
-		// performed on the relatively rare SYNC command.
-		//
-		case "SYNC":
-			if len(event.Fields) == 1 {
-				// SYNC
-				// Send the stored events in our history
-				//
-				ms.Sync(thisClient)
-			} else {
-				if event.Fields[1] == "CHAT" {
-					// SYNC CHAT [target]
-					ms.lock.RLock()
-					start := 0
-					if len(event.Fields) > 2 {
-						target, err := strconv.Atoi(event.Fields[2])
-						if err != nil {
-							ms.lock.RUnlock()
-							log.Printf("[client %s] SYNC CHAT target value not understood: %v", thisClient.ClientAddr, err)
-							return
-						}
-						if target < 0 {
-							// send the most recent |target| messages
-							start = len(ms.ChatHistory) + target
-							if start < 0 {
-								start = 0
-							}
-						} else {
-							// send everything from message #target+1 to the end
-							start = sort.Search(len(ms.ChatHistory), func (i int) bool {
-								numeric_id, err := ms.ChatHistory[i].MessageID()
-								if err != nil { return false }
-								return numeric_id > target
-							})
-						}
-					}
-					for _, message := range ms.ChatHistory[start:] {
-						if message.CanSendTo(thisClient.Username()) {
-							thisClient.Send(message.Fields...)
-						}
-					}
-					ms.lock.RUnlock()
-				} else {
-					log.Printf("[client %s] SYNC command not understood", thisClient.ClientAddr)
-				}
-			}
-			return // don't record the SYNC in the history
-
-		//
-		// TO <sender> <recipientlist> <message> [<messageID>]
-		//
-		// Send a chat message to the list of recipients (as with the D
-		// command). The <messageID> is ignored when provided by a client
-		// but one is assigned by the server as it relays the message.
-		// We will also replace the <sender> value with the actual sender's
-		// name.
-		//
-		case "TO":
-			if len(event.Fields) == 4 {
-				event.Fields = append(event.Fields, "")
-			} else if len(event.Fields) != 5 {
-				log.Printf("[client %s] Rejected malformed TO event %v", thisClient.ClientAddr, event.Fields)
-				return
-			}
-			to_all := false
-			to_list, err := ParseTclList(event.Fields[2])
-			if err != nil {
-				thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
-					fmt.Sprintf("ERROR: recipient list not understood: %v", err),
-					NextMessageID())
-				return
-			}
-			for _, recipient := range to_list {
-				if recipient == "*" {
-					to_all = true
-				}
-			}
-			event.Fields[1] = thisClient.Username()
-			ms.lock.Lock()
-			event.AssignMessageID()
-			ms.ChatHistory = append(ms.ChatHistory, event)
-			ms.SaveNeeded = true
-			ms.lock.Unlock()
-			if to_all {
-				thisClient.SendToOthers(event.Fields...)
-			} else {
-				for _, peer := range ms.Clients {
-					if peer.WriteOnly || !peer.Authenticated || peer.ClientAddr == thisClient.ClientAddr {
-						continue
-					}
-					ok := false
-					for _, recipient := range to_list {
-						if recipient == peer.Username() {
-							ok = true
-							break
-						}
-					}
-					if !ok {
-						continue
-					}
-					peer.Send(event.Fields...)
-				}
-			}
-			thisClient.Send(event.Fields...)
+	defer thisClient.traceAs(thisClient.traceID())()
+	event.User = thisClient.Username()
+	ms.noticeActivity(event, thisClient)
+	if !interceptMessage(ms, thisClient, event) {
+		return
+	}
 
+	handler, ok := lookupMessageHandler(event.EventType())
+	if !ok {
+		log.Printf("[client %s] No handler defined for %s event (ignored)", thisClient.logTag(), event.EventType())
+		return
+	}
+	defer ms.timeHandler(event, thisClient, time.Now())
+	if handler.Privilege == PrivGM && !thisClient.IsGM() {
+		log.Printf("[client %s] DENIED privileged command %v to non-GM user", thisClient.logTag(), event.Fields)
+		thisClient.Send("PRIV", fmt.Sprintf("You are not authorized to use the %v command", event.EventType()))
+		ms.securityEvent(SecurityPrivilege, thisClient.Username(), thisClient.ClientAddr, fmt.Sprintf("sent GM-only command %s", event.EventType()))
+		return
+	}
+	if !ms.checkTurn(event, thisClient) || !ms.checkLayerAccess(event, thisClient) || !ms.checkDrawingQuota(event, thisClient) {
+		return
+	}
+	if ms.duplicateRelay(event, handler, thisClient) {
+		return
+	}
+	ms.checkGMConflict(event, handler, thisClient)
+	if stream := orderStream(event, handler); stream != "" {
+		defer ms.order.hold(stream)()
+	}
+	if handler.Handle(ms, event, thisClient) && handler.RecordsEvent {
 		//
-		// /CONN
-		//
-		// Request a list of connected users.
+		// Add this event to the tracked game state
 		//
-		case "/CONN":
-			thisClient.ConnResponse()
+		ms.UpdateState(event)
 	}
-	//
-	// Add this event to the tracked game state
-	//
-	ms.UpdateState(event)
 }
 
 func (ms *MapService) Sync(thisClient *MapClient) {
 	//
-	// pull our list of events from the map so they can be
-	// sorted
-	ms.lock.RLock()
-	events_to_sync := make(MapEventList, len(ms.EventHistory))
-	i := 0
-	for _, event := range ms.EventHistory {
-		events_to_sync[i] = event
-		i++
-	}
-	ms.lock.RUnlock()
+	// get the events sorted by sequence and send them to the client
 	//
-	// sort events by sequence and send them to the client
-	// 
-	sort.Sort(events_to_sync)
+	events_to_sync := ms.State.Events()
+	thisClient.beginBulk()
+	defer thisClient.endBulk()
 	thisClient.Send("//", "DUMP OF CURRENT GAME STATE FOLLOWS")
 	thisClient.Send("CLR", "*")
+	gm := thisClient.IsGM()
 	for _, event := range events_to_sync {
+		if !gm && ms.isGMObject(event.ID) {
+			continue
+		}
 		if event.MultiRawData != nil {
 			thisClient.SendWithExtraData(event)
 		} else {
@@ -1890,347 +1293,158 @@ func (ms *MapService) SendDicePresetsToOtherClients(mainClient *MapClient, usern
 }
 
 //
-// Send die-roll presets to a logged-in user's connection.
+// Send die-roll presets to a logged-in user's connection:
+//   DD=
+//   DD: <i> <name> <description> <dice-spec> <folder> <sort-order>
+//   ...
+//   DD. <count> <checksum>
+// If that connection already has the current revision of
+// the presets, we just send a DD~ message to say nothing
+// has changed.
 //
 func (ms *MapService) SendMyPresets(thisClient *MapClient, username string) {
-	var count int
-
-	thisClient.Send("DD=")
-	cksum := sha256.New()
-	presets, ok := ms.PlayerDicePresets[username]
-	if ok {
-		for i, preset := range presets {
-			thisClient.Send("DD:", strconv.Itoa(i), preset.Name, preset.Description, preset.RollSpec)
-			chkdata, err := PackageValues(strconv.Itoa(i), preset.Name, preset.Description, preset.RollSpec)
-			if err != nil {
-				log.Printf("WARNING: falied to package DD: data for checksum: %v", err)
-				// we will continue to complete the operation in this case, however.
-			} else {
-				cksum.Write([]byte(chkdata))
-			}
-		}
-		count = len(presets)
-	} else {
-		count = 0
+	revision := ms.DicePresetRevision(username)
+	if thisClient.swapPresetRevision(revision) == revision {
+		thisClient.Send("DD~", revision)
+		return
 	}
-
-	thisClient.Send("DD.", strconv.Itoa(count), base64.StdEncoding.EncodeToString(cksum.Sum(nil)))
+	transfer := thisClient.startTransfer("DD", "DD=")
+	for i, preset := range ms.DicePresets(username) {
+		transfer.Send(strconv.Itoa(i), preset.Name, preset.Description, preset.RollSpec, preset.Folder, strconv.Itoa(preset.SortOrder))
+	}
+	transfer.Finish()
 }
 
 //
-// Creature names may be <name> or <image>=<name>. Either way,
-// we just want the <name> part.
+// Note that the client has (or is about to be sent) the given revision
+// of its die-roll presets, returning the revision it had before. This
+// is done under the client's lock, since the presets are sent to a
+// user's other connections from the goroutine of the one which changed
+// them.
 //
-func strip_creature_base_name(name string) string {
-	return name[strings.Index(name, "=")+1:]
+func (c *MapClient) swapPresetRevision(revision string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	previous := c.presetRevision
+	c.presetRevision = revision
+	return previous
 }
 
 //
-// Save current game state to the database
-//
-// Database Schema
-//  ________________       ________________
-// | events         |     | extradata      |
-// |----------------|     |----------------|
-// | eventid    PAi |---->| extraid    PAi |
-// | rawdata      s |     | eventid      i |
-// | sequence     i |     | datarow      s |
-// | key          s |     |________________|
-// | class        s |
-// | objid        s |
-// |________________|
-//  ________________
-// | chats          |
-// |----------------|
-// | rawdata      s |
-// | msgid        s |
-// |________________|
-//  ________________
-// | images         |
-// |----------------|
-// | name         s |
-// | zoom         s |
-// | location     s |
-// |________________|
-//  ________________
-// | idbyname       |
-// |----------------|
-// | name         s |
-// | objid        s |
-// |________________|
-//  ________________
-// | classbyid      |
-// |----------------|
-// | objid        s |
-// | class        s |
-// |________________|
-//
-
-// P=primary key
-// A=auto-increment
-// i=integer
-// s=string
-
-func (ms *MapService) LoadState() error {
-	var err error
-	var result, subresult *sql.Rows
-	var event *MapEvent
-	var actual_msgid int
-
-	if ms.Database == nil {
-		log.Printf("LoadState: no database open")
-		return fmt.Errorf("LoadState: no database open")
+// Change the die-roll presets for a user.
+//
+func (ms *MapService) SetDicePresets(username string, presets []DicePreset) {
+	ms.presetLock.Lock()
+	defer ms.presetLock.Unlock()
+	if ms.PlayerDicePresets == nil {
+		ms.PlayerDicePresets = make(map[string][]DicePreset)
 	}
-	ms.lock.Lock()
-	ms.EventHistory = make(map[string]*MapEvent)
-	result, err = ms.Database.Query(`
-		select eventid, rawdata, sequence, key, class, objid 
-		from events`)
-	if err != nil {
-		log.Printf("LoadState: error loading from events table: %v", err)
-		goto load_err
-	}
-	for result.Next() {
-		var eventid  int64
-		var rawdata  string
-		var sequence int64
-		var key      string
-		var class    string
-		var objid    string
-		var extra    string
-		err = result.Scan(&eventid, &rawdata, &sequence, &key, &class, &objid)
-		if err != nil {
-			log.Printf("LoadState: error scanning results from events table: %v", err)
-			goto load_err
-		}
-		event, err = NewMapEvent(rawdata, objid, class)
-		if err != nil {
-			log.Printf("LoadState: error constructing new map event from \"%s\" (id %v, class %v): %v", rawdata, objid, class, err)
-			goto load_err
-		}
-		event.Sequence = int(sequence)
-		if event.Key != key {
-			fmt.Printf("Warning: Loaded event #%d (seq %d) has key %s but we think it should be %s", eventid, sequence, key, event.Key)
-		}
-		subresult, err = ms.Database.Query(`
-			select datarow from extradata
-				where extradata.eventid = ?
-				order by extraid
-		`, eventid)
-		if err != nil {
-			log.Printf("LoadState: error querying extradata for event id %v: %v", eventid, err)
-			goto load_err
-		}
-		for subresult.Next() {
-			err = subresult.Scan(&extra)
-			if err != nil {
-				log.Printf("LoadState: error scanning extradata value for event id %v: %v", eventid, err)
-				goto load_err
-			}
-			event.MultiRawData = append(event.MultiRawData, extra)
-		}
-		subresult.Close()
-		ms.EventHistory[event.Key] = event
-		if nextEventSequence <= event.Sequence {
-			nextEventSequence = event.Sequence+1
-		}
+	ms.PlayerDicePresets[username] = presets
+	delete(ms.presetRevisions, username)
+
+	names := make(map[string]bool)
+	for _, preset := range presets {
+		names[preset.Name] = true
 	}
-	result.Close()
+	ms.presetUsage.keepOnly(username, names)
+}
 
-	ms.ChatHistory = nil
-	result, err = ms.Database.Query(`select rawdata, msgid from chats`)
-	if err != nil {
-		log.Printf("LoadState: error querying chats table: %v", err)
-		goto load_err
+//
+// DicePresets returns a user's die-roll presets.
+//
+func (ms *MapService) DicePresets(username string) []DicePreset {
+	ms.presetLock.Lock()
+	defer ms.presetLock.Unlock()
+	return ms.PlayerDicePresets[username]
+}
+
+//
+// Save a user's die-roll presets in the database, or hold them until
+// it comes back if it is unavailable.
+//
+func (ms *MapService) storeDicePresets(username string, presets []DicePreset) {
+	storage := ms.Storage
+	ms.persist("DD "+username, "die-roll presets for "+username, func() error {
+		return storage.UpdateDicePresets(username, presets)
+	})
+}
+
+//
+// The revision of a user's die-roll presets is the same checksum
+// we send in the DD. message at the end of the list, so a client
+// can tell which revision it has. Since it only depends on the content
+// of the presets, it stays the same across server restarts and when
+// a change doesn't actually change anything.
+//
+func (ms *MapService) DicePresetRevision(username string) string {
+	ms.presetLock.Lock()
+	defer ms.presetLock.Unlock()
+	if revision, ok := ms.presetRevisions[username]; ok {
+		return revision
 	}
-	for result.Next() {
-		var rawdata  string
-		var msgid    int
-		err = result.Scan(&rawdata, &msgid)
-		if err != nil {
-			log.Printf("LoadState: error scanning result of chats table query: %v", err)
-			goto load_err
-		}
-		event, err = NewMapEvent(rawdata, "", "")
-		if err != nil {
-			log.Printf("LoadState: error creating new map event for \"%s\": %v", rawdata, err)
-			goto load_err
-		}
-		actual_msgid, err = event.MessageID()
+	cksum := sha256.New()
+	for i, preset := range ms.PlayerDicePresets[username] {
+		ckval, err := transferChecksumData([]string{strconv.Itoa(i), preset.Name, preset.Description, preset.RollSpec, preset.Folder, strconv.Itoa(preset.SortOrder)})
 		if err != nil {
-			log.Printf("Warning: skipping restored chat message %s with no apparent message ID", rawdata)
+			log.Printf("WARNING: failed to package DD: data for checksum: %v", err)
 			continue
 		}
-		if actual_msgid != msgid {
-			log.Printf("Warning: restored chat message %s with message ID %d but database says it should be %d",
-				rawdata, actual_msgid, msgid)
-		}
-		ms.ChatHistory = append(ms.ChatHistory, event)
-		AdvanceMessageId(actual_msgid)
+		cksum.Write([]byte(ckval))
 	}
-	result.Close()
-
-	ms.ImageList = make(map[string]string)
-	result, err = ms.Database.Query(`select name, zoom, location from images`)
-	if err != nil {
-		log.Printf("LoadState: error querying images table: %v", err)
-		goto load_err
-	}
-	for result.Next() {
-		var name string
-		var zoom string
-		var location string
-		err = result.Scan(&name, &zoom, &location)
-		if err != nil {
-			log.Printf("LoadState: error scanning image table: %v", err)
-			goto load_err
-		}
-		ms.ImageList[name + "‖" + zoom] = location
+	revision := base64.StdEncoding.EncodeToString(cksum.Sum(nil))
+	if ms.presetRevisions == nil {
+		ms.presetRevisions = make(map[string]string)
 	}
-	result.Close()
+	ms.presetRevisions[username] = revision
+	return revision
+}
 
-	ms.IdByName = make(map[string]string)
-	result, err = ms.Database.Query(`select name, objid from idbyname`)
-	if err != nil {
-		log.Printf("LoadState: error querying idbyname table: %v", err)
-		goto load_err
-	}
-	for result.Next() {
-		var name string
-		var objid string
-		err = result.Scan(&name, &objid)
-		if err != nil {
-			log.Printf("LoadState: error scanning idbyname: %v", err)
-			goto load_err
-		}
-		ms.IdByName[name] = objid
-	}
-	result.Close()
+//
+// Creature names may be <name> or <image>=<name>. Either way,
+// we just want the <name> part.
+//
+func strip_creature_base_name(name string) string {
+	return name[strings.Index(name, "=")+1:]
+}
 
-	ms.ClassById = make(map[string]string)
-	result, err = ms.Database.Query(`select objid, class from classbyid`)
-	if err != nil {
-		log.Printf("LoadState: error querying classbyid table: %v", err)
-		goto load_err
+//
+// Load the game state from persistent storage, replacing whatever
+// state we currently hold.
+//
+func (ms *MapService) LoadState() error {
+	if ms.Storage == nil {
+		log.Printf("LoadState: no database open")
+		return fmt.Errorf("LoadState: no database open")
 	}
-	for result.Next() {
-		var class string
-		var objid string
-		err = result.Scan(&objid, &class)
-		if err != nil {
-			log.Printf("LoadState: error scanning classbyid: %v", err)
-			goto load_err
-		}
-		ms.ClassById[objid] = class
+	if ms.State == nil {
+		ms.State = NewGameState()
 	}
-	result.Close()
-
-	ms.lock.Unlock()
-	return nil
-
-load_err:
-	ms.lock.Unlock()
-	return fmt.Errorf("Error reading from game state database (%v)", err)
+	return ms.Storage.LoadState(ms.State)
 }
 
+//
+// Save the current game state to persistent storage, if anything
+// has changed since the last time we did so.
+//
 func (ms *MapService) SaveState() error {
-	var err error
-	var tx *sql.Tx
-	var event, chat *MapEvent
-	var rawdata, extra string
-	var res sql.Result
-	var eventid int64
-	var msgid int
-
-	if ms.Database == nil {
+	if ms.Storage == nil {
 		return fmt.Errorf("SaveState: no database open")
 	}
-	if !ms.SaveNeeded {
-		log.Printf("Game state does not need to be saved.")
-		return nil
-	}
-
-	tx, err = ms.Database.Begin()
-	if err != nil {
-		return fmt.Errorf("SaveState: Unable to start transaction: %v", err)
-	}
-
-	if _, err = tx.Exec(`
-		delete from events;
-		delete from extradata;
-		delete from chats;
-		delete from images;
-		delete from idbyname;
-		delete from classbyid;
-	`); err != nil { goto bail_out }
-
-	ms.lock.RLock()
-	for _, event = range ms.EventHistory {
-		rawdata, err = event.RawEventText()
-		if err != nil { goto save_err }
-		res, err = tx.Exec(`insert into events (rawdata, sequence, key, class, objid)
-			values (?, ?, ?, ?, ?)`,
-			rawdata, event.Sequence, event.Key, event.Class, event.ID)
-		if err != nil { goto save_err }
-		eventid, err = res.LastInsertId()
-		if err != nil { goto save_err }
-		for _, extra = range event.MultiRawData {
-			if _, err = tx.Exec(`insert into extradata (eventid, datarow) values (?, ?)`,
-				eventid, extra); err != nil {
-				goto save_err
-			}
-		}
-	}
-	for _, chat = range ms.ChatHistory {
-		msgid, err = chat.MessageID()
-		if err != nil { goto save_err }
-		rawdata, err = chat.RawEventText()
-		if err != nil { goto save_err }
-		if _, err = tx.Exec(`insert into chats (rawdata, msgid) values (?, ?)`,
-			rawdata, msgid); err != nil {
-			goto save_err
-		}
-	}
-
-	for k, location := range ms.ImageList {
-		parts := strings.SplitN(k, "‖", 2)
-		if len(parts) != 2 {
-			log.Printf("ImageList entry has invalid key \"%s\"", k)
-			continue
-		}
-		_, err = tx.Exec(`insert into images (name, zoom, location) values (?, ?, ?)`, parts[0], parts[1], location)
-		if err != nil { goto save_err }
+	if err := ms.saveBandwidth(); err != nil {
+		log.Printf("Unable to save bandwidth totals: %v", err)
 	}
-
-	for k, v := range ms.IdByName {
-		_, err = tx.Exec(`insert into idbyname (name, objid) values (?, ?)`, k, v)
-		if err != nil { goto save_err }
+	if err := ms.savePresetUsage(); err != nil {
+		log.Printf("Unable to save die-roll preset counters: %v", err)
 	}
-
-	for k, v := range ms.ClassById {
-		_, err = tx.Exec(`insert into classbyid (objid, class) values (?, ?)`, k, v)
-		if err != nil { goto save_err }
+	if ms.State == nil || !ms.State.NeedsSave() {
+		log.Printf("Game state does not need to be saved.")
+		return nil
 	}
-
-	ms.lock.RUnlock()
-
-	if err = tx.Commit(); err != nil {
-		goto bail_out
+	if err := ms.Storage.SaveState(ms.State); err != nil {
+		return err
 	}
-
-	ms.lock.Lock()
-	ms.SaveNeeded = false
-	ms.lock.Unlock()
+	ms.State.MarkSaved()
 	return nil
-
-save_err:
-	ms.lock.RUnlock()
-
-bail_out:
-	if rberr := tx.Rollback(); rberr != nil {
-		return fmt.Errorf("Error writing to game state database (%v); further, failed to rollback database transaction (%v)!", err, rberr)
-	}
-	return fmt.Errorf("Error writing to game state database (%v)", err)
 }
 
 //
@@ -2239,42 +1453,26 @@ bail_out:
 func (ms *MapService) DumpState() {
 	ms.lock.RLock()
 	log.Printf("Dump of current game state:")
-	log.Printf("SEQUENCE CLS ID------------------------------ DATA-----------------------------")
-	for _, event := range ms.EventHistory {
-		rawdata, err := event.RawEventText()
-		if err != nil {
-			rawdata = fmt.Sprintf("**ERROR** %v", err)
-		}
-		log.Printf("%8d %3s %-32s %s", event.Sequence, event.Class, event.ID, rawdata)
+	if ms.State != nil {
+		ms.State.Dump()
 	}
-	log.Printf("IMAGE-ID------------ SIZE FILE-------------------------------------------------")
-	for key, image := range ms.ImageList {
-		parts := strings.SplitN(key, "‖", 2)
-		if len(parts) != 2 {
-			log.Printf("**INVALID** %13s %s", key, image)
-		} else {
-			log.Printf("%20s %4s %s", parts[0], parts[1], image)
-		}
-	}
-	log.Printf("ID------------------------------ CLS")
-	for id, class := range ms.ClassById {
-		log.Printf("%-32s %s", id, class)
-	}
-	log.Printf("ID------------------------------ NAME")
-	for name, id := range ms.IdByName {
-		log.Printf("%-32s %s", name, id)
-	}
-	log.Printf("Next sequence: %d", nextEventSequence)
-	log.Printf("Save needed?   %v", ms.SaveNeeded)
 
 	log.Printf("ADDRESS--------- USER----------- CLIENT--------- AUTH?")
-	for _, client := range ms.Clients {
+	for _, client := range ms.Clients.All() {
 		client_type := "<unknown>"
 		if client.Auth != nil {
 			client_type = client.Auth.Client
 		}
 		log.Printf("%-16s %-15s %-15s %v", client.ClientAddr, client.Username(), client_type, client.Authenticated)
 	}
+	log.Printf("ADDRESS--------- ROLE---- RUNNING- REMOVED")
+	for _, g := range ms.goroutines.list() {
+		removed := "-"
+		if !g.Removed.IsZero() {
+			removed = time.Since(g.Removed).Round(time.Second).String()
+		}
+		log.Printf("%-16s %-8s %8s %s", g.ClientAddr, g.Role, time.Since(g.Started).Round(time.Second), removed)
+	}
 	log.Printf("******************************** END ******************************************")
 	ms.lock.RUnlock()
 }
@@ -19,7 +19,12 @@
 
 package mapservice
 
-import "testing"
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
 
 // Ensure that the supported version of the service protocol
 // matches the one that the rest of the GMA suite believes to
@@ -35,6 +40,72 @@ func TestMapService_CurrentProtocol(t *testing.T) {
 	}
 }
 
+
+func TestMapClient_Timeouts(t *testing.T) {
+	ms := &MapService{ReadTimeout: 50 * time.Millisecond, WriteTimeout: 50 * time.Millisecond}
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &MapClient{
+		Connection: server,
+		Reader:     bufio.NewReader(server),
+		Service:    ms,
+	}
+
+	if _, err := c.NextEvent(); err == nil {
+		t.Fatalf("NextEvent returned without input")
+	}
+	if c.DisconnectReason() != DisconnectReadTimeout {
+		t.Errorf("disconnect reason %q after read timeout", c.DisconnectReason())
+	}
+
+	c = &MapClient{Connection: server, Service: ms}
+	if err := c.writeMessage("MARCO"); err == nil {
+		t.Errorf("write to unread pipe did not time out")
+	} else if ioErrorReason(err, DisconnectWriteTimeout) != DisconnectWriteTimeout {
+		t.Errorf("write error %v not seen as a timeout", err)
+	}
+}
+
+func TestMapClient_Teardown(t *testing.T) {
+	ms := newTestService()
+	server, client := net.Pipe()
+	c := &MapClient{
+		Connection:  server,
+		ClientAddr:  "pipe",
+		Service:     ms,
+		CommChannel: make(chan string, CommChannelBufferSize),
+		stopSending: make(chan struct{}),
+		senderDone:  make(chan struct{}),
+	}
+	received := make(chan []string)
+	go func() {
+		var lines []string
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+	go c.backgroundSender()
+
+	c.Send("DENIED", "go away")
+	c.Close()
+	c.Close() // must be harmless to do more than once
+	done := make(chan bool)
+	go func() {
+		ms.WaitAndRemoveClient(c)
+		done <- true
+	}()
+	select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("client teardown did not complete")
+	}
+	if lines := <-received; len(lines) != 1 || lines[0] != "DENIED {go away}" {
+		t.Errorf("client received %v before disconnect", lines)
+	}
+}
+
 // @[00]@| GMA 4.2.2
 // @[01]@|
 // @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
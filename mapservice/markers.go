@@ -0,0 +1,164 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                    Map Markers                                     //
+//                                                                                    //
+// A MARK message flashes a marker on everyone's map for a moment. The server may     //
+// keep each marker for a short time, so clients which connect (or ask with MARK?)    //
+// shortly afterward still see it, and then tell everyone when it has expired so      //
+// nobody is left with a stale marker on their map.                                   //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+//
+// A map marker someone placed recently.
+//
+type recentMark struct {
+	X, Y string
+	At   time.Time
+}
+
+//
+// markHistory keeps the map markers placed within the server's
+// MarkRetention time, oldest first.
+//
+type markHistory struct {
+	lock  sync.Mutex
+	marks []recentMark
+}
+
+func (h *markHistory) add(x, y string, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.marks = append(h.marks, recentMark{X: x, Y: y, At: now})
+}
+
+//
+// Remove and return the markers placed more than retention ago.
+//
+func (h *markHistory) expire(now time.Time, retention time.Duration) []recentMark {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	n := 0
+	for n < len(h.marks) && now.Sub(h.marks[n].At) >= retention {
+		n++
+	}
+	expired := append([]recentMark(nil), h.marks[:n]...)
+	h.marks = h.marks[n:]
+	return expired
+}
+
+//
+// Return the markers placed within the last retention time.
+//
+func (h *markHistory) recent(now time.Time, retention time.Duration) []recentMark {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var marks []recentMark
+	for _, m := range h.marks {
+		if now.Sub(m.At) < retention {
+			marks = append(marks, m)
+		}
+	}
+	return marks
+}
+
+//
+// Remember a marker for a while, then tell everyone it has expired.
+//
+func (ms *MapService) rememberMark(x, y string) {
+	if ms.MarkRetention <= 0 {
+		return
+	}
+	ms.marks.add(x, y, time.Now())
+	time.AfterFunc(ms.MarkRetention, func() { ms.expireMarks(time.Now()) })
+}
+
+//
+// Tell everyone about the markers which have now expired.
+//
+func (ms *MapService) expireMarks(now time.Time) {
+	for _, m := range ms.marks.expire(now, ms.MarkRetention) {
+		log.Printf("map marker at (%s, %s) expired", m.X, m.Y)
+		for _, peer := range ms.Clients.Subscribers("MARK-") {
+			if !peer.WriteOnly {
+				peer.Send("MARK-", m.X, m.Y)
+			}
+		}
+	}
+}
+
+//
+// Send a client the markers which are still fresh.
+//
+func (ms *MapService) sendRecentMarks(thisClient *MapClient) {
+	if ms.MarkRetention <= 0 {
+		return
+	}
+	for _, m := range ms.marks.recent(time.Now(), ms.MarkRetention) {
+		thisClient.Send("MARK", m.X, m.Y)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,115 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for map markers
+//
+
+package mapservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMarkHistory(t *testing.T) {
+	var h markHistory
+	start := time.Now()
+	h.add("1", "2", start)
+	h.add("3", "4", start.Add(5*time.Second))
+
+	if marks := h.recent(start.Add(8*time.Second), 10*time.Second); len(marks) != 2 {
+		t.Errorf("recent marks were %v", marks)
+	}
+	if expired := h.expire(start.Add(8*time.Second), 10*time.Second); len(expired) != 0 {
+		t.Errorf("marks expired early: %v", expired)
+	}
+	if marks := h.recent(start.Add(12*time.Second), 10*time.Second); len(marks) != 1 || marks[0].X != "3" {
+		t.Errorf("recent marks were %v", marks)
+	}
+	if expired := h.expire(start.Add(12*time.Second), 10*time.Second); len(expired) != 1 || expired[0].X != "1" {
+		t.Errorf("expired marks were %v", expired)
+	}
+	if expired := h.expire(start.Add(20*time.Second), 10*time.Second); len(expired) != 1 || expired[0].X != "3" {
+		t.Errorf("expired marks were %v", expired)
+	}
+}
+
+func TestMarkRetention(t *testing.T) {
+	ms := newTestService()
+	alice := newTestClient(ms, "alice", "alice", false)
+	bob := newTestClient(ms, "bob", "bob", false)
+
+	ms.ExecuteAction(testEvent(t, "MARK 10 20"), alice)
+	ms.ExecuteAction(testEvent(t, "MARK?"), bob)
+	if sent := sentToTestClient(bob); len(sent) != 1 || sent[0] != "MARK 10 20" {
+		t.Errorf("without retention bob was sent %q", sent)
+	}
+
+	ms.MarkRetention = time.Hour
+	ms.ExecuteAction(testEvent(t, "MARK 30 40"), alice)
+	sentToTestClient(bob)
+	ms.ExecuteAction(testEvent(t, "MARK?"), bob)
+	if sent := sentToTestClient(bob); len(sent) != 1 || sent[0] != "MARK 30 40" {
+		t.Errorf("bob was sent %q", sent)
+	}
+	ms.expireMarks(time.Now().Add(2 * time.Hour))
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "MARK- 30 40" {
+		t.Errorf("alice was sent %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "MARK?"), bob)
+	if sent := sentToTestClient(bob); len(sent) != 1 || sent[0] != "MARK- 30 40" {
+		t.Errorf("bob was sent %q after expiry", sent)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
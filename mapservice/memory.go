@@ -0,0 +1,175 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                            Per-connection memory budget                            //
+//                                                                                    //
+// Keeping track of roughly how much memory we are using on behalf of each client     //
+// connection, so no single client can make the server run out of memory by sending   //
+// (or failing to receive) an enormous amount of data.                                //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+//
+// Unless configured otherwise, we won't hold more than this many
+// bytes of data on behalf of any one client connection.
+//
+const DefaultClientMemoryLimit = 64 * 1024 * 1024
+
+//
+// clientMemory keeps a running total of the data we are holding for
+// a client which could grow without bound if we let it: messages
+// backed up waiting to be sent to it, and the chunks of a multi-part
+// transfer (such as LS) it is partway through sending us. Added to
+// the input buffer we read its messages through, this gives an
+// approximate figure for the memory the client is costing us.
+//
+type clientMemory struct {
+	lock     sync.Mutex
+	backlog  int64 // bytes of messages in the backlog queue
+	incoming int64 // bytes of transfer chunks received so far
+	exceeded bool  // has the client gone over its limit?
+}
+
+//
+// Claim room for more backlogged and/or incoming data, if that
+// won't take the client over limit bytes (a negative limit means
+// there is no limit). If it would, nothing is claimed and we
+// return false.
+//
+func (m *clientMemory) reserve(backlog, incoming, limit int64) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if limit >= 0 && ReadBufferSize+m.backlog+m.incoming+backlog+incoming > limit {
+		return false
+	}
+	m.backlog += backlog
+	m.incoming += incoming
+	return true
+}
+
+//
+// Give back room claimed with reserve.
+//
+func (m *clientMemory) release(backlog, incoming int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.backlog -= backlog
+	m.incoming -= incoming
+}
+
+//
+// Note that the client has gone over its limit. Returns true
+// the first time this is called, so we only act on it once.
+//
+func (m *clientMemory) exceed() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	first := !m.exceeded
+	m.exceeded = true
+	return first
+}
+
+//
+// The approximate number of bytes we are holding for the client.
+//
+func (m *clientMemory) usage() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return ReadBufferSize + m.backlog + m.incoming
+}
+
+//
+// The memory limit in effect for this client, or -1 if there is none.
+//
+func (c *MapClient) memoryLimit() int64 {
+	if c.Service == nil || c.Service.ClientMemoryLimit == 0 {
+		return DefaultClientMemoryLimit
+	}
+	if c.Service.ClientMemoryLimit < 0 {
+		return -1
+	}
+	return c.Service.ClientMemoryLimit
+}
+
+//
+// MemoryUsage returns the approximate number of bytes the server is
+// holding on behalf of this client.
+//
+func (c *MapClient) MemoryUsage() int64 {
+	return c.memory.usage()
+}
+
+//
+// Called when holding more data for a client would take it over its
+// memory limit. What goes over the limit has already been refused;
+// here we make note of it.
+//
+func (c *MapClient) memoryExceeded(what string) {
+	detail := fmt.Sprintf("%s would take it over its limit of %d bytes", what, c.memoryLimit())
+	log.Printf("[client %s] MEMORY LIMIT: %s", c.logTag(), detail)
+	if c.Service != nil {
+		c.Service.securityEvent(SecurityMemoryLimit, c.Username(), c.ClientAddr, detail)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
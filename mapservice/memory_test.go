@@ -0,0 +1,162 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the per-connection memory budget
+//
+
+package mapservice
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientMemory(t *testing.T) {
+	var m clientMemory
+	if !m.reserve(100, 50, ReadBufferSize+200) || m.usage() != ReadBufferSize+150 {
+		t.Errorf("usage was %d", m.usage())
+	}
+	if m.reserve(0, 51, ReadBufferSize+200) || m.usage() != ReadBufferSize+150 {
+		t.Errorf("reserved past the limit; usage was %d", m.usage())
+	}
+	if !m.reserve(0, 50, ReadBufferSize+200) || !m.reserve(1<<40, 0, -1) {
+		t.Errorf("reserve refused within the limit")
+	}
+	m.release(100+1<<40, 100)
+	if m.usage() != ReadBufferSize {
+		t.Errorf("usage was %d after releasing everything", m.usage())
+	}
+	if !m.exceed() || m.exceed() {
+		t.Errorf("exceed didn't report only the first time")
+	}
+}
+
+func TestTransferMemoryLimit(t *testing.T) {
+	ms := newTestService()
+	ms.ClientMemoryLimit = ReadBufferSize + 100
+	c := newTestClient(ms, "1.2.3.4:1", "alice", false)
+	chunk := strings.Repeat("x", 40)
+
+	c.beginTransfer(testEvent(t, "LS"))
+	c.transferChunk(testEvent(t, "LS: "+chunk))
+	c.transferChunk(testEvent(t, "LS: "+chunk))
+	if c.MemoryUsage() != ReadBufferSize+80 {
+		t.Errorf("usage was %d during transfer", c.MemoryUsage())
+	}
+	// This one (and anything after it) is too much to hold.
+	c.transferChunk(testEvent(t, "LS: "+chunk))
+	c.transferChunk(testEvent(t, "LS: y"))
+	if c.MemoryUsage() != ReadBufferSize || len(c.incoming.Chunks) != 0 {
+		t.Errorf("usage was %d with %d chunks held after overflow", c.MemoryUsage(), len(c.incoming.Chunks))
+	}
+	if tr := c.finishTransfer(testEvent(t, "LS. 4")); tr != nil || c.incoming != nil {
+		t.Errorf("oversized transfer accepted")
+	}
+	if sent := sentToTestClient(c); len(sent) != 1 || !strings.Contains(sent[0], "ERROR: your LS data was not accepted") {
+		t.Errorf("client was sent %v", sent)
+	}
+	if events, _ := ms.SecurityEventsSince(time.Time{}, 0); len(events) != 1 || events[0].Kind != SecurityMemoryLimit || events[0].User != "alice" {
+		t.Errorf("security events were %+v", events)
+	}
+
+	// a resent chunk replaces what it overlaps
+	c.beginTransfer(testEvent(t, "LS"))
+	c.transferChunk(testEvent(t, "LS: "+chunk+" 0"))
+	c.transferChunk(testEvent(t, "LS: "+chunk+" 1"))
+	c.transferChunk(testEvent(t, "LS: ab 1"))
+	if c.MemoryUsage() != ReadBufferSize+42 {
+		t.Errorf("usage was %d after resend", c.MemoryUsage())
+	}
+	if tr := c.finishTransfer(testEvent(t, "LS. 2")); tr == nil || len(tr.Chunks) != 2 || c.MemoryUsage() != ReadBufferSize {
+		t.Errorf("transfer within the limit not accepted; usage %d", c.MemoryUsage())
+	}
+}
+
+func TestBacklogMemoryLimit(t *testing.T) {
+	ms := newTestService()
+	ms.ClientMemoryLimit = ReadBufferSize + 1000
+	c := newTestClient(ms, "1.2.3.4:1", "alice", false)
+	for i := 0; i < CommChannelBufferSize; i++ {
+		c.sendToClientChannel("AC x")
+	}
+	message := "TO a b " + strings.Repeat("x", 93)
+	for i := 0; i < 10; i++ {
+		c.sendToClientChannel(message)
+	}
+	if c.ReachedEOF || len(c.messageBacklogQueue) != 10 || c.MemoryUsage() != ReadBufferSize+1000 {
+		t.Fatalf("backlog of %d messages (%d bytes held) was too much", len(c.messageBacklogQueue), c.MemoryUsage())
+	}
+	c.sendToClientChannel(message)
+	c.sendToClientChannel(message)
+	if !c.ReachedEOF || c.DisconnectReason() != DisconnectMemory || len(c.messageBacklogQueue) != 10 {
+		t.Errorf("client not dropped (%q) with %d messages backlogged", c.DisconnectReason(), len(c.messageBacklogQueue))
+	}
+	if reports := ms.SlowClientReports(); len(reports) != 1 || reports[0].Memory != ReadBufferSize+1000 {
+		t.Errorf("slow client reports were %+v", reports)
+	}
+	if events, _ := ms.SecurityEventsSince(time.Time{}, 0); len(events) != 1 || events[0].Kind != SecurityMemoryLimit {
+		t.Errorf("security events were %+v", events)
+	}
+
+	// the memory is given back as the backlog drains
+	for len(c.CommChannel) > 0 {
+		<-c.CommChannel
+	}
+	c.refillFromBacklog(false)
+	if n := int64(len(c.messageBacklogQueue)) * 100; c.MemoryUsage() != ReadBufferSize+n {
+		t.Errorf("usage was %d with %d messages left", c.MemoryUsage(), len(c.messageBacklogQueue))
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,338 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Server Metrics                                   //
+//                                                                                    //
+// A rolling history of how busy the server has been (clients, message rates, and     //
+// backed-up output queues) over the last day, for operators who want to graph it     //
+// without setting up a separate monitoring system.                                   //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// MetricsInterval is how often we take a sample of the server's metrics.
+//
+const MetricsInterval = 10 * time.Second
+
+//
+// MetricsRetention is how long we keep the samples.
+//
+const MetricsRetention = 24 * time.Hour
+
+//
+// A MetricSample is a snapshot of how busy the server was at some
+// moment.
+//
+type MetricSample struct {
+	Time        time.Time `json:"time"`
+	Clients     int       `json:"clients"`      // connected clients
+	MessagesIn  float64   `json:"messages_in"`  // messages/second received since the last sample
+	MessagesOut float64   `json:"messages_out"` // messages/second sent since the last sample
+	QueueDepth  int       `json:"queue_depth"`  // messages waiting to be sent to all clients
+	MaxQueue    int       `json:"max_queue"`    // messages waiting to be sent to the most backed-up client
+}
+
+//
+// metricsHistory counts the messages going in and out, and keeps the
+// samples taken over the last MetricsRetention.
+//
+type metricsHistory struct {
+	messagesIn  uint64
+	messagesOut uint64
+	abandoned   uint64 // incoming transfers given up on since the server started
+	duplicates  uint64 // duplicate relayed messages dropped since the server started
+	lock        sync.Mutex
+	samples     []MetricSample
+	lastIn      uint64
+	lastOut     uint64
+	slowClients []SlowClientReport
+}
+
+func (m *metricsHistory) countIn() {
+	atomic.AddUint64(&m.messagesIn, 1)
+}
+
+func (m *metricsHistory) countOut() {
+	atomic.AddUint64(&m.messagesOut, 1)
+}
+
+func (m *metricsHistory) countAbandonedTransfer() {
+	atomic.AddUint64(&m.abandoned, 1)
+}
+
+func (m *metricsHistory) countDuplicate() {
+	atomic.AddUint64(&m.duplicates, 1)
+}
+
+//
+// AbandonedTransfers returns how many multi-part transfers from clients
+// we have given up on (because they stalled) since the server started.
+//
+func (ms *MapService) AbandonedTransfers() uint64 {
+	return atomic.LoadUint64(&ms.metrics.abandoned)
+}
+
+//
+// DuplicatesDropped returns how many repeated messages from clients
+// we have declined to relay to the others since the server started.
+//
+func (ms *MapService) DuplicatesDropped() uint64 {
+	return atomic.LoadUint64(&ms.metrics.duplicates)
+}
+
+//
+// Add a sample (after filling in the message rates since the previous
+// one), forgetting those which have aged out.
+//
+func (m *metricsHistory) add(sample MetricSample) MetricSample {
+	in := atomic.LoadUint64(&m.messagesIn)
+	out := atomic.LoadUint64(&m.messagesOut)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if n := len(m.samples); n > 0 {
+		if elapsed := sample.Time.Sub(m.samples[n-1].Time).Seconds(); elapsed > 0 {
+			sample.MessagesIn = float64(in-m.lastIn) / elapsed
+			sample.MessagesOut = float64(out-m.lastOut) / elapsed
+		}
+	}
+	m.lastIn, m.lastOut = in, out
+	m.samples = append(m.samples, sample)
+	m.trim(sample.Time.Add(-MetricsRetention))
+	return sample
+}
+
+func (m *metricsHistory) trim(before time.Time) {
+	i := 0
+	for i < len(m.samples) && m.samples[i].Time.Before(before) {
+		i++
+	}
+	if i > 0 {
+		m.samples = append([]MetricSample(nil), m.samples[i:]...)
+	}
+}
+
+//
+// since returns the samples taken at or after the given time.
+//
+func (m *metricsHistory) since(when time.Time) []MetricSample {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	samples := []MetricSample{}
+	for _, s := range m.samples {
+		if !s.Time.Before(when) {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+//
+// queueDepth is how many messages are waiting to go out to the client.
+//
+func (c *MapClient) queueDepth() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.CommChannel) + len(c.messageBacklogQueue)
+}
+
+//
+// SampleMetrics takes a sample of the server's metrics now, adding it
+// to the history (and saving it in the database if PersistMetrics is
+// set). This should be called every MetricsInterval.
+//
+func (ms *MapService) SampleMetrics(now time.Time) MetricSample {
+	sample := MetricSample{Time: now}
+	for _, peer := range ms.AllClients() {
+		depth := peer.queueDepth()
+		sample.Clients++
+		sample.QueueDepth += depth
+		if depth > sample.MaxQueue {
+			sample.MaxQueue = depth
+		}
+	}
+	sample = ms.metrics.add(sample)
+
+	if ms.PersistMetrics {
+		if storage, ok := ms.Storage.(MetricsStorage); ok {
+			if err := storage.SaveMetricSample(sample, now.Add(-MetricsRetention)); err != nil {
+				log.Printf("Unable to save server metrics: %v", err)
+			}
+		}
+	}
+	return sample
+}
+
+//
+// MetricsSince returns the samples taken at or after the given time.
+//
+func (ms *MapService) MetricsSince(when time.Time) []MetricSample {
+	return ms.metrics.since(when)
+}
+
+//
+// Pick up the history we saved before the server was last restarted.
+//
+func (ms *MapService) loadMetricsHistory() error {
+	if !ms.PersistMetrics {
+		return nil
+	}
+	storage, ok := ms.Storage.(MetricsStorage)
+	if !ok {
+		return nil
+	}
+	samples, err := storage.LoadMetricSamples(time.Now().Add(-MetricsRetention))
+	if err != nil {
+		return err
+	}
+	ms.metrics.lock.Lock()
+	defer ms.metrics.lock.Unlock()
+	ms.metrics.samples = append(samples, ms.metrics.samples...)
+	return nil
+}
+
+//
+// MetricsStorage is implemented by storage backends which can keep
+// the metrics history across restarts of the server.
+//
+type MetricsStorage interface {
+	SaveMetricSample(sample MetricSample, keepSince time.Time) error
+	LoadMetricSamples(since time.Time) ([]MetricSample, error)
+}
+
+//
+// Database Schema
+//  ________________
+// | metrics        |
+// |----------------|
+// | time       P i |
+// | clients      i |
+// | msgin        f |
+// | msgout       f |
+// | queue        i |
+// | maxqueue     i |
+// |________________|
+//
+// P=primary key
+// i=integer
+// f=floating-point
+//
+// The time is stored as seconds since the epoch.
+//
+func createMetricsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists metrics (
+			time     integer primary key,
+			clients  integer not null,
+			msgin    real    not null,
+			msgout   real    not null,
+			queue    integer not null,
+			maxqueue integer not null
+		);`)
+	return err
+}
+
+//
+// SaveMetricSample adds a sample to the saved history, forgetting
+// any taken before keepSince.
+//
+func SaveMetricSample(db *sql.DB, s MetricSample, keepSince time.Time) error {
+	return withTransaction(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`replace into metrics (time, clients, msgin, msgout, queue, maxqueue) values (?, ?, ?, ?, ?, ?)`,
+			s.Time.Unix(), s.Clients, s.MessagesIn, s.MessagesOut, s.QueueDepth, s.MaxQueue); err != nil {
+			return fmt.Errorf("Unable to save metrics: %w", err)
+		}
+		if _, err := tx.Exec(`delete from metrics where time < ?`, keepSince.Unix()); err != nil {
+			return fmt.Errorf("Unable to expire old metrics: %w", err)
+		}
+		return nil
+	})
+}
+
+//
+// LoadMetricSamples reads the saved samples taken at or after the given
+// time, oldest first.
+//
+func LoadMetricSamples(db *sql.DB, since time.Time) ([]MetricSample, error) {
+	rows, err := db.Query(`select time, clients, msgin, msgout, queue, maxqueue from metrics where time >= ? order by time`, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var samples []MetricSample
+	for rows.Next() {
+		var s MetricSample
+		var when int64
+		if err = rows.Scan(&when, &s.Clients, &s.MessagesIn, &s.MessagesOut, &s.QueueDepth, &s.MaxQueue); err != nil {
+			return nil, fmt.Errorf("unable to read metrics: %v", err)
+		}
+		s.Time = time.Unix(when, 0)
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,146 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the server metrics history
+//
+
+package mapservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetricsHistory(t *testing.T) {
+	ms := newTestService()
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	a := newTestClient(ms, "1.2.3.4:1", "alice", false)
+	newTestClient(ms, "1.2.3.4:2", "bob", false)
+	a.CommChannel <- "FOO"
+	a.queueMessage("BAR")
+
+	first := ms.SampleMetrics(start)
+	if first.Clients != 2 || first.QueueDepth != 2 || first.MaxQueue != 2 || first.MessagesIn != 0 {
+		t.Errorf("first sample was %+v", first)
+	}
+	for i := 0; i < 30; i++ {
+		ms.metrics.countIn()
+	}
+	for i := 0; i < 5; i++ {
+		ms.metrics.countOut()
+	}
+	second := ms.SampleMetrics(start.Add(MetricsInterval))
+	if second.MessagesIn != 3 || second.MessagesOut != 0.5 {
+		t.Errorf("second sample was %+v", second)
+	}
+	if s := ms.MetricsSince(start.Add(time.Second)); len(s) != 1 || s[0] != second {
+		t.Errorf("samples since the first were %+v", s)
+	}
+
+	third := ms.SampleMetrics(start.Add(MetricsRetention + time.Minute))
+	if s := ms.MetricsSince(time.Time{}); len(s) != 1 || s[0] != third {
+		t.Errorf("old samples weren't forgotten: %+v", s)
+	}
+}
+
+func TestMetricsAPI(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/api.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	_, token, _ := ms.issueAPIToken("grapher", ScopeReadOnly, 0)
+	ms.SampleMetrics(time.Now().Add(-2 * time.Hour))
+	ms.SampleMetrics(time.Now())
+
+	if status, reply := apiTestRequest(t, ms, "GET", "/api/v1/metrics", token, ""); status != 200 || len(reply["samples"].([]interface{})) != 2 || reply["interval"] != MetricsInterval.Seconds() {
+		t.Errorf("GET metrics got %d %v", status, reply)
+	}
+	if status, reply := apiTestRequest(t, ms, "GET", "/api/v1/metrics?since=1h", token, ""); status != 200 || len(reply["samples"].([]interface{})) != 1 {
+		t.Errorf("GET metrics since 1h got %d %v", status, reply)
+	}
+	if status, reply := apiTestRequest(t, ms, "GET", "/api/v1/metrics?since=yesterday", token, ""); status != 400 {
+		t.Errorf("GET metrics with bad since got %d %v", status, reply)
+	}
+}
+
+func TestMetricsPersistence(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/metrics.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	ms.PersistMetrics = true
+
+	now := time.Now().Truncate(time.Second)
+	ms.SampleMetrics(now.Add(-MetricsRetention - time.Hour))
+	ms.SampleMetrics(now.Add(-time.Minute))
+	ms.SampleMetrics(now)
+
+	restarted := newTestService()
+	restarted.Storage = storage
+	restarted.PersistMetrics = true
+	if err = restarted.loadMetricsHistory(); err != nil {
+		t.Fatalf("unable to load metrics: %v", err)
+	}
+	s := restarted.MetricsSince(time.Time{})
+	if len(s) != 2 || !s[0].Time.Equal(now.Add(-time.Minute)) || !s[1].Time.Equal(now) {
+		t.Errorf("reloaded samples were %+v", s)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,289 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                               Movement Reservations                                //
+//                                                                                    //
+// For games where everyone moves at once, clients may reserve the path each creature //
+// will take this round before anyone actually moves. The server checks each proposed //
+// path against the others already reserved and the creatures standing still, and     //
+// confirms or rejects it. The GM starts a new round of reservations when the moves   //
+// have been made.                                                                    //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+//
+// GridLocation is a square on the map grid.
+//
+type GridLocation struct {
+	X, Y int
+}
+
+func (l GridLocation) String() string {
+	return fmt.Sprintf("(%d, %d)", l.X, l.Y)
+}
+
+//
+// ParsePath makes sense of a path given as a list of grid coordinates
+// x0 y0 x1 y1 ... naming each square moved into in turn.
+//
+func ParsePath(path string) ([]GridLocation, error) {
+	coords, err := ParseTclList(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(coords)%2 != 0 {
+		return nil, fmt.Errorf("Path must have an even number of coordinates")
+	}
+	var squares []GridLocation
+	for i := 0; i < len(coords); i += 2 {
+		x, err1 := strconv.Atoi(coords[i])
+		y, err2 := strconv.Atoi(coords[i+1])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("Path coordinates (%s, %s) must be integers", coords[i], coords[i+1])
+		}
+		squares = append(squares, GridLocation{x, y})
+	}
+	return squares, nil
+}
+
+//
+// Is b one square away from a (including diagonally)?
+//
+func adjacent(a, b GridLocation) bool {
+	dx, dy := a.X-b.X, a.Y-b.Y
+	return a != b && dx >= -1 && dx <= 1 && dy >= -1 && dy <= 1
+}
+
+//
+// MovementReservation is a path a creature intends to take this round.
+//
+type MovementReservation struct {
+	ID       string         // identifier chosen by the client
+	Creature string         // ID of the creature moving
+	Name     string         // name of the creature moving
+	User     string         // who reserved it
+	Start    GridLocation   // where the creature started
+	Path     []GridLocation // each square it moves into in turn
+}
+
+//
+// Where is the creature after the given number of steps? It stays
+// put once it reaches the end of its path.
+//
+func (r MovementReservation) at(step int) GridLocation {
+	if step <= 0 || len(r.Path) == 0 {
+		return r.Start
+	}
+	if step > len(r.Path) {
+		return r.Path[len(r.Path)-1]
+	}
+	return r.Path[step-1]
+}
+
+//
+// checkPath makes sure a creature's proposed path is unbroken and
+// won't run into anything. Everyone moves at once, one square per step,
+// so two creatures collide if they would be in the same square after
+// the same number of steps (including when they've stopped at the ends
+// of their paths). Creatures which aren't moving this round (those in
+// stationary) may not be moved through.
+//
+func checkPath(r MovementReservation, others []MovementReservation, stationary map[GridLocation]string) error {
+	if len(r.Path) == 0 {
+		return fmt.Errorf("The path is empty")
+	}
+	previous := r.Start
+	for _, square := range r.Path {
+		if !adjacent(previous, square) {
+			return fmt.Errorf("The path jumps from %v to %v", previous, square)
+		}
+		if who, ok := stationary[square]; ok {
+			return fmt.Errorf("The path runs into %s at %v", who, square)
+		}
+		previous = square
+	}
+	for _, other := range others {
+		steps := len(r.Path)
+		if len(other.Path) > steps {
+			steps = len(other.Path)
+		}
+		for step := 1; step <= steps; step++ {
+			if r.at(step) == other.at(step) {
+				return fmt.Errorf("The path runs into %s at %v on step %d", other.Name, r.at(step), step)
+			}
+		}
+	}
+	return nil
+}
+
+//
+// movementReservations are the paths reserved so far this round,
+// by creature ID.
+//
+type movementReservations struct {
+	lock       sync.Mutex
+	byCreature map[string]MovementReservation
+}
+
+//
+// Reserve a path if it doesn't collide with any others already
+// reserved (other than one for the same creature, which it replaces)
+// or with the creatures which aren't moving. The positions of all the
+// creatures on the map are given by ID.
+//
+func (m *movementReservations) reserve(r MovementReservation, names map[string]string, positions map[string]GridLocation) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.byCreature == nil {
+		m.byCreature = make(map[string]MovementReservation)
+	}
+	var others []MovementReservation
+	for id, other := range m.byCreature {
+		if id != r.Creature {
+			others = append(others, other)
+		}
+	}
+	stationary := make(map[GridLocation]string)
+	for id, loc := range positions {
+		if _, moving := m.byCreature[id]; !moving && id != r.Creature {
+			stationary[loc] = names[id]
+		}
+	}
+	if err := checkPath(r, others, stationary); err != nil {
+		return err
+	}
+	m.byCreature[r.Creature] = r
+	return nil
+}
+
+//
+// Withdraw a reservation by its ID. Returns false if there was none.
+//
+func (m *movementReservations) withdraw(id, creature string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if r, ok := m.byCreature[creature]; ok && r.ID == id {
+		delete(m.byCreature, creature)
+		return true
+	}
+	return false
+}
+
+//
+// End the round, returning the reservations which were made in it,
+// sorted by ID.
+//
+func (m *movementReservations) clear() []MovementReservation {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var all []MovementReservation
+	for _, r := range m.byCreature {
+		all = append(all, r)
+	}
+	m.byCreature = nil
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all
+}
+
+//
+// CreatureID finds a creature's ID from its ID or name.
+//
+func (gs *GameState) CreatureID(ref string) (string, bool) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	if obj := gs.creature(ref); obj != nil && obj.IsCreature() {
+		return obj.ID, true
+	}
+	return "", false
+}
+
+//
+// CreaturePositions returns the grid location of each creature on the
+// map by ID, along with their names.
+//
+func (gs *GameState) CreaturePositions() (map[string]GridLocation, map[string]string) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	positions := make(map[string]GridLocation)
+	names := make(map[string]string)
+	for id, obj := range gs.Objects {
+		if !obj.IsCreature() {
+			continue
+		}
+		x, err1 := strconv.Atoi(obj.Attrs["GX"])
+		y, err2 := strconv.Atoi(obj.Attrs["GY"])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		positions[id] = GridLocation{x, y}
+		names[id] = obj.Attrs["NAME"]
+	}
+	return positions, names
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
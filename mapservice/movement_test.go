@@ -0,0 +1,113 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for movement reservations
+//
+
+package mapservice
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	path, err := ParsePath("1 2 2 3")
+	if err != nil || len(path) != 2 || path[0] != (GridLocation{1, 2}) || path[1] != (GridLocation{2, 3}) {
+		t.Errorf("path was %v, %v", path, err)
+	}
+	for _, bad := range []string{"1 2 3", "1 x", "{1 2"} {
+		if _, err := ParsePath(bad); err == nil {
+			t.Errorf("path %q accepted", bad)
+		}
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	path := func(s string) []GridLocation {
+		p, err := ParsePath(s)
+		if err != nil {
+			t.Fatalf("bad test path %q: %v", s, err)
+		}
+		return p
+	}
+	others := []MovementReservation{
+		{Name: "orc", Start: GridLocation{5, 0}, Path: path("4 0 3 0")},
+		{Name: "goblin", Start: GridLocation{0, 5}, Path: path("0 4")},
+	}
+	stationary := map[GridLocation]string{{2, 2}: "statue"}
+
+	for i, test := range []struct {
+		start GridLocation
+		path  string
+		err   string
+	}{
+		{GridLocation{0, 0}, "1 1 2 1 3 1", ""},
+		{GridLocation{0, 0}, "", "empty"},
+		{GridLocation{0, 0}, "1 1 3 3", "jumps from (1, 1) to (3, 3)"},
+		{GridLocation{1, 1}, "2 2 3 3", "into statue at (2, 2)"},
+		{GridLocation{1, 0}, "2 0 3 0", "into orc at (3, 0) on step 2"},
+		{GridLocation{2, 1}, "3 0", "into orc at (3, 0) on step 2"},
+		{GridLocation{1, 1}, "2 1 3 1 4 1", ""},
+		{GridLocation{0, 2}, "0 3 0 4", "into goblin at (0, 4) on step 2"},
+	} {
+		err := checkPath(MovementReservation{Start: test.start, Path: path(test.path)}, others, stationary)
+		if test.err == "" && err != nil {
+			t.Errorf("test %d: path refused: %v", i, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("test %d: got error %v, expected %q", i, err, test.err)
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,376 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                MQTT Event Publisher                                //
+//                                                                                    //
+// Mirroring selected game events (combat starting, whose turn it is, natural 20s) to //
+// an MQTT broker so gadgets at the table such as smart lights can react to them.     //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Events which may be published to an MQTT broker, each on the topic
+// <prefix>/<event>.
+//
+const (
+	PublishCombat     = "combat"     // combat started or ended: {"active": bool} (retained)
+	PublishInitiative = "initiative" // whose turn it is: {"time": ..., "id": ..., "name": ...}
+	PublishCritical   = "critical"   // a natural 20 rolled for all to see: {"from": ..., "title": ..., "result": ...}
+)
+
+//
+// PublishableEvents lists all the events which may be published.
+//
+var PublishableEvents = []string{PublishCombat, PublishInitiative, PublishCritical}
+
+//
+// MQTTQueueSize is how many events may wait to be published before
+// we start dropping them; the game never waits on the broker.
+//
+const MQTTQueueSize = 64
+
+//
+// MQTTRetryInterval is how long we leave an unreachable broker alone
+// before trying it again (events in the meantime are dropped).
+//
+const MQTTRetryInterval = 30 * time.Second
+
+//
+// MQTTTimeout is how long we give the broker to accept our connection
+// or each message.
+//
+const MQTTTimeout = 10 * time.Second
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+//
+// An MQTTPublisher mirrors selected game events to an MQTT broker as
+// JSON messages, so things like smart lights at the table can react to
+// the game. It speaks just enough MQTT 3.1.1 to publish at QoS 0.
+//
+type MQTTPublisher struct {
+	Broker   string          // host:port
+	Username string
+	Password string
+	Prefix   string          // topic prefix
+	ClientID string
+	Events   map[string]bool // events to publish
+	queue    chan mqttMessage
+	done     chan struct{}
+	once     sync.Once
+}
+
+//
+// NewMQTTPublisher creates a publisher for a broker given as a URL
+//   mqtt://[<user>[:<password>]@]<host>[:<port>][/<prefix>]
+// (the prefix defaults to "gma") which publishes the named events, or
+// all of them if none are named. Call Start to begin publishing.
+//
+func NewMQTTPublisher(broker string, events []string) (*MQTTPublisher, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("MQTT broker URL not understood: %v", err)
+	}
+	if u.Scheme != "mqtt" || u.Hostname() == "" {
+		return nil, fmt.Errorf("MQTT broker must be given as mqtt://[user[:password]@]host[:port][/prefix]")
+	}
+	p := &MQTTPublisher{
+		Broker:   u.Host,
+		Prefix:   strings.Trim(u.Path, "/"),
+		ClientID: fmt.Sprintf("go-gma-server-%d", time.Now().Unix()),
+		Events:   make(map[string]bool),
+		queue:    make(chan mqttMessage, MQTTQueueSize),
+		done:     make(chan struct{}),
+	}
+	if u.Port() == "" {
+		p.Broker = net.JoinHostPort(u.Hostname(), "1883")
+	}
+	if p.Prefix == "" {
+		p.Prefix = "gma"
+	}
+	if u.User != nil {
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+	if len(events) == 0 {
+		events = PublishableEvents
+	}
+	for _, event := range events {
+		event = strings.TrimSpace(strings.ToLower(event))
+		known := false
+		for _, e := range PublishableEvents {
+			if e == event {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("Event %s can't be published (use %s)", event, strings.Join(PublishableEvents, ", "))
+		}
+		p.Events[event] = true
+	}
+	return p, nil
+}
+
+//
+// Start publishing queued events in the background.
+//
+func (p *MQTTPublisher) Start() {
+	go p.run()
+}
+
+//
+// Close stops the publisher, disconnecting from the broker once the
+// events already queued are sent.
+//
+func (p *MQTTPublisher) Close() {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() {
+		close(p.queue)
+		<-p.done
+	})
+}
+
+//
+// Publish queues an event to be sent to the broker, if we publish that
+// kind of event. If the queue is full, the event is dropped.
+//
+func (p *MQTTPublisher) Publish(event string, payload interface{}) {
+	if p == nil || !p.Events[event] {
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[mqtt] unable to publish %s event: %v", event, err)
+		return
+	}
+	select {
+		case p.queue <- mqttMessage{topic: p.Prefix + "/" + event, payload: data, retain: event == PublishCombat}:
+		default:
+			log.Printf("[mqtt] queue full; %s event dropped", event)
+	}
+}
+
+func (p *MQTTPublisher) run() {
+	defer close(p.done)
+	var conn net.Conn
+	var lastTry time.Time
+	for message := range p.queue {
+		if conn == nil {
+			if time.Since(lastTry) < MQTTRetryInterval {
+				continue
+			}
+			lastTry = time.Now()
+			var err error
+			if conn, err = p.connect(); err != nil {
+				log.Printf("[mqtt] unable to connect to %s: %v", p.Broker, err)
+				continue
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(MQTTTimeout))
+		if _, err := conn.Write(mqttPublishPacket(message)); err != nil {
+			log.Printf("[mqtt] lost connection to %s: %v", p.Broker, err)
+			conn.Close()
+			conn = nil
+			lastTry = time.Time{}
+		}
+	}
+	if conn != nil {
+		conn.Write([]byte{0xe0, 0x00}) // DISCONNECT
+		conn.Close()
+	}
+}
+
+//
+// Connect to the broker, returning once it has accepted us.
+//
+func (p *MQTTPublisher) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.Broker, MQTTTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(MQTTTimeout))
+	if _, err = conn.Write(p.connectPacket()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var ack [4]byte
+	if _, err = io.ReadFull(conn, ack[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack[0] != 0x20 || ack[1] != 0x02 {
+		conn.Close()
+		return nil, fmt.Errorf("broker didn't acknowledge our connection")
+	}
+	if ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("broker refused our connection (return code %d)", ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("[mqtt] connected to %s", p.Broker)
+	return conn, nil
+}
+
+//
+// MQTT packets are a type byte, the remaining length (7 bits at a time,
+// least significant first), and the rest; strings within them are
+// prefixed with their 16-bit length.
+//
+func mqttPacket(packetType byte, body []byte) []byte {
+	packet := []byte{packetType}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func (p *MQTTPublisher) connectPacket() []byte {
+	flags := byte(0x02) // clean session
+	if p.Username != "" {
+		flags |= 0x80
+		if p.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body := append(mqttString("MQTT"), 4, flags, 0, 0) // protocol level 4, no keep-alive
+	body = append(body, mqttString(p.ClientID)...)
+	if p.Username != "" {
+		body = append(body, mqttString(p.Username)...)
+		if p.Password != "" {
+			body = append(body, mqttString(p.Password)...)
+		}
+	}
+	return mqttPacket(0x10, body)
+}
+
+func mqttPublishPacket(message mqttMessage) []byte {
+	packetType := byte(0x30)
+	if message.retain {
+		packetType |= 0x01
+	}
+	return mqttPacket(packetType, append(mqttString(message.topic), message.payload...))
+}
+
+//
+// Does a die roll's breakdown show a natural 20 on a single d20?
+//
+func naturalTwenty(details []StructuredDescription) bool {
+	for i, detail := range details {
+		if detail.Type == "diespec" && detail.Value == "1d20" {
+			for _, d := range details[i+1:] {
+				if d.Type == "roll" || d.Type == "maxroll" {
+					if d.Type == "roll" && d.Value == "20" {
+						return true
+					}
+					break
+				}
+			}
+		}
+	}
+	return false
+}
+
+//
+// Publish a change of turn or combat mode.
+//
+func (ms *MapService) publishTurnChange(event *MapEvent) {
+	if ms.EventBus == nil {
+		return
+	}
+	switch event.EventType() {
+		case "CO":
+			ms.EventBus.Publish(PublishCombat, map[string]bool{"active": ms.State.CombatActive()})
+		case "I":
+			name := ""
+			if obj, ok := ms.State.Object(event.Fields[2]); ok {
+				name = obj.Attrs["NAME"]
+			}
+			ms.EventBus.Publish(PublishInitiative, map[string]string{"time": event.Fields[1], "id": event.Fields[2], "name": name})
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
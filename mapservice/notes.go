@@ -0,0 +1,178 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                       Notes                                        //
+//                                                                                    //
+// Private notes each user can keep on the server, so they follow the user from one   //
+// client to another.                                                                 //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+//
+// A Note is something a user wrote down for themselves during a game.
+// Nobody else gets to see it.
+//
+type Note struct {
+	Title    string    // unique (per user) title of the note
+	Text     string    // what the note says
+	Modified time.Time // when the note was last saved
+}
+
+//
+// NoteStorage is implemented by storage backends which can keep
+// users' private notes.
+//
+type NoteStorage interface {
+	ListNotes(user string) ([]Note, error)
+	LoadNote(user, title string) (Note, bool, error)
+	SaveNote(user string, note Note) error
+	DeleteNote(user, title string) (bool, error)
+}
+
+//
+// Database Schema
+//  _______________
+// | notes         |
+// |---------------|
+// | user       Ps |
+// | title      Ps |
+// | body        s |
+// | modified    i |
+// |_______________|
+//
+// P=primary key
+// i=integer
+// s=string
+//
+// The modified time is stored as seconds since the epoch. This table was
+// added after the others, so it is created whenever we open a database
+// which doesn't have it yet.
+//
+func createNoteTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists notes (
+			user     text    not null,
+			title    text    not null,
+			body     text    not null,
+			modified integer not null,
+			primary key (user, title)
+		);`)
+	return err
+}
+
+//
+// LoadNotes reads a user's notes from the database, in order by title.
+// If title is not empty, only that note is read.
+//
+func LoadNotes(db *sql.DB, user, title string) ([]Note, error) {
+	var rows *sql.Rows
+	var err error
+
+	if title == "" {
+		rows, err = db.Query(`select title, body, modified from notes where user = ? order by title`, user)
+	} else {
+		rows, err = db.Query(`select title, body, modified from notes where user = ? and title = ?`, user, title)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []Note
+	for rows.Next() {
+		var note Note
+		var modified int64
+		if err = rows.Scan(&note.Title, &note.Text, &modified); err != nil {
+			return nil, fmt.Errorf("unable to read notes for %s: %v", user, err)
+		}
+		note.Modified = time.Unix(modified, 0)
+		notes = append(notes, note)
+	}
+	return notes, rows.Err()
+}
+
+//
+// SaveNote stores one of a user's notes, replacing any existing one
+// with the same title.
+//
+func SaveNote(db *sql.DB, user string, note Note) error {
+	if _, err := db.Exec(`insert or replace into notes (user, title, body, modified) values (?, ?, ?, ?)`,
+		user, note.Title, note.Text, note.Modified.Unix()); err != nil {
+		return fmt.Errorf("Unable to save note %s: %v", note.Title, err)
+	}
+	return nil
+}
+
+//
+// DeleteNote removes one of a user's notes. It returns false if there
+// was no such note.
+//
+func DeleteNote(db *sql.DB, user, title string) (bool, error) {
+	result, err := db.Exec(`delete from notes where user = ? and title = ?`, user, title)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,111 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for private notes
+//
+
+package mapservice
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNoteStorage(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", filepath.Join(t.TempDir(), "notes.db"))
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ns, ok := storage.(NoteStorage)
+	if !ok {
+		t.Fatalf("sqlite storage doesn't store notes")
+	}
+
+	when := time.Unix(1600000000, 0)
+	for _, note := range []Note{
+		{"loot", "200gp and a wand", when},
+		{"clues", "the butler did it", when},
+		{"loot", "300gp and a wand", when.Add(time.Minute)},
+	} {
+		if err = ns.SaveNote("alice", note); err != nil {
+			t.Fatalf("unable to save note: %v", err)
+		}
+	}
+	if err = ns.SaveNote("bob", Note{"loot", "nothing", when}); err != nil {
+		t.Fatalf("unable to save note: %v", err)
+	}
+
+	notes, err := ns.ListNotes("alice")
+	if err != nil || len(notes) != 2 || notes[0].Title != "clues" || notes[1].Text != "300gp and a wand" || !notes[1].Modified.Equal(when.Add(time.Minute)) {
+		t.Errorf("alice's notes were %v, %v", notes, err)
+	}
+	if note, found, err := ns.LoadNote("bob", "loot"); !found || err != nil || note.Text != "nothing" {
+		t.Errorf("bob's loot note was %v, %v, %v", note, found, err)
+	}
+	if note, found, err := ns.LoadNote("bob", "clues"); found || err != nil {
+		t.Errorf("bob has alice's clues note %v, %v", note, err)
+	}
+	if found, err := ns.DeleteNote("bob", "clues"); found || err != nil {
+		t.Errorf("deleted bob's nonexistent note: %v, %v", found, err)
+	}
+	if found, err := ns.DeleteNote("alice", "clues"); !found || err != nil {
+		t.Errorf("deleting alice's note: %v, %v", found, err)
+	}
+	if notes, err := ns.ListNotes("alice"); err != nil || len(notes) != 1 {
+		t.Errorf("alice's notes after delete were %v, %v", notes, err)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,413 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                               Offline Notifications                                //
+//                                                                                    //
+// Letting players who aren't connected know, through a webhook of their choosing,    //
+// that someone has sent them a message or mentioned them in chat.                    //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//
+// NotifyInterval is the least time between notifications sent to the
+// same player, so a busy chat doesn't flood them.
+//
+const NotifyInterval = 5 * time.Minute
+
+//
+// NotifyTimeout is how long we wait for a player's webhook to accept
+// a notification.
+//
+const NotifyTimeout = 10 * time.Second
+
+//
+// A Notification is what we POST (as JSON) to a player's webhook when
+// someone wants their attention while they're not connected.
+//
+type Notification struct {
+	Campaign string    `json:"campaign,omitempty"`
+	User     string    `json:"user"`   // the player being notified
+	From     string    `json:"from"`   // who sent the message
+	Text     string    `json:"text"`   // the message
+	Direct   bool      `json:"direct"` // was it sent to them (rather than mentioning them)?
+	Held     bool      `json:"held"`   // will it be delivered when they next log in?
+	Time     time.Time `json:"time"`
+}
+
+//
+// NotifyStorage is implemented by storage backends which can keep the
+// webhooks players want to be notified through.
+//
+type NotifyStorage interface {
+	SetNotifyURL(user, url string) error
+	NotifyURL(user string) (string, bool, error)
+}
+
+//
+// Database Schema
+//  ________________
+// | notifyurls     |
+// |----------------|
+// | user       P s |
+// | url          s |
+// |________________|
+//
+// P=primary key
+// s=string
+//
+func createNotifyTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists notifyurls (
+			user text primary key,
+			url  text not null
+		);`)
+	return err
+}
+
+//
+// SetNotifyURL sets the webhook to which the user's notifications are
+// sent, or stops sending them if url is "".
+//
+func SetNotifyURL(db *sql.DB, user, url string) error {
+	var err error
+	if url == "" {
+		_, err = db.Exec(`delete from notifyurls where user = ?`, user)
+	} else {
+		_, err = db.Exec(`replace into notifyurls (user, url) values (?, ?)`, user, url)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to save notification webhook for %s: %v", user, err)
+	}
+	return nil
+}
+
+//
+// NotifyURL returns the webhook to which the user's notifications are
+// sent, if they have one.
+//
+func NotifyURL(db *sql.DB, user string) (string, bool, error) {
+	var url string
+	err := db.QueryRow(`select url from notifyurls where user = ?`, user).Scan(&url)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return url, true, nil
+}
+
+//
+// CheckNotifyURL makes sure a webhook URL is one we're willing to POST to.
+// (Players' webhooks are also checked when we connect to them, since
+// only then do we know what address the host name really leads to;
+// see webhookDialControl.)
+//
+func CheckNotifyURL(webhook string) error {
+	u, err := url.Parse(webhook)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook must be an http or https URL")
+	}
+	return nil
+}
+
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([\w.-]*\w)`)
+
+//
+// MentionedUsers returns the users @mentioned in a chat message.
+//
+func MentionedUsers(text string) []string {
+	var users []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			users = append(users, match[1])
+		}
+	}
+	return users
+}
+
+//
+// notifyThrottle remembers when we last notified each player.
+//
+type notifyThrottle struct {
+	lock sync.Mutex
+	last map[string]time.Time
+}
+
+//
+// ok returns true (and notes that we're notifying them now) if it has
+// been long enough since the user's last notification.
+//
+func (n *notifyThrottle) ok(user string, now time.Time) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.last == nil {
+		n.last = make(map[string]time.Time)
+	}
+	if last, seen := n.last[user]; seen && now.Sub(last) < NotifyInterval {
+		return false
+	}
+	n.last[user] = now
+	return true
+}
+
+//
+// Let players who aren't connected know someone wants them: those the
+// chat message was sent to (held lists the ones we're holding it for)
+// and, if it was sent to everyone, those @mentioned in it.
+//
+func (ms *MapService) notifyAddressed(event *MapEvent, to_list, held []string) {
+	if !ms.NotifyWebhooks {
+		return
+	}
+	storage, ok := ms.Storage.(NotifyStorage)
+	if !ok {
+		return
+	}
+	from, text := event.Fields[1], event.Fields[3]
+	now := time.Now()
+	notify := func(user string, direct, isHeld bool) {
+		if len(ms.Clients.ByUser(user)) > 0 || user == from {
+			return
+		}
+		webhook, found, err := storage.NotifyURL(user)
+		if err != nil {
+			log.Printf("Unable to look up notification webhook for %s: %v", user, err)
+			return
+		}
+		if !found || !ms.notified.ok(user, now) {
+			return
+		}
+		go ms.sendNotification(webhook, Notification{
+			Campaign: ms.Campaign,
+			User:     user,
+			From:     from,
+			Text:     text,
+			Direct:   direct,
+			Held:     isHeld,
+			Time:     now,
+		})
+	}
+
+	for _, user := range held {
+		notify(user, true, true)
+	}
+	for _, recipient := range to_list {
+		if recipient == "*" {
+			for _, user := range MentionedUsers(text) {
+				notify(user, false, false)
+			}
+			return
+		}
+	}
+}
+
+func (ms *MapService) sendNotification(webhook string, n Notification) {
+	defer ms.ReportCrash()
+	defer ms.goroutines.track("webhook", "notify "+n.User)()
+	if err := postWebhookVia(ms.playerWebhookClient(), webhook, n); err != nil {
+		log.Printf("Unable to notify %s: %v", n.User, err)
+		return
+	}
+	log.Printf("Notified %s of message from %s", n.User, n.From)
+}
+
+//
+// POST a value, as JSON, to a webhook the server's operator gave us.
+//
+func postWebhook(webhook string, payload interface{}) error {
+	return postWebhookVia(&http.Client{Timeout: NotifyTimeout}, webhook, payload)
+}
+
+//
+// POST a value, as JSON, to a webhook using the given client.
+//
+func postWebhookVia(client *http.Client, webhook string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook replied %s", resp.Status)
+	}
+	return nil
+}
+
+//
+// Networks players' webhooks may not reach (unless the operator allows
+// them with NotifyAllowed): this machine, private and carrier-grade NAT
+// networks, and link-local addresses such as the cloud metadata service
+// at 169.254.169.254.
+//
+var privateNetworks = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+//
+// ParseNetworks parses a comma-separated list of networks in CIDR notation
+// (a bare address stands for just that host).
+//
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip == nil {
+				return nil, fmt.Errorf("%s is not an IP address or network", cidr)
+			} else if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+//
+// webhookDialControl returns a net.Dialer Control function which refuses
+// to connect to private addresses other than those in allowed. Since it
+// sees the address actually being dialed, a host name which resolves to
+// (or is redirected to) such an address is caught too.
+//
+func webhookDialControl(allowed []*net.IPNet) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return fmt.Errorf("webhook address %s is not an IP address", host)
+		}
+		for _, n := range allowed {
+			if n.Contains(ip) {
+				return nil
+			}
+		}
+		if ip.IsMulticast() {
+			return fmt.Errorf("webhooks may not send to multicast address %s", ip)
+		}
+		for _, n := range privateNetworks {
+			if n.Contains(ip) {
+				return fmt.Errorf("webhooks may not send to private address %s", ip)
+			}
+		}
+		return nil
+	}
+}
+
+//
+// playerWebhookClient returns an HTTP client for POSTing to players'
+// webhooks, which won't connect to private addresses.
+//
+func (ms *MapService) playerWebhookClient() *http.Client {
+	return &http.Client{
+		Timeout: NotifyTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: NotifyTimeout,
+				Control: webhookDialControl(ms.NotifyAllowed),
+			}).DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,213 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for offline notifications
+//
+
+package mapservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMentionedUsers(t *testing.T) {
+	for text, want := range map[string][]string{
+		"nobody here":                 nil,
+		"@alice, where's @bob.smith?": {"alice", "bob.smith"},
+		"@carol @carol":               {"carol"},
+		"mail me at dave@example.com": nil,
+		"(@erin) and @@frank":         {"erin"},
+	} {
+		if got := MentionedUsers(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("mentions in %q were %q, expected %q", text, got, want)
+		}
+	}
+}
+
+func TestCheckNotifyURL(t *testing.T) {
+	for webhook, ok := range map[string]bool{
+		"https://hooks.example.com/x": true,
+		"http://localhost:8080/":      true,
+		"ftp://example.com/":          false,
+		"mailto:alice@example.com":    false,
+		"https:///nohost":             false,
+	} {
+		if err := CheckNotifyURL(webhook); (err == nil) != ok {
+			t.Errorf("webhook %s: %v", webhook, err)
+		}
+	}
+}
+
+func TestWebhookDialControl(t *testing.T) {
+	allowed, err := ParseNetworks("192.168.1.0/24, 10.1.2.3")
+	if err != nil {
+		t.Fatalf("unable to parse networks: %v", err)
+	}
+	control := webhookDialControl(allowed)
+	for address, ok := range map[string]bool{
+		"127.0.0.1:80":             false,
+		"169.254.169.254:80":       false,
+		"[::1]:443":                false,
+		"[::ffff:127.0.0.1]:80":    false,
+		"[fd00:ec2::254]:80":       false,
+		"0.0.0.0:80":               false,
+		"10.0.0.1:80":              false,
+		"172.16.5.4:80":            false,
+		"192.168.2.1:80":           false,
+		"192.168.1.20:80":          true,
+		"10.1.2.3:80":              true,
+		"93.184.216.34:443":        true,
+		"[2606:2800:220:1::1]:443": true,
+	} {
+		if err := control("tcp", address, nil); (err == nil) != ok {
+			t.Errorf("dialing %s: %v", address, err)
+		}
+	}
+	if _, err = ParseNetworks("10.0.0.0/8,bogus"); err == nil {
+		t.Errorf("bad network list was accepted")
+	}
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("webhook on loopback address was called")
+	}))
+	defer hook.Close()
+	ms := newTestService()
+	if err = postWebhookVia(ms.playerWebhookClient(), hook.URL, Notification{User: "bob"}); err == nil || !strings.Contains(err.Error(), "private address") {
+		t.Errorf("webhook to %s got %v", hook.URL, err)
+	}
+}
+
+func TestNotifyThrottle(t *testing.T) {
+	var n notifyThrottle
+	now := time.Now()
+	if !n.ok("alice", now) || n.ok("alice", now.Add(time.Minute)) || !n.ok("bob", now) || !n.ok("alice", now.Add(NotifyInterval)) {
+		t.Errorf("notifications weren't throttled correctly")
+	}
+}
+
+func TestNotifyAddressed(t *testing.T) {
+	received := make(chan Notification, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("notification not understood: %v", err)
+		}
+		received <- n
+	}))
+	defer hook.Close()
+
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/notify.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	ms.Campaign = "Test"
+	ms.NotifyAllowed, _ = ParseNetworks("127.0.0.1")
+	s := storage.(NotifyStorage)
+	for _, user := range []string{"bob", "carol", "dave"} {
+		if err = s.SetNotifyURL(user, hook.URL+"/"+user); err != nil {
+			t.Fatalf("unable to set webhook: %v", err)
+		}
+	}
+	newTestClient(ms, "dave", "dave", false)
+
+	expect := func(want ...Notification) {
+		t.Helper()
+		for _, w := range want {
+			select {
+			case n := <-received:
+				n.Time = time.Time{}
+				if n != w {
+					t.Errorf("notification was %+v, expected %+v", n, w)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("notification %+v never arrived", w)
+			}
+		}
+		select {
+		case n := <-received:
+			t.Errorf("unexpected notification %+v", n)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	event := &MapEvent{Fields: []string{"TO", "alice", "*", "@bob @dave @erin roll initiative", "1"}}
+	ms.notifyAddressed(event, []string{"*"}, nil)
+	expect()
+
+	ms.NotifyWebhooks = true
+	ms.notifyAddressed(event, []string{"*"}, nil)
+	expect(Notification{Campaign: "Test", User: "bob", From: "alice", Text: "@bob @dave @erin roll initiative"})
+
+	event = &MapEvent{Fields: []string{"TO", "alice", "{bob carol}", "psst @dave", "2"}}
+	ms.notifyAddressed(event, []string{"bob", "carol"}, []string{"bob", "carol"})
+	expect(Notification{Campaign: "Test", User: "carol", From: "alice", Text: "psst @dave", Direct: true, Held: true})
+
+	if err = s.SetNotifyURL("carol", ""); err != nil {
+		t.Fatalf("unable to clear webhook: %v", err)
+	}
+	if _, found, err := s.NotifyURL("carol"); found || err != nil {
+		t.Errorf("carol's webhook wasn't removed: %v", err)
+	}
+}
+
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,228 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Object History                                   //
+//                                                                                    //
+// The changes made to each object on the map, who made them, and when, as remembered //
+// by the journal, so the GM can see (for example) when a condition was applied.      //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// An AttributeChange is one change made to an object's attributes
+// (or its removal from the map).
+//
+type AttributeChange struct {
+	N      int64     `json:"n"`                // position in the journal
+	Time   time.Time `json:"time"`             // when it was made
+	User   string    `json:"user,omitempty"`   // who made it, if we know
+	Action string    `json:"action"`           // set, add, remove, or delete (the object)
+	Attr   string    `json:"attr,omitempty"`   // the attribute changed
+	Value  string    `json:"value,omitempty"`  // its new value (for set)
+	Values []string  `json:"values,omitempty"` // what was added to or removed from it (for add and remove)
+}
+
+//
+// The attributes set by each field of a PS message, from the third on.
+//
+var psAttributes = []string{"COLOR", "NAME", "AREA", "SIZE", "TYPE", "GX", "GY", "REACH"}
+
+//
+// ObjectTimeline returns the changes made to an object which the
+// journal remembers (see Journal.ObjectHistory), oldest first. If any
+// attributes are named, only the changes to those (and the object's
+// removal) are included. Without a journal there is no history.
+//
+func (ms *MapService) ObjectTimeline(id string, attrs ...string) []AttributeChange {
+	if ms.Journal == nil {
+		return nil
+	}
+	wanted := make(map[string]bool)
+	for _, attr := range attrs {
+		wanted[strings.ToUpper(attr)] = true
+	}
+	var timeline []AttributeChange
+	for _, entry := range ms.Journal.ObjectHistory(id) {
+		for _, change := range journalChanges(entry, id) {
+			if len(wanted) == 0 || change.Attr == "" || wanted[strings.ToUpper(change.Attr)] {
+				timeline = append(timeline, change)
+			}
+		}
+	}
+	return timeline
+}
+
+//
+// The changes a journal entry made to the given object. Entries we
+// can't make sense of (which the game state couldn't either) made
+// none.
+//
+func journalChanges(entry JournalEntry, id string) []AttributeChange {
+	var changes []AttributeChange
+	change := func(action, attr, value string, values []string) {
+		changes = append(changes, AttributeChange{
+			N:      entry.N,
+			Time:   entry.Time,
+			User:   entry.User,
+			Action: action,
+			Attr:   attr,
+			Value:  value,
+			Values: values,
+		})
+	}
+
+	if entry.Op == "clear" {
+		change("delete", "", "", nil)
+		return changes
+	}
+	event, err := NewMapEvent(entry.Event, entry.ID, entry.Class)
+	if err != nil {
+		return nil
+	}
+	switch event.EventType() {
+		case "OA":
+			if len(event.Fields) < 3 {
+				return nil
+			}
+			kvlist, err := ParseTclList(event.Fields[2])
+			if err != nil {
+				return nil
+			}
+			for i := 0; i+1 < len(kvlist); i += 2 {
+				change("set", kvlist[i], kvlist[i+1], nil)
+			}
+
+		case "OA+", "OA-":
+			if len(event.Fields) < 4 {
+				return nil
+			}
+			values, err := ParseTclList(event.Fields[3])
+			if err != nil {
+				return nil
+			}
+			if event.EventType() == "OA+" {
+				change("add", event.Fields[2], "", values)
+			} else {
+				change("remove", event.Fields[2], "", values)
+			}
+
+		case "PS":
+			if len(event.Fields) < 2+len(psAttributes) {
+				return nil
+			}
+			for i, attr := range psAttributes {
+				change("set", attr, event.Fields[i+2], nil)
+			}
+
+		case "LS":
+			event.MultiRawData = entry.Extra
+			objects, err := ObjectsFromLoadEvent(event)
+			if err != nil {
+				return nil
+			}
+			obj, ok := objects[id]
+			if !ok {
+				return nil
+			}
+			var names []string
+			for attr := range obj.Attrs {
+				names = append(names, attr)
+			}
+			sort.Strings(names)
+			for _, attr := range names {
+				change("set", attr, obj.Attrs[attr], nil)
+			}
+	}
+	return changes
+}
+
+//
+// GET /api/v1/history/<id>[?attr=<name>[&attr=<name>...]]
+//   {"id": <id>, "changes": [<AttributeChange>, ...]}
+// The changes made to an object which the server remembers (see
+// ObjectTimeline), oldest first, such as who changed its HEALTH and
+// when. Only admin tokens may see the history of objects on the GM's
+// own map layers.
+//
+func (ms *MapService) apiObjectHistory(w http.ResponseWriter, r *http.Request, t APIToken) {
+	if ms.Journal == nil {
+		apiError(w, http.StatusServiceUnavailable, "object history can't be kept without a journal")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/history/")
+	if id == "" {
+		apiError(w, http.StatusBadRequest, "no object ID given")
+		return
+	}
+	if !t.Allows(ScopeAdmin) && ms.isGMObject(id) {
+		apiError(w, http.StatusNotFound, "there is no history for object %s", id)
+		return
+	}
+	changes := ms.ObjectTimeline(id, r.URL.Query()["attr"]...)
+	if changes == nil {
+		changes = []AttributeChange{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "changes": changes})
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,212 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the history of changes to objects
+//
+
+package mapservice
+
+import (
+	"fmt"
+	"testing"
+)
+
+//
+// Summarize a timeline as user:action:attr=value lines for comparison.
+//
+func timelineTestSummary(timeline []AttributeChange) []string {
+	var summary []string
+	for _, change := range timeline {
+		s := fmt.Sprintf("%s:%s:%s=%s", change.User, change.Action, change.Attr, change.Value)
+		if change.Values != nil {
+			s += fmt.Sprintf("%v", change.Values)
+		}
+		summary = append(summary, s)
+	}
+	return summary
+}
+
+func TestObjectTimeline(t *testing.T) {
+	dir := t.TempDir()
+	ms, journal := journalTestService(t, dir)
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "PS abc red Grax 1 M monster 3 4 0"), gm)
+	if err := ms.SaveState(); err != nil {
+		t.Fatalf("unable to save state: %v", err)
+	}
+	ms.ExecuteAction(testEvent(t, "OA @Grax {HEALTH {10 0 0 12 0 0 0 {}} GX 10}"), alice)
+	ms.ExecuteAction(testEvent(t, "OA+ abc STATUSLIST {prone shaken}"), gm)
+	ms.ExecuteAction(testEvent(t, "OA def {GX 1}"), alice)
+	ms.ExecuteAction(testEvent(t, "OA- abc STATUSLIST prone"), alice)
+	ms.State.ClearObjects("abc")
+
+	expected := []string{
+		"GM:set:COLOR=red", "GM:set:NAME=Grax", "GM:set:AREA=1", "GM:set:SIZE=M",
+		"GM:set:TYPE=monster", "GM:set:GX=3", "GM:set:GY=4", "GM:set:REACH=0",
+		"alice:set:HEALTH=10 0 0 12 0 0 0 {}", "alice:set:GX=10",
+		"GM:add:STATUSLIST=[prone shaken]",
+		"alice:remove:STATUSLIST=[prone]",
+		":delete:=",
+	}
+	timeline := ms.ObjectTimeline("abc")
+	if summary := timelineTestSummary(timeline); fmt.Sprint(summary) != fmt.Sprint(expected) {
+		t.Errorf("timeline was %q; expected %q", summary, expected)
+	}
+	for i := 1; i < len(timeline); i++ {
+		if timeline[i].N < timeline[i-1].N || timeline[i].Time.Before(timeline[i-1].Time) || timeline[i].Time.IsZero() {
+			t.Errorf("timeline out of order at %d: %v", i, timeline)
+		}
+	}
+
+	expected = []string{"alice:set:HEALTH=10 0 0 12 0 0 0 {}", ":delete:="}
+	if summary := timelineTestSummary(ms.ObjectTimeline("abc", "health")); fmt.Sprint(summary) != fmt.Sprint(expected) {
+		t.Errorf("HEALTH timeline was %q; expected %q", summary, expected)
+	}
+	if timeline := ms.ObjectTimeline("nothing"); timeline != nil {
+		t.Errorf("timeline for unknown object was %v", timeline)
+	}
+
+	// after a restart, we still know what the journal held
+	journal.Close()
+	ms.Storage.Close()
+	recovered, journal := journalTestService(t, dir)
+	defer recovered.Storage.Close()
+	defer journal.Close()
+	expected = []string{
+		"alice:set:HEALTH=10 0 0 12 0 0 0 {}", "alice:set:GX=10",
+		"GM:add:STATUSLIST=[prone shaken]",
+		"alice:remove:STATUSLIST=[prone]",
+		":delete:=",
+	}
+	if summary := timelineTestSummary(recovered.ObjectTimeline("abc")); fmt.Sprint(summary) != fmt.Sprint(expected) {
+		t.Errorf("recovered timeline was %q; expected %q", summary, expected)
+	}
+}
+
+func TestObjectTimelineLimit(t *testing.T) {
+	journal, err := OpenJournal(t.TempDir() + "/journal")
+	if err != nil {
+		t.Fatalf("unable to open journal: %v", err)
+	}
+	defer journal.Close()
+	ms := &MapService{State: NewGameState(), Journal: journal}
+	ms.State.SetJournal(journal)
+
+	for i := 0; i <= ObjectHistoryLimit; i++ {
+		ms.UpdateState(testEvent(t, fmt.Sprintf("OA abc {GX %d}", i)))
+	}
+	ms.UpdateState(testEvent(t, "CS 12 0"))
+	timeline := ms.ObjectTimeline("abc")
+	if len(timeline) != ObjectHistoryLimit || timeline[0].Value != "1" || timeline[len(timeline)-1].Value != fmt.Sprint(ObjectHistoryLimit) {
+		t.Errorf("timeline has %d changes, from %v", len(timeline), timeline[0])
+	}
+}
+
+func TestObjectHistoryAPI(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/history.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	_, admin, _ := ms.issueAPIToken("gm", ScopeAdmin, 0)
+	_, reader, _ := ms.issueAPIToken("overlay", ScopeReadOnly, 0)
+	gm := newTestClient(ms, "gm", "GM", true)
+
+	if status, reply := apiTestRequest(t, ms, "GET", "/api/v1/history/p1", reader, ""); status != 503 {
+		t.Errorf("GET history without a journal got %d %v", status, reply)
+	}
+	journal, err := OpenJournal(t.TempDir() + "/journal")
+	if err != nil {
+		t.Fatalf("unable to open journal: %v", err)
+	}
+	defer journal.Close()
+	ms.Journal = journal
+	ms.State.SetJournal(journal)
+
+	sendTestLS(t, ms, gm,
+		"P NAME:p1 Fizban", "P GX:p1 3",
+		"M NAME:m1 Assassin", "M LAYER:m1 gm")
+	ms.ExecuteAction(testEvent(t, "OA p1 {HEALTH {10 0 0 12 0 0 0 {}}}"), gm)
+
+	status, reply := apiTestRequest(t, ms, "GET", "/api/v1/history/p1?attr=HEALTH&attr=NAME", reader, "")
+	if status != 200 || reply["id"] != "p1" {
+		t.Fatalf("GET history got %d %v", status, reply)
+	}
+	changes, _ := reply["changes"].([]interface{})
+	if len(changes) != 2 {
+		t.Fatalf("changes were %v", reply["changes"])
+	}
+	if c := changes[0].(map[string]interface{}); c["action"] != "set" || c["attr"] != "NAME" || c["value"] != "Fizban" || c["user"] != "GM" {
+		t.Errorf("first change was %v", c)
+	}
+	if c := changes[1].(map[string]interface{}); c["attr"] != "HEALTH" || c["value"] != "10 0 0 12 0 0 0 {}" || c["time"] == nil {
+		t.Errorf("second change was %v", c)
+	}
+
+	// objects on the GM's layers are kept from everyone else
+	if status, reply := apiTestRequest(t, ms, "GET", "/api/v1/history/m1", reader, ""); status != 404 {
+		t.Errorf("GET history of GM object got %d %v", status, reply)
+	}
+	if status, reply := apiTestRequest(t, ms, "GET", "/api/v1/history/m1", admin, ""); status != 200 || len(reply["changes"].([]interface{})) != 2 {
+		t.Errorf("GET history of GM object as admin got %d %v", status, reply)
+	}
+	if status, reply := apiTestRequest(t, ms, "GET", "/api/v1/history/nothing", reader, ""); status != 200 || len(reply["changes"].([]interface{})) != 0 {
+		t.Errorf("GET history of unknown object got %d %v", status, reply)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
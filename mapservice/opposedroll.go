@@ -0,0 +1,277 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Opposed rolls                                    //
+//                                                                                    //
+// Contests where two users each roll dice and the higher result wins, such as        //
+// grapples and contested skill checks. The server rolls both sides, applies the      //
+// chosen tie-break rule, and announces a single outcome.                             //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// How long we'll wait for the opponent to respond to an opposed
+// roll before forgetting about it.
+//
+const OpposedRollTimeout = 5 * time.Minute
+
+//
+// If the tie-break rule is to reroll, this is how many times we'll
+// try before calling it a tie anyway.
+//
+const OpposedRollMaxRerolls = 10
+
+//
+// Ways to break a tie in an opposed roll.
+//
+const (
+	TieDefender   = "defender"   // the opponent wins ties (default)
+	TieChallenger = "challenger" // the challenger wins ties
+	TieReroll     = "reroll"     // both sides roll again
+	TieNone       = "none"       // ties stand
+)
+
+//
+// OpposedRoll is a contest between two users' die rolls.
+//
+type OpposedRoll struct {
+	ID             string    // identifier chosen by the challenger
+	Challenger     string    // user who started the contest
+	Opponent       string    // user being challenged
+	ChallengerSpec string    // die-roll spec for each side
+	OpponentSpec   string
+	TieBreak       string    // how to break ties (Tie* constants)
+	Limits         DiceLimits // limits on the die rolls
+	Attributes     AttributeSource // where @creature.attr references are looked up
+	Started        time.Time // when the challenge was made
+}
+
+//
+// The outcome of one side of an opposed roll.
+//
+type OpposedRollSide struct {
+	Title  string
+	Result StructuredResult
+}
+
+//
+// The outcome of an opposed roll. Winner is the user name of the
+// winner, or "" if it was a tie.
+//
+type OpposedRollOutcome struct {
+	Challenger OpposedRollSide
+	Opponent   OpposedRollSide
+	Winner     string
+	Rerolls    int
+}
+
+//
+// opposedRollQueue holds the challenges still waiting for the
+// opponent to respond.
+//
+type opposedRollQueue struct {
+	lock    sync.Mutex
+	pending map[string]*OpposedRoll
+}
+
+func opposedRollKey(challenger, id string) string {
+	return challenger + "\x00" + id
+}
+
+//
+// Add a challenge to the queue.
+//
+func (q *opposedRollQueue) add(contest *OpposedRoll) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.expire()
+	if q.pending == nil {
+		q.pending = make(map[string]*OpposedRoll)
+	}
+	q.pending[opposedRollKey(contest.Challenger, contest.ID)] = contest
+}
+
+//
+// If there's a challenge waiting from challenger to opponent with
+// the given ID, remove it from the queue and return it.
+//
+func (q *opposedRollQueue) take(challenger, opponent, id string) *OpposedRoll {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.expire()
+	key := opposedRollKey(challenger, id)
+	if contest, ok := q.pending[key]; ok && contest.Opponent == opponent {
+		delete(q.pending, key)
+		return contest
+	}
+	return nil
+}
+
+//
+// Forget about challenges nobody answered. Call with the lock held.
+//
+func (q *opposedRollQueue) expire() {
+	for key, contest := range q.pending {
+		if time.Since(contest.Started) > OpposedRollTimeout {
+			delete(q.pending, key)
+		}
+	}
+}
+
+//
+// Check that a tie-break rule is one we know about, filling in the
+// default if none was given.
+//
+func checkTieBreak(rule string) (string, error) {
+	switch rule {
+		case "":
+			return TieDefender, nil
+		case TieDefender, TieChallenger, TieReroll, TieNone:
+			return rule, nil
+	}
+	return "", fmt.Errorf("Tie-break rule \"%s\" not understood; must be %s, %s, %s, or %s", rule, TieDefender, TieChallenger, TieReroll, TieNone)
+}
+
+//
+// Roll one side of the contest. If the spec produces more than one
+// result (e.g., a critical confirmation), the first one counts.
+//
+func rollOpposedSide(spec string, limits DiceLimits, attrs AttributeSource) (OpposedRollSide, error) {
+	roller, err := NewDieRoller()
+	if err != nil {
+		return OpposedRollSide{}, err
+	}
+	roller.DiceLimits = limits
+	roller.Attributes = attrs
+	title, results, err := roller.DoRoll(spec)
+	if err != nil {
+		return OpposedRollSide{}, err
+	}
+	if len(results) == 0 {
+		return OpposedRollSide{}, fmt.Errorf("Die roll \"%s\" produced no result", spec)
+	}
+	return OpposedRollSide{Title: title, Result: results[0]}, nil
+}
+
+//
+// Roll both sides of the contest and decide who won.
+//
+func (contest *OpposedRoll) Resolve() (*OpposedRollOutcome, error) {
+	var err error
+	outcome := &OpposedRollOutcome{}
+
+	for {
+		if outcome.Challenger, err = rollOpposedSide(contest.ChallengerSpec, contest.Limits, contest.Attributes); err != nil {
+			return nil, fmt.Errorf("%s's roll: %v", contest.Challenger, err)
+		}
+		if outcome.Opponent, err = rollOpposedSide(contest.OpponentSpec, contest.Limits, contest.Attributes); err != nil {
+			return nil, fmt.Errorf("%s's roll: %v", contest.Opponent, err)
+		}
+		c, o := outcome.Challenger.Result.Result, outcome.Opponent.Result.Result
+		switch {
+			case c > o:
+				outcome.Winner = contest.Challenger
+			case o > c:
+				outcome.Winner = contest.Opponent
+			case contest.TieBreak == TieChallenger:
+				outcome.Winner = contest.Challenger
+			case contest.TieBreak == TieDefender:
+				outcome.Winner = contest.Opponent
+			case contest.TieBreak == TieReroll && outcome.Rerolls < OpposedRollMaxRerolls:
+				outcome.Rerolls++
+				continue
+			default:
+				outcome.Winner = ""
+		}
+		return outcome, nil
+	}
+}
+
+//
+// Build the ORR message announcing the outcome of a contest:
+//   ORR <id> <challenger> <opponent> <winner> <rerolls>
+//       <challenger-title> <challenger-result> <challenger-details>
+//       <opponent-title> <opponent-result> <opponent-details>
+// <winner> is "*" for a tie.
+//
+func (contest *OpposedRoll) OutcomeMessage(outcome *OpposedRollOutcome) ([]string, error) {
+	winner := outcome.Winner
+	if winner == "" {
+		winner = "*"
+	}
+	challenger_details, err := formatRollDetails(outcome.Challenger.Result)
+	if err != nil {
+		return nil, err
+	}
+	opponent_details, err := formatRollDetails(outcome.Opponent.Result)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"ORR", contest.ID, contest.Challenger, contest.Opponent, winner,
+		strconv.Itoa(outcome.Rerolls),
+		outcome.Challenger.Title, strconv.Itoa(outcome.Challenger.Result.Result), challenger_details,
+		outcome.Opponent.Title, strconv.Itoa(outcome.Opponent.Result.Result), opponent_details,
+	}, nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,115 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for opposed rolls
+//
+
+package mapservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOpposedRoll_Resolve(t *testing.T) {
+	for i, test := range []struct {
+		c, o, tiebreak, winner string
+	}{
+		{"d20+5|!", "d20|!", TieDefender, "alice"},
+		{"d20|!", "d20+1|!", TieChallenger, "bob"},
+		{"d20|!", "d20|!", TieDefender, "bob"},
+		{"d20|!", "d20|!", TieChallenger, "alice"},
+		{"d20|!", "d20|!", TieNone, ""},
+		{"d20|!", "d20|!", TieReroll, ""},
+	} {
+		contest := &OpposedRoll{ID: "1", Challenger: "alice", Opponent: "bob", ChallengerSpec: test.c, OpponentSpec: test.o, TieBreak: test.tiebreak}
+		outcome, err := contest.Resolve()
+		if err != nil {
+			t.Fatalf("test #%d error %v", i, err)
+		}
+		if outcome.Winner != test.winner {
+			t.Errorf("test #%d winner %q, expected %q", i, outcome.Winner, test.winner)
+		}
+		if test.tiebreak == TieReroll && outcome.Rerolls != OpposedRollMaxRerolls {
+			t.Errorf("test #%d rerolled %d times, expected %d", i, outcome.Rerolls, OpposedRollMaxRerolls)
+		}
+	}
+
+	contest := &OpposedRoll{ID: "1", Challenger: "alice", Opponent: "bob", ChallengerSpec: "d20", OpponentSpec: "bogus"}
+	if _, err := contest.Resolve(); err == nil {
+		t.Errorf("bad opponent spec was accepted")
+	}
+	if _, err := checkTieBreak("coin-flip"); err == nil {
+		t.Errorf("bad tie-break rule was accepted")
+	}
+}
+
+func TestOpposedRoll_Queue(t *testing.T) {
+	var q opposedRollQueue
+	q.add(&OpposedRoll{ID: "1", Challenger: "alice", Opponent: "bob", Started: time.Now()})
+	q.add(&OpposedRoll{ID: "2", Challenger: "alice", Opponent: "bob", Started: time.Now().Add(-2 * OpposedRollTimeout)})
+	if q.take("alice", "carol", "1") != nil {
+		t.Errorf("took a contest meant for someone else")
+	}
+	if q.take("alice", "bob", "2") != nil {
+		t.Errorf("took an expired contest")
+	}
+	if q.take("alice", "bob", "1") == nil {
+		t.Errorf("couldn't take pending contest")
+	}
+	if q.take("alice", "bob", "1") != nil {
+		t.Errorf("took the same contest twice")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,152 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Message Ordering                                  //
+//                                                                                    //
+// Keeping the messages of each stream--the chat, and the changes to any one object-- //
+// in the same order for every client as in the game state, however many clients      //
+// are sending them at once.                                                          //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"sync"
+)
+
+//
+// ChatStream is the name of the stream all chat messages and die rolls
+// belong to.
+//
+const ChatStream = "chat"
+
+//
+// Each client's messages are sent down a single connection, in the order
+// they are queued for it (whether they go straight into its channel or
+// wait in its backlog), and a client which falls too far behind is
+// dropped rather than skipped over. So a client never misses a message
+// in the middle of a session, and sees each sender's messages in the
+// order they were sent.
+//
+// What that alone doesn't promise is the order between messages sent by
+// different clients at the same moment. Two chat messages could be given
+// their IDs in one order and reach some clients in the other, or two
+// changes to the same object could be recorded in the game state in one
+// order and relayed in the other, leaving clients disagreeing with the
+// server about where the object is. To prevent that, each stream of
+// messages whose order matters is handled one message at a time, from
+// the moment the message is numbered or recorded until it has been
+// queued for every client which gets it:
+//
+//   chat        Every TO, ROLL and CC, in message ID order. A client
+//               which was away can ask for the ones it missed with
+//               SYNC CHAT <id>, giving the last message ID it saw.
+//   object <id> Every change to that object, in the order they were
+//               recorded in the game state (the order given by the
+//               event clock; see EventClock). A client which was away
+//               can ask for what changed with SYNC.
+//
+// Messages from different streams may still pass one another.
+//
+type streamOrder struct {
+	lock    sync.Mutex
+	streams map[string]*orderedStream
+}
+
+type orderedStream struct {
+	sync.Mutex
+	waiting int // goroutines holding or waiting for the stream
+}
+
+//
+// Wait until no other goroutine is handling a message from the given
+// stream, then claim it. Returns the function which gives it back.
+//
+func (o *streamOrder) hold(stream string) func() {
+	o.lock.Lock()
+	if o.streams == nil {
+		o.streams = make(map[string]*orderedStream)
+	}
+	s, ok := o.streams[stream]
+	if !ok {
+		s = &orderedStream{}
+		o.streams[stream] = s
+	}
+	s.waiting++
+	o.lock.Unlock()
+
+	s.Lock()
+	return func() {
+		s.Unlock()
+		o.lock.Lock()
+		if s.waiting--; s.waiting == 0 {
+			delete(o.streams, stream)
+		}
+		o.lock.Unlock()
+	}
+}
+
+//
+// The stream an incoming message belongs to, if it has to be kept in
+// order with others (see streamOrder), or "". Chat messages claim the
+// chat stream for themselves, around giving out their message IDs.
+//
+func orderStream(event *MapEvent, handler MessageHandler) string {
+	if !handler.RecordsEvent || event.ID == "" {
+		return ""
+	}
+	return "object " + event.ID
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,185 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for message ordering
+//
+
+package mapservice
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamOrderHold(t *testing.T) {
+	var o streamOrder
+	release := o.hold(ChatStream)
+
+	other := make(chan struct{})
+	go func() {
+		o.hold("object abc")()
+		close(other)
+	}()
+	select {
+	case <-other:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("holding the chat stream held up an object stream")
+	}
+
+	waiter := make(chan struct{})
+	go func() {
+		o.hold(ChatStream)()
+		close(waiter)
+	}()
+	select {
+	case <-waiter:
+		t.Fatalf("the chat stream was claimed twice at once")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-waiter:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the chat stream wasn't handed on when it was given back")
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.streams) != 0 {
+		t.Errorf("streams still tracked after everyone finished with them: %v", o.streams)
+	}
+}
+
+func TestChatOrdering(t *testing.T) {
+	ms := newTestService()
+	observer := newTestClient(ms, "observer", "olga", false)
+	var senders []*MapClient
+	for i := 0; i < 4; i++ {
+		senders = append(senders, newTestClient(ms, fmt.Sprintf("sender%d", i), fmt.Sprintf("user%d", i), false))
+	}
+
+	var wg sync.WaitGroup
+	for i, sender := range senders {
+		wg.Add(1)
+		go func(i int, sender *MapClient) {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				ms.ExecuteAction(testEvent(t, fmt.Sprintf("TO {} * {message %d from %d} 0", n, i)), sender)
+			}
+		}(i, sender)
+	}
+	wg.Wait()
+
+	sent := sentToTestClient(observer)
+	if len(sent) != 80 {
+		t.Fatalf("observer got %d messages, not 80", len(sent))
+	}
+	last := -1
+	for _, message := range sent {
+		fields, err := ParseTclList(message)
+		if err != nil || len(fields) < 5 || fields[0] != "TO" {
+			t.Fatalf("observer got %q", message)
+		}
+		id, err := strconv.Atoi(fields[4])
+		if err != nil {
+			t.Fatalf("message ID in %q not understood: %v", message, err)
+		}
+		if id <= last {
+			t.Errorf("observer got message %d after %d", id, last)
+		}
+		last = id
+	}
+}
+
+func TestObjectOrdering(t *testing.T) {
+	ms := newTestService()
+	observer := newTestClient(ms, "observer", "olga", false)
+	var gms []*MapClient
+	for i := 0; i < 4; i++ {
+		gms = append(gms, newTestClient(ms, fmt.Sprintf("gm%d", i), "GM", true))
+	}
+
+	var wg sync.WaitGroup
+	for i, gm := range gms {
+		wg.Add(1)
+		go func(i int, gm *MapClient) {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				ms.ExecuteAction(testEvent(t, fmt.Sprintf("PS abc red Grax 1 M monster %d %d 0", i, n)), gm)
+			}
+		}(i, gm)
+	}
+	wg.Wait()
+
+	sent := sentToTestClient(observer)
+	if len(sent) != 80 {
+		t.Fatalf("observer got %d messages, not 80", len(sent))
+	}
+	obj, ok := ms.State.Object("abc")
+	if !ok {
+		t.Fatalf("Grax wasn't recorded in the game state")
+	}
+	recorded := obj.Attrs["GX"] + "," + obj.Attrs["GY"]
+	fields, err := ParseTclList(sent[len(sent)-1])
+	if err != nil || len(fields) < 9 {
+		t.Fatalf("observer's last message was %q", sent[len(sent)-1])
+	}
+	if seen := fields[7] + "," + fields[8]; seen != recorded {
+		t.Errorf("observer last saw Grax at %s, but the game state has %s", seen, recorded)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,309 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Adaptive Pacing                                   //
+//                                                                                    //
+// Feeding bulk data (SYNC, relayed LS) to each client at the rate it can take it,    //
+// judged by how quickly it answers MARCO and empties its queue, so slower machines   //
+// aren't flooded.                                                                    //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"sync"
+	"time"
+)
+
+//
+// Large amounts of data for a client (the game state for SYNC, or map
+// objects relayed with LS) are let into its CommChannel a window of
+// messages at a time, with the rest waiting in its backlog until the
+// client has taken those. The window starts at InitialPaceWindow
+// messages, then grows (up to MaxPaceWindow) while the client keeps up
+// and shrinks (down to MinPaceWindow) when it lags behind.
+//
+const (
+	MinPaceWindow     = 8
+	InitialPaceWindow = 32
+	MaxPaceWindow     = CommChannelBufferSize
+)
+
+//
+// PaceLagThreshold is how long a client may take to answer a MARCO, or
+// to take a window of messages from us, before we consider it to be
+// lagging behind.
+//
+const PaceLagThreshold = 2 * time.Second
+
+//
+// MaxPaceDelay is the longest we'll give a lagging client to catch up
+// before sending it the next window of messages.
+//
+const MaxPaceDelay = 5 * time.Second
+
+//
+// pacer keeps track of how well a client is keeping up with what we
+// send it.
+//
+type pacer struct {
+	lock       sync.Mutex
+	window     int           // how many messages to let into the channel at once
+	rtt        time.Duration // smoothed time from sending MARCO to getting POLO back
+	marcoSent  time.Time     // when our oldest unanswered MARCO was sent (zero if none)
+	probing    bool          // have we put a MARCO in with the data to measure rtt?
+	windowSent time.Time     // when we let the current window into the channel
+	lastWrite  time.Time     // when we last wrote anything to the client
+	bulk       int           // how many bulk transfers are being sent
+}
+
+func (p *pacer) currentWindow() int {
+	if p.window == 0 {
+		return InitialPaceWindow
+	}
+	return p.window
+}
+
+//
+// Note that we're about to write a message to the client. (We note a
+// MARCO before it's written, in case the answer is quicker than we are.)
+//
+func (p *pacer) writing(message string, now time.Time) {
+	if message != "MARCO" {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.marcoSent.IsZero() {
+		p.marcoSent = now
+	}
+}
+
+//
+// Note that we've written a message to the client.
+//
+func (p *pacer) wrote(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.lastWrite = now
+}
+
+//
+// Note that the client has answered our MARCO, and update our idea of
+// its round-trip time (smoothed over recent answers, as TCP does).
+//
+func (p *pacer) gotPolo(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.probing = false
+	if p.marcoSent.IsZero() {
+		return
+	}
+	sample := now.Sub(p.marcoSent)
+	p.marcoSent = time.Time{}
+	if p.rtt == 0 {
+		p.rtt = sample
+	} else {
+		p.rtt = (7*p.rtt + sample) / 8
+	}
+}
+
+//
+// Should a message wait in the backlog rather than go into a channel
+// already holding queued messages? Only while a bulk transfer is being
+// sent and the channel holds a full window.
+//
+func (p *pacer) holding(queued int) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.bulk > 0 && queued >= p.currentWindow()
+}
+
+//
+// Should we put a MARCO in with the next window, to see how long the
+// client takes to get through it? Only if we're not still waiting to
+// hear back from the last one.
+//
+func (p *pacer) probe() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.probing || !p.marcoSent.IsZero() {
+		return false
+	}
+	p.probing = true
+	return true
+}
+
+//
+// The client has taken everything in its channel and there's more in
+// the backlog. Decide how many messages to let through next, based on
+// how long it took over the last window and how long it takes to answer
+// a MARCO. If it's lagging behind, we also return how long to give it
+// to catch up before sending any more; when that's over, call this
+// again with resumed set.
+//
+func (p *pacer) nextWindow(now time.Time, resumed bool) (int, time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.window = p.currentWindow()
+	if !p.windowSent.IsZero() && !resumed {
+		if p.rtt > PaceLagThreshold || now.Sub(p.windowSent) > PaceLagThreshold {
+			if p.window /= 2; p.window < MinPaceWindow {
+				p.window = MinPaceWindow
+			}
+			if p.rtt > PaceLagThreshold {
+				delay := p.rtt
+				if delay > MaxPaceDelay {
+					delay = MaxPaceDelay
+				}
+				return p.window, delay
+			}
+		} else if p.window *= 2; p.window > MaxPaceWindow {
+			p.window = MaxPaceWindow
+		}
+	}
+	p.windowSent = now
+	return p.window, 0
+}
+
+//
+// The backlog is empty again. The window we've arrived at is kept for
+// next time.
+//
+func (p *pacer) drained() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.windowSent = time.Time{}
+}
+
+//
+// Is the client still taking data from us, even if it hasn't answered
+// a MARCO lately?
+//
+func (p *pacer) absorbing(now time.Time, within time.Duration) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return !p.lastWrite.IsZero() && now.Sub(p.lastWrite) <= within
+}
+
+func (p *pacer) stats() (int, time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.currentWindow(), p.rtt
+}
+
+//
+// Start sending a bulk transfer (such as the game state for SYNC) to
+// the client, which will be paced to suit it. Call endBulk when it's
+// all been sent.
+//
+func (c *MapClient) beginBulk() {
+	c.pace.lock.Lock()
+	c.pace.bulk++
+	c.pace.lock.Unlock()
+}
+
+func (c *MapClient) endBulk() {
+	c.pace.lock.Lock()
+	c.pace.bulk--
+	c.pace.lock.Unlock()
+}
+
+//
+// Let the next window of messages from the backlog into the client's
+// channel, which it has emptied. If the client needs time to catch up
+// first, nothing is sent and we return how long to wait before calling
+// this again (with resumed set).
+//
+func (c *MapClient) refillFromBacklog(resumed bool) time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.messageBacklogQueue == nil {
+		return 0
+	}
+	if len(c.messageBacklogQueue) > 0 {
+		window, delay := c.pace.nextWindow(time.Now(), resumed)
+		if delay > 0 {
+			return delay
+		}
+		if c.accepts("MARCO") && c.pace.probe() {
+			c.CommChannel <- "MARCO"
+			window--
+		}
+fill:
+		for ; window > 0 && len(c.messageBacklogQueue) > 0; window-- {
+			select {
+				case c.CommChannel <- c.messageBacklogQueue[0]:
+					if d := debugLog(DebugIO); d != nil {
+						d.Printf("[client %s] unqueue %s", c.logTag(), c.messageBacklogQueue[0])
+					}
+					c.memory.release(int64(len(c.messageBacklogQueue[0])), 0)
+					c.messageBacklogQueue = c.messageBacklogQueue[1:]
+
+				default:
+					// no more will fit, stop here
+					break fill
+			}
+		}
+	}
+	if len(c.messageBacklogQueue) == 0 {
+		c.messageBacklogQueue = nil
+		c.slowReported = false
+		c.pace.drained()
+	}
+	return 0
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
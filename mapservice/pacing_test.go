@@ -0,0 +1,184 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for pacing bulk data to clients
+//
+
+package mapservice
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	var p pacer
+	now := time.Now()
+
+	// a client keeping up gets bigger windows
+	if w, d := p.nextWindow(now, false); w != InitialPaceWindow || d != 0 {
+		t.Errorf("first window %d, delay %v", w, d)
+	}
+	for i := 0; i < 5; i++ {
+		now = now.Add(100 * time.Millisecond)
+		p.nextWindow(now, false)
+	}
+	if w, _ := p.stats(); w != MaxPaceWindow {
+		t.Errorf("window grew to %d", w)
+	}
+
+	// one slow to take a window gets smaller ones
+	now = now.Add(3 * time.Second)
+	if w, d := p.nextWindow(now, false); w != MaxPaceWindow/2 || d != 0 {
+		t.Errorf("window after slow drain %d, delay %v", w, d)
+	}
+
+	// one slow to answer MARCO is given time to catch up as well
+	p.writing("MARCO", now)
+	p.writing("MARCO", now.Add(time.Second))
+	p.gotPolo(now.Add(4 * time.Second))
+	if _, rtt := p.stats(); rtt != 4*time.Second {
+		t.Errorf("round trip %v", rtt)
+	}
+	p.writing("MARCO", now)
+	p.gotPolo(now.Add(12 * time.Second))
+	if _, rtt := p.stats(); rtt != 5*time.Second {
+		t.Errorf("smoothed round trip %v", rtt)
+	}
+	now = now.Add(100 * time.Millisecond)
+	if w, d := p.nextWindow(now, false); w != MaxPaceWindow/4 || d != MaxPaceDelay {
+		t.Errorf("window for lagging client %d, delay %v", w, d)
+	}
+	if w, d := p.nextWindow(now.Add(MaxPaceDelay), true); w != MaxPaceWindow/4 || d != 0 {
+		t.Errorf("window after catching up %d, delay %v", w, d)
+	}
+	for i := 0; i < 10; i++ {
+		now = now.Add(100 * time.Millisecond)
+		p.nextWindow(now, false)
+	}
+	if w, _ := p.stats(); w != MinPaceWindow {
+		t.Errorf("window shrank to %d", w)
+	}
+
+	if p.holding(100) {
+		t.Errorf("held messages outside a bulk transfer")
+	}
+	p.bulk = 1
+	if p.holding(MinPaceWindow-1) || !p.holding(MinPaceWindow) {
+		t.Errorf("held the wrong number of messages")
+	}
+	if !p.probe() || p.probe() {
+		t.Errorf("probe was not sent just once")
+	}
+	p.wrote(now)
+	if !p.absorbing(now, ClientIdleTimeout*time.Second) || p.absorbing(now.Add(time.Hour), ClientIdleTimeout*time.Second) {
+		t.Errorf("absorbing was wrong")
+	}
+}
+
+func TestPacedClientNotDropped(t *testing.T) {
+	ms := newTestService()
+	c := newTestClient(ms, "1.2.3.4:1", "alice", false)
+	for i := 0; i < CommChannelBufferSize; i++ {
+		c.sendToClientChannel("AC x")
+	}
+	// it hasn't answered a MARCO in ages, but it is still taking data
+	c.LastPolo = time.Now().Unix() - ClientIdleTimeout - 1
+	c.pace.wrote(time.Now())
+	c.sendToClientChannel("TO a b c")
+	if c.ReachedEOF || len(c.messageBacklogQueue) != 1 {
+		t.Errorf("client still taking data was dropped")
+	}
+}
+
+func TestPacedSync(t *testing.T) {
+	ms := newTestService()
+	for i := 0; i < 300; i++ {
+		ms.UpdateState(testEvent(t, fmt.Sprintf("CLR obj%03d", i)))
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	c := newTestClient(ms, "pipe", "alice", false)
+	c.Connection = server
+	c.stopSending = make(chan struct{})
+	c.senderDone = make(chan struct{})
+	go c.backgroundSender()
+	defer c.Close()
+
+	ms.Sync(c)
+	if len(c.CommChannel) > InitialPaceWindow {
+		t.Errorf("%d messages were put into the channel at once", len(c.CommChannel))
+	}
+	scanner := bufio.NewScanner(client)
+	var lines []string
+	for len(lines) < 303 && scanner.Scan() {
+		line := scanner.Text()
+		if line == "MARCO" {
+			handlePolo(ms, nil, c)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 303 || lines[0] != "// {DUMP OF CURRENT GAME STATE FOLLOWS}" || lines[1] != "CLR *" || lines[2] != "CLR obj000" ||
+		lines[301] != "CLR obj299" || lines[302] != "// {END OF STATE DUMP}" {
+		t.Errorf("client received %d lines: %v", len(lines), lines)
+	}
+	if w, rtt := c.pace.stats(); w <= InitialPaceWindow || rtt == 0 {
+		t.Errorf("window %d, round trip %v after sync", w, rtt)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,134 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Password Files                                   //
+//                                                                                    //
+// Reading the server's password file, noting any lines we can't make sense of.       //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+//
+// PasswordFile holds the passwords read from the server's password
+// file. The file's first line is the password shared by all players,
+// the second (optional) line is the GM's password, and any further
+// lines are personal passwords for individual players, as
+//   <username>:<password>
+//
+type PasswordFile struct {
+	GroupPassword     []byte            // password shared by all players
+	GmPassword        []byte            // GM's password (nil if none)
+	PersonalPasswords map[string][]byte // passwords for individual players
+	Problems          []string          // lines we couldn't use, with their line numbers
+}
+
+//
+// ReadPasswordFile reads a password file. Lines which can't be
+// understood are skipped and described in Problems.
+//
+func ReadPasswordFile(path string) (PasswordFile, error) {
+	p := PasswordFile{PersonalPasswords: make(map[string][]byte)}
+	fp, err := os.Open(path)
+	if err != nil {
+		return p, err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	for line := 1; scanner.Scan(); line++ {
+		switch line {
+			case 1:
+				p.GroupPassword = []byte(scanner.Text())
+				if len(p.GroupPassword) == 0 {
+					p.Problems = append(p.Problems, fmt.Sprintf("%s:%d: the player password is empty", path, line))
+				}
+
+			case 2:
+				p.GmPassword = []byte(scanner.Text())
+				if len(p.GmPassword) == 0 {
+					p.Problems = append(p.Problems, fmt.Sprintf("%s:%d: the GM password is empty", path, line))
+				}
+
+			default:
+				personal_password := strings.SplitN(scanner.Text(), ":", 2)
+				if len(personal_password) != 2 {
+					p.Problems = append(p.Problems, fmt.Sprintf("%s:%d: personal password setting rejected (missing ':' delimiter)", path, line))
+				} else if personal_password[0] == "" {
+					p.Problems = append(p.Problems, fmt.Sprintf("%s:%d: personal password setting rejected (no username)", path, line))
+				} else {
+					if _, ok := p.PersonalPasswords[personal_password[0]]; ok {
+						p.Problems = append(p.Problems, fmt.Sprintf("%s:%d: personal password for %s replaces an earlier one", path, line, personal_password[0]))
+					}
+					p.PersonalPasswords[personal_password[0]] = []byte(personal_password[1])
+				}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return p, err
+	}
+	if p.GroupPassword == nil {
+		p.Problems = append(p.Problems, fmt.Sprintf("%s: the file is empty", path))
+	}
+	return p, nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
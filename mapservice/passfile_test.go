@@ -0,0 +1,98 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for reading password files
+//
+
+package mapservice
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadPasswordFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "good.pass")
+	writeTestFile(t, path, "hello", "world", "steve:forty-two", "alice:x:y")
+	p, err := ReadPasswordFile(path)
+	if err != nil {
+		t.Fatalf("unable to read password file: %v", err)
+	}
+	if string(p.GroupPassword) != "hello" || string(p.GmPassword) != "world" || len(p.PersonalPasswords) != 2 ||
+		string(p.PersonalPasswords["steve"]) != "forty-two" || string(p.PersonalPasswords["alice"]) != "x:y" || len(p.Problems) != 0 {
+		t.Errorf("read %+v", p)
+	}
+
+	path = filepath.Join(dir, "bad.pass")
+	writeTestFile(t, path, "hello", "world", "steve", "alice:x", ":y", "alice:z")
+	p, err = ReadPasswordFile(path)
+	if err != nil {
+		t.Fatalf("unable to read password file: %v", err)
+	}
+	expected := []string{"bad.pass:3: ", "bad.pass:5: ", "bad.pass:6: "}
+	if len(p.Problems) != len(expected) {
+		t.Fatalf("problems were %q", p.Problems)
+	}
+	for i, problem := range p.Problems {
+		if !strings.Contains(problem, expected[i]) {
+			t.Errorf("problem %q, expected %q", problem, expected[i])
+		}
+	}
+	if string(p.PersonalPasswords["alice"]) != "z" {
+		t.Errorf("alice's password is %q", p.PersonalPasswords["alice"])
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
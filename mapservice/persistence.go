@@ -0,0 +1,305 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                Degraded persistence                                //
+//                                                                                    //
+// Carrying on when the database stops working in the middle of a game: chat messages //
+// and die-roll presets are held in memory until it comes back, then written out in   //
+// the order they arrived, so players aren't told every command failed.              //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//
+// While the database is unavailable, we try it again after
+// PersistenceRetryMin, doubling the wait after each failure up to
+// PersistenceRetryMax.
+//
+const PersistenceRetryMin = time.Second
+const PersistenceRetryMax = time.Minute
+
+//
+// MaxQueuedWrites is how many writes we hold for the database while
+// it is unavailable. Past that, the oldest are dropped.
+//
+const MaxQueuedWrites = 10000
+
+//
+// A write waiting for the database to come back.
+//
+type queuedWrite struct {
+	seq   uint64       // order in which it was queued
+	key   string       // a later write with the same key replaces this one ("" for none)
+	what  string       // what it is, for the log
+	write func() error // do it
+}
+
+type persistenceState struct {
+	lock     sync.Mutex
+	degraded bool          // is the database unavailable?
+	since    time.Time     // when it became unavailable
+	queue    []queuedWrite // writes waiting for it to come back
+	nextSeq  uint64
+	dropped  int // writes we gave up on because the queue was full
+}
+
+//
+// PersistenceStatus says whether the database is working, as reported
+// at /healthz and in the peer list.
+//
+type PersistenceStatus struct {
+	Degraded bool       `json:"degraded"`
+	Since    *time.Time `json:"since,omitempty"`   // when it stopped working
+	Queued   int        `json:"queued"`            // writes waiting to be made
+	Dropped  int        `json:"dropped,omitempty"` // writes lost because too many were waiting
+}
+
+//
+// PersistenceStatus reports whether the database is working.
+//
+func (ms *MapService) PersistenceStatus() PersistenceStatus {
+	p := &ms.persistence
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status := PersistenceStatus{
+		Degraded: p.degraded,
+		Queued:   len(p.queue),
+		Dropped:  p.dropped,
+	}
+	if p.degraded {
+		since := p.since
+		status.Since = &since
+	}
+	return status
+}
+
+//
+// Make a write to the database. If it fails, the database is marked as
+// unavailable and the write is held until it comes back. While it is
+// unavailable, new writes are queued behind the ones already waiting
+// rather than being tried out of order.
+//
+// If key isn't empty, a later write with the same key replaces this
+// one in the queue (say, when each write saves a user's whole list of
+// presets, only the last one matters).
+//
+func (ms *MapService) persist(key, what string, write func() error) {
+	p := &ms.persistence
+	p.lock.Lock()
+	if !p.degraded {
+		p.lock.Unlock()
+		err := write()
+		if err == nil {
+			return
+		}
+		p.lock.Lock()
+		if !p.degraded {
+			p.degraded = true
+			p.since = time.Now()
+			p.dropped = 0
+			log.Printf("WARNING: the database is unavailable (%v); holding changes in memory until it comes back", err)
+			go ms.retryPersistence()
+			defer ms.announcePersistence()
+		}
+	}
+	p.enqueue(key, what, write)
+	p.lock.Unlock()
+}
+
+//
+// Add a write to the queue. The lock must be held.
+//
+func (p *persistenceState) enqueue(key, what string, write func() error) {
+	p.nextSeq++
+	w := queuedWrite{seq: p.nextSeq, key: key, what: what, write: write}
+	if key != "" {
+		for i := range p.queue {
+			if p.queue[i].key == key {
+				p.queue[i] = w
+				return
+			}
+		}
+	}
+	if len(p.queue) >= MaxQueuedWrites {
+		log.Printf("WARNING: too many changes are waiting for the database; dropping %s", p.queue[0].what)
+		p.queue = p.queue[1:]
+		p.dropped++
+	}
+	p.queue = append(p.queue, w)
+}
+
+//
+// Try the queued writes again, waiting longer after each failure,
+// until they have all been made.
+//
+func (ms *MapService) retryPersistence() {
+	defer ms.ReportCrash()
+	defer ms.goroutines.track("database", "retry writes")()
+	delay := PersistenceRetryMin
+	for {
+		time.Sleep(delay)
+		if ms.replayWrites() {
+			ms.announcePersistence()
+			return
+		}
+		if delay *= 2; delay > PersistenceRetryMax {
+			delay = PersistenceRetryMax
+		}
+	}
+}
+
+//
+// Make the queued writes in order, stopping at the first one which
+// fails. Returns true (and marks the database as working again) once
+// they have all been made.
+//
+// We don't hold the lock while writing, so clients aren't kept waiting
+// on a database which is slow to fail; a write which was replaced while
+// we were making it is left in the queue to be made again.
+//
+func (ms *MapService) replayWrites() bool {
+	p := &ms.persistence
+	written := 0
+	for {
+		p.lock.Lock()
+		if len(p.queue) == 0 {
+			if p.degraded {
+				log.Printf("The database is available again after %v; %d held changes were saved",
+					time.Since(p.since).Round(time.Second), written)
+				if p.dropped > 0 {
+					log.Printf("WARNING: %d changes were lost while the database was unavailable", p.dropped)
+				}
+			}
+			p.degraded = false
+			p.lock.Unlock()
+			return true
+		}
+		w := p.queue[0]
+		p.lock.Unlock()
+
+		if err := w.write(); err != nil {
+			log.Printf("The database is still unavailable (%v); %s is still waiting", err, w.what)
+			return false
+		}
+		written++
+
+		p.lock.Lock()
+		if len(p.queue) > 0 && p.queue[0].seq == w.seq {
+			p.queue = p.queue[1:]
+		}
+		p.lock.Unlock()
+	}
+}
+
+//
+// Let the connected clients know the database has stopped or started
+// working by sending them the peer list again.
+//
+func (ms *MapService) announcePersistence() {
+	for _, peer := range ms.AllClients() {
+		if peer.Authenticated {
+			peer.ConnResponse()
+		}
+	}
+}
+
+//
+// The notice we put at the top of the peer list while the database is
+// unavailable ("" if it isn't).
+//
+func (ms *MapService) persistenceNotice() string {
+	status := ms.PersistenceStatus()
+	if !status.Degraded {
+		return ""
+	}
+	return fmt.Sprintf("database unavailable since %s; %d changes waiting to be saved",
+		status.Since.Format(time.RFC3339), status.Queued)
+}
+
+//
+// GET /healthz
+// Whether the server is up and its database is working (no token is
+// needed to see it). The server still answers 200 while the database
+// is unavailable, since the game carries on; the status says
+// "degraded" instead of "ok".
+//
+func (ms *MapService) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	status := ms.PersistenceStatus()
+	health := "ok"
+	if status.Degraded {
+		health = "degraded"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      health,
+		"persistence": status,
+	})
+}
+
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,158 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for carrying on while the database is unavailable
+//
+
+package mapservice
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//
+// A database which we can make stop working.
+//
+type flakyStorage struct {
+	*SQLiteStorage
+	lock sync.Mutex
+	down bool
+}
+
+func (s *flakyStorage) setDown(down bool) {
+	s.lock.Lock()
+	s.down = down
+	s.lock.Unlock()
+}
+
+func (s *flakyStorage) check() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.down {
+		return errors.New("database is locked")
+	}
+	return nil
+}
+
+func (s *flakyStorage) AddChatMessage(event *MapEvent) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.SQLiteStorage.AddChatMessage(event)
+}
+
+func (s *flakyStorage) UpdateDicePresets(user string, presets []DicePreset) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.SQLiteStorage.UpdateDicePresets(user, presets)
+}
+
+func TestPersistenceDegraded(t *testing.T) {
+	backend, err := OpenStorageBackend("sqlite", t.TempDir()+"/flaky.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer backend.Close()
+	storage := &flakyStorage{SQLiteStorage: backend.(*SQLiteStorage)}
+	ms := newTestService()
+	ms.Storage = storage
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	if status, reply := apiTestRequest(t, ms, "GET", "/healthz", "", ""); status != 200 || reply["status"] != "ok" {
+		t.Errorf("healthy server reported %d %v", status, reply)
+	}
+
+	storage.setDown(true)
+	ms.addChatMessage(&MapEvent{Fields: []string{"TO", "alice", "*", "hello", ""}})
+	ms.storeDicePresets("alice", []DicePreset{{Name: "a", RollSpec: "d20"}})
+	ms.storeDicePresets("alice", []DicePreset{{Name: "b", RollSpec: "d12"}})
+	ms.addChatMessage(&MapEvent{Fields: []string{"TO", "alice", "*", "still there?", ""}})
+
+	status := ms.PersistenceStatus()
+	if !status.Degraded || status.Queued != 3 {
+		t.Errorf("after failed writes, status is %+v", status)
+	}
+	if status, reply := apiTestRequest(t, ms, "GET", "/healthz", "", ""); status != 200 || reply["status"] != "degraded" {
+		t.Errorf("degraded server reported %d %v", status, reply)
+	}
+	sentToTestClient(alice)
+	alice.ConnResponse()
+	if sent := sentToTestClient(alice); len(sent) == 0 || !strings.HasPrefix(sent[0], "// {database unavailable since ") {
+		t.Errorf("peer list while degraded was %q", sent)
+	}
+	if ms.replayWrites() {
+		t.Errorf("replayed writes while the database was still down")
+	}
+
+	storage.setDown(false)
+	if !ms.replayWrites() {
+		t.Fatalf("unable to replay writes once the database came back")
+	}
+	if status := ms.PersistenceStatus(); status.Degraded || status.Queued != 0 {
+		t.Errorf("after the database came back, status is %+v", status)
+	}
+	messages, err := storage.ChatMessagesAfter(0, 10)
+	if err != nil || len(messages) != 2 || messages[0].Fields[3] != "hello" || messages[1].Fields[3] != "still there?" {
+		t.Errorf("chat messages saved were %v, %v", messages, err)
+	}
+	presets, err := storage.LoadDicePresets()
+	if err != nil || len(presets["alice"]) != 1 || presets["alice"][0].Name != "b" {
+		t.Errorf("presets saved were %v, %v", presets, err)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,363 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                       Polls                                        //
+//                                                                                    //
+// Quick questions put to everyone at the table ("Long rest or press on?"). Each      //
+// user votes privately, and may change their mind until the poll closes, either      //
+// when its time is up or when whoever opened it closes it early. The tallies are     //
+// then announced to everyone and kept in the chat history for the record.            //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// DefaultPollTimeout is how long a poll stays open if whoever opened
+// it doesn't say.
+//
+const DefaultPollTimeout = 5 * time.Minute
+
+//
+// MaxPollTimeout is the longest a poll may stay open.
+//
+const MaxPollTimeout = 24 * time.Hour
+
+//
+// MaxPollOptions is the most choices a poll may offer.
+//
+const MaxPollOptions = 20
+
+//
+// A Poll is a question put to everyone, with the choices they may
+// vote for.
+//
+type Poll struct {
+	ID       string
+	Question string
+	Options  []string
+	OpenedBy string
+	Closes   time.Time
+	votes    map[string]int // option each user voted for, by user name
+}
+
+//
+// PollTally is how many votes one of a poll's options received.
+//
+type PollTally struct {
+	Option string
+	Votes  int
+}
+
+//
+// Tally counts the votes for each option, in the order the options
+// were given.
+//
+func (p *Poll) Tally() []PollTally {
+	tally := make([]PollTally, len(p.Options))
+	for i, option := range p.Options {
+		tally[i].Option = option
+	}
+	for _, choice := range p.votes {
+		tally[choice].Votes++
+	}
+	return tally
+}
+
+//
+// Find the option a vote is for, given as the option itself (ignoring
+// case) or its number (counting from 1).
+//
+func (p *Poll) option(vote string) (int, bool) {
+	for i, option := range p.Options {
+		if strings.EqualFold(option, vote) {
+			return i, true
+		}
+	}
+	if n, err := strconv.Atoi(vote); err == nil && n >= 1 && n <= len(p.Options) {
+		return n - 1, true
+	}
+	return 0, false
+}
+
+//
+// OpenMessage returns the POLL+ message which puts the poll to a client:
+//   POLL+ <id> <question> <options> <opened-by> <closes>
+// where <closes> is when it will close, in seconds since the epoch.
+//
+func (p *Poll) OpenMessage() ([]string, error) {
+	options, err := ToTclString(p.Options)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"POLL+", p.ID, p.Question, options, p.OpenedBy, strconv.FormatInt(p.Closes.Unix(), 10)}, nil
+}
+
+//
+// ResultMessage returns the POLL. message announcing how a poll came out:
+//   POLL. <id> <question> <tally> <voters>
+// where <tally> lists each option followed by the number of votes for
+// it (<option> <votes> <option> <votes> ...), in the order the options
+// were given.
+//
+func (p *Poll) ResultMessage() ([]string, error) {
+	var tally []string
+	for _, t := range p.Tally() {
+		tally = append(tally, t.Option, strconv.Itoa(t.Votes))
+	}
+	list, err := ToTclString(tally)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"POLL.", p.ID, p.Question, list, strconv.Itoa(len(p.votes))}, nil
+}
+
+//
+// Summary describes how a poll came out, for the chat history.
+//
+func (p *Poll) Summary() string {
+	var tally []string
+	for _, t := range p.Tally() {
+		tally = append(tally, fmt.Sprintf("%s: %d", t.Option, t.Votes))
+	}
+	return fmt.Sprintf("Poll closed: %s (%s; %d voter%s)", p.Question, strings.Join(tally, ", "), len(p.votes), plural(len(p.votes)))
+}
+
+//
+// pollList holds the polls which are open, by ID.
+//
+type pollList struct {
+	lock  sync.Mutex
+	polls map[string]*Poll
+}
+
+//
+// Open a poll, unless one with the same ID is already open.
+//
+func (l *pollList) open(p *Poll) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.polls[p.ID]; ok {
+		return fmt.Errorf("There is already a poll %s open", p.ID)
+	}
+	if l.polls == nil {
+		l.polls = make(map[string]*Poll)
+	}
+	l.polls[p.ID] = p
+	return nil
+}
+
+//
+// Record a user's vote (replacing any they already made), returning
+// the option they voted for.
+//
+func (l *pollList) vote(id, user, vote string) (string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	p, ok := l.polls[id]
+	if !ok {
+		return "", fmt.Errorf("There is no poll %s open", id)
+	}
+	choice, ok := p.option(vote)
+	if !ok {
+		return "", fmt.Errorf("\"%s\" isn't one of the choices", vote)
+	}
+	p.votes[user] = choice
+	return p.Options[choice], nil
+}
+
+//
+// Close a poll, returning it (or nil if it wasn't open). If p isn't
+// nil, only that poll is closed, not another opened since with the
+// same ID.
+//
+func (l *pollList) close(id string, p *Poll) *Poll {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	open, ok := l.polls[id]
+	if !ok || (p != nil && open != p) {
+		return nil
+	}
+	delete(l.polls, id)
+	return open
+}
+
+func (l *pollList) get(id string) (*Poll, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	p, ok := l.polls[id]
+	return p, ok
+}
+
+//
+// The open polls, sorted by ID.
+//
+func (l *pollList) all() []*Poll {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var polls []*Poll
+	for _, p := range l.polls {
+		polls = append(polls, p)
+	}
+	sort.Slice(polls, func(i, j int) bool { return polls[i].ID < polls[j].ID })
+	return polls
+}
+
+//
+// Send a message about a poll to everyone.
+//
+func (ms *MapService) sendPollMessage(message []string) {
+	for _, peer := range ms.Clients.Subscribers(message[0]) {
+		if peer.Authenticated && !peer.WriteOnly {
+			peer.Send(message...)
+		}
+	}
+}
+
+//
+// OpenPoll puts a question to everyone, closing it after the timeout
+// (or DefaultPollTimeout if that's 0).
+//
+func (ms *MapService) OpenPoll(id, question string, options []string, timeout time.Duration, by string) (*Poll, error) {
+	if id == "" || question == "" {
+		return nil, fmt.Errorf("Polls need an ID and a question")
+	}
+	if len(options) < 2 || len(options) > MaxPollOptions {
+		return nil, fmt.Errorf("Polls must offer from 2 to %d choices", MaxPollOptions)
+	}
+	for i, option := range options {
+		if option == "" {
+			return nil, fmt.Errorf("Poll choices may not be empty")
+		}
+		for _, other := range options[:i] {
+			if strings.EqualFold(option, other) {
+				return nil, fmt.Errorf("Poll choice \"%s\" is given twice", option)
+			}
+		}
+	}
+	if timeout == 0 {
+		timeout = DefaultPollTimeout
+	}
+	if timeout < 0 || timeout > MaxPollTimeout {
+		return nil, fmt.Errorf("Polls may stay open for no more than %v", MaxPollTimeout)
+	}
+	p := &Poll{
+		ID:       id,
+		Question: question,
+		Options:  options,
+		OpenedBy: by,
+		Closes:   time.Now().Add(timeout),
+		votes:    make(map[string]int),
+	}
+	message, err := p.OpenMessage()
+	if err != nil {
+		return nil, err
+	}
+	if err = ms.polls.open(p); err != nil {
+		return nil, err
+	}
+	// if it was closed early, this finds nothing to close
+	time.AfterFunc(timeout, func() { ms.closePoll(id, p) })
+	ms.sendPollMessage(message)
+	return p, nil
+}
+
+//
+// ClosePoll closes the poll with the given ID, returning false if there
+// wasn't one open. Everyone is told how it came out, and the result is
+// added to the chat history from whoever opened it.
+//
+func (ms *MapService) ClosePoll(id string) bool {
+	return ms.closePoll(id, nil) != nil
+}
+
+func (ms *MapService) closePoll(id string, only *Poll) *Poll {
+	p := ms.polls.close(id, only)
+	if p == nil {
+		return nil
+	}
+	message, err := p.ResultMessage()
+	if err != nil {
+		log.Printf("Unable to announce result of poll %s: %v", p.ID, err)
+		return p
+	}
+	ms.sendPollMessage(message)
+	if _, err = ms.postChat(p.OpenedBy, []string{"*"}, p.Summary()); err != nil {
+		log.Printf("Unable to record result of poll %s in the chat history: %v", p.ID, err)
+	}
+	log.Printf("Poll %s closed (%d voter%s)", p.ID, len(p.votes), plural(len(p.votes)))
+	return p
+}
+
+//
+// Show a client the polls which are open, so it may vote in them.
+//
+func (ms *MapService) sendOpenPolls(thisClient *MapClient) {
+	for _, p := range ms.polls.all() {
+		if message, err := p.OpenMessage(); err == nil {
+			thisClient.Send(message...)
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,199 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for polls
+//
+
+package mapservice
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPollCommands(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	bob := newTestClient(ms, "bob", "bob", false)
+
+	ms.ExecuteAction(testEvent(t, "POLL p1 {Rest?} {yes no}"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.Contains(sent[0], "only the GM may open polls") {
+		t.Errorf("player opening a poll was sent %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "POLL p1 {Long rest or press on?} {{Long rest} {Press on}}"), gm)
+	for _, c := range []*MapClient{gm, alice, bob} {
+		sent := sentToTestClient(c)
+		if len(sent) != 1 || !strings.HasPrefix(sent[0], "POLL+ p1 {Long rest or press on?} {{Long rest} {Press on}} GM ") {
+			t.Errorf("%s was sent %q when poll opened", c.Username(), sent)
+		}
+	}
+	ms.ExecuteAction(testEvent(t, "POLL p1 {Again?} {yes no}"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "already a poll p1") {
+		t.Errorf("GM was sent %q when reusing a poll ID", sent)
+	}
+
+	// votes are private, and may be changed
+	ms.ExecuteAction(testEvent(t, "VOTE p1 {press on}"), alice)
+	ms.ExecuteAction(testEvent(t, "VOTE p1 1"), alice)
+	ms.ExecuteAction(testEvent(t, "VOTE p1 2"), bob)
+	ms.ExecuteAction(testEvent(t, "VOTE p1 {Long rest}"), gm)
+	if sent := sentToTestClient(alice); strings.Join(sent, "\n") != "VOTE+ p1 {Press on}\nVOTE+ p1 {Long rest}" {
+		t.Errorf("alice was sent %q when voting", sent)
+	}
+	if sent := sentToTestClient(bob); strings.Join(sent, "\n") != "VOTE+ p1 {Press on}" {
+		t.Errorf("bob was sent %q when voting", sent)
+	}
+	sentToTestClient(gm)
+	ms.ExecuteAction(testEvent(t, "VOTE p1 maybe"), bob)
+	ms.ExecuteAction(testEvent(t, "VOTE p2 yes"), bob)
+	if sent := sentToTestClient(bob); len(sent) != 2 || sent[0] != "VOTE- p1 {\"maybe\" isn't one of the choices}" || sent[1] != "VOTE- p2 {There is no poll p2 open}" {
+		t.Errorf("bob was sent %q for bad votes", sent)
+	}
+
+	// only the GM or whoever opened it may close it
+	ms.ExecuteAction(testEvent(t, "POLL- p1"), bob)
+	if sent := sentToTestClient(bob); len(sent) != 1 || !strings.Contains(sent[0], "only the GM or GM may close poll p1") {
+		t.Errorf("bob was sent %q when closing the poll", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "POLL- p1"), gm)
+	for _, c := range []*MapClient{gm, alice, bob} {
+		sent := sentToTestClient(c)
+		if len(sent) != 2 || sent[0] != "POLL. p1 {Long rest or press on?} {{Long rest} 2 {Press on} 1} 3" || !strings.HasPrefix(sent[1], "TO GM * {Poll closed: Long rest or press on? (Long rest: 2, Press on: 1; 3 voters)} ") {
+			t.Errorf("%s was sent %q when poll closed", c.Username(), sent)
+		}
+	}
+	chat, err := ms.State.ChatMessages("")
+	if err != nil || len(chat) != 1 || !strings.HasPrefix(chat[0].Fields[3], "Poll closed: ") {
+		t.Errorf("chat history is %v, %v", chat, err)
+	}
+	ms.ExecuteAction(testEvent(t, "POLL- p1"), gm)
+	ms.ExecuteAction(testEvent(t, "VOTE p1 1"), alice)
+	if sent := sentToTestClient(gm); len(sent) != 1 || sent[0] != "// {There is no poll p1 open.}" {
+		t.Errorf("GM was sent %q closing a closed poll", sent)
+	}
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "VOTE- p1 ") {
+		t.Errorf("alice was sent %q voting in a closed poll", sent)
+	}
+
+	for _, bad := range []string{
+		"POLL p2 {Rest?} {yes}",
+		"POLL p2 {Rest?} {yes Yes}",
+		"POLL p2 {Rest?} {yes no} soon",
+		"POLL p2 {Rest?} {yes no} 48h",
+	} {
+		ms.ExecuteAction(testEvent(t, bad), gm)
+		if sent := sentToTestClient(gm); len(sent) != 1 || !strings.Contains(sent[0], "poll") {
+			t.Errorf("%s gave %q", bad, sent)
+		}
+	}
+	if polls := ms.polls.all(); len(polls) != 0 {
+		t.Errorf("bad polls were opened: %v", polls)
+	}
+}
+
+func TestPollsByPlayers(t *testing.T) {
+	ms := newTestService()
+	ms.PlayerPolls = true
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "POLL p1 {Pizza?} {yes no}"), alice)
+	if sent := sentToTestClient(gm); len(sent) != 1 || !strings.HasPrefix(sent[0], "POLL+ p1 Pizza? {yes no} alice ") {
+		t.Errorf("GM was sent %q when alice opened a poll", sent)
+	}
+
+	// latecomers are shown the polls still open
+	bob := newTestClient(ms, "bob", "bob", false)
+	ms.sendPostAuthPreamble(bob, true)
+	if sent := strings.Join(sentToTestClient(bob), "\n"); !strings.Contains(sent, "POLL+ p1 Pizza? {yes no} alice ") {
+		t.Errorf("bob was greeted with %q", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "POLL- p1"), alice)
+	if sent := sentToTestClient(bob); len(sent) != 2 || sent[0] != "POLL. p1 Pizza? {yes 0 no 0} 0" {
+		t.Errorf("bob was sent %q when alice closed her poll", sent)
+	}
+}
+
+func TestPollTimeout(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "POLL p1 {Rest?} {yes no} 20ms"), gm)
+	ms.ExecuteAction(testEvent(t, "VOTE p1 yes"), alice)
+	sentToTestClient(alice)
+	time.Sleep(200 * time.Millisecond)
+	if sent := sentToTestClient(alice); len(sent) != 2 || sent[0] != "POLL. p1 Rest? {yes 1 no 0} 1" {
+		t.Errorf("alice was sent %q when the poll timed out", sent)
+	}
+
+	// a poll closed early is left alone when its time is up
+	p, err := ms.OpenPoll("p2", "Rest?", []string{"yes", "no"}, 50*time.Millisecond, "GM")
+	if err != nil {
+		t.Fatalf("unable to open poll: %v", err)
+	}
+	ms.ClosePoll("p2")
+	if _, err = ms.OpenPoll("p2", "Fight?", []string{"yes", "no"}, time.Minute, "GM"); err != nil {
+		t.Fatalf("unable to reopen poll: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if open, ok := ms.polls.get("p2"); !ok || open == p || open.Question != "Fight?" {
+		t.Errorf("poll p2 is now %v, %v", open, ok)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,118 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                 Generated Preamble                                 //
+//                                                                                    //
+// The part of each client's greeting which is generated from the current game state  //
+// instead of being read from the init file.                                          //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"sort"
+)
+
+//
+// StatusMarkers returns the DSM events which define the status markers
+// the GM has set up, sorted by condition name.
+//
+func (gs *GameState) StatusMarkers() []*MapEvent {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	var markers []*MapEvent
+	for _, event := range gs.EventHistory {
+		if event.EventType() == "DSM" {
+			markers = append(markers, event)
+		}
+	}
+	sort.Slice(markers, func(i, j int) bool { return markers[i].Key < markers[j].Key })
+	return markers
+}
+
+//
+// Send a newly-authenticated client the parts of its greeting which
+// depend on what's going on in the game right now, rather than what's
+// in the init file: the status markers, game clock, initiative list,
+// and so on. If the client is about to be sent the whole game state
+// anyway, we leave out what that will include. Last of all, we
+// deliver any private messages held for the player while they were
+// away.
+//
+func (ms *MapService) sendPostAuthPreamble(thisClient *MapClient, syncing bool) {
+	if !syncing {
+		for _, event := range ms.State.StatusMarkers() {
+			thisClient.Send(event.Fields...)
+		}
+		for _, key := range []string{"CS", "IL"} {
+			if fields, ok := ms.State.RecordedEvent(key); ok {
+				thisClient.Send(fields...)
+			}
+		}
+	}
+	thisClient.sendServerTime()
+	ms.sendCapabilities(thisClient)
+	ms.sendGridSettings(thisClient)
+	ms.sendAmbientEffects(thisClient)
+	ms.sendRecentMarks(thisClient)
+	ms.sendRegions(thisClient)
+	ms.sendLights(thisClient)
+	ms.sendOpenPolls(thisClient)
+	ms.sendFollowMode(thisClient)
+	ms.deliverDeadLetters(thisClient)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,103 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the generated preamble
+//
+
+package mapservice
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPostAuthPreamble(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "DSM stunned |v red"), gm)
+	ms.ExecuteAction(testEvent(t, "DSM bleeding / red"), gm)
+	ms.ExecuteAction(testEvent(t, "DSM stunned |v yellow"), gm)
+	ms.ExecuteAction(testEvent(t, "FM 1"), gm)
+	ms.ExecuteAction(testEvent(t, "CS 100 0"), gm)
+	ms.ExecuteAction(testEvent(t, "IL {{0 Grax 0 0 1}}"), gm)
+	ms.ExecuteAction(testEvent(t, "CS 160 6"), gm)
+	sentIgnoringTime(alice)
+
+	ms.sendPostAuthPreamble(alice, false)
+	expected := []string{
+		"DSM bleeding / red",
+		"DSM stunned |v yellow",
+		"CS 160 6",
+		"IL {{0 Grax 0 0 1}}",
+		"GRID square 5ft 0 0",
+		"FX 0 0 0",
+		"FM 1",
+	}
+	sent, caps := withoutCapabilities(sentIgnoringTime(alice))
+	if !reflect.DeepEqual(sent, expected) {
+		t.Errorf("alice was sent %q, expected %q", sent, expected)
+	}
+	if len(caps) != len(ms.Capabilities())+2 {
+		t.Errorf("alice was told the server's capabilities as %q", caps)
+	}
+
+	ms.sendPostAuthPreamble(alice, true)
+	if sent, _ := withoutCapabilities(sentIgnoringTime(alice)); !reflect.DeepEqual(sent, expected[4:]) {
+		t.Errorf("alice was sent %q when syncing, expected %q", sent, expected[4:])
+	}
+}
+
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
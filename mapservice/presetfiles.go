@@ -0,0 +1,317 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                               Die-roll preset files                                //
+//                                                                                    //
+// Exporting a user's die-roll presets to a JSON or CSV file and importing them back, //
+// so players can back up their presets and share collections of them.               //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// Formats of die-roll preset files.
+//
+const (
+	PresetFormatJSON = "json" // a list of objects with name, description, and rollspec
+	PresetFormatCSV  = "csv"  // a name,description,rollspec,folder,sort_order header and one preset per row
+)
+
+//
+// What to do with the presets a user already has when importing more.
+//
+const (
+	PresetImportMerge   = "merge"   // keep them, replacing any with the same name as an imported one
+	PresetImportReplace = "replace" // throw them all out
+)
+
+//
+// How a die-roll preset looks in a JSON file.
+//
+type presetRecord struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	RollSpec    string `json:"rollspec"`
+	Folder      string `json:"folder,omitempty"`
+	SortOrder   int    `json:"sort_order,omitempty"`
+}
+
+var presetCSVHeader = []string{"name", "description", "rollspec", "folder", "sort_order"}
+
+//
+// Files written before presets had folders and sort orders don't have
+// those columns.
+//
+const presetCSVOldColumns = 3
+
+//
+// A PresetRowError says what was wrong with one row of an imported
+// file: a record of a CSV file (counting the header as row 1), or an
+// element of a JSON list (counting from 1).
+//
+type PresetRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+//
+// ExportDicePresets writes the presets to w in the given format.
+//
+func ExportDicePresets(w io.Writer, format string, presets []DicePreset) error {
+	switch format {
+		case PresetFormatJSON:
+			records := make([]presetRecord, 0, len(presets))
+			for _, p := range presets {
+				records = append(records, presetRecord{Name: p.Name, Description: p.Description, RollSpec: p.RollSpec, Folder: p.Folder, SortOrder: p.SortOrder})
+			}
+			// all on one line, so it can be sent as a single DX: message
+			return json.NewEncoder(w).Encode(records)
+
+		case PresetFormatCSV:
+			out := csv.NewWriter(w)
+			out.Write(presetCSVHeader)
+			for _, p := range presets {
+				out.Write([]string{p.Name, p.Description, p.RollSpec, p.Folder, strconv.Itoa(p.SortOrder)})
+			}
+			out.Flush()
+			return out.Error()
+	}
+	return fmt.Errorf("unknown preset file format \"%s\" (use %s or %s)", format, PresetFormatJSON, PresetFormatCSV)
+}
+
+//
+// ImportDicePresets reads presets from a file in the given format,
+// checking each one. Each preset must have a name which no other in the
+// file has, no line breaks (since they couldn't be sent in a DD: message),
+// and a die-roll spec we could roll within the limits given.
+// If any rows are wrong, they are all reported and no presets are
+// returned. An error is returned if the file can't be read at all.
+//
+func ImportDicePresets(r io.Reader, format string, limits DiceLimits) ([]DicePreset, []PresetRowError, error) {
+	var presets []DicePreset
+	var rows []int
+	var problems []PresetRowError
+
+	switch format {
+		case PresetFormatJSON:
+			var elements []json.RawMessage
+			if err := json.NewDecoder(r).Decode(&elements); err != nil {
+				return nil, nil, fmt.Errorf("preset file is not a JSON list: %v", err)
+			}
+			for i, element := range elements {
+				var record presetRecord
+				decoder := json.NewDecoder(bytes.NewReader(element))
+				decoder.DisallowUnknownFields()
+				if err := decoder.Decode(&record); err != nil {
+					problems = append(problems, PresetRowError{Row: i + 1, Error: err.Error()})
+					continue
+				}
+				presets = append(presets, DicePreset{Name: record.Name, Description: record.Description, RollSpec: record.RollSpec, Folder: record.Folder, SortOrder: record.SortOrder})
+				rows = append(rows, i+1)
+			}
+
+		case PresetFormatCSV:
+			in := csv.NewReader(r)
+			in.FieldsPerRecord = -1
+			header, err := in.Read()
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to read preset file header: %v", err)
+			}
+			for i := range header {
+				header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+			}
+			if strings.Join(header, ",") != strings.Join(presetCSVHeader, ",") &&
+				strings.Join(header, ",") != strings.Join(presetCSVHeader[:presetCSVOldColumns], ",") {
+				return nil, nil, fmt.Errorf("preset file header must be %s", strings.Join(presetCSVHeader, ","))
+			}
+			for line := 2; ; line++ {
+				record, err := in.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					if _, ok := err.(*csv.ParseError); !ok {
+						return nil, nil, err
+					}
+					problems = append(problems, PresetRowError{Row: line, Error: err.Error()})
+					continue
+				}
+				if len(record) != len(header) {
+					problems = append(problems, PresetRowError{Row: line, Error: fmt.Sprintf("expected %d fields but found %d", len(header), len(record))})
+					continue
+				}
+				preset := DicePreset{Name: record[0], Description: record[1], RollSpec: record[2]}
+				if len(record) > presetCSVOldColumns {
+					preset.Folder = record[3]
+					if record[4] != "" {
+						if preset.SortOrder, err = strconv.Atoi(record[4]); err != nil {
+							problems = append(problems, PresetRowError{Row: line, Error: fmt.Sprintf("sort order %q is not a number", record[4])})
+							continue
+						}
+					}
+				}
+				presets = append(presets, preset)
+				rows = append(rows, line)
+			}
+
+		default:
+			return nil, nil, fmt.Errorf("unknown preset file format \"%s\" (use %s or %s)", format, PresetFormatJSON, PresetFormatCSV)
+	}
+
+	seen := make(map[string]int)
+	for i, p := range presets {
+		if err := checkDicePreset(p, limits); err != nil {
+			problems = append(problems, PresetRowError{Row: rows[i], Error: err.Error()})
+		} else if first, ok := seen[p.Name]; ok {
+			problems = append(problems, PresetRowError{Row: rows[i], Error: fmt.Sprintf("preset %s is also in row %d", p.Name, first)})
+		} else {
+			seen[p.Name] = rows[i]
+		}
+	}
+	if len(problems) > 0 {
+		sort.SliceStable(problems, func(i, j int) bool { return problems[i].Row < problems[j].Row })
+		return nil, problems, nil
+	}
+	return presets, nil, nil
+}
+
+//
+// Stands in for the creatures on the map when checking die-roll specs
+// which refer to their attributes, since those creatures may not be
+// there yet.
+//
+type anyAttributes struct{}
+
+func (anyAttributes) CreatureAttribute(creature, attr string) (string, bool) {
+	return "0", true
+}
+
+//
+// Make sure a preset is one we could use.
+//
+func checkDicePreset(p DicePreset, limits DiceLimits) error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("preset has no name")
+	}
+	if strings.ContainsAny(p.Name+p.Description+p.RollSpec+p.Folder, "\n\r") {
+		return fmt.Errorf("preset %s has more than one line in it", p.Name)
+	}
+	spec, err := ResolveAttributeReferences(p.RollSpec, anyAttributes{})
+	if err != nil {
+		return fmt.Errorf("preset %s: %v", p.Name, err)
+	}
+	if _, _, err = PreviewRoll(spec, limits); err != nil {
+		return fmt.Errorf("preset %s: %v", p.Name, err)
+	}
+	return nil
+}
+
+//
+// MergeDicePresets adds the imported presets to the existing ones,
+// replacing any existing preset with the same name as an imported one
+// (in its place in the list); the others are added at the end.
+//
+func MergeDicePresets(existing, imported []DicePreset) []DicePreset {
+	merged := append([]DicePreset(nil), existing...)
+	index := make(map[string]int)
+	for i, p := range merged {
+		index[p.Name] = i
+	}
+	for _, p := range imported {
+		if i, ok := index[p.Name]; ok {
+			merged[i] = p
+		} else {
+			index[p.Name] = len(merged)
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+//
+// Give a user the presets imported from a file, merged with the ones
+// they already had or replacing them, and send their clients the new
+// list. Returns how many presets they now have.
+//
+func (ms *MapService) importDicePresets(user, mode string, imported []DicePreset) (int, error) {
+	var presets []DicePreset
+	switch mode {
+		case PresetImportMerge:
+			presets = MergeDicePresets(ms.DicePresets(user), imported)
+		case PresetImportReplace:
+			presets = imported
+		default:
+			return 0, fmt.Errorf("unknown import mode \"%s\" (use %s or %s)", mode, PresetImportMerge, PresetImportReplace)
+	}
+	ms.storeDicePresets(user, presets)
+	ms.SetDicePresets(user, presets)
+	for _, peer := range ms.Clients.ByUser(user) {
+		ms.SendMyPresets(peer, user)
+	}
+	return len(presets), nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,259 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+// Unit tests for die-roll preset import and export
+//
+
+package mapservice
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var testPresets = []DicePreset{
+	{Name: "010|attack", Description: "sword, with \"flair\"", RollSpec: "d20+5"},
+	{Name: "damage", Description: "sword, two-handed", RollSpec: "2d6+3", Folder: "melee", SortOrder: 2},
+}
+
+func TestPresetFileRoundTrip(t *testing.T) {
+	for _, format := range []string{PresetFormatJSON, PresetFormatCSV} {
+		var file bytes.Buffer
+		if err := ExportDicePresets(&file, format, testPresets); err != nil {
+			t.Fatalf("%s export failed: %v", format, err)
+		}
+		presets, problems, err := ImportDicePresets(&file, format, DiceLimits{})
+		if err != nil || problems != nil {
+			t.Fatalf("%s import failed: %v %v", format, err, problems)
+		}
+		if diff := cmp.Diff(testPresets, presets); diff != "" {
+			t.Errorf("%s round trip changed the presets (-want +got):\n%s", format, diff)
+		}
+	}
+	if err := ExportDicePresets(&bytes.Buffer{}, "xml", testPresets); err == nil {
+		t.Errorf("export to an unknown format succeeded")
+	}
+}
+
+func TestPresetFileRowErrors(t *testing.T) {
+	for _, test := range []struct {
+		format, file string
+		problems     []PresetRowError
+	}{
+		{PresetFormatCSV,
+			"name,description,rollspec\n" +
+				"a,first,d20\n" +
+				",no name,d6\n" +
+				"a,again,d8\n" +
+				"b,too,many,fields\n" +
+				"c,bad spec,d20+zap\n",
+			[]PresetRowError{
+				{Row: 3, Error: "preset has no name"},
+				{Row: 4, Error: "preset a is also in row 2"},
+				{Row: 5, Error: "expected 3 fields but found 4"},
+				{Row: 6},
+			}},
+		{PresetFormatCSV,
+			"name,description,rollspec,folder,sort_order\n" +
+				"a,,d20,melee,1\n" +
+				"b,,d20,melee,first\n" +
+				"c,,d20,melee\n",
+			[]PresetRowError{
+				{Row: 3, Error: `sort order "first" is not a number`},
+				{Row: 4, Error: "expected 5 fields but found 4"},
+			}},
+		{PresetFormatJSON,
+			`[{"name":"a","rollspec":"d20"},{"name":"b","rollspec":"d6","colour":"red"},{"name":"a","rollspec":"d4"}]`,
+			[]PresetRowError{
+				{Row: 2},
+				{Row: 3, Error: "preset a is also in row 1"},
+			}},
+	} {
+		presets, problems, err := ImportDicePresets(strings.NewReader(test.file), test.format, DiceLimits{})
+		if err != nil {
+			t.Fatalf("%s import failed: %v", test.format, err)
+		}
+		if presets != nil {
+			t.Errorf("%s import with errors returned presets %v", test.format, presets)
+		}
+		if len(problems) != len(test.problems) {
+			t.Fatalf("%s import reported %v; expected %v", test.format, problems, test.problems)
+		}
+		for i, want := range test.problems {
+			if problems[i].Row != want.Row || (want.Error != "" && problems[i].Error != want.Error) || problems[i].Error == "" {
+				t.Errorf("%s problem %d was %v; expected %v", test.format, i, problems[i], want)
+			}
+		}
+	}
+
+	for _, bad := range []struct{ format, file string }{
+		{PresetFormatJSON, `{"name":"a"}`},
+		{PresetFormatCSV, "name,rollspec\na,d20\n"},
+		{"xml", "<presets/>"},
+	} {
+		if _, _, err := ImportDicePresets(strings.NewReader(bad.file), bad.format, DiceLimits{}); err == nil {
+			t.Errorf("%s import of %q succeeded", bad.format, bad.file)
+		}
+	}
+}
+
+func TestMergeDicePresets(t *testing.T) {
+	merged := MergeDicePresets(testPresets, []DicePreset{
+		{Name: "damage", Description: "sword, one-handed", RollSpec: "d8+3"},
+		{Name: "030|save", RollSpec: "d20+2"},
+	})
+	expected := []DicePreset{
+		testPresets[0],
+		{Name: "damage", Description: "sword, one-handed", RollSpec: "d8+3"},
+		{Name: "030|save", RollSpec: "d20+2"},
+	}
+	if diff := cmp.Diff(expected, merged); diff != "" {
+		t.Errorf("merge gave the wrong presets (-want +got):\n%s", diff)
+	}
+	if testPresets[1].RollSpec != "2d6+3" {
+		t.Errorf("merge changed the existing presets")
+	}
+}
+
+//
+// Send a DI transfer of the given file from a client.
+//
+func sendTestDI(t *testing.T, ms *MapService, c *MapClient, format, mode, file string) {
+	lines := strings.Split(file, "\n")
+	ms.ExecuteAction(testEvent(t, "DI "+format+" "+mode), c)
+	for _, line := range lines {
+		chunk, _ := ToTclString([]string{"DI:", line})
+		ms.ExecuteAction(testEvent(t, chunk), c)
+	}
+	ms.ExecuteAction(testEvent(t, fmt.Sprintf("DI. %d %s", len(lines), transferTestChecksum(lines...))), c)
+}
+
+func TestPresetFileCommands(t *testing.T) {
+	ms := newTestService()
+	alice := newTestClient(ms, "alice", "alice", false)
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/presets.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+	ms.SetDicePresets("alice", testPresets)
+
+	ms.ExecuteAction(testEvent(t, "DX csv"), alice)
+	sent := sentToTestClient(alice)
+	if len(sent) != 5 || !strings.HasPrefix(sent[0], "DX= csv") || !strings.Contains(sent[3], "damage") || !strings.HasPrefix(sent[4], "DX. 3 ") {
+		t.Fatalf("DX sent %q", sent)
+	}
+
+	sendTestDI(t, ms, alice, "csv", "merge", "name,description,rollspec\n030|save,\"will, reflex\",d20+2\n")
+	sent = sentToTestClient(alice)
+	if !strings.Contains(strings.Join(sent, ""), "Imported 1 die-roll presets; you now have 3.") {
+		t.Errorf("DI merge sent %q", sent)
+	}
+	if presets := ms.DicePresets("alice"); len(presets) != 3 || presets[2].Description != "will, reflex" {
+		t.Errorf("after merge alice has presets %v", presets)
+	}
+	if saved, err := storage.LoadDicePresets(); err != nil || len(saved["alice"]) != 3 {
+		t.Errorf("after merge the database has presets %v (%v)", saved, err)
+	}
+
+	sendTestDI(t, ms, alice, "csv", "replace", "name,description,rollspec\nx,\"two\nlines\",d20\ny,,d20+zap\n")
+	sent = sentToTestClient(alice)
+	if len(sent) != 3 || !strings.HasPrefix(sent[0], "DI! 2 ") || !strings.HasPrefix(sent[1], "DI! 3 ") {
+		t.Errorf("DI with a bad row sent %q", sent)
+	}
+	if presets := ms.DicePresets("alice"); len(presets) != 3 {
+		t.Errorf("bad import changed alice's presets to %v", presets)
+	}
+
+	sendTestDI(t, ms, alice, "json", "replace", `[{"name": "x", "rollspec": "d20"}]`)
+	sentToTestClient(alice)
+	if presets := ms.DicePresets("alice"); len(presets) != 1 || presets[0].Name != "x" {
+		t.Errorf("after replace alice has presets %v", presets)
+	}
+}
+
+func TestPresetFileAPI(t *testing.T) {
+	ms := newTestService()
+	ms.SetDicePresets("bob", testPresets)
+
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/api.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+	_, admin, _ := ms.issueAPIToken("admin", ScopeAdmin, 0)
+
+	status, reply := apiTestRequest(t, ms, "POST", "/api/v1/presets/bob?format=json", admin, `[{"name":"030|save","rollspec":"d20+2"}]`)
+	if status != http.StatusOK || reply["imported"] != 1.0 || reply["presets"] != 3.0 {
+		t.Errorf("merge gave %d %v", status, reply)
+	}
+	status, reply = apiTestRequest(t, ms, "PUT", "/api/v1/presets/bob?format=csv", admin, "name,description,rollspec\nx,,d20\ny,,\n")
+	if status != http.StatusBadRequest || reply["rows"] == nil {
+		t.Errorf("replace with a bad row gave %d %v", status, reply)
+	}
+	status, reply = apiTestRequest(t, ms, "PUT", "/api/v1/presets/bob?format=csv", admin, "name,description,rollspec\nx,,d20\n")
+	if status != http.StatusOK || reply["imported"] != 1.0 || reply["presets"] != 1.0 {
+		t.Errorf("replace gave %d %v", status, reply)
+	}
+	if presets := ms.DicePresets("bob"); len(presets) != 1 || presets[0].Name != "x" {
+		t.Errorf("after replace bob has presets %v", presets)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,359 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                 Die-Roll Preset Usage                              //
+//                                                                                    //
+// Counting how often and how recently each of a user's die-roll presets is rolled,   //
+// so clients can offer the ones they use most on a quick-bar.                        //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// Unless the client asks for some other number, the DU? command
+// reports this many of the user's top and recent presets.
+//
+const DefaultPresetUsageLimit = 10
+
+//
+// PresetUsage is how often one of a user's die-roll presets has been
+// rolled, and when it last was.
+//
+type PresetUsage struct {
+	User     string    `json:"user"`
+	Name     string    `json:"name"`      // the preset's name
+	Count    uint64    `json:"count"`     // how many times it has been rolled
+	LastUsed time.Time `json:"last_used"` // when it was last rolled
+}
+
+//
+// presetUsageLedger keeps the counters for each user's presets.
+//
+type presetUsageLedger struct {
+	lock    sync.Mutex
+	usage   map[string]map[string]*PresetUsage // by user, then preset name
+	changed bool
+}
+
+//
+// Count a roll of one of a user's presets.
+//
+func (l *presetUsageLedger) count(user, name string, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.usage == nil {
+		l.usage = make(map[string]map[string]*PresetUsage)
+	}
+	if l.usage[user] == nil {
+		l.usage[user] = make(map[string]*PresetUsage)
+	}
+	u, ok := l.usage[user][name]
+	if !ok {
+		u = &PresetUsage{User: user, Name: name}
+		l.usage[user][name] = u
+	}
+	u.Count++
+	u.LastUsed = now
+	l.changed = true
+}
+
+//
+// Forget the counters for any of a user's presets which aren't among
+// the given names (because they were deleted or renamed).
+//
+func (l *presetUsageLedger) keepOnly(user string, names map[string]bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for name := range l.usage[user] {
+		if !names[name] {
+			delete(l.usage[user], name)
+			l.changed = true
+		}
+	}
+}
+
+func (l *presetUsageLedger) forUser(user string) []PresetUsage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var usage []PresetUsage
+	for _, u := range l.usage[user] {
+		usage = append(usage, *u)
+	}
+	return usage
+}
+
+func (l *presetUsageLedger) all() []PresetUsage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	usage := []PresetUsage{}
+	for _, presets := range l.usage {
+		for _, u := range presets {
+			usage = append(usage, *u)
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].User != usage[j].User {
+			return usage[i].User < usage[j].User
+		}
+		return usage[i].Name < usage[j].Name
+	})
+	return usage
+}
+
+func (l *presetUsageLedger) load(usage []PresetUsage) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.usage = make(map[string]map[string]*PresetUsage)
+	for i := range usage {
+		if l.usage[usage[i].User] == nil {
+			l.usage[usage[i].User] = make(map[string]*PresetUsage)
+		}
+		l.usage[usage[i].User][usage[i].Name] = &usage[i]
+	}
+}
+
+//
+// Take the changed flag, so we only save the counters when there's
+// something new in them.
+//
+func (l *presetUsageLedger) takeChanged() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	changed := l.changed
+	l.changed = false
+	return changed
+}
+
+//
+// Count a die roll against the preset it came from, if any. Clients
+// may name the preset they rolled; for those which don't, a roll of
+// exactly the same dice as one (and only one) of the user's presets
+// counts as a roll of that preset.
+//
+func (ms *MapService) countPresetUse(user, name, spec string) {
+	matched := ""
+	for _, preset := range ms.DicePresets(user) {
+		if name != "" {
+			if preset.Name == name {
+				matched = name
+				break
+			}
+		} else if preset.RollSpec == spec {
+			if matched != "" {
+				return // we can't tell which one it was
+			}
+			matched = preset.Name
+		}
+	}
+	if matched != "" {
+		ms.presetUsage.count(user, matched, time.Now())
+	}
+}
+
+//
+// PresetUsage returns the user's most often rolled presets (most first),
+// and their most recently rolled ones (latest first), at most n of each.
+// Presets the user no longer has aren't included.
+//
+func (ms *MapService) PresetUsage(user string, n int) (top, recent []PresetUsage) {
+	current := make(map[string]bool)
+	for _, preset := range ms.DicePresets(user) {
+		current[preset.Name] = true
+	}
+	for _, u := range ms.presetUsage.forUser(user) {
+		if current[u.Name] {
+			top = append(top, u)
+		}
+	}
+	recent = append([]PresetUsage(nil), top...)
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		if !top[i].LastUsed.Equal(top[j].LastUsed) {
+			return top[i].LastUsed.After(top[j].LastUsed)
+		}
+		return top[i].Name < top[j].Name
+	})
+	sort.Slice(recent, func(i, j int) bool {
+		if !recent[i].LastUsed.Equal(recent[j].LastUsed) {
+			return recent[i].LastUsed.After(recent[j].LastUsed)
+		}
+		return recent[i].Name < recent[j].Name
+	})
+	if len(top) > n {
+		top, recent = top[:n], recent[:n]
+	}
+	return top, recent
+}
+
+//
+// Save the preset counters, if they've changed, so they last across
+// restarts of the server.
+//
+func (ms *MapService) savePresetUsage() error {
+	storage, ok := ms.Storage.(PresetUsageStorage)
+	if !ok || !ms.presetUsage.takeChanged() {
+		return nil
+	}
+	return storage.SavePresetUsage(ms.presetUsage.all())
+}
+
+//
+// Pick up the preset counters saved before the server was last restarted.
+//
+func (ms *MapService) loadPresetUsage() error {
+	storage, ok := ms.Storage.(PresetUsageStorage)
+	if !ok {
+		return nil
+	}
+	usage, err := storage.LoadPresetUsage()
+	if err != nil {
+		return err
+	}
+	ms.presetUsage.load(usage)
+	return nil
+}
+
+//
+// PresetUsageStorage is implemented by storage backends which can keep
+// the preset counters across restarts of the server.
+//
+type PresetUsageStorage interface {
+	SavePresetUsage(usage []PresetUsage) error
+	LoadPresetUsage() ([]PresetUsage, error)
+}
+
+//
+// Database Schema
+//  ________________
+// | presetusage    |
+// |----------------|
+// | user       P s |
+// | name       P s |
+// | count        i |
+// | lastused     i |
+// |________________|
+//
+// P=primary key
+// i=integer
+// s=string
+//
+// The lastused time is stored as seconds since the epoch.
+//
+func createPresetUsageTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists presetusage (
+			user     text    not null,
+			name     text    not null,
+			count    integer not null,
+			lastused integer not null,
+				primary key (user, name)
+		);`)
+	return err
+}
+
+//
+// SavePresetUsage replaces the saved preset counters with the ones
+// given.
+//
+func SavePresetUsage(db *sql.DB, usage []PresetUsage) error {
+	return withTransaction(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`delete from presetusage`); err != nil {
+			return fmt.Errorf("Unable to clear preset counters: %w", err)
+		}
+		for _, u := range usage {
+			if _, err := tx.Exec(`insert into presetusage (user, name, count, lastused) values (?, ?, ?, ?)`,
+				u.User, u.Name, int64(u.Count), u.LastUsed.Unix()); err != nil {
+				return fmt.Errorf("Unable to save counter for %s's preset %s: %w", u.User, u.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+//
+// LoadPresetUsage reads the saved preset counters.
+//
+func LoadPresetUsage(db *sql.DB) ([]PresetUsage, error) {
+	rows, err := db.Query(`select user, name, count, lastused from presetusage order by user, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []PresetUsage
+	for rows.Next() {
+		var u PresetUsage
+		var count, lastused int64
+		if err = rows.Scan(&u.User, &u.Name, &count, &lastused); err != nil {
+			return nil, fmt.Errorf("unable to read preset counters: %v", err)
+		}
+		u.Count, u.LastUsed = uint64(count), time.Unix(lastused, 0)
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,178 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+// Unit tests for die-roll preset usage counters
+//
+
+package mapservice
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPresetUsageCounting(t *testing.T) {
+	ms := newTestService()
+	ms.SetDicePresets("alice", []DicePreset{
+		{Name: "attack", RollSpec: "d20+5"},
+		{Name: "damage", RollSpec: "2d6+3"},
+		{Name: "save", RollSpec: "d20+2"},
+		{Name: "also save", RollSpec: "d20+2"},
+	})
+
+	ms.countPresetUse("alice", "attack", "d20+5")
+	ms.countPresetUse("alice", "damage", "2d6+3")
+	ms.countPresetUse("alice", "", "d20+5")         // the same dice as attack
+	ms.countPresetUse("alice", "", "d20+2")         // could be either save
+	ms.countPresetUse("alice", "nonesuch", "d20+5") // not one of hers
+	ms.countPresetUse("bob", "attack", "d20+5")     // not his
+
+	top, recent := ms.PresetUsage("alice", 10)
+	if len(top) != 2 || top[0].Name != "attack" || top[0].Count != 2 || top[1].Name != "damage" || top[1].Count != 1 {
+		t.Errorf("top presets were %v", top)
+	}
+	if len(recent) != 2 {
+		t.Errorf("recent presets were %v", recent)
+	}
+	if top, _ = ms.PresetUsage("bob", 10); len(top) != 0 {
+		t.Errorf("bob has presets %v", top)
+	}
+
+	// presets which go away take their counters with them
+	ms.SetDicePresets("alice", []DicePreset{{Name: "damage", RollSpec: "2d6+3"}})
+	if top, _ = ms.PresetUsage("alice", 10); len(top) != 1 || top[0].Name != "damage" {
+		t.Errorf("after deleting presets, top presets were %v", top)
+	}
+	if all := ms.presetUsage.all(); len(all) != 1 {
+		t.Errorf("after deleting presets, counters are %v", all)
+	}
+}
+
+func TestPresetUsageOrder(t *testing.T) {
+	ms := newTestService()
+	ms.SetDicePresets("alice", []DicePreset{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+	now := time.Unix(1000000, 0)
+	ms.presetUsage.count("alice", "a", now)
+	ms.presetUsage.count("alice", "a", now)
+	ms.presetUsage.count("alice", "a", now)
+	ms.presetUsage.count("alice", "b", now.Add(time.Minute))
+	ms.presetUsage.count("alice", "c", now.Add(2*time.Minute))
+	ms.presetUsage.count("alice", "b", now.Add(3*time.Minute))
+
+	top, recent := ms.PresetUsage("alice", 2)
+	if len(top) != 2 || top[0].Name != "a" || top[1].Name != "b" {
+		t.Errorf("top presets were %v", top)
+	}
+	if len(recent) != 2 || recent[0].Name != "b" || recent[1].Name != "c" {
+		t.Errorf("recent presets were %v", recent)
+	}
+}
+
+func TestPresetUsageCommands(t *testing.T) {
+	var err error
+	ms := newTestService()
+	alice := newTestClient(ms, "alice", "alice", false)
+	if alice.dice, err = NewDieRoller(); err != nil {
+		t.Fatalf("unable to create die roller: %v", err)
+	}
+	ms.SetDicePresets("alice", []DicePreset{
+		{Name: "attack", RollSpec: "d20+5"},
+		{Name: "damage", RollSpec: "2d6+3"},
+	})
+
+	ms.ExecuteAction(testEvent(t, "D @ 2d6+3 damage"), alice)
+	ms.ExecuteAction(testEvent(t, "D @ 2d6+3"), alice)
+	ms.ExecuteAction(testEvent(t, "D @ d20+5"), alice)
+	sentToTestClient(alice)
+
+	ms.ExecuteAction(testEvent(t, "DU? 1"), alice)
+	sent := sentToTestClient(alice)
+	if len(sent) != 4 || sent[0] != "DU=" || !strings.HasPrefix(sent[1], "DU: top damage 2 ") ||
+		!strings.HasPrefix(sent[2], "DU: recent attack 1 ") || !strings.HasPrefix(sent[3], "DU. 2 ") {
+		t.Errorf("DU? sent %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "DU? none"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.Contains(sent[0], "ERROR") {
+		t.Errorf("DU? with a bad count sent %q", sent)
+	}
+}
+
+func TestPresetUsageStorage(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/usage.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+
+	ms := newTestService()
+	ms.Storage = storage
+	ms.SetDicePresets("alice", []DicePreset{{Name: "attack", RollSpec: "d20+5"}})
+	ms.presetUsage.count("alice", "attack", time.Unix(1000000, 0))
+	ms.presetUsage.count("alice", "attack", time.Unix(2000000, 0))
+	if err = ms.savePresetUsage(); err != nil {
+		t.Fatalf("unable to save counters: %v", err)
+	}
+
+	restored := newTestService()
+	restored.Storage = storage
+	restored.SetDicePresets("alice", []DicePreset{{Name: "attack", RollSpec: "d20+5"}})
+	if err = restored.loadPresetUsage(); err != nil {
+		t.Fatalf("unable to load counters: %v", err)
+	}
+	top, _ := restored.PresetUsage("alice", 10)
+	if len(top) != 1 || top[0].Count != 2 || !top[0].LastUsed.Equal(time.Unix(2000000, 0)) {
+		t.Errorf("restored counters were %v", top)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,545 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                      QR Codes                                      //
+//                                                                                    //
+// Just enough of a QR code encoder (byte mode, medium error correction, versions 1   //
+// to 10) to put a link to the game on a phone or tablet by pointing its camera at it.//
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+//
+// QRCode is an encoded QR symbol: a square of modules, each dark
+// (true) or light.
+//
+type QRCode struct {
+	Version int
+	Size    int
+	Modules [][]bool // [row][column]
+
+	function [][]bool // modules which are part of the fixed patterns
+}
+
+//
+// Error correction blocks for each version at level M: how many error
+// correction codewords each block gets, and how many blocks of how
+// many data codewords there are (the second group having one more
+// data codeword per block than the first).
+//
+type qrBlocks struct {
+	ecPerBlock, blocks1, data1, blocks2 int
+}
+
+var qrVersionsM = []qrBlocks{
+	{},
+	{10, 1, 16, 0},
+	{16, 1, 28, 0},
+	{26, 1, 44, 0},
+	{18, 2, 32, 0},
+	{24, 2, 43, 0},
+	{16, 4, 27, 0},
+	{18, 4, 31, 0},
+	{22, 2, 38, 2},
+	{22, 3, 36, 2},
+	{26, 4, 43, 1},
+}
+
+//
+// Centres of the alignment patterns (in each direction) for each
+// version.
+//
+var qrAlignment = [][]int{
+	{}, {}, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+//
+// QRMaxBytes is the most data we can encode.
+//
+const QRMaxBytes = 213
+
+func (b qrBlocks) dataCodewords() int {
+	return b.blocks1*b.data1 + b.blocks2*(b.data1+1)
+}
+
+//
+// EncodeQR encodes the data as a QR code in byte mode with medium (M)
+// error correction, using the smallest version it fits in.
+//
+func EncodeQR(data []byte) (*QRCode, error) {
+	version := 0
+	for v := 1; v < len(qrVersionsM); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*qrVersionsM[v].dataCodewords() {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%d bytes is too much for a QR code (the most is %d)", len(data), QRMaxBytes)
+	}
+
+	q := &QRCode{Version: version, Size: 17 + 4*version}
+	q.Modules = make([][]bool, q.Size)
+	q.function = make([][]bool, q.Size)
+	for i := range q.Modules {
+		q.Modules[i] = make([]bool, q.Size)
+		q.function[i] = make([]bool, q.Size)
+	}
+	q.drawFunctionPatterns()
+	q.drawCodewords(qrCodewords(data, version))
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask) // undo it
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+	return q, nil
+}
+
+//
+// The full sequence of codewords for the data: the data codewords
+// (mode, length, data, and padding) split into blocks, each with its
+// error correction codewords added, then interleaved.
+//
+func qrCodewords(data []byte, version int) []byte {
+	blocks := qrVersionsM[version]
+	var bits []bool
+	put := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (value>>uint(i))&1 != 0)
+		}
+	}
+	put(4, 4) // byte mode
+	if version >= 10 {
+		put(len(data), 16)
+	} else {
+		put(len(data), 8)
+	}
+	for _, b := range data {
+		put(int(b), 8)
+	}
+	capacity := 8 * blocks.dataCodewords()
+	for i := 0; i < 4 && len(bits) < capacity; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	for pad := 0xec; len(bits) < capacity; pad ^= 0xec ^ 0x11 {
+		put(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+
+	divisor := reedSolomonDivisor(blocks.ecPerBlock)
+	var dataBlocks, ecBlocks [][]byte
+	for i := 0; i < blocks.blocks1+blocks.blocks2; i++ {
+		n := blocks.data1
+		if i >= blocks.blocks1 {
+			n++
+		}
+		dataBlocks = append(dataBlocks, codewords[:n])
+		ecBlocks = append(ecBlocks, reedSolomonRemainder(codewords[:n], divisor))
+		codewords = codewords[n:]
+	}
+	var result []byte
+	for i := 0; i <= blocks.data1; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < blocks.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+//
+// Multiply in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+//
+func gfMultiply(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		carry := z & 0x80
+		z <<= 1
+		if carry != 0 {
+			z ^= 0x1d
+		}
+		if (y>>uint(i))&1 != 0 {
+			z ^= x
+		}
+	}
+	return z
+}
+
+//
+// The Reed-Solomon generator polynomial of the given degree, highest
+// coefficient first (leaving out the leading 1).
+//
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	var root byte = 1
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 2)
+	}
+	return result
+}
+
+//
+// The error correction codewords for the data.
+//
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+func (q *QRCode) setFunction(x, y int, dark bool) {
+	q.Modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+//
+// Draw the finder, timing, and alignment patterns, and the version
+// information, and reserve room for the format information.
+//
+func (q *QRCode) drawFunctionPatterns() {
+	for i := 0; i < q.Size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+	for _, corner := range [][2]int{{3, 3}, {q.Size - 4, 3}, {3, q.Size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := corner[0]+dx, corner[1]+dy
+				if x < 0 || y < 0 || x >= q.Size || y >= q.Size {
+					continue
+				}
+				d := qrMax(qrAbs(dx), qrAbs(dy))
+				q.setFunction(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+	centres := qrAlignment[q.Version]
+	for i, cx := range centres {
+		for j, cy := range centres {
+			if (i == 0 && j == 0) || (i == 0 && j == len(centres)-1) || (i == len(centres)-1 && j == 0) {
+				continue // these would sit on the finder patterns
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(cx+dx, cy+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormatBits(0)
+	if q.Version >= 7 {
+		bits := qrVersionBits(q.Version)
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 != 0
+			a, b := q.Size-11+i%3, i/3
+			q.setFunction(a, b, dark)
+			q.setFunction(b, a, dark)
+		}
+	}
+}
+
+//
+// The 15-bit format information for error correction level M and the
+// given mask.
+//
+func qrFormatBits(mask int) int {
+	data := 0<<3 | mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+//
+// The 18-bit version information.
+//
+func qrVersionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+	}
+	return version<<12 | rem
+}
+
+func (q *QRCode) drawFormatBits(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.Size-15+i, bit(i))
+	}
+	q.setFunction(8, q.Size-8, true) // always dark
+}
+
+//
+// Lay the codewords out over the symbol in the zig-zag order the
+// standard calls for, around the function patterns.
+//
+func (q *QRCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if upward {
+					y = q.Size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(codewords)*8 {
+					q.Modules[y][x] = (codewords[i/8]>>uint(7-i%8))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *QRCode) applyMask(mask int) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			var invert bool
+			switch mask {
+				case 0: invert = (x+y)%2 == 0
+				case 1: invert = y%2 == 0
+				case 2: invert = x%3 == 0
+				case 3: invert = (x+y)%3 == 0
+				case 4: invert = (x/3+y/2)%2 == 0
+				case 5: invert = x*y%2+x*y%3 == 0
+				case 6: invert = (x*y%2+x*y%3)%2 == 0
+				case 7: invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.Modules[y][x] = !q.Modules[y][x]
+			}
+		}
+	}
+}
+
+//
+// Score how hard the symbol would be to read, as the standard does
+// to choose between masks (lower is better).
+//
+func (q *QRCode) penalty() int {
+	penalty := 0
+	line := func(get func(i int) bool) {
+		run := 0
+		var pattern strings.Builder
+		for i := 0; i < q.Size; i++ {
+			if i > 0 && get(i) == get(i-1) {
+				run++
+			} else {
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+			if get(i) {
+				pattern.WriteByte('1')
+			} else {
+				pattern.WriteByte('0')
+			}
+		}
+		if run >= 5 {
+			penalty += run - 2
+		}
+		penalty += 40 * (strings.Count(pattern.String(), "10111010000") + strings.Count(pattern.String(), "00001011101"))
+	}
+	dark := 0
+	for y := 0; y < q.Size; y++ {
+		line(func(x int) bool { return q.Modules[y][x] })
+		line(func(x int) bool { return q.Modules[x][y] })
+		for x := 0; x < q.Size; x++ {
+			if q.Modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := q.Modules[y][x]
+				if q.Modules[y-1][x] == c && q.Modules[y][x-1] == c && q.Modules[y-1][x-1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+	percent := dark * 100 / (q.Size * q.Size)
+	return penalty + 10*(qrAbs(percent-50)/5)
+}
+
+func qrAbs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func qrMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+//
+// QRQuietZone is how many light modules surround a QR code when it is
+// drawn.
+//
+const QRQuietZone = 4
+
+//
+// Image draws the QR code with each module scale pixels square.
+//
+func (q *QRCode) Image(scale int) image.Image {
+	side := (q.Size + 2*QRQuietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for py := 0; py < side; py++ {
+		for px := 0; px < side; px++ {
+			x, y := px/scale-QRQuietZone, py/scale-QRQuietZone
+			if x >= 0 && y >= 0 && x < q.Size && y < q.Size && q.Modules[y][x] {
+				img.SetGray(px, py, color.Gray{Y: 0})
+			} else {
+				img.SetGray(px, py, color.Gray{Y: 255})
+			}
+		}
+	}
+	return img
+}
+
+//
+// Text draws the QR code with block characters, two rows of modules
+// to each line of text, to be shown in a terminal with dark text on a
+// light background (or scanned with inverted colours otherwise).
+//
+func (q *QRCode) Text() string {
+	dark := func(x, y int) bool {
+		x, y = x-QRQuietZone, y-QRQuietZone
+		return x >= 0 && y >= 0 && x < q.Size && y < q.Size && q.Modules[y][x]
+	}
+	var text strings.Builder
+	side := q.Size + 2*QRQuietZone
+	for y := 0; y < side; y += 2 {
+		for x := 0; x < side; x++ {
+			switch upper, lower := dark(x, y), dark(x, y+1); {
+				case upper && lower: text.WriteString("█")
+				case upper:          text.WriteString("▀")
+				case lower:          text.WriteString("▄")
+				default:             text.WriteString(" ")
+			}
+		}
+		text.WriteByte('\n')
+	}
+	return text.String()
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
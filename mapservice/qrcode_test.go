@@ -0,0 +1,260 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the QR code encoder
+//
+
+package mapservice
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// "HELLO WORLD" as version 1-M, from the usual QR code tutorial
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if ec := reedSolomonRemainder(data, reedSolomonDivisor(10)); !bytes.Equal(ec, expected) {
+		t.Errorf("error correction codewords %v, not %v", ec, expected)
+	}
+}
+
+func TestQRFormatAndVersionBits(t *testing.T) {
+	for mask, expected := range []int{0x5412, 0x5125, 0x5e7c, 0x5b4b, 0x45f9, 0x40ce, 0x4f97, 0x4aa0} {
+		if bits := qrFormatBits(mask); bits != expected {
+			t.Errorf("format bits for mask %d were %015b, not %015b", mask, bits, expected)
+		}
+	}
+	if bits := qrVersionBits(7); bits != 0x07c94 {
+		t.Errorf("version 7 information was %018b", bits)
+	}
+}
+
+//
+// Read a QR code back the way a scanner would (given it has already
+// found the modules), returning the data it holds.
+//
+func readTestQR(t *testing.T, q *QRCode) []byte {
+	var format int
+	for i := 0; i <= 5; i++ {
+		if q.Modules[i][8] {
+			format |= 1 << uint(i)
+		}
+	}
+	for i, pos := range [][2]int{{8, 7}, {8, 8}, {7, 8}} {
+		if q.Modules[pos[1]][pos[0]] {
+			format |= 1 << uint(6+i)
+		}
+	}
+	for i := 9; i < 15; i++ {
+		if q.Modules[8][14-i] {
+			format |= 1 << uint(i)
+		}
+	}
+	mask := -1
+	for m := 0; m < 8; m++ {
+		if qrFormatBits(m) == format {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("format information %015b not understood", format)
+	}
+
+	unmasked := &QRCode{Version: q.Version, Size: q.Size, function: q.function}
+	for _, row := range q.Modules {
+		unmasked.Modules = append(unmasked.Modules, append([]bool(nil), row...))
+	}
+	unmasked.applyMask(mask)
+	var codewords []byte
+	var current byte
+	n := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = q.Size - 1 - vert
+				}
+				if q.function[y][x] {
+					continue
+				}
+				current <<= 1
+				if unmasked.Modules[y][x] {
+					current |= 1
+				}
+				if n++; n%8 == 0 {
+					codewords = append(codewords, current)
+				}
+			}
+		}
+	}
+
+	blocks := qrVersionsM[q.Version]
+	count := blocks.blocks1 + blocks.blocks2
+	dataBlocks := make([][]byte, count)
+	i := 0
+	for k := 0; k <= blocks.data1; k++ {
+		for b := 0; b < count; b++ {
+			if k < blocks.data1 || b >= blocks.blocks1 {
+				dataBlocks[b] = append(dataBlocks[b], codewords[i])
+				i++
+			}
+		}
+	}
+	divisor := reedSolomonDivisor(blocks.ecPerBlock)
+	var data []byte
+	for b, block := range dataBlocks {
+		whole := append([]byte(nil), block...)
+		for k := 0; k < blocks.ecPerBlock; k++ {
+			whole = append(whole, codewords[i+k*count+b])
+		}
+		if remainder := reedSolomonRemainder(whole, divisor); !bytes.Equal(remainder, make([]byte, len(remainder))) {
+			t.Errorf("block %d fails its error check", b)
+		}
+		data = append(data, block...)
+	}
+
+	if data[0]>>4 != 4 {
+		t.Fatalf("mode %d", data[0]>>4)
+	}
+	bit := func(pos int) int { return int(data[pos/8]>>uint(7-pos%8)) & 1 }
+	field := func(pos, width int) int {
+		v := 0
+		for k := 0; k < width; k++ {
+			v = v<<1 | bit(pos+k)
+		}
+		return v
+	}
+	countBits := 8
+	if q.Version >= 10 {
+		countBits = 16
+	}
+	length := field(4, countBits)
+	var decoded []byte
+	for k := 0; k < length; k++ {
+		decoded = append(decoded, byte(field(4+countBits+8*k, 8)))
+	}
+	return decoded
+}
+
+func TestEncodeQR(t *testing.T) {
+	for _, tc := range []struct {
+		data    string
+		version int
+	}{
+		{"HELLO WORLD", 1},
+		{"gma://192.168.1.20:2323/?user=alice", 3},
+		{strings.Repeat("x", 150), 8},
+		{strings.Repeat("y", QRMaxBytes), 10},
+	} {
+		q, err := EncodeQR([]byte(tc.data))
+		if err != nil {
+			t.Errorf("%q: %v", tc.data, err)
+			continue
+		}
+		if q.Version != tc.version || q.Size != 17+4*tc.version || len(q.Modules) != q.Size {
+			t.Errorf("%q encoded as version %d (size %d)", tc.data, q.Version, q.Size)
+		}
+		for _, corner := range [][2]int{{0, 0}, {q.Size - 7, 0}, {0, q.Size - 7}} {
+			for k := 0; k < 7; k++ {
+				if !q.Modules[corner[1]][corner[0]+k] || !q.Modules[corner[1]+k][corner[0]] || q.Modules[corner[1]+1][corner[0]+1] {
+					t.Errorf("%q has no finder pattern at %v", tc.data, corner)
+				}
+			}
+		}
+		if decoded := string(readTestQR(t, q)); decoded != tc.data {
+			t.Errorf("%q read back as %q", tc.data, decoded)
+		}
+	}
+	if _, err := EncodeQR(make([]byte, QRMaxBytes+1)); err == nil {
+		t.Errorf("too much data was encoded")
+	}
+}
+
+func TestQRRendering(t *testing.T) {
+	q, err := EncodeQR([]byte("HELLO WORLD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := q.Image(3)
+	if side := (21 + 2*QRQuietZone) * 3; img.Bounds().Dx() != side || img.Bounds().Dy() != side {
+		t.Errorf("image is %v", img.Bounds())
+	}
+	if r, _, _, _ := img.At(QRQuietZone*3, QRQuietZone*3).RGBA(); r != 0 {
+		t.Errorf("finder pattern corner is light")
+	}
+	if r, _, _, _ := img.At(0, 0).RGBA(); r == 0 {
+		t.Errorf("quiet zone is dark")
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Errorf("unable to make a PNG: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(q.Text(), "\n"), "\n")
+	if len(lines) != (21+2*QRQuietZone+1)/2 || len([]rune(lines[0])) != 21+2*QRQuietZone {
+		t.Errorf("text is %d lines of %d", len(lines), len([]rune(lines[0])))
+	}
+	if row := []rune(lines[2]); row[QRQuietZone] != '█' || row[0] != ' ' {
+		t.Errorf("text row 2 is %q", lines[2])
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,213 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                            Delayed and Readied Actions                             //
+//                                                                                    //
+// During combat, creatures may delay their turn or ready an action to be taken when  //
+// another creature acts. The server keeps these with the initiative state, reminds   //
+// the GM when the triggering creature's turn comes up, and logs when each action     //
+// fires or expires.                                                                  //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+//
+// The kinds of actions a creature may hold until later in the round.
+// A delayed action is taken after the trigger creature's turn; a
+// readied action is taken when the trigger creature does something
+// (as described by the action's description).
+//
+const (
+	ActionDelayed = "delay"
+	ActionReadied = "ready"
+)
+
+//
+// ReadiedAction is a delayed or readied action waiting for its trigger.
+//
+type ReadiedAction struct {
+	ID          string // identifier chosen by the client
+	Creature    string // creature (ID or name) holding the action
+	Kind        string // ActionDelayed or ActionReadied
+	Trigger     string // creature (ID or name) whose turn triggers it
+	Description string // what the creature intends to do, and when
+}
+
+//
+// Make a ReadiedAction from an RA event.
+//
+func readiedActionFromEvent(event *MapEvent) ReadiedAction {
+	action := ReadiedAction{
+		ID:       event.Fields[1],
+		Creature: event.Fields[2],
+		Kind:     event.Fields[3],
+		Trigger:  event.Fields[4],
+	}
+	if len(event.Fields) > 5 {
+		action.Description = event.Fields[5]
+	}
+	return action
+}
+
+//
+// ReadiedActions returns the delayed and readied actions waiting
+// for their triggers, in the order they were declared.
+//
+func (gs *GameState) ReadiedActions() []ReadiedAction {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	var events []*MapEvent
+	for key, event := range gs.EventHistory {
+		if strings.HasPrefix(key, "RA:") {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Sequence < events[j].Sequence })
+	actions := make([]ReadiedAction, 0, len(events))
+	for _, event := range events {
+		actions = append(actions, readiedActionFromEvent(event))
+	}
+	return actions
+}
+
+//
+// Do two creature references (IDs or names) refer to the same creature?
+//
+func (gs *GameState) sameCreature(a, b string) bool {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	if a == b {
+		return true
+	}
+	ca, cb := gs.creature(a), gs.creature(b)
+	return ca != nil && ca == cb
+}
+
+//
+// May this user declare or cancel an action for the given creature?
+//
+func (gs *GameState) mayActFor(user, creature string) bool {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	obj := gs.creature(creature)
+	return obj != nil && obj.playedBy(user)
+}
+
+//
+// Remove a delayed or readied action, telling everyone why.
+//
+func (ms *MapService) endReadiedAction(action ReadiedAction, reason string) {
+	log.Printf("%s action %s for %s %s", action.Kind, action.ID, action.Creature, reason)
+	event, err := NewMapEventFromList("", []string{"RA-", action.ID, reason}, "", "")
+	if err != nil {
+		log.Printf("Internal error creating RA- event: %v", err)
+		return
+	}
+	ms.UpdateState(event)
+	for _, peer := range ms.Clients.Subscribers("RA-") {
+		peer.Send(event.Fields...)
+	}
+}
+
+//
+// It is now the turn of the given creature. Remind the GM of any
+// actions triggered by it, and expire any actions the creature itself
+// held since its last turn, since those are now lost.
+//
+func (ms *MapService) readiedActionsForTurn(active string) {
+	for _, action := range ms.State.ReadiedActions() {
+		if ms.State.sameCreature(action.Creature, active) {
+			ms.endReadiedAction(action, "expired")
+			continue
+		}
+		if ms.State.sameCreature(action.Trigger, active) {
+			var reminder string
+			if action.Kind == ActionDelayed {
+				reminder = fmt.Sprintf("Reminder: %s is waiting to act after %s.", action.Creature, action.Trigger)
+			} else {
+				reminder = fmt.Sprintf("Reminder: %s has an action readied for %s's turn.", action.Creature, action.Trigger)
+			}
+			if action.Description != "" {
+				reminder += " (" + action.Description + ")"
+			}
+			for _, peer := range ms.Clients.ByUser("GM") {
+				if !peer.WriteOnly {
+					peer.Send("TO", "GM", "GM", reminder, NextMessageID())
+				}
+			}
+		}
+	}
+}
+
+//
+// Combat is over, so any actions still waiting are lost.
+//
+func (ms *MapService) expireReadiedActions() {
+	for _, action := range ms.State.ReadiedActions() {
+		ms.endReadiedAction(action, "expired")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
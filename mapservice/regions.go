@@ -0,0 +1,441 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                    Map Regions                                     //
+//                                                                                    //
+// Areas of the map the GM has outlined and annotated (such as a room with a trap),   //
+// which aren't drawn on the map as its elements are. Each has a title, and a note    //
+// for the GM alone. The GM may reveal a region to the players, who are then shown    //
+// its outline and title (but never its note).                                        //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//
+// RegionFileSuffix is added to a .map file's name (in place of ".map")
+// for the file beside it holding the regions that go with it.
+//
+const RegionFileSuffix = ".regions"
+
+//
+// A Region is an area of the map outlined and annotated by the GM.
+//
+type Region struct {
+	ID       string    `json:"id"`
+	Title    string    `json:"title"`
+	Points   []float64 `json:"points"`         // x0 y0 x1 y1 ... around its outline, in map coordinates
+	Note     string    `json:"note,omitempty"` // for the GM only
+	Revealed bool      `json:"revealed"`       // may the players see it?
+}
+
+//
+// ParseRegion makes sense of the fields of an RG message (<id> <title>
+// <points> <note> [<revealed>]). If <revealed> isn't given, the region
+// is revealed if old (the region already defined with the same ID, if
+// any) was.
+//
+func ParseRegion(fields []string, old *Region) (Region, error) {
+	if len(fields) < 4 || len(fields) > 5 {
+		return Region{}, fmt.Errorf("Regions need an ID, title, outline, and note")
+	}
+	r := Region{ID: fields[0], Title: fields[1], Note: fields[3]}
+	if r.ID == "" {
+		return Region{}, fmt.Errorf("Regions must have an ID")
+	}
+	points, err := ParseTclList(fields[2])
+	if err != nil {
+		return Region{}, fmt.Errorf("Region %s outline is malformed (%v)", r.ID, err)
+	}
+	if len(points) < 6 || len(points)%2 != 0 {
+		return Region{}, fmt.Errorf("Region %s outline must have x and y coordinates for at least three points", r.ID)
+	}
+	for _, p := range points {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return Region{}, fmt.Errorf("Region %s outline coordinate %s is not a number", r.ID, p)
+		}
+		r.Points = append(r.Points, v)
+	}
+	if len(fields) > 4 {
+		if r.Revealed, err = strconv.ParseBool(fields[4]); err != nil {
+			return Region{}, fmt.Errorf("Region %s revealed flag must be 0 or 1", r.ID)
+		}
+	} else if old != nil {
+		r.Revealed = old.Revealed
+	}
+	return r, nil
+}
+
+//
+// Message returns the RG message which shows the region to a client,
+// leaving out the note unless it's for the GM.
+//
+func (r Region) Message(gm bool) []string {
+	var points []string
+	for _, v := range r.Points {
+		points = append(points, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	note := ""
+	if gm {
+		note = r.Note
+	}
+	revealed := "0"
+	if r.Revealed {
+		revealed = "1"
+	}
+	return []string{"RG", r.ID, r.Title, strings.Join(points, " "), note, revealed}
+}
+
+//
+// regionList holds the regions defined on the map, by ID.
+//
+type regionList struct {
+	lock    sync.Mutex
+	regions map[string]Region
+}
+
+//
+// Set a region, returning the one it replaced, if any.
+//
+func (l *regionList) set(r Region) *Region {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.regions == nil {
+		l.regions = make(map[string]Region)
+	}
+	old, ok := l.regions[r.ID]
+	l.regions[r.ID] = r
+	if ok {
+		return &old
+	}
+	return nil
+}
+
+func (l *regionList) get(id string) (Region, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	r, ok := l.regions[id]
+	return r, ok
+}
+
+func (l *regionList) remove(id string) (Region, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	r, ok := l.regions[id]
+	delete(l.regions, id)
+	return r, ok
+}
+
+//
+// The regions, sorted by ID; only those revealed to the players
+// unless gm is true.
+//
+func (l *regionList) all(gm bool) []Region {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var regions []Region
+	for _, r := range l.regions {
+		if gm || r.Revealed {
+			regions = append(regions, r)
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].ID < regions[j].ID })
+	return regions
+}
+
+//
+// RegionStorage is implemented by storage backends which can keep the
+// regions defined on the map.
+//
+type RegionStorage interface {
+	LoadRegions() ([]Region, error)
+	SaveRegion(r Region) error
+	DeleteRegion(id string) error
+}
+
+//
+// Database Schema
+//  _______________
+// | regions       |
+// |---------------|
+// | id         Ps |
+// | title       s |
+// | points      s |
+// | note        s |
+// | revealed    i |
+// |_______________|
+//
+// P=primary key
+// i=integer
+// s=string
+//
+// The points are the outline as a space-separated list of coordinates.
+// This table was added after the others, so it is created whenever we
+// open a database which doesn't have it yet.
+//
+func createRegionTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists regions (
+			id       text    primary key,
+			title    text    not null,
+			points   text    not null,
+			note     text    not null,
+			revealed integer not null
+		);`)
+	return err
+}
+
+//
+// LoadRegions reads the regions from the database.
+//
+func LoadRegions(db *sql.DB) ([]Region, error) {
+	rows, err := db.Query(`select id, title, points, note, revealed from regions order by id`)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read regions: %v", err)
+	}
+	defer rows.Close()
+	var regions []Region
+	for rows.Next() {
+		var fields [5]string
+		if err = rows.Scan(&fields[0], &fields[1], &fields[2], &fields[3], &fields[4]); err != nil {
+			return nil, fmt.Errorf("Unable to read regions: %v", err)
+		}
+		r, err := ParseRegion(fields[:], nil)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, r)
+	}
+	return regions, rows.Err()
+}
+
+//
+// SaveRegion stores a region, replacing any with the same ID.
+//
+func SaveRegion(db *sql.DB, r Region) error {
+	fields := r.Message(true)
+	if _, err := db.Exec(`insert or replace into regions (id, title, points, note, revealed) values (?, ?, ?, ?, ?)`,
+		r.ID, r.Title, fields[3], r.Note, r.Revealed); err != nil {
+		return fmt.Errorf("Unable to save region %s: %v", r.ID, err)
+	}
+	return nil
+}
+
+//
+// DeleteRegion removes a region from the database.
+//
+func DeleteRegion(db *sql.DB, id string) error {
+	if _, err := db.Exec(`delete from regions where id = ?`, id); err != nil {
+		return fmt.Errorf("Unable to delete region %s: %v", id, err)
+	}
+	return nil
+}
+
+//
+// Load the saved regions, if the storage backend keeps them.
+//
+func (ms *MapService) loadRegions() error {
+	storage, ok := ms.Storage.(RegionStorage)
+	if !ok {
+		return nil
+	}
+	regions, err := storage.LoadRegions()
+	if err != nil {
+		return err
+	}
+	for _, r := range regions {
+		ms.regions.set(r)
+	}
+	return nil
+}
+
+//
+// Regions returns the regions defined on the map, sorted by ID. Only
+// those revealed to the players are included unless gm is true.
+//
+func (ms *MapService) Regions(gm bool) []Region {
+	return ms.regions.all(gm)
+}
+
+//
+// Define a region (or change one), saving it if we can, and show it to
+// everyone but the client who did it (nil if the server did).
+//
+func (ms *MapService) setRegion(thisClient *MapClient, r Region) error {
+	if storage, ok := ms.Storage.(RegionStorage); ok {
+		if err := storage.SaveRegion(r); err != nil {
+			return err
+		}
+	}
+	old := ms.regions.set(r)
+	for _, peer := range ms.Clients.Subscribers("RG") {
+		if peer == thisClient || !peer.Authenticated {
+			continue
+		}
+		if peer.IsGM() || r.Revealed {
+			peer.Send(r.Message(peer.IsGM())...)
+		} else if old != nil && old.Revealed {
+			peer.Send("RG-", r.ID)
+		}
+	}
+	return nil
+}
+
+//
+// Remove a region, returning false if there wasn't one with that ID,
+// and tell everyone who could see it but the client who removed it.
+//
+func (ms *MapService) deleteRegion(thisClient *MapClient, id string) (bool, error) {
+	if _, ok := ms.regions.get(id); !ok {
+		return false, nil
+	}
+	if storage, ok := ms.Storage.(RegionStorage); ok {
+		if err := storage.DeleteRegion(id); err != nil {
+			return false, err
+		}
+	}
+	r, ok := ms.regions.remove(id)
+	if !ok {
+		return false, nil
+	}
+	for _, peer := range ms.Clients.Subscribers("RG-") {
+		if peer != thisClient && peer.Authenticated && (peer.IsGM() || r.Revealed) {
+			peer.Send("RG-", id)
+		}
+	}
+	return true, nil
+}
+
+//
+// Show a client the regions it may see.
+//
+func (ms *MapService) sendRegions(thisClient *MapClient) {
+	gm := thisClient.IsGM()
+	for _, r := range ms.regions.all(gm) {
+		thisClient.Send(r.Message(gm)...)
+	}
+}
+
+//
+// The region file which goes with a .map file.
+//
+func regionFilePath(mapPath string) string {
+	return strings.TrimSuffix(mapPath, ".map") + RegionFileSuffix
+}
+
+//
+// Save the regions beside a .map file, so they go with it when it is
+// deployed as a scene. If there aren't any, there is no region file.
+//
+func (ms *MapService) saveRegionFile(mapPath string) (int, error) {
+	regions := ms.regions.all(true)
+	path := regionFilePath(mapPath)
+	if len(regions) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		return 0, nil
+	}
+	data, err := json.MarshalIndent(regions, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return len(regions), os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+//
+// Define the regions saved beside a .map file, if there are any,
+// returning how many there were.
+//
+func (ms *MapService) deployRegionFile(mapPath string) (int, error) {
+	data, err := os.ReadFile(regionFilePath(mapPath))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var regions []Region
+	if err = json.Unmarshal(data, &regions); err != nil {
+		return 0, fmt.Errorf("region file for %s is unreadable: %v", mapPath, err)
+	}
+	for _, r := range regions {
+		// check them just as if the GM had sent them
+		r, err = ParseRegion(r.Message(true)[1:], nil)
+		if err != nil {
+			return 0, err
+		}
+		if err = ms.setRegion(nil, r); err != nil {
+			return 0, err
+		}
+	}
+	log.Printf("Deployed %d regions from %s", len(regions), regionFilePath(mapPath))
+	return len(regions), nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,243 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for map regions
+//
+
+package mapservice
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRegion(t *testing.T) {
+	r, err := ParseRegion([]string{"r1", "Trap", "0 0 50 0 50.5 -50", "pit DC 20"}, nil)
+	if err != nil || r.ID != "r1" || r.Title != "Trap" || len(r.Points) != 6 || r.Points[4] != 50.5 || r.Note != "pit DC 20" || r.Revealed {
+		t.Errorf("region parsed as %v (%v)", r, err)
+	}
+	if m := r.Message(false); strings.Join(m, "|") != "RG|r1|Trap|0 0 50 0 50.5 -50||0" {
+		t.Errorf("player message was %q", m)
+	}
+	if m := r.Message(true); m[4] != "pit DC 20" {
+		t.Errorf("GM message was %q", m)
+	}
+
+	// revealed unless we're told otherwise, if it was before
+	old := Region{Revealed: true}
+	if r, err = ParseRegion([]string{"r1", "Trap", "0 0 50 0 50 50", ""}, &old); err != nil || !r.Revealed {
+		t.Errorf("redefined region was %v (%v)", r, err)
+	}
+	if r, err = ParseRegion([]string{"r1", "Trap", "0 0 50 0 50 50", "", "0"}, &old); err != nil || r.Revealed {
+		t.Errorf("redefined hidden region was %v (%v)", r, err)
+	}
+
+	for _, fields := range [][]string{
+		{"", "Trap", "0 0 50 0 50 50", ""},
+		{"r1", "Trap", "0 0 50 0", ""},
+		{"r1", "Trap", "0 0 50 0 50", ""},
+		{"r1", "Trap", "0 0 50 0 50 x", ""},
+		{"r1", "Trap", "0 0 50 0 50 NaN", ""},
+		{"r1", "Trap", "0 0 50 0 {50", ""},
+		{"r1", "Trap", "0 0 50 0 50 50", "", "maybe"},
+		{"r1", "Trap", "0 0 50 0 50 50"},
+	} {
+		if r, err := ParseRegion(fields, nil); err == nil {
+			t.Errorf("region %q accepted as %v", fields, r)
+		}
+	}
+}
+
+func TestRegionCommands(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	gm2 := newTestClient(ms, "gm2", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "RG r1 Trap {0 0 50 0 50 50} {pit trap DC 20}"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 1 || !strings.HasPrefix(sent[0], "PRIV") {
+		t.Errorf("player defining a region was sent %v", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "RG r1 Trap {0 0 50 0 50 50} {pit trap DC 20}"), gm)
+	ms.ExecuteAction(testEvent(t, "RG r2 Altar {100 100 150 100 150 150} {} 1"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 0 {
+		t.Errorf("GM was sent %v", sent)
+	}
+	if sent := sentToTestClient(gm2); strings.Join(sent, "\n") != "RG r1 Trap {0 0 50 0 50 50} {pit trap DC 20} 0\nRG r2 Altar {100 100 150 100 150 150} {} 1" {
+		t.Errorf("other GM was sent %q", sent)
+	}
+	if sent := sentToTestClient(alice); strings.Join(sent, "\n") != "RG r2 Altar {100 100 150 100 150 150} {} 1" {
+		t.Errorf("player was sent %q", sent)
+	}
+
+	// the GM may see them all, and the players only what is revealed
+	ms.ExecuteAction(testEvent(t, "RG?"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 4 || sent[0] != "RG=" || sent[1] != "RG: r1 Trap {0 0 50 0 50 50} {pit trap DC 20} 0" {
+		t.Errorf("GM's RG? was answered with %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "RG?"), alice)
+	if sent := sentToTestClient(alice); len(sent) != 3 || sent[1] != "RG: r2 Altar {100 100 150 100 150 150} {} 1" {
+		t.Errorf("player's RG? was answered with %q", sent)
+	}
+
+	// revealing a region shows it to the players, without the note
+	ms.ExecuteAction(testEvent(t, "RGV r1 1"), gm)
+	if sent := sentToTestClient(alice); strings.Join(sent, "\n") != "RG r1 Trap {0 0 50 0 50 50} {} 1" {
+		t.Errorf("player was sent %q when region revealed", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "RG r1 {Spiked Trap} {0 0 60 0 60 60} {pit trap DC 22}"), gm)
+	if sent := sentToTestClient(alice); strings.Join(sent, "\n") != "RG r1 {Spiked Trap} {0 0 60 0 60 60} {} 1" {
+		t.Errorf("player was sent %q when revealed region changed", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "RGV r1 0"), gm)
+	if sent := sentToTestClient(alice); strings.Join(sent, "\n") != "RG- r1" {
+		t.Errorf("player was sent %q when region hidden", sent)
+	}
+	sentToTestClient(gm2)
+
+	// removing a hidden region is only news to the GMs
+	ms.ExecuteAction(testEvent(t, "RG- r1"), gm)
+	if sent := sentToTestClient(gm2); strings.Join(sent, "\n") != "RG- r1" {
+		t.Errorf("other GM was sent %q when region removed", sent)
+	}
+	if sent := sentToTestClient(alice); len(sent) != 0 {
+		t.Errorf("player was sent %q when hidden region removed", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "RG- r2"), gm)
+	if sent := sentToTestClient(alice); strings.Join(sent, "\n") != "RG- r2" {
+		t.Errorf("player was sent %q when revealed region removed", sent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "RG- r2"), gm)
+	ms.ExecuteAction(testEvent(t, "RGV r2 1"), gm)
+	ms.ExecuteAction(testEvent(t, "RG r3 Bad {0 0 1 1} {}"), gm)
+	sent := sentToTestClient(gm)
+	if len(sent) != 3 || sent[0] != "// {There is no region r2.}" || !strings.Contains(sent[1], "there is no region r2") || !strings.Contains(sent[2], "at least three points") {
+		t.Errorf("GM was sent %q for mistakes", sent)
+	}
+}
+
+func TestRegionsSaved(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", filepath.Join(t.TempDir(), "regions.db"))
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	gm := newTestClient(ms, "gm", "GM", true)
+	ms.ExecuteAction(testEvent(t, "RG r1 Trap {0 0 50 0 50 50} {pit trap DC 20}"), gm)
+	ms.ExecuteAction(testEvent(t, "RG r2 Altar {100 100 150 100 150 150} {} 1"), gm)
+	ms.ExecuteAction(testEvent(t, "RG- r1"), gm)
+
+	restarted := newTestService()
+	restarted.Storage = storage
+	if err = restarted.loadRegions(); err != nil {
+		t.Fatalf("unable to load regions: %v", err)
+	}
+	regions := restarted.Regions(true)
+	if len(regions) != 1 || regions[0].ID != "r2" || !regions[0].Revealed || regions[0].Points[5] != 150 {
+		t.Errorf("regions loaded were %v", regions)
+	}
+
+	// and they're shown to each client as it connects
+	alice := newTestClient(restarted, "alice", "alice", false)
+	restarted.sendPostAuthPreamble(alice, true)
+	if sent := strings.Join(sentToTestClient(alice), "\n"); !strings.Contains(sent, "RG r2 Altar {100 100 150 100 150 150} {} 1") {
+		t.Errorf("player was greeted with %q", sent)
+	}
+}
+
+func TestRegionsWithScene(t *testing.T) {
+	ms := newTestService()
+	ms.MapExportDir = t.TempDir()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	sendTestLS(t, ms, gm, "TEXT:t1 {welcome}", "X:t1 5")
+	ms.ExecuteAction(testEvent(t, "RG r1 Trap {0 0 50 0 50 50} {pit trap DC 20}"), gm)
+	ms.ExecuteAction(testEvent(t, "RG r2 Altar {100 100 150 100 150 150} {} 1"), gm)
+	ms.ExecuteAction(testEvent(t, "EXPORT cave"), gm)
+	if sent := sentToTestClient(gm); len(sent) != 1 || sent[0] != "// {Map exported to cave.map (1 objects, 2 regions).}" {
+		t.Errorf("EXPORT gave %q", sent)
+	}
+	if _, err := os.Stat(filepath.Join(ms.MapExportDir, "cave"+RegionFileSuffix)); err != nil {
+		t.Errorf("region file not written: %v", err)
+	}
+
+	ms.ExecuteAction(testEvent(t, "RG- r1"), gm)
+	ms.ExecuteAction(testEvent(t, "RG- r2"), gm)
+	sentToTestClient(alice)
+	ms.ExecuteAction(testEvent(t, "SCENE cave"), gm)
+	if sent := sentToTestClient(gm); len(sent) == 0 || sent[len(sent)-1] != "// {Scene cave deployed (1 objects, 0 images, 2 regions).}" {
+		t.Errorf("SCENE gave %q", sent)
+	}
+	if regions := ms.Regions(true); len(regions) != 2 || regions[0].Note != "pit trap DC 20" || !regions[1].Revealed {
+		t.Errorf("regions deployed were %v", regions)
+	}
+	if sent := strings.Join(sentToTestClient(alice), "\n"); strings.Contains(sent, "Trap") || !strings.Contains(sent, "RG r2 Altar") {
+		t.Errorf("player was sent %q", sent)
+	}
+
+	// without regions, the region file goes away
+	ms.ExecuteAction(testEvent(t, "RG- r1"), gm)
+	ms.ExecuteAction(testEvent(t, "RG- r2"), gm)
+	ms.ExecuteAction(testEvent(t, "EXPORT cave"), gm)
+	if _, err := os.Stat(filepath.Join(ms.MapExportDir, "cave"+RegionFileSuffix)); !os.IsNotExist(err) {
+		t.Errorf("region file still there (%v)", err)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
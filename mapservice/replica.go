@@ -0,0 +1,481 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Standby servers                                   //
+//                                                                                    //
+// A standby server mirrors the game state of a primary server through its journal,   //
+// so that it can take over if the primary fails during a long game.                  //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ReplicaPath is where a server with a journal offers it to standby
+// servers which mirror its game state.
+//
+const ReplicaPath = "/api/v1/replica"
+
+//
+// ReplicaKeepAlive is how often the primary server tells an idle
+// standby that it's still there.
+//
+const ReplicaKeepAlive = 5 * time.Second
+
+//
+// ReplicaTimeout is how long a standby waits to hear from the primary
+// before it gives up on the connection and makes a new one.
+//
+const ReplicaTimeout = 3 * ReplicaKeepAlive
+
+//
+// ReplicaRetry is how long a standby waits between attempts to
+// connect to the primary.
+//
+const ReplicaRetry = 2 * time.Second
+
+//
+// ReplicaBacklog is how many journal entries may wait to be sent to a
+// standby before we give up on it (and it has to start over).
+//
+const ReplicaBacklog = 1024
+
+//
+// Start sending new journal entries to a standby.
+//
+func (j *Journal) follow() chan JournalEntry {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.followers == nil {
+		j.followers = make(map[chan JournalEntry]bool)
+	}
+	ch := make(chan JournalEntry, ReplicaBacklog)
+	if j.closed {
+		close(ch)
+	} else {
+		j.followers[ch] = true
+	}
+	return ch
+}
+
+func (j *Journal) unfollow(ch chan JournalEntry) {
+	j.lock.Lock()
+	j.unfollowLocked(ch)
+	j.lock.Unlock()
+}
+
+//
+// Stop sending entries to a standby, closing its channel to tell it
+// so. Called with j.lock held.
+//
+func (j *Journal) unfollowLocked(ch chan JournalEntry) {
+	if j.followers[ch] {
+		delete(j.followers, ch)
+		close(ch)
+	}
+}
+
+//
+// Send a new entry to every standby, dropping any which have fallen
+// too far behind. Called with j.lock held.
+//
+func (j *Journal) publish(entry JournalEntry) {
+	for ch := range j.followers {
+		select {
+			case ch <- entry:
+			default:
+				log.Printf("Journal %s: a standby server fell %d entries behind; dropping it", j.path, ReplicaBacklog)
+				j.unfollowLocked(ch)
+		}
+	}
+}
+
+//
+// The game state as journal entries to bring a standby up to date,
+// beginning with a "reset" entry, and the channel on which the entries
+// made after them will be sent. Taking both with the state locked means
+// no change can fall between them.
+//
+func (gs *GameState) replicaSnapshot(j *Journal) ([]JournalEntry, chan JournalEntry) {
+	gs.rlockAll()
+	defer gs.runlockAll()
+
+	follow := j.follow()
+	entries := []JournalEntry{{N: j.Mark(), Op: "reset"}}
+	events := gs.allEvents()
+	sort.Sort(events)
+	for _, event := range events {
+		entry, err := eventJournalEntry(event, event.ID, event.Class)
+		if err != nil {
+			log.Printf("Unable to send %v to a standby server: %v", event.Fields, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	for _, image := range gs.Images {
+		image := image
+		entries = append(entries, JournalEntry{Op: "image", Image: &image})
+	}
+	return entries, follow
+}
+
+//
+// Forget the map (but not the chat history, which isn't mirrored)
+// before taking on the primary server's.
+//
+func (gs *GameState) resetMap() {
+	gs.lockAll()
+	chat := gs.ChatHistory
+	gs.reset()
+	gs.ChatHistory = chat
+	gs.unlockAll()
+	gs.markChanged()
+}
+
+//
+// GET /api/v1/replica
+// A stream of journal entries (see JournalEntry), one JSON object per
+// line, for a standby server to mirror this one. It begins with a
+// "reset" entry and the whole game state, then sends each change as
+// it is made, and a "ping" entry every ReplicaKeepAlive when there
+// aren't any. This server must have a journal (see --journal).
+//
+func (ms *MapService) apiReplica(w http.ResponseWriter, r *http.Request, t APIToken) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apiError(w, http.StatusInternalServerError, "streaming is not supported here")
+		return
+	}
+	if ms.standby.mirroring() {
+		apiError(w, http.StatusConflict, "this server is itself a standby")
+		return
+	}
+	if ms.Journal == nil {
+		apiError(w, http.StatusConflict, "this server has no journal to mirror")
+		return
+	}
+
+	entries, follow := ms.State.replicaSnapshot(ms.Journal)
+	defer ms.Journal.unfollow(follow)
+	log.Printf("[api] standby server %s (token %s) is mirroring the game state", r.RemoteAddr, t.Name)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	out := json.NewEncoder(w)
+	for _, entry := range entries {
+		if out.Encode(entry) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(ReplicaKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+			case entry, ok := <-follow:
+				if !ok {
+					return
+				}
+				err = out.Encode(entry)
+			case <-keepAlive.C:
+				err = out.Encode(JournalEntry{Op: "ping"})
+			case <-r.Context().Done():
+				return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+//
+// standbyState tracks how a standby server is getting on with
+// mirroring the primary.
+//
+type standbyState struct {
+	lock        sync.Mutex
+	running     bool      // are we mirroring (and not yet promoted)?
+	promoted    bool      // were we a standby which took over?
+	promote     chan bool // closed to promote us
+	connected   bool      // are we receiving the primary's journal now?
+	mirrored    bool      // have we ever?
+	lastContact time.Time // when we last heard from the primary
+	mark        int64     // last journal entry we have from the primary
+}
+
+func (s *standbyState) mirroring() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.running
+}
+
+func (s *standbyState) wasPromoted() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.promoted
+}
+
+func (s *standbyState) heard(entry JournalEntry) {
+	s.lock.Lock()
+	s.connected, s.mirrored = true, true
+	s.lastContact = time.Now()
+	if entry.N > 0 {
+		s.mark = entry.N
+	}
+	s.lock.Unlock()
+}
+
+//
+// APIStandby is how a server is getting on as a standby.
+//
+type APIStandby struct {
+	Standby     bool       `json:"standby"`                // is this server a standby now?
+	Promoted    bool       `json:"promoted"`               // was it one which took over?
+	Primary     string     `json:"primary,omitempty"`      // the server it mirrors (or mirrored)
+	Connected   bool       `json:"connected"`              // is it receiving the primary's journal now?
+	LastContact *time.Time `json:"last_contact,omitempty"` // when it last heard from the primary
+	Mark        int64      `json:"mark"`                   // last journal entry it has from the primary
+}
+
+//
+// StandbyStatus reports how the server is getting on as a standby.
+//
+func (ms *MapService) StandbyStatus() APIStandby {
+	ms.standby.lock.Lock()
+	defer ms.standby.lock.Unlock()
+	status := APIStandby{
+		Standby:   ms.standby.running,
+		Promoted:  ms.standby.promoted,
+		Primary:   ms.StandbyOf,
+		Connected: ms.standby.connected,
+		Mark:      ms.standby.mark,
+	}
+	if !ms.standby.lastContact.IsZero() {
+		contact := ms.standby.lastContact
+		status.LastContact = &contact
+	}
+	return status
+}
+
+//
+// RunStandby mirrors the game state of the primary server at StandbyOf
+// (the base URL of its HTTP API, authenticating with StandbyToken)
+// until this server is promoted to take its place, either by calling
+// Promote or, if FailoverAfter is set, when the primary has been
+// unreachable for that long. Only then does it return, after which
+// the server should start listening for clients and call Run.
+//
+// A standby never takes over automatically unless it has mirrored
+// the primary at least once, so it can't replace a game it has never
+// seen with an empty one.
+//
+func (ms *MapService) RunStandby() {
+	if ms.State == nil {
+		ms.State = NewGameState()
+	}
+	ms.standby.lock.Lock()
+	ms.standby.running = true
+	ms.standby.promote = make(chan bool)
+	promote := ms.standby.promote
+	ms.standby.lastContact = time.Time{}
+	ms.standby.lock.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-promote
+		cancel()
+	}()
+
+	started := time.Now()
+	for {
+		log.Printf("Standby: mirroring the game state of %s", ms.StandbyOf)
+		err := ms.mirror(ctx)
+		ms.standby.lock.Lock()
+		ms.standby.connected = false
+		mirrored, lastContact := ms.standby.mirrored, ms.standby.lastContact
+		ms.standby.lock.Unlock()
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("Standby: lost contact with %s: %v", ms.StandbyOf, err)
+		if lastContact.IsZero() {
+			lastContact = started
+		}
+		if ms.FailoverAfter > 0 && mirrored && time.Since(lastContact) >= ms.FailoverAfter {
+			log.Printf("Standby: nothing from %s for %v; taking over", ms.StandbyOf, time.Since(lastContact).Round(time.Second))
+			ms.Promote()
+			break
+		}
+		select {
+			case <-time.After(ReplicaRetry):
+			case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	log.Printf("Standby: promoted to take over from %s", ms.StandbyOf)
+}
+
+//
+// Promote a standby server to take over from the primary. Returns false
+// if the server isn't a standby.
+//
+func (ms *MapService) Promote() bool {
+	ms.standby.lock.Lock()
+	defer ms.standby.lock.Unlock()
+	if !ms.standby.running {
+		return false
+	}
+	ms.standby.running = false
+	ms.standby.promoted = true
+	close(ms.standby.promote)
+	return true
+}
+
+//
+// Mirror the primary's game state until the connection to it fails or
+// we are promoted.
+//
+func (ms *MapService) mirror(parent context.Context) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(ms.StandbyOf, "/")+ReplicaPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+ms.StandbyToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var reply struct{ Error string `json:"error"` }
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		json.Unmarshal(body, &reply)
+		return fmt.Errorf("the primary refused to be mirrored (%s): %s", resp.Status, reply.Error)
+	}
+
+	watchdog := time.AfterFunc(ReplicaTimeout, cancel)
+	defer watchdog.Stop()
+	in := bufio.NewReader(resp.Body)
+	for {
+		line, err := in.ReadBytes('\n')
+		if err != nil {
+			if ctx.Err() != nil && parent.Err() == nil {
+				return fmt.Errorf("nothing received for %v", ReplicaTimeout)
+			}
+			return err
+		}
+		watchdog.Reset(ReplicaTimeout)
+		var entry JournalEntry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("unreadable journal entry: %v", err)
+		}
+		ms.standby.heard(entry)
+		if err = ms.applyReplica(entry); err != nil {
+			log.Printf("Standby: skipping journal entry %d: %v", entry.N, err)
+		}
+	}
+}
+
+func (ms *MapService) applyReplica(entry JournalEntry) error {
+	switch entry.Op {
+		case "ping":
+			return nil
+		case "reset":
+			log.Printf("Standby: receiving the game state of %s", ms.StandbyOf)
+			ms.State.resetMap()
+			return nil
+	}
+	return ms.State.replayJournal(entry)
+}
+
+//
+// GET /api/v1/standby
+//   how the server is getting on as a standby (an APIStandby)
+// POST /api/v1/standby
+//   promote a standby server to take over from the primary
+//
+func (ms *MapService) apiStandby(w http.ResponseWriter, r *http.Request, t APIToken) {
+	if r.Method == http.MethodPost {
+		if !ms.Promote() {
+			apiError(w, http.StatusConflict, "this server is not a standby")
+			return
+		}
+		log.Printf("[api] %s promoted this standby server to take over", t.Name)
+	}
+	writeJSON(w, http.StatusOK, ms.StandbyStatus())
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,211 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for standby servers
+//
+
+package mapservice
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func replicaTestServer(t *testing.T, name string) (*MapService, string) {
+	dir := t.TempDir()
+	storage, err := OpenStorageBackend("sqlite", filepath.Join(dir, name+".db"))
+	if err != nil {
+		t.Fatalf("unable to open database: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	ms := &MapService{Storage: storage, State: NewGameState()}
+	_, token, err := ms.issueAPIToken(name, ScopeAdmin, 0)
+	if err != nil {
+		t.Fatalf("unable to issue token: %v", err)
+	}
+	return ms, token
+}
+
+func waitForReplica(t *testing.T, what string, ok func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStandby(t *testing.T) {
+	primary, token := replicaTestServer(t, "primary")
+	if status, reply := apiTestRequest(t, primary, "GET", ReplicaPath, token, ""); status != 409 {
+		t.Errorf("mirroring without a journal got %d %v", status, reply)
+	}
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatalf("unable to open journal: %v", err)
+	}
+	defer journal.Close()
+	primary.Journal = journal
+	primary.State.SetJournal(journal)
+	primary.UpdateState(testEvent(t, "PS abc red Grax 1 M monster 3 4 0"))
+	primary.UpdateState(testEvent(t, "CS 12 0"))
+	primary.State.SetImageLocation("goblin", "1", "/images/goblin.png")
+	srv := httptest.NewServer(primary.HTTPHandler())
+	defer srv.Close()
+
+	standby, standbyToken := replicaTestServer(t, "standby")
+	standby.UpdateState(testEvent(t, "PS old red Old 1 M monster 1 1 0"))
+	standby.StandbyOf, standby.StandbyToken = srv.URL, token
+	done := make(chan bool)
+	go func() {
+		standby.RunStandby()
+		close(done)
+	}()
+
+	// it gets the whole state, then each change
+	waitForReplica(t, "the state", func() bool { _, ok := standby.State.Object("abc"); return ok })
+	if _, ok := standby.State.Object("old"); ok {
+		t.Errorf("standby kept its own map")
+	}
+	if _, ok := standby.State.ImageLocation("goblin", "1"); !ok {
+		t.Errorf("standby didn't get the images")
+	}
+	primary.UpdateState(testEvent(t, "OA abc {GX 10}"))
+	primary.State.ClearObjects("*")
+	primary.UpdateState(testEvent(t, "PS def red Fred 1 M monster 5 4 0"))
+	waitForReplica(t, "the changes", func() bool { _, ok := standby.State.Object("def"); return ok })
+	if _, ok := standby.State.Object("abc"); ok || standby.State.Clock().String() != primary.State.Clock().String() {
+		t.Errorf("standby has clock %v, primary %v", standby.State.Clock(), primary.State.Clock())
+	}
+	status := standby.StandbyStatus()
+	if !status.Standby || !status.Connected || status.Mark != journal.Mark() || status.Primary != srv.URL {
+		t.Errorf("standby status %+v", status)
+	}
+	if status, reply := apiTestRequest(t, standby, "GET", ReplicaPath, standbyToken, ""); status != 409 {
+		t.Errorf("mirroring a standby got %d %v", status, reply)
+	}
+
+	// promoted by hand
+	if status, reply := apiTestRequest(t, standby, "POST", "/api/v1/standby", standbyToken, ""); status != 200 || reply["promoted"] != true || reply["standby"] != false {
+		t.Errorf("promotion got %d %v", status, reply)
+	}
+	select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("standby didn't stop mirroring when promoted")
+	}
+	if status, _ := apiTestRequest(t, standby, "POST", "/api/v1/standby", standbyToken, ""); status != 409 {
+		t.Errorf("second promotion got %d", status)
+	}
+	if status, reply := apiTestRequest(t, primary, "GET", "/api/v1/standby", token, ""); status != 200 || reply["standby"] != false || reply["promoted"] != false {
+		t.Errorf("primary standby status %d %v", status, reply)
+	}
+}
+
+func TestStandbyFailover(t *testing.T) {
+	primary, token := replicaTestServer(t, "primary")
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatalf("unable to open journal: %v", err)
+	}
+	defer journal.Close()
+	primary.Journal = journal
+	primary.State.SetJournal(journal)
+	primary.UpdateState(testEvent(t, "PS abc red Grax 1 M monster 3 4 0"))
+	srv := httptest.NewServer(primary.HTTPHandler())
+
+	standby, _ := replicaTestServer(t, "standby")
+	standby.StandbyOf, standby.StandbyToken, standby.FailoverAfter = srv.URL, token, 10*time.Millisecond
+	done := make(chan bool)
+	go func() {
+		standby.RunStandby()
+		close(done)
+	}()
+	waitForReplica(t, "the state", func() bool { _, ok := standby.State.Object("abc"); return ok })
+
+	// the primary goes away
+	srv.CloseClientConnections()
+	srv.Close()
+	select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("standby didn't take over")
+	}
+	if status := standby.StandbyStatus(); status.Standby || !status.Promoted || status.Connected {
+		t.Errorf("standby status %+v", status)
+	}
+	if _, ok := standby.State.Object("abc"); !ok {
+		t.Errorf("standby lost the map when it took over")
+	}
+}
+
+func TestStandbyNeverMirrored(t *testing.T) {
+	standby := &MapService{State: NewGameState(), StandbyOf: "http://127.0.0.1:1", FailoverAfter: time.Millisecond}
+	done := make(chan bool)
+	go func() {
+		standby.RunStandby()
+		close(done)
+	}()
+	select {
+		case <-done:
+			t.Fatalf("standby took over without ever mirroring the primary")
+		case <-time.After(3 * ReplicaRetry / 2):
+	}
+	standby.Promote()
+	<-done
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,129 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                Die-roll rate limits                                //
+//                                                                                    //
+// Holding each user to a configurable number of die rolls per minute, so nobody can  //
+// keep the server busy rolling dice.                                                 //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//
+// rollRateLimiter keeps track of when each user made their recent
+// die rolls, so we can hold each user to a maximum number of rolls
+// per minute.
+//
+type rollRateLimiter struct {
+	lock   sync.Mutex
+	recent map[string][]time.Time
+}
+
+//
+// Record that a user wants to make n more die rolls at time now.
+// If that would go over the limit for the past minute, nothing is
+// recorded and an error explains when they may try again.
+//
+func (r *rollRateLimiter) allow(user string, n, limit int, now time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.recent == nil {
+		r.recent = make(map[string][]time.Time)
+	}
+	times := r.recent[user]
+	for len(times) > 0 && now.Sub(times[0]) >= time.Minute {
+		times = times[1:]
+	}
+	if n > limit {
+		r.recent[user] = times
+		return fmt.Errorf("That is more than the %d die rolls allowed per minute", limit)
+	}
+	if len(times)+n > limit {
+		r.recent[user] = times
+		wait := times[len(times)+n-limit-1].Add(time.Minute).Sub(now)
+		return fmt.Errorf("You have made too many die rolls in the last minute (the limit is %d); try again in %d second%s",
+			limit, int(wait.Seconds()+0.999), plural(int(wait.Seconds()+0.999)))
+	}
+	for i := 0; i < n; i++ {
+		times = append(times, now)
+	}
+	r.recent[user] = times
+	return nil
+}
+
+//
+// Check if a client may make n more die rolls under the server's
+// per-minute limit. If not, the client is told why and we return false.
+//
+func (ms *MapService) checkRollRate(thisClient *MapClient, n int) bool {
+	if ms.MaxRollsPerMinute <= 0 {
+		return true
+	}
+	if err := ms.rollRate.allow(thisClient.Username(), n, ms.MaxRollsPerMinute, time.Now()); err != nil {
+		thisClient.sendError("die roll request not accepted: %v", err)
+		ms.securityEvent(SecurityRateLimit, thisClient.Username(), thisClient.ClientAddr, err.Error())
+		return false
+	}
+	return true
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
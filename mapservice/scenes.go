@@ -0,0 +1,232 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                       Scenes                                       //
+//                                                                                    //
+// Putting a prepared map (such as one imported from another tabletop) onto           //
+// everyone's map at once, with the images its tiles need.                            //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//
+// ReadMapFile reads objects from a GMA .map file (as written by
+// WriteMapFile), returning the comment from its header along with them.
+//
+func ReadMapFile(r io.Reader) (string, []MapObject, error) {
+	var comment string
+	var order []string
+	objects := make(map[string]*MapObject)
+
+	in := bufio.NewScanner(r)
+	in.Buffer(nil, DefaultMaxMessageSize)
+	for n := 1; in.Scan(); n++ {
+		line := strings.TrimSpace(in.Text())
+		if line == "" {
+			continue
+		}
+		if n == 1 {
+			if !strings.HasPrefix(line, "__MAPPER__:") {
+				return "", nil, fmt.Errorf("Not a GMA map file")
+			}
+			if i := strings.IndexByte(line, ' '); i > 0 {
+				if header, err := ParseTclList(line[i+1:]); err == nil && len(header) > 0 {
+					if fields, err := ParseTclList(header[0]); err == nil && len(fields) > 0 {
+						comment = fields[0]
+					}
+				}
+			}
+			continue
+		}
+		item, err := ParseTclList(line)
+		if err != nil {
+			return "", nil, fmt.Errorf("Map file line %d: %v", n, err)
+		}
+		if len(item) == 0 {
+			continue
+		}
+		id, class, attr, value, err := parseObjectItem(item)
+		if err != nil {
+			return "", nil, fmt.Errorf("Map file line %d: %v", n, err)
+		}
+		obj, ok := objects[id]
+		if !ok {
+			obj = NewMapObject(id, class)
+			objects[id] = obj
+			order = append(order, id)
+		}
+		if obj.Class == "" {
+			obj.Class = class
+		}
+		if attr == "" {
+			obj.Extra = append(obj.Extra, line)
+		} else {
+			obj.Attrs[attr] = value
+		}
+	}
+	if err := in.Err(); err != nil {
+		return "", nil, err
+	}
+	var list []MapObject
+	for _, id := range order {
+		list = append(list, *objects[id])
+	}
+	return comment, list, nil
+}
+
+//
+// Image files we'll look for next to a scene's .map file, for the tiles
+// on it which need them.
+//
+var sceneImageExtensions = []string{".png", ".webp", ".jpg", ".gif", ".img"}
+
+//
+// Put the objects from a .map file in the MapExportDir (such as one
+// imported from another tabletop) onto everyone's map, along with any
+// images for its tiles found next to it, and the regions and ambient
+// effects saved with it. Returns the number of objects, images, and
+// regions sent.
+//
+func (ms *MapService) deployScene(name string) (int, int, int, error) {
+	if ms.MapExportDir == "" {
+		return 0, 0, 0, fmt.Errorf("map export is not enabled on this server")
+	}
+	if !mapFileName.MatchString(name) {
+		return 0, 0, 0, fmt.Errorf("map file name \"%s\" may only contain letters, digits, underscores, hyphens and dots", name)
+	}
+	if !strings.HasSuffix(name, ".map") {
+		name += ".map"
+	}
+	path := filepath.Join(ms.MapExportDir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	_, objects, err := ReadMapFile(f)
+	f.Close()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	//
+	// Send the images first, so the tiles have them when they arrive.
+	// They come from the server itself, so nobody is skipped as the
+	// sender.
+	//
+	server := &MapClient{}
+	images := 0
+	sent := make(map[string]bool)
+	for _, obj := range objects {
+		image := obj.Attrs["IMAGE"]
+		if obj.Attrs["TYPE"] != "tile" || image == "" || sent[image] || !mapFileName.MatchString(image) {
+			continue
+		}
+		sent[image] = true
+		for _, ext := range sceneImageExtensions {
+			if data, err := os.ReadFile(filepath.Join(ms.MapExportDir, image+ext)); err == nil {
+				relayImage(ms, server, image, "1", data)
+				images++
+				break
+			}
+		}
+	}
+
+	var events []*MapEvent
+	var definitions [][]string
+	for i := range objects {
+		event, err := objects[i].LoadEvent()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		definition, err := objects[i].Definition()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		events = append(events, event)
+		definitions = append(definitions, definition)
+	}
+	for _, event := range events {
+		ms.UpdateState(event)
+	}
+	for _, peer := range ms.Clients.Subscribers("LS") {
+		peer.beginBulk()
+		transfer := peer.startTransfer("LS", "LS")
+		for i, obj := range objects {
+			if peer.IsGM() || !ms.isGMLayer(obj.Attrs["LAYER"]) {
+				for _, line := range definitions[i] {
+					transfer.Send(line)
+				}
+			}
+		}
+		transfer.Finish()
+		peer.endBulk()
+	}
+	regions, err := ms.deployRegionFile(path)
+	if err != nil {
+		return len(objects), images, 0, err
+	}
+	return len(objects), images, regions, ms.deployEffectsFile(path)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
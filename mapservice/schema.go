@@ -0,0 +1,222 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Protocol Schema                                   //
+//                                                                                    //
+// A machine-readable description (as JSON Schema) of every message this server       //
+// understands, for generating client code and checking a client against the exact    //
+// version of the server it's talking to.                                             //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// SchemaDialect is the version of JSON Schema our protocol schema is
+// written in.
+//
+const SchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+//
+// SchemaPath is where the HTTP API serves the protocol schema.
+//
+const SchemaPath = "/api/v1/schema"
+
+//
+// Each message is a Tcl list, so in the schema it is described as the
+// array of its fields, all strings, the first being the message type.
+// The names of the fields are taken from the message's syntax (see
+// map_event_parameters); those in brackets are optional, and a message
+// whose syntax ends in "..." may have any number more.
+//
+// Besides what JSON Schema itself defines, each message says whether
+// only the GM may send it (x-gma-gm-only), whether only the server
+// sends it (x-gma-server-only), and whether it is added to the game
+// state (x-gma-records-event). Messages added by extensions (see
+// RegisterMessageHandler) are included too, though we know nothing of
+// their fields but how many there may be.
+//
+type MessageSchema struct {
+	Type        string        `json:"type"`
+	Description string        `json:"description,omitempty"`
+	PrefixItems []FieldSchema `json:"prefixItems"`
+	Items       interface{}   `json:"items"`
+	MinItems    int           `json:"minItems"`
+	MaxItems    *int          `json:"maxItems,omitempty"`
+	GMOnly      bool          `json:"x-gma-gm-only,omitempty"`
+	ServerOnly  bool          `json:"x-gma-server-only,omitempty"`
+	Records     bool          `json:"x-gma-records-event,omitempty"`
+}
+
+//
+// FieldSchema describes one field of a message.
+//
+type FieldSchema struct {
+	Const string `json:"const,omitempty"`
+	Title string `json:"title,omitempty"`
+	Type  string `json:"type"`
+}
+
+//
+// ProtocolSchema is a JSON Schema which any message of our protocol
+// matches, with a definition of each message type.
+//
+type ProtocolSchema struct {
+	Schema      string                   `json:"$schema"`
+	ID          string                   `json:"$id"`
+	Title       string                   `json:"title"`
+	Version     string                   `json:"version"`
+	OneOf       []map[string]string      `json:"oneOf"`
+	Definitions map[string]MessageSchema `json:"$defs"`
+}
+
+//
+// The schema of one message type, from what we know about it.
+//
+func messageSchema(msgType string, params map_event_parameters, checked bool, handler MessageHandler, handled bool) MessageSchema {
+	m := MessageSchema{
+		Type:        "array",
+		Description: params.Syntax,
+		PrefixItems: []FieldSchema{{Const: msgType, Type: "string"}},
+		Items:       false,
+		MinItems:    1,
+		GMOnly:      handled && handler.Privilege == PrivGM,
+		ServerOnly:  handled && handler.ServerOnly,
+		Records:     handled && handler.RecordsEvent,
+	}
+	if !checked {
+		// we don't check these, so anything goes
+		m.Items = FieldSchema{Type: "string"}
+		return m
+	}
+
+	var names []string
+	if words := strings.Fields(params.Syntax); len(words) > 0 && words[0] == msgType {
+		names = words[1:]
+	}
+	for i := 0; i < params.MaxParams || (params.MaxParams < 0 && i < len(names)); i++ {
+		title := "field" + strconv.Itoa(i+1)
+		if i < len(names) {
+			title = strings.Trim(names[i], "[]")
+		}
+		if title == "..." {
+			break
+		}
+		m.PrefixItems = append(m.PrefixItems, FieldSchema{Title: title, Type: "string"})
+	}
+	m.MinItems = params.MinParams + 1
+	if params.MaxParams < 0 {
+		m.Items = FieldSchema{Type: "string"}
+	} else {
+		max := params.MaxParams + 1
+		m.MaxItems = &max
+	}
+	return m
+}
+
+//
+// Schema describes every message type this server knows.
+//
+func (ms *MapService) Schema() ProtocolSchema {
+	schema := ProtocolSchema{
+		Schema:      SchemaDialect,
+		ID:          "urn:gma:protocol:" + ms.ServerVersion,
+		Title:       "GMA mapper protocol",
+		Version:     ms.ServerVersion,
+		Definitions: make(map[string]MessageSchema),
+	}
+
+	handlerLock.RLock()
+	types := make(map[string]bool)
+	for msgType := range messageHandlers {
+		types[msgType] = true
+	}
+	for msgType := range map_event_checklist {
+		types[msgType] = true
+	}
+	for msgType := range types {
+		params, checked := map_event_checklist[msgType]
+		handler, handled := messageHandlers[msgType]
+		schema.Definitions[msgType] = messageSchema(msgType, params, checked, handler, handled)
+	}
+	handlerLock.RUnlock()
+
+	var names []string
+	for msgType := range schema.Definitions {
+		names = append(names, msgType)
+	}
+	sort.Strings(names)
+	for _, msgType := range names {
+		schema.OneOf = append(schema.OneOf, map[string]string{"$ref": "#/$defs/" + msgType})
+	}
+	return schema
+}
+
+//
+// GET /api/v1/schema
+//
+// The protocol schema (see Schema). Since it says nothing about the
+// game, anyone may have it.
+//
+func (ms *MapService) apiSchema(w http.ResponseWriter, r *http.Request, t APIToken) {
+	writeJSON(w, http.StatusOK, ms.Schema())
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
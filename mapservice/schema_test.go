@@ -0,0 +1,136 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the protocol schema
+//
+
+package mapservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMessageSchema(t *testing.T) {
+	schema := newTestService().Schema()
+	if schema.Schema != SchemaDialect || len(schema.OneOf) != len(schema.Definitions) {
+		t.Errorf("schema is %s with %d of %d messages listed", schema.Schema, len(schema.OneOf), len(schema.Definitions))
+	}
+
+	to, ok := schema.Definitions["TO"]
+	if !ok {
+		t.Fatalf("no schema for TO")
+	}
+	var titles []string
+	for _, field := range to.PrefixItems[1:] {
+		titles = append(titles, field.Title)
+	}
+	if to.PrefixItems[0].Const != "TO" || !reflect.DeepEqual(titles, []string{"from", "recip", "message", "id", "time"}) {
+		t.Errorf("TO fields are %v", to.PrefixItems)
+	}
+	if to.MinItems != 4 || to.MaxItems == nil || *to.MaxItems != 6 || to.Items != false {
+		t.Errorf("TO may have %d to %v fields (items %v)", to.MinItems, to.MaxItems, to.Items)
+	}
+
+	if comment := schema.Definitions["//"]; comment.MinItems != 1 || comment.MaxItems != nil || comment.Items != (FieldSchema{Type: "string"}) {
+		t.Errorf("comment schema is %+v", comment)
+	}
+	if co := schema.Definitions["CO"]; !co.GMOnly || co.ServerOnly {
+		t.Errorf("CO schema is %+v", co)
+	}
+	if ps := schema.Definitions["PS"]; !ps.Records || ps.GMOnly {
+		t.Errorf("PS schema is %+v", ps)
+	}
+	if conn, ok := schema.Definitions["CONN:"]; !ok || !conn.ServerOnly || conn.Items == false {
+		t.Errorf("CONN: schema is %+v", conn)
+	}
+
+	RegisterMessageHandler("TEST-SCHEMA", 1, 2, MessageHandler{Handle: handleIgnored})
+	defer func() {
+		handlerLock.Lock()
+		delete(messageHandlers, "TEST-SCHEMA")
+		handlerLock.Unlock()
+		delete(map_event_checklist, "TEST-SCHEMA")
+	}()
+	ext := newTestService().Schema().Definitions["TEST-SCHEMA"]
+	if len(ext.PrefixItems) != 3 || ext.PrefixItems[1].Title != "field1" || ext.PrefixItems[2].Title != "field2" || ext.MinItems != 2 {
+		t.Errorf("extension message schema is %+v", ext)
+	}
+}
+
+func TestSchemaAPI(t *testing.T) {
+	ms := newTestService()
+	ms.ServerVersion = "1.2.3"
+	w := httptest.NewRecorder()
+	ms.HTTPHandler().ServeHTTP(w, httptest.NewRequest("GET", SchemaPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("schema request without a token gave status %d", w.Code)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &schema); err != nil {
+		t.Fatalf("schema %q not understood: %v", w.Body.String(), err)
+	}
+	if schema["version"] != "1.2.3" || schema["$schema"] != SchemaDialect {
+		t.Errorf("schema is for version %v in %v", schema["version"], schema["$schema"])
+	}
+	defs, _ := schema["$defs"].(map[string]interface{})
+	seq, _ := defs["SEQ"].(map[string]interface{})
+	if seq["minItems"] != 2.0 || seq["maxItems"] != 2.0 || seq["items"] != false {
+		t.Errorf("SEQ schema is %v", seq)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,346 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                 Security event log                                 //
+//                                                                                    //
+// Keeping track of failed logins, attempts to do things people aren't allowed to,    //
+// and rate limits being hit, so a server exposed to the internet notices when it is  //
+// being attacked, and can alert its operator through a webhook.                      //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//
+// Kinds of security events.
+//
+const (
+	SecurityAuthFailure = "auth-failure" // a login or API token was refused
+	SecurityPrivilege   = "privilege"    // someone tried something they aren't allowed to do
+	SecurityRateLimit   = "rate-limit"   // someone went over a rate limit
+	SecurityMemoryLimit = "memory-limit" // a client tried to make us hold too much data
+)
+
+//
+// Unless the server says otherwise, we send an alert when this many
+// security events of the same kind happen within the alert window.
+//
+const DefaultSecurityAlertThreshold = 10
+const DefaultSecurityAlertWindow = 5 * time.Minute
+
+//
+// MaxSecurityEvents is how many security events we keep in memory
+// when there is no database to put them in.
+//
+const MaxSecurityEvents = 500
+
+//
+// A SecurityEvent is something which happened on the server which
+// might mean someone is attacking it, such as a failed login.
+//
+type SecurityEvent struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`           // one of the Security* constants
+	User   string    `json:"user,omitempty"` // who they said they were, if we know
+	Source string    `json:"source"`         // network address it came from
+	Detail string    `json:"detail"`         // what happened
+}
+
+//
+// A SecurityAlert is what we POST (as JSON) to the AlertWebhook when
+// security events of one kind start piling up.
+//
+type SecurityAlert struct {
+	Campaign string        `json:"campaign,omitempty"`
+	Kind     string        `json:"kind"`
+	Count    int           `json:"count"`   // how many there were...
+	Window   float64       `json:"window"`  // ...in this many seconds
+	Sources  []string      `json:"sources"` // the addresses they came from
+	Latest   SecurityEvent `json:"latest"`
+	Time     time.Time     `json:"time"`
+}
+
+//
+// SecurityStorage is implemented by storage backends which can keep
+// the security event log.
+//
+type SecurityStorage interface {
+	AddSecurityEvent(e SecurityEvent) error
+	SecurityEvents(since time.Time, limit int) ([]SecurityEvent, error)
+}
+
+//
+// Database Schema
+//  ________________
+// | securityevents |
+// |----------------|
+// | id         P i |
+// | time         i |
+// | kind         s |
+// | user         s |
+// | source       s |
+// | detail       s |
+// |________________|
+//
+// P=primary key
+// i=integer
+// s=string
+//
+// The time is stored as seconds since the epoch.
+//
+func createSecurityTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists securityevents (
+			id     integer primary key,
+			time   integer not null,
+			kind   text    not null,
+			user   text    not null,
+			source text    not null,
+			detail text    not null
+		);`)
+	return err
+}
+
+//
+// AddSecurityEvent appends an event to the security log.
+//
+func AddSecurityEvent(db *sql.DB, e SecurityEvent) error {
+	if _, err := db.Exec(`insert into securityevents (time, kind, user, source, detail) values (?, ?, ?, ?, ?)`,
+		e.Time.Unix(), e.Kind, e.User, e.Source, e.Detail); err != nil {
+		return fmt.Errorf("Unable to save security event: %v", err)
+	}
+	return nil
+}
+
+//
+// SecurityEvents reads the most recent security events (up to limit
+// of them, if limit > 0) which happened at or after since, oldest first.
+//
+func SecurityEvents(db *sql.DB, since time.Time, limit int) ([]SecurityEvent, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := db.Query(`select time, kind, user, source, detail from (
+			select id, time, kind, user, source, detail from securityevents
+			where time >= ? order by id desc limit ?
+		) order by id`, since.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []SecurityEvent
+	for rows.Next() {
+		var e SecurityEvent
+		var when int64
+		if err = rows.Scan(&when, &e.Kind, &e.User, &e.Source, &e.Detail); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(when, 0)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+//
+// securityMonitor keeps the security events for servers without
+// a database, and watches for them piling up so we can raise the
+// alarm.
+//
+type securityMonitor struct {
+	lock    sync.Mutex
+	events  []SecurityEvent            // recent events, if we have nowhere else to keep them
+	recent  map[string][]SecurityEvent // events of each kind within the alert window
+	alerted map[string]time.Time       // when we last raised the alarm for each kind
+}
+
+//
+// Note a security event. If it brings the number of events of its
+// kind within the window up to the threshold, and we haven't already
+// raised the alarm about them within the window, an alert is returned.
+//
+func (m *securityMonitor) note(e SecurityEvent, keep bool, threshold int, window time.Duration) (SecurityAlert, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if keep {
+		m.events = append(m.events, e)
+		if len(m.events) > MaxSecurityEvents {
+			m.events = append([]SecurityEvent(nil), m.events[len(m.events)-MaxSecurityEvents:]...)
+		}
+	}
+	if m.recent == nil {
+		m.recent = make(map[string][]SecurityEvent)
+		m.alerted = make(map[string]time.Time)
+	}
+	recent := m.recent[e.Kind]
+	for len(recent) > 0 && e.Time.Sub(recent[0].Time) >= window {
+		recent = recent[1:]
+	}
+	recent = append(recent, e)
+	m.recent[e.Kind] = recent
+
+	if len(recent) < threshold {
+		return SecurityAlert{}, false
+	}
+	if last, ok := m.alerted[e.Kind]; ok && e.Time.Sub(last) < window {
+		return SecurityAlert{}, false
+	}
+	m.alerted[e.Kind] = e.Time
+
+	alert := SecurityAlert{
+		Kind:   e.Kind,
+		Count:  len(recent),
+		Window: window.Seconds(),
+		Latest: e,
+		Time:   e.Time,
+	}
+	seen := make(map[string]bool)
+	for _, r := range recent {
+		if !seen[r.Source] {
+			seen[r.Source] = true
+			alert.Sources = append(alert.Sources, r.Source)
+		}
+	}
+	return alert, true
+}
+
+//
+// The security events we've kept in memory at or after since.
+//
+func (m *securityMonitor) since(since time.Time) []SecurityEvent {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var events []SecurityEvent
+	for _, e := range m.events {
+		if !e.Time.Before(since) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+//
+// Record a security event in the server log and the security log
+// (in the database if we have one), and send an alert to the
+// AlertWebhook if too many of them are happening.
+//
+func (ms *MapService) securityEvent(kind, user, source, detail string) {
+	e := SecurityEvent{
+		Time:   time.Now(),
+		Kind:   kind,
+		User:   user,
+		Source: source,
+		Detail: detail,
+	}
+	log.Printf("SECURITY %s from %s (user %q): %s", kind, source, user, detail)
+
+	storage, stored := ms.Storage.(SecurityStorage)
+	if stored {
+		if err := storage.AddSecurityEvent(e); err != nil {
+			log.Printf("Unable to record security event: %v", err)
+		}
+	}
+	threshold, window := ms.AlertThreshold, ms.AlertWindow
+	if threshold <= 0 {
+		threshold = DefaultSecurityAlertThreshold
+	}
+	if window <= 0 {
+		window = DefaultSecurityAlertWindow
+	}
+	if alert, raised := ms.security.note(e, !stored, threshold, window); raised {
+		alert.Campaign = ms.Campaign
+		log.Printf("SECURITY ALERT: %d %s events from %d source%s in the last %v",
+			alert.Count, alert.Kind, len(alert.Sources), plural(len(alert.Sources)), window)
+		if ms.AlertWebhook != "" {
+			go ms.sendSecurityAlert(alert)
+		}
+	}
+}
+
+//
+// SecurityEventsSince returns the security events which happened at
+// or after since, oldest first (at most limit of them, if limit > 0).
+//
+func (ms *MapService) SecurityEventsSince(since time.Time, limit int) ([]SecurityEvent, error) {
+	if storage, ok := ms.Storage.(SecurityStorage); ok {
+		return storage.SecurityEvents(since, limit)
+	}
+	events := ms.security.since(since)
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events, nil
+}
+
+func (ms *MapService) sendSecurityAlert(alert SecurityAlert) {
+	defer ms.ReportCrash()
+	defer ms.goroutines.track("webhook", "security alert")()
+	if err := postWebhook(ms.AlertWebhook, alert); err != nil {
+		log.Printf("Unable to send security alert: %v", err)
+		return
+	}
+	log.Printf("Sent security alert about %s events", alert.Kind)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,205 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the security event log
+//
+
+package mapservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSecurityMonitor(t *testing.T) {
+	var m securityMonitor
+	now := time.Date(2020, 5, 1, 19, 0, 0, 0, time.UTC)
+	event := func(kind, source string, at time.Duration) SecurityEvent {
+		return SecurityEvent{Time: now.Add(at), Kind: kind, Source: source}
+	}
+
+	for i, e := range []SecurityEvent{
+		event(SecurityAuthFailure, "10.0.0.1:1000", 0),
+		event(SecurityAuthFailure, "10.0.0.1:1001", 10*time.Second),
+		event(SecurityRateLimit, "10.0.0.2:1000", 20*time.Second),
+	} {
+		if _, raised := m.note(e, true, 3, time.Minute); raised {
+			t.Errorf("alert raised on event %d", i)
+		}
+	}
+	alert, raised := m.note(event(SecurityAuthFailure, "10.0.0.1:1000", 30*time.Second), true, 3, time.Minute)
+	if !raised || alert.Kind != SecurityAuthFailure || alert.Count != 3 || alert.Window != 60 ||
+		len(alert.Sources) != 2 || alert.Sources[0] != "10.0.0.1:1000" || alert.Sources[1] != "10.0.0.1:1001" {
+		t.Errorf("alert was %v, %+v", raised, alert)
+	}
+	if _, raised = m.note(event(SecurityAuthFailure, "10.0.0.1:1000", 40*time.Second), true, 3, time.Minute); raised {
+		t.Errorf("alert raised again within the window")
+	}
+	if _, raised = m.note(event(SecurityAuthFailure, "10.0.0.3:1000", 80*time.Second), true, 3, time.Minute); raised {
+		t.Errorf("alert raised again within the window")
+	}
+	if _, raised = m.note(event(SecurityAuthFailure, "10.0.0.3:1000", 91*time.Second), true, 3, time.Minute); !raised {
+		t.Errorf("alert not raised again after the window")
+	}
+	if _, raised = m.note(event(SecurityAuthFailure, "10.0.0.3:1000", 10*time.Minute), true, 3, time.Minute); raised {
+		t.Errorf("alert raised for old events")
+	}
+	if n := len(m.since(now.Add(40 * time.Second))); n != 4 {
+		t.Errorf("%d events since 40s", n)
+	}
+}
+
+func TestSecurityEventStorage(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/security.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+
+	ms.securityEvent(SecurityAuthFailure, "alice", "10.0.0.1:1000", "login incorrect")
+	ms.securityEvent(SecurityRateLimit, "bob", "10.0.0.2:1000", "too many rolls")
+	ms.securityEvent(SecurityPrivilege, "bob", "10.0.0.2:1000", "sent GM-only command DF")
+	events, err := ms.SecurityEventsSince(time.Time{}, 2)
+	if err != nil {
+		t.Fatalf("unable to read events: %v", err)
+	}
+	if len(events) != 2 || events[0].Kind != SecurityRateLimit || events[1].Kind != SecurityPrivilege ||
+		events[1].User != "bob" || events[1].Source != "10.0.0.2:1000" || events[1].Detail != "sent GM-only command DF" {
+		t.Errorf("events were %+v", events)
+	}
+	if events, _ = ms.SecurityEventsSince(time.Now().Add(time.Hour), 0); len(events) != 0 {
+		t.Errorf("events from the future: %+v", events)
+	}
+	if len(ms.security.events) != 0 {
+		t.Errorf("events kept in memory as well as the database")
+	}
+}
+
+func TestSecurityAlerts(t *testing.T) {
+	received := make(chan SecurityAlert, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert SecurityAlert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("alert not understood: %v", err)
+		}
+		received <- alert
+	}))
+	defer hook.Close()
+
+	ms := newTestService()
+	ms.Campaign = "Test"
+	ms.AlertWebhook = hook.URL
+	ms.AlertThreshold = 2
+	player := newTestClient(ms, "alice", "alice", false)
+
+	ms.ExecuteAction(testEvent(t, "CO 1"), player)
+	ms.ExecuteAction(testEvent(t, "CO 1"), player)
+	select {
+	case alert := <-received:
+		if alert.Campaign != "Test" || alert.Kind != SecurityPrivilege || alert.Count != 2 ||
+			alert.Latest.User != "alice" || alert.Latest.Detail != "sent GM-only command CO" {
+			t.Errorf("alert was %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no alert received")
+	}
+
+	status, reply := apiTestRequest(t, ms, "GET", "/api/v1/security", "", "")
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("request without a database gave status %d %v", status, reply)
+	}
+	if events, _ := ms.SecurityEventsSince(time.Time{}, 0); len(events) != 2 {
+		t.Errorf("events were %+v", events)
+	}
+}
+
+func TestSecurityAPI(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/security.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	_, reader, _ := ms.issueAPIToken("status page", ScopeReadOnly, 0)
+	_, admin, _ := ms.issueAPIToken("admin", ScopeAdmin, 0)
+
+	apiTestRequest(t, ms, "GET", "/api/v1/clients", "bogus", "")
+	if status, _ := apiTestRequest(t, ms, "GET", "/api/v1/security", reader, ""); status != http.StatusForbidden {
+		t.Errorf("read-only token gave status %d", status)
+	}
+	status, reply := apiTestRequest(t, ms, "GET", "/api/v1/security?since=1h", admin, "")
+	events, _ := reply["events"].([]interface{})
+	if status != http.StatusOK || len(events) != 2 {
+		t.Fatalf("security log was %d %v", status, reply)
+	}
+	if kind := events[0].(map[string]interface{})["kind"]; kind != SecurityAuthFailure {
+		t.Errorf("first event was %v", events[0])
+	}
+	if kind := events[1].(map[string]interface{})["kind"]; kind != SecurityPrivilege {
+		t.Errorf("second event was %v", events[1])
+	}
+	if status, reply = apiTestRequest(t, ms, "GET", "/api/v1/security?limit=1", admin, ""); status != http.StatusOK || len(reply["events"].([]interface{})) != 1 {
+		t.Errorf("limited security log was %d %v", status, reply)
+	}
+	if status, _ = apiTestRequest(t, ms, "GET", "/api/v1/security?since=yesterday", admin, ""); status != http.StatusBadRequest {
+		t.Errorf("bad since gave status %d", status)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,283 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Sequence Numbers                                  //
+//                                                                                    //
+// Numbering the messages we send a client, for those which ask, and keeping the last //
+// few so a client which notices it has missed some can have them sent again.         //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// Unless configured otherwise, we keep the last DefaultReplayBuffer
+// numbered messages we sent each client, so we can send them again if
+// asked, but no more than ReplayBufferBytes of them.
+//
+const DefaultReplayBuffer = 1000
+const ReplayBufferBytes = 1024 * 1024
+
+//
+// A client may ask us to number the messages we send it with
+//
+//   SEQ 1
+//
+// We answer with the same message, and from that answer on, every line
+// we send begins with its sequence number (counting from 0) and a space:
+//
+//   0 SEQ 1
+//   1 TO alice * {Hello} 1234 1638000000000
+//   2 MARCO
+//   ...
+//
+// If the client sees a number missing, it can have the missing lines
+// sent again with
+//
+//   NAK SEQ <from> [<to>]
+//
+// (<to> defaults to the last line we sent). They are sent as they were
+// the first time, numbers and all, as soon as we can (without waiting
+// behind everything else queued for the client). If any of them are too old for us to still have, the client
+// is told so, and should SYNC to catch up instead.
+//
+// The client can stop the numbering with SEQ 0, which we answer with
+// SEQ 0, the first line sent without a number. Asking for SEQ 1 again
+// starts the count over from 0.
+//
+// Since the numbers are given as the lines are written to the client,
+// they are in the order it gets them, whichever part of the server
+// sent them.
+//
+type replayBuffer struct {
+	lock    sync.Mutex
+	on      bool          // are we numbering lines?
+	next    int           // number for the next line we send
+	lines   []string      // the last lines sent, oldest first (numbered next-len(lines) onward)
+	size    int           // total bytes in lines
+	resends []string      // lines to be sent again
+	wake    chan struct{} // tells backgroundSender there are lines to resend
+}
+
+//
+// The number of lines to keep in a client's replay buffer.
+//
+func (c *MapClient) replayLimit() int {
+	if c.Service == nil || c.Service.ReplayBuffer == 0 {
+		return DefaultReplayBuffer
+	}
+	if c.Service.ReplayBuffer < 0 {
+		return 0
+	}
+	return c.Service.ReplayBuffer
+}
+
+//
+// Called for each line as it is written to the client; returns the line
+// as it should go out (numbered, if we're numbering them), keeping up
+// to limit lines in case we're asked to resend them.
+//
+func (r *replayBuffer) number(message string, limit int) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch message {
+		case "SEQ 1":
+			r.on, r.next, r.lines, r.size = true, 0, nil, 0
+			if r.wake == nil {
+				r.wake = make(chan struct{}, 1)
+			}
+		case "SEQ 0":
+			r.on, r.lines, r.size, r.resends = false, nil, 0, nil
+	}
+	if !r.on {
+		return message
+	}
+	line := strconv.Itoa(r.next) + " " + message
+	r.next++
+	r.lines = append(r.lines, line)
+	r.size += len(line)
+	for len(r.lines) > 0 && (len(r.lines) > limit || r.size > ReplayBufferBytes) {
+		r.size -= len(r.lines[0])
+		r.lines = r.lines[1:]
+	}
+	return line
+}
+
+//
+// Arrange for the lines numbered from through to to be sent again,
+// as far as we still have them. If to is negative, we send everything
+// from onward. Returns the range of lines we no longer have (first > last
+// if we have them all), or ok=false if we aren't numbering lines at all.
+//
+func (r *replayBuffer) request(from, to int) (first, last int, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.on {
+		return 0, -1, false
+	}
+	if to < 0 || to >= r.next {
+		to = r.next - 1
+	}
+	oldest := r.next - len(r.lines)
+	if from < 0 {
+		from = 0
+	}
+	for n := from; n <= to; n++ {
+		if n >= oldest {
+			r.resends = append(r.resends, r.lines[n-oldest])
+		}
+	}
+	select {
+		case r.wake <- struct{}{}:
+		default:
+	}
+	if from < oldest {
+		last = oldest - 1
+		if to < last {
+			last = to
+		}
+		return from, last, true
+	}
+	return 0, -1, true
+}
+
+//
+// The lines waiting to be sent again.
+//
+func (r *replayBuffer) takeResends() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	resends := r.resends
+	r.resends = nil
+	return resends
+}
+
+//
+// The channel which tells backgroundSender there are lines to resend,
+// or nil if the client has never asked for its lines to be numbered.
+//
+func (r *replayBuffer) wakeup() <-chan struct{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.wake
+}
+
+//
+// Send the client the lines it asked to have again.
+//
+func (c *MapClient) writeResends() error {
+	for _, line := range c.replay.takeResends() {
+		if c.Service != nil && c.Service.WriteTimeout > 0 {
+			c.Connection.SetWriteDeadline(time.Now().Add(c.Service.WriteTimeout))
+		}
+		n, err := c.Connection.Write([]byte(line + "\n"))
+		c.countBandwidth(0, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// SEQ 0|1
+//
+// Stop or start numbering the lines we send this client.
+//
+func handleSequenceNumbers(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	switch event.Fields[1] {
+		case "0", "1":
+			// numbering changes as this is written (see replayBuffer)
+			thisClient.SendRaw("SEQ " + event.Fields[1])
+		default:
+			thisClient.sendError("SEQ must be 0 or 1, not \"%s\"", event.Fields[1])
+	}
+	return false
+}
+
+//
+// NAK SEQ <from> [<to>]
+//
+// The client missed the lines we numbered <from> through <to>.
+//
+func (c *MapClient) resendRequested(fields []string) {
+	from, err := strconv.Atoi(fields[0])
+	to := -1
+	if err == nil && len(fields) > 1 {
+		to, err = strconv.Atoi(fields[1])
+	}
+	if err != nil {
+		c.sendError("NAK SEQ needs sequence numbers: %v", err)
+		return
+	}
+	first, last, ok := c.replay.request(from, to)
+	if !ok {
+		c.sendError("lines aren't being numbered (send SEQ 1 to start)")
+		return
+	}
+	if first <= last {
+		log.Printf("[client %s] asked for lines %d-%d which are no longer held", c.logTag(), first, last)
+		c.sendError("lines %d-%d can no longer be sent again; SYNC to catch up", first, last)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
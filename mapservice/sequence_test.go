@@ -0,0 +1,188 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for sequence numbers and resending lines
+//
+
+package mapservice
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayBuffer(t *testing.T) {
+	var r replayBuffer
+	if line := r.number("MARCO", 3); line != "MARCO" {
+		t.Errorf("line numbered as %q before the client asked", line)
+	}
+	if _, _, ok := r.request(0, -1); ok {
+		t.Errorf("resend accepted before the client asked for numbering")
+	}
+	for i, expected := range []string{"0 SEQ 1", "1 a", "2 b", "3 c", "4 d"} {
+		message := strings.SplitN(expected, " ", 2)[1]
+		if line := r.number(message, 3); line != expected {
+			t.Errorf("line %d numbered as %q, not %q", i, line, expected)
+		}
+	}
+
+	if first, last, ok := r.request(3, 3); !ok || first <= last {
+		t.Errorf("resend of line 3 reported %d-%d missing (ok=%v)", first, last, ok)
+	}
+	if resends := r.takeResends(); len(resends) != 1 || resends[0] != "3 c" {
+		t.Errorf("resending line 3 sent %v", resends)
+	}
+	if first, last, ok := r.request(0, -1); !ok || first != 0 || last != 1 {
+		t.Errorf("resend of everything reported %d-%d missing (ok=%v), not 0-1", first, last, ok)
+	}
+	if resends := r.takeResends(); len(resends) != 3 || resends[0] != "2 b" || resends[2] != "4 d" {
+		t.Errorf("resending everything sent %v", resends)
+	}
+	select {
+		case <-r.wakeup():
+		default:
+			t.Errorf("sender wasn't woken to resend lines")
+	}
+
+	if line := r.number("SEQ 1", 3); line != "0 SEQ 1" {
+		t.Errorf("numbering didn't start over: %q", line)
+	}
+	if line := r.number("SEQ 0", 3); line != "SEQ 0" {
+		t.Errorf("SEQ 0 sent as %q", line)
+	}
+	if line := r.number("MARCO", 3); line != "MARCO" {
+		t.Errorf("line numbered as %q after numbering was turned off", line)
+	}
+}
+
+func TestSequenceResend(t *testing.T) {
+	ms := newTestService()
+	ms.ReplayBuffer = 4
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &MapClient{
+		Connection:    server,
+		ClientAddr:    "pipe",
+		Service:       ms,
+		Authenticated: true,
+		Auth:          &Authenticator{Username: "alice"},
+		CommChannel:   make(chan string, CommChannelBufferSize),
+		stopSending:   make(chan struct{}),
+		senderDone:    make(chan struct{}),
+	}
+	ms.Clients.Add(c)
+	lines := make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	go c.backgroundSender()
+	defer c.Close()
+
+	expect := func(expected ...string) {
+		t.Helper()
+		for _, e := range expected {
+			select {
+				case line := <-lines:
+					if line != e {
+						t.Fatalf("client got %q, not %q", line, e)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("client never got %q", e)
+			}
+		}
+	}
+
+	c.Send("//", "before")
+	ms.ExecuteAction(testEvent(t, "SEQ 1"), c)
+	for i := 0; i < 6; i++ {
+		c.Send("//", strconv.Itoa(i))
+	}
+	expect("// before", "0 SEQ 1", "1 // 0", "2 // 1", "3 // 2", "4 // 3", "5 // 4", "6 // 5")
+
+	ms.ExecuteAction(testEvent(t, "NAK SEQ 4 5"), c)
+	expect("4 // 3", "5 // 4")
+
+	// the resent lines go out ahead of the error, or not, as they may
+	ms.ExecuteAction(testEvent(t, "NAK SEQ 1"), c)
+	var resent []string
+	told := false
+	for len(resent) < 4 || !told {
+		select {
+			case line := <-lines:
+				if strings.HasPrefix(line, "7 TO alice alice {ERROR: lines 1-2 can no longer be sent again;") {
+					told = true
+				} else {
+					resent = append(resent, line)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("after resending %v, client was told=%v about the lines it can't have", resent, told)
+		}
+	}
+	if strings.Join(resent, "|") != "3 // 2|4 // 3|5 // 4|6 // 5" {
+		t.Errorf("client was sent %v again", resent)
+	}
+
+	ms.ExecuteAction(testEvent(t, "SEQ 0"), c)
+	c.Send("//", "after")
+	expect("SEQ 0", "// after")
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,140 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                    Server Time                                     //
+//                                                                                    //
+// The server's clock is the one everyone goes by. It is sent out from time to time   //
+// (and at the start of every turn) so clients can tell how far off their own clocks  //
+// are, and every chat message and die roll is stamped with it, so clients with       //
+// skewed clocks still show them in the right order and at the right time.            //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"strconv"
+	"time"
+)
+
+//
+// A time as we give it to clients: milliseconds since the Unix epoch.
+//
+func serverTimestamp(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+//
+// Where the server's timestamp goes in each kind of chat event, after
+// its message ID.
+//
+func serverTimeField(eventType string) int {
+	switch eventType {
+		case "TO":   return 5
+		case "ROLL": return 7
+	}
+	return -1
+}
+
+//
+// Stamp a chat event (TO or ROLL) with the server's time, replacing
+// any time it already had.
+//
+func (ev *MapEvent) stampServerTime(t time.Time) {
+	i := serverTimeField(ev.EventType())
+	if i < 0 || len(ev.Fields) < i {
+		return
+	}
+	if len(ev.Fields) == i {
+		ev.Fields = append(ev.Fields, "")
+	}
+	ev.Fields[i] = serverTimestamp(t)
+}
+
+//
+// ServerTime is when the server took in a chat event, if it was
+// stamped with it.
+//
+func (ev *MapEvent) ServerTime() (time.Time, bool) {
+	i := serverTimeField(ev.EventType())
+	if i < 0 || len(ev.Fields) <= i {
+		return time.Time{}, false
+	}
+	ms, err := strconv.ParseInt(ev.Fields[i], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
+
+//
+// Tell the client what time it is by the server's clock:
+//   TIME <milliseconds since the Unix epoch>
+//
+func (c *MapClient) sendServerTime() {
+	c.Send("TIME", serverTimestamp(time.Now()))
+}
+
+//
+// Tell everyone who has logged in what time it is.
+//
+func (ms *MapService) broadcastServerTime() {
+	now := serverTimestamp(time.Now())
+	for _, peer := range ms.AllClients() {
+		if peer.Authenticated && !peer.WriteOnly {
+			peer.Send("TIME", now)
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
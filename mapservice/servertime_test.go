@@ -0,0 +1,150 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for server time
+//
+
+package mapservice
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Like sentToTestClient, but leaving out the TIME messages we send
+// along with other things.
+//
+func sentIgnoringTime(c *MapClient) []string {
+	var sent []string
+	for _, message := range sentToTestClient(c) {
+		if !strings.HasPrefix(message, "TIME ") {
+			sent = append(sent, message)
+		}
+	}
+	return sent
+}
+
+func TestServerTimeStamps(t *testing.T) {
+	when := time.Date(2026, 10, 17, 12, 0, 0, 250*int(time.Millisecond), time.UTC)
+	if s := serverTimestamp(when); s != "1792238400250" {
+		t.Errorf("timestamp %s", s)
+	}
+
+	to := &MapEvent{Fields: []string{"TO", "alice", "*", "hi", "12"}}
+	if _, ok := to.ServerTime(); ok {
+		t.Errorf("unstamped message has a time")
+	}
+	to.stampServerTime(when)
+	to.stampServerTime(when)
+	if len(to.Fields) != 6 || to.Fields[5] != "1792238400250" {
+		t.Errorf("stamped message is %q", to.Fields)
+	}
+	if stamped, ok := to.ServerTime(); !ok || !stamped.Equal(when) {
+		t.Errorf("stamped message's time is %v", stamped)
+	}
+	roll := &MapEvent{Fields: []string{"ROLL", "alice", "*", "", "3", "{}", "13"}}
+	roll.stampServerTime(when)
+	if len(roll.Fields) != 8 || roll.Fields[7] != "1792238400250" {
+		t.Errorf("stamped roll is %q", roll.Fields)
+	}
+	other := &MapEvent{Fields: []string{"CC", "alice", "", "14"}}
+	other.stampServerTime(when)
+	if len(other.Fields) != 4 {
+		t.Errorf("CC was stamped: %q", other.Fields)
+	}
+}
+
+func TestServerTimeMessages(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	alice.AcceptedList = []string{"TO"}
+	bob := newTestClient(ms, "bob", "bob", false)
+
+	before := time.Now()
+	ms.ExecuteAction(testEvent(t, "TO alice * hello 99 12345"), alice)
+	sent := sentToTestClient(bob)
+	if len(sent) != 1 {
+		t.Fatalf("bob was sent %q", sent)
+	}
+	fields, _ := ParseTclList(sent[0])
+	stamp, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if len(fields) != 6 || err != nil || stamp < before.UnixNano()/int64(time.Millisecond) {
+		t.Errorf("chat message was %q", sent[0])
+	}
+	entries, err := ChatLog(ms.State.ChatHistory)
+	if err != nil || len(entries) != 1 || entries[0].Time == nil || entries[0].Time.Before(before.Truncate(time.Millisecond)) {
+		t.Errorf("chat log is %+v (%v)", entries, err)
+	}
+
+	sentToTestClient(gm)
+	ms.ExecuteAction(testEvent(t, "I {1 0 0} 1"), gm)
+	for _, c := range []*MapClient{gm, bob} {
+		if sent := sentToTestClient(c); len(sent) == 0 || !strings.HasPrefix(sent[0], "TIME ") {
+			t.Errorf("%s was sent %q at the start of a turn", c.Username(), sent)
+		}
+	}
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "TO alice * hello "+fields[4]+" "+fields[5] {
+		t.Errorf("alice was sent %q", sent)
+	}
+
+	ms.PingAll()
+	if sent := sentToTestClient(bob); len(sent) != 2 || sent[0] != "MARCO" || !strings.HasPrefix(sent[1], "TIME ") {
+		t.Errorf("bob was pinged with %q", sent)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
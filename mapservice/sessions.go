@@ -0,0 +1,155 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                Concurrent sessions                                 //
+//                                                                                    //
+// Letting users know when they are logged in more than once, so account sharing or a //
+// hijacked login is noticed, and letting them cut off their other sessions.          //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+)
+
+//
+// Describe a client connection for the user's benefit, as
+// "<address> using <client program>".
+//
+func (c *MapClient) sessionDescription() string {
+	client := "<unknown>"
+	if c.Auth != nil && c.Auth.Client != "" {
+		client = c.Auth.Client
+	}
+	return fmt.Sprintf("%s using %s", c.ClientAddr, client)
+}
+
+//
+// Find the user's other connections besides thisClient.
+// This only makes sense if the server authenticates its
+// users, since otherwise we don't know who anyone is. GMs
+// who logged in under different names are different people,
+// even though they are all "GM".
+//
+func (ms *MapService) otherSessions(thisClient *MapClient) []*MapClient {
+	if thisClient.Auth == nil || !thisClient.Authenticated {
+		return nil
+	}
+	var others []*MapClient
+	for _, peer := range ms.Clients.ByUser(thisClient.Username()) {
+		if peer != thisClient && peer.GMName() == thisClient.GMName() {
+			others = append(others, peer)
+		}
+	}
+	return others
+}
+
+//
+// Called when a client has just logged in. If the same user
+// is already connected elsewhere, every one of their sessions is
+// told about the others (and the GM too, if ReportSharedLogins
+// is set), so a shared or stolen login doesn't go unnoticed.
+//
+func (ms *MapService) noticeConcurrentSessions(thisClient *MapClient) {
+	others := ms.otherSessions(thisClient)
+	if len(others) == 0 {
+		return
+	}
+	user := thisClient.Username()
+	log.Printf("[client %s] %s logged in while already connected %d other time%s",
+		thisClient.logTag(), user, len(others), plural(len(others)))
+
+	for _, peer := range others {
+		peer.Send("TO", user, user,
+			fmt.Sprintf("NOTICE: you (%s) just logged in again from %s. If that wasn't you, send SESS- from here to disconnect your other sessions, and change your password.",
+				user, thisClient.sessionDescription()),
+			NextMessageID())
+		thisClient.Send("TO", user, user,
+			fmt.Sprintf("NOTICE: you (%s) are also logged in from %s. Send SESS- to disconnect your other sessions.",
+				user, peer.sessionDescription()),
+			NextMessageID())
+	}
+	if ms.ReportSharedLogins && user != "GM" {
+		for _, gm := range ms.Clients.ByUser("GM") {
+			gm.Send("TO", gm.Username(), gm.Username(),
+				fmt.Sprintf("NOTICE: %s logged in from %s while already connected %d other time%s.",
+					user, thisClient.sessionDescription(), len(others), plural(len(others))),
+				NextMessageID())
+		}
+	}
+}
+
+//
+// Disconnect all of the user's connections other than thisClient,
+// telling each why it is being dropped. Returns the number of
+// connections dropped.
+//
+func (ms *MapService) dropOtherSessions(thisClient *MapClient) int {
+	others := ms.otherSessions(thisClient)
+	for _, peer := range others {
+		log.Printf("[client %s] Disconnecting %s at the request of their session at %s",
+			peer.ClientAddr, peer.Username(), thisClient.ClientAddr)
+		peer.Send("TO", peer.Username(), peer.Username(),
+			fmt.Sprintf("NOTICE: this session was disconnected by your session at %s.", thisClient.sessionDescription()),
+			NextMessageID())
+		peer.setDisconnectReason(DisconnectReplaced)
+		peer.Close()
+	}
+	return len(others)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,143 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for concurrent session handling
+//
+
+package mapservice
+
+import (
+	"strings"
+	"testing"
+)
+
+func countNotices(sent []string, text string) int {
+	n := 0
+	for _, message := range sent {
+		if strings.Contains(message, text) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestConcurrentSessionNotices(t *testing.T) {
+	ms := newTestService()
+	ms.ReportSharedLogins = true
+	gm := newTestClient(ms, "gm", "GM", true)
+	first := newTestClient(ms, "first", "alice", false)
+	first.Auth.Client = "mapper 3.42"
+	bob := newTestClient(ms, "bob", "bob", false)
+
+	ms.noticeConcurrentSessions(first)
+	if sent := sentToTestClient(first); len(sent) != 0 {
+		t.Errorf("first login was told %v", sent)
+	}
+
+	second := newTestClient(ms, "second", "alice", false)
+	second.Auth.Client = "mapper 3.43"
+	ms.noticeConcurrentSessions(second)
+	if n := countNotices(sentToTestClient(first), "just logged in again from second using mapper 3.43"); n != 1 {
+		t.Errorf("first session got %d notices of the second", n)
+	}
+	if n := countNotices(sentToTestClient(second), "also logged in from first using mapper 3.42"); n != 1 {
+		t.Errorf("second session got %d notices of the first", n)
+	}
+	if n := countNotices(sentToTestClient(gm), "alice logged in from second"); n != 1 {
+		t.Errorf("GM got %d notices", n)
+	}
+	if sent := sentToTestClient(bob); len(sent) != 0 {
+		t.Errorf("bob was told %v", sent)
+	}
+
+	ms.ReportSharedLogins = false
+	third := newTestClient(ms, "third", "alice", false)
+	ms.noticeConcurrentSessions(third)
+	if n := countNotices(sentToTestClient(third), "also logged in from"); n != 2 {
+		t.Errorf("third session got %d notices", n)
+	}
+	if sent := sentToTestClient(gm); len(sent) != 0 {
+		t.Errorf("GM was told %v when not asked to be", sent)
+	}
+}
+
+func TestDropOtherSessions(t *testing.T) {
+	ms := newTestService()
+	first := newTestClient(ms, "first", "alice", false)
+	second := newTestClient(ms, "second", "alice", false)
+	bob := newTestClient(ms, "bob", "bob", false)
+
+	ms.ExecuteAction(testEvent(t, "SESS-"), second)
+	if !first.ReachedEOF || first.DisconnectReason() != DisconnectReplaced {
+		t.Errorf("first session not dropped (reason %q)", first.DisconnectReason())
+	}
+	if n := countNotices(sentToTestClient(first), "disconnected by your session at second"); n != 1 {
+		t.Errorf("first session got %d notices of being dropped", n)
+	}
+	if second.ReachedEOF || bob.ReachedEOF {
+		t.Errorf("wrong sessions dropped")
+	}
+	if n := countNotices(sentToTestClient(second), "Disconnected 1 other session."); n != 1 {
+		t.Errorf("second session got %d confirmations", n)
+	}
+
+	// Without authentication, we can't tell whose sessions are whose.
+	anon := newTestClient(ms, "anon", "", false)
+	anon.Auth = nil
+	ms.ExecuteAction(testEvent(t, "SESS-"), anon)
+	if second.ReachedEOF || bob.ReachedEOF {
+		t.Errorf("unauthenticated client dropped sessions")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
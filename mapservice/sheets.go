@@ -0,0 +1,303 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Character Sheets                                  //
+//                                                                                    //
+// A shared store of character sheets (JSON documents the server treats as opaque) so //
+// the mapper clients and external sheet tools all work from the same copy.           //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+//
+// A CharacterSheet is a JSON document describing a character, kept
+// for its owner. The server doesn't look inside it; that's up to the
+// clients and sheet tools which share it.
+//
+type CharacterSheet struct {
+	Name       string          `json:"name"`
+	Owner      string          `json:"owner"`       // player who may change it (along with the GM)
+	Version    int             `json:"version"`     // incremented every time it is saved
+	Modified   time.Time       `json:"modified"`
+	ModifiedBy string          `json:"modified_by"`
+	Document   json.RawMessage `json:"document,omitempty"`
+}
+
+//
+// ErrSheetVersion is returned when saving a character sheet which was
+// changed by someone else since the version the change was based on.
+//
+var ErrSheetVersion = errors.New("Character sheet was changed by someone else; reload it and try again")
+
+//
+// CharacterSheetStorage is implemented by storage backends which can
+// keep character sheets.
+//
+type CharacterSheetStorage interface {
+	ListCharacterSheets() ([]CharacterSheet, error)
+	LoadCharacterSheet(name string) (CharacterSheet, bool, error)
+	SaveCharacterSheet(sheet CharacterSheet, baseVersion int) (int, error)
+	DeleteCharacterSheet(name string) (bool, error)
+}
+
+//
+// Database Schema
+//  ________________
+// | sheets         |
+// |----------------|
+// | name       P s |
+// | owner        s |
+// | version      i |
+// | modified     i |
+// | modifiedby   s |
+// | document     s |
+// |________________|
+//
+// P=primary key
+// i=integer
+// s=string
+//
+// The modification time is stored as seconds since the epoch.
+//
+func createCharacterSheetTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists sheets (
+			name       text    primary key,
+			owner      text    not null,
+			version    integer not null,
+			modified   integer not null,
+			modifiedby text    not null,
+			document   text    not null
+		);`)
+	return err
+}
+
+//
+// ListCharacterSheets reads all the character sheets (without their
+// documents) in name order.
+//
+func ListCharacterSheets(db *sql.DB) ([]CharacterSheet, error) {
+	rows, err := db.Query(`select name, owner, version, modified, modifiedby from sheets order by name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sheets []CharacterSheet
+	for rows.Next() {
+		var s CharacterSheet
+		var when int64
+		if err = rows.Scan(&s.Name, &s.Owner, &s.Version, &when, &s.ModifiedBy); err != nil {
+			return nil, fmt.Errorf("unable to read character sheets: %v", err)
+		}
+		s.Modified = time.Unix(when, 0)
+		sheets = append(sheets, s)
+	}
+	return sheets, rows.Err()
+}
+
+//
+// LoadCharacterSheet reads the named character sheet.
+//
+func LoadCharacterSheet(db *sql.DB, name string) (CharacterSheet, bool, error) {
+	s := CharacterSheet{Name: name}
+	var when int64
+	var document string
+	err := db.QueryRow(`select owner, version, modified, modifiedby, document from sheets where name = ?`, name).
+		Scan(&s.Owner, &s.Version, &when, &s.ModifiedBy, &document)
+	if err == sql.ErrNoRows {
+		return CharacterSheet{}, false, nil
+	}
+	if err != nil {
+		return CharacterSheet{}, false, err
+	}
+	s.Modified = time.Unix(when, 0)
+	s.Document = json.RawMessage(document)
+	return s, true, nil
+}
+
+//
+// SaveCharacterSheet stores a character sheet, returning its new
+// version number. The change must be based on the version currently
+// stored (0 if there isn't one yet), or ErrSheetVersion is returned.
+// The sheet keeps its original owner.
+//
+func SaveCharacterSheet(db *sql.DB, sheet CharacterSheet, baseVersion int) (int, error) {
+	current := 0
+	err := withTransaction(db, func(tx *sql.Tx) error {
+		current = 0
+		err := tx.QueryRow(`select version from sheets where name = ?`, sheet.Name).Scan(&current)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if current != baseVersion {
+			return ErrSheetVersion
+		}
+		if current == 0 {
+			_, err = tx.Exec(`insert into sheets (name, owner, version, modified, modifiedby, document) values (?, ?, 1, ?, ?, ?)`,
+				sheet.Name, sheet.Owner, sheet.Modified.Unix(), sheet.ModifiedBy, string(sheet.Document))
+		} else {
+			_, err = tx.Exec(`update sheets set version = ?, modified = ?, modifiedby = ?, document = ? where name = ?`,
+				current+1, sheet.Modified.Unix(), sheet.ModifiedBy, string(sheet.Document), sheet.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to save character sheet %s: %w", sheet.Name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return current + 1, nil
+}
+
+//
+// DeleteCharacterSheet removes the named character sheet, returning
+// false if there wasn't one.
+//
+func DeleteCharacterSheet(db *sql.DB, name string) (bool, error) {
+	result, err := db.Exec(`delete from sheets where name = ?`, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+//
+// May the user (who might be the GM) see and change the sheet?
+//
+func (s CharacterSheet) Allows(user string, gm bool) bool {
+	return gm || s.Owner == user
+}
+
+//
+// Save a change to a character sheet on behalf of a user, checking
+// that they're allowed to, and let everyone else who may see it know
+// it changed. A new sheet belongs to owner.
+//
+func (ms *MapService) saveCharacterSheet(storage CharacterSheetStorage, user string, gm bool, owner, name string, baseVersion int, document []byte) (CharacterSheet, error) {
+	if name == "" {
+		return CharacterSheet{}, fmt.Errorf("Character sheets must have a name")
+	}
+	if !json.Valid(document) {
+		return CharacterSheet{}, fmt.Errorf("Character sheet %s is not a valid JSON document", name)
+	}
+	sheet, found, err := storage.LoadCharacterSheet(name)
+	if err != nil {
+		return CharacterSheet{}, err
+	}
+	if found && !sheet.Allows(user, gm) {
+		return CharacterSheet{}, fmt.Errorf("Character sheet %s belongs to %s", name, sheet.Owner)
+	}
+	if !found {
+		sheet = CharacterSheet{Name: name, Owner: owner}
+	}
+	sheet.Modified = time.Now()
+	sheet.ModifiedBy = user
+	sheet.Document = json.RawMessage(document)
+	if sheet.Version, err = storage.SaveCharacterSheet(sheet, baseVersion); err != nil {
+		return CharacterSheet{}, err
+	}
+	ms.notifySheetChange(sheet, "")
+	return sheet, nil
+}
+
+//
+// Delete a character sheet on behalf of a user, checking that they're
+// allowed to, and let everyone else who could see it know it's gone.
+//
+func (ms *MapService) deleteCharacterSheet(storage CharacterSheetStorage, user string, gm bool, name string) (bool, error) {
+	sheet, found, err := storage.LoadCharacterSheet(name)
+	if err != nil || !found {
+		return false, err
+	}
+	if !sheet.Allows(user, gm) {
+		return false, fmt.Errorf("Character sheet %s belongs to %s", name, sheet.Owner)
+	}
+	if found, err = storage.DeleteCharacterSheet(name); err != nil || !found {
+		return found, err
+	}
+	sheet.ModifiedBy = user
+	ms.notifySheetChange(sheet, "-")
+	return true, nil
+}
+
+//
+// Tell the sheet's owner and the GM that it changed (or, if version
+// is "-", that it was deleted) by sending them
+//   SH! <name> <version> <owner> <modified-by>
+//
+func (ms *MapService) notifySheetChange(sheet CharacterSheet, version string) {
+	if version == "" {
+		version = strconv.Itoa(sheet.Version)
+	}
+	for _, peer := range ms.Clients.Subscribers("SH!") {
+		if peer.Authenticated && (peer.IsGM() || peer.Username() == sheet.Owner) {
+			peer.Send("SH!", sheet.Name, version, sheet.Owner, sheet.ModifiedBy)
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,163 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for character sheets
+//
+
+package mapservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCharacterSheetStorage(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/sheets.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	s := storage.(CharacterSheetStorage)
+
+	when := time.Unix(1760000000, 0)
+	sheet := CharacterSheet{Name: "Fizban", Owner: "alice", Modified: when, ModifiedBy: "alice", Document: []byte(`{"str":8}`)}
+	if _, err = s.SaveCharacterSheet(sheet, 1); err != ErrSheetVersion {
+		t.Errorf("saving new sheet as version 1 gave %v", err)
+	}
+	if v, err := s.SaveCharacterSheet(sheet, 0); v != 1 || err != nil {
+		t.Fatalf("saving new sheet gave %d %v", v, err)
+	}
+	if _, err = s.SaveCharacterSheet(sheet, 0); err != ErrSheetVersion {
+		t.Errorf("saving over existing sheet as new gave %v", err)
+	}
+	sheet.Owner = "mallory"
+	sheet.ModifiedBy = "GM"
+	sheet.Document = []byte(`{"str":9}`)
+	if v, err := s.SaveCharacterSheet(sheet, 1); v != 2 || err != nil {
+		t.Fatalf("saving version 2 gave %d %v", v, err)
+	}
+
+	got, found, err := s.LoadCharacterSheet("Fizban")
+	if err != nil || !found || got.Owner != "alice" || got.Version != 2 || got.ModifiedBy != "GM" || string(got.Document) != `{"str":9}` || !got.Modified.Equal(when) {
+		t.Errorf("loaded %+v %v %v", got, found, err)
+	}
+	list, err := s.ListCharacterSheets()
+	if err != nil || len(list) != 1 || list[0].Document != nil || list[0].Version != 2 {
+		t.Errorf("listed %+v %v", list, err)
+	}
+	if found, err = s.DeleteCharacterSheet("Fizban"); !found || err != nil {
+		t.Errorf("delete gave %v %v", found, err)
+	}
+	if _, found, err = s.LoadCharacterSheet("Fizban"); found || err != nil {
+		t.Errorf("sheet still there after delete: %v", err)
+	}
+}
+
+func TestCharacterSheetAPI(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/api.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	_, admin, _ := ms.issueAPIToken("sheettool", ScopeAdmin, 0)
+	_, reader, _ := ms.issueAPIToken("alice", ScopeReadOnly, 0)
+	_, bob, _ := ms.issueAPIToken("bob", ScopeReadOnly, 0)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	if status, reply := apiTestRequest(t, ms, "PUT", "/api/v1/sheets/Fizban", reader, `{"version": 0, "document": {}}`); status != 403 {
+		t.Errorf("PUT with read token got %d %v", status, reply)
+	}
+	status, reply := apiTestRequest(t, ms, "PUT", "/api/v1/sheets/Fizban", admin, `{"version": 0, "owner": "alice", "document": {"str": 8}}`)
+	if status != 200 || reply["version"] != 1.0 || reply["owner"] != "alice" || reply["modified_by"] != "sheettool" {
+		t.Errorf("PUT new sheet got %d %v", status, reply)
+	}
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "SH! Fizban 1 alice sheettool" {
+		t.Errorf("alice was sent %q", sent)
+	}
+	if status, reply = apiTestRequest(t, ms, "PUT", "/api/v1/sheets/Fizban", admin, `{"version": 0, "document": {"str": 9}}`); status != 409 {
+		t.Errorf("PUT over newer version got %d %v", status, reply)
+	}
+	if status, reply = apiTestRequest(t, ms, "PUT", "/api/v1/sheets/Fizban", admin, `{"version": 1, "document": "not json`); status != 400 {
+		t.Errorf("PUT with bad document got %d %v", status, reply)
+	}
+	status, reply = apiTestRequest(t, ms, "GET", "/api/v1/sheets/Fizban", reader, "")
+	if doc, _ := reply["document"].(map[string]interface{}); status != 200 || doc["str"] != 8.0 {
+		t.Errorf("GET sheet got %d %v", status, reply)
+	}
+	if status, reply = apiTestRequest(t, ms, "GET", "/api/v1/sheets", reader, ""); status != 200 || len(reply["sheets"].([]interface{})) != 1 {
+		t.Errorf("GET sheets got %d %v", status, reply)
+	}
+	if status, reply = apiTestRequest(t, ms, "GET", "/api/v1/sheets/Fizban", bob, ""); status != 404 {
+		t.Errorf("GET another player's sheet got %d %v", status, reply)
+	}
+	if status, reply = apiTestRequest(t, ms, "GET", "/api/v1/sheets", bob, ""); status != 200 || len(reply["sheets"].([]interface{})) != 0 {
+		t.Errorf("GET sheets for another player got %d %v", status, reply)
+	}
+	if status, reply = apiTestRequest(t, ms, "GET", "/api/v1/sheets", admin, ""); status != 200 || len(reply["sheets"].([]interface{})) != 1 {
+		t.Errorf("GET sheets for the GM got %d %v", status, reply)
+	}
+	if status, reply = apiTestRequest(t, ms, "DELETE", "/api/v1/sheets/Fizban", admin, ""); status != 200 {
+		t.Errorf("DELETE sheet got %d %v", status, reply)
+	}
+	if sent := sentToTestClient(alice); len(sent) != 1 || sent[0] != "SH! Fizban - alice sheettool" {
+		t.Errorf("alice was sent %q", sent)
+	}
+	if status, reply = apiTestRequest(t, ms, "GET", "/api/v1/sheets/Fizban", reader, ""); status != 404 {
+		t.Errorf("GET deleted sheet got %d %v", status, reply)
+	}
+}
+
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
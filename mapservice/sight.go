@@ -0,0 +1,355 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Line of Sight                                    //
+//                                                                                    //
+// Walls are drawn as map elements (lines, polygons, and rectangles) on the wall      //
+// layers. Given a creature on the map, the server works out which parts of the map   //
+// it can see past those walls, and which other creatures it can see, so that every   //
+// client draws the same thing rather than each working it out its own way.           //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// DefaultWallLayers are the map layers whose elements block line of
+// sight, unless the server is told otherwise.
+//
+var DefaultWallLayers = []string{"walls"}
+
+//
+// SightResult is what a creature can see: the outline of the part of
+// the map visible to it (x0 y0 x1 y1 ..., in map pixels), the IDs of
+// the other creatures in its line of sight, and the IDs of those it can
+// make out by the light it has.
+//
+type SightResult struct {
+	Polygon   []float64
+	Visible   []string
+	Perceived []string
+}
+
+//
+// A wall (or one side of one) from (X1, Y1) to (X2, Y2).
+//
+type wallSegment struct {
+	X1, Y1, X2, Y2 float64
+}
+
+//
+// Is this one of the layers whose elements block line of sight?
+//
+func (ms *MapService) isWallLayer(layer string) bool {
+	if layer == "" {
+		return false
+	}
+	layers := ms.WallLayers
+	if layers == nil {
+		layers = DefaultWallLayers
+	}
+	for _, l := range layers {
+		if strings.EqualFold(l, layer) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// The wall segments making up a map element: each leg of a line, each
+// side of a polygon, or the four sides of a rectangle. Anything else
+// (or anything we can't make sense of) has none.
+//
+func wallSegments(obj *MapObject) []wallSegment {
+	coords, err := ParseTclList(obj.Attrs["X"] + " " + obj.Attrs["Y"] + " " + obj.Attrs["POINTS"])
+	if err != nil || len(coords)%2 != 0 || len(coords) < 4 {
+		return nil
+	}
+	var p []float64
+	for _, c := range coords {
+		v, err := strconv.ParseFloat(c, 64)
+		if err != nil {
+			return nil
+		}
+		p = append(p, v)
+	}
+	switch obj.Attrs["TYPE"] {
+		case "line":
+		case "poly":
+			p = append(p, p[0], p[1])
+		case "rect":
+			p = []float64{p[0], p[1], p[2], p[1], p[2], p[3], p[0], p[3], p[0], p[1]}
+		default:
+			return nil
+	}
+	var walls []wallSegment
+	for i := 0; i+3 < len(p); i += 2 {
+		walls = append(walls, wallSegment{p[i], p[i+1], p[i+2], p[i+3]})
+	}
+	return walls
+}
+
+//
+// How many grid squares across is a creature of the given size?
+//
+func creatureSquares(size string) float64 {
+	if size == "" {
+		return 1
+	}
+	switch strings.ToUpper(size[:1]) {
+		case "L": return 2
+		case "H": return 3
+		case "G": return 4
+		case "C": return 6
+		default:  return 1
+	}
+}
+
+//
+// The area a creature covers on the map, in map pixels: its top left
+// corner and width. Returns false if it isn't on the grid.
+//
+func creatureArea(obj *MapObject) (x, y, width float64, ok bool) {
+	gx, err1 := strconv.Atoi(obj.Attrs["GX"])
+	gy, err2 := strconv.Atoi(obj.Attrs["GY"])
+	if err1 != nil || err2 != nil {
+		return 0, 0, 0, false
+	}
+	return float64(gx * GMAGridSize), float64(gy * GMAGridSize), creatureSquares(obj.Attrs["SIZE"]) * GMAGridSize, true
+}
+
+//
+// How far along a ray from (x, y) in direction (dx, dy) does it meet
+// the wall, in multiples of (dx, dy)? Returns false if it doesn't.
+//
+func rayHitsWall(x, y, dx, dy float64, w wallSegment) (float64, bool) {
+	ex, ey := w.X2-w.X1, w.Y2-w.Y1
+	d := dx*ey - dy*ex
+	if math.Abs(d) < 1e-9 {
+		return 0, false
+	}
+	t := ((w.X1-x)*ey - (w.Y1-y)*ex) / d
+	u := ((w.X1-x)*dy - (w.Y1-y)*dx) / d
+	if t < 0 || u < -1e-9 || u > 1+1e-9 {
+		return 0, false
+	}
+	return t, true
+}
+
+//
+// Can (x1, y1) see (x2, y2), or is there a wall in the way?
+//
+func sightBlocked(x1, y1, x2, y2 float64, walls []wallSegment) bool {
+	for _, w := range walls {
+		if t, ok := rayHitsWall(x1, y1, x2-x1, y2-y1, w); ok && t < 1-1e-9 {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// The outline of what can be seen from (x, y) past the walls, out to
+// the edges of the box (minX, minY)-(maxX, maxY). We look toward each
+// end of each wall, and just to either side of it, to find the nearest
+// wall in that direction; the points where those rays stop, in order
+// around the viewer, make the outline.
+//
+func visibilityPolygon(x, y float64, walls []wallSegment, minX, minY, maxX, maxY float64) []float64 {
+	walls = append(walls[:len(walls):len(walls)],
+		wallSegment{minX, minY, maxX, minY},
+		wallSegment{maxX, minY, maxX, maxY},
+		wallSegment{maxX, maxY, minX, maxY},
+		wallSegment{minX, maxY, minX, minY},
+	)
+	var angles []float64
+	for _, w := range walls {
+		for _, end := range [][2]float64{{w.X1, w.Y1}, {w.X2, w.Y2}} {
+			a := math.Atan2(end[1]-y, end[0]-x)
+			angles = append(angles, a-1e-4, a, a+1e-4)
+		}
+	}
+	sort.Float64s(angles)
+
+	var polygon []float64
+	for _, a := range angles {
+		dx, dy := math.Cos(a), math.Sin(a)
+		nearest := math.Inf(1)
+		for _, w := range walls {
+			if t, ok := rayHitsWall(x, y, dx, dy, w); ok && t < nearest {
+				nearest = t
+			}
+		}
+		if math.IsInf(nearest, 1) {
+			continue
+		}
+		px := math.Round((x+dx*nearest)*10) / 10
+		py := math.Round((y+dy*nearest)*10) / 10
+		if n := len(polygon); n >= 2 && polygon[n-2] == px && polygon[n-1] == py {
+			continue
+		}
+		polygon = append(polygon, px, py)
+	}
+	return polygon
+}
+
+//
+// LineOfSight works out what the creature <ref> (ID or name) can see
+// past the walls on the map. If <rangeSquares> is positive, it can see
+// no farther than that many grid squares from its center (and the
+// outline is cut off at a square box of that size around it);
+// otherwise the outline reaches just past everything on the map.
+// Another creature is visible if the line to its center or to any of
+// its corners is clear. It is perceived as well if that point is lit
+// (see Light) or close enough for the viewer's darkvision (see
+// ParseVision); if no lights have been placed at all, the whole map is
+// taken to be lit. Unless <gm> is true, the creature must not be on a
+// GM-only layer, and creatures which are aren't reported.
+//
+func (ms *MapService) LineOfSight(ref string, rangeSquares float64, gm bool) (SightResult, error) {
+	ms.State.lock.RLock()
+	defer ms.State.lock.RUnlock()
+
+	viewer := ms.State.creature(ref)
+	if viewer == nil || !viewer.IsCreature() || (!gm && ms.isGMLayer(viewer.Attrs["LAYER"])) {
+		return SightResult{}, fmt.Errorf("There is no creature %s on the map", ref)
+	}
+	vx, vy, vw, ok := creatureArea(viewer)
+	if !ok {
+		return SightResult{}, fmt.Errorf("%s isn't on the grid", ref)
+	}
+	x, y := vx+vw/2, vy+vw/2
+	reach := rangeSquares * GMAGridSize
+	minX, minY, maxX, maxY := vx, vy, vx+vw, vy+vw
+	stretch := func(px, py float64) {
+		minX, minY = math.Min(minX, px), math.Min(minY, py)
+		maxX, maxY = math.Max(maxX, px), math.Max(maxY, py)
+	}
+
+	var walls []wallSegment
+	type target struct {
+		id     string
+		points [][2]float64
+	}
+	var targets []target
+	for id, obj := range ms.State.Objects {
+		if obj.IsCreature() {
+			if id == viewer.ID || (!gm && ms.isGMLayer(obj.Attrs["LAYER"])) {
+				continue
+			}
+			cx, cy, cw, ok := creatureArea(obj)
+			if !ok {
+				continue
+			}
+			stretch(cx, cy)
+			stretch(cx+cw, cy+cw)
+			targets = append(targets, target{id, [][2]float64{
+				{cx + cw/2, cy + cw/2},
+				{cx + 1, cy + 1}, {cx + cw - 1, cy + 1},
+				{cx + 1, cy + cw - 1}, {cx + cw - 1, cy + cw - 1},
+			}})
+		} else if ms.isWallLayer(obj.Attrs["LAYER"]) {
+			for _, w := range wallSegments(obj) {
+				stretch(w.X1, w.Y1)
+				stretch(w.X2, w.Y2)
+				walls = append(walls, w)
+			}
+		}
+	}
+
+	var result SightResult
+	if reach > 0 {
+		result.Polygon = visibilityPolygon(x, y, walls, x-reach, y-reach, x+reach, y+reach)
+	} else {
+		result.Polygon = visibilityPolygon(x, y, walls, minX-GMAGridSize, minY-GMAGridSize, maxX+GMAGridSize, maxY+GMAGridSize)
+	}
+	lowLight, darkvision, err := ParseVision(viewer.Attrs["VISION"])
+	if err != nil {
+		return SightResult{}, fmt.Errorf("%s: %v", ref, err)
+	}
+	lights, placed := ms.shiningLights(lowLight)
+	for _, t := range targets {
+		visible, perceived := false, false
+		for _, p := range t.points {
+			distance := math.Hypot(p[0]-x, p[1]-y)
+			if (reach > 0 && distance > reach) || sightBlocked(x, y, p[0], p[1], walls) {
+				continue
+			}
+			visible = true
+			if !placed || distance <= darkvision*GMAGridSize || litPoint(p[0], p[1], lights, walls) {
+				perceived = true
+				break
+			}
+		}
+		if visible {
+			result.Visible = append(result.Visible, t.id)
+		}
+		if perceived {
+			result.Perceived = append(result.Perceived, t.id)
+		}
+	}
+	sort.Strings(result.Visible)
+	sort.Strings(result.Perceived)
+	return result, nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
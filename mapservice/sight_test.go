@@ -0,0 +1,161 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for line of sight
+//
+
+package mapservice
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWallSegments(t *testing.T) {
+	for i, test := range []struct {
+		attrs map[string]string
+		walls []wallSegment
+	}{
+		{map[string]string{"TYPE": "line", "X": "0", "Y": "0", "POINTS": "10 0 10 10"},
+			[]wallSegment{{0, 0, 10, 0}, {10, 0, 10, 10}}},
+		{map[string]string{"TYPE": "poly", "X": "0", "Y": "0", "POINTS": "10 0 10 10"},
+			[]wallSegment{{0, 0, 10, 0}, {10, 0, 10, 10}, {10, 10, 0, 0}}},
+		{map[string]string{"TYPE": "rect", "X": "0", "Y": "0", "POINTS": "10 20"},
+			[]wallSegment{{0, 0, 10, 0}, {10, 0, 10, 20}, {10, 20, 0, 20}, {0, 20, 0, 0}}},
+		{map[string]string{"TYPE": "circ", "X": "0", "Y": "0", "POINTS": "10 20"}, nil},
+		{map[string]string{"TYPE": "line", "X": "0", "Y": "0", "POINTS": "10"}, nil},
+		{map[string]string{"TYPE": "line", "X": "0", "Y": "0", "POINTS": "x 10"}, nil},
+	} {
+		obj := NewMapObject("w", "E")
+		obj.Attrs = test.attrs
+		walls := wallSegments(obj)
+		if len(walls) != len(test.walls) {
+			t.Errorf("test %d: walls %v, expected %v", i, walls, test.walls)
+			continue
+		}
+		for j := range walls {
+			if walls[j] != test.walls[j] {
+				t.Errorf("test %d: walls %v, expected %v", i, walls, test.walls)
+				break
+			}
+		}
+	}
+}
+
+func TestLineOfSight(t *testing.T) {
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+
+	sendTestLS(t, ms, gm,
+		"TYPE:w1 line", "X:w1 100", "Y:w1 -1000", "POINTS:w1 {100 1000}", "LAYER:w1 walls",
+		"TYPE:d1 line", "X:d1 0", "Y:d1 200", "POINTS:d1 {50 200}", "LAYER:d1 players",
+	)
+	ms.ExecuteAction(testEvent(t, "PS p1 blue Alice 1 M player 0 0 1"), gm)
+	ms.ExecuteAction(testEvent(t, "PS m1 red Orc 1 M monster 4 0 1"), gm)
+	ms.ExecuteAction(testEvent(t, "PS m2 red Goblin 1 M monster 1 2 1"), gm)
+	ms.ExecuteAction(testEvent(t, "PS m3 red Lurker 1 M monster 0 5 1"), gm)
+	ms.ExecuteAction(testEvent(t, "OA m3 {LAYER gm}"), gm)
+
+	sight, err := ms.LineOfSight("Alice", 0, true)
+	if err != nil {
+		t.Fatalf("line of sight failed: %v", err)
+	}
+	if strings.Join(sight.Visible, " ") != "m2 m3" {
+		t.Errorf("GM was told Alice can see %v", sight.Visible)
+	}
+	if len(sight.Polygon) < 6 || len(sight.Polygon)%2 != 0 {
+		t.Fatalf("polygon was %v", sight.Polygon)
+	}
+	wall := false
+	for i := 0; i < len(sight.Polygon); i += 2 {
+		if sight.Polygon[i+1] < -900 || sight.Polygon[i+1] > 900 {
+			continue // it can see around the ends of the wall
+		}
+		if sight.Polygon[i] > 100 {
+			t.Errorf("polygon %v reaches past the wall", sight.Polygon)
+			break
+		}
+		wall = wall || sight.Polygon[i] == 100
+	}
+	if !wall {
+		t.Errorf("polygon %v doesn't reach the wall", sight.Polygon)
+	}
+
+	if sight, err = ms.LineOfSight("p1", 0, false); err != nil || strings.Join(sight.Visible, " ") != "m2" {
+		t.Errorf("player was told Alice can see %v, %v", sight.Visible, err)
+	}
+	if sight, err = ms.LineOfSight("p1", 1, true); err != nil || len(sight.Visible) != 0 {
+		t.Errorf("Alice can see %v within 1 square, %v", sight.Visible, err)
+	}
+	if _, err = ms.LineOfSight("m3", 0, false); err == nil {
+		t.Errorf("player could look from a GM-only creature")
+	}
+	if _, err = ms.LineOfSight("nobody", 0, true); err == nil {
+		t.Errorf("line of sight from nobody worked")
+	}
+
+	ms.ExecuteAction(testEvent(t, "LOS? q1 Alice 3"), alice)
+	sent := sentToTestClient(alice)
+	if len(sent) == 0 || !strings.HasPrefix(sent[len(sent)-1], "LOS= q1 {") || !strings.HasSuffix(sent[len(sent)-1], "} m2 m2") {
+		t.Errorf("alice was sent %q", sent)
+	}
+	ms.ExecuteAction(testEvent(t, "LOS? q2 Alice far"), alice)
+	ms.ExecuteAction(testEvent(t, "LOS? q3 Lurker"), alice)
+	sent = sentToTestClient(alice)
+	if len(sent) != 2 || !strings.HasPrefix(sent[0], "LOS! q2 ") || sent[1] != "LOS! q3 {There is no creature Lurker on the map}" {
+		t.Errorf("alice was sent %q", sent)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
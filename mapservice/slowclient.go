@@ -0,0 +1,173 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                              Slow Client Diagnostics                               //
+//                                                                                    //
+// Snapshots of clients which aren't keeping up with the messages we send them, taken //
+// when their backlog grows too large and again if we have to give up on them.        //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// SlowClientThreshold is how many messages may back up waiting to go
+// out to a client (beyond those in its CommChannel) before we take a
+// diagnostic snapshot of it.
+//
+const SlowClientThreshold = 512
+
+//
+// MaxSlowClientReports is how many of the most recent snapshots we keep.
+//
+const MaxSlowClientReports = 20
+
+//
+// A SlowClientReport is a snapshot of a client which isn't keeping up
+// with what we're sending it, so we can later tell why it was dropped.
+//
+type SlowClientReport struct {
+	Time         time.Time      `json:"time"`
+	Client       string         `json:"client"`
+	User         string         `json:"user"`
+	Reason       string         `json:"reason"`
+	InChannel    int            `json:"in_channel"`    // messages in its CommChannel
+	Backlog      int            `json:"backlog"`       // messages waiting to get into the channel
+	Memory       int64          `json:"memory"`        // bytes we're holding for it (see clientMemory)
+	LastPolo     time.Time      `json:"last_polo"`     // when we last heard from it
+	RTT          float64        `json:"rtt"`           // seconds it has been taking to answer MARCO
+	Window       int            `json:"window"`        // messages we're letting into its channel at a time
+	MessageTypes map[string]int `json:"message_types"` // backlogged messages of each type
+}
+
+func (r SlowClientReport) String() string {
+	var types []string
+	for t, n := range r.MessageTypes {
+		types = append(types, fmt.Sprintf("%s=%d", t, n))
+	}
+	sort.Strings(types)
+	return fmt.Sprintf("%s: %d messages in channel, %d backlogged (%s), %d bytes held, last POLO %v ago, round trip %.1fs, window %d",
+		r.Reason, r.InChannel, r.Backlog, strings.Join(types, " "), r.Memory, r.Time.Sub(r.LastPolo).Truncate(time.Second), r.RTT, r.Window)
+}
+
+//
+// Take a snapshot of the client's output queue.
+//
+func (c *MapClient) slowClientReport(reason string, now time.Time) SlowClientReport {
+	window, rtt := c.pace.stats()
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	report := SlowClientReport{
+		Time:         now,
+		Client:       c.ClientAddr,
+		Reason:       reason,
+		InChannel:    len(c.CommChannel),
+		Backlog:      len(c.messageBacklogQueue),
+		Memory:       c.memory.usage(),
+		LastPolo:     time.Unix(c.LastPolo, 0),
+		RTT:          rtt.Seconds(),
+		Window:       window,
+		MessageTypes: make(map[string]int),
+	}
+	if c.Auth != nil {
+		report.User = c.Auth.Username
+	}
+	for _, message := range c.messageBacklogQueue {
+		if fields := strings.Fields(message); len(fields) > 0 {
+			report.MessageTypes[fields[0]]++
+		}
+	}
+	return report
+}
+
+//
+// Record a snapshot of a client which isn't keeping up, in the log
+// and with the server's metrics.
+//
+func (c *MapClient) reportSlowClient(reason string) {
+	report := c.slowClientReport(reason, time.Now())
+	log.Printf("[client %s] SLOW CLIENT %s", c.logTag(), report)
+	if c.Service != nil {
+		c.Service.metrics.addSlowClient(report)
+	}
+}
+
+func (m *metricsHistory) addSlowClient(report SlowClientReport) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.slowClients = append(m.slowClients, report)
+	if len(m.slowClients) > MaxSlowClientReports {
+		m.slowClients = append([]SlowClientReport(nil), m.slowClients[len(m.slowClients)-MaxSlowClientReports:]...)
+	}
+}
+
+//
+// SlowClientReports returns the most recent snapshots of clients which
+// weren't keeping up, oldest first.
+//
+func (ms *MapService) SlowClientReports() []SlowClientReport {
+	ms.metrics.lock.Lock()
+	defer ms.metrics.lock.Unlock()
+	return append([]SlowClientReport{}, ms.metrics.slowClients...)
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,117 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the slow client diagnostics
+//
+
+package mapservice
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowClientReports(t *testing.T) {
+	ms := newTestService()
+	c := newTestClient(ms, "1.2.3.4:1", "alice", false)
+	for i := 0; i < CommChannelBufferSize; i++ {
+		c.sendToClientChannel("AC x")
+	}
+	for i := 0; i < SlowClientThreshold-2; i++ {
+		c.sendToClientChannel("LS-ARC x")
+	}
+	c.sendToClientChannel("TO a b c")
+	if r := ms.SlowClientReports(); len(r) != 0 {
+		t.Fatalf("reported slow client too soon: %v", r)
+	}
+	c.sendToClientChannel("TO a b c")
+	c.sendToClientChannel("TO a b c")
+
+	reports := ms.SlowClientReports()
+	if len(reports) != 1 {
+		t.Fatalf("expected one report, got %v", reports)
+	}
+	r := reports[0]
+	if r.Client != "1.2.3.4:1" || r.User != "alice" || r.InChannel != CommChannelBufferSize || r.Backlog != SlowClientThreshold ||
+		r.MessageTypes["LS-ARC"] != SlowClientThreshold-2 || r.MessageTypes["TO"] != 2 || len(r.MessageTypes) != 2 {
+		t.Errorf("report was %+v", r)
+	}
+	if s := r.String(); !strings.Contains(s, "LS-ARC=510 TO=2") || !strings.Contains(s, "256 messages in channel") {
+		t.Errorf("report text was %q", s)
+	}
+
+	// the backlog drains, but the channel is still full when the client
+	// stops answering pings
+	c.messageBacklogQueue = nil
+	c.LastPolo = time.Now().Unix() - ClientIdleTimeout - 1
+	c.sendToClientChannel("TO a b c")
+	reports = ms.SlowClientReports()
+	if len(reports) != 2 || reports[1].Reason != "dropped as too slow" || !c.ReachedEOF {
+		t.Errorf("reports after drop were %v", reports)
+	}
+}
+
+func TestSlowClientReportLimit(t *testing.T) {
+	ms := newTestService()
+	c := newTestClient(ms, "1.2.3.4:1", "alice", false)
+	for i := 0; i < MaxSlowClientReports+5; i++ {
+		c.reportSlowClient(string(rune('a' + i)))
+	}
+	reports := ms.SlowClientReports()
+	if len(reports) != MaxSlowClientReports || reports[0].Reason != "f" {
+		t.Errorf("kept reports %v", reports)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,806 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   SQLite Storage                                   //
+//                                                                                    //
+// Persistent storage of the game state and die-roll presets in a sqlite3 database.   //
+// This is the default StorageBackend implementation.                                 //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//////////////////////////////////////////////////////////////////////////////////
+//
+// SQLiteStorage is the standard StorageBackend, which keeps the game
+// state and die-roll presets in a sqlite3 database. It is registered
+// under the name "sqlite".
+//
+type SQLiteStorage struct {
+	DB	*sql.DB		// open database handle
+}
+
+func init() {
+	RegisterStorageBackend("sqlite", OpenSQLiteStorage)
+}
+
+//
+// OpenSQLiteStorage opens the sqlite3 database at the given path, creating
+// a new one with an empty schema if it doesn't already exist.
+//
+func OpenSQLiteStorage(path string) (StorageBackend, error) {
+	var err error
+	var sqldb *sql.DB
+
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		// database doesn't exist yet; create a new one
+		log.Printf("No existing sqlite3 database \"%s\" found--creating a new one.", path)
+		sqldb, err = sql.Open("sqlite3", "file:"+path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create sqlite3 database %s: %v", path, err)
+		}
+		_, err = sqldb.Exec(`
+			create table users (
+				userid integer primary key,
+				username text not null
+			);
+			create table dicepresets (
+				presetid    integer primary key,
+				userid      integer not null,
+				name        text    not null,
+				description text    not null,
+				rollspec    text    not null,
+					foreign key (userid)
+						references users (userid) 
+						on delete cascade
+			);
+			create table events (
+				eventid integer primary key,
+				rawdata  text    not null,
+				sequence integer not null,
+				key      text    not null,
+				class    text    not null,
+				objid    text    not null
+			);
+			create table extradata (
+				extraid integer primary key,
+				eventid integer not null,
+				datarow text    not null,
+					foreign key (eventid)
+						references events (eventid)
+						on delete cascade
+			);
+			create table chats (
+				rawdata text    not null,
+				msgid   text    not null
+			);
+			create table images (
+				name    text    not null,
+				zoom    text    not null,
+				location text   not null
+			);
+			create table idbyname (
+				name    text    not null,
+				objid	text    not null
+			);
+			create table classbyid (
+				objid   text    not null,
+				class   text    not null
+			);`)
+		if err != nil {
+			sqldb.Close()
+			return nil, fmt.Errorf("Unable to create sqlite3 database %s contents: %v; %s may be in a corrupt state--fix or delete before running the server!", path, err, path)
+		}
+	} else {
+		sqldb, err = sql.Open("sqlite3", "file:"+path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open sqlite3 database %s: %v", path, err)
+		}
+	}
+	if err = addDicePresetFolderColumns(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add die-roll preset folder columns to sqlite3 database %s: %v", path, err)
+	}
+	if err = createEncounterTables(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add encounter tables to sqlite3 database %s: %v", path, err)
+	}
+	if err = createCreatureTemplateTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add creature template table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createGridTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add grid table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createNoteTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add note table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createAwardTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add award table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createAPITokenTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add API token table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createMetricsTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add metrics table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createDeadLetterTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add dead letter table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createNotifyTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add notification table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createCharacterSheetTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add character sheet table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createBandwidthTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add bandwidth table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createPresetUsageTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add preset usage table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createRegionTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add region table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createLightTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add light table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createEffectsTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add effects table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createChatIndex(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to index chat messages in sqlite3 database %s: %v", path, err)
+	}
+	if err = addEventClockColumns(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add event clock columns to sqlite3 database %s: %v", path, err)
+	}
+	if err = createJournalTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add journal table to sqlite3 database %s: %v", path, err)
+	}
+	if err = createSecurityTable(sqldb); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("Unable to add security event table to sqlite3 database %s: %v", path, err)
+	}
+	return &SQLiteStorage{DB: sqldb}, nil
+}
+
+func (s *SQLiteStorage) Close() error {
+	return s.DB.Close()
+}
+
+func (s *SQLiteStorage) LoadDicePresets() (map[string][]DicePreset, error) {
+	return LoadDicePresets(s.DB)
+}
+
+func (s *SQLiteStorage) UpdateDicePresets(user string, presets []DicePreset) error {
+	return UpdateDicePresets(s.DB, user, presets)
+}
+
+func (s *SQLiteStorage) ListEncounters() ([]Encounter, error) {
+	return LoadEncounters(s.DB, "")
+}
+
+func (s *SQLiteStorage) LoadEncounter(name string) (Encounter, bool, error) {
+	encounters, err := LoadEncounters(s.DB, name)
+	if err != nil || len(encounters) == 0 {
+		return Encounter{}, false, err
+	}
+	return encounters[0], true, nil
+}
+
+func (s *SQLiteStorage) SaveEncounter(enc Encounter) error {
+	return SaveEncounter(s.DB, enc)
+}
+
+func (s *SQLiteStorage) DeleteEncounter(name string) (bool, error) {
+	return DeleteEncounter(s.DB, name)
+}
+
+func (s *SQLiteStorage) ListCreatureTemplates() ([]CreatureTemplate, error) {
+	return LoadCreatureTemplates(s.DB, "")
+}
+
+func (s *SQLiteStorage) LoadCreatureTemplate(name string) (CreatureTemplate, bool, error) {
+	templates, err := LoadCreatureTemplates(s.DB, name)
+	if err != nil || len(templates) == 0 {
+		return CreatureTemplate{}, false, err
+	}
+	return templates[0], true, nil
+}
+
+func (s *SQLiteStorage) SaveCreatureTemplate(t CreatureTemplate) error {
+	return SaveCreatureTemplate(s.DB, t)
+}
+
+func (s *SQLiteStorage) LoadGridSettings() (GridSettings, bool, error) {
+	return LoadGridSettings(s.DB)
+}
+
+func (s *SQLiteStorage) SaveGridSettings(g GridSettings) error {
+	return SaveGridSettings(s.DB, g)
+}
+
+func (s *SQLiteStorage) DeleteCreatureTemplate(name string) (bool, error) {
+	return DeleteCreatureTemplate(s.DB, name)
+}
+
+func (s *SQLiteStorage) ListNotes(user string) ([]Note, error) {
+	return LoadNotes(s.DB, user, "")
+}
+
+func (s *SQLiteStorage) LoadNote(user, title string) (Note, bool, error) {
+	notes, err := LoadNotes(s.DB, user, title)
+	if err != nil || len(notes) == 0 {
+		return Note{}, false, err
+	}
+	return notes[0], true, nil
+}
+
+func (s *SQLiteStorage) SaveNote(user string, note Note) error {
+	return SaveNote(s.DB, user, note)
+}
+
+func (s *SQLiteStorage) DeleteNote(user, title string) (bool, error) {
+	return DeleteNote(s.DB, user, title)
+}
+
+func (s *SQLiteStorage) AddAwards(awards []Award) error {
+	return AddAwards(s.DB, awards)
+}
+
+func (s *SQLiteStorage) LoadAwards(user string) ([]Award, error) {
+	return LoadAwards(s.DB, user)
+}
+
+func (s *SQLiteStorage) SaveAPIToken(t APIToken, hash string) error {
+	return SaveAPIToken(s.DB, t, hash)
+}
+
+func (s *SQLiteStorage) ListAPITokens() ([]APIToken, error) {
+	return ListAPITokens(s.DB)
+}
+
+func (s *SQLiteStorage) LookupAPIToken(hash string) (APIToken, bool, error) {
+	return LookupAPIToken(s.DB, hash)
+}
+
+func (s *SQLiteStorage) RevokeAPIToken(id string) (bool, error) {
+	return RevokeAPIToken(s.DB, id)
+}
+
+func (s *SQLiteStorage) TouchAPIToken(id string, when time.Time) error {
+	return TouchAPIToken(s.DB, id, when)
+}
+
+func (s *SQLiteStorage) SaveMetricSample(sample MetricSample, keepSince time.Time) error {
+	return SaveMetricSample(s.DB, sample, keepSince)
+}
+
+func (s *SQLiteStorage) LoadMetricSamples(since time.Time) ([]MetricSample, error) {
+	return LoadMetricSamples(s.DB, since)
+}
+
+func (s *SQLiteStorage) SaveDeadLetter(recipients []string, letter DeadLetter) error {
+	return SaveDeadLetter(s.DB, recipients, letter)
+}
+
+func (s *SQLiteStorage) TakeDeadLetters(user string) ([]DeadLetter, error) {
+	return TakeDeadLetters(s.DB, user)
+}
+
+func (s *SQLiteStorage) SetNotifyURL(user, url string) error {
+	return SetNotifyURL(s.DB, user, url)
+}
+
+func (s *SQLiteStorage) NotifyURL(user string) (string, bool, error) {
+	return NotifyURL(s.DB, user)
+}
+
+func (s *SQLiteStorage) ListCharacterSheets() ([]CharacterSheet, error) {
+	return ListCharacterSheets(s.DB)
+}
+
+func (s *SQLiteStorage) LoadCharacterSheet(name string) (CharacterSheet, bool, error) {
+	return LoadCharacterSheet(s.DB, name)
+}
+
+func (s *SQLiteStorage) SaveCharacterSheet(sheet CharacterSheet, baseVersion int) (int, error) {
+	return SaveCharacterSheet(s.DB, sheet, baseVersion)
+}
+
+func (s *SQLiteStorage) DeleteCharacterSheet(name string) (bool, error) {
+	return DeleteCharacterSheet(s.DB, name)
+}
+
+func (s *SQLiteStorage) SaveBandwidthUsage(usage []BandwidthUsage) error {
+	return SaveBandwidthUsage(s.DB, usage)
+}
+
+func (s *SQLiteStorage) LoadBandwidthUsage() ([]BandwidthUsage, error) {
+	return LoadBandwidthUsage(s.DB)
+}
+
+func (s *SQLiteStorage) SavePresetUsage(usage []PresetUsage) error {
+	return SavePresetUsage(s.DB, usage)
+}
+
+func (s *SQLiteStorage) LoadPresetUsage() ([]PresetUsage, error) {
+	return LoadPresetUsage(s.DB)
+}
+
+func (s *SQLiteStorage) LoadRegions() ([]Region, error) {
+	return LoadRegions(s.DB)
+}
+
+func (s *SQLiteStorage) SaveRegion(r Region) error {
+	return SaveRegion(s.DB, r)
+}
+
+func (s *SQLiteStorage) DeleteRegion(id string) error {
+	return DeleteRegion(s.DB, id)
+}
+
+func (s *SQLiteStorage) LoadLights() ([]Light, error) {
+	return LoadLights(s.DB)
+}
+
+func (s *SQLiteStorage) SaveLight(l Light) error {
+	return SaveLight(s.DB, l)
+}
+
+func (s *SQLiteStorage) DeleteLight(id string) error {
+	return DeleteLight(s.DB, id)
+}
+
+func (s *SQLiteStorage) LoadAmbientEffects() (AmbientEffects, error) {
+	return LoadAmbientEffects(s.DB)
+}
+
+func (s *SQLiteStorage) SaveAmbientEffects(e AmbientEffects) error {
+	return SaveAmbientEffects(s.DB, e)
+}
+
+func (s *SQLiteStorage) AddSecurityEvent(e SecurityEvent) error {
+	return AddSecurityEvent(s.DB, e)
+}
+
+func (s *SQLiteStorage) SecurityEvents(since time.Time, limit int) ([]SecurityEvent, error) {
+	return SecurityEvents(s.DB, since, limit)
+}
+
+func (s *SQLiteStorage) AddChatMessage(event *MapEvent) error {
+	return AddChatMessage(s.DB, event)
+}
+
+func (s *SQLiteStorage) ClearChatMessages(target string) error {
+	return ClearChatMessages(s.DB, target)
+}
+
+func (s *SQLiteStorage) ChatMessagesAfter(after, limit int) ([]*MapEvent, error) {
+	return ChatMessagesAfter(s.DB, after, limit)
+}
+
+func (s *SQLiteStorage) RecentChatMessageID(n int) (int, bool, error) {
+	return RecentChatMessageID(s.DB, n)
+}
+
+//
+// Save current game state to the database
+//
+// Database Schema
+//  ________________       ________________
+// | events         |     | extradata      |
+// |----------------|     |----------------|
+// | eventid    PAi |---->| extraid    PAi |
+// | rawdata      s |     | eventid      i |
+// | sequence     i |     | datarow      s |
+// | key          s |     |________________|
+// | class        s |
+// | objid        s |
+// | writer       s |
+// | changedby    s |
+// | changed      i |
+// |________________|
+//  ________________
+// | chats          |
+// |----------------|
+// | rawdata      s |
+// | msgid        s |
+// |________________|
+//  ________________
+// | images         |
+// |----------------|
+// | name         s |
+// | zoom         s |
+// | location     s |
+// |________________|
+//  ________________
+// | idbyname       |
+// |----------------|
+// | name         s |
+// | objid        s |
+// |________________|
+//  ________________
+// | classbyid      |
+// |----------------|
+// | objid        s |
+// | class        s |
+// |________________|
+//  ________________
+// | journal        |
+// |----------------|
+// | mark         i |
+// |________________|
+//
+
+// P=primary key
+// A=auto-increment
+// i=integer
+// s=string
+
+func (s *SQLiteStorage) LoadState(gs *GameState) error {
+	var err error
+	var result, subresult *sql.Rows
+	var event *MapEvent
+	var actual_msgid int
+	var loaded MapEventList
+	classes := make(map[string]string)
+
+	if s.DB == nil {
+		log.Printf("LoadState: no database open")
+		return fmt.Errorf("LoadState: no database open")
+	}
+	gs.lockAll()
+	gs.reset()
+	result, err = s.DB.Query(`
+		select eventid, rawdata, sequence, key, class, objid, writer, changedby, changed
+		from events`)
+	if err != nil {
+		log.Printf("LoadState: error loading from events table: %v", err)
+		goto load_err
+	}
+	for result.Next() {
+		var eventid  int64
+		var rawdata  string
+		var sequence int64
+		var key      string
+		var class    string
+		var objid    string
+		var writer   string
+		var changedby string
+		var changed  int64
+		var extra    string
+		err = result.Scan(&eventid, &rawdata, &sequence, &key, &class, &objid, &writer, &changedby, &changed)
+		if err != nil {
+			log.Printf("LoadState: error scanning results from events table: %v", err)
+			goto load_err
+		}
+		event, err = NewMapEvent(rawdata, objid, class)
+		if err != nil {
+			log.Printf("LoadState: error constructing new map event from \"%s\" (id %v, class %v): %v", rawdata, objid, class, err)
+			goto load_err
+		}
+		event.Sequence = int(sequence)
+		if writer != "" {
+			event.Writer = writer
+			event.Changed = EventStamp{Writer: changedby, Sequence: int(changed)}
+		}
+		if event.Key != key {
+			fmt.Printf("Warning: Loaded event #%d (seq %d) has key %s but we think it should be %s", eventid, sequence, key, event.Key)
+		}
+		subresult, err = s.DB.Query(`
+			select datarow from extradata
+				where extradata.eventid = ?
+				order by extraid
+		`, eventid)
+		if err != nil {
+			log.Printf("LoadState: error querying extradata for event id %v: %v", eventid, err)
+			goto load_err
+		}
+		for subresult.Next() {
+			err = subresult.Scan(&extra)
+			if err != nil {
+				log.Printf("LoadState: error scanning extradata value for event id %v: %v", eventid, err)
+				goto load_err
+			}
+			event.MultiRawData = append(event.MultiRawData, extra)
+		}
+		subresult.Close()
+		loaded = append(loaded, event)
+	}
+	result.Close()
+	//
+	// Replay the saved events in their original order to rebuild
+	// the game state. (Older databases have the individual PS and OA
+	// events; newer ones have a single LS event for each object.)
+	//
+	sort.Sort(loaded)
+	for _, event = range loaded {
+		if err = gs.apply(event); err != nil {
+			log.Printf("LoadState: skipping event %v: %v", event.Fields, err)
+			err = nil
+		}
+	}
+
+	result, err = s.DB.Query(`select rawdata, msgid from chats`)
+	if err != nil {
+		log.Printf("LoadState: error querying chats table: %v", err)
+		goto load_err
+	}
+	for result.Next() {
+		var rawdata  string
+		var msgid    int
+		err = result.Scan(&rawdata, &msgid)
+		if err != nil {
+			log.Printf("LoadState: error scanning result of chats table query: %v", err)
+			goto load_err
+		}
+		event, err = NewMapEvent(rawdata, "", "")
+		if err != nil {
+			log.Printf("LoadState: error creating new map event for \"%s\": %v", rawdata, err)
+			goto load_err
+		}
+		actual_msgid, err = event.MessageID()
+		if err != nil {
+			log.Printf("Warning: skipping restored chat message %s with no apparent message ID", rawdata)
+			continue
+		}
+		if actual_msgid != msgid {
+			log.Printf("Warning: restored chat message %s with message ID %d but database says it should be %d",
+				rawdata, actual_msgid, msgid)
+		}
+		gs.ChatHistory = append(gs.ChatHistory, event)
+		AdvanceMessageId(actual_msgid)
+	}
+	result.Close()
+
+	result, err = s.DB.Query(`select name, zoom, location from images`)
+	if err != nil {
+		log.Printf("LoadState: error querying images table: %v", err)
+		goto load_err
+	}
+	for result.Next() {
+		var name string
+		var zoom string
+		var location string
+		err = result.Scan(&name, &zoom, &location)
+		if err != nil {
+			log.Printf("LoadState: error scanning image table: %v", err)
+			goto load_err
+		}
+		gs.Images[name + "‖" + zoom] = ImageLocation{Name: name, Zoom: zoom, Location: location}
+	}
+	result.Close()
+
+	result, err = s.DB.Query(`select name, objid from idbyname`)
+	if err != nil {
+		log.Printf("LoadState: error querying idbyname table: %v", err)
+		goto load_err
+	}
+	for result.Next() {
+		var name string
+		var objid string
+		err = result.Scan(&name, &objid)
+		if err != nil {
+			log.Printf("LoadState: error scanning idbyname: %v", err)
+			goto load_err
+		}
+		gs.IdByName[name] = objid
+	}
+	result.Close()
+
+	result, err = s.DB.Query(`select objid, class from classbyid`)
+	if err != nil {
+		log.Printf("LoadState: error querying classbyid table: %v", err)
+		goto load_err
+	}
+	for result.Next() {
+		var class string
+		var objid string
+		err = result.Scan(&objid, &class)
+		if err != nil {
+			log.Printf("LoadState: error scanning classbyid: %v", err)
+			goto load_err
+		}
+		classes[objid] = class
+	}
+	result.Close()
+	for objid, class := range classes {
+		if obj, ok := gs.Objects[objid]; ok && obj.Class == "" {
+			obj.Class = class
+		}
+	}
+
+	err = s.DB.QueryRow(`select mark from journal`).Scan(&gs.journaled)
+	if err == sql.ErrNoRows {
+		err = nil
+	} else if err != nil {
+		log.Printf("LoadState: error querying journal table: %v", err)
+		goto load_err
+	}
+
+	gs.unlockAll()
+	gs.MarkSaved()
+	return nil
+
+load_err:
+	gs.unlockAll()
+	return fmt.Errorf("Error reading from game state database (%v)", err)
+}
+
+func (s *SQLiteStorage) SaveState(gs *GameState) error {
+	var mark int64
+
+	if s.DB == nil {
+		return fmt.Errorf("SaveState: no database open")
+	}
+
+	err := withTransaction(s.DB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			delete from events;
+			delete from extradata;
+			delete from chats;
+			delete from images;
+			delete from idbyname;
+			delete from classbyid;
+			delete from journal;
+		`); err != nil {
+			return err
+		}
+
+		gs.rlockAll()
+		defer gs.runlockAll()
+		mark = gs.journalMark()
+		return saveGameState(tx, gs, mark)
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing to game state database (%v)", err)
+	}
+	gs.noteSnapshot(mark)
+	return nil
+}
+
+//
+// Write the game state into the (freshly emptied) tables. The caller
+// must hold the game state's locks.
+//
+func saveGameState(tx *sql.Tx, gs *GameState, mark int64) error {
+	if _, err := tx.Exec(`insert into journal (mark) values (?)`, mark); err != nil {
+		return err
+	}
+	for _, event := range gs.allEvents() {
+		rawdata, err := event.RawEventText()
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(`insert into events (rawdata, sequence, key, class, objid, writer, changedby, changed)
+			values (?, ?, ?, ?, ?, ?, ?, ?)`,
+			rawdata, event.Sequence, event.Key, event.Class, event.ID, event.Writer, event.Changed.Writer, event.Changed.Sequence)
+		if err != nil {
+			return err
+		}
+		eventid, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for _, extra := range event.MultiRawData {
+			if _, err = tx.Exec(`insert into extradata (eventid, datarow) values (?, ?)`,
+				eventid, extra); err != nil {
+				return err
+			}
+		}
+	}
+	for _, chat := range gs.ChatHistory {
+		msgid, err := chat.MessageID()
+		if err != nil {
+			return err
+		}
+		rawdata, err := chat.RawEventText()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`insert into chats (rawdata, msgid) values (?, ?)`,
+			rawdata, msgid); err != nil {
+			return err
+		}
+	}
+
+	for _, image := range gs.Images {
+		if _, err := tx.Exec(`insert into images (name, zoom, location) values (?, ?, ?)`, image.Name, image.Zoom, image.Location); err != nil {
+			return err
+		}
+	}
+
+	for k, v := range gs.IdByName {
+		if _, err := tx.Exec(`insert into idbyname (name, objid) values (?, ?)`, k, v); err != nil {
+			return err
+		}
+	}
+
+	for k, obj := range gs.Objects {
+		if _, err := tx.Exec(`insert into classbyid (objid, class) values (?, ?)`, k, obj.Class); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,116 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the sqlite storage backend
+//
+
+package mapservice
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSQLiteStorage_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	storage, err := OpenStorageBackend("sqlite", path)
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+
+	ms := MapService{Storage: storage, State: NewGameState()}
+	ms.State.SetImageLocation("goblin", "1.0", "abc123")
+	ev, err := NewMapEvent("PS 1234 red Grax 1 M monster 3 4 0", "", "")
+	if err != nil {
+		t.Fatalf("unable to create event: %v", err)
+	}
+	ms.UpdateState(ev)
+
+	if err = ms.SaveState(); err != nil {
+		t.Fatalf("unable to save state: %v", err)
+	}
+	if ms.State.NeedsSave() {
+		t.Errorf("SaveNeeded still set after save")
+	}
+
+	restored := MapService{Storage: storage}
+	if err = restored.LoadState(); err != nil {
+		t.Fatalf("unable to load state: %v", err)
+	}
+	if !cmp.Equal(ms.State.Images, restored.State.Images) {
+		t.Errorf("image list differs: %s", cmp.Diff(ms.State.Images, restored.State.Images))
+	}
+	if !cmp.Equal(ms.State.IdByName, restored.State.IdByName) {
+		t.Errorf("name list differs: %s", cmp.Diff(ms.State.IdByName, restored.State.IdByName))
+	}
+	r, ok := restored.State.Objects["1234"]
+	if !ok {
+		t.Fatalf("creature not restored: %v", restored.State.Objects)
+	}
+	if !cmp.Equal(r, ms.State.Objects["1234"]) {
+		t.Errorf("restored object differs: %s", cmp.Diff(ms.State.Objects["1234"], r))
+	}
+
+	if err = storage.UpdateDicePresets("alice", []DicePreset{{Name: "a", Description: "b", RollSpec: "d20"}}); err != nil {
+		t.Fatalf("unable to update presets: %v", err)
+	}
+	presets, err := storage.LoadDicePresets()
+	if err != nil || len(presets["alice"]) != 1 {
+		t.Errorf("presets not restored (%v): %v", err, presets)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,275 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                   Game State API                                   //
+//                                                                                    //
+// Read-only views of the game state (what is on the map, where the creatures are,    //
+// the initiative order, the game clock, and who is connected) for the HTTP API.      //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// An APIObject is an object on the map, with all its attributes.
+//
+type APIObject struct {
+	ID    string            `json:"id"`
+	Class string            `json:"class"`
+	Attrs map[string]string `json:"attributes"`
+}
+
+//
+// An APICreature is where a creature token is on the map's grid.
+//
+type APICreature struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	X    int    `json:"x"`
+	Y    int    `json:"y"`
+}
+
+//
+// An APIInitiativeSlot is one creature's place in the initiative order.
+//
+type APIInitiativeSlot struct {
+	Slot     int    `json:"slot"`
+	Name     string `json:"name"`
+	HP       int    `json:"hp"`
+	Hold     bool   `json:"hold"`
+	NoHealth bool   `json:"no_health"`
+}
+
+//
+// APIInitiative is the initiative order and whose turn it is.
+//
+type APIInitiative struct {
+	Combat bool                `json:"combat"`
+	Time   string              `json:"time,omitempty"` // game time of the current turn
+	Turn   string              `json:"turn,omitempty"` // creature whose turn it is
+	Slots  []APIInitiativeSlot `json:"slots"`
+}
+
+//
+// APIClock is the game clock, as last set by the GM.
+//
+type APIClock struct {
+	Absolute string `json:"absolute"`
+	Relative string `json:"relative"`
+}
+
+//
+// An APIClient is someone connected to the server.
+//
+type APIClient struct {
+	User string `json:"user"`
+	GM   bool   `json:"gm"`
+}
+
+//
+// APIGameState is the whole game state as it is offered through the
+// HTTP API, for dashboards and stream overlays which don't speak the
+// mapper protocol.
+//
+type APIGameState struct {
+	Objects    []APIObject   `json:"objects"`
+	Creatures  []APICreature `json:"creatures"`
+	Initiative APIInitiative `json:"initiative"`
+	Clock      *APIClock     `json:"clock"`
+	Clients    []APIClient   `json:"clients"`
+}
+
+//
+// RecordedEvent returns the fields of the last event recorded under
+// the given key (such as "IL" or "CS"), if there was one.
+//
+func (gs *GameState) RecordedEvent(key string) ([]string, bool) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	ev, ok := gs.EventHistory[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]string(nil), ev.Fields...), true
+}
+
+//
+// The objects on the map, leaving out those on the GM's own layers
+// unless gm is true.
+//
+func (ms *MapService) apiObjects(gm bool) []APIObject {
+	objects := []APIObject{}
+	for _, obj := range ms.State.MapObjects() {
+		if gm || !ms.isGMLayer(obj.Attrs["LAYER"]) {
+			objects = append(objects, APIObject{ID: obj.ID, Class: obj.Class, Attrs: obj.Attrs})
+		}
+	}
+	return objects
+}
+
+//
+// Where each creature is on the map, leaving out those on the GM's own
+// layers unless gm is true.
+//
+func (ms *MapService) apiCreatures(gm bool) []APICreature {
+	creatures := []APICreature{}
+	positions, names := ms.State.CreaturePositions()
+	for id, position := range positions {
+		if gm || !ms.isGMObject(id) {
+			creatures = append(creatures, APICreature{ID: id, Name: names[id], X: position.X, Y: position.Y})
+		}
+	}
+	sort.Slice(creatures, func(i, j int) bool { return creatures[i].ID < creatures[j].ID })
+	return creatures
+}
+
+//
+// The initiative order (from the last IL message) and whose turn it is.
+//
+func (ms *MapService) apiInitiative() APIInitiative {
+	initiative := APIInitiative{Combat: ms.State.CombatActive(), Slots: []APIInitiativeSlot{}}
+	if fields, ok := ms.State.RecordedEvent("I"); ok && len(fields) > 2 {
+		initiative.Time, initiative.Turn = fields[1], fields[2]
+	}
+	fields, ok := ms.State.RecordedEvent("IL")
+	if !ok || len(fields) < 2 {
+		return initiative
+	}
+	slots, err := ParseTclList(fields[1])
+	if err != nil {
+		return initiative
+	}
+	for _, s := range slots {
+		slot, err := ParseTclList(s)
+		if err != nil || len(slot) < 2 {
+			continue
+		}
+		entry := APIInitiativeSlot{Name: slot[1]}
+		entry.Slot, _ = strconv.Atoi(slot[0])
+		if len(slot) > 2 {
+			entry.HP, _ = strconv.Atoi(slot[2])
+		}
+		entry.Hold = len(slot) > 3 && slot[3] != "0" && slot[3] != ""
+		entry.NoHealth = len(slot) > 4 && slot[4] != "0" && slot[4] != ""
+		initiative.Slots = append(initiative.Slots, entry)
+	}
+	return initiative
+}
+
+//
+// The game clock (from the last CS message), if it has been set.
+//
+func (ms *MapService) apiClock() *APIClock {
+	if fields, ok := ms.State.RecordedEvent("CS"); ok && len(fields) > 2 {
+		return &APIClock{Absolute: fields[1], Relative: fields[2]}
+	}
+	return nil
+}
+
+//
+// Who is connected, sorted by name.
+//
+func (ms *MapService) apiConnectedClients() []APIClient {
+	clients := []APIClient{}
+	for _, peer := range ms.AllClients() {
+		if peer.Authenticated {
+			clients = append(clients, APIClient{User: peer.Username(), GM: peer.IsGM()})
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].User < clients[j].User })
+	return clients
+}
+
+//
+// GET /api/v1/state
+// GET /api/v1/state/objects|creatures|initiative|clock|clients
+// The current state of the game (an APIGameState), or just one part of
+// it. Anything on the GM's own map layers is only included for admin
+// tokens.
+//
+func (ms *MapService) apiGameState(w http.ResponseWriter, r *http.Request, t APIToken) {
+	gm := t.Allows(ScopeAdmin)
+	switch strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/state"), "/") {
+		case "":
+			writeJSON(w, http.StatusOK, APIGameState{
+				Objects:    ms.apiObjects(gm),
+				Creatures:  ms.apiCreatures(gm),
+				Initiative: ms.apiInitiative(),
+				Clock:      ms.apiClock(),
+				Clients:    ms.apiConnectedClients(),
+			})
+		case "objects":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"objects": ms.apiObjects(gm)})
+		case "creatures":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"creatures": ms.apiCreatures(gm)})
+		case "initiative":
+			writeJSON(w, http.StatusOK, ms.apiInitiative())
+		case "clock":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"clock": ms.apiClock()})
+		case "clients":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"clients": ms.apiConnectedClients()})
+		default:
+			apiError(w, http.StatusNotFound, "no such part of the game state")
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,135 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the game state API
+//
+
+package mapservice
+
+import (
+	"testing"
+)
+
+func TestGameStateAPI(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/api.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := newTestService()
+	ms.Storage = storage
+	_, admin, _ := ms.issueAPIToken("gm", ScopeAdmin, 0)
+	_, reader, _ := ms.issueAPIToken("overlay", ScopeReadOnly, 0)
+	gm := newTestClient(ms, "gm", "GM", true)
+	newTestClient(ms, "alice", "alice", false)
+
+	sendTestLS(t, ms, gm,
+		"P NAME:p1 Fizban", "P GX:p1 3", "P GY:p1 4",
+		"M NAME:m1 Assassin", "M GX:m1 7", "M GY:m1 1", "M LAYER:m1 gm",
+		"TEXT:t1 {welcome}")
+	ms.ExecuteAction(testEvent(t, "IL {{0 Fizban 12 0 0} {1 Assassin 8 1 1}}"), gm)
+	ms.ExecuteAction(testEvent(t, "CO 1"), gm)
+	ms.ExecuteAction(testEvent(t, "I {1 0 0} p1"), gm)
+	ms.ExecuteAction(testEvent(t, "CS 1234 56"), gm)
+
+	status, reply := apiTestRequest(t, ms, "GET", "/api/v1/state", reader, "")
+	if status != 200 {
+		t.Fatalf("GET state got %d %v", status, reply)
+	}
+	if objects, _ := reply["objects"].([]interface{}); len(objects) != 2 {
+		t.Errorf("objects were %v", reply["objects"])
+	}
+	creatures, _ := reply["creatures"].([]interface{})
+	if len(creatures) != 1 {
+		t.Fatalf("creatures were %v", reply["creatures"])
+	}
+	if c := creatures[0].(map[string]interface{}); c["id"] != "p1" || c["name"] != "Fizban" || c["x"] != 3.0 || c["y"] != 4.0 {
+		t.Errorf("creature was %v", c)
+	}
+	initiative, _ := reply["initiative"].(map[string]interface{})
+	slots, _ := initiative["slots"].([]interface{})
+	if initiative["combat"] != true || initiative["turn"] != "p1" || initiative["time"] != "1 0 0" || len(slots) != 2 {
+		t.Fatalf("initiative was %v", initiative)
+	}
+	if s := slots[1].(map[string]interface{}); s["slot"] != 1.0 || s["name"] != "Assassin" || s["hp"] != 8.0 || s["hold"] != true || s["no_health"] != true {
+		t.Errorf("initiative slot was %v", s)
+	}
+	if clock, _ := reply["clock"].(map[string]interface{}); clock["absolute"] != "1234" || clock["relative"] != "56" {
+		t.Errorf("clock was %v", reply["clock"])
+	}
+	if clients, _ := reply["clients"].([]interface{}); len(clients) != 2 {
+		t.Errorf("clients were %v", reply["clients"])
+	}
+
+	if status, reply = apiTestRequest(t, ms, "GET", "/api/v1/state/creatures", admin, ""); status != 200 {
+		t.Errorf("GET creatures got %d %v", status, reply)
+	} else if creatures, _ := reply["creatures"].([]interface{}); len(creatures) != 2 {
+		t.Errorf("GM's creatures were %v", reply["creatures"])
+	}
+	if status, reply = apiTestRequest(t, ms, "GET", "/api/v1/state/objects", admin, ""); status != 200 {
+		t.Errorf("GET objects got %d %v", status, reply)
+	} else if objects, _ := reply["objects"].([]interface{}); len(objects) != 3 {
+		t.Errorf("GM's objects were %v", reply["objects"])
+	}
+	if status, reply = apiTestRequest(t, ms, "GET", "/api/v1/state/initiative", reader, ""); status != 200 || reply["turn"] != "p1" {
+		t.Errorf("GET initiative got %d %v", status, reply)
+	}
+	if status, reply = apiTestRequest(t, ms, "GET", "/api/v1/state/hp", reader, ""); status != 404 {
+		t.Errorf("GET unknown part got %d %v", status, reply)
+	}
+	if status, reply = apiTestRequest(t, ms, "POST", "/api/v1/state", admin, ""); status != 405 {
+		t.Errorf("POST state got %d %v", status, reply)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,197 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                 Game State Locking                                 //
+//                                                                                    //
+// The separate locks guarding each part of the game state, and the contention        //
+// figures they collect so a busy server's lock convoys can be seen.                  //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// LockContentionThreshold is how long a goroutine may wait for one of
+// the game state's locks before we count that as contention.
+//
+const LockContentionThreshold = 100 * time.Microsecond
+
+//
+// contendedLock is a sync.RWMutex which keeps track of how often, and
+// for how long, goroutines have had to wait for it.
+//
+type contendedLock struct {
+	acquired  int64 // times the lock has been taken
+	contended int64 // times someone waited longer than LockContentionThreshold for it
+	waitNanos int64 // total time spent in those waits
+	maxNanos  int64 // longest wait
+	mutex     sync.RWMutex
+}
+
+func (l *contendedLock) Lock() {
+	start := time.Now()
+	l.mutex.Lock()
+	l.waited(time.Since(start))
+}
+
+func (l *contendedLock) Unlock() {
+	l.mutex.Unlock()
+}
+
+func (l *contendedLock) RLock() {
+	start := time.Now()
+	l.mutex.RLock()
+	l.waited(time.Since(start))
+}
+
+func (l *contendedLock) RUnlock() {
+	l.mutex.RUnlock()
+}
+
+func (l *contendedLock) waited(wait time.Duration) {
+	atomic.AddInt64(&l.acquired, 1)
+	if wait < LockContentionThreshold {
+		return
+	}
+	atomic.AddInt64(&l.contended, 1)
+	atomic.AddInt64(&l.waitNanos, int64(wait))
+	for {
+		longest := atomic.LoadInt64(&l.maxNanos)
+		if int64(wait) <= longest || atomic.CompareAndSwapInt64(&l.maxNanos, longest, int64(wait)) {
+			return
+		}
+	}
+}
+
+//
+// LockStats describes how much waiting there has been for one of the
+// game state's locks since the server started.
+//
+type LockStats struct {
+	Name      string  `json:"name"`
+	Acquired  int64   `json:"acquired"`  // times the lock was taken
+	Contended int64   `json:"contended"` // times someone had to wait for it
+	Wait      float64 `json:"wait"`      // total seconds spent waiting
+	MaxWait   float64 `json:"max_wait"`  // longest wait in seconds
+}
+
+func (l *contendedLock) stats(name string) LockStats {
+	return LockStats{
+		Name:      name,
+		Acquired:  atomic.LoadInt64(&l.acquired),
+		Contended: atomic.LoadInt64(&l.contended),
+		Wait:      time.Duration(atomic.LoadInt64(&l.waitNanos)).Seconds(),
+		MaxWait:   time.Duration(atomic.LoadInt64(&l.maxNanos)).Seconds(),
+	}
+}
+
+//
+// The game state is guarded by separate locks for its objects and
+// events (which change together), its chat history, and its image
+// locations, so that (say) a flurry of die rolls doesn't hold up
+// moving creatures around. When more than one is needed, they are
+// always taken in that order.
+//
+func (gs *GameState) lockAll() {
+	gs.lock.Lock()
+	gs.chatLock.Lock()
+	gs.imageLock.Lock()
+}
+
+func (gs *GameState) unlockAll() {
+	gs.imageLock.Unlock()
+	gs.chatLock.Unlock()
+	gs.lock.Unlock()
+}
+
+func (gs *GameState) rlockAll() {
+	gs.lock.RLock()
+	gs.chatLock.RLock()
+	gs.imageLock.RLock()
+}
+
+func (gs *GameState) runlockAll() {
+	gs.imageLock.RUnlock()
+	gs.chatLock.RUnlock()
+	gs.lock.RUnlock()
+}
+
+//
+// Note that the game state has changed since it was last saved.
+//
+func (gs *GameState) markChanged() {
+	gs.saveLock.Lock()
+	gs.SaveNeeded = true
+	gs.saveLock.Unlock()
+}
+
+//
+// LockStats reports how much waiting there has been for each of the
+// game state's locks.
+//
+func (gs *GameState) LockStats() []LockStats {
+	return []LockStats{
+		gs.lock.stats("objects"),
+		gs.chatLock.stats("chat"),
+		gs.imageLock.stats("images"),
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,149 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for the game state's locks
+//
+
+package mapservice
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestContendedLock(t *testing.T) {
+	var l contendedLock
+	l.RLock()
+	l.RUnlock()
+	l.Lock()
+	done := make(chan bool)
+	go func() {
+		l.RLock()
+		l.RUnlock()
+		done <- true
+	}()
+	time.Sleep(20 * time.Millisecond)
+	l.Unlock()
+	<-done
+
+	s := l.stats("test")
+	if s.Name != "test" || s.Acquired != 3 || s.Contended != 1 || s.MaxWait < 0.01 || s.Wait != s.MaxWait {
+		t.Errorf("stats were %+v", s)
+	}
+}
+
+func TestGameStateShards(t *testing.T) {
+	gs := NewGameState()
+
+	// someone holding the chat history doesn't hold up the map
+	gs.chatLock.Lock()
+	recorded := make(chan error)
+	go func() {
+		gs.SetImageLocation("goblin", "1", "/images/goblin.png")
+		recorded <- gs.Record(testEvent(t, "PS abc red goblin 1 M monster 3 4 0"))
+	}()
+	select {
+		case err := <-recorded:
+			if err != nil {
+				t.Errorf("record failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("recording an object waited for the chat lock")
+	}
+	gs.chatLock.Unlock()
+	if _, ok := gs.Object("abc"); !ok || !gs.NeedsSave() {
+		t.Errorf("object was not recorded")
+	}
+
+	// and everything still works when all of them are busy at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				gs.AddChatMessage(testEvent(t, fmt.Sprintf("TO GM * {hi %d} 0", j)))
+				gs.SetImageLocation(fmt.Sprintf("img%d", i), "1", "x")
+				gs.Record(testEvent(t, fmt.Sprintf("AV %d %d", i, j)))
+				gs.ChatMessages("-5")
+				gs.Events()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if m, _ := gs.ChatMessages(""); len(m) != 400 {
+		t.Errorf("%d chat messages recorded", len(m))
+	}
+
+	stats := gs.LockStats()
+	if len(stats) != 3 || stats[0].Name != "objects" || stats[1].Name != "chat" || stats[2].Name != "images" || stats[1].Acquired < 800 {
+		t.Errorf("lock stats were %+v", stats)
+	}
+
+	ms := newTestService()
+	ms.State = gs
+	storage, err := OpenStorageBackend("sqlite", t.TempDir()+"/locks.db")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms.Storage = storage
+	_, token, _ := ms.issueAPIToken("grafana", ScopeReadOnly, 0)
+	if status, reply := apiTestRequest(t, ms, "GET", "/api/v1/metrics", token, ""); status != 200 || len(reply["locks"].([]interface{})) != 3 {
+		t.Errorf("metrics got %d %v", status, reply)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
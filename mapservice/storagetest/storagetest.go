@@ -0,0 +1,363 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                             Storage backend conformance                            //
+//                                                                                    //
+// Tests which any StorageBackend must pass, so whoever writes a new one (for another //
+// database, say) can check it keeps everything the server expects it to.            //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+//
+// Package storagetest checks that a storage backend for the map server
+// behaves as the server expects. A backend's own tests call Run with a
+// function which opens a fresh, empty instance of it:
+//
+//   func TestConformance(t *testing.T) {
+//       storagetest.Run(t, func(t *testing.T) mapservice.StorageBackend {
+//           s, err := OpenMyStorage(t.TempDir() + "/test.db")
+//           if err != nil {
+//               t.Fatalf("unable to open storage: %v", err)
+//           }
+//           return s
+//       })
+//   }
+//
+// The optional interfaces a backend may implement (such as ChatStorage)
+// are tested only if it does.
+//
+package storagetest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fizban-of-ragnarok/go-gma-server/mapservice"
+)
+
+//
+// An Opener opens a new, empty instance of the backend being tested.
+// It should fail the test if it can't. The backend is closed when the
+// test which opened it is done.
+//
+type Opener func(t *testing.T) mapservice.StorageBackend
+
+//
+// Run runs all of the conformance tests against the backend, each as
+// a subtest with an instance of its own.
+//
+func Run(t *testing.T, open Opener) {
+	for _, test := range []struct {
+		name string
+		run  func(*testing.T, mapservice.StorageBackend)
+	}{
+		{"DicePresets", testDicePresets},
+		{"Images", testImages},
+		{"Scene", testScene},
+		{"ChatHistory", testChatHistory},
+		{"ChatStorage", testChatStorage},
+		{"EmptyState", testEmptyState},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			s := open(t)
+			defer func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("Close: %v", err)
+				}
+			}()
+			test.run(t, s)
+		})
+	}
+}
+
+//
+// Save the game state and load it back into a new one.
+//
+func roundTrip(t *testing.T, s mapservice.StorageBackend, gs *mapservice.GameState) *mapservice.GameState {
+	t.Helper()
+	if err := s.SaveState(gs); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+	restored := mapservice.NewGameState()
+	if err := s.LoadState(restored); err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	return restored
+}
+
+func testDicePresets(t *testing.T, s mapservice.StorageBackend) {
+	presets, err := s.LoadDicePresets()
+	if err != nil {
+		t.Fatalf("LoadDicePresets from empty storage: %v", err)
+	}
+	if len(presets) != 0 {
+		t.Errorf("empty storage has presets %v", presets)
+	}
+
+	alice := []mapservice.DicePreset{
+		{Name: "attack", Description: "sword", RollSpec: "d20+5", Folder: "melee", SortOrder: 2},
+		{Name: "1|damage", Description: "sword {with} \"quotes\"", RollSpec: "1d8+3"},
+	}
+	bob := []mapservice.DicePreset{
+		{Name: "init", Description: "", RollSpec: "d20+2"},
+	}
+	for user, list := range map[string][]mapservice.DicePreset{"alice": alice, "bob": bob} {
+		if err = s.UpdateDicePresets(user, list); err != nil {
+			t.Fatalf("UpdateDicePresets(%s): %v", user, err)
+		}
+	}
+	if presets, err = s.LoadDicePresets(); err != nil {
+		t.Fatalf("LoadDicePresets: %v", err)
+	}
+	if !reflect.DeepEqual(presets["alice"], alice) || !reflect.DeepEqual(presets["bob"], bob) {
+		t.Errorf("presets came back as %v", presets)
+	}
+
+	// an update replaces the user's whole list, and nobody else's
+	if err = s.UpdateDicePresets("alice", alice[1:]); err != nil {
+		t.Fatalf("UpdateDicePresets: %v", err)
+	}
+	if err = s.UpdateDicePresets("bob", nil); err != nil {
+		t.Fatalf("UpdateDicePresets with no presets: %v", err)
+	}
+	if presets, err = s.LoadDicePresets(); err != nil {
+		t.Fatalf("LoadDicePresets: %v", err)
+	}
+	if !reflect.DeepEqual(presets["alice"], alice[1:]) || len(presets["bob"]) != 0 {
+		t.Errorf("after updates, presets came back as %v", presets)
+	}
+}
+
+func testImages(t *testing.T, s mapservice.StorageBackend) {
+	gs := mapservice.NewGameState()
+	gs.SetImageLocation("goblin", "1.0", "abc123")
+	gs.SetImageLocation("goblin", "2.0", "def456")
+	gs.SetImageLocation("cave floor", "1.0", "https://example.com/floor.png")
+
+	restored := roundTrip(t, s, gs)
+	if !reflect.DeepEqual(restored.Images, gs.Images) {
+		t.Errorf("images came back as %v, expected %v", restored.Images, gs.Images)
+	}
+
+	// saving replaces what was saved before
+	gs = mapservice.NewGameState()
+	gs.SetImageLocation("orc", "1.0", "aaa")
+	restored = roundTrip(t, s, gs)
+	if !reflect.DeepEqual(restored.Images, gs.Images) {
+		t.Errorf("after saving again, images came back as %v, expected %v", restored.Images, gs.Images)
+	}
+}
+
+//
+// A small scene, as it would be read from a .map file, with map
+// elements, a creature, and an element with multiple lines of data.
+//
+const testMapFile = `__MAPPER__:17 {{conformance test} {1600000000 {Sun Sep 13 12:26:40 UTC 2020}}}
+TYPE:w1 line
+X:w1 10
+Y:w1 20
+POINTS:w1 {30 20 30 40}
+FILL:w1 {}
+TYPE:t1 tile
+IMAGE:t1 {cave floor}
+X:t1 0
+Y:t1 0
+M NAME:g1 {Grax the Goblin}
+M TYPE:g1 monster
+M GX:g1 3
+M GY:g1 4
+M SIZE:g1 S
+M COLOR:g1 red
+`
+
+func testScene(t *testing.T, s mapservice.StorageBackend) {
+	_, objects, err := mapservice.ReadMapFile(strings.NewReader(testMapFile))
+	if err != nil {
+		t.Fatalf("unable to read test scene: %v", err)
+	}
+	gs := mapservice.NewGameState()
+	for i := range objects {
+		event, err := objects[i].LoadEvent()
+		if err != nil {
+			t.Fatalf("unable to place %s: %v", objects[i].ID, err)
+		}
+		if err = gs.Record(event); err != nil {
+			t.Fatalf("unable to place %s: %v", objects[i].ID, err)
+		}
+	}
+	if len(gs.MapObjects()) != len(objects) {
+		t.Fatalf("test scene has %d objects, but only %d were placed", len(objects), len(gs.MapObjects()))
+	}
+
+	restored := roundTrip(t, s, gs)
+	if got, expected := restored.MapObjects(), gs.MapObjects(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("scene came back as\n%v\nexpected\n%v", got, expected)
+	}
+	if !reflect.DeepEqual(restored.IdByName, gs.IdByName) {
+		t.Errorf("creature names came back as %v, expected %v", restored.IdByName, gs.IdByName)
+	}
+	if restored.Clock().String() != gs.Clock().String() {
+		t.Errorf("event clock came back as %v, expected %v", restored.Clock(), gs.Clock())
+	}
+
+	// clearing the map and saving again leaves nothing behind
+	gs.ClearObjects("*")
+	restored = roundTrip(t, s, gs)
+	if objects := restored.MapObjects(); len(objects) != 0 {
+		t.Errorf("after clearing the map, %d objects came back", len(objects))
+	}
+}
+
+func chatMessage(t *testing.T, raw string) *mapservice.MapEvent {
+	t.Helper()
+	event, err := mapservice.NewMapEvent(raw, "", "")
+	if err != nil {
+		t.Fatalf("unable to make chat message %q: %v", raw, err)
+	}
+	return event
+}
+
+//
+// The text of each message, in order.
+//
+func chatText(messages []*mapservice.MapEvent) []string {
+	var text []string
+	for _, m := range messages {
+		raw, _ := m.RawEventText()
+		text = append(text, raw)
+	}
+	return text
+}
+
+func testChatHistory(t *testing.T, s mapservice.StorageBackend) {
+	gs := mapservice.NewGameState()
+	gs.AddChatMessage(chatMessage(t, `TO alice * {hello, everyone} 0`))
+	gs.AddChatMessage(chatMessage(t, `TO GM {bob GM} {a {private} word} 0`))
+	gs.AddChatMessage(chatMessage(t, `ROLL bob * {d20 = 17} {17 {= d20}} 0 0`))
+
+	restored := roundTrip(t, s, gs)
+	expected, _ := gs.ChatMessages("")
+	got, err := restored.ChatMessages("")
+	if err != nil {
+		t.Fatalf("ChatMessages: %v", err)
+	}
+	if !reflect.DeepEqual(chatText(got), chatText(expected)) {
+		t.Errorf("chat history came back as\n%q\nexpected\n%q", chatText(got), chatText(expected))
+	}
+}
+
+func testChatStorage(t *testing.T, s mapservice.StorageBackend) {
+	chats, ok := s.(mapservice.ChatStorage)
+	if !ok {
+		t.Skip("backend doesn't implement ChatStorage")
+	}
+	gs := mapservice.NewGameState()
+	var ids []int
+	for _, raw := range []string{`TO alice * one 0`, `TO bob * two 0`, `TO alice * three 0`} {
+		event := chatMessage(t, raw)
+		gs.AddChatMessage(event)
+		if err := chats.AddChatMessage(event); err != nil {
+			t.Fatalf("AddChatMessage: %v", err)
+		}
+		id, err := event.MessageID()
+		if err != nil {
+			t.Fatalf("message %v has no ID: %v", event.Fields, err)
+		}
+		ids = append(ids, id)
+	}
+
+	all, err := chats.ChatMessagesAfter(0, 10)
+	if err != nil {
+		t.Fatalf("ChatMessagesAfter: %v", err)
+	}
+	expected, _ := gs.ChatMessages("")
+	if !reflect.DeepEqual(chatText(all), chatText(expected)) {
+		t.Errorf("chat messages came back as\n%q\nexpected\n%q", chatText(all), chatText(expected))
+	}
+	if batch, err := chats.ChatMessagesAfter(ids[0], 1); err != nil || len(batch) != 1 || batch[0].Fields[3] != "two" {
+		t.Errorf("ChatMessagesAfter(%d, 1) = %q, %v", ids[0], chatText(batch), err)
+	}
+	if id, found, err := chats.RecentChatMessageID(2); err != nil || !found || id != ids[1] {
+		t.Errorf("RecentChatMessageID(2) = %d, %v, %v; expected %d", id, found, err, ids[1])
+	}
+	if _, found, err := chats.RecentChatMessageID(4); err != nil || found {
+		t.Errorf("RecentChatMessageID(4) of 3 found a message (%v)", err)
+	}
+
+	// CC -1 keeps only the most recent message
+	if err = chats.ClearChatMessages("-1"); err != nil {
+		t.Fatalf("ClearChatMessages(-1): %v", err)
+	}
+	if left, err := chats.ChatMessagesAfter(0, 10); err != nil || len(left) != 1 || left[0].Fields[3] != "three" {
+		t.Errorf("after CC -1, chat messages are %q (%v)", chatText(left), err)
+	}
+	if err = chats.ClearChatMessages(""); err != nil {
+		t.Fatalf("ClearChatMessages: %v", err)
+	}
+	if left, err := chats.ChatMessagesAfter(0, 10); err != nil || len(left) != 0 {
+		t.Errorf("after CC, chat messages are %q (%v)", chatText(left), err)
+	}
+}
+
+func testEmptyState(t *testing.T, s mapservice.StorageBackend) {
+	restored := roundTrip(t, s, mapservice.NewGameState())
+	if len(restored.MapObjects()) != 0 || len(restored.Images) != 0 || len(restored.ChatHistory) != 0 {
+		t.Errorf("empty game state came back with %d objects, %d images, and %d chat messages",
+			len(restored.MapObjects()), len(restored.Images), len(restored.ChatHistory))
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
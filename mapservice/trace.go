@@ -0,0 +1,146 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                  Request tracing                                   //
+//                                                                                    //
+// Tagging each message a client sends us with a trace ID which appears in the log    //
+// messages and error replies we generate while handling it, so the lines about one   //
+// message can be picked out from those about everything else going on at the same    //
+// time.                                                                              //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+var lastTraceID uint64
+
+//
+// NewTraceID makes up a new ID for the messages we log (and the
+// errors we report) while reading and handling one message from a
+// client, so that when several clients are busy at once, the lines
+// about each message can be picked out of the log afterward.
+//
+func NewTraceID() string {
+	return fmt.Sprintf("#%x", atomic.AddUint64(&lastTraceID, 1))
+}
+
+//
+// The trace ID of the message the client is sending us or we are
+// handling for it, if any.
+//
+func (c *MapClient) traceID() string {
+	id, _ := c.trace.Load().(string)
+	return id
+}
+
+func (c *MapClient) setTrace(id string) {
+	c.trace.Store(id)
+}
+
+//
+// Start tracing the next message from the client, and return its
+// trace ID.
+//
+func (c *MapClient) beginTrace() string {
+	id := NewTraceID()
+	c.setTrace(id)
+	return id
+}
+
+//
+// Trace what we do for the client under the given trace ID (or a new
+// one if it is empty) until the returned function is called, which
+// puts back the client's previous trace ID. This lets a message held
+// up for a while (such as one sent out of turn) still be traced under
+// the ID it had when it arrived.
+//
+func (c *MapClient) traceAs(id string) func() {
+	if id == "" {
+		id = NewTraceID()
+	}
+	previous := c.traceID()
+	c.setTrace(id)
+	return func() { c.setTrace(previous) }
+}
+
+//
+// How we identify the client in the log: its address, followed by
+// the trace ID of the message we're dealing with, if any.
+//
+func (c *MapClient) logTag() string {
+	if id := c.traceID(); id != "" {
+		return c.ClientAddr + " " + id
+	}
+	return c.ClientAddr
+}
+
+//
+// Tell the client something went wrong with what it asked us to do,
+// including the trace ID so the reason can be found in the server's
+// log.
+//
+func (c *MapClient) sendError(format string, args ...interface{}) {
+	message := "ERROR: " + fmt.Sprintf(format, args...)
+	if id := c.traceID(); id != "" {
+		message += " (trace " + id + ")"
+	}
+	c.Send("TO", c.Username(), c.Username(), message, NextMessageID())
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,151 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                    Transactions                                    //
+//                                                                                    //
+// Making several changes to the database as one transaction, which is rolled back if //
+// any of them fails, and tried again from the start if the database was too busy     //
+// with someone else's changes to take ours.                                          //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+//
+// When the database is busy, we try a transaction again up to
+// TransactionRetries more times, waiting TransactionRetryDelay before
+// the first retry and twice as long before each one after that.
+//
+const TransactionRetries = 5
+const TransactionRetryDelay = 10 * time.Millisecond
+
+//
+// If set (which only the tests do), transactionFault is called before
+// each transaction is committed. If it returns an error, the
+// transaction fails with that error as though the database had
+// reported it, so we can see how we cope with a busy or broken
+// database.
+//
+var transactionFault func() error
+
+//
+// Run fn in a transaction, which is committed if fn returns nil and
+// rolled back if it returns an error. If the database was too busy to
+// carry it out, the whole thing (including fn) is tried again, so fn
+// must start over from scratch each time it is called. Errors which
+// fn wraps with %w are recognized as the database being busy.
+//
+func withTransaction(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	delay := TransactionRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := tryTransaction(db, fn)
+		if err == nil || !isBusy(err) || attempt >= TransactionRetries {
+			return err
+		}
+		log.Printf("Database busy (%v); trying the transaction again in %v", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func tryTransaction(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %w", err)
+	}
+	if err = fn(tx); err == nil && transactionFault != nil {
+		err = transactionFault()
+	}
+	if err != nil {
+		if rberr := tx.Rollback(); rberr != nil {
+			return fmt.Errorf("%w; further, failed to roll back the transaction (%v)", err, rberr)
+		}
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit transaction: %w", err)
+	}
+	return nil
+}
+
+//
+// Does the error mean our transaction lost out to someone else's and
+// should be tried again? For sqlite, that's SQLITE_BUSY or
+// SQLITE_LOCKED; for databases which report an SQLSTATE, it's a
+// serialization failure (40001) or deadlock (40P01).
+//
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		state := stateErr.SQLState()
+		return state == "40001" || state == "40P01"
+	}
+	return false
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
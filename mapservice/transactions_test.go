@@ -0,0 +1,204 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for database transactions
+//
+
+package mapservice
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var errBusy = sqlite3.Error{Code: sqlite3.ErrBusy}
+
+//
+// Make the next transactions fail with the given errors, one per
+// commit, and count how many commits are tried.
+//
+func injectTransactionFaults(t *testing.T, faults ...error) *int {
+	tries := 0
+	transactionFault = func() error {
+		tries++
+		if len(faults) == 0 {
+			return nil
+		}
+		err := faults[0]
+		faults = faults[1:]
+		return err
+	}
+	t.Cleanup(func() { transactionFault = nil })
+	return &tries
+}
+
+func TestTransactionRetries(t *testing.T) {
+	storage, err := OpenStorageBackend("sqlite", filepath.Join(t.TempDir(), "retry.db"))
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	defer storage.Close()
+	ms := MapService{Storage: storage, State: NewGameState()}
+	ms.State.SetImageLocation("goblin", "1.0", "abc123")
+
+	tries := injectTransactionFaults(t, errBusy, errBusy)
+	if err = ms.SaveState(); err != nil {
+		t.Fatalf("busy database wasn't retried: %v", err)
+	}
+	if *tries != 3 {
+		t.Errorf("saved after %d tries, expected 3", *tries)
+	}
+
+	ms.State.SetImageLocation("orc", "1.0", "def456")
+	faults := make([]error, TransactionRetries+1)
+	for i := range faults {
+		faults[i] = errBusy
+	}
+	tries = injectTransactionFaults(t, faults...)
+	if err = ms.SaveState(); err == nil {
+		t.Errorf("saved to a database which was always busy")
+	}
+	if *tries != TransactionRetries+1 {
+		t.Errorf("gave up after %d tries, expected %d", *tries, TransactionRetries+1)
+	}
+
+	tries = injectTransactionFaults(t, errors.New("disk I/O error"))
+	if err = ms.SaveState(); err == nil {
+		t.Errorf("save succeeded in spite of an error")
+	}
+	if *tries != 1 {
+		t.Errorf("error which wasn't about being busy was tried %d times", *tries)
+	}
+
+	transactionFault = nil
+	restored := MapService{Storage: storage}
+	if err = restored.LoadState(); err != nil {
+		t.Fatalf("unable to load state: %v", err)
+	}
+	if len(restored.State.Images) != 1 {
+		t.Errorf("failed saves weren't rolled back: %v", restored.State.Images)
+	}
+}
+
+func TestTransactionContention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "busy.db")
+	storage, err := OpenStorageBackend("sqlite", path)
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	storage.Close()
+
+	// without a busy timeout, sqlite reports SQLITE_BUSY right away
+	// instead of waiting for the lock itself
+	impatient, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=0")
+	if err != nil {
+		t.Fatalf("unable to open database: %v", err)
+	}
+	defer impatient.Close()
+	other, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		t.Fatalf("unable to open database: %v", err)
+	}
+	defer other.Close()
+
+	tx, err := other.Begin()
+	if err != nil {
+		t.Fatalf("unable to start competing transaction: %v", err)
+	}
+	if _, err = tx.Exec(`insert into users (username) values ('someone else')`); err != nil {
+		t.Fatalf("unable to lock database: %v", err)
+	}
+	go func() {
+		time.Sleep(5 * TransactionRetryDelay)
+		tx.Commit()
+	}()
+
+	if err = UpdateDicePresets(impatient, "alice", []DicePreset{{Name: "a", Description: "b", RollSpec: "d20"}}); err != nil {
+		t.Fatalf("unable to save presets while the database was busy: %v", err)
+	}
+	presets, err := LoadDicePresets(impatient)
+	if err != nil || len(presets["alice"]) != 1 {
+		t.Errorf("presets not saved (%v): %v", err, presets)
+	}
+}
+
+func TestIsBusy(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		busy bool
+	}{
+		{errBusy, true},
+		{sqlite3.Error{Code: sqlite3.ErrLocked}, true},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint}, false},
+		{sqlStateError("40001"), true},
+		{sqlStateError("40P01"), true},
+		{sqlStateError("23505"), false},
+		{errors.New("busy"), false},
+	} {
+		if busy := isBusy(c.err); busy != c.busy {
+			t.Errorf("isBusy(%v) = %v", c.err, busy)
+		}
+	}
+}
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "SQLSTATE " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
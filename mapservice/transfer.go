@@ -0,0 +1,448 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                Multi-part transfers                                //
+//                                                                                    //
+// Helpers for sending and receiving large data sets as a checksummed series of chunk //
+// messages, with retransmission requests when something goes wrong.                  //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Several parts of the protocol send a large block of data as a
+// series of messages: a message which begins the transfer, any
+// number of "chunk" messages (named with a trailing colon), and
+// a final message (named with a trailing period) which gives the
+// number of chunks sent and the SHA-256 checksum of their contents:
+//
+//   LS            AI <name> <zoom>       CONN         DD=
+//   LS: <data>    AI: <data>             CONN: ...    DD: ...
+//   LS. <n> <cks> AI. <n> <cks>          CONN. <n> <cks>  DD. <n> <cks>
+//
+// Each chunk contributes its value to the checksum if it has only
+// one field, or the Tcl list of all of its fields if it has more.
+//
+// Clients may optionally give each incoming chunk a sequence number
+// after its data (counting from 0), which lets us notice a gap as
+// soon as it happens. If we detect a gap, a miscount, or a checksum
+// mismatch, we send the client
+//
+//   NAK <type> <seq>
+//
+// asking it to resend the chunks from <seq> onward, followed by the
+// final message again. Clients which don't number their chunks will
+// always be asked to start over from 0, which they may do by sending
+// the chunks again, or by starting a whole new transfer.
+//
+// Likewise, a client may send us a NAK for CAPS, CONN or DD to have us
+// send that data set again, or for any lines we sent it which it missed,
+// if it asked us to number them (see replayBuffer).
+//
+
+//
+// How many times we will ask a client to retransmit part of a transfer
+// before giving up on it entirely.
+//
+const MaxTransferRetries = 3
+
+//
+// Unless configured otherwise, a transfer from a client which has
+// gone this long without another chunk is abandoned.
+//
+const DefaultTransferTimeout = 2 * time.Minute
+
+//
+// incomingTransfer holds the chunks of a multi-part transfer while we
+// are receiving it from a client.
+//
+type incomingTransfer struct {
+	Type     string    // base message type (e.g., "LS")
+	Header   *MapEvent // the message which started the transfer
+	Chunks   []string  // the data received so far
+	size     int64     // total bytes in Chunks (counted against the client's memory limit)
+	retries  int       // number of NAKs sent for this transfer
+	nakSent  bool      // waiting for chunks to be resent
+	overflow bool      // too big to hold; the rest of it is ignored
+	lastSeen time.Time // when we last received any of it
+}
+
+//
+// The data a chunk contributes to the transfer checksum.
+//
+func transferChecksumData(values []string) (string, error) {
+	if len(values) == 1 {
+		return values[0], nil
+	}
+	return PackageValues(values...)
+}
+
+//
+// Called when a client starts a new multi-part transfer. Any transfer
+// already in progress is abandoned.
+//
+func (c *MapClient) beginTransfer(event *MapEvent) {
+	if c.incoming != nil {
+		log.Printf("[client %s] WARNING: %s command received before previous %s transfer completed!",
+			c.logTag(), event.Fields[0], c.incoming.Type)
+		log.Printf("[client %s] WARNING: Abandoning %d element%s previously received!",
+			c.logTag(), len(c.incoming.Chunks), plural(len(c.incoming.Chunks)))
+		c.dropTransfer()
+	}
+	c.incoming = &incomingTransfer{
+		Type:     event.Fields[0],
+		Header:   event,
+		lastSeen: time.Now(),
+	}
+}
+
+//
+// The time limit in effect for a stalled transfer from this client,
+// or 0 if there is none.
+//
+func (c *MapClient) transferTimeout() time.Duration {
+	if c.Service == nil || c.Service.TransferTimeout == 0 {
+		return DefaultTransferTimeout
+	}
+	if c.Service.TransferTimeout < 0 {
+		return 0
+	}
+	return c.Service.TransferTimeout
+}
+
+//
+// When the transfer in progress (if any) will be abandoned unless
+// we hear more of it. Returns false if there's no such deadline.
+//
+func (c *MapClient) transferDeadline() (time.Time, bool) {
+	timeout := c.transferTimeout()
+	if c.incoming == nil || timeout == 0 {
+		return time.Time{}, false
+	}
+	return c.incoming.lastSeen.Add(timeout), true
+}
+
+//
+// If the client has let the transfer in progress stall past its
+// deadline, give up on it, freeing what we'd received so far, and
+// tell the client. Returns true if it was abandoned.
+//
+func (c *MapClient) abandonStalledTransfer(now time.Time) bool {
+	deadline, ok := c.transferDeadline()
+	if !ok || now.Before(deadline) {
+		return false
+	}
+	t := c.incoming
+	log.Printf("[client %s] ERROR: %s transfer stalled after %d chunk%s; abandoning it",
+		c.logTag(), t.Type, len(t.Chunks), plural(len(t.Chunks)))
+	c.sendError("your %s data was abandoned after %v without any more of it arriving", t.Type, c.transferTimeout())
+	if c.Service != nil {
+		c.Service.metrics.countAbandonedTransfer()
+	}
+	c.dropTransfer()
+	return true
+}
+
+//
+// Find the transfer in progress which a chunk or final message belongs
+// to, or nil if it doesn't belong to any.
+//
+func (c *MapClient) currentTransfer(event *MapEvent) *incomingTransfer {
+	msgType := event.Fields[0][:len(event.Fields[0])-1]
+	if c.incoming == nil {
+		log.Printf("[client %s] WARNING: %s command received before %s command (ignored)", c.logTag(), event.Fields[0], msgType)
+		return nil
+	}
+	if c.incoming.Type != msgType {
+		log.Printf("[client %s] WARNING: %s command received during %s command set (ignored)", c.logTag(), event.Fields[0], c.incoming.Type)
+		return nil
+	}
+	return c.incoming
+}
+
+//
+// Forget about the transfer in progress, giving back the memory
+// its chunks took up.
+//
+func (c *MapClient) dropTransfer() {
+	if c.incoming != nil {
+		c.memory.release(0, c.incoming.size)
+		c.incoming = nil
+	}
+}
+
+//
+// Throw away chunks from position n onward of a transfer in progress.
+//
+func (c *MapClient) truncateTransfer(t *incomingTransfer, n int) {
+	var size int64
+	for _, chunk := range t.Chunks[n:] {
+		size += int64(len(chunk))
+	}
+	c.memory.release(0, size)
+	t.size -= size
+	t.Chunks = t.Chunks[:n]
+}
+
+//
+// Called for each chunk of data (<type>: <data> [<seq>]) received from
+// the client.
+//
+func (c *MapClient) transferChunk(event *MapEvent) {
+	t := c.currentTransfer(event)
+	if t == nil || t.overflow {
+		return
+	}
+	var data string
+	if len(event.Fields) > 1 {
+		data = event.Fields[1]
+	}
+	if len(event.Fields) > 2 && event.Fields[2] != "" {
+		seq, err := strconv.Atoi(event.Fields[2])
+		if err != nil || seq < 0 {
+			log.Printf("[client %s] ERROR: %s command sequence number %q not understood", c.logTag(), event.Fields[0], event.Fields[2])
+			c.nakTransfer(len(t.Chunks), "bad sequence number")
+			return
+		}
+		if seq > len(t.Chunks) {
+			if !t.nakSent {
+				c.nakTransfer(len(t.Chunks), fmt.Sprintf("expected chunk %d but got %d", len(t.Chunks), seq))
+			}
+			return
+		}
+		// a resent chunk replaces whatever we had from that point on
+		c.truncateTransfer(t, seq)
+	} else if t.nakSent {
+		// without sequence numbers, we can only accept a fresh start
+		c.truncateTransfer(t, 0)
+	}
+	t.nakSent = false
+	t.lastSeen = time.Now()
+	if !c.memory.reserve(0, int64(len(data)), c.memoryLimit()) {
+		// Don't hold any more of this; we'll ignore the rest of it
+		// and refuse it when it's finished.
+		c.memoryExceeded(fmt.Sprintf("%s data of more than %d bytes", t.Type, t.size+int64(len(data))))
+		c.truncateTransfer(t, 0)
+		t.overflow = true
+		return
+	}
+	t.size += int64(len(data))
+	t.Chunks = append(t.Chunks, data)
+}
+
+//
+// Called when the final message of a transfer (<type>. <count> [<checksum>])
+// is received. If everything checks out, the completed transfer is
+// returned. Otherwise we ask the client to resend what we need and
+// return nil.
+//
+func (c *MapClient) finishTransfer(event *MapEvent) *incomingTransfer {
+	t := c.currentTransfer(event)
+	if t == nil {
+		return nil
+	}
+	if t.overflow {
+		log.Printf("[client %s] ERROR: %s data too large to accept (sequence not accepted)", c.logTag(), t.Type)
+		c.sendError("your %s data was not accepted: it was too large for the server to hold", t.Type)
+		c.dropTransfer()
+		return nil
+	}
+	expected_count, err := strconv.Atoi(event.Fields[1])
+	if err != nil {
+		log.Printf("[client %s] ERROR: %s command count value couldn't be parsed: %v (%s sequence not accepted)", c.logTag(), event.Fields[0], err, t.Type)
+		c.dropTransfer()
+		return nil
+	}
+	if len(t.Chunks) != expected_count {
+		log.Printf("[client %s] ERROR: %s command count value %d doesn't match expected count %d", c.logTag(), event.Fields[0], len(t.Chunks), expected_count)
+		from := len(t.Chunks)
+		if from > expected_count {
+			from = 0
+		}
+		c.nakTransfer(from, "chunk count mismatch")
+		return nil
+	}
+
+	if len(event.Fields) < 3 || event.Fields[2] == "" {
+		log.Printf("[client %s] WARNING: %s command without checksum (won't validate)", c.logTag(), event.Fields[0])
+	} else {
+		expected_checksum, err := base64.StdEncoding.DecodeString(event.Fields[2])
+		if err != nil {
+			log.Printf("[client %s] ERROR: %s command checksum value couldn't be parsed: %v (%s sequence not accepted)", c.logTag(), event.Fields[0], err, t.Type)
+			c.dropTransfer()
+			return nil
+		}
+		cksum := sha256.New()
+		for _, x := range t.Chunks {
+			cksum.Write([]byte(x))
+		}
+		if !bytesEqual(expected_checksum, cksum.Sum(nil)) {
+			log.Printf("[client %s] ERROR: %s command checksum mismatch", c.logTag(), event.Fields[0])
+			log.Printf("[client %s] calculated: %v", c.logTag(), cksum.Sum(nil))
+			log.Printf("[client %s] expected:   %v", c.logTag(), expected_checksum)
+			c.nakTransfer(0, "checksum mismatch")
+			return nil
+		}
+	}
+	c.dropTransfer()
+	return t
+}
+
+//
+// Ask the client to resend the current transfer from chunk <from>
+// onward, unless we've already asked too many times, in which case
+// we give up on it.
+//
+func (c *MapClient) nakTransfer(from int, reason string) {
+	t := c.incoming
+	if t.retries >= MaxTransferRetries {
+		log.Printf("[client %s] ERROR: %s transfer failed (%s) after %d retransmission request%s; sequence not accepted",
+			c.logTag(), t.Type, reason, t.retries, plural(t.retries))
+		c.sendError("%s data could not be received correctly (%s)", t.Type, reason)
+		c.dropTransfer()
+		return
+	}
+	t.retries++
+	t.nakSent = true
+	log.Printf("[client %s] %s transfer %s; requesting retransmission from chunk %d", c.logTag(), t.Type, reason, from)
+	c.Send("NAK", t.Type, strconv.Itoa(from))
+}
+
+//
+// outgoingTransfer sends a multi-part transfer to a client, keeping
+// track of the count and checksum to send at the end.
+//
+type outgoingTransfer struct {
+	client *MapClient
+	base   string
+	cksum  hash.Hash
+	count  int
+}
+
+//
+// Start sending a multi-part transfer to a client. The begin message
+// is sent as given; chunks and the final message are named by adding
+// ":" and "." to base.
+//
+func (c *MapClient) startTransfer(base string, begin ...string) *outgoingTransfer {
+	c.Send(begin...)
+	return &outgoingTransfer{
+		client: c,
+		base:   base,
+		cksum:  sha256.New(),
+	}
+}
+
+//
+// Send the next chunk of data.
+//
+func (t *outgoingTransfer) Send(values ...string) {
+	t.client.Send(append([]string{t.base + ":"}, values...)...)
+	ckval, err := transferChecksumData(values)
+	if err != nil {
+		log.Printf("[client %s] WARNING: Unable to calculate checksum for line %d of %s data: %v", t.client.logTag(), t.count, t.base, err)
+		// we will continue to complete the operation in this case, however.
+	} else {
+		t.cksum.Write([]byte(ckval))
+	}
+	t.count++
+}
+
+//
+// Finish the transfer by sending the count and checksum.
+//
+func (t *outgoingTransfer) Finish() {
+	t.client.Send(t.base+".", strconv.Itoa(t.count), base64.StdEncoding.EncodeToString(t.cksum.Sum(nil)))
+}
+
+//
+// NAK <type> <seq>
+// NAK SEQ <from> [<to>]
+//
+// The client didn't get a good copy of a data set we sent, or missed
+// some of the lines we numbered for it (see replayBuffer), and would
+// like them again.
+//
+func handleRetransmitRequest(ms *MapService, event *MapEvent, thisClient *MapClient) bool {
+	switch strings.ToUpper(event.Fields[1]) {
+		case "CAPS":
+			ms.sendCapabilities(thisClient)
+		case "CONN":
+			thisClient.ConnResponse()
+		case "DD":
+			if thisClient.Authenticated && thisClient.Auth != nil {
+				ms.SendMyPresets(thisClient, thisClient.Username())
+			}
+		case "SEQ":
+			thisClient.resendRequested(event.Fields[2:])
+		default:
+			log.Printf("[client %s] NAK for %s data cannot be honored", thisClient.logTag(), event.Fields[1])
+			thisClient.sendError("%s data cannot be resent by the server", event.Fields[1])
+	}
+	return false
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,207 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for multi-part transfers
+//
+
+package mapservice
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func transferTestChecksum(chunks ...string) string {
+	cksum := sha256.Sum256([]byte(strings.Join(chunks, "")))
+	return base64.StdEncoding.EncodeToString(cksum[:])
+}
+
+func TestTransfer_Incoming(t *testing.T) {
+	ms := newTestService()
+	c := newTestClient(ms, "client", "alice", false)
+	cks := transferTestChecksum("a", "b", "c")
+
+	// clean transfer
+	c.beginTransfer(testEvent(t, "AI test 1"))
+	for _, chunk := range []string{"AI: a", "AI: b", "AI: c"} {
+		c.transferChunk(testEvent(t, chunk))
+	}
+	if tr := c.finishTransfer(testEvent(t, "AI. 3 "+cks)); tr == nil || strings.Join(tr.Chunks, ",") != "a,b,c" || tr.Header.Fields[1] != "test" {
+		t.Errorf("transfer failed: %v", tr)
+	}
+	if c.incoming != nil {
+		t.Errorf("transfer still in progress after completion")
+	}
+
+	// gap in sequence numbers, then resend
+	c.beginTransfer(testEvent(t, "AI test 1"))
+	c.transferChunk(testEvent(t, "AI: a 0"))
+	c.transferChunk(testEvent(t, "AI: c 2"))
+	if sent := sentToTestClient(c); len(sent) != 1 || sent[0] != "NAK AI 1" {
+		t.Errorf("after gap, client was sent %v", sent)
+	}
+	c.transferChunk(testEvent(t, "AI: b 1"))
+	c.transferChunk(testEvent(t, "AI: c 2"))
+	if tr := c.finishTransfer(testEvent(t, "AI. 3 "+cks)); tr == nil || strings.Join(tr.Chunks, ",") != "a,b,c" {
+		t.Errorf("resent transfer failed: %v", tr)
+	}
+
+	// checksum mismatch without sequence numbers
+	c.beginTransfer(testEvent(t, "LS"))
+	c.transferChunk(testEvent(t, "LS: a"))
+	c.transferChunk(testEvent(t, "LS: x"))
+	c.transferChunk(testEvent(t, "LS: c"))
+	if tr := c.finishTransfer(testEvent(t, "LS. 3 "+cks)); tr != nil {
+		t.Errorf("transfer with bad checksum was accepted")
+	}
+	if sent := sentToTestClient(c); len(sent) != 1 || sent[0] != "NAK LS 0" {
+		t.Errorf("after mismatch, client was sent %v", sent)
+	}
+	for _, chunk := range []string{"LS: a", "LS: b", "LS: c"} {
+		c.transferChunk(testEvent(t, chunk))
+	}
+	if tr := c.finishTransfer(testEvent(t, "LS. 3 "+cks)); tr == nil || strings.Join(tr.Chunks, ",") != "a,b,c" {
+		t.Errorf("restarted transfer failed: %v", tr)
+	}
+
+	// give up eventually
+	c.beginTransfer(testEvent(t, "LS"))
+	for i := 0; i <= MaxTransferRetries; i++ {
+		c.transferChunk(testEvent(t, "LS: x"))
+		if tr := c.finishTransfer(testEvent(t, "LS. 1 "+cks)); tr != nil {
+			t.Errorf("transfer with bad checksum was accepted")
+		}
+	}
+	sent := sentToTestClient(c)
+	if len(sent) != MaxTransferRetries+1 || !strings.HasPrefix(sent[MaxTransferRetries], "TO alice alice {ERROR: LS data") {
+		t.Errorf("after too many retries, client was sent %v", sent)
+	}
+	if c.incoming != nil {
+		t.Errorf("transfer still in progress after giving up")
+	}
+}
+
+func TestTransfer_Outgoing(t *testing.T) {
+	ms := newTestService()
+	c := newTestClient(ms, "client", "alice", false)
+
+	tr := c.startTransfer("AI", "AI", "test", "1")
+	tr.Send("a")
+	tr.Send("b c")
+	tr.Send("1", "b c")
+	tr.Finish()
+	sent := sentToTestClient(c)
+	expected := []string{"AI test 1", "AI: a", "AI: {b c}", "AI: 1 {b c}", "AI. 3 " + transferTestChecksum("a", "b c", "1 {b c}")}
+	if strings.Join(sent, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("sent %q; expected %q", sent, expected)
+	}
+}
+
+func TestTransfer_Stalled(t *testing.T) {
+	ms := newTestService()
+	ms.TransferTimeout = 50 * time.Millisecond
+	server, client := net.Pipe()
+	defer client.Close()
+	c := newTestClient(ms, "client", "alice", false)
+	c.Connection = server
+	c.Reader = bufio.NewReader(server)
+
+	next := func() *MapEvent {
+		t.Helper()
+		event, err := c.NextEvent()
+		if err != nil {
+			t.Fatalf("NextEvent failed: %v", err)
+		}
+		return event
+	}
+	go io.WriteString(client, "LS\nLS: a\n")
+	c.beginTransfer(next())
+	c.transferChunk(next())
+	if c.MemoryUsage() != ReadBufferSize+1 {
+		t.Errorf("usage was %d during transfer", c.MemoryUsage())
+	}
+
+	// The client stalls partway through a line; when it picks up
+	// again, we've given up on the transfer but not on the line.
+	go func() {
+		io.WriteString(client, "PO")
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(client, "LO\n")
+	}()
+	if event := next(); event.EventType() != "POLO" {
+		t.Errorf("next event was %v", event.Fields)
+	}
+	if c.incoming != nil || c.MemoryUsage() != ReadBufferSize || ms.AbandonedTransfers() != 1 {
+		t.Errorf("transfer not abandoned (%d bytes held, %d abandoned)", c.MemoryUsage(), ms.AbandonedTransfers())
+	}
+	if sent := sentToTestClient(c); len(sent) != 1 || !strings.Contains(sent[0], "ERROR: your LS data was abandoned") {
+		t.Errorf("client was sent %v", sent)
+	}
+
+	// without a transfer in progress, there's no time limit
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(client, "POLO\n")
+	}()
+	if event := next(); event.EventType() != "POLO" || ms.AbandonedTransfers() != 1 {
+		t.Errorf("next event was %v", event.Fields)
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,283 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                                     Turn Order                                     //
+//                                                                                    //
+// While combat mode is on, the server may hold players to the initiative order, so   //
+// that moves and die rolls made out of turn are held until the player's turn or      //
+// politely refused.                                                                  //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package mapservice
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+//
+// How strictly the server holds players to the initiative order while
+// combat mode is on. With TurnsHold, out-of-turn moves and die rolls are
+// kept until the player's turn comes up; with TurnsReject, they are
+// refused. Either way, the player is told why.
+//
+const (
+	TurnsFree   = ""
+	TurnsHold   = "hold"
+	TurnsReject = "reject"
+)
+
+//
+// MaxHeldMessages is the most out-of-turn messages we'll hold for any
+// one player. Any more than that are rejected.
+//
+const MaxHeldMessages = 20
+
+//
+// CheckTurnEnforcement makes sure a turn enforcement mode is one we
+// know about. "off" is the same as TurnsFree.
+//
+func CheckTurnEnforcement(mode string) (string, error) {
+	switch mode {
+		case "off", TurnsFree:
+			return TurnsFree, nil
+		case TurnsHold, TurnsReject:
+			return mode, nil
+	}
+	return "", fmt.Errorf("Turn enforcement mode \"%s\" not understood; must be off, %s, or %s", mode, TurnsHold, TurnsReject)
+}
+
+//
+// Is the given message a move or die roll which should wait for
+// the player's turn?
+//
+func isTurnAction(event *MapEvent) bool {
+	switch event.EventType() {
+		case "D", "DB", "OR":
+			return true
+		case "OA":
+			attrs, err := ParseTclList(event.Fields[2])
+			if err != nil {
+				return false
+			}
+			for i := 0; i < len(attrs); i += 2 {
+				if attrs[i] == "GX" || attrs[i] == "GY" {
+					return true
+				}
+			}
+	}
+	return false
+}
+
+//
+// CombatActive reports whether combat mode is on.
+//
+func (gs *GameState) CombatActive() bool {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	ev, ok := gs.EventHistory["CO"]
+	if !ok || len(ev.Fields) < 2 {
+		return false
+	}
+	switch strings.ToLower(ev.Fields[1]) {
+		case "1", "on", "true", "yes":
+			return true
+	}
+	return false
+}
+
+//
+// IsTurnOf reports whether the creature whose turn it is (according to
+// the last I message) is played by the given user. A creature is played
+// by a user if its PLAYER attribute names them, or if it has no PLAYER
+// attribute and its name is the same as their username.
+//
+func (gs *GameState) IsTurnOf(user string) bool {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	ev, ok := gs.EventHistory["I"]
+	if !ok || len(ev.Fields) < 3 {
+		return false
+	}
+	obj := gs.creature(ev.Fields[2])
+	return obj != nil && obj.playedBy(user)
+}
+
+//
+// Find a creature by ID or name. The caller must hold the lock.
+//
+func (gs *GameState) creature(ref string) *MapObject {
+	if obj, ok := gs.Objects[ref]; ok {
+		return obj
+	}
+	if id, ok := gs.IdByName[strip_creature_base_name(ref)]; ok {
+		return gs.Objects[id]
+	}
+	return nil
+}
+
+//
+// Is this creature played by the given user?
+//
+func (o *MapObject) playedBy(user string) bool {
+	if player, ok := o.Attrs["PLAYER"]; ok {
+		return strings.EqualFold(player, user)
+	}
+	return strings.EqualFold(o.Attrs["NAME"], user)
+}
+
+//
+// A message held until its sender's turn.
+//
+type heldMessage struct {
+	client *MapClient
+	event  *MapEvent
+	trace  string // trace ID the message arrived under
+}
+
+//
+// heldMessageQueue keeps the out-of-turn messages for each user.
+//
+type heldMessageQueue struct {
+	lock   sync.Mutex
+	byUser map[string][]heldMessage
+}
+
+//
+// Hold a message for later. Returns false if too many are held already.
+//
+func (q *heldMessageQueue) hold(user string, msg heldMessage) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.byUser == nil {
+		q.byUser = make(map[string][]heldMessage)
+	}
+	if len(q.byUser[user]) >= MaxHeldMessages {
+		return false
+	}
+	q.byUser[user] = append(q.byUser[user], msg)
+	return true
+}
+
+//
+// Remove and return the held messages for any users for whom
+// ready returns true.
+//
+func (q *heldMessageQueue) release(ready func(string) bool) []heldMessage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var released []heldMessage
+	for user, held := range q.byUser {
+		if ready(user) {
+			released = append(released, held...)
+			delete(q.byUser, user)
+		}
+	}
+	return released
+}
+
+//
+// Check if a client's message may be acted upon now, given the turn
+// order. If not, it is held or rejected according to the server's
+// TurnEnforcement setting, the client is told, and we return false.
+//
+func (ms *MapService) checkTurn(event *MapEvent, thisClient *MapClient) bool {
+	if ms.TurnEnforcement == TurnsFree || thisClient.IsGM() || !isTurnAction(event) {
+		return true
+	}
+	if !ms.State.CombatActive() || ms.State.IsTurnOf(thisClient.Username()) {
+		return true
+	}
+	if ms.TurnEnforcement == TurnsHold && ms.heldMessages.hold(thisClient.Username(), heldMessage{client: thisClient, event: event, trace: thisClient.traceID()}) {
+		log.Printf("[client %s] holding out-of-turn %s until %s's turn", thisClient.logTag(), event.EventType(), thisClient.Username())
+		thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
+			"It isn't your turn yet; this will go through when your turn comes up.",
+			NextMessageID())
+		return false
+	}
+	log.Printf("[client %s] rejected out-of-turn %s from %s", thisClient.logTag(), event.EventType(), thisClient.Username())
+	thisClient.Send("TO", thisClient.Username(), thisClient.Username(),
+		"Sorry, it isn't your turn yet. Please wait until your turn comes up and try again.",
+		NextMessageID())
+	return false
+}
+
+//
+// Now that the turn has changed (or combat is over), act on any held
+// messages whose senders may now go ahead. This happens on the GM's
+// goroutine, so we wait until the sender isn't in the middle of acting
+// on a message of their own; handlers use the client's die roller,
+// preferences and so on without locking them.
+//
+func (ms *MapService) releaseHeldMessages() {
+	combat := ms.State.CombatActive()
+	for _, held := range ms.heldMessages.release(func(user string) bool {
+		return !combat || ms.State.IsTurnOf(user)
+	}) {
+		if _, connected := ms.Clients.Get(held.client.ClientAddr); connected {
+			held.client.handling.Lock()
+			restore := held.client.traceAs(held.trace)
+			ms.ExecuteAction(held.event, held.client)
+			restore()
+			held.client.handling.Unlock()
+		}
+	}
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
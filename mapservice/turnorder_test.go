@@ -0,0 +1,168 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+
+//
+// Unit tests for turn order enforcement
+//
+
+package mapservice
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTurnOrder(t *testing.T) {
+	gs := NewGameState()
+	recordTestEvents(t, gs,
+		"PS 1 red Grax 1 M monster 3 4 0",
+		"PS 2 blue Alice 1 M player 5 6 0",
+		"PS 3 green Fizban 1 M player 7 8 0",
+		"OA 3 {PLAYER bob}",
+	)
+	if gs.CombatActive() {
+		t.Errorf("combat active before CO")
+	}
+	recordTestEvents(t, gs, "CO 1", "I {1 0 0} 2")
+	if !gs.CombatActive() || !gs.IsTurnOf("alice") || gs.IsTurnOf("bob") {
+		t.Errorf("turn of Alice by ID not recognized")
+	}
+	recordTestEvents(t, gs, "I {1 1 0} Fizban")
+	if !gs.IsTurnOf("bob") || gs.IsTurnOf("fizban") || gs.IsTurnOf("alice") {
+		t.Errorf("turn of bob's creature by name not recognized")
+	}
+	recordTestEvents(t, gs, "CO 0")
+	if gs.CombatActive() {
+		t.Errorf("combat still active after CO 0")
+	}
+
+	for i, raw := range []string{"D * d20", "OA 2 {GX 3 GY 4}", "OR x y d20"} {
+		if !isTurnAction(testEvent(t, raw)) {
+			t.Errorf("case %d: %s not considered a turn action", i, raw)
+		}
+	}
+	for i, raw := range []string{"OA 2 {HEALTH {1 2 3}}", "TO alice bob hi", "D? 1 d20"} {
+		if isTurnAction(testEvent(t, raw)) {
+			t.Errorf("case %d: %s considered a turn action", i, raw)
+		}
+	}
+
+	for _, mode := range []string{"off", "", "hold", "reject"} {
+		if _, err := CheckTurnEnforcement(mode); err != nil {
+			t.Errorf("mode %s refused: %v", mode, err)
+		}
+	}
+	if _, err := CheckTurnEnforcement("strict"); err == nil || !strings.Contains(err.Error(), "strict") {
+		t.Errorf("bad mode gave %v", err)
+	}
+}
+
+func TestHeldMessageQueue(t *testing.T) {
+	var q heldMessageQueue
+	for i := 0; i < MaxHeldMessages; i++ {
+		if !q.hold("alice", heldMessage{}) {
+			t.Fatalf("message %d not held", i)
+		}
+	}
+	if q.hold("alice", heldMessage{}) {
+		t.Errorf("more than %d messages held", MaxHeldMessages)
+	}
+	q.hold("bob", heldMessage{})
+	if released := q.release(func(u string) bool { return u == "bob" }); len(released) != 1 {
+		t.Errorf("released %d messages for bob", len(released))
+	}
+	if released := q.release(func(u string) bool { return true }); len(released) != MaxHeldMessages {
+		t.Errorf("released %d messages for alice", len(released))
+	}
+}
+
+func TestHeldMessagesWaitForSender(t *testing.T) {
+	var err error
+	ms := newTestService()
+	gm := newTestClient(ms, "gm", "GM", true)
+	alice := newTestClient(ms, "alice", "alice", false)
+	if alice.dice, err = NewDieRoller(); err != nil {
+		t.Fatalf("unable to create die roller: %v", err)
+	}
+	ms.TurnEnforcement = TurnsHold
+	for _, raw := range []string{"PS 1 red Grax 1 M monster 3 4 0", "PS 2 blue Alice 1 M player 5 6 0", "CO 1", "I {1 0 0} 1"} {
+		ms.ExecuteAction(testEvent(t, raw), gm)
+	}
+	ms.ExecuteAction(testEvent(t, "D * d20"), alice)
+	sentIgnoringTime(alice)
+
+	alice.handling.Lock()
+	turn := testEvent(t, "I {1 1 0} 2")
+	done := make(chan struct{})
+	go func() {
+		ms.ExecuteAction(turn, gm)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Errorf("held roll was acted on while alice's own message was")
+	case <-time.After(50 * time.Millisecond):
+	}
+	alice.handling.Unlock()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("held roll was never acted on")
+	}
+	if sent := sentIgnoringTime(alice); len(sent) != 2 || !strings.HasPrefix(sent[1], "ROLL alice ") {
+		t.Errorf("held roll gave %q", sent)
+	}
+}
+
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//
@@ -0,0 +1,259 @@
+// vi:set ai sm nu ts=4 sw=4 fileencoding=utf-8:
+/*
+########################################################################################
+#  _______  _______  _______                ___       _______     _______              #
+# (  ____ \(       )(  ___  )              /   )     / ___   )   / ___   )             #
+# | (    \/| () () || (   ) |             / /) |     \/   )  |   \/   )  |             #
+# | |      | || || || (___) |            / (_) (_        /   )       /   )             #
+# | | ____ | |(_)| ||  ___  |           (____   _)     _/   /      _/   /              #
+# | | \_  )| |   | || (   ) | Game           ) (      /   _/      /   _/               #
+# | (___) || )   ( || )   ( | Master's       | |   _ (   (__/\ _ (   (__/\             #
+# (_______)|/     \||/     \| Assistant      (_)  (_)\_______/(_)\_______/             #
+#                                                                                      #
+########################################################################################
+*/
+//
+////////////////////////////////////////////////////////////////////////////////////////
+//                                                                                    //
+//                              Maintenance subcommands                               //
+//                                                                                    //
+// Commands for the server operator which are run in place of the server itself, as   //
+// go-gma-server <command> [<options>].                                               //
+//                                                                                    //
+////////////////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fizban-of-ragnarok/go-gma-server/mapservice"
+)
+
+//
+// go-gma-server check-config [-init-file path] [-password-file path] [-campaign name]
+//
+// Read the server's configuration files the way the server would,
+// reporting any problems and showing what clients would be sent.
+// Returns the exit status for the program.
+//
+func checkConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	initFile := flags.String("init-file", "", "check this init file")
+	passFile := flags.String("password-file", "", "check this password file")
+	campaign := flags.String("campaign", "", "name of the campaign (substituted for {{.Campaign}} in the init file)")
+	flags.Parse(args)
+
+	if *initFile == "" && *passFile == "" {
+		fmt.Fprintf(os.Stderr, "Nothing to check: give -init-file and/or -password-file\n")
+		return 2
+	}
+
+	problems := 0
+	if *initFile != "" {
+		greeting, err := mapservice.ReadInitFile(*initFile, mapservice.NewInitFileVars(*campaign, time.Now()))
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			problems++
+		} else {
+			fmt.Printf("Init file %s: clients will be sent %d lines:\n", *initFile, len(greeting.Lines))
+			for _, line := range greeting.Lines {
+				fmt.Printf("    %s\n", line)
+			}
+			if len(greeting.PostAuth) > 0 {
+				fmt.Printf("and after they log in, %d more lines:\n", len(greeting.PostAuth))
+				for _, line := range greeting.PostAuth {
+					fmt.Printf("    %s\n", line)
+				}
+			}
+			if greeting.Sync {
+				fmt.Printf("followed by the game state (SYNC).\n")
+			}
+		}
+	}
+	if *passFile != "" {
+		passwords, err := mapservice.ReadPasswordFile(*passFile)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			problems++
+		} else {
+			for _, problem := range passwords.Problems {
+				fmt.Printf("ERROR: %s\n", problem)
+				problems++
+			}
+			users := make([]string, 0, len(passwords.PersonalPasswords))
+			for user := range passwords.PersonalPasswords {
+				users = append(users, user)
+			}
+			sort.Strings(users)
+			fmt.Printf("Password file %s: player password set: %v; GM password set: %v; personal passwords for: %s\n",
+				*passFile, len(passwords.GroupPassword) > 0, len(passwords.GmPassword) > 0, strings.Join(users, ", "))
+		}
+	}
+	if problems > 0 {
+		fmt.Printf("%d problems found.\n", problems)
+		return 1
+	}
+	fmt.Printf("No problems found.\n")
+	return 0
+}
+
+//
+// go-gma-server dice-selftest [-samples n] [-sides list] [-seed n] [-alpha p]
+//
+// Roll lots of dice and report whether they look fair.
+// Returns the exit status for the program.
+//
+func diceSelfTest(args []string) int {
+	flags := flag.NewFlagSet("dice-selftest", flag.ExitOnError)
+	samples := flags.Int("samples", 100000, "number of times to roll each die")
+	sides := flags.String("sides", "", "comma-separated list of die sizes to test (default 2,3,4,6,8,10,12,20,100)")
+	seed := flags.Int64("seed", 0, "test a generator seeded with this value instead of the live one")
+	alpha := flags.Float64("alpha", 0.001, "report dice as suspicious if their p-value is below this")
+	flags.Parse(args)
+
+	die_sizes := mapservice.DefaultSelfTestSides
+	if *sides != "" {
+		die_sizes = nil
+		for _, s := range strings.Split(*sides, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Die size %q not understood: %v\n", s, err)
+				return 2
+			}
+			die_sizes = append(die_sizes, n)
+		}
+	}
+
+	var r mapservice.RandomSource
+	if *seed != 0 {
+		r = rand.New(rand.NewSource(*seed))
+	}
+	results, err := mapservice.DiceSelfTest(die_sizes, *samples, r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Self-test failed: %v\n", err)
+		return 2
+	}
+
+	failures := 0
+	fmt.Printf("%-6s %10s %4s %12s %10s  %s\n", "DIE", "SAMPLES", "DF", "CHI-SQUARE", "P-VALUE", "RESULT")
+	for _, result := range results {
+		verdict := "ok"
+		if result.PValue < *alpha {
+			verdict = "SUSPICIOUS"
+			failures++
+		}
+		fmt.Printf("%-6s %10d %4d %12.3f %10.4f  %s\n", fmt.Sprintf("d%d", result.Sides),
+			result.Samples, result.DegreesOfFreedom, result.ChiSquare, result.PValue, verdict)
+	}
+	fmt.Printf("\nA fair die will occasionally fall below p=%g by chance (about %g%% of the time);\n", *alpha, *alpha*100)
+	fmt.Printf("if that happens, run the test again. Consistently low p-values indicate a problem.\n")
+	if failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+//
+// go-gma-server import -format foundry|roll20|uvtt [-comment text] input-file output-file
+//
+// Convert a map exported from another virtual tabletop into a GMA
+// .map file. Any images it brings with it are written next to the
+// output file. Returns the exit status for the program.
+//
+func importMap(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "format of the input file (foundry, roll20, or uvtt)")
+	comment := flags.String("comment", "", "comment for the map file header")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 || *format == "" {
+		fmt.Fprintf(os.Stderr, "usage: go-gma-server import -format foundry|roll20|uvtt [-comment text] input-file output-file\n")
+		return 2
+	}
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read map: %v\n", err)
+		return 1
+	}
+	base := filepath.Base(flags.Arg(1))
+	imported, err := mapservice.ImportMap(*format, data, strings.TrimSuffix(base, filepath.Ext(base)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if *comment == "" {
+		*comment = fmt.Sprintf("Imported from %s: %s", *format, imported.Name)
+	}
+	out, err := os.Create(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write map: %v\n", err)
+		return 1
+	}
+	if err = mapservice.WriteMapFile(out, imported.Objects, *comment, time.Now()); err != nil {
+		out.Close()
+		fmt.Fprintf(os.Stderr, "Unable to write map: %v\n", err)
+		return 1
+	}
+	if err = out.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write map: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Wrote %d objects to %s\n", len(imported.Objects), flags.Arg(1))
+	images, err := imported.SaveImages(filepath.Dir(flags.Arg(1)))
+	for _, image := range images {
+		fmt.Printf("Wrote map image to %s\n", image)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write map image: %v\n", err)
+		return 1
+	}
+	return 0
+}
+// @[00]@| GMA 4.2.2
+// @[01]@|
+// @[10]@| Copyright © 1992–2020 by Steven L. Willoughby
+// @[11]@| (AKA Software Alchemy), Aloha, Oregon, USA. All Rights Reserved.
+// @[12]@| Distributed under the terms and conditions of the BSD-3-Clause
+// @[13]@| License as described in the accompanying LICENSE file distributed
+// @[14]@| with GMA.
+// @[15]@|
+// @[20]@| Redistribution and use in source and binary forms, with or without
+// @[21]@| modification, are permitted provided that the following conditions
+// @[22]@| are met:
+// @[23]@| 1. Redistributions of source code must retain the above copyright
+// @[24]@|    notice, this list of conditions and the following disclaimer.
+// @[25]@| 2. Redistributions in binary form must reproduce the above copy-
+// @[26]@|    right notice, this list of conditions and the following dis-
+// @[27]@|    claimer in the documentation and/or other materials provided
+// @[28]@|    with the distribution.
+// @[29]@| 3. Neither the name of the copyright holder nor the names of its
+// @[30]@|    contributors may be used to endorse or promote products derived
+// @[31]@|    from this software without specific prior written permission.
+// @[32]@|
+// @[33]@| THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// @[34]@| CONTRIBUTORS “AS IS” AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// @[35]@| INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// @[36]@| MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// @[37]@| DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS
+// @[38]@| BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY,
+// @[39]@| OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// @[40]@| PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// @[41]@| PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// @[42]@| THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR
+// @[43]@| TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// @[44]@| THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// @[45]@| SUCH DAMAGE.
+// @[46]@|
+// @[50]@| This software is not intended for any use or application in which
+// @[51]@| the safety of lives or property would be at risk due to failure or
+// @[52]@| defect of the software.
+//